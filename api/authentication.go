@@ -0,0 +1,343 @@
+package api
+
+// authentication.go contains the endpoint middleware guarding mutating
+// endpoints with the bearer tokens issued on login.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/users"
+)
+
+var (
+	ErrForbidden = errors.New("Forbidden")
+	// ErrAccountDisabled is returned to disabled users giving their correct
+	// credentials
+	ErrAccountDisabled = errors.New("Account disabled")
+)
+
+type bearerKey struct{}
+
+type apiKeyHeaderKey struct{}
+
+// bearerToContext moves the bearer token of the Authorization header into
+// the context for the authentication middleware.
+func bearerToContext(ctx context.Context, r *http.Request) context.Context {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return context.WithValue(ctx, bearerKey{}, strings.TrimSpace(h[7:]))
+	}
+	return ctx
+}
+
+// apiKeyToContext moves the X-API-Key header into the context for
+// RequireAPIKey.
+func apiKeyToContext(ctx context.Context, r *http.Request) context.Context {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		return context.WithValue(ctx, apiKeyHeaderKey{}, k)
+	}
+	return ctx
+}
+
+// clientCertToContext stores the identity of a verified TLS client
+// certificate in the context.
+func clientCertToContext(ctx context.Context, r *http.Request) context.Context {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ctx
+	}
+	return auth.NewClientCertContext(ctx, auth.ClientIdentity(r.TLS.VerifiedChains[0][0]))
+}
+
+// principal names the authenticated caller for audit records: the API key,
+// the user of the token, the service of the TLS client certificate, or
+// "anonymous" when authentication is disabled.
+func principal(ctx context.Context) string {
+	if name, ok := auth.APIKeyFromContext(ctx); ok {
+		return "apikey:" + name
+	}
+	if c, ok := auth.FromContext(ctx); ok {
+		return c.UserID()
+	}
+	if id, ok := auth.ClientCertFromContext(ctx); ok {
+		return "cert:" + id
+	}
+	return "anonymous"
+}
+
+// tagPrincipal returns the principal of ctx, tagging the request's span
+// with it.
+func tagPrincipal(ctx context.Context) string {
+	p := principal(ctx)
+	tagSpan(ctx, "principal", p)
+	return p
+}
+
+// ownerFunc returns ErrForbidden when the authenticated claims may not act
+// on the target of request.
+type ownerFunc func(ctx context.Context, request interface{}, c auth.Claims) error
+
+// authenticationMiddleware requires a valid bearer token, stores its claims
+// in the context and, when role is given, requires the token to carry it.
+// When owner is given it checks the caller may act on the target of the
+// request; tokens carrying the admin role may act on any user. A nil issuer
+// disables authentication altogether.
+func authenticationMiddleware(issuer *auth.Issuer, role string, owner ownerFunc) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		if issuer == nil {
+			return next
+		}
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			token, _ := ctx.Value(bearerKey{}).(string)
+			if token == "" {
+				return nil, ErrUnauthorized
+			}
+			if err := csrfCheck(ctx); err != nil {
+				return nil, err
+			}
+			c, err := issuer.Parse(token)
+			if err != nil {
+				return nil, ErrUnauthorized
+			}
+			if role != "" && !c.HasRole(role) {
+				return nil, ErrForbidden
+			}
+			if owner != nil && !c.HasRole(auth.RoleAdmin) {
+				if err := owner(ctx, request, c); err != nil {
+					return nil, err
+				}
+			}
+			return next(auth.NewContext(ctx, c), request)
+		}
+	}
+}
+
+// RequireAPIKey returns an endpoint middleware for administrative endpoints,
+// requiring one of keys in the X-API-Key header. Bearer tokens do not count,
+// whatever their roles. The key name is stored in the context as principal.
+// Without keys every request is refused.
+func RequireAPIKey(keys *auth.APIKeys) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if keys == nil {
+				return nil, ErrUnauthorized
+			}
+			key, _ := ctx.Value(apiKeyHeaderKey{}).(string)
+			name, ok := keys.Lookup(key)
+			if !ok {
+				return nil, ErrUnauthorized
+			}
+			return next(auth.NewAPIKeyContext(ctx, name), request)
+		}
+	}
+}
+
+// requireKey returns a handler serving h only to requests carrying one of
+// keys in the X-API-Key header, or h itself when keys is nil. It guards the
+// administrative handlers outside of the endpoints.
+func requireKey(keys *auth.APIKeys, h http.Handler) http.Handler {
+	return requireScopedKey(keys, "", h)
+}
+
+// requireScopedKey is requireKey with keys granted scope only, any key
+// when scope is empty
+func requireScopedKey(keys *auth.APIKeys, scope string, h http.Handler) http.Handler {
+	if keys == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if _, ok := keys.Lookup(key); !ok {
+			encodeError(r.Context(), ErrUnauthorized, w)
+			return
+		}
+		if scope != "" {
+			if _, ok := keys.LookupScope(key, scope); !ok {
+				encodeError(r.Context(), ErrForbidden, w)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// sameUser returns an ownerFunc allowing only the user whose id is returned
+// by id. An empty id, like an address for an anonymous user, is allowed.
+func sameUser(id func(request interface{}) string) ownerFunc {
+	return func(_ context.Context, request interface{}, c auth.Claims) error {
+		if target := id(request); target != "" && target != c.UserID() {
+			return ErrForbidden
+		}
+		return nil
+	}
+}
+
+// adminDeletesCustomers is the ownerFunc of deletes: customers are deleted
+// by admins only, while the service checks a caller deleting an address or a
+// card holds it
+func adminDeletesCustomers(_ context.Context, request interface{}, _ auth.Claims) error {
+	if req, ok := request.(deleteRequest); ok && req.Entity == "customers" {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// storedRole returns an endpoint middleware re-checking against the database
+// that the caller still holds role, for endpoints where a role revoked after
+// the token was issued must take effect at once. It follows an
+// authenticationMiddleware and passes when authentication is disabled.
+func storedRole(s Service, role string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			c, ok := auth.FromContext(ctx)
+			if !ok {
+				return next(ctx, request)
+			}
+			u, err := s.GetUser(c.UserID())
+			if err != nil || !u.HasRole(role) {
+				return nil, ErrForbidden
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// ExposeCardNumbers returns an endpoint middleware for the card endpoint
+// returning full card numbers to requests asking for them with ?full=true,
+// provided the token carries the payment role. Every other response keeps
+// its masked numbers.
+func ExposeCardNumbers(issuer *auth.Issuer) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		unmasked := authenticationMiddleware(issuer, "", nil)(
+			func(ctx context.Context, request interface{}) (interface{}, error) {
+				// Checked here rather than as an ownerFunc so that the
+				// admin role does not grant access to card numbers
+				if c, _ := auth.FromContext(ctx); !c.HasRole(auth.RolePayment) {
+					return nil, ErrForbidden
+				}
+				response, err := next(ctx, request)
+				return unmaskCards(response), err
+			})
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			if req, ok := request.(GetRequest); !ok || !req.Full {
+				return next(ctx, request)
+			}
+			if issuer == nil {
+				return nil, ErrForbidden
+			}
+			return unmasked(ctx, request)
+		}
+	}
+}
+
+// MaskCardsForRole returns an endpoint middleware for the card, customer
+// and login endpoints masking card numbers with style in the responses to
+// tokens carrying role, as the first six and last four digits for admin
+// views. The claims are those authentication stored in the context, or, on
+// endpoints open to anonymous callers, those of the bearer token once
+// authenticated; a login is answered by the roles of the user logging in.
+// Other callers, those without a valid token included, keep the default
+// style.
+func MaskCardsForRole(issuer *auth.Issuer, role string, style users.MaskStyle) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		masked := func(ctx context.Context, request interface{}) (interface{}, error) {
+			response, err := next(ctx, request)
+			if err != nil {
+				return response, err
+			}
+			var holds bool
+			if r, login := response.(userResponse); login {
+				holds = r.User.HasRole(role)
+			} else if c, ok := auth.FromContext(ctx); ok {
+				holds = c.HasRole(role)
+			}
+			if !holds {
+				return response, err
+			}
+			return maskCards(response, style), err
+		}
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			token, _ := ctx.Value(bearerKey{}).(string)
+			if _, ok := auth.FromContext(ctx); ok || issuer == nil || token == "" {
+				return masked(ctx, request)
+			}
+			authenticated := false
+			response, err := authenticationMiddleware(issuer, "", nil)(
+				func(ctx context.Context, request interface{}) (interface{}, error) {
+					authenticated = true
+					return masked(ctx, request)
+				})(ctx, request)
+			if !authenticated {
+				// The endpoint is open: a token refused only loses the
+				// style of its role
+				return next(ctx, request)
+			}
+			return response, err
+		}
+	}
+}
+
+// maskCards has the cards of response marshal with style
+func maskCards(response interface{}, style users.MaskStyle) interface{} {
+	switch r := response.(type) {
+	case users.Card:
+		return r.WithMaskStyle(style)
+	case userResponse:
+		if r.Embedded != nil {
+			cs := make([]users.Card, 0, len(r.Embedded.Cards))
+			for _, c := range r.Embedded.Cards {
+				cs = append(cs, c.WithMaskStyle(style))
+			}
+			r.Embedded = &userAttributes{Addresses: r.Embedded.Addresses, Cards: cs}
+		}
+		return r
+	case EmbedStruct:
+		if cr, ok := r.Embed.(cardsResponse); ok {
+			cs := make([]users.Card, 0, len(cr.Cards))
+			for _, c := range cr.Cards {
+				cs = append(cs, c.WithMaskStyle(style))
+			}
+			r.Embed = cardsResponse{Cards: cs}
+			return r
+		}
+	case streamResponse:
+		return streamResponse{each: func(fn func(interface{}) error) error {
+			return r.each(func(v interface{}) error {
+				if c, ok := v.(users.Card); ok {
+					v = c.WithMaskStyle(style)
+				}
+				return fn(v)
+			})
+		}}
+	}
+	return response
+}
+
+func unmaskCards(response interface{}) interface{} {
+	switch r := response.(type) {
+	case users.Card:
+		return users.UnmaskedCard(r)
+	case EmbedStruct:
+		if cr, ok := r.Embed.(cardsResponse); ok {
+			cs := make([]users.UnmaskedCard, 0, len(cr.Cards))
+			for _, c := range cr.Cards {
+				cs = append(cs, users.UnmaskedCard(c))
+			}
+			return EmbedStruct{Embed: unmaskedCardsResponse{Cards: cs}, page: r.page}
+		}
+	case streamResponse:
+		return streamResponse{each: func(fn func(interface{}) error) error {
+			return r.each(func(v interface{}) error {
+				if c, ok := v.(users.Card); ok {
+					v = users.UnmaskedCard(c)
+				}
+				return fn(v)
+			})
+		}}
+	}
+	return response
+}
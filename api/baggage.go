@@ -0,0 +1,57 @@
+package api
+
+// baggage.go propagates the id of the authenticated user as trace baggage,
+// so the services a request reaches know the customer it is for without
+// parsing tokens again.
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db"
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// WithUserBaggage sets the id of the authenticated user as the user.id
+// baggage member of requests, and tags their spans with it. User ids are
+// personal data in some environments, hence the option.
+func WithUserBaggage() EndpointsOption {
+	return func(cfg *endpointsConfig) {
+		cfg.userBaggage = true
+	}
+}
+
+// dropUserBaggage removes the user.id member from the baggage of ctx. A
+// caller may not claim a user for a request that was not authenticated as
+// that user.
+func dropUserBaggage(ctx context.Context) context.Context {
+	b := baggage.FromContext(ctx)
+	if b.Member(db.UserBaggageKey).Key() == "" {
+		return ctx
+	}
+	return baggage.ContextWithBaggage(ctx, b.DeleteMember(db.UserBaggageKey))
+}
+
+// userBaggage returns an endpoint middleware setting the user of the
+// claims in the context as the user.id baggage member and tagging the span
+// with it. It follows authenticationMiddleware; requests authenticated by
+// API key or not at all carry no user.
+func userBaggage(next endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		c, ok := auth.FromContext(ctx)
+		if !ok || c.UserID() == "" {
+			return next(ctx, request)
+		}
+		m, err := baggage.NewMemberRaw(db.UserBaggageKey, c.UserID())
+		if err != nil {
+			return next(ctx, request)
+		}
+		b, err := baggage.FromContext(ctx).SetMember(m)
+		if err != nil {
+			return next(ctx, request)
+		}
+		tagSpan(ctx, db.UserBaggageKey, c.UserID())
+		return next(baggage.ContextWithBaggage(ctx, b), request)
+	}
+}
@@ -0,0 +1,54 @@
+package api
+
+// bodylimit.go caps the size of request bodies, so a client cannot make the
+// service read an arbitrarily large body into memory.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// DefaultMaxBodySize is the largest request body accepted unless configured
+// otherwise with WithMaxBodySize
+const DefaultMaxBodySize = 1 << 20
+
+// ErrBodyTooLarge is returned when a request body exceeds the configured cap
+var ErrBodyTooLarge = errors.New("Request body too large")
+
+// WithMaxBodySize caps request bodies at n bytes. Larger bodies are refused
+// with 413.
+func WithMaxBodySize(n int64) HTTPOption {
+	return func(cfg *httpConfig) {
+		cfg.maxBodySize = n
+	}
+}
+
+// limitBody returns a request function capping the body at n bytes. Routes
+// taking larger bodies, like batches, are served with options holding their
+// own limitBody in place of the default one.
+func limitBody(n int64) func(context.Context, *http.Request) context.Context {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(nil, r.Body, n)
+		}
+		return ctx
+	}
+}
+
+// decodeJSON decodes the request body into v. A body over the cap fails
+// with ErrBodyTooLarge, an empty body with io.EOF and any other malformed
+// body with ErrInvalidRequest.
+func decodeJSON(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	var mb *http.MaxBytesError
+	switch {
+	case err == nil, err == io.EOF:
+		return err
+	case errors.As(err, &mb):
+		return ErrBodyTooLarge
+	}
+	return ErrInvalidRequest
+}
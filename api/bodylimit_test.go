@@ -0,0 +1,52 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db/memory"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestMaxBodySize(t *testing.T) {
+	s := NewFixedService(memory.New())
+	id, err := s.Register("limited", "password", "limited@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), nil), log.NewNopLogger(), WithMaxBodySize(1024))
+
+	big := strings.Repeat("x", 2048)
+	for _, tc := range []struct {
+		method, path, body string
+		code               int
+	}{
+		{"POST", "/register", `{"username": "big", "password": "password", "firstName": "` + big + `"}`, http.StatusRequestEntityTooLarge},
+		{"PATCH", "/customers/" + id, `{"firstName": "` + big + `"}`, http.StatusRequestEntityTooLarge},
+		{"PUT", "/customers/" + id, `{"firstName": "` + big + `"}`, http.StatusRequestEntityTooLarge},
+		{"PATCH", "/customers/" + id, `{"firstName": "small"}`, http.StatusOK},
+		{"PATCH", "/customers/" + id, `{"firstName": `, http.StatusBadRequest},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if rec.Code != tc.code {
+			t.Errorf("%v %v: expected %v, received %v", tc.method, tc.path, tc.code, rec.Code)
+			continue
+		}
+		if tc.code != http.StatusRequestEntityTooLarge {
+			continue
+		}
+		var body ErrorBody
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if body.Error.Code != CodeBodyTooLarge {
+			t.Errorf("%v %v: expected code %v, received %+v", tc.method, tc.path, CodeBodyTooLarge, body.Error)
+		}
+	}
+}
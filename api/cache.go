@@ -0,0 +1,349 @@
+package api
+
+// cache.go keeps the customers, addresses and cards read through the
+// service in memory for a while, so repeated reads of the same entities do
+// not reach the database. The changes made through the service drop what
+// they may have made stale; those made around it, by other instances, are
+// seen once entries expire.
+
+import (
+	"container/list"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/users"
+)
+
+// DefaultCacheEntries caps the entries of the cache when no cap is given
+const DefaultCacheEntries = 10000
+
+// NewCachingService returns next with the results of GetUser, GetAddress
+// and GetCard cached for ttl, up to maxEntries of them, the least recently
+// used evicted first. The calls changing customers, addresses or cards drop
+// the entries they may affect. Each lookup is counted in lookups, by entity
+// and result, hit or miss. A ttl of zero caches nothing, returning next.
+func NewCachingService(next Service, ttl time.Duration, maxEntries int, lookups metrics.Counter) Service {
+	if ttl <= 0 {
+		return next
+	}
+	if maxEntries <= 0 {
+		maxEntries = DefaultCacheEntries
+	}
+	return cachingService{
+		Service: next,
+		cache:   newLRU(ttl, maxEntries, time.Now),
+		lookups: lookups,
+	}
+}
+
+type cachingService struct {
+	Service
+	cache   *lru
+	lookups metrics.Counter
+}
+
+func (s cachingService) withContext(ctx context.Context) Service {
+	s.Service = withContext(s.Service, ctx)
+	return s
+}
+
+func (s cachingService) GetUser(id string) (users.User, error) {
+	return cached(s, "customers", id, s.Service.GetUser, users.User.Clone)
+}
+
+func (s cachingService) GetAddress(id string) (users.Address, error) {
+	return cached(s, "addresses", id, s.Service.GetAddress, users.Address.Clone)
+}
+
+func (s cachingService) GetCard(id string) (users.Card, error) {
+	return cached(s, "cards", id, s.Service.GetCard, users.Card.Clone)
+}
+
+// cached returns a copy of the cached entity, or reads it and caches a
+// copy of it when it was read without error
+func cached[T any](s cachingService, entity, id string, read func(string) (T, error), clone func(T) T) (T, error) {
+	key := entity + "/" + id
+	if v, ok := s.cache.get(key); ok {
+		s.lookups.With("entity", entity, "result", "hit").Add(1)
+		return clone(v.(T)), nil
+	}
+	s.lookups.With("entity", entity, "result", "miss").Add(1)
+	gen := s.cache.generation()
+	item, err := read(id)
+	if err != nil {
+		return item, err
+	}
+	s.cache.add(key, clone(item), gen)
+	return item, nil
+}
+
+// Login always reads the user, but drops it from the cache as a login may
+// rehash its password
+func (s cachingService) Login(username, password string, attributes bool) (users.User, string, error) {
+	u, token, err := s.Service.Login(username, password, attributes)
+	if u.UserID != "" {
+		s.dropCustomer(u.UserID)
+	}
+	return u, token, err
+}
+
+func (s cachingService) LoginMFA(challenge, code string) (users.User, string, error) {
+	u, token, err := s.Service.LoginMFA(challenge, code)
+	if u.UserID != "" {
+		s.dropCustomer(u.UserID)
+	}
+	return u, token, err
+}
+
+func (s cachingService) Register(username, password, email, first, last, phone, displayName string) (string, error) {
+	id, err := s.Service.Register(username, password, email, first, last, phone, displayName)
+	if id != "" {
+		s.dropCustomer(id)
+	}
+	return id, err
+}
+
+func (s cachingService) PostUser(u users.User) (users.User, error) {
+	created, err := s.Service.PostUser(u)
+	if created.UserID != "" {
+		s.dropCustomer(created.UserID)
+	}
+	return created, err
+}
+
+func (s cachingService) UpdateUser(id string, u users.User, principal string) (users.User, error) {
+	defer s.dropCustomer(id)
+	return s.Service.UpdateUser(id, u, principal)
+}
+
+func (s cachingService) PatchUser(id string, p users.UserPatch, principal string) (users.User, error) {
+	defer s.dropCustomer(id)
+	return s.Service.PatchUser(id, p, principal)
+}
+
+func (s cachingService) ChangePassword(id, current, next string) error {
+	defer s.dropCustomer(id)
+	return s.Service.ChangePassword(id, current, next)
+}
+
+func (s cachingService) LogoutAll(id, principal string) error {
+	defer s.dropCustomer(id)
+	return s.Service.LogoutAll(id, principal)
+}
+
+func (s cachingService) SetRoles(id string, roles []string, principal string) (users.User, error) {
+	defer s.dropCustomer(id)
+	return s.Service.SetRoles(id, roles, principal)
+}
+
+func (s cachingService) SetStatus(id, status, reason, principal string) (users.User, error) {
+	defer s.dropCustomer(id)
+	return s.Service.SetStatus(id, status, reason, principal)
+}
+
+func (s cachingService) SetPreferences(id string, changes map[string]*string) (map[string]string, error) {
+	defer s.dropCustomer(id)
+	return s.Service.SetPreferences(id, changes)
+}
+
+func (s cachingService) ProvisionMFA(id string) (string, string, error) {
+	defer s.dropCustomer(id)
+	return s.Service.ProvisionMFA(id)
+}
+
+func (s cachingService) ConfirmMFA(id, code string) ([]string, error) {
+	defer s.dropCustomer(id)
+	return s.Service.ConfirmMFA(id, code)
+}
+
+func (s cachingService) DisableMFA(id, code string) error {
+	defer s.dropCustomer(id)
+	return s.Service.DisableMFA(id, code)
+}
+
+func (s cachingService) PostAddress(a users.Address, userid, principal string) (string, error) {
+	defer s.dropCustomer(userid)
+	return s.Service.PostAddress(a, userid, principal)
+}
+
+// SetDefaultAddress drops every address with the customer, as the types of
+// its other addresses may change too
+func (s cachingService) SetDefaultAddress(id, addressID, typ string) (users.User, error) {
+	defer s.dropCustomer(id)
+	defer s.cache.dropEntity("addresses")
+	return s.Service.SetDefaultAddress(id, addressID, typ)
+}
+
+func (s cachingService) PostCard(c users.Card, userid, principal string) (string, error) {
+	defer s.dropCustomer(userid)
+	return s.Service.PostCard(c, userid, principal)
+}
+
+func (s cachingService) SetCardLabel(id, cardID, label string) (users.Card, error) {
+	defer s.dropCustomer(id)
+	defer s.cache.drop("cards/" + cardID)
+	return s.Service.SetCardLabel(id, cardID, label)
+}
+
+func (s cachingService) SetDefaultCard(id, cardID string) (users.User, error) {
+	defer s.dropCustomer(id)
+	return s.Service.SetDefaultCard(id, cardID)
+}
+
+func (s cachingService) MergeAttributes(id, session string, addresses, cards []string) MergeResult {
+	defer s.dropCustomer(id)
+	return s.Service.MergeAttributes(id, session, addresses, cards)
+}
+
+func (s cachingService) AddEmail(id, address string) ([]users.EmailAddress, string, error) {
+	defer s.dropCustomer(id)
+	return s.Service.AddEmail(id, address)
+}
+
+func (s cachingService) VerifyEmail(id, address, code string) ([]users.EmailAddress, error) {
+	defer s.dropCustomer(id)
+	return s.Service.VerifyEmail(id, address, code)
+}
+
+func (s cachingService) RemoveEmail(id, address string) ([]users.EmailAddress, error) {
+	defer s.dropCustomer(id)
+	return s.Service.RemoveEmail(id, address)
+}
+
+func (s cachingService) SetPrimaryEmail(id, address string) (users.User, error) {
+	defer s.dropCustomer(id)
+	return s.Service.SetPrimaryEmail(id, address)
+}
+
+func (s cachingService) SetConsents(id, source string, consents map[string]bool) (users.ConsentState, error) {
+	defer s.dropCustomer(id)
+	return s.Service.SetConsents(id, source, consents)
+}
+
+// Delete drops the entity. A customer goes with its addresses and cards,
+// and an address or a card with the customers, as which of them held it is
+// not known here; all of those are dropped.
+func (s cachingService) Delete(entity, id string, version int64, principal string) error {
+	defer func() {
+		s.cache.drop(entity + "/" + id)
+		switch entity {
+		case "customers":
+			s.cache.dropEntity("addresses")
+			s.cache.dropEntity("cards")
+		case "addresses", "cards":
+			s.cache.dropEntity("customers")
+		}
+	}()
+	return s.Service.Delete(entity, id, version, principal)
+}
+
+func (s cachingService) AnonymizeUser(id, principal string) error {
+	defer func() {
+		s.dropCustomer(id)
+		s.cache.dropEntity("addresses")
+		s.cache.dropEntity("cards")
+	}()
+	return s.Service.AnonymizeUser(id, principal)
+}
+
+// dropCustomer drops the customer id from the cache
+func (s cachingService) dropCustomer(id string) {
+	s.cache.drop("customers/" + id)
+}
+
+// lru is a cache of entries expiring after ttl, holding up to max of them
+// and evicting the least recently used first. Keys are an entity and an id,
+// parted by a slash.
+type lru struct {
+	mtx     sync.Mutex
+	ttl     time.Duration
+	max     int
+	now     func() time.Time
+	order   *list.List
+	entries map[string]*list.Element
+	// gen counts the drops, so reads overtaken by one cache nothing
+	gen uint64
+}
+
+// lruEntry is an element of the order of an lru
+type lruEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+func newLRU(ttl time.Duration, max int, now func() time.Time) *lru {
+	return &lru{ttl: ttl, max: max, now: now, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// get returns the value of key, unless it is missing or expired
+func (c *lru) get(key string) (interface{}, bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*lruEntry)
+	if !c.now().Before(e.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.value, true
+}
+
+// generation returns the count of drops, to be given to add
+func (c *lru) generation() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.gen
+}
+
+// add caches value under key, unless anything was dropped since the
+// generation gen the value was read at, as it may be stale already
+func (c *lru) add(key string, value interface{}, gen uint64) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if gen != c.gen {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: c.now().Add(c.ttl)})
+	for c.order.Len() > c.max {
+		c.remove(c.order.Back())
+	}
+}
+
+// drop removes key
+func (c *lru) drop(key string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.gen++
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+// dropEntity removes every key of entity
+func (c *lru) dropEntity(entity string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.gen++
+	prefix := entity + "/"
+	for key, el := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(el)
+		}
+	}
+}
+
+func (c *lru) remove(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.entries, el.Value.(*lruEntry).key)
+}
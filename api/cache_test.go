@@ -0,0 +1,125 @@
+package api
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countedReads counts the calls of GetUser and GetAddress reaching it
+type countedReads struct {
+	Service
+	users, addresses int32
+}
+
+func (s *countedReads) GetUser(id string) (users.User, error) {
+	atomic.AddInt32(&s.users, 1)
+	return s.Service.GetUser(id)
+}
+
+func (s *countedReads) GetAddress(id string) (users.Address, error) {
+	atomic.AddInt32(&s.addresses, 1)
+	return s.Service.GetAddress(id)
+}
+
+func TestCachingService(t *testing.T) {
+	inner := NewFixedService(memory.New())
+	id, err := inner.Register("cached", "password", "cached@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addressID, err := inner.PostAddress(users.Address{Street: "High Street", City: "London", Country: "United Kingdom", PostCode: "SW1A 1AA"}, id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counted := &countedReads{Service: inner}
+	lookups := stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "lookups"}, []string{"entity", "result"})
+	s := NewCachingService(counted, time.Minute, 10, kitprometheus.NewCounter(lookups))
+
+	u, err := s.GetUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.FirstName = "changed"
+	u.Addresses[0].Street = "changed"
+	if u, err = s.GetUser(id); err != nil || u.FirstName != "first" || u.Addresses[0].Street != "High Street" {
+		t.Errorf("Expected a copy of the cached customer, received %+v %v", u, err)
+	}
+	if counted.users != 1 {
+		t.Errorf("Expected one read of the customer, received %v", counted.users)
+	}
+	if hits, misses := testutil.ToFloat64(lookups.WithLabelValues("customers", "hit")), testutil.ToFloat64(lookups.WithLabelValues("customers", "miss")); hits != 1 || misses != 1 {
+		t.Errorf("Expected a hit and a miss, received %v and %v", hits, misses)
+	}
+
+	patched := "patched"
+	if _, err := s.PatchUser(id, users.UserPatch{FirstName: &patched}, id); err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := s.GetUser(id); u.FirstName != "patched" || counted.users != 2 {
+		t.Errorf("Expected the patch to drop the customer, received %v after %v reads", u.FirstName, counted.users)
+	}
+
+	if _, err := s.GetAddress(addressID); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("addresses", addressID, db.AnyVersion, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetAddress(addressID); err == nil || counted.addresses != 2 {
+		t.Errorf("Expected the deleted address read again and missing, received %v after %v reads", err, counted.addresses)
+	}
+	if u, _ := s.GetUser(id); len(u.Addresses) != 0 || counted.users != 3 {
+		t.Errorf("Expected the customer of the address dropped, received %+v after %v reads", u.Addresses, counted.users)
+	}
+
+	if _, _, err := s.Login("cached", "password", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetUser(id); err != nil || counted.users != 4 {
+		t.Errorf("Expected a login to drop the customer, received %v reads", counted.users)
+	}
+
+	if NewCachingService(counted, 0, 10, kitprometheus.NewCounter(lookups)) != Service(counted) {
+		t.Error("Expected a zero ttl to cache nothing")
+	}
+}
+
+func TestLRU(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := newLRU(time.Minute, 2, func() time.Time { return now })
+	c.add("customers/a", "a", c.generation())
+	c.add("customers/b", "b", c.generation())
+	c.get("customers/a")
+	c.add("customers/c", "c", c.generation())
+	if _, ok := c.get("customers/b"); ok {
+		t.Error("Expected the least recently used entry evicted")
+	}
+	if v, ok := c.get("customers/a"); !ok || v != "a" {
+		t.Errorf("Expected the recently used entry kept, received %v", v)
+	}
+
+	gen := c.generation()
+	c.drop("cards/x")
+	c.add("customers/d", "d", gen)
+	if _, ok := c.get("customers/d"); ok {
+		t.Error("Expected a value read before a drop not cached")
+	}
+
+	now = now.Add(time.Minute)
+	if _, ok := c.get("customers/a"); ok {
+		t.Error("Expected the entry expired")
+	}
+	c.add("addresses/a", "a", c.generation())
+	c.dropEntity("addresses")
+	if _, ok := c.get("addresses/a"); ok || c.order.Len() != 1 {
+		t.Errorf("Expected the addresses dropped, %v entries left", c.order.Len())
+	}
+}
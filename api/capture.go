@@ -0,0 +1,168 @@
+package api
+
+// capture.go records the bodies of a sample of requests and responses, to
+// reproduce decoding bugs with exactly what clients sent.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/microservices-demo/user/redact"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// MaxCaptureSize bounds the bodies recorded by CaptureMiddleware, once
+// redacted
+const MaxCaptureSize = 4 << 10
+
+// captureReadLimit bounds the bodies kept for redaction, which needs the
+// whole document
+const captureReadLimit = 64 << 10
+
+type captureKey struct{}
+
+// capture holds the bodies of a sampled request
+type capture struct {
+	request  limitedBuffer
+	response limitedBuffer
+	status   int
+
+	mu      sync.Mutex
+	traceID string
+}
+
+// CaptureMiddleware records the request body, response status and response
+// body of a fraction rate of requests, redacted and truncated to
+// MaxCaptureSize, as events of the span of the endpoint and a debug line of
+// logger. Probes and /metrics are never captured; a rate of 0 captures
+// nothing.
+func CaptureMiddleware(rate float64, logger log.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if rate <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if probePath(r.URL.Path) || r.URL.Path == "/metrics" || rand.Float64() >= rate {
+				next.ServeHTTP(w, r)
+				return
+			}
+			c := &capture{status: http.StatusOK}
+			if r.Body != nil {
+				r.Body = captureBody{ReadCloser: r.Body, tee: io.TeeReader(r.Body, &c.request)}
+			}
+			next.ServeHTTP(&captureWriter{ResponseWriter: w, c: c}, r.WithContext(context.WithValue(r.Context(), captureKey{}, c)))
+			requestID, _ := RequestIDFromContext(r.Context())
+			level.Debug(logger).Log("msg", "Captured request", "request_id", requestID, "traceid", c.trace(),
+				"http_method", r.Method, "path", r.URL.Path, "status", c.status,
+				"request_body", capturedBody(&c.request), "response_body", capturedBody(&c.response))
+		})
+	}
+}
+
+// recordCapture adds the captured request body to span, with the response
+// the endpoint answered with its status, when the request of ctx is
+// captured. The response body is not yet written then, so it is encoded
+// here as the transport would.
+func recordCapture(ctx context.Context, span trace.Span, response interface{}, err error) {
+	c, ok := ctx.Value(captureKey{}).(*capture)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	c.traceID = traceID(ctx)
+	c.mu.Unlock()
+	span.AddEvent("request", trace.WithAttributes(attribute.String("body", capturedBody(&c.request))))
+	status := http.StatusOK
+	if err != nil {
+		status = errorStatus(err)
+		response = newErrorBody(ctx, err, status)
+	}
+	var b limitedBuffer
+	if _, stream := response.(streamResponse); !stream {
+		json.NewEncoder(&b).Encode(response)
+	}
+	span.AddEvent("response", trace.WithAttributes(attribute.Int("status", status), attribute.String("body", capturedBody(&b))))
+}
+
+func (c *capture) trace() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.traceID
+}
+
+// capturedBody returns the body held by b redacted and truncated to
+// MaxCaptureSize. A body that is not JSON, or too large to be kept whole,
+// cannot be redacted and is recorded by its size only.
+func capturedBody(b *limitedBuffer) string {
+	if b.Len() == 0 && b.dropped == 0 {
+		return ""
+	}
+	if b.dropped > 0 {
+		return fmt.Sprintf("[%v bytes, too large to capture]", b.Len()+b.dropped)
+	}
+	redacted, err := redact.JSON(b.Bytes())
+	if err != nil {
+		return fmt.Sprintf("[%v bytes, not JSON]", b.Len())
+	}
+	if len(redacted) > MaxCaptureSize {
+		return string(redacted[:MaxCaptureSize]) + "...(truncated)"
+	}
+	return string(redacted)
+}
+
+// limitedBuffer keeps the first captureReadLimit bytes written to it,
+// counting those dropped
+type limitedBuffer struct {
+	bytes.Buffer
+	dropped int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := captureReadLimit - b.Len(); len(p) > room {
+		b.dropped += len(p) - room
+		b.Buffer.Write(p[:room])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// captureBody copies what the decoder reads of the request body
+type captureBody struct {
+	io.ReadCloser
+	tee io.Reader
+}
+
+func (b captureBody) Read(p []byte) (int, error) {
+	return b.tee.Read(p)
+}
+
+// captureWriter copies the status and body of the response
+type captureWriter struct {
+	http.ResponseWriter
+	c *capture
+}
+
+func (w *captureWriter) WriteHeader(status int) {
+	w.c.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *captureWriter) Write(p []byte) (int, error) {
+	w.c.response.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *captureWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
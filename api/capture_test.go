@@ -0,0 +1,50 @@
+package api
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db/memory"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestCaptureMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(&buf)
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(NewFixedService(memory.New()), tracer, log.NewNopLogger(), nil), log.NewNopLogger())
+
+	CaptureMiddleware(1, logger)(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/register",
+		strings.NewReader(`{"username": "captured", "password": "hunter22", "email": "captured@example.com", "firstName": "first", "lastName": "last"}`)))
+	logged := buf.String()
+	for _, want := range []string{"level=debug", "status=200", `\"username\":\"captured\"`, `\"password\":\"[REDACTED]\"`, `response_body="{\"id\":`} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("Expected %v logged, received %v", want, logged)
+		}
+	}
+	if strings.Contains(logged, "hunter22") {
+		t.Errorf("Expected the password left out, received %v", logged)
+	}
+	ended := spans.Ended()
+	if len(ended) != 1 || len(ended[0].Events()) != 2 || ended[0].Events()[0].Name != "request" {
+		t.Fatalf("Expected the request and response recorded on the span, received %+v", ended)
+	}
+
+	buf.Reset()
+	CaptureMiddleware(1, logger)(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/register", strings.NewReader(`{"username": `)))
+	if !strings.Contains(buf.String(), `request_body="[13 bytes, not JSON]"`) || !strings.Contains(buf.String(), "status=400") {
+		t.Errorf("Expected a malformed body recorded by size, received %v", buf.String())
+	}
+
+	buf.Reset()
+	CaptureMiddleware(1, logger)(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/health", nil))
+	CaptureMiddleware(0, logger)(h).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/customers", nil))
+	if buf.Len() != 0 {
+		t.Errorf("Expected health checks and unsampled requests not captured, received %v", buf.String())
+	}
+}
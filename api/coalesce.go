@@ -0,0 +1,110 @@
+package api
+
+// coalesce.go makes concurrent reads of the same entities share one call to
+// the service below, so a burst of requests for a hot customer costs one
+// database round trip.
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/users"
+	"golang.org/x/sync/singleflight"
+)
+
+// CoalescingMiddleware makes concurrent calls of GetUser, GetAddress and
+// GetCard for the same id, and of ListUsers, ListAddresses and ListCards
+// with the same params, share the call of the first of them. Each caller
+// receives a copy of the shared result. Calls answered by another's are
+// counted in coalesced, by entity.
+func CoalescingMiddleware(coalesced metrics.Counter) Middleware {
+	return func(next Service) Service {
+		return coalescingMiddleware{Service: next, group: &singleflight.Group{}, coalesced: coalesced}
+	}
+}
+
+type coalescingMiddleware struct {
+	Service
+	group     *singleflight.Group
+	coalesced metrics.Counter
+}
+
+// withContext binds the service below; a shared call is made for the
+// request of the first of its callers
+func (mw coalescingMiddleware) withContext(ctx context.Context) Service {
+	mw.Service = withContext(mw.Service, ctx)
+	return mw
+}
+
+func (mw coalescingMiddleware) GetUser(id string) (users.User, error) {
+	return coalesce(mw, "customers", id, func() (users.User, error) { return mw.Service.GetUser(id) }, users.User.Clone)
+}
+
+func (mw coalescingMiddleware) ListUsers(params ListParams) ([]users.User, Page, error) {
+	return coalesceList(mw, "customers", params, mw.Service.ListUsers, users.User.Clone)
+}
+
+func (mw coalescingMiddleware) GetAddress(id string) (users.Address, error) {
+	return coalesce(mw, "addresses", id, func() (users.Address, error) { return mw.Service.GetAddress(id) }, users.Address.Clone)
+}
+
+func (mw coalescingMiddleware) ListAddresses(params ListParams) ([]users.Address, Page, error) {
+	return coalesceList(mw, "addresses", params, mw.Service.ListAddresses, users.Address.Clone)
+}
+
+func (mw coalescingMiddleware) GetCard(id string) (users.Card, error) {
+	return coalesce(mw, "cards", id, func() (users.Card, error) { return mw.Service.GetCard(id) }, users.Card.Clone)
+}
+
+func (mw coalescingMiddleware) ListCards(params ListParams) ([]users.Card, Page, error) {
+	return coalesceList(mw, "cards", params, mw.Service.ListCards, users.Card.Clone)
+}
+
+// coalesce calls read, unless a call for the same entity and key is
+// running, whose result it then shares. A shared result is cloned for each
+// caller, the one that read it included, as callers change what they get.
+func coalesce[T any](mw coalescingMiddleware, entity, key string, read func() (T, error), clone func(T) T) (T, error) {
+	ran := false
+	v, err, shared := mw.group.Do(entity+"/"+key, func() (interface{}, error) {
+		ran = true
+		return read()
+	})
+	if shared && !ran {
+		mw.coalesced.With("entity", entity).Add(1)
+	}
+	item, _ := v.(T)
+	if !shared {
+		return item, err
+	}
+	return clone(item), err
+}
+
+// listed is a page of a list, as lists are coalesced
+type listed[T any] struct {
+	items []T
+	page  Page
+}
+
+// coalesceList coalesces the calls of list with the same params, as
+// coalesce does those of reads
+func coalesceList[T any](mw coalescingMiddleware, entity string, params ListParams, list func(ListParams) ([]T, Page, error), clone func(T) T) ([]T, Page, error) {
+	read := func() (listed[T], error) {
+		items, page, err := list(params)
+		return listed[T]{items: items, page: page}, err
+	}
+	cloneAll := func(l listed[T]) listed[T] {
+		if l.items == nil {
+			return l
+		}
+		copies := make([]T, len(l.items))
+		for i, item := range l.items {
+			copies[i] = clone(item)
+		}
+		l.items = copies
+		return l
+	}
+	// A list key cannot be taken for an id, which has no ?
+	l, err := coalesce(mw, entity, fmt.Sprintf("?%+v", params), read, cloneAll)
+	return l.items, l.page, err
+}
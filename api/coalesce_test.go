@@ -0,0 +1,107 @@
+package api
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+)
+
+// entityCounter counts by the value of the entity label
+type entityCounter struct {
+	counts *sync.Map
+	entity string
+}
+
+func (c entityCounter) With(labelValues ...string) metrics.Counter {
+	return entityCounter{counts: c.counts, entity: labelValues[1]}
+}
+
+func (c entityCounter) Add(delta float64) {
+	v, _ := c.counts.LoadOrStore(c.entity, new(int64))
+	atomic.AddInt64(v.(*int64), int64(delta))
+}
+
+func (c entityCounter) get(entity string) int64 {
+	v, ok := c.counts.Load(entity)
+	if !ok {
+		return 0
+	}
+	return atomic.LoadInt64(v.(*int64))
+}
+
+// slowReads holds GetUser until released, counting the calls reaching it
+type slowReads struct {
+	Service
+	calls   int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowReads) GetUser(id string) (users.User, error) {
+	if atomic.AddInt32(&s.calls, 1) == 1 {
+		close(s.started)
+	}
+	<-s.release
+	return s.Service.GetUser(id)
+}
+
+func TestCoalescing(t *testing.T) {
+	inner := NewFixedService(memory.New())
+	id, err := inner.Register("coalesce", "password", "coalesce@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow := &slowReads{Service: inner, started: make(chan struct{}), release: make(chan struct{})}
+	coalesced := entityCounter{counts: &sync.Map{}}
+	s := CoalescingMiddleware(coalesced)(slow)
+
+	const n = 10
+	results := make([]users.User, n)
+	var wg sync.WaitGroup
+	read := func(i int) {
+		defer wg.Done()
+		u, err := s.GetUser(id)
+		if err != nil {
+			t.Error(err)
+		}
+		results[i] = u
+	}
+	wg.Add(n)
+	go read(0)
+	<-slow.started
+	for i := 1; i < n; i++ {
+		go read(i)
+	}
+	// Give the others time to join the running call
+	time.Sleep(50 * time.Millisecond)
+	close(slow.release)
+	wg.Wait()
+
+	if calls := atomic.LoadInt32(&slow.calls); calls != 1 {
+		t.Errorf("Expected one call to the service, received %v", calls)
+	}
+	if got := coalesced.get("customers"); got != n-1 {
+		t.Errorf("Expected %v coalesced calls, counted %v", n-1, got)
+	}
+	// Callers own what they receive
+	results[0].FirstName = "changed"
+	results[0].Links["self"] = users.Href{Href: "changed"}
+	for i, u := range results[1:] {
+		if u.FirstName != "first" || u.Links["self"].Href == "changed" {
+			t.Errorf("Expected caller %v unaffected by the changes of another, received %+v", i+1, u)
+		}
+	}
+
+	// Calls once the first is over read again
+	if _, err := s.GetUser(id); err != nil {
+		t.Fatal(err)
+	}
+	if calls := atomic.LoadInt32(&slow.calls); calls != 2 {
+		t.Errorf("Expected a later call to reach the service, received %v calls", calls)
+	}
+}
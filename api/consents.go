@@ -0,0 +1,32 @@
+package api
+
+// consents.go holds the consents of customers to marketing: reading them, and
+// changing them, which appends to their history rather than overwriting it.
+
+import (
+	"time"
+
+	"github.com/microservices-demo/user/users"
+)
+
+// GetConsents returns the current consents of the user and their history
+func (s *fixedService) GetConsents(id string) (users.ConsentState, error) {
+	u, err := s.db.GetUser(id)
+	if err != nil {
+		return users.ConsentState{}, notFound(err, "customers", id)
+	}
+	return u.ConsentState(), nil
+}
+
+// SetConsents records the consents of the user to the channels of consents,
+// given through source, returning its consents
+func (s *fixedService) SetConsents(id, source string, consents map[string]bool) (users.ConsentState, error) {
+	records, err := users.NewConsentRecords(consents, source, time.Now().UTC())
+	if err != nil {
+		return users.ConsentState{}, err
+	}
+	if err := s.db.AppendConsents(id, records); err != nil {
+		return users.ConsentState{}, notFound(err, "customers", id)
+	}
+	return s.GetConsents(id)
+}
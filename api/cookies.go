@@ -0,0 +1,178 @@
+package api
+
+// cookies.go contains the opt-in session cookie mode, in which login sets an
+// HttpOnly cookie instead of returning the access token to the browser, and
+// the double-submit CSRF protection of requests authenticated by it.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/microservices-demo/user/auth"
+)
+
+// Session cookie modes
+const (
+	// CookieModeJWT stores the access token itself in the cookie
+	CookieModeJWT = "jwt"
+	// CookieModeSession stores an opaque session id in the cookie, backed
+	// by a server-side session store
+	CookieModeSession = "session"
+)
+
+const (
+	// CSRFCookie is the readable cookie holding the CSRF token
+	CSRFCookie = "csrf_token"
+	// CSRFHeader is the header mutating requests echo the CSRF token in
+	CSRFHeader = "X-CSRF-Token"
+)
+
+// SessionCookie configures the session cookie. Cookies are always Secure
+// and HttpOnly.
+type SessionCookie struct {
+	Mode     string
+	Name     string
+	Domain   string
+	MaxAge   time.Duration
+	SameSite http.SameSite
+	// Sessions backs CookieModeSession
+	Sessions auth.SessionStore
+}
+
+// HTTPOption configures the handler returned by MakeHTTPHandler.
+type HTTPOption func(*httpConfig)
+
+type httpConfig struct {
+	cookie      *SessionCookie
+	maxBodySize int64
+	logLevel    http.Handler
+}
+
+// WithSessionCookie makes login set the session cookie described by c, and
+// accepts that cookie wherever a bearer token is accepted.
+func WithSessionCookie(c SessionCookie) HTTPOption {
+	return func(cfg *httpConfig) {
+		cfg.cookie = &c
+	}
+}
+
+type sessionIDKey struct{}
+
+type csrfFailedKey struct{}
+
+// toContext puts the token of the session cookie into the context as bearer
+// token, unless the request carries an Authorization header. Mutating
+// requests authenticated by the cookie must echo the CSRF cookie in the
+// CSRFHeader, otherwise csrfCheck fails.
+func (c *SessionCookie) toContext(ctx context.Context, r *http.Request) context.Context {
+	ck, err := r.Cookie(c.Name)
+	if err != nil || ck.Value == "" {
+		return ctx
+	}
+	token := ck.Value
+	if c.Mode == CookieModeSession {
+		ctx = context.WithValue(ctx, sessionIDKey{}, ck.Value)
+		if token, err = c.Sessions.Get(ck.Value); err != nil {
+			return ctx
+		}
+	}
+	if _, ok := ctx.Value(bearerKey{}).(string); ok {
+		return ctx
+	}
+	if !safeMethod(r.Method) && !validCSRF(r) {
+		ctx = context.WithValue(ctx, csrfFailedKey{}, true)
+	}
+	return context.WithValue(ctx, bearerKey{}, token)
+}
+
+// csrfCheck returns ErrForbidden for requests authenticated by the session
+// cookie that failed the CSRF check.
+func csrfCheck(ctx context.Context) error {
+	if failed, _ := ctx.Value(csrfFailedKey{}).(bool); failed {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func validCSRF(r *http.Request) bool {
+	ck, err := r.Cookie(CSRFCookie)
+	if err != nil || ck.Value == "" {
+		return false
+	}
+	h := r.Header.Get(CSRFHeader)
+	return h != "" && subtle.ConstantTimeCompare([]byte(h), []byte(ck.Value)) == 1
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// encodeLogin sets the cookie for a successful login and leaves the access
+// token out of the body.
+func (c *SessionCookie) encodeLogin(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if ur, ok := response.(userResponse); ok && ur.Token != "" {
+		value := ur.Token
+		if c.Mode == CookieModeSession {
+			id, err := c.Sessions.Create(ur.Token, c.MaxAge)
+			if err != nil {
+				return err
+			}
+			value = id
+		}
+		// Every login rotates the CSRF token
+		csrf, err := newCSRFToken()
+		if err != nil {
+			return err
+		}
+		http.SetCookie(w, c.cookie(value, int(c.MaxAge.Seconds())))
+		http.SetCookie(w, c.csrfCookie(csrf, int(c.MaxAge.Seconds())))
+		ur.Token = ""
+		response = ur
+	}
+	return encodeResponse(ctx, w, response)
+}
+
+// encodeLogout ends the server-side session and clears the cookie.
+func (c *SessionCookie) encodeLogout(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if id, ok := ctx.Value(sessionIDKey{}).(string); ok {
+		if err := c.Sessions.Delete(id); err != nil {
+			return err
+		}
+	}
+	http.SetCookie(w, c.cookie("", -1))
+	http.SetCookie(w, c.csrfCookie("", -1))
+	return encodeResponse(ctx, w, response)
+}
+
+func (c *SessionCookie) cookie(value string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     c.Name,
+		Value:    value,
+		Path:     "/",
+		Domain:   c.Domain,
+		MaxAge:   maxAge,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: c.SameSite,
+	}
+}
+
+// csrfCookie is readable by scripts, which echo it in the CSRFHeader
+func (c *SessionCookie) csrfCookie(value string, maxAge int) *http.Cookie {
+	ck := c.cookie(value, maxAge)
+	ck.Name = CSRFCookie
+	ck.HttpOnly = false
+	return ck
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,162 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSessionCookie(t *testing.T) {
+	for _, mode := range []string{CookieModeJWT, CookieModeSession} {
+		t.Run(mode, func(t *testing.T) {
+			issuer, _ := auth.NewIssuer(auth.HS256, []byte("secret"))
+			issuer.Denylist = auth.NewMemoryDenylist()
+			s := NewFixedService(memory.New(), WithTokenIssuer(issuer), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+			id, err := s.Register("cookie", "password", "cookie@example.com", "first", "last", "", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessions := auth.NewMemorySessionStore()
+			tracer := noop.NewTracerProvider().Tracer("")
+			h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer), log.NewNopLogger(),
+				WithSessionCookie(SessionCookie{
+					Mode:     mode,
+					Name:     "session",
+					Domain:   "example.com",
+					MaxAge:   time.Hour,
+					SameSite: http.SameSiteStrictMode,
+					Sessions: sessions,
+				}))
+
+			req := httptest.NewRequest("GET", "/login", nil)
+			req.SetBasicAuth("cookie", "password")
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			var login userResponse
+			json.NewDecoder(rec.Body).Decode(&login)
+			if login.Token != "" {
+				t.Error("Expected no token in the body")
+			}
+			ck, csrf := cookie(rec, "session"), cookie(rec, CSRFCookie)
+			if ck == nil || csrf == nil || csrf.HttpOnly {
+				t.Fatalf("Expected a session and a readable CSRF cookie, received %v", rec.Result().Cookies())
+			}
+			if ck.Name != "session" || !ck.Secure || !ck.HttpOnly || ck.SameSite != http.SameSiteStrictMode ||
+				ck.MaxAge != 3600 || ck.Domain != "example.com" {
+				t.Errorf("Unexpected cookie %+v", ck)
+			}
+			if _, err := issuer.Parse(ck.Value); (err == nil) != (mode == CookieModeJWT) {
+				t.Errorf("Expected the cookie to hold a token only in jwt mode, received %v", err)
+			}
+
+			patch := func() int {
+				req := httptest.NewRequest("PATCH", "/customers/"+id, strings.NewReader(`{"firstName": "x"}`))
+				req.AddCookie(&http.Cookie{Name: ck.Name, Value: ck.Value})
+				req.AddCookie(&http.Cookie{Name: CSRFCookie, Value: csrf.Value})
+				req.Header.Set(CSRFHeader, csrf.Value)
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				return rec.Code
+			}
+			if code := patch(); code != http.StatusOK {
+				t.Errorf("Expected the cookie accepted, received %v", code)
+			}
+
+			req = httptest.NewRequest("POST", "/logout", nil)
+			req.AddCookie(&http.Cookie{Name: ck.Name, Value: ck.Value})
+			req.AddCookie(&http.Cookie{Name: CSRFCookie, Value: csrf.Value})
+			req.Header.Set(CSRFHeader, csrf.Value)
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("Expected 200 on logout, received %v: %v", rec.Code, rec.Body.String())
+			}
+			if c := cookie(rec, "session"); c == nil || c.MaxAge >= 0 {
+				t.Errorf("Expected the cookie cleared, received %v", rec.Result().Cookies())
+			}
+			if code := patch(); code != http.StatusUnauthorized {
+				t.Errorf("Expected the cookie refused after logout, received %v", code)
+			}
+			if mode == CookieModeSession {
+				if _, err := sessions.Get(ck.Value); err != auth.ErrNoSession {
+					t.Errorf("Expected the session deleted, received %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestCSRF(t *testing.T) {
+	issuer, _ := auth.NewIssuer(auth.HS256, []byte("secret"))
+	s := NewFixedService(memory.New(), WithTokenIssuer(issuer), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	id, err := s.Register("csrf", "password", "csrf@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer), log.NewNopLogger(),
+		WithSessionCookie(SessionCookie{Mode: CookieModeJWT, Name: "session", MaxAge: time.Hour}))
+	login := func() (*http.Cookie, *http.Cookie) {
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.SetBasicAuth("csrf", "password")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return cookie(rec, "session"), cookie(rec, CSRFCookie)
+	}
+	session, csrf := login()
+	if _, again := login(); again.Value == csrf.Value {
+		t.Error("Expected the CSRF token rotated on login")
+	}
+	_, token, _ := s.Login("csrf", "password", false)
+
+	for _, tc := range []struct {
+		name               string
+		csrfCookie, header string
+		bearer             bool
+		method             string
+		code               int
+	}{
+		{"matching", csrf.Value, csrf.Value, false, "PATCH", http.StatusOK},
+		{"header missing", csrf.Value, "", false, "PATCH", http.StatusForbidden},
+		{"cookie missing", "", csrf.Value, false, "PATCH", http.StatusForbidden},
+		{"mismatch", csrf.Value, "other", false, "PATCH", http.StatusForbidden},
+		{"bearer", "", "", true, "PATCH", http.StatusOK},
+		{"safe method", "", "", false, "GET", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, "/customers/"+id, strings.NewReader(`{"firstName": "x"}`))
+		req.AddCookie(&http.Cookie{Name: session.Name, Value: session.Value})
+		if tc.csrfCookie != "" {
+			req.AddCookie(&http.Cookie{Name: CSRFCookie, Value: tc.csrfCookie})
+		}
+		if tc.header != "" {
+			req.Header.Set(CSRFHeader, tc.header)
+		}
+		if tc.bearer {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%v: expected %v, received %v: %v", tc.name, tc.code, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func cookie(rec *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
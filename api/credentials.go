@@ -0,0 +1,79 @@
+package api
+
+// credentials.go keeps the tokens issued to a user from outliving a change
+// of its credentials: a password change, the account disabled, or a logout
+// from everywhere bump the credentials version of the user, and tokens
+// carrying an older one are refused.
+
+import (
+	"errors"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+)
+
+// DefaultCredentialsEntries bounds the versions a CredentialsCache holds
+const DefaultCredentialsEntries = 10000
+
+// CredentialsCache is the auth.CredentialsVersions of an issuer, reading the
+// versions of users from the database and remembering each for a while, so
+// authenticating a request does not read the user every time. A version the
+// service bumps is forgotten at once on this replica, other replicas see it
+// once their copy expires.
+type CredentialsCache struct {
+	db    db.Database
+	cache *lru
+}
+
+// NewCredentialsCache returns a CredentialsCache over d remembering versions
+// for ttl; a ttl of 0 reads the database on every check
+func NewCredentialsCache(d db.Database, ttl time.Duration) *CredentialsCache {
+	return &CredentialsCache{db: d, cache: newLRU(ttl, DefaultCredentialsEntries, time.Now)}
+}
+
+// CredentialsVersion returns the credentials version of the user. Users
+// that do not exist, as tokens may outlive their user, are at version 0.
+func (c *CredentialsCache) CredentialsVersion(userID string) (int64, error) {
+	key := "customers/" + userID
+	if v, ok := c.cache.get(key); ok {
+		return v.(int64), nil
+	}
+	gen := c.cache.generation()
+	u, err := c.db.GetUser(userID)
+	if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrInvalidHexID) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	c.cache.add(key, u.CredentialsVersion, gen)
+	return u.CredentialsVersion, nil
+}
+
+// forget drops the version of the user, once it was bumped
+func (c *CredentialsCache) forget(userID string) {
+	c.cache.drop("customers/" + userID)
+}
+
+// revokeCredentials bumps the credentials version of the user, so the tokens
+// and sessions issued to it before are refused, and revokes its refresh
+// tokens
+func (s *fixedService) revokeCredentials(id string) error {
+	if err := s.db.BumpCredentialsVersion(id); err != nil {
+		return notFound(err, "customers", id)
+	}
+	if s.tokens != nil {
+		if c, ok := s.tokens.Credentials.(*CredentialsCache); ok {
+			c.forget(id)
+		}
+	}
+	return s.db.RevokeRefreshTokens(id)
+}
+
+// LogoutAll ends every session of the user, audited as done by principal
+func (s *fixedService) LogoutAll(id, principal string) error {
+	if err := s.revokeCredentials(id); err != nil {
+		return serviceError(err)
+	}
+	return s.audit("logout-all", "customers", id, principal)
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestRevokeCredentials(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := memory.New()
+	issuer.Credentials = NewCredentialsCache(d, time.Minute)
+	s := NewFixedService(d, WithTokenIssuer(issuer), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	id, _ := s.Register("revoked", "password", "revoked@example.com", "first", "last", "", "")
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer), log.NewNopLogger())
+	do := func(method, path, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	login := func(password string) (string, string) {
+		_, token, err := s.Login("revoked", password, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		refresh, err := s.CreateRefreshToken(id, "phone")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token, refresh
+	}
+	refused := func(why, token, refresh string) {
+		t.Helper()
+		if code := do("GET", "/customers/"+id+"/emails", token); code != http.StatusUnauthorized {
+			t.Errorf("Expected the token refused after %v, received %v", why, code)
+		}
+		if _, _, err := s.Refresh(refresh); !errors.Is(err, ErrUnauthorized) {
+			t.Errorf("Expected the refresh token revoked after %v, received %v", why, err)
+		}
+	}
+
+	token, refresh := login("password")
+	if code := do("GET", "/customers/"+id+"/emails", token); code != http.StatusOK {
+		t.Fatalf("Expected the token accepted, received %v", code)
+	}
+	if err := s.ChangePassword(id, "password", "changed password"); err != nil {
+		t.Fatal(err)
+	}
+	refused("a password change", token, refresh)
+
+	token, refresh = login("changed password")
+	if code := do("POST", "/customers/"+id+"/logout-all", token); code != http.StatusOK {
+		t.Fatalf("Expected logout from everywhere, received %v", code)
+	}
+	refused("a logout from everywhere", token, refresh)
+
+	token, refresh = login("changed password")
+	if code := do("GET", "/customers/"+id+"/emails", token); code != http.StatusOK {
+		t.Fatalf("Expected a new login accepted, received %v", code)
+	}
+	if _, err := s.SetStatus(id, users.StatusDisabled, "compromised", ""); err != nil {
+		t.Fatal(err)
+	}
+	refused("the account disabled", token, refresh)
+
+	other, _ := s.Register("other", "password", "other@example.com", "first", "last", "", "")
+	_, otherToken, _ := s.Login("other", "password", false)
+	if code := do("POST", "/customers/"+id+"/logout-all", otherToken); code != http.StatusForbidden {
+		t.Errorf("Expected the sessions of others kept, received %v", code)
+	}
+	if code := do("GET", "/customers/"+other+"/emails", otherToken); code != http.StatusOK {
+		t.Errorf("Expected the tokens of others accepted, received %v", code)
+	}
+
+	support := storeAdmin(t, s, "support")
+	adminToken, _ := issuer.Issue(support, "support", auth.RoleAdmin)
+	if code := do("POST", "/customers/"+other+"/logout-all", adminToken); code != http.StatusOK {
+		t.Fatalf("Expected an admin to end the sessions of others, received %v", code)
+	}
+	entries := d.AuditLog()
+	if e := entries[len(entries)-1]; e.Action != "logout-all" || e.ID != other || e.Principal != support {
+		t.Errorf("Expected the logout audited as done by the admin, received %+v", e)
+	}
+}
@@ -0,0 +1,80 @@
+package api
+
+// debug.go contains the profiling handlers, served on a port of their own
+// and only when asked for, since profiles reveal much about the process.
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/microservices-demo/user/auth"
+)
+
+var processStart = time.Now()
+
+// MakeDebugHandler returns the handler of the debug port, serving the
+// net/http/pprof profiles under /debug/pprof/ and the published expvar
+// variables, build info and runtime stats under /debug/vars. With keys, every
+// request must carry one of them granted auth.ScopeAdmin in the X-API-Key
+// header.
+func MakeDebugHandler(keys *auth.APIKeys) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/debug/vars", serveVars)
+	return requireScopedKey(keys, auth.ScopeAdmin, mux)
+}
+
+// runtimeVars are the runtime stats of /debug/vars
+type runtimeVars struct {
+	Version      string  `json:"version"`
+	Goroutines   int     `json:"goroutines"`
+	GOMAXPROCS   int     `json:"gomaxprocs"`
+	HeapAlloc    uint64  `json:"heapAlloc"`
+	HeapObjects  uint64  `json:"heapObjects"`
+	Sys          uint64  `json:"sys"`
+	NumGC        uint32  `json:"numGC"`
+	PauseTotalNs uint64  `json:"pauseTotalNs"`
+	Uptime       float64 `json:"uptimeSeconds"`
+}
+
+// serveVars writes the expvar variables, with build and runtime added
+func serveVars(w http.ResponseWriter, _ *http.Request) {
+	vars := map[string]interface{}{}
+	expvar.Do(func(kv expvar.KeyValue) {
+		vars[kv.Key] = json.RawMessage(kv.Value.String())
+	})
+	if info, ok := debug.ReadBuildInfo(); ok {
+		build := map[string]string{"go": info.GoVersion, "path": info.Path, "version": info.Main.Version}
+		for _, s := range info.Settings {
+			switch s.Key {
+			case "vcs.revision", "vcs.time", "vcs.modified":
+				build[s.Key] = s.Value
+			}
+		}
+		vars["build"] = build
+	}
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	vars["runtime"] = runtimeVars{
+		Version:      runtime.Version(),
+		Goroutines:   runtime.NumGoroutine(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapObjects:  mem.HeapObjects,
+		Sys:          mem.Sys,
+		NumGC:        mem.NumGC,
+		PauseTotalNs: mem.PauseTotalNs,
+		Uptime:       time.Since(processStart).Seconds(),
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(vars)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/microservices-demo/user/auth"
+)
+
+func TestDebugHandler(t *testing.T) {
+	t.Setenv("TEST_API_KEYS", "ops="+auth.HashAPIKey("key")+":admin,exporter="+auth.HashAPIKey("exporter"))
+	keys, err := auth.LoadAPIKeys("", "TEST_API_KEYS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := MakeDebugHandler(keys)
+	serve := func(path, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, key := range []string{"", "wrong"} {
+		if rec := serve("/debug/pprof/", key); rec.Code != http.StatusUnauthorized {
+			t.Errorf("Expected key %q refused with 401, received %v", key, rec.Code)
+		}
+	}
+	if rec := serve("/debug/pprof/", "exporter"); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected a key without the admin scope refused with 403, received %v", rec.Code)
+	}
+	if rec := serve("/debug/pprof/", "key"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the profile index served, received %v", rec.Code)
+	}
+	if rec := serve("/debug/pprof/goroutine?debug=1", "key"); rec.Code != http.StatusOK {
+		t.Errorf("Expected the goroutine profile served, received %v", rec.Code)
+	}
+
+	rec := serve("/debug/vars", "key")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the vars served, received %v", rec.Code)
+	}
+	var vars struct {
+		Runtime  runtimeVars     `json:"runtime"`
+		MemStats json.RawMessage `json:"memstats"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Runtime.Goroutines == 0 || vars.Runtime.Version == "" {
+		t.Errorf("Expected runtime stats, received %+v", vars.Runtime)
+	}
+	if len(vars.MemStats) == 0 {
+		t.Error("Expected the expvar memstats")
+	}
+
+	if rec := serve("/customers", "key"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected only debug paths served, received %v", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	MakeDebugHandler(nil).ServeHTTP(rec, httptest.NewRequest("GET", "/debug/vars", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected the vars served without keys configured, received %v", rec.Code)
+	}
+}
@@ -0,0 +1,157 @@
+package api
+
+// emails.go contains the emails of a customer besides the primary one: their
+// addition, verification by a code mailed to the address, removal, and the
+// promotion of a verified email to primary.
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+)
+
+// errWrongEmailCode is returned for a verification code not matching that of
+// the email
+var errWrongEmailCode = users.FieldErrors{{Field: "code", Code: users.FieldInvalid, Message: "Code is not the one sent to the address"}}
+
+// errEmailNotUpdatable is returned for a profile update changing the primary
+// email, which only a verified email made primary replaces
+var errEmailNotUpdatable = users.FieldErrors{{Field: "email", Code: users.FieldInvalid, Message: "The email is changed by adding and verifying another, then making it primary"}}
+
+// GetEmails lists the emails of the user, the primary first
+func (s *fixedService) GetEmails(id string) ([]users.EmailAddress, error) {
+	u, err := s.db.GetUser(id)
+	if err != nil {
+		return nil, notFound(err, "customers", id)
+	}
+	return u.EmailList(), nil
+}
+
+// emailAttempts bounds the reads of a user whose emails keep changing while
+// they are changed
+const emailAttempts = 3
+
+// updateEmails reads the user, lets change change its emails and stores
+// them, provided the user did not change meanwhile; when it did, the user is
+// read and changed again. It returns the user as stored.
+func (s *fixedService) updateEmails(id string, change func(u *users.User) error) (users.User, error) {
+	for attempt := 1; ; attempt++ {
+		u, err := s.db.GetUser(id)
+		if err != nil {
+			return users.New(), notFound(err, "customers", id)
+		}
+		if err := change(&u); err != nil {
+			return users.New(), err
+		}
+		err = s.db.SetUserEmails(id, u.Email, u.Emails, u.Version)
+		if errors.Is(err, db.ErrVersionMismatch) && attempt < emailAttempts {
+			continue
+		}
+		if err != nil {
+			return users.New(), notFound(err, "customers", id)
+		}
+		return u, nil
+	}
+}
+
+// AddEmail adds an unverified email to the user, returning its emails and
+// the code verifying the address, to be mailed to it. Adding an unverified
+// email the user holds, the primary included, replaces its code.
+func (s *fixedService) AddEmail(id, address string) ([]users.EmailAddress, string, error) {
+	if err := users.ValidateEmail(address); err != nil {
+		return nil, "", err
+	}
+	codes, hashes, err := auth.NewRecoveryCodes(1)
+	if err != nil {
+		return nil, "", err
+	}
+	u, err := s.updateEmails(id, func(u *users.User) error {
+		k := u.FindEmail(address)
+		switch {
+		case k >= 0 && u.Emails[k].Verified:
+			return db.AlreadyExistsError{Field: "email"}
+		case k >= 0:
+			u.Emails[k].CodeHash = hashes[0]
+		case len(u.EmailList()) >= users.MaxEmails && !users.SameEmail(address, u.Email):
+			return users.FieldErrors{{Field: "address", Code: users.FieldTooLong, Message: fmt.Sprintf("A customer holds at most %v emails", users.MaxEmails)}}
+		default:
+			u.Emails = append(u.Emails, users.EmailAddress{Address: address, CodeHash: hashes[0]})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return u.EmailList(), codes[0], nil
+}
+
+// VerifyEmail marks the email of the user verified when code is the one
+// AddEmail returned for it
+func (s *fixedService) VerifyEmail(id, address, code string) ([]users.EmailAddress, error) {
+	hash := auth.HashRecoveryCode(code)
+	u, err := s.updateEmails(id, func(u *users.User) error {
+		k := u.FindEmail(address)
+		if k < 0 {
+			return db.NotFoundError{Entity: "emails", ID: address}
+		}
+		if u.Emails[k].Verified {
+			return nil
+		}
+		if u.Emails[k].CodeHash == "" || subtle.ConstantTimeCompare([]byte(hash), []byte(u.Emails[k].CodeHash)) != 1 {
+			return errWrongEmailCode
+		}
+		u.Emails[k].Verified = true
+		u.Emails[k].CodeHash = ""
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u.EmailList(), nil
+}
+
+// RemoveEmail removes an email of the user other than its primary
+func (s *fixedService) RemoveEmail(id, address string) ([]users.EmailAddress, error) {
+	u, err := s.updateEmails(id, func(u *users.User) error {
+		if users.SameEmail(address, u.Email) {
+			return users.FieldErrors{{Field: "address", Code: users.FieldInvalid, Message: "The primary email cannot be removed, make another primary first"}}
+		}
+		k := u.FindEmail(address)
+		if k < 0 {
+			return db.NotFoundError{Entity: "emails", ID: address}
+		}
+		u.Emails = append(u.Emails[:k], u.Emails[k+1:]...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return u.EmailList(), nil
+}
+
+// SetPrimaryEmail makes a verified email of the user its primary one, the
+// former primary staying among its emails
+func (s *fixedService) SetPrimaryEmail(id, address string) (users.User, error) {
+	_, err := s.updateEmails(id, func(u *users.User) error {
+		k := u.FindEmail(address)
+		if k < 0 {
+			return db.NotFoundError{Entity: "emails", ID: address}
+		}
+		if !u.Emails[k].Verified {
+			return users.FieldErrors{{Field: "address", Code: users.FieldUnverified, Message: "Only a verified email can be made primary"}}
+		}
+		if u.Email != "" && u.FindEmail(u.Email) < 0 {
+			u.Emails = append(u.Emails, users.EmailAddress{Address: u.Email})
+		}
+		u.Email = u.Emails[k].Address
+		return nil
+	})
+	if err != nil {
+		return users.New(), err
+	}
+	return s.GetUser(id)
+}
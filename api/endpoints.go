@@ -6,283 +6,725 @@ package api
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/tracing/opentracing"
+	"github.com/go-kit/kit/log/level"
+	"github.com/microservices-demo/user/auth"
 	"github.com/microservices-demo/user/db"
 	"github.com/microservices-demo/user/users"
-	stdopentracing "github.com/opentracing/opentracing-go"
-	zipkinot "github.com/openzipkin-contrib/zipkin-go-opentracing"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Method names of the endpoints, shared by their log lines and metrics
+const (
+	methodLogin          = "Login"
+	methodLoginMFA       = "LoginMFA"
+	methodRefresh        = "Refresh"
+	methodLogout         = "Logout"
+	methodLogoutAll      = "LogoutAll"
+	methodImpersonate    = "Impersonate"
+	methodRegister       = "Register"
+	methodGetUsers       = "GetUsers"
+	methodPostUser       = "PostUser"
+	methodPutUser        = "PutUser"
+	methodPatchUser      = "PatchUser"
+	methodChangePassword = "ChangePassword"
+	methodSetRoles       = "SetRoles"
+	methodSetStatus      = "SetStatus"
+	methodSetPreferences = "SetPreferences"
+	methodProvisionMFA   = "ProvisionMFA"
+	methodConfirmMFA     = "ConfirmMFA"
+	methodDisableMFA     = "DisableMFA"
+	methodGetAddresses   = "GetAddresses"
+	methodPostAddress    = "PostAddress"
+	methodSetDefault     = "SetDefaultAddress"
+	methodGetCards       = "GetCards"
+	methodPostCard       = "PostCard"
+	methodSetCardLabel   = "SetCardLabel"
+	methodDefaultCard    = "SetDefaultCard"
+	methodMerge          = "MergeAttributes"
+	methodGetEmails      = "GetEmails"
+	methodAddEmail       = "AddEmail"
+	methodVerifyEmail    = "VerifyEmail"
+	methodRemoveEmail    = "RemoveEmail"
+	methodPrimaryEmail   = "SetPrimaryEmail"
+	methodGetConsents    = "GetConsents"
+	methodSetConsents    = "SetConsents"
+	methodDelete         = "Delete"
 )
 
 // Endpoints collects the endpoints that comprise the Service.
 type Endpoints struct {
-	LoginEndpoint       endpoint.Endpoint
-	RegisterEndpoint    endpoint.Endpoint
-	UserGetEndpoint     endpoint.Endpoint
-	UserPostEndpoint    endpoint.Endpoint
-	AddressGetEndpoint  endpoint.Endpoint
-	AddressPostEndpoint endpoint.Endpoint
-	CardGetEndpoint     endpoint.Endpoint
-	CardPostEndpoint    endpoint.Endpoint
-	DeleteEndpoint      endpoint.Endpoint
-	HealthEndpoint      endpoint.Endpoint
+	LoginEndpoint        endpoint.Endpoint
+	LoginMFAEndpoint     endpoint.Endpoint
+	RegisterEndpoint     endpoint.Endpoint
+	UserGetEndpoint      endpoint.Endpoint
+	UserPostEndpoint     endpoint.Endpoint
+	UserPutEndpoint      endpoint.Endpoint
+	UserPatchEndpoint    endpoint.Endpoint
+	PasswordEndpoint     endpoint.Endpoint
+	RolesEndpoint        endpoint.Endpoint
+	StatusEndpoint       endpoint.Endpoint
+	PreferencesEndpoint  endpoint.Endpoint
+	MFAProvisionEndpoint endpoint.Endpoint
+	MFAConfirmEndpoint   endpoint.Endpoint
+	MFADisableEndpoint   endpoint.Endpoint
+	RefreshEndpoint      endpoint.Endpoint
+	LogoutEndpoint       endpoint.Endpoint
+	LogoutAllEndpoint    endpoint.Endpoint
+	ImpersonateEndpoint  endpoint.Endpoint
+	AddressGetEndpoint   endpoint.Endpoint
+	AddressPostEndpoint  endpoint.Endpoint
+	DefaultEndpoint      endpoint.Endpoint
+	CardGetEndpoint      endpoint.Endpoint
+	CardPostEndpoint     endpoint.Endpoint
+	CardLabelEndpoint    endpoint.Endpoint
+	CardDefaultEndpoint  endpoint.Endpoint
+	MergeEndpoint        endpoint.Endpoint
+	EmailsGetEndpoint    endpoint.Endpoint
+	EmailAddEndpoint     endpoint.Endpoint
+	EmailVerifyEndpoint  endpoint.Endpoint
+	EmailRemoveEndpoint  endpoint.Endpoint
+	EmailPrimaryEndpoint endpoint.Endpoint
+	ConsentsGetEndpoint  endpoint.Endpoint
+	ConsentsSetEndpoint  endpoint.Endpoint
+	DeleteEndpoint       endpoint.Endpoint
+	HealthEndpoint       endpoint.Endpoint
+	ReadyEndpoint        endpoint.Endpoint
 }
 
 // MakeEndpoints returns an Endpoints structure, where each endpoint is
-// backed by the given service.
-func MakeEndpoints(s Service, tracer stdopentracing.Tracer, logger log.Logger) Endpoints {
+// backed by the given service. Mutating endpoints require a bearer token
+// verified by issuer; a nil issuer leaves them open. Panics in endpoints are
+// logged and answered as internal errors. Requests are logged, and recorded
+// in the metrics of WithEndpointMetrics, under the method of their endpoint.
+func MakeEndpoints(s Service, tracer trace.Tracer, logger log.Logger, issuer *auth.Issuer, opts ...EndpointsOption) Endpoints {
+	cfg := endpointsConfig{readyTimeout: DefaultReadyTimeout}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	// Create logging middleware that extracts trace info
 	loggingMiddleware := func(method string) endpoint.Middleware {
 		return func(next endpoint.Endpoint) endpoint.Endpoint {
+			next = impersonation(issuer, s, method, cfg.impersonatedWrites)(next)
+			next = recoverPanic(next, cfg.panics)
+			if cfg.metrics != nil {
+				next = instrument(next, method, *cfg.metrics)
+			}
 			return func(ctx context.Context, request interface{}) (interface{}, error) {
 				begin := time.Now()
+				if cfg.userBaggage {
+					ctx = dropUserBaggage(ctx)
+				}
+				requestID, _ := RequestIDFromContext(ctx)
+				if requestID != "" {
+					tagSpan(ctx, "request_id", requestID)
+				}
 				response, err := next(ctx, request)
 
-				// Extract trace information from context
-				span := stdopentracing.SpanFromContext(ctx)
-				traceid := ""
-				spanid := ""
-				if span != nil {
-					if sc, ok := span.Context().(zipkinot.SpanContext); ok {
-						// Format trace ID - use Low part for 64-bit trace IDs
-						traceid = fmt.Sprintf("%x", sc.TraceID.Low)
-						// Format span ID - this is the server span ID created by TraceServer
-						spanid = fmt.Sprintf("%x", uint64(sc.ID))
-					}
-				}
+				// Extract trace information from context, the span being
+				// the server span created by traceServer
+				traceid := traceID(ctx)
+				spanid := spanID(ctx)
 
 				// Build log message
 				logArgs := []interface{}{
 					"traceid", traceid,
+					"traceid_short", shortTraceID(ctx),
 					"spanid", spanid,
+					"request_id", requestID,
 					"method", method,
 				}
 
-				// Add request-specific fields based on method
-				logArgs = appendRequestFields(logArgs, method, request, response, err)
+				// Keep the cause of authentication failures out of the
+				// response but in the logs
+				var ae AuthError
+				if errors.As(err, &ae) {
+					logArgs = append(logArgs, "reason", ae.Reason)
+				}
+				var se ServiceError
+				if errors.As(err, &se) && se.Kind == ErrUnavailable {
+					logArgs = append(logArgs, "cause", se.Err.Error())
+				}
+				var pe PanicError
+				if errors.As(err, &pe) {
+					logArgs = append(logArgs, "panic", fmt.Sprint(pe.Value), "stack", string(pe.Stack))
+				}
 
-				// Add error if present
+				// Add the status an error is answered with, misses apart
+				// from failures. The error itself and the time taken are
+				// logged by the logging middleware of the service, on a
+				// line with the same traceid and request_id.
 				if err != nil {
-					logArgs = append(logArgs, "err", err.Error())
-				} else {
-					logArgs = append(logArgs, "err", "null")
+					logArgs = append(logArgs, "status", errorStatus(err))
+					if kind := db.ErrorKind(err); kind == db.KindNotFound {
+						logArgs = append(logArgs, "result", kind)
+					} else {
+						logArgs = append(logArgs, "error_kind", kind)
+					}
 				}
 
-				// Add duration
-				logArgs = append(logArgs, "took", fmt.Sprintf("%v", time.Since(begin)))
-
-				logger.Log(logArgs...)
+				took := time.Since(begin)
+				requestLogger(logger, err).Log(logArgs...)
+				level.Debug(logger).Log("traceid", traceid, "request_id", requestID, "method", method,
+					"request", dump{request}, "response", dump{response})
+				reportSlow(cfg, logger, method, traceid, request, took)
 				return response, err
 			}
 		}
 	}
 
-	return Endpoints{
-		LoginEndpoint:       opentracing.TraceServer(tracer, "GET /login")(loggingMiddleware("Login")(MakeLoginEndpoint(s))),
-		RegisterEndpoint:    opentracing.TraceServer(tracer, "POST /register")(loggingMiddleware("Register")(MakeRegisterEndpoint(s))),
-		HealthEndpoint:      MakeHealthEndpoint(s), // No tracing for health checks
-		UserGetEndpoint:     opentracing.TraceServer(tracer, "GET /customers")(loggingMiddleware("GetUsers")(MakeUserGetEndpoint(s))),
-		UserPostEndpoint:    opentracing.TraceServer(tracer, "POST /customers")(loggingMiddleware("PostUser")(MakeUserPostEndpoint(s))),
-		AddressGetEndpoint:  opentracing.TraceServer(tracer, "GET /addresses")(loggingMiddleware("GetAddresses")(MakeAddressGetEndpoint(s))),
-		AddressPostEndpoint: opentracing.TraceServer(tracer, "POST /addresses")(loggingMiddleware("PostAddress")(MakeAddressPostEndpoint(s))),
-		CardGetEndpoint:     opentracing.TraceServer(tracer, "GET /cards")(loggingMiddleware("GetCards")(MakeCardGetEndpoint(s))),
-		DeleteEndpoint:      opentracing.TraceServer(tracer, "DELETE /")(loggingMiddleware("Delete")(MakeDeleteEndpoint(s))),
-		CardPostEndpoint:    opentracing.TraceServer(tracer, "POST /cards")(loggingMiddleware("PostCard")(MakeCardPostEndpoint(s))),
-	}
-}
-
-// appendRequestFields adds method-specific fields to log output
-func appendRequestFields(logArgs []interface{}, method string, request interface{}, response interface{}, err error) []interface{} {
-	switch method {
-	case "GetUsers":
-		req := request.(GetRequest)
-		id := req.ID
-		if id == "" {
-			id = "all"
+	authenticate := func(role string, owner ownerFunc) endpoint.Middleware {
+		if cfg.userBaggage {
+			return endpoint.Chain(authenticationMiddleware(issuer, role, owner), userBaggage)
 		}
-		logArgs = append(logArgs, "id", id)
-		if err == nil {
-			if usersResp, ok := response.(EmbedStruct); ok {
-				if ur, ok := usersResp.Embed.(usersResponse); ok {
-					logArgs = append(logArgs, "result", len(ur.Users))
-				}
-			} else if user, ok := response.(users.User); ok {
-				if user.UserID != "" {
-					logArgs = append(logArgs, "result", 1)
-				} else {
-					logArgs = append(logArgs, "result", 0)
-				}
-			}
-		}
-	case "GetAddresses":
-		req := request.(GetRequest)
-		id := req.ID
-		if id == "" {
-			id = "all"
-		}
-		logArgs = append(logArgs, "id", id)
-		if err == nil {
-			if addrsResp, ok := response.(EmbedStruct); ok {
-				if ar, ok := addrsResp.Embed.(addressesResponse); ok {
-					logArgs = append(logArgs, "result", len(ar.Addresses))
-				}
-			}
+		return authenticationMiddleware(issuer, role, owner)
+	}
+	userID := func(request interface{}) string {
+		switch req := request.(type) {
+		case userPutRequest:
+			return req.ID
+		case userPatchRequest:
+			return req.ID
+		case passwordRequest:
+			return req.ID
+		case logoutAllRequest:
+			return req.ID
+		case mfaRequest:
+			return req.ID
+		case preferencesRequest:
+			return req.ID
+		case defaultAddressRequest:
+			return req.ID
+		case cardLabelRequest:
+			return req.ID
+		case defaultCardRequest:
+			return req.ID
+		case mergeRequest:
+			return req.ID
+		case emailRequest:
+			return req.ID
+		case consentsRequest:
+			return req.ID
+		case addressPostRequest:
+			return req.UserID
+		case cardPostRequest:
+			return req.UserID
 		}
-	case "GetCards":
-		req := request.(GetRequest)
-		id := req.ID
-		if id == "" {
-			id = "all"
+		return ""
+	}
+
+	return Endpoints{
+		LoginEndpoint:        traceServer(tracer, "GET /login")(loggingMiddleware(methodLogin)(MakeLoginEndpoint(s))),
+		LoginMFAEndpoint:     traceServer(tracer, "POST /login/mfa")(loggingMiddleware(methodLoginMFA)(MakeLoginMFAEndpoint(s))),
+		RefreshEndpoint:      traceServer(tracer, "POST /token/refresh")(loggingMiddleware(methodRefresh)(MakeRefreshEndpoint(s))),
+		LogoutEndpoint:       traceServer(tracer, "POST /logout")(loggingMiddleware(methodLogout)(MakeLogoutEndpoint(s))),
+		RegisterEndpoint:     traceServer(tracer, "POST /register")(loggingMiddleware(methodRegister)(MakeRegisterEndpoint(s))),
+		HealthEndpoint:       recoverPanic(MakeHealthEndpoint(s), cfg.panics), // No tracing for health checks
+		ReadyEndpoint:        recoverPanic(MakeReadyEndpoint(s, cfg.readyTimeout), cfg.panics),
+		UserGetEndpoint:      traceServer(tracer, "GET /customers")(loggingMiddleware(methodGetUsers)(MakeUserGetEndpoint(s))),
+		UserPostEndpoint:     traceServer(tracer, "POST /customers")(loggingMiddleware(methodPostUser)(authenticate("", nil)(MakeUserPostEndpoint(s)))),
+		UserPutEndpoint:      traceServer(tracer, "PUT /customers")(loggingMiddleware(methodPutUser)(authenticate("", sameUser(userID))(MakeUserPutEndpoint(s)))),
+		UserPatchEndpoint:    traceServer(tracer, "PATCH /customers")(loggingMiddleware(methodPatchUser)(authenticate("", sameUser(userID))(MakeUserPatchEndpoint(s)))),
+		PasswordEndpoint:     traceServer(tracer, "POST /customers/password")(loggingMiddleware(methodChangePassword)(authenticate("", sameUser(userID))(MakePasswordEndpoint(s)))),
+		LogoutAllEndpoint:    traceServer(tracer, "POST /customers/logout-all")(loggingMiddleware(methodLogoutAll)(authenticate("", sameUser(userID))(MakeLogoutAllEndpoint(s)))),
+		ImpersonateEndpoint:  traceServer(tracer, "POST /admin/impersonate")(loggingMiddleware(methodImpersonate)(RequireAPIKey(cfg.impersonationKeys)(authenticate(auth.RoleAdmin, nil)(storedRole(s, users.RoleAdmin)(MakeImpersonateEndpoint(s)))))),
+		RolesEndpoint:        traceServer(tracer, "PUT /customers/roles")(loggingMiddleware(methodSetRoles)(authenticate(auth.RoleAdmin, nil)(storedRole(s, users.RoleAdmin)(MakeRolesEndpoint(s))))),
+		StatusEndpoint:       traceServer(tracer, "PUT /customers/status")(loggingMiddleware(methodSetStatus)(authenticate(auth.RoleAdmin, nil)(storedRole(s, users.RoleAdmin)(MakeStatusEndpoint(s))))),
+		PreferencesEndpoint:  traceServer(tracer, "PUT /customers/preferences")(loggingMiddleware(methodSetPreferences)(authenticate("", sameUser(userID))(MakePreferencesEndpoint(s)))),
+		MFAProvisionEndpoint: traceServer(tracer, "POST /customers/mfa")(loggingMiddleware(methodProvisionMFA)(authenticate(auth.RoleAdmin, sameUser(userID))(MakeMFAProvisionEndpoint(s)))),
+		MFAConfirmEndpoint:   traceServer(tracer, "POST /customers/mfa/confirm")(loggingMiddleware(methodConfirmMFA)(authenticate("", sameUser(userID))(MakeMFAConfirmEndpoint(s)))),
+		MFADisableEndpoint:   traceServer(tracer, "POST /customers/mfa/disable")(loggingMiddleware(methodDisableMFA)(authenticate("", sameUser(userID))(MakeMFADisableEndpoint(s)))),
+		AddressGetEndpoint:   traceServer(tracer, "GET /addresses")(loggingMiddleware(methodGetAddresses)(MakeAddressGetEndpoint(s))),
+		AddressPostEndpoint:  traceServer(tracer, "POST /addresses")(loggingMiddleware(methodPostAddress)(authenticate("", sameUser(userID))(MakeAddressPostEndpoint(s)))),
+		DefaultEndpoint:      traceServer(tracer, "POST /customers/addresses/default")(loggingMiddleware(methodSetDefault)(authenticate("", sameUser(userID))(MakeDefaultAddressEndpoint(s)))),
+		CardGetEndpoint:      traceServer(tracer, "GET /cards")(loggingMiddleware(methodGetCards)(MakeCardGetEndpoint(s))),
+		DeleteEndpoint:       traceServer(tracer, "DELETE /")(loggingMiddleware(methodDelete)(authenticate("", adminDeletesCustomers)(MakeDeleteEndpoint(s)))),
+		CardPostEndpoint:     traceServer(tracer, "POST /cards")(loggingMiddleware(methodPostCard)(authenticate("", sameUser(userID))(MakeCardPostEndpoint(s)))),
+		CardLabelEndpoint:    traceServer(tracer, "PATCH /customers/cards")(loggingMiddleware(methodSetCardLabel)(authenticate("", sameUser(userID))(MakeCardLabelEndpoint(s)))),
+		CardDefaultEndpoint:  traceServer(tracer, "POST /customers/cards/default")(loggingMiddleware(methodDefaultCard)(authenticate("", sameUser(userID))(MakeCardDefaultEndpoint(s)))),
+		MergeEndpoint:        traceServer(tracer, "POST /customers/merge")(loggingMiddleware(methodMerge)(authenticate("", sameUser(userID))(MakeMergeEndpoint(s)))),
+		EmailsGetEndpoint:    traceServer(tracer, "GET /customers/emails")(loggingMiddleware(methodGetEmails)(authenticate("", sameUser(userID))(MakeEmailsGetEndpoint(s)))),
+		EmailAddEndpoint:     traceServer(tracer, "POST /customers/emails")(loggingMiddleware(methodAddEmail)(authenticate("", sameUser(userID))(MakeEmailAddEndpoint(s)))),
+		EmailVerifyEndpoint:  traceServer(tracer, "POST /customers/emails/verify")(loggingMiddleware(methodVerifyEmail)(authenticate("", sameUser(userID))(MakeEmailVerifyEndpoint(s)))),
+		EmailRemoveEndpoint:  traceServer(tracer, "DELETE /customers/emails")(loggingMiddleware(methodRemoveEmail)(authenticate("", sameUser(userID))(MakeEmailRemoveEndpoint(s)))),
+		EmailPrimaryEndpoint: traceServer(tracer, "POST /customers/emails/primary")(loggingMiddleware(methodPrimaryEmail)(authenticate("", sameUser(userID))(MakeEmailPrimaryEndpoint(s)))),
+		ConsentsGetEndpoint:  traceServer(tracer, "GET /customers/consents")(loggingMiddleware(methodGetConsents)(authenticate("", sameUser(userID))(MakeConsentsGetEndpoint(s)))),
+		ConsentsSetEndpoint:  traceServer(tracer, "PUT /customers/consents")(loggingMiddleware(methodSetConsents)(authenticate("", sameUser(userID))(MakeConsentsSetEndpoint(s)))),
+	}
+}
+
+// MakeLoginEndpoint returns an endpoint via the given service.
+func MakeLoginEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(loginRequest)
+		u, token, err := s.Login(req.Username, req.Password, req.Attributes)
+		var mfa MFARequiredError
+		if errors.As(err, &mfa) {
+			return mfaRequiredResponse{MFARequired: true, Challenge: mfa.Challenge}, nil
 		}
-		logArgs = append(logArgs, "id", id)
-		if err == nil {
-			if cardsResp, ok := response.(EmbedStruct); ok {
-				if cr, ok := cardsResp.Embed.(cardsResponse); ok {
-					logArgs = append(logArgs, "result", len(cr.Cards))
-				}
-			}
+		res := userResponse{User: u, Token: token}
+		if req.Attributes && err == nil {
+			res.Embedded = &userAttributes{Addresses: u.Addresses, Cards: u.Cards}
 		}
-	case "PostUser", "PostAddress", "PostCard", "Register":
-		if err == nil {
-			if pr, ok := response.(postResponse); ok {
-				logArgs = append(logArgs, "result", pr.ID)
-			}
+		if err != nil || !req.Remember || token == "" {
+			return res, err
 		}
-	case "Delete":
-		req := request.(deleteRequest)
-		logArgs = append(logArgs, "entity", req.Entity, "id", req.ID)
-		if err == nil {
-			if sr, ok := response.(statusResponse); ok {
-				logArgs = append(logArgs, "result", sr.Status)
-			}
+		res.RefreshToken, err = s.CreateRefreshToken(u.UserID, req.Device)
+		return res, err
+	}
+}
+
+// merge links the guest addresses and cards to the customer, returning nil
+// when there are none
+func merge(s Service, id, session string, addresses, cards []string) *MergeResult {
+	if len(addresses) == 0 && len(cards) == 0 {
+		return nil
+	}
+	r := s.MergeAttributes(id, session, addresses, cards)
+	return &r
+}
+
+// MakeMergeEndpoint returns an endpoint via the given service.
+func MakeMergeEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(mergeRequest)
+		return s.MergeAttributes(req.ID, req.GuestSession, req.GuestAddresses, req.GuestCards), nil
+	}
+}
+
+// MakeLoginMFAEndpoint returns an endpoint via the given service.
+func MakeLoginMFAEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(loginMFARequest)
+		u, token, err := s.LoginMFA(req.Challenge, req.Code)
+		if err != nil || !req.Remember || token == "" {
+			return userResponse{User: u, Token: token}, err
 		}
+		refresh, err := s.CreateRefreshToken(u.UserID, req.Device)
+		return userResponse{User: u, Token: token, RefreshToken: refresh}, err
 	}
-	return logArgs
 }
 
-// MakeLoginEndpoint returns an endpoint via the given service.
-func MakeLoginEndpoint(s Service) endpoint.Endpoint {
+// MakeLogoutEndpoint returns an endpoint via the given service.
+func MakeLogoutEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		db.SetTraceContext(ctx)
-		req := request.(loginRequest)
-		u, err := s.Login(req.Username, req.Password)
-		return userResponse{User: u}, err
+		s := withContext(s, ctx)
+		req := request.(logoutRequest)
+		err = s.Logout(req.RefreshToken, req.AccessToken)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeRefreshEndpoint returns an endpoint via the given service.
+func MakeRefreshEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(refreshRequest)
+		token, refresh, err := s.Refresh(req.RefreshToken)
+		return tokenResponse{Token: token, RefreshToken: refresh}, err
 	}
 }
 
-// MakeRegisterEndpoint returns an endpoint via the given service.
+// MakeRegisterEndpoint returns an endpoint via the given service. The
+// consents given along are recorded once the customer is registered; should
+// that fail, the customer has consented to nothing, as without them.
 func MakeRegisterEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		db.SetTraceContext(ctx)
+		s := withContext(s, ctx)
 		req := request.(registerRequest)
-		id, err := s.Register(req.Username, req.Password, req.Email, req.FirstName, req.LastName)
-		return postResponse{ID: id}, err
+		if len(req.Consents) > 0 {
+			if _, err := users.NewConsentRecords(req.Consents, users.ConsentSourceRegistration, time.Time{}); err != nil {
+				return postResponse{}, err
+			}
+		}
+		id, err := s.Register(req.Username, req.Password, req.Email, req.FirstName, req.LastName, req.Phone, req.DisplayName)
+		if err != nil {
+			return postResponse{}, err
+		}
+		res := postResponse{ID: id}
+		if len(req.Consents) > 0 {
+			// The customer is registered all the same; the consents are
+			// given again through /customers/{id}/consents
+			if _, err := s.SetConsents(id, users.ConsentSourceRegistration, req.Consents); err != nil {
+				res.ConsentsFailed, _ = errorDetails(serviceError(err))
+			}
+		}
+		res.Merged = merge(s, id, req.GuestSession, req.GuestAddresses, req.GuestCards)
+		return res, nil
 	}
 }
 
 // MakeUserGetEndpoint returns an endpoint via the given service.
 func MakeUserGetEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		db.SetTraceContext(ctx)
+		s := withContext(s, ctx)
 		req := request.(GetRequest)
 
-		usrs, err := s.GetUsers(req.ID)
-		if req.ID == "" {
-			return EmbedStruct{usersResponse{Users: usrs}}, err
+		if req.ID == "" && req.Stream {
+			return streamOf(func(fn func(users.User) error) error { return s.StreamUsers(req.Sort, fn) }), nil
 		}
-		if len(usrs) == 0 {
-			if req.Attr == "addresses" {
-				return EmbedStruct{addressesResponse{Addresses: make([]users.Address, 0)}}, err
-			}
-			if req.Attr == "cards" {
-				return EmbedStruct{cardsResponse{Cards: make([]users.Card, 0)}}, err
-			}
-			return users.User{}, err
+		if req.ID == "" {
+			usrs, page, err := s.ListUsers(req.listParams())
+			return EmbedStruct{Embed: usersResponse{Users: usrs}, page: page}, err
 		}
-		user := usrs[0]
-		db.GetUserAttributes(&user)
-		if req.Attr == "addresses" {
-			return EmbedStruct{addressesResponse{Addresses: user.Addresses}}, err
+		user, err := s.GetUser(req.ID)
+		if err != nil {
+			return nil, err
 		}
-		if req.Attr == "cards" {
-			return EmbedStruct{cardsResponse{Cards: user.Cards}}, err
+		switch req.Attr {
+		case "addresses":
+			return EmbedStruct{Embed: addressesResponse{Addresses: user.Addresses}}, nil
+		case "cards":
+			return EmbedStruct{Embed: cardsResponse{Cards: user.Cards}}, nil
+		case "preferences":
+			if user.Preferences == nil {
+				return map[string]string{}, nil
+			}
+			return user.Preferences, nil
 		}
-		return user, err
+		return user, nil
 	}
 }
 
 // MakeUserPostEndpoint returns an endpoint via the given service.
 func MakeUserPostEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		db.SetTraceContext(ctx)
+		s := withContext(s, ctx)
 		req := request.(users.User)
-		id, err := s.PostUser(req)
-		return postResponse{ID: id}, err
+		u, err := s.PostUser(req)
+		resp := postResponse{ID: u.UserID}
+		for _, a := range u.Addresses {
+			resp.Addresses = append(resp.Addresses, a.ID)
+		}
+		for _, c := range u.Cards {
+			resp.Cards = append(resp.Cards, c.ID)
+		}
+		return resp, err
+	}
+}
+
+// MakeUserPutEndpoint returns an endpoint via the given service.
+func MakeUserPutEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(userPutRequest)
+		u := users.User{
+			Username:  req.Username,
+			Email:     req.Email,
+			FirstName: req.FirstName,
+			LastName:  req.LastName,
+			Phone:     req.Phone,
+		}
+		u.DisplayName = req.DisplayName
+		return s.UpdateUser(req.ID, u, tagPrincipal(ctx))
+	}
+}
+
+// MakeUserPatchEndpoint returns an endpoint via the given service.
+func MakeUserPatchEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(userPatchRequest)
+		return s.PatchUser(req.ID, req.UserPatch, tagPrincipal(ctx))
+	}
+}
+
+// MakePasswordEndpoint returns an endpoint via the given service.
+func MakePasswordEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(passwordRequest)
+		err = s.ChangePassword(req.ID, req.CurrentPassword, req.NewPassword)
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeLogoutAllEndpoint returns an endpoint via the given service.
+func MakeLogoutAllEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(logoutAllRequest)
+		err = s.LogoutAll(req.ID, tagPrincipal(ctx))
+		return statusResponse{Status: err == nil}, err
+	}
+}
+
+// MakeImpersonateEndpoint returns an endpoint via the given service.
+func MakeImpersonateEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(impersonateRequest)
+		c, _ := auth.FromContext(ctx)
+		u, token, err := s.Impersonate(req.ID, c.UserID())
+		return userResponse{User: u, Token: token}, err
+	}
+}
+
+// MakeRolesEndpoint returns an endpoint via the given service.
+func MakeRolesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(rolesRequest)
+		return s.SetRoles(req.ID, req.Roles, tagPrincipal(ctx))
+	}
+}
+
+// MakeStatusEndpoint returns an endpoint via the given service.
+func MakeStatusEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(statusRequest)
+		return s.SetStatus(req.ID, req.Status, req.Reason, tagPrincipal(ctx))
+	}
+}
+
+// MakePreferencesEndpoint returns an endpoint via the given service.
+func MakePreferencesEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(preferencesRequest)
+		return s.SetPreferences(req.ID, req.Changes)
+	}
+}
+
+// MakeDefaultAddressEndpoint returns an endpoint via the given service.
+func MakeDefaultAddressEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(defaultAddressRequest)
+		return s.SetDefaultAddress(req.ID, req.AddressID, req.Type)
+	}
+}
+
+// MakeMFAProvisionEndpoint returns an endpoint via the given service.
+func MakeMFAProvisionEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(mfaRequest)
+		secret, uri, err := s.ProvisionMFA(req.ID)
+		return mfaProvisionResponse{Secret: secret, URI: uri}, err
+	}
+}
+
+// MakeMFAConfirmEndpoint returns an endpoint via the given service.
+func MakeMFAConfirmEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(mfaRequest)
+		codes, err := s.ConfirmMFA(req.ID, req.Code)
+		return recoveryCodesResponse{RecoveryCodes: codes}, err
+	}
+}
+
+// MakeMFADisableEndpoint returns an endpoint via the given service.
+func MakeMFADisableEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(mfaRequest)
+		err = s.DisableMFA(req.ID, req.Code)
+		return statusResponse{Status: err == nil}, err
 	}
 }
 
 // MakeAddressGetEndpoint returns an endpoint via the given service.
 func MakeAddressGetEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		db.SetTraceContext(ctx)
+		s := withContext(s, ctx)
 		req := request.(GetRequest)
-		adds, err := s.GetAddresses(req.ID)
-		if req.ID == "" {
-			return EmbedStruct{addressesResponse{Addresses: adds}}, err
+		if req.ID == "" && req.Stream {
+			return streamOf(s.StreamAddresses), nil
 		}
-		if len(adds) == 0 {
-			return users.Address{}, err
+		if req.ID == "" {
+			adds, page, err := s.ListAddresses(req.listParams())
+			return EmbedStruct{Embed: addressesResponse{Addresses: adds}, page: page}, err
 		}
-		return adds[0], err
+		return s.GetAddress(req.ID)
 	}
 }
 
 // MakeAddressPostEndpoint returns an endpoint via the given service.
 func MakeAddressPostEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		db.SetTraceContext(ctx)
+		s := withContext(s, ctx)
 		req := request.(addressPostRequest)
-		id, err := s.PostAddress(req.Address, req.UserID)
-		return postResponse{ID: id}, err
+		res := postResponse{}
+		req.Address.Guest = ""
+		if req.UserID == "" {
+			res.GuestSession, req.Address.Guest, err = guestSession(req.GuestSession)
+			if err != nil {
+				return postResponse{}, err
+			}
+		}
+		res.ID, err = s.PostAddress(req.Address, req.UserID, tagPrincipal(ctx))
+		if err != nil {
+			res.GuestSession = ""
+		}
+		return res, err
 	}
 }
 
 // MakeCardGetEndpoint returns an endpoint via the given service.
 func MakeCardGetEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		db.SetTraceContext(ctx)
+		s := withContext(s, ctx)
 		req := request.(GetRequest)
-		cards, err := s.GetCards(req.ID)
-		if req.ID == "" {
-			return EmbedStruct{cardsResponse{Cards: cards}}, err
+		if req.ID == "" && req.Stream {
+			return streamOf(func(fn func(users.Card) error) error {
+				return s.StreamCards(func(c users.Card) error {
+					if !labelled(c, req.Label) {
+						return nil
+					}
+					return fn(c)
+				})
+			}), nil
 		}
-		if len(cards) == 0 {
-			return users.Card{}, err
+		if req.ID == "" {
+			cards, page, err := s.ListCards(req.listParams())
+			return EmbedStruct{Embed: cardsResponse{Cards: cards}, page: page}, err
 		}
-		return cards[0], err
+		return s.GetCard(req.ID)
+	}
+}
+
+// labelled reports whether the label of c holds q, in any case. Every card
+// matches an empty q.
+func labelled(c users.Card, q string) bool {
+	return strings.Contains(strings.ToLower(c.Label), strings.ToLower(q))
+}
+
+// MakeCardDefaultEndpoint returns an endpoint via the given service.
+func MakeCardDefaultEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(defaultCardRequest)
+		return s.SetDefaultCard(req.ID, req.CardID)
+	}
+}
+
+// MakeEmailsGetEndpoint returns an endpoint via the given service.
+func MakeEmailsGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(emailRequest)
+		es, err := s.GetEmails(req.ID)
+		return emailsResponse{Emails: es}, err
+	}
+}
+
+// MakeEmailAddEndpoint returns an endpoint via the given service. The code
+// verifying the email is only mailed, never returned.
+func MakeEmailAddEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(emailRequest)
+		es, _, err := s.AddEmail(req.ID, req.Address)
+		return emailsResponse{Emails: es}, err
+	}
+}
+
+// MakeEmailVerifyEndpoint returns an endpoint via the given service.
+func MakeEmailVerifyEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(emailRequest)
+		es, err := s.VerifyEmail(req.ID, req.Address, req.Code)
+		return emailsResponse{Emails: es}, err
+	}
+}
+
+// MakeEmailRemoveEndpoint returns an endpoint via the given service.
+func MakeEmailRemoveEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(emailRequest)
+		es, err := s.RemoveEmail(req.ID, req.Address)
+		return emailsResponse{Emails: es}, err
+	}
+}
+
+// MakeEmailPrimaryEndpoint returns an endpoint via the given service.
+func MakeEmailPrimaryEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(emailRequest)
+		return s.SetPrimaryEmail(req.ID, req.Address)
+	}
+}
+
+// MakeConsentsGetEndpoint returns an endpoint via the given service.
+func MakeConsentsGetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(consentsRequest)
+		return s.GetConsents(req.ID)
+	}
+}
+
+// MakeConsentsSetEndpoint returns an endpoint via the given service.
+func MakeConsentsSetEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(consentsRequest)
+		return s.SetConsents(req.ID, req.Source, req.Consents)
+	}
+}
+
+// MakeCardLabelEndpoint returns an endpoint via the given service.
+func MakeCardLabelEndpoint(s Service) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		s := withContext(s, ctx)
+		req := request.(cardLabelRequest)
+		return s.SetCardLabel(req.ID, req.CardID, req.Label)
 	}
 }
 
 // MakeCardPostEndpoint returns an endpoint via the given service.
 func MakeCardPostEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		db.SetTraceContext(ctx)
+		s := withContext(s, ctx)
 		req := request.(cardPostRequest)
-		id, err := s.PostCard(req.Card, req.UserID)
-		return postResponse{ID: id}, err
+		res := postResponse{}
+		req.Card.Guest = ""
+		if req.UserID == "" {
+			res.GuestSession, req.Card.Guest, err = guestSession(req.GuestSession)
+			if err != nil {
+				return postResponse{}, err
+			}
+		}
+		res.ID, err = s.PostCard(req.Card, req.UserID, tagPrincipal(ctx))
+		if err != nil {
+			res.GuestSession = ""
+		}
+		return res, err
 	}
 }
 
 // MakeDeleteEndpoint returns an endpoint via the given service.
 func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		db.SetTraceContext(ctx)
+		s := withContext(s, ctx)
 		req := request.(deleteRequest)
-		err = s.Delete(req.Entity, req.ID)
+		p := tagPrincipal(ctx)
+		version := db.AnyVersion
+		if req.IfMatch != "" {
+			version, err = matchCustomer(ctx, s, req.ID, req.IfMatch)
+		}
+		switch {
+		case err != nil:
+		case req.Mode == deleteModeAnonymize:
+			err = s.AnonymizeUser(req.ID, p)
+		default:
+			err = s.Delete(req.Entity, req.ID, version, p)
+		}
 		if err == nil {
 			return statusResponse{Status: true}, err
 		}
@@ -293,32 +735,169 @@ func MakeDeleteEndpoint(s Service) endpoint.Endpoint {
 // MakeHealthEndpoint returns current health of the given service.
 func MakeHealthEndpoint(s Service) endpoint.Endpoint {
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
-		health := s.Health()
-		return healthResponse{Health: health}, nil
+		req, _ := request.(healthRequest)
+		health := s.Health(req.Force)
+		status, _ := healthStatus(health)
+		return healthResponse{Status: status, Health: health, Version: version}, nil
 	}
 }
 
 type GetRequest struct {
 	ID   string
 	Attr string
+	// Full asks for unmasked card numbers, see ExposeCardNumbers
+	Full bool
+	// Page and Size select a page of a list; a zero Size lists everything
+	Page int
+	Size int
+	// Sort orders the list of customers
+	Sort db.Sort
+	// Stream asks for the full list as newline delimited JSON
+	Stream bool
+	// Label narrows the list of cards to those whose label holds it, in
+	// any case
+	Label string
+}
+
+// listParams returns the ListParams of a list request
+func (r GetRequest) listParams() ListParams {
+	return ListParams{Page: r.Page, Size: r.Size, Sort: r.Sort, Label: r.Label}
 }
 
 type loginRequest struct {
 	Username string
 	Password string
+	Remember bool
+	Device   string
+	// Metadata is passed to the LoginGate
+	Metadata map[string]string
+	// Attributes embeds the addresses and cards of the user in the response
+	Attributes bool
 }
 
 type userResponse struct {
-	User users.User `json:"user"`
+	User         users.User `json:"user"`
+	Token        string     `json:"token,omitempty"`
+	RefreshToken string     `json:"refreshToken,omitempty"`
+	// Embedded holds the addresses and cards of the user when they were
+	// asked for
+	Embedded *userAttributes `json:"_embedded,omitempty"`
+}
+
+// userAttributes are the addresses and cards of a user embedded in a login
+type userAttributes struct {
+	Addresses []users.Address `json:"address"`
+	Cards     []users.Card    `json:"card"`
+}
+
+// mfaRequiredResponse is returned by login for users enrolled in two-factor
+// authentication, instead of the user and token.
+type mfaRequiredResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	Challenge   string `json:"challenge"`
+}
+
+type loginMFARequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+	Remember  bool   `json:"-"`
+	Device    string `json:"-"`
+}
+
+type rolesRequest struct {
+	ID    string   `json:"-"`
+	Roles []string `json:"roles"`
+}
+
+type statusRequest struct {
+	ID     string `json:"-"`
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+}
+
+// preferencesRequest carries the preferences to set, those null to delete
+type preferencesRequest struct {
+	ID      string
+	Changes map[string]*string
+}
+
+// defaultAddressRequest names the address to make the default of its type
+type defaultAddressRequest struct {
+	ID        string
+	AddressID string
+	Type      string
+}
+
+// defaultCardRequest names the card to make the default of the customer
+type defaultCardRequest struct {
+	ID     string
+	CardID string
+}
+
+// emailRequest names an email of the customer, with the code verifying it
+// when one is sent
+type emailRequest struct {
+	ID      string
+	Address string `json:"address"`
+	Code    string `json:"code"`
+}
+
+// emailsResponse lists the emails of a customer
+type emailsResponse struct {
+	Emails []users.EmailAddress `json:"emails"`
+}
+
+// consentsRequest carries the consents of the customer to change, and the
+// form or page they were given through
+type consentsRequest struct {
+	ID       string          `json:"-"`
+	Source   string          `json:"source"`
+	Consents map[string]bool `json:"consents"`
+}
+
+// mfaRequest carries a TOTP or recovery code where one is needed
+type mfaRequest struct {
+	ID   string `json:"-"`
+	Code string `json:"code"`
+}
+
+type mfaProvisionResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+type logoutRequest struct {
+	RefreshToken string `json:"refreshToken"`
+	AccessToken  string `json:"-"`
+}
+
+type tokenResponse struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refreshToken"`
 }
 
 type usersResponse struct {
 	Users []users.User `json:"customer"`
 }
 
+type unmaskedCardsResponse struct {
+	Cards []users.UnmaskedCard `json:"card"`
+}
+
 type addressPostRequest struct {
 	users.Address
 	UserID string `json:"userID"`
+	// GuestSession is the guest session an address without a customer is
+	// posted in, a new one being started without it
+	GuestSession string `json:"guestSession"`
 }
 
 type addressesResponse struct {
@@ -328,6 +907,16 @@ type addressesResponse struct {
 type cardPostRequest struct {
 	users.Card
 	UserID string `json:"userID"`
+	// GuestSession is the guest session a card without a customer is
+	// posted in, a new one being started without it
+	GuestSession string `json:"guestSession"`
+}
+
+// cardLabelRequest carries the label to give a card of the user
+type cardLabelRequest struct {
+	ID     string `json:"-"`
+	CardID string `json:"-"`
+	Label  string `json:"label"`
 }
 
 type cardsResponse struct {
@@ -340,6 +929,51 @@ type registerRequest struct {
 	Email     string `json:"email"`
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
+	Phone     string `json:"phone"`
+	// DisplayName is optional, the first and last names shown without it
+	DisplayName string `json:"displayName"`
+	// Consents to marketing by channel, a channel left out not consented to
+	Consents map[string]bool `json:"consents"`
+	// GuestAddresses and GuestCards are the ids of those created during a
+	// guest checkout, in GuestSession, to be linked to the new customer
+	GuestSession   string   `json:"guestSession"`
+	GuestAddresses []string `json:"guestAddresses"`
+	GuestCards     []string `json:"guestCards"`
+}
+
+// mergeRequest carries the addresses and cards a guest created in its guest
+// session, to be linked to the customer it logged in as
+type mergeRequest struct {
+	ID             string   `json:"-"`
+	GuestSession   string   `json:"guestSession"`
+	GuestAddresses []string `json:"guestAddresses"`
+	GuestCards     []string `json:"guestCards"`
+}
+
+// userPutRequest carries a registerRequest; the password, consents and
+// guest addresses and cards are ignored.
+type userPutRequest struct {
+	registerRequest
+	ID string `json:"-"`
+}
+
+type userPatchRequest struct {
+	users.UserPatch
+	ID string `json:"-"`
+}
+
+type logoutAllRequest struct {
+	ID string
+}
+
+type impersonateRequest struct {
+	ID string
+}
+
+type passwordRequest struct {
+	ID              string `json:"-"`
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword     string `json:"newPassword"`
 }
 
 type statusResponse struct {
@@ -348,21 +982,50 @@ type statusResponse struct {
 
 type postResponse struct {
 	ID string `json:"id"`
+	// Addresses and Cards are the ids of those created with a customer, in
+	// the order they were posted
+	Addresses []string `json:"addresses,omitempty"`
+	Cards     []string `json:"cards,omitempty"`
+	// Merged tells of the guest addresses and cards linked to a registered
+	// customer, when any were given
+	Merged *MergeResult `json:"merged,omitempty"`
+	// GuestSession is the guest session an address or card posted without a
+	// customer was created in
+	GuestSession string `json:"guestSession,omitempty"`
+	// ConsentsFailed is the error code of consents given at registration
+	// that could not be recorded, the customer being registered without them
+	ConsentsFailed string `json:"consentsFailed,omitempty"`
 }
 
 type deleteRequest struct {
 	Entity string
 	ID     string
+	Mode   string
+	// IfMatch is the If-Match header of a conditional delete
+	IfMatch string
 }
 
+const (
+	deleteModePurge     = "purge"
+	deleteModeAnonymize = "anonymize"
+)
+
 type healthRequest struct {
-	//
+	// Force pings the dependencies instead of reusing recent results
+	Force bool
 }
 
 type healthResponse struct {
+	// Status is the overall status of the components, see healthStatus
+	Status string   `json:"status"`
 	Health []Health `json:"health"`
+	// Version is the version of the binary, see Build
+	Version string `json:"version"`
 }
 
 type EmbedStruct struct {
 	Embed interface{} `json:"_embedded"`
+	Links users.Links `json:"_links,omitempty"`
+	// page is the page of a paginated list, for its links
+	page Page
 }
@@ -0,0 +1,243 @@
+package api
+
+// errors.go contains the envelope every endpoint answers errors with and
+// the machine readable codes clients can rely on.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+)
+
+// Error codes of the error envelope. They are part of the API: add new
+// codes rather than changing existing ones.
+const (
+	CodeInvalidID          = "invalid_id"
+	CodeInvalidRequest     = "invalid_request"
+	CodeValidationFailed   = "validation_failed"
+	CodeUnauthorized       = "unauthorized"
+	CodeForbidden          = "forbidden"
+	CodeChallengeRequired  = "challenge_required"
+	CodeAccountDisabled    = "account_disabled"
+	CodeImpersonatedWrite  = "impersonation_read_only"
+	CodeUserNotFound       = "user_not_found"
+	CodeAddressNotFound    = "address_not_found"
+	CodeCardNotFound       = "card_not_found"
+	CodeNotFound           = "not_found"
+	CodeDuplicateUsername  = "duplicate_username"
+	CodeDuplicateEmail     = "duplicate_email"
+	CodeAlreadyExists      = "already_exists"
+	CodeAlreadyLinked      = "already_linked"
+	CodeMFAEnrolled        = "mfa_enrolled"
+	CodeMFANotEnrolled     = "mfa_not_enrolled"
+	CodeMFAUnavailable     = "mfa_unavailable"
+	CodeRateLimited        = "rate_limited"
+	CodeBodyTooLarge       = "body_too_large"
+	CodeIdempotencyReused  = "idempotency_key_reused"
+	CodeIdempotencyInUse   = "idempotency_key_in_use"
+	CodeShuttingDown       = "shutting_down"
+	CodePreconditionFailed = "precondition_failed"
+	CodeMethodNotAllowed   = "method_not_allowed"
+	CodeUnknownTenant      = "unknown_tenant"
+	CodeOverloaded         = "overloaded"
+	CodeNotReady           = "not_ready"
+	CodeUnavailable        = "unavailable"
+	CodeInternal           = "internal"
+)
+
+// DetailNotPatchable is the code of a field a PATCH request cannot change
+const DetailNotPatchable = "not_patchable"
+
+// ErrorBody is the envelope errors are answered with. Entity and ID name
+// the entity that was not found.
+type ErrorBody struct {
+	Error      ErrorDetails `json:"error"`
+	StatusCode int          `json:"status_code"`
+	StatusText string       `json:"status_text"`
+	Entity     string       `json:"entity,omitempty"`
+	ID         string       `json:"id,omitempty"`
+}
+
+// ErrorDetails describes an error. TraceID and RequestID are the trace and
+// id of the request, for users to quote to support; either is empty when
+// unknown, as when tracing is disabled.
+type ErrorDetails struct {
+	Code      string        `json:"code"`
+	Message   string        `json:"message"`
+	Details   []FieldDetail `json:"details,omitempty"`
+	TraceID   string        `json:"trace_id"`
+	RequestID string        `json:"request_id"`
+}
+
+// FieldDetail is a problem with one field of the request
+type FieldDetail struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// errorStatus returns the HTTP status code err is answered with. Errors
+// not of a known kind are unexpected and answered with 500. The error
+// encoder, the endpoint metrics and the logs all map errors with it, so
+// they agree on the status of a request.
+func errorStatus(err error) int {
+	var pe users.PasswordPolicyError
+	var fe users.FieldErrors
+	var rl RateLimitedError
+	var ol OverloadedError
+	var nr NotReadyError
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case err == ErrForbidden, err == ErrChallengeRequired, err == ErrAccountDisabled, err == ErrImpersonatedWrite:
+		return http.StatusForbidden
+	case errors.Is(err, ErrNotFound), errors.Is(err, db.ErrNotFound), err == ErrRouteNotFound:
+		return http.StatusNotFound
+	case err == ErrMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case errors.Is(err, ErrUserExists), errors.Is(err, db.ErrAlreadyExists), errors.Is(err, db.ErrAlreadyLinked), err == ErrMFAEnrolled, err == ErrMFANotEnrolled, err == ErrIdempotencyKeyInUse:
+		return http.StatusConflict
+	case err == ErrIdempotencyKeyReused:
+		return http.StatusUnprocessableEntity
+	case err == ErrMFAUnavailable:
+		return http.StatusNotImplemented
+	case err == ErrShuttingDown, errors.Is(err, ErrUnavailable), errors.As(err, &ol), errors.As(err, &nr):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, db.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, db.ErrInvalidInput), errors.As(err, &pe), errors.As(err, &fe), err == ErrUnknownTenant:
+		return http.StatusBadRequest
+	case errors.As(err, &rl):
+		return http.StatusTooManyRequests
+	case err == ErrBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// statusClass returns the class of the HTTP status code, as in 4xx
+func statusClass(code int) string {
+	return strconv.Itoa(code/100) + "xx"
+}
+
+// errorDetails returns the code and field details of err
+func errorDetails(err error) (string, []FieldDetail) {
+	var nf db.NotFoundError
+	var ae db.AlreadyExistsError
+	var pe users.PasswordPolicyError
+	var fe users.FieldErrors
+	var np NotPatchableError
+	var ol OverloadedError
+	var nr NotReadyError
+	switch {
+	case errors.As(err, &fe):
+		details := make([]FieldDetail, 0, len(fe))
+		for _, f := range fe {
+			details = append(details, FieldDetail{Field: f.Field, Code: f.Code, Message: f.Message})
+		}
+		return CodeValidationFailed, details
+	case errors.As(err, &pe):
+		details := make([]FieldDetail, 0, len(pe.Rules))
+		for _, r := range pe.Rules {
+			details = append(details, FieldDetail{Field: "password", Code: r})
+		}
+		return CodeValidationFailed, details
+	case errors.As(err, &np):
+		return CodeValidationFailed, []FieldDetail{{Field: np.Field, Code: DetailNotPatchable, Message: np.Error()}}
+	case errors.As(err, &nf):
+		switch nf.Entity {
+		case "customers":
+			return CodeUserNotFound, nil
+		case "addresses":
+			return CodeAddressNotFound, nil
+		case "cards":
+			return CodeCardNotFound, nil
+		}
+		return CodeNotFound, nil
+	case errors.As(err, &ae):
+		switch ae.Field {
+		case "username":
+			return CodeDuplicateUsername, nil
+		case "email":
+			return CodeDuplicateEmail, nil
+		}
+		return CodeAlreadyExists, nil
+	case errors.Is(err, db.ErrAlreadyLinked):
+		return CodeAlreadyLinked, nil
+	case errors.Is(err, db.ErrInvalidHexID):
+		return CodeInvalidID, nil
+	case err == ErrChallengeRequired:
+		return CodeChallengeRequired, nil
+	case err == ErrAccountDisabled:
+		return CodeAccountDisabled, nil
+	case err == ErrImpersonatedWrite:
+		return CodeImpersonatedWrite, nil
+	case err == ErrMFAEnrolled:
+		return CodeMFAEnrolled, nil
+	case err == ErrMFANotEnrolled:
+		return CodeMFANotEnrolled, nil
+	case err == ErrMFAUnavailable:
+		return CodeMFAUnavailable, nil
+	case err == ErrIdempotencyKeyReused:
+		return CodeIdempotencyReused, nil
+	case err == ErrIdempotencyKeyInUse:
+		return CodeIdempotencyInUse, nil
+	case err == ErrShuttingDown:
+		return CodeShuttingDown, nil
+	case errors.Is(err, db.ErrVersionMismatch):
+		return CodePreconditionFailed, nil
+	case err == ErrMethodNotAllowed:
+		return CodeMethodNotAllowed, nil
+	case err == ErrUnknownTenant:
+		return CodeUnknownTenant, nil
+	case errors.As(err, &ol):
+		return CodeOverloaded, nil
+	case errors.As(err, &nr):
+		return CodeNotReady, nil
+	case errors.Is(err, ErrUnavailable):
+		return CodeUnavailable, nil
+	}
+	switch errorStatus(err) {
+	case http.StatusBadRequest:
+		return CodeInvalidRequest, nil
+	case http.StatusUnauthorized:
+		return CodeUnauthorized, nil
+	case http.StatusForbidden:
+		return CodeForbidden, nil
+	case http.StatusNotFound:
+		return CodeNotFound, nil
+	case http.StatusConflict:
+		return CodeAlreadyExists, nil
+	case http.StatusTooManyRequests:
+		return CodeRateLimited, nil
+	case http.StatusRequestEntityTooLarge:
+		return CodeBodyTooLarge, nil
+	}
+	return CodeInternal, nil
+}
+
+// newErrorBody returns the envelope for err, answered with status code
+func newErrorBody(ctx context.Context, err error, code int) ErrorBody {
+	c, details := errorDetails(err)
+	requestID, _ := RequestIDFromContext(ctx)
+	body := ErrorBody{
+		Error: ErrorDetails{
+			Code:      c,
+			Message:   err.Error(),
+			Details:   details,
+			TraceID:   requestTraceID(ctx),
+			RequestID: requestID,
+		},
+		StatusCode: code,
+		StatusText: http.StatusText(code),
+	}
+	var nf db.NotFoundError
+	if errors.As(err, &nf) {
+		body.Entity, body.ID = nf.Entity, nf.ID
+	}
+	return body
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestErrorStatus(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want int
+	}{
+		{db.ErrNotFound, http.StatusNotFound},
+		{db.NotFoundError{Entity: "customers", ID: "x"}, http.StatusNotFound},
+		{db.ErrAlreadyExists, http.StatusConflict},
+		{memory.ErrDuplicateUsername, http.StatusConflict},
+		{AuthError{Reason: reasonWrongPassword}, http.StatusUnauthorized},
+		{db.ErrInvalidHexID, http.StatusBadRequest},
+		{ErrInvalidRequest, http.StatusBadRequest},
+		{NotPatchableError{Field: "password"}, http.StatusBadRequest},
+		{errors.New("connection reset"), http.StatusInternalServerError},
+	} {
+		if got := errorStatus(tc.err); got != tc.want {
+			t.Errorf("%v: expected %v, received %v", tc.err, tc.want, got)
+		}
+	}
+}
+
+func TestErrorBody(t *testing.T) {
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	h := newTestHandler(s)
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{"POST", "/register", `{"username": "twice", "password": "password", "email": "twice@example.com", "firstName": "first", "lastName": "last"}`, http.StatusOK, ""},
+		{"POST", "/register", `{"username": "twice", "password": "password", "email": "twice@example.com", "firstName": "first", "lastName": "last"}`, http.StatusConflict, CodeDuplicateUsername},
+		{"POST", "/register", `{"username": "other", "password": "password", "email": " twice@EXAMPLE.com", "firstName": "first", "lastName": "last"}`, http.StatusConflict, CodeDuplicateEmail},
+		{"GET", "/customers/5a0e9c4e0000000000000000", "", http.StatusNotFound, CodeUserNotFound},
+		{"GET", "/cards/5a0e9c4e0000000000000000", "", http.StatusNotFound, CodeCardNotFound},
+		{"GET", "/customers/invalid", "", http.StatusBadRequest, CodeInvalidID},
+		{"PATCH", "/customers/5a0e9c4e0000000000000000", `{"password": "x"}`, http.StatusBadRequest, CodeValidationFailed},
+		{"GET", "/login", "", http.StatusUnauthorized, CodeUnauthorized},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body)))
+		if rec.Code != tc.status {
+			t.Errorf("%v %v: expected %v, received %v", tc.method, tc.path, tc.status, rec.Code)
+			continue
+		}
+		if tc.code == "" {
+			continue
+		}
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.Error.Code != tc.code || body.Error.Message == "" {
+			t.Errorf("%v %v: expected error code %v, received %+v %v", tc.method, tc.path, tc.code, body, err)
+		}
+	}
+}
+
+func TestErrorTraceID(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	tracer := sdktrace.NewTracerProvider().Tracer("")
+	s := NewFixedService(memory.New())
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), nil), log.NewNopLogger())
+
+	req := httptest.NewRequest("GET", "/customers/invalid", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var body ErrorBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected trace id of the request, received %+v", body.Error)
+	}
+}
+
+func TestErrorIDs(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("")
+	s := NewFixedService(memory.New())
+	h := RequestIDMiddleware(MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), nil), log.NewNopLogger()))
+
+	req := httptest.NewRequest("GET", "/customers/invalid", nil)
+	req.Header.Set(RequestIDHeader, "support-7")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var body ErrorBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	ended := spans.Ended()
+	if len(ended) != 1 || body.Error.TraceID != ended[0].SpanContext().TraceID().String() {
+		t.Errorf("Expected the trace id of the server span, received %+v", body.Error)
+	}
+	if body.Error.RequestID != "support-7" {
+		t.Errorf("Expected the request id, received %+v", body.Error)
+	}
+
+	// Untraced, the ids are empty rather than missing
+	h = MakeHTTPHandler(MakeEndpoints(s, noop.NewTracerProvider().Tracer(""), log.NewNopLogger(), nil), log.NewNopLogger())
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/customers/invalid", nil))
+	if !strings.Contains(rec.Body.String(), `"trace_id":""`) || !strings.Contains(rec.Body.String(), `"request_id":""`) {
+		t.Errorf("Expected empty ids, received %v", rec.Body.String())
+	}
+}
@@ -0,0 +1,110 @@
+package api
+
+// etag.go contains the entity tags of customer responses, letting polling
+// clients revalidate with If-None-Match instead of re-fetching.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/fallback"
+	"github.com/microservices-demo/user/users"
+)
+
+type ifNoneMatchKey struct{}
+
+// ifNoneMatchToContext puts the If-None-Match header into the context
+func ifNoneMatchToContext(ctx context.Context, r *http.Request) context.Context {
+	if v := r.Header.Get("If-None-Match"); v != "" {
+		return context.WithValue(ctx, ifNoneMatchKey{}, v)
+	}
+	return ctx
+}
+
+// encodeTaggedResponse encodes response like encodeResponse, tagged with a
+// hash of the body, so any change to the customer changes the tag. A single
+// customer gets a strong tag, lists and embedded collections a weak one. A
+// request whose If-None-Match holds the tag is answered 304 without body.
+func encodeTaggedResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	// A stream is written as it is read, there is no body to tag
+	if sr, ok := response.(streamResponse); ok {
+		return encodeStream(ctx, w, sr)
+	}
+	b, tag, err := taggedBody(ctx, response)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("ETag", tag)
+	if fallback.IsStale(ctx) {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	if inm, ok := ctx.Value(ifNoneMatchKey{}).(string); ok && etagMatch(inm, tag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/hal+json")
+	_, err = w.Write(b)
+	return err
+}
+
+// taggedBody returns the body response is encoded with and its tag. The
+// tag of a customer also covers its version, which counts changes to its
+// addresses and cards as well.
+func taggedBody(ctx context.Context, response interface{}) ([]byte, string, error) {
+	response = withLinks(ctx, response)
+	b, err := json.Marshal(response)
+	if err != nil {
+		return nil, "", err
+	}
+	b = append(b, '\n')
+	h := sha256.New()
+	h.Write(b)
+	u, strong := response.(users.User)
+	if strong {
+		fmt.Fprintf(h, "%d", u.Version)
+	}
+	tag := `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+	if !strong {
+		tag = "W/" + tag
+	}
+	return b, tag, nil
+}
+
+// matchCustomer returns the version of customer id when the If-Match
+// header value im holds the tag a GET of the customer is answered with
+func matchCustomer(ctx context.Context, s Service, id, im string) (int64, error) {
+	u, err := s.GetUser(id)
+	if err != nil {
+		return 0, err
+	}
+	_, tag, err := taggedBody(ctx, u)
+	if err != nil {
+		return 0, err
+	}
+	for _, t := range strings.Split(im, ",") {
+		// If-Match compares strongly, so weak tags never match
+		if t = strings.TrimSpace(t); t == "*" || t == tag {
+			return u.Version, nil
+		}
+	}
+	return 0, db.ErrVersionMismatch
+}
+
+// etagMatch reports whether the If-None-Match header value inm holds tag,
+// comparing weakly as RFC 7232 asks for If-None-Match
+func etagMatch(inm, tag string) bool {
+	tag = strings.TrimPrefix(tag, "W/")
+	for _, t := range strings.Split(inm, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
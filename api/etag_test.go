@@ -0,0 +1,122 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+)
+
+func TestETag(t *testing.T) {
+	s := NewFixedService(memory.New())
+	id, err := s.Register("tagged", "password", "tagged@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(s)
+	get := func(path, inm string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if inm != "" {
+			req.Header.Set("If-None-Match", inm)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Missing header
+	rec := get("/customers/"+id, "")
+	tag := rec.Header().Get("ETag")
+	if rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+		t.Fatalf("Expected customer, received %v", rec.Code)
+	}
+	if tag == "" || strings.HasPrefix(tag, "W/") {
+		t.Fatalf("Expected strong ETag, received %q", tag)
+	}
+	if again := get("/customers/"+id, "").Header().Get("ETag"); again != tag {
+		t.Errorf("Expected stable ETag, received %q then %q", tag, again)
+	}
+
+	// Match
+	for _, inm := range []string{tag, `"other", ` + tag, "W/" + tag, "*"} {
+		rec = get("/customers/"+id, inm)
+		if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+			t.Errorf("If-None-Match %v: expected empty 304, received %v %q", inm, rec.Code, rec.Body.String())
+		}
+		if rec.Header().Get("ETag") != tag {
+			t.Errorf("If-None-Match %v: expected ETag on 304", inm)
+		}
+	}
+
+	// Mismatch
+	if rec = get("/customers/"+id, `"stale"`); rec.Code != http.StatusOK || rec.Body.Len() == 0 {
+		t.Errorf("Expected customer for mismatched tag, received %v", rec.Code)
+	}
+
+	// A change to the customer changes the tag
+	req := httptest.NewRequest("PATCH", "/customers/"+id, strings.NewReader(`{"firstName": "changed"}`))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if rec = get("/customers/"+id, tag); rec.Code != http.StatusOK || rec.Header().Get("ETag") == tag {
+		t.Errorf("Expected new tag after update, received %v %v", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	list := get("/customers", "").Header().Get("ETag")
+	if !strings.HasPrefix(list, "W/") {
+		t.Fatalf("Expected weak ETag on the list, received %q", list)
+	}
+	if rec = get("/customers", list); rec.Code != http.StatusNotModified {
+		t.Errorf("Expected 304 for the list, received %v", rec.Code)
+	}
+}
+
+func TestConditionalDelete(t *testing.T) {
+	s := NewFixedService(memory.New())
+	id, err := s.Register("conditional", "password", "conditional@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(s)
+	etag := func() string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/customers/"+id, nil))
+		return rec.Header().Get("ETag")
+	}
+	del := func(path, im string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("DELETE", path, nil)
+		req.Header.Set("If-Match", im)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	read := etag()
+	cardID, err := s.PostCard(users.Card{LongNum: "4111111111111111", Expires: "12/30", CCV: "123"}, id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := etag()
+	if current == read {
+		t.Fatal("Expected a new card to change the ETag")
+	}
+	if rec := del("/customers/"+id, read); rec.Code != http.StatusPreconditionFailed || !strings.Contains(rec.Body.String(), CodePreconditionFailed) {
+		t.Errorf("Expected 412 for a stale ETag, received %v: %v", rec.Code, rec.Body.String())
+	}
+	if rec := del("/customers/"+id, "W/"+current); rec.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 for a weak ETag, received %v", rec.Code)
+	}
+	if _, err := s.GetCard(cardID); err != nil {
+		t.Errorf("Expected the card kept, received %v", err)
+	}
+	if rec := del("/cards/"+cardID, current); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a conditional card delete, received %v", rec.Code)
+	}
+	if rec := del("/customers/"+id, current); rec.Code != http.StatusOK {
+		t.Errorf("Expected 200 for the current ETag, received %v: %v", rec.Code, rec.Body.String())
+	}
+	if rec := del("/customers/"+id, "*"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 deleting a deleted customer, received %v", rec.Code)
+	}
+}
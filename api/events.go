@@ -0,0 +1,189 @@
+package api
+
+// events.go tells an events.Emitter of the changes made through the
+// service, once they succeed.
+
+import (
+	"context"
+
+	"github.com/microservices-demo/user/events"
+	"github.com/microservices-demo/user/users"
+)
+
+// EventsMiddleware emits the events of successful registrations, customer
+// changes and deletions, and new addresses and cards to e
+func EventsMiddleware(e events.Emitter) Middleware {
+	return func(next Service) Service {
+		return eventsMiddleware{Service: next, emitter: e, ctx: context.Background()}
+	}
+}
+
+type eventsMiddleware struct {
+	Service
+	emitter events.Emitter
+	// ctx is the context of the request making the changes
+	ctx context.Context
+}
+
+func (mw eventsMiddleware) withContext(ctx context.Context) Service {
+	return eventsMiddleware{Service: withContext(mw.Service, ctx), emitter: mw.emitter, ctx: ctx}
+}
+
+// emit tells of an event of type typ about the entity id, in the trace of
+// the request making the change
+func (mw eventsMiddleware) emit(typ, id string, data interface{}) {
+	e := events.New(typ, id, data)
+	e.TraceID = traceID(mw.ctx)
+	mw.emitter.Emit(e)
+}
+
+func (mw eventsMiddleware) Register(username, password, email, first, last, phone, displayName string) (string, error) {
+	id, err := mw.Service.Register(username, password, email, first, last, phone, displayName)
+	if err == nil {
+		u := users.User{UserID: id, Username: username, FirstName: first, LastName: last, Phone: phone, DisplayName: displayName}
+		mw.emit(events.UserCreated, id, u)
+	}
+	return id, err
+}
+
+func (mw eventsMiddleware) PostUser(u users.User) (users.User, error) {
+	created, err := mw.Service.PostUser(u)
+	if err == nil {
+		e := created.Clone()
+		e.MaskCCs()
+		for k := range e.Cards {
+			e.Cards[k].CCV = ""
+		}
+		mw.emit(events.UserCreated, e.UserID, e)
+	}
+	return created, err
+}
+
+// UpdateUser tells of the changes made along the user
+func (mw eventsMiddleware) UpdateUser(id string, u users.User, principal string) (users.User, error) {
+	updated, err := mw.Service.UpdateUser(id, u, principal)
+	if err == nil {
+		mw.emitChanges(id, updated)
+	}
+	return updated, err
+}
+
+// PatchUser tells of the changes made along the user
+func (mw eventsMiddleware) PatchUser(id string, p users.UserPatch, principal string) (users.User, error) {
+	updated, err := mw.Service.PatchUser(id, p, principal)
+	if err == nil {
+		mw.emitChanges(id, updated)
+	}
+	return updated, err
+}
+
+// emitChanges tells of the update of u with the Changes it carries
+func (mw eventsMiddleware) emitChanges(id string, u users.User) {
+	e := events.New(events.UserUpdated, id, u)
+	e.Changes = u.Changes
+	e.TraceID = traceID(mw.ctx)
+	mw.emitter.Emit(e)
+}
+
+func (mw eventsMiddleware) SetRoles(id string, roles []string, principal string) (users.User, error) {
+	updated, err := mw.Service.SetRoles(id, roles, principal)
+	if err == nil {
+		mw.emit(events.UserUpdated, id, updated)
+	}
+	return updated, err
+}
+
+func (mw eventsMiddleware) SetStatus(id, status, reason, principal string) (users.User, error) {
+	updated, err := mw.Service.SetStatus(id, status, reason, principal)
+	if err == nil {
+		mw.emit(events.UserUpdated, id, updated)
+	}
+	return updated, err
+}
+
+func (mw eventsMiddleware) SetDefaultAddress(id, addressID, typ string) (users.User, error) {
+	updated, err := mw.Service.SetDefaultAddress(id, addressID, typ)
+	if err == nil {
+		mw.emit(events.UserUpdated, id, updated)
+	}
+	return updated, err
+}
+
+func (mw eventsMiddleware) SetDefaultCard(id, cardID string) (users.User, error) {
+	updated, err := mw.Service.SetDefaultCard(id, cardID)
+	if err == nil {
+		mw.emit(events.UserUpdated, id, updated)
+	}
+	return updated, err
+}
+
+// emailVerification is the data of an events.EmailVerification event
+type emailVerification struct {
+	Address string `json:"address"`
+	Code    string `json:"code"`
+}
+
+// AddEmail sends the verification code through the events; it is given to
+// no one else
+func (mw eventsMiddleware) AddEmail(id, address string) ([]users.EmailAddress, string, error) {
+	es, code, err := mw.Service.AddEmail(id, address)
+	if err == nil {
+		mw.emit(events.EmailVerification, id, emailVerification{Address: address, Code: code})
+	}
+	return es, code, err
+}
+
+func (mw eventsMiddleware) SetPrimaryEmail(id, address string) (users.User, error) {
+	updated, err := mw.Service.SetPrimaryEmail(id, address)
+	if err == nil {
+		mw.emit(events.UserUpdated, id, updated)
+	}
+	return updated, err
+}
+
+// SetConsents tells of the consents of the user once they change
+func (mw eventsMiddleware) SetConsents(id, source string, consents map[string]bool) (users.ConsentState, error) {
+	c, err := mw.Service.SetConsents(id, source, consents)
+	if err == nil {
+		mw.emit(events.ConsentsUpdated, id, c.Consents)
+	}
+	return c, err
+}
+
+func (mw eventsMiddleware) Delete(entity, id string, version int64, principal string) error {
+	err := mw.Service.Delete(entity, id, version, principal)
+	if err == nil && entity == "customers" {
+		mw.emit(events.UserDeleted, id, nil)
+	}
+	return err
+}
+
+// AnonymizeUser is told as a deletion: the customer is gone but for its id
+func (mw eventsMiddleware) AnonymizeUser(id, principal string) error {
+	err := mw.Service.AnonymizeUser(id, principal)
+	if err == nil {
+		mw.emit(events.UserDeleted, id, nil)
+	}
+	return err
+}
+
+func (mw eventsMiddleware) PostAddress(add users.Address, userid, principal string) (string, error) {
+	id, err := mw.Service.PostAddress(add, userid, principal)
+	if err == nil {
+		add.ID = id
+		mw.emit(events.AddressCreated, id, add)
+	}
+	return id, err
+}
+
+// PostCard tells of the card masked, and without its security code
+func (mw eventsMiddleware) PostCard(card users.Card, userid, principal string) (string, error) {
+	id, err := mw.Service.PostCard(card, userid, principal)
+	if err == nil {
+		card.ID = id
+		card.MaskCC()
+		card.CCV = ""
+		mw.emit(events.CardCreated, id, card)
+	}
+	return id, err
+}
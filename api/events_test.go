@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/events"
+	"github.com/microservices-demo/user/users"
+)
+
+type recordingEmitter []events.Event
+
+func (r *recordingEmitter) Emit(e events.Event) {
+	*r = append(*r, e)
+}
+
+func TestEventsMiddleware(t *testing.T) {
+	var emitted recordingEmitter
+	s := EventsMiddleware(&emitted)(NewFixedService(memory.New()))
+
+	id, err := s.Register("events", "password", "events@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register("events", "password", "events@example.com", "first", "last", "", ""); err == nil {
+		t.Fatal("Expected a duplicate registration to fail")
+	}
+	addressID, err := s.PostAddress(users.Address{Street: "street", City: "city"}, id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cardID, err := s.PostCard(users.Card{LongNum: "4111111111111111", Expires: "12/30", CCV: "123"}, id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := "changed"
+	if _, err := s.PatchUser(id, users.UserPatch{LastName: &last}, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("customers", id, db.AnyVersion, "apikey:test"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct{ typ, id string }{
+		{events.UserCreated, id},
+		{events.AddressCreated, addressID},
+		{events.CardCreated, cardID},
+		{events.UserUpdated, id},
+		{events.UserDeleted, id},
+	}
+	if len(emitted) != len(want) {
+		t.Fatalf("Expected %v events, received %v", len(want), emitted)
+	}
+	for i, w := range want {
+		if emitted[i].Version != events.SchemaVersion {
+			t.Errorf("Expected schema version %v, received %v", events.SchemaVersion, emitted[i].Version)
+		}
+		if emitted[i].Type != w.typ || emitted[i].EntityID != w.id {
+			t.Errorf("Expected event %v about %v, received %v about %v", w.typ, w.id, emitted[i].Type, emitted[i].EntityID)
+		}
+	}
+	if want := []users.FieldChange{{Field: "lastName", Old: "last", New: "changed"}}; !reflect.DeepEqual(emitted[3].Changes, want) {
+		t.Errorf("Expected the update told with its changes %+v, received %+v", want, emitted[3].Changes)
+	}
+	b, err := json.Marshal(emitted[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "4111111111111111") || strings.Contains(string(b), `"123"`) {
+		t.Errorf("Expected the card masked and without its security code, received %s", b)
+	}
+}
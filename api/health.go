@@ -0,0 +1,122 @@
+package api
+
+// health.go checks the components of the service concurrently, each within
+// a timeout of its own, so a dependency that hangs is reported as failing
+// without holding up the report of the others.
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+)
+
+// Severities of the components of the health. Only critical components
+// gate readiness; an optional one failing leaves the service degraded.
+const (
+	SeverityCritical = "critical"
+	SeverityOptional = "optional"
+)
+
+// Statuses of components, and overall statuses of the health
+const (
+	HealthOK       = "OK"
+	HealthDegraded = "degraded"
+	HealthErr      = "err"
+)
+
+// DefaultHealthTimeout is the time each component gets to answer a health
+// check
+const DefaultHealthTimeout = time.Second
+
+// WithHealthTimeout gives each component d to answer health checks before
+// it is reported as failing; 0 waits for all of them.
+func WithHealthTimeout(d time.Duration) ServiceOption {
+	return func(s *fixedService) {
+		s.healthTimeout = d
+	}
+}
+
+// WithHealthCheck adds component, of the given severity, to the health of
+// the service, healthy as long as ping succeeds. Its pings are reused like
+// those of the database.
+func WithHealthCheck(component, severity string, ping func() error) ServiceOption {
+	return func(s *fixedService) {
+		s.checks = append(s.checks, healthCheck{component: component, severity: severity, ping: &cachedPing{ping: ping}})
+	}
+}
+
+// healthCheck is a component of the health and its ping
+type healthCheck struct {
+	component string
+	severity  string
+	ping      *cachedPing
+}
+
+// check returns the health of the component, failing when its ping does
+// not answer within timeout. A ping left running answers the checks that
+// follow once it returns; until then they wait for it rather than starting
+// another, so a hanging component holds a single ping.
+func (c healthCheck) check(interval, timeout time.Duration, force bool) Health {
+	done := c.ping.start(interval, force)
+	if timeout <= 0 {
+		<-done
+		return pingHealth(c.component, c.severity, c.ping)
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		return pingHealth(c.component, c.severity, c.ping)
+	case <-t.C:
+		return Health{
+			Service:  c.component,
+			Status:   HealthErr,
+			Severity: c.severity,
+			Time:     time.Now().String(),
+			Latency:  timeout.Seconds(),
+			Error:    fmt.Sprintf("no answer within %v", timeout),
+		}
+	}
+}
+
+func (s *fixedService) Health(force bool) []Health {
+	now := time.Now().String()
+	checked := make([]Health, len(s.checks))
+	var wg sync.WaitGroup
+	for k, c := range s.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checked[k] = c.check(s.pingInterval, s.healthTimeout, force)
+		}()
+	}
+	wg.Wait()
+
+	health := []Health{{Service: "user", Status: HealthOK, Severity: SeverityCritical, Time: now}}
+	health = append(health, checked...)
+	if r, ok := s.db.(db.SourceReporter); ok {
+		health = append(health, Health{Service: "user-db-source", Status: r.Source(), Severity: SeverityOptional, Time: now})
+	}
+	return health
+}
+
+// healthStatus returns the overall status of health and the critical
+// components failing it: err when a critical component fails, degraded
+// when only optional ones do. Components without a severity are critical.
+func healthStatus(health []Health) (string, []string) {
+	status := HealthOK
+	var failed []string
+	for _, h := range health {
+		switch {
+		case h.Status != HealthErr:
+		case h.Severity != SeverityOptional:
+			failed = append(failed, h.Service)
+			status = HealthErr
+		case status == HealthOK:
+			status = HealthDegraded
+		}
+	}
+	return status, failed
+}
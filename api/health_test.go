@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db/memory"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestHealthChecks(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+	s := NewFixedService(memory.New(), WithPingInterval(0), WithHealthTimeout(50*time.Millisecond),
+		WithHealthCheck("broker", SeverityOptional, func() error { <-hung; return nil }),
+		WithHealthCheck("webhooks", SeverityOptional, func() error { return errors.New("queue full") }),
+	)
+	begin := time.Now()
+	health := s.Health(false)
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("Expected the checks run concurrently within their timeout, took %v", took)
+	}
+	byName := make(map[string]Health)
+	for _, h := range health {
+		byName[h.Service] = h
+	}
+	if h := byName["user-db"]; h.Status != HealthOK || h.Severity != SeverityCritical || h.Error != "" {
+		t.Errorf("Expected the database healthy and critical, received %+v", h)
+	}
+	if h := byName["broker"]; h.Status != HealthErr || h.Severity != SeverityOptional || !strings.Contains(h.Error, "no answer") {
+		t.Errorf("Expected the hung broker timed out, received %+v", h)
+	}
+	if h := byName["webhooks"]; h.Status != HealthErr || h.Error != "queue full" {
+		t.Errorf("Expected the error of the webhooks, received %+v", h)
+	}
+	if status, failed := healthStatus(health); status != HealthDegraded || len(failed) != 0 {
+		t.Errorf("Expected the service degraded, received %v %v", status, failed)
+	}
+
+	tracer := noop.NewTracerProvider().Tracer("")
+	serve := func(s Service, path string) (int, healthResponse, ErrorBody) {
+		h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), nil), log.NewNopLogger())
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var res healthResponse
+		var body ErrorBody
+		if rec.Code == http.StatusOK {
+			json.NewDecoder(rec.Body).Decode(&res)
+		} else {
+			json.NewDecoder(rec.Body).Decode(&body)
+		}
+		return rec.Code, res, body
+	}
+	if code, res, _ := serve(s, "/ready"); code != http.StatusOK || res.Status != HealthDegraded {
+		t.Errorf("Expected optional components not to gate readiness, received %v %v", code, res.Status)
+	}
+
+	s = NewFixedService(memory.New(), WithHealthCheck("ledger", SeverityCritical, func() error { return errors.New("down") }))
+	if code, _, body := serve(s, "/ready"); code != http.StatusServiceUnavailable || !strings.Contains(body.Error.Message, "ledger") {
+		t.Errorf("Expected a critical component to gate readiness, received %v %+v", code, body.Error)
+	}
+	if code, res, _ := serve(s, "/health"); code != http.StatusOK || res.Status != HealthErr {
+		t.Errorf("Expected the failure in the health, received %v %v", code, res.Status)
+	}
+}
+
+func TestHealthHungPingStartedOnce(t *testing.T) {
+	hung := make(chan struct{})
+	defer close(hung)
+	var pings atomic.Int32
+	s := NewFixedService(memory.New(), WithPingInterval(0), WithHealthTimeout(10*time.Millisecond),
+		WithHealthCheck("broker", SeverityOptional, func() error { pings.Add(1); <-hung; return nil }),
+	)
+	for k := 0; k < 5; k++ {
+		for _, h := range s.Health(true) {
+			if h.Service == "broker" && h.Status != HealthErr {
+				t.Errorf("Expected the hung broker timed out, received %+v", h)
+			}
+		}
+	}
+	if n := pings.Load(); n != 1 {
+		t.Errorf("Expected a single ping of the hung broker, received %v", n)
+	}
+}
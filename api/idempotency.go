@@ -0,0 +1,177 @@
+package api
+
+// idempotency.go lets clients retry creating requests safely: a request
+// carrying an Idempotency-Key is answered with the stored response of the
+// first request with that key instead of creating a duplicate.
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/microservices-demo/user/auth"
+)
+
+// IdempotencyHeader carries the key of a retryable request
+const IdempotencyHeader = "Idempotency-Key"
+
+const maxIdempotencyKeyLength = 255
+
+var (
+	// ErrIdempotencyKeyReused is returned when a key is sent again with a
+	// different payload
+	ErrIdempotencyKeyReused = errors.New("Idempotency key reused with a different payload")
+	// ErrIdempotencyKeyInUse is returned while the first request with a key
+	// is still being processed
+	ErrIdempotencyKeyInUse = errors.New("Idempotency key in use by a request in progress")
+)
+
+// IdempotencyRecord is what is kept of a request under its key: the
+// fingerprint of its payload and, once done, its response.
+type IdempotencyRecord struct {
+	Fingerprint string
+	Response    interface{}
+	Done        bool
+}
+
+// IdempotencyStore keeps the records of keyed requests until they expire
+type IdempotencyStore interface {
+	// Reserve claims key for a request with fingerprint and returns true,
+	// or returns the record already held under key and false
+	Reserve(key, fingerprint string) (IdempotencyRecord, bool)
+	// Complete stores the response of the request holding key
+	Complete(key string, response interface{})
+	// Release gives up key, so the request can be retried with it
+	Release(key string)
+}
+
+type idempotencyKey struct{}
+
+// idempotencyKeyToContext moves the Idempotency-Key header into the context
+func idempotencyKeyToContext(ctx context.Context, r *http.Request) context.Context {
+	if k := r.Header.Get(IdempotencyHeader); k != "" {
+		return context.WithValue(ctx, idempotencyKey{}, k)
+	}
+	return ctx
+}
+
+// Idempotent returns an endpoint middleware replaying the stored response
+// of requests repeating an Idempotency-Key. Keys are scoped to scope, which
+// names the endpoint, and to the caller: the user of a valid bearer token,
+// else the principal. Failed requests are not stored, so they can be
+// retried with the same key.
+func Idempotent(store IdempotencyStore, issuer *auth.Issuer, scope string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			k, ok := ctx.Value(idempotencyKey{}).(string)
+			if !ok {
+				return next(ctx, request)
+			}
+			if len(k) > maxIdempotencyKeyLength {
+				return nil, ErrInvalidRequest
+			}
+			key := scope + "\x00" + idempotencyCaller(ctx, issuer) + "\x00" + k
+			fp := fingerprint(request)
+			rec, reserved := store.Reserve(key, fp)
+			if !reserved {
+				switch {
+				case rec.Fingerprint != fp:
+					return nil, ErrIdempotencyKeyReused
+				case !rec.Done:
+					return nil, ErrIdempotencyKeyInUse
+				}
+				return rec.Response, nil
+			}
+			response, err := next(ctx, request)
+			if err != nil {
+				store.Release(key)
+				return response, err
+			}
+			store.Complete(key, response)
+			return response, nil
+		}
+	}
+}
+
+func idempotencyCaller(ctx context.Context, issuer *auth.Issuer) string {
+	if token, _ := ctx.Value(bearerKey{}).(string); token != "" && issuer != nil {
+		if c, err := issuer.Parse(token); err == nil {
+			return c.UserID()
+		}
+	}
+	return principal(ctx)
+}
+
+// fingerprint hashes every field of a decoded request, including those
+// never serialized like passwords
+func fingerprint(request interface{}) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%#v", request)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type idempotencyEntry struct {
+	IdempotencyRecord
+	expires time.Time
+}
+
+// MemoryIdempotencyStore is an IdempotencyStore local to the process, so
+// retries are only recognized by the replica that served the first request.
+type MemoryIdempotencyStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	swept   time.Time
+	now     func() time.Time
+}
+
+// NewMemoryIdempotencyStore returns a store keeping records for ttl
+func NewMemoryIdempotencyStore(ttl time.Duration) *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{ttl: ttl, entries: make(map[string]*idempotencyEntry), now: time.Now}
+}
+
+// Reserve claims key unless a live record holds it
+func (m *MemoryIdempotencyStore) Reserve(key, fingerprint string) (IdempotencyRecord, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	if now.Sub(m.swept) > m.ttl {
+		for k, e := range m.entries {
+			if now.After(e.expires) {
+				delete(m.entries, k)
+			}
+		}
+		m.swept = now
+	}
+	if e, ok := m.entries[key]; ok && !now.After(e.expires) {
+		return e.IdempotencyRecord, false
+	}
+	m.entries[key] = &idempotencyEntry{
+		IdempotencyRecord: IdempotencyRecord{Fingerprint: fingerprint},
+		expires:           now.Add(m.ttl),
+	}
+	return IdempotencyRecord{}, true
+}
+
+// Complete stores the response under key
+func (m *MemoryIdempotencyStore) Complete(key string, response interface{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[key]; ok {
+		e.Response, e.Done = response, true
+	}
+}
+
+// Release forgets key
+func (m *MemoryIdempotencyStore) Release(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+}
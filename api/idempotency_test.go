@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestIdempotent(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	owner, err := s.Register("owner", "password", "owner@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Register("other", "password", "other@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerToken, _ := issuer.Issue(owner, "owner")
+	otherToken, _ := issuer.Issue(other, "other")
+
+	tracer := noop.NewTracerProvider().Tracer("")
+	e := MakeEndpoints(s, tracer, log.NewNopLogger(), issuer)
+	store := NewMemoryIdempotencyStore(time.Hour)
+	e.RegisterEndpoint = Idempotent(store, issuer, "register")(e.RegisterEndpoint)
+	e.CardPostEndpoint = Idempotent(store, issuer, "cards")(e.CardPostEndpoint)
+	h := MakeHTTPHandler(e, log.NewNopLogger())
+
+	post := func(path, token, key, body string) (int, string) {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if key != "" {
+			req.Header.Set(IdempotencyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var r struct {
+			ID    string       `json:"id"`
+			Error ErrorDetails `json:"error"`
+		}
+		json.NewDecoder(rec.Body).Decode(&r)
+		if r.Error.Code != "" {
+			return rec.Code, r.Error.Code
+		}
+		return rec.Code, r.ID
+	}
+
+	register := `{"username": "retry", "password": "password", "email": "retry@example.com", "firstName": "first", "lastName": "last"}`
+	code, first := post("/register", "", "k1", register)
+	if code != http.StatusOK {
+		t.Fatalf("Expected registration, received %v %v", code, first)
+	}
+	if code, id := post("/register", "", "k1", register); code != http.StatusOK || id != first {
+		t.Errorf("Expected replayed registration %v, received %v %v", first, code, id)
+	}
+	if code, c := post("/register", "", "k1", strings.Replace(register, "retry", "changed", 1)); code != http.StatusUnprocessableEntity || c != CodeIdempotencyReused {
+		t.Errorf("Expected 422 for a reused key, received %v %v", code, c)
+	}
+	if code, c := post("/register", "", "k2", register); code != http.StatusConflict || c != CodeDuplicateUsername {
+		t.Errorf("Expected a new key to register again, received %v %v", code, c)
+	}
+
+	card := func(user string) string {
+		return `{"userID": "` + user + `", "longNum": "4111111111111111"}`
+	}
+	_, ownerCard := post("/cards", ownerToken, "k1", card(owner))
+	if _, id := post("/cards", ownerToken, "k1", card(owner)); id != ownerCard {
+		t.Errorf("Expected replayed card %v, received %v", ownerCard, id)
+	}
+	if _, id := post("/cards", otherToken, "k1", card(other)); id == ownerCard || id == "" {
+		t.Errorf("Expected keys scoped to the caller, received %v", id)
+	}
+	if cards, _, _ := s.ListCards(ListParams{}); len(cards) != 2 {
+		t.Errorf("Expected 2 cards, found %v", len(cards))
+	}
+
+	// Failed requests are not stored
+	if code, _ := post("/cards", ownerToken, "k3", card(other)); code != http.StatusForbidden {
+		t.Fatalf("Expected 403, received %v", code)
+	}
+	if code, _ := post("/cards", ownerToken, "k3", card(owner)); code != http.StatusOK {
+		t.Errorf("Expected retry after failure to go through, received %v", code)
+	}
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	now := time.Now()
+	m := NewMemoryIdempotencyStore(time.Minute)
+	m.now = func() time.Time { return now }
+	if _, ok := m.Reserve("k", "a"); !ok {
+		t.Fatal("Expected key reserved")
+	}
+	if rec, ok := m.Reserve("k", "a"); ok || rec.Done {
+		t.Errorf("Expected key in use, received %+v %v", rec, ok)
+	}
+	m.Complete("k", "response")
+	if rec, ok := m.Reserve("k", "a"); ok || rec.Response != "response" {
+		t.Errorf("Expected stored response, received %+v %v", rec, ok)
+	}
+	now = now.Add(2 * time.Minute)
+	if _, ok := m.Reserve("k", "b"); !ok {
+		t.Error("Expected expired key reserved again")
+	}
+}
@@ -0,0 +1,111 @@
+package api
+
+// impersonation.go lets support see the service as a customer sees it: an
+// admin holding an API key is issued a short lived token of the customer
+// naming the admin as impersonator. Requests made with it are read-only
+// unless WithImpersonatedWrites, and each is audited with both identities.
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+)
+
+// ErrImpersonatedWrite is returned to impersonation tokens calling a
+// mutating endpoint, without WithImpersonatedWrites
+var ErrImpersonatedWrite = errors.New("Impersonation tokens are read-only")
+
+// impersonatedReads are the methods served to impersonation tokens when
+// writes are not allowed. Logging out only ends the impersonation.
+var impersonatedReads = map[string]bool{
+	methodGetUsers:     true,
+	methodGetAddresses: true,
+	methodGetCards:     true,
+	methodGetEmails:    true,
+	methodGetConsents:  true,
+	methodLogout:       true,
+}
+
+// WithImpersonation serves POST /admin/impersonate/{id} to admins also
+// giving one of keys in the X-API-Key header. Without it the endpoint
+// refuses every request.
+func WithImpersonation(keys *auth.APIKeys) EndpointsOption {
+	return func(cfg *endpointsConfig) {
+		cfg.impersonationKeys = keys
+	}
+}
+
+// WithImpersonatedWrites lets impersonation tokens call mutating endpoints
+func WithImpersonatedWrites() EndpointsOption {
+	return func(cfg *endpointsConfig) {
+		cfg.impersonatedWrites = true
+	}
+}
+
+// Impersonate issues a token of the user to the impersonator. It carries
+// the customer role only, whatever the roles of the user, and no refresh
+// token is issued with it.
+func (s *fixedService) Impersonate(id, impersonator string) (users.User, string, error) {
+	if s.tokens == nil {
+		return users.New(), "", ErrForbidden
+	}
+	u, err := s.GetUser(id)
+	if err != nil {
+		return users.New(), "", err
+	}
+	token, err := s.tokens.IssueImpersonation(u.UserID, u.Username, u.CredentialsVersion, impersonator, users.RoleCustomer)
+	if err != nil {
+		return users.New(), "", err
+	}
+	if err := s.audit("impersonate", "customers", id, impersonator); err != nil {
+		return users.New(), "", err
+	}
+	u.MaskCCs()
+	return u, token, nil
+}
+
+// AuditImpersonation records the request as made by the impersonator on
+// the customer, as impersonated or, when it was refused, as
+// impersonation-refused
+func (s *fixedService) AuditImpersonation(id, impersonator, method string, refused bool) error {
+	action := "impersonated"
+	if refused {
+		action = "impersonation-refused"
+	}
+	return s.record(db.AuditEntry{Action: action, Entity: "customers", ID: id, Principal: impersonator, Method: method})
+}
+
+// impersonation returns an endpoint middleware auditing the requests made
+// to method with an impersonation token, and refusing them when method
+// mutates and writes are not allowed. Other requests pass untouched, as do
+// tokens that fail verification, left to the authentication middleware. A
+// request is refused when it cannot be audited.
+func impersonation(issuer *auth.Issuer, s Service, method string, writes bool) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		if issuer == nil {
+			return next
+		}
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			token, _ := ctx.Value(bearerKey{}).(string)
+			if token == "" || !auth.Impersonated(token) {
+				return next(ctx, request)
+			}
+			c, err := issuer.Parse(token)
+			if err != nil {
+				return next(ctx, request)
+			}
+			refused := !writes && !impersonatedReads[method]
+			if err := withContext(s, ctx).AuditImpersonation(c.UserID(), c.Impersonator, method, refused); err != nil {
+				return nil, err
+			}
+			if refused {
+				return nil, ErrImpersonatedWrite
+			}
+			return next(ctx, request)
+		}
+	}
+}
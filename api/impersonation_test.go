@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestImpersonation(t *testing.T) {
+	t.Setenv("TEST_API_KEYS", "support="+auth.HashAPIKey("key"))
+	keys, err := auth.LoadAPIKeys("", "TEST_API_KEYS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, _ := auth.NewIssuer(auth.HS256, []byte("secret"))
+	d := memory.New()
+	s := NewFixedService(d, WithTokenIssuer(issuer), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	admin, _ := s.Register("admin", "password", "admin@example.com", "first", "last", "", "")
+	customer, _ := s.Register("customer", "password", "customer@example.com", "first", "last", "", "")
+	if _, err := s.SetRoles(admin, []string{users.RoleCustomer, users.RoleAdmin}, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, adminToken, _ := s.Login("admin", "password", false)
+	_, customerToken, _ := s.Login("customer", "password", false)
+	tracer := noop.NewTracerProvider().Tracer("")
+	handler := func(opts ...EndpointsOption) http.Handler {
+		return MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer, opts...), log.NewNopLogger())
+	}
+	h := handler(WithImpersonation(keys))
+	do := func(h http.Handler, method, path, token, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for name, tc := range map[string]struct {
+		h          http.Handler
+		token, key string
+		code       int
+	}{
+		"without key":          {h, adminToken, "", http.StatusUnauthorized},
+		"without admin role":   {h, customerToken, "key", http.StatusForbidden},
+		"without keys to take": {handler(), adminToken, "key", http.StatusUnauthorized},
+	} {
+		if rec := do(tc.h, "POST", "/admin/impersonate/"+customer, tc.token, tc.key, ""); rec.Code != tc.code {
+			t.Errorf("%v: expected %v, received %v", name, tc.code, rec.Code)
+		}
+	}
+	rec := do(h, "POST", "/admin/impersonate/"+customer, adminToken, "key", "")
+	var res struct {
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || rec.Code != http.StatusOK || res.User.ID != customer {
+		t.Fatalf("Expected a token of the customer, received %v %+v %v", rec.Code, res, err)
+	}
+	c, err := issuer.Parse(res.Token)
+	if err != nil || c.UserID() != customer || c.Impersonator != admin || c.HasRole(auth.RoleAdmin) {
+		t.Fatalf("Expected the customer impersonated by the admin, received %+v %v", c, err)
+	}
+
+	if rec := do(h, "GET", "/customers/"+customer+"/emails", res.Token, "", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected reads served, received %v", rec.Code)
+	}
+	rec = do(h, "PUT", "/customers/"+customer+"/preferences", res.Token, "", `{"currency": "EUR"}`)
+	var body ErrorBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || rec.Code != http.StatusForbidden || body.Error.Code != CodeImpersonatedWrite {
+		t.Errorf("Expected writes refused, received %v %+v %v", rec.Code, body.Error, err)
+	}
+	if u, _ := s.GetUser(customer); len(u.Preferences) != 0 {
+		t.Errorf("Expected the preferences untouched, received %v", u.Preferences)
+	}
+	if rec := do(h, "POST", "/admin/impersonate/"+admin, res.Token, "key", ""); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected an impersonation token not to impersonate, received %v", rec.Code)
+	}
+	if rec := do(h, "POST", "/token/refresh", "", "", `{"refreshToken": "`+res.Token+`"}`); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected the token not refreshed, received %v", rec.Code)
+	}
+	if rec := do(h, "GET", "/customers/"+customer+"/emails", customerToken, "", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected the sessions of the customer kept, received %v", rec.Code)
+	}
+
+	var audited []db.AuditEntry
+	for _, e := range d.AuditLog() {
+		if strings.HasPrefix(e.Action, "impersonat") {
+			audited = append(audited, e)
+		}
+	}
+	want := []struct{ action, method string }{
+		{"impersonate", ""},
+		{"impersonated", methodGetEmails},
+		{"impersonation-refused", methodSetPreferences},
+		{"impersonation-refused", methodImpersonate},
+	}
+	if len(audited) != len(want) {
+		t.Fatalf("Expected %v impersonation audits, received %+v", len(want), audited)
+	}
+	for k, w := range want {
+		if e := audited[k]; e.Action != w.action || e.Method != w.method || e.ID != customer || e.Principal != admin {
+			t.Errorf("Expected %v of %v by the admin audited, received %+v", w.action, w.method, e)
+		}
+	}
+
+	h = handler(WithImpersonation(keys), WithImpersonatedWrites())
+	if rec := do(h, "PUT", "/customers/"+customer+"/preferences", res.Token, "", `{"currency": "EUR"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected writes served once allowed, received %v", rec.Code)
+	}
+}
@@ -0,0 +1,174 @@
+package api
+
+// links.go contains the HAL links of HTTP responses. They are set when a
+// response is encoded, so they point at the address the client used.
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/microservices-demo/user/users"
+)
+
+// maxPageSize is the largest page of a list
+const maxPageSize = 1000
+
+// Page is the page of a paginated list: its Number, from 1, and Size, and
+// whether More items follow. The zero Page is that of a list served whole.
+type Page struct {
+	Number int
+	Size   int
+	More   bool
+}
+
+// paginate returns page of items, of size items each. A zero size returns
+// all items and the zero Page.
+func paginate[T any](items []T, page, size int) ([]T, Page) {
+	if size == 0 {
+		return items, Page{}
+	}
+	// Compared before multiplying, which overflows for huge pages
+	start := len(items)
+	if page-1 < len(items)/size+1 {
+		start = min((page-1)*size, len(items))
+	}
+	end := start + size
+	if end > len(items) {
+		end = len(items)
+	}
+	return items[start:end], Page{Number: page, Size: size, More: end < len(items)}
+}
+
+// decodePage reads the page and size query parameters of a list. A page
+// without a size has 20 items.
+func decodePage(r *http.Request) (page, size int, err error) {
+	q := r.URL.Query()
+	if q.Get("page") == "" && q.Get("size") == "" {
+		return 0, 0, nil
+	}
+	page, size = 1, 20
+	if v := q.Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			return 0, 0, ErrInvalidRequest
+		}
+	}
+	if v := q.Get("size"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil || size < 1 || size > maxPageSize {
+			return 0, 0, ErrInvalidRequest
+		}
+	}
+	return page, size, nil
+}
+
+type linksKey struct{}
+
+// linkContext is what links are built from: the base URL and the URL of
+// the request
+type linkContext struct {
+	base string
+	url  *url.URL
+}
+
+// linksToContext stores what links are built from. Links are under base
+// when it is set, else under the address the client reached, as told by
+// X-Forwarded-Proto and the Host header.
+func linksToContext(base string) httptransport.RequestFunc {
+	return func(ctx context.Context, r *http.Request) context.Context {
+		lc := linkContext{base: base, url: r.URL}
+		if lc.base == "" {
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+			if p := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]); p == "http" || p == "https" {
+				scheme = p
+			}
+			lc.base = scheme + "://" + r.Host
+		}
+		return context.WithValue(ctx, linksKey{}, lc)
+	}
+}
+
+// withLinks returns response with the links of its entities set: a
+// customer links to itself, its addresses and cards, an address or card to
+// itself and, when listed under one, its customer. Lists link to
+// themselves and, when paginated, to the next and previous pages.
+func withLinks(ctx context.Context, response interface{}) interface{} {
+	lc, ok := ctx.Value(linksKey{}).(linkContext)
+	if !ok {
+		return response
+	}
+	switch r := response.(type) {
+	case users.User:
+		r.Links = users.CustomerLinks(lc.base, r.UserID)
+		return r
+	case userResponse:
+		r.User.Links = users.CustomerLinks(lc.base, r.User.UserID)
+		return r
+	case users.Address:
+		r.Links = users.AddressLinks(lc.base, r.ID, "")
+		return r
+	case users.Card:
+		r.Links = users.CardLinks(lc.base, r.ID, "")
+		return r
+	case EmbedStruct:
+		return lc.list(r)
+	}
+	return response
+}
+
+func (lc linkContext) list(e EmbedStruct) EmbedStruct {
+	// Addresses and cards listed under /customers/{id} belong to that customer
+	var owner string
+	if p := strings.Split(lc.url.Path, "/"); len(p) > 3 && p[1] == "customers" {
+		owner = p[2]
+	}
+	switch r := e.Embed.(type) {
+	case usersResponse:
+		us := make([]users.User, len(r.Users))
+		for i, u := range r.Users {
+			u.Links = users.CustomerLinks(lc.base, u.UserID)
+			us[i] = u
+		}
+		e.Embed = usersResponse{Users: us}
+	case addressesResponse:
+		as := make([]users.Address, len(r.Addresses))
+		for i, a := range r.Addresses {
+			a.Links = users.AddressLinks(lc.base, a.ID, owner)
+			as[i] = a
+		}
+		e.Embed = addressesResponse{Addresses: as}
+	case cardsResponse:
+		cs := make([]users.Card, len(r.Cards))
+		for i, c := range r.Cards {
+			c.Links = users.CardLinks(lc.base, c.ID, owner)
+			cs[i] = c
+		}
+		e.Embed = cardsResponse{Cards: cs}
+	default:
+		return e
+	}
+	e.Links = users.Links{"self": users.Href{Href: lc.base + lc.url.RequestURI()}}
+	if e.page.Size != 0 {
+		if e.page.More {
+			e.Links["next"] = users.Href{Href: lc.pageURL(e.page.Number+1, e.page.Size)}
+		}
+		if e.page.Number > 1 {
+			e.Links["prev"] = users.Href{Href: lc.pageURL(e.page.Number-1, e.page.Size)}
+		}
+	}
+	return e
+}
+
+func (lc linkContext) pageURL(page, size int) string {
+	u := *lc.url
+	q := u.Query()
+	q.Set("page", strconv.Itoa(page))
+	q.Set("size", strconv.Itoa(size))
+	u.RawQuery = q.Encode()
+	return lc.base + u.RequestURI()
+}
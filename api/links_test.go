@@ -0,0 +1,117 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+)
+
+func TestLinks(t *testing.T) {
+	s := NewFixedService(memory.New())
+	var ids []string
+	for _, name := range []string{"links1", "links2", "links3"} {
+		id, err := s.Register(name, "password", name+"@example.com", "first", "last", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	cardID, err := s.PostCard(users.Card{LongNum: "4111111111111111", Expires: "12/30", CCV: "123"}, ids[0], "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(s)
+
+	get := func(path string, v interface{}) {
+		t.Helper()
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = "users.example.com"
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for %v, received %v: %v", path, rec.Code, rec.Body.String())
+		}
+		if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	base := "https://users.example.com"
+
+	var u users.User
+	get("/customers/"+ids[0], &u)
+	for rel, want := range map[string]string{
+		"self":      base + "/customers/" + ids[0],
+		"addresses": base + "/customers/" + ids[0] + "/addresses",
+		"cards":     base + "/customers/" + ids[0] + "/cards",
+	} {
+		if got := u.Links[rel].Href; got != want {
+			t.Errorf("Expected %v link %v, received %v", rel, want, got)
+		}
+	}
+
+	var cards struct {
+		Embedded struct {
+			Card []users.Card `json:"card"`
+		} `json:"_embedded"`
+	}
+	get("/customers/"+ids[0]+"/cards", &cards)
+	if len(cards.Embedded.Card) != 1 {
+		t.Fatalf("Expected one card, received %v", cards.Embedded.Card)
+	}
+	if got := cards.Embedded.Card[0].Links["self"].Href; got != base+"/cards/"+cardID {
+		t.Errorf("Expected card self link, received %v", got)
+	}
+	if got := cards.Embedded.Card[0].Links["customer"].Href; got != base+"/customers/"+ids[0] {
+		t.Errorf("Expected card owner link, received %v", got)
+	}
+
+	var page struct {
+		Embedded struct {
+			Customer []users.User `json:"customer"`
+		} `json:"_embedded"`
+		Links users.Links `json:"_links"`
+	}
+	get("/customers?size=2", &page)
+	if len(page.Embedded.Customer) != 2 {
+		t.Fatalf("Expected two customers on the first page, received %v", len(page.Embedded.Customer))
+	}
+	if got := page.Links["self"].Href; got != base+"/customers?size=2" {
+		t.Errorf("Expected self link of the page, received %v", got)
+	}
+	if got := page.Links["next"].Href; got != base+"/customers?page=2&size=2" {
+		t.Errorf("Expected next link, received %v", got)
+	}
+	if _, ok := page.Links["prev"]; ok {
+		t.Error("Expected no prev link on the first page")
+	}
+
+	page.Links = nil
+	get("/customers?page=2&size=2", &page)
+	if len(page.Embedded.Customer) != 1 {
+		t.Fatalf("Expected one customer on the last page, received %v", len(page.Embedded.Customer))
+	}
+	if _, ok := page.Links["next"]; ok {
+		t.Error("Expected no next link on the last page")
+	}
+	if got := page.Links["prev"].Href; got != base+"/customers?page=1&size=2" {
+		t.Errorf("Expected prev link, received %v", got)
+	}
+
+	page.Embedded.Customer = nil
+	get("/customers?page=9223372036854775807&size=100", &page)
+	if len(page.Embedded.Customer) != 0 {
+		t.Errorf("Expected no customers past the last page, received %v", len(page.Embedded.Customer))
+	}
+
+	req := httptest.NewRequest("GET", "/customers?size=0", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an empty page, received %v", rec.Code)
+	}
+}
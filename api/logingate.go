@@ -0,0 +1,209 @@
+package api
+
+// logingate.go contains the hook run before login checks credentials, where
+// captcha or bot detection checks can be plugged in.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// CaptchaHeader carries the captcha token of a login attempt
+const CaptchaHeader = "X-Captcha-Token"
+
+// Keys of the metadata passed to LoginGate.Allow
+const (
+	MetaCaptchaToken = "captcha_token"
+	MetaUserAgent    = "user_agent"
+)
+
+// ErrChallengeRequired is returned when a login attempt must first pass a
+// challenge, like a captcha.
+var ErrChallengeRequired = errors.New("Challenge required")
+
+// LoginGate decides whether a login attempt may go on to the credential
+// check. Rejections should be ErrChallengeRequired.
+type LoginGate interface {
+	Allow(ctx context.Context, username, clientIP string, metadata map[string]string) error
+}
+
+// LoginRecorder is implemented by gates that want to know the outcome of the
+// login attempts they let through.
+type LoginRecorder interface {
+	Record(username, clientIP string, err error)
+}
+
+// NopLoginGate allows every login attempt
+type NopLoginGate struct{}
+
+// Allow returns nil
+func (NopLoginGate) Allow(context.Context, string, string, map[string]string) error {
+	return nil
+}
+
+// LoginGateMiddleware returns an endpoint middleware asking gate before each
+// login. The gate gets at most timeout to decide; a gate that takes longer
+// lets the attempt through, so a slow vendor cannot take login down.
+func LoginGateMiddleware(gate LoginGate, trusted []*net.IPNet, timeout time.Duration) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			req, ok := request.(loginRequest)
+			if !ok {
+				return next(ctx, request)
+			}
+			ip := clientIP(ctx, trusted)
+			gctx, cancel := context.WithTimeout(ctx, timeout)
+			err := gate.Allow(gctx, req.Username, ip, req.Metadata)
+			timedOut := gctx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+			cancel()
+			if err != nil && !timedOut {
+				return nil, err
+			}
+			response, err := next(ctx, request)
+			if r, ok := gate.(LoginRecorder); ok {
+				r.Record(req.Username, ip, err)
+			}
+			return response, err
+		}
+	}
+}
+
+// CaptchaVerifier checks a captcha token solved by the client
+type CaptchaVerifier interface {
+	Verify(ctx context.Context, token, clientIP string) error
+}
+
+// ThresholdGate lets login attempts through until Failures attempts from a
+// client IP failed within Window, then requires a verified captcha token
+// until a login from that IP succeeds or the window passes.
+type ThresholdGate struct {
+	Failures int
+	Window   time.Duration
+	Captcha  CaptchaVerifier
+
+	mu     sync.Mutex
+	counts map[string]*failureCount
+	swept  time.Time
+	now    func() time.Time
+}
+
+type failureCount struct {
+	n    int
+	last time.Time
+}
+
+// NewThresholdGate returns a ThresholdGate verifying captchas with captcha
+func NewThresholdGate(failures int, window time.Duration, captcha CaptchaVerifier) *ThresholdGate {
+	return &ThresholdGate{
+		Failures: failures,
+		Window:   window,
+		Captcha:  captcha,
+		counts:   make(map[string]*failureCount),
+		now:      time.Now,
+	}
+}
+
+// Allow requires a captcha from clients over the failure threshold
+func (g *ThresholdGate) Allow(ctx context.Context, _, clientIP string, metadata map[string]string) error {
+	if g.failures(clientIP) < g.Failures {
+		return nil
+	}
+	token := metadata[MetaCaptchaToken]
+	if token == "" {
+		return ErrChallengeRequired
+	}
+	if err := g.Captcha.Verify(ctx, token, clientIP); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrChallengeRequired
+	}
+	return nil
+}
+
+// Record counts failed logins and forgets the IP after a successful one
+func (g *ThresholdGate) Record(_, clientIP string, err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	switch {
+	case err == nil:
+		delete(g.counts, clientIP)
+	case errors.Is(err, ErrUnauthorized):
+		now := g.now()
+		c, ok := g.counts[clientIP]
+		if !ok || now.Sub(c.last) > g.Window {
+			c = &failureCount{}
+			g.counts[clientIP] = c
+		}
+		c.n++
+		c.last = now
+	}
+}
+
+func (g *ThresholdGate) failures(clientIP string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	if now.Sub(g.swept) > g.Window {
+		for ip, c := range g.counts {
+			if now.Sub(c.last) > g.Window {
+				delete(g.counts, ip)
+			}
+		}
+		g.swept = now
+	}
+	c, ok := g.counts[clientIP]
+	if !ok || now.Sub(c.last) > g.Window {
+		return 0
+	}
+	return c.n
+}
+
+// SiteVerifyCaptcha verifies tokens against a siteverify endpoint as offered
+// by reCAPTCHA, hCaptcha and Turnstile: a form post of secret, response and
+// remoteip answered by JSON with a success field.
+type SiteVerifyCaptcha struct {
+	URL    string
+	Secret string
+	Client *http.Client
+}
+
+var errCaptchaRejected = errors.New("Captcha rejected")
+
+// Verify posts token to the siteverify endpoint
+func (c SiteVerifyCaptcha) Verify(ctx context.Context, token, clientIP string) error {
+	form := url.Values{"secret": {c.Secret}, "response": {token}, "remoteip": {clientIP}}
+	req, err := http.NewRequest("POST", c.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return errCaptchaRejected
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type fakeCaptcha struct {
+	delay time.Duration
+}
+
+func (c fakeCaptcha) Verify(ctx context.Context, token, _ string) error {
+	select {
+	case <-time.After(c.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	if token != "solved" {
+		return errors.New("unsolved")
+	}
+	return nil
+}
+
+func TestThresholdGate(t *testing.T) {
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	if _, err := s.Register("gated", "password", "gated@example.com", "first", "last", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	tracer := noop.NewTracerProvider().Tracer("")
+	e := MakeEndpoints(s, tracer, log.NewNopLogger(), nil)
+	gate := NewThresholdGate(2, time.Minute, fakeCaptcha{})
+	e.LoginEndpoint = LoginGateMiddleware(gate, nil, time.Second)(e.LoginEndpoint)
+	h := MakeHTTPHandler(e, log.NewNopLogger())
+
+	login := func(password, captcha string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.SetBasicAuth("gated", password)
+		if captcha != "" {
+			req.Header.Set(CaptchaHeader, captcha)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < 2; i++ {
+		if rec := login("wrong", ""); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("Attempt %v: expected 401, received %v", i, rec.Code)
+		}
+	}
+	for _, captcha := range []string{"", "guessed"} {
+		rec := login("password", captcha)
+		if rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), `"code":"challenge_required"`) {
+			t.Errorf("Captcha %q: expected 403 requiring a challenge, received %v: %v", captcha, rec.Code, rec.Body.String())
+		}
+	}
+	if rec := login("password", "solved"); rec.Code != http.StatusOK {
+		t.Errorf("Expected login with solved captcha, received %v", rec.Code)
+	}
+	if rec := login("password", ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected failures forgotten after a successful login, received %v", rec.Code)
+	}
+}
+
+func TestLoginGateTimeout(t *testing.T) {
+	gate := NewThresholdGate(0, time.Minute, fakeCaptcha{delay: time.Hour})
+	called := false
+	next := func(context.Context, interface{}) (interface{}, error) {
+		called = true
+		return nil, nil
+	}
+	req := loginRequest{Username: "slow", Metadata: map[string]string{MetaCaptchaToken: "solved"}}
+	begin := time.Now()
+	if _, err := LoginGateMiddleware(gate, nil, 10*time.Millisecond)(next)(context.Background(), req); err != nil || !called {
+		t.Errorf("Expected login let through when the gate times out, received %v", err)
+	}
+	if took := time.Since(begin); took > time.Second {
+		t.Errorf("Expected gate bounded by its timeout, took %v", took)
+	}
+}
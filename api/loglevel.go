@@ -0,0 +1,177 @@
+package api
+
+// loglevel.go contains the log level of the service, adjustable at runtime
+// through the admin endpoint or signals.
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/redact"
+)
+
+// LogLevel is the least severity of the log lines written
+type LogLevel int32
+
+// The log levels, from the most verbose
+const (
+	// LevelDebug adds full request and response dumps
+	LevelDebug LogLevel = iota
+	// LevelInfo logs a line per request
+	LevelInfo
+	// LevelWarn logs failed requests only
+	LevelWarn
+	// LevelError logs requests failed by the service itself only
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// ErrInvalidLogLevel is returned for a log level other than debug, info,
+// warn or error
+var ErrInvalidLogLevel error = db.InputError("Invalid log level, expected debug, info, warn or error")
+
+// ParseLogLevel returns the log level named s
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, ErrInvalidLogLevel
+}
+
+func (l LogLevel) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+	return logLevelNames[l]
+}
+
+// LevelLogger passes on the lines of its level and above to the logger it
+// wraps. Lines without a level, like those of startup and shutdown, are
+// always passed on.
+type LevelLogger struct {
+	next  log.Logger
+	level int32
+}
+
+// NewLevelLogger returns a LevelLogger writing to next lines of l and above
+func NewLevelLogger(next log.Logger, l LogLevel) *LevelLogger {
+	return &LevelLogger{next: next, level: int32(l)}
+}
+
+// Log passes keyvals on unless their level is below that of the logger
+func (l *LevelLogger) Log(keyvals ...interface{}) error {
+	for i := 1; i < len(keyvals); i += 2 {
+		v, ok := keyvals[i].(level.Value)
+		if !ok {
+			continue
+		}
+		if lv, err := ParseLogLevel(v.String()); err == nil && lv < l.Level() {
+			return nil
+		}
+		break
+	}
+	return l.next.Log(keyvals...)
+}
+
+// Level returns the current level
+func (l *LevelLogger) Level() LogLevel {
+	return LogLevel(atomic.LoadInt32(&l.level))
+}
+
+// SetLevel changes the level to lv
+func (l *LevelLogger) SetLevel(lv LogLevel) {
+	atomic.StoreInt32(&l.level, int32(lv))
+}
+
+// Raise makes the logger one level more verbose, up to debug, returning the
+// new level
+func (l *LevelLogger) Raise() LogLevel {
+	return l.step(-1)
+}
+
+// Lower makes the logger one level less verbose, down to error, returning
+// the new level
+func (l *LevelLogger) Lower() LogLevel {
+	return l.step(1)
+}
+
+func (l *LevelLogger) step(d int32) LogLevel {
+	for {
+		cur := atomic.LoadInt32(&l.level)
+		next := cur + d
+		if next < int32(LevelDebug) || next > int32(LevelError) {
+			return LogLevel(cur)
+		}
+		if atomic.CompareAndSwapInt32(&l.level, cur, next) {
+			return LogLevel(next)
+		}
+	}
+}
+
+// requestLogger returns logger at the level of a request ending in err:
+// info for a success or a miss, warn for a failure caused by the request
+// and error for one of the service itself
+func requestLogger(logger log.Logger, err error) log.Logger {
+	switch {
+	case err == nil, db.ErrorKind(err) == db.KindNotFound:
+		return level.Info(logger)
+	case errorStatus(err) < http.StatusInternalServerError:
+		return level.Warn(logger)
+	}
+	return level.Error(logger)
+}
+
+// dump formats a request or response in full, sensitive fields redacted,
+// only once a line of it is written
+type dump struct {
+	v interface{}
+}
+
+func (d dump) String() string {
+	return redact.Sprint(d.v)
+}
+
+// logLevelBody is the body of the admin log level endpoint
+type logLevelBody struct {
+	Level string `json:"level"`
+}
+
+// MakeLogLevelHandler returns the handler of /admin/loglevel: GET answers
+// the level of l, PUT with a {"level": "debug"} body changes it. Every
+// request must carry one of keys in the X-API-Key header.
+func MakeLogLevelHandler(l *LevelLogger, keys *auth.APIKeys) http.Handler {
+	return requireKey(keys, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" {
+			var body logLevelBody
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				encodeError(r.Context(), ErrInvalidRequest, w)
+				return
+			}
+			lv, err := ParseLogLevel(body.Level)
+			if err != nil {
+				encodeError(r.Context(), err, w)
+				return
+			}
+			l.SetLevel(lv)
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(logLevelBody{Level: l.Level().String()})
+	}))
+}
+
+// WithLogLevelAdmin mounts the handler of MakeLogLevelHandler at
+// /admin/loglevel, for GET and PUT
+func WithLogLevelAdmin(l *LevelLogger, keys *auth.APIKeys) HTTPOption {
+	return func(cfg *httpConfig) {
+		cfg.logLevel = MakeLogLevelHandler(l, keys)
+	}
+}
@@ -0,0 +1,116 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db/memory"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestLevelLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLevelLogger(log.NewLogfmtLogger(&buf), LevelWarn)
+	logger := log.With(l, "ts", "now")
+	level.Info(logger).Log("msg", "dropped")
+	level.Warn(logger).Log("msg", "kept warn")
+	level.Error(logger).Log("msg", "kept error")
+	logger.Log("msg", "kept unlevelled")
+	for _, want := range []string{"kept warn", "kept error", "kept unlevelled"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q logged, received %v", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "dropped") {
+		t.Errorf("Expected info dropped at warn, received %v", buf.String())
+	}
+
+	for _, want := range []LogLevel{LevelInfo, LevelDebug, LevelDebug} {
+		if got := l.Raise(); got != want {
+			t.Errorf("Expected raised to %v, received %v", want, got)
+		}
+	}
+	for _, want := range []LogLevel{LevelInfo, LevelWarn, LevelError, LevelError} {
+		if got := l.Lower(); got != want {
+			t.Errorf("Expected lowered to %v, received %v", want, got)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err != ErrInvalidLogLevel {
+		t.Errorf("Expected unknown level refused, received %v", err)
+	}
+}
+
+func TestRequestLogLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLevelLogger(log.NewLogfmtLogger(&buf), LevelInfo)
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(NewFixedService(memory.New()), tracer, l, nil), log.NewNopLogger())
+	get := func(path string) string {
+		buf.Reset()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		return buf.String()
+	}
+
+	if logged := get("/customers"); !strings.Contains(logged, "level=info") || strings.Contains(logged, "request=") {
+		t.Errorf("Expected a success logged at info without dump, received %v", logged)
+	}
+	if logged := get("/customers/5a0e9c4e0000000000000000"); !strings.Contains(logged, "level=info") {
+		t.Errorf("Expected a miss logged at info, received %v", logged)
+	}
+	if logged := get("/customers/zzz"); !strings.Contains(logged, "level=warn") {
+		t.Errorf("Expected a bad request logged at warn, received %v", logged)
+	}
+
+	l.SetLevel(LevelDebug)
+	if logged := get("/customers"); !strings.Contains(logged, "level=debug") || !strings.Contains(logged, "request=") {
+		t.Errorf("Expected the request dumped at debug, received %v", logged)
+	}
+	l.SetLevel(LevelWarn)
+	if logged := get("/customers"); logged != "" {
+		t.Errorf("Expected successes quiet at warn, received %v", logged)
+	}
+}
+
+func TestLogLevelAdmin(t *testing.T) {
+	t.Setenv("TEST_API_KEYS", "ops="+auth.HashAPIKey("key"))
+	keys, err := auth.LoadAPIKeys("", "TEST_API_KEYS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLevelLogger(log.NewNopLogger(), LevelInfo)
+	h := MakeHTTPHandler(Endpoints{}, log.NewNopLogger(), WithLogLevelAdmin(l, keys))
+	serve := func(method, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/admin/loglevel", strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := serve("PUT", "", `{"level": "debug"}`); rec.Code != http.StatusUnauthorized || l.Level() != LevelInfo {
+		t.Errorf("Expected a change without key refused, received %v at %v", rec.Code, l.Level())
+	}
+	if rec := serve("PUT", "key", `{"level": "loud"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown level refused with 400, received %v", rec.Code)
+	}
+	rec := serve("PUT", "key", `{"level": "debug"}`)
+	if rec.Code != http.StatusOK || l.Level() != LevelDebug {
+		t.Fatalf("Expected the level changed, received %v at %v", rec.Code, l.Level())
+	}
+	var body logLevelBody
+	if err := json.NewDecoder(serve("GET", "key", "").Body).Decode(&body); err != nil || body.Level != "debug" {
+		t.Errorf("Expected the level answered, received %+v %v", body, err)
+	}
+	if rec := serve("POST", "key", `{"level": "info"}`); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected POST refused with 405, received %v", rec.Code)
+	}
+}
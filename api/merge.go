@@ -0,0 +1,84 @@
+package api
+
+// merge.go links the addresses and cards a guest created during checkout,
+// without a customer, to the customer the guest registers or logs in as.
+// A guest posting its first address or card is handed a guest session, which
+// it posts the others in; only those created in the session are linked, so
+// knowing the id of an address or card is not enough to take it.
+
+import "github.com/microservices-demo/user/auth"
+
+// MaxMergedAttributes bounds the addresses and cards merged by a single
+// registration or merge request
+const MaxMergedAttributes = 50
+
+// MergeResult lists the guest addresses and cards linked to a customer, and
+// those that could not be
+type MergeResult struct {
+	Addresses []string       `json:"addresses,omitempty"`
+	Cards     []string       `json:"cards,omitempty"`
+	Failed    []MergeFailure `json:"failed,omitempty"`
+}
+
+// MergeFailure is an address or card not linked, with the error code saying
+// why: address_not_found or card_not_found when it does not exist or was
+// created in another guest session,
+// already_linked when a customer holds it, invalid_id for a malformed id
+type MergeFailure struct {
+	Entity string `json:"entity"`
+	ID     string `json:"id"`
+	Code   string `json:"code"`
+}
+
+func (s *fixedService) MergeAttributes(id, session string, addresses, cards []string) MergeResult {
+	var r MergeResult
+	guest := ""
+	if auth.ValidGuestSession(session) {
+		guest = auth.HashGuestSession(session)
+	}
+	for _, aid := range addresses {
+		if err := s.link("addresses", aid, id, guest, &r); err == nil {
+			r.Addresses = append(r.Addresses, aid)
+		}
+	}
+	for _, cid := range cards {
+		if err := s.link("cards", cid, id, guest, &r); err == nil {
+			r.Cards = append(r.Cards, cid)
+		}
+	}
+	return r
+}
+
+// link links the attribute created in the guest session with hash guest to
+// the user, adding a failure to r when it cannot be
+func (s *fixedService) link(entity, id, userID, guest string, r *MergeResult) error {
+	err := s.db.LinkAttribute(entity, id, userID, guest)
+	if err != nil {
+		code, _ := errorDetails(serviceError(err))
+		r.Failed = append(r.Failed, MergeFailure{Entity: entity, ID: id, Code: code})
+	}
+	return err
+}
+
+// validMerge returns ErrInvalidRequest when the addresses and cards to merge
+// are too many, or are given without a guest session they were posted in
+func validMerge(session string, addresses, cards []string) error {
+	n := len(addresses) + len(cards)
+	if n > MaxMergedAttributes || n > 0 && !auth.ValidGuestSession(session) {
+		return ErrInvalidRequest
+	}
+	return nil
+}
+
+// guestSession returns the guest session an address or card posted without
+// a customer is created in: session when the guest has one, a new one
+// otherwise. The address or card keeps its hash.
+func guestSession(session string) (string, string, error) {
+	if session == "" {
+		return auth.NewGuestSession()
+	}
+	if !auth.ValidGuestSession(session) {
+		return "", "", ErrInvalidRequest
+	}
+	return session, auth.HashGuestSession(session), nil
+}
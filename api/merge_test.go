@@ -0,0 +1,110 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+)
+
+func TestMergeAttributes(t *testing.T) {
+	d := memory.New()
+	s := NewFixedService(d)
+	h := newTestHandler(s)
+	other, err := s.Register("other", "password", "other@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, err := s.PostAddress(users.Address{Street: "held", City: "city"}, other, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(path, body string) postResponse {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		var res postResponse
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || rec.Code != http.StatusOK || res.ID == "" || res.GuestSession == "" {
+			t.Fatalf("Expected %v to succeed in a guest session, received %v %+v %v", path, rec.Code, res, err)
+		}
+		return res
+	}
+	// guest posts an address and a card in a guest session, the first post
+	// starting it
+	guest := func() (string, string, string) {
+		a := post("/addresses", `{"street": "High Street", "city": "London", "country": "United Kingdom", "postcode": "sw1a1aa"}`)
+		c := post("/cards", `{"longNum": "4111111111111111", "expires": "12/30", "guestSession": "`+a.GuestSession+`"}`)
+		if c.GuestSession != a.GuestSession {
+			t.Fatalf("Expected the card posted in the session of the address, received %v", c.GuestSession)
+		}
+		return a.GuestSession, a.ID, c.ID
+	}
+	session, address, card := guest()
+	_, foreign, _ := guest()
+	missing := "5a0e9c4e0000000000000000"
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/register", strings.NewReader(`{"username": "guest", "password": "password", "email": "guest@example.com", "firstName": "first", "lastName": "last",
+		"guestSession": "`+session+`", "guestAddresses": ["`+address+`", "`+held+`", "`+foreign+`"], "guestCards": ["`+card+`", "`+missing+`"]}`)))
+	var reg postResponse
+	if err := json.NewDecoder(rec.Body).Decode(&reg); err != nil || rec.Code != http.StatusOK || reg.ID == "" {
+		t.Fatalf("Expected the registration to succeed, received %v %+v %v", rec.Code, reg, err)
+	}
+	want := &MergeResult{
+		Addresses: []string{address},
+		Cards:     []string{card},
+		Failed: []MergeFailure{
+			{Entity: "addresses", ID: held, Code: CodeAddressNotFound},
+			{Entity: "addresses", ID: foreign, Code: CodeAddressNotFound},
+			{Entity: "cards", ID: missing, Code: CodeCardNotFound},
+		},
+	}
+	if !reflect.DeepEqual(reg.Merged, want) {
+		t.Errorf("Expected %+v merged, received %+v", want, reg.Merged)
+	}
+	u, err := s.GetUser(reg.ID)
+	if err != nil || len(u.Addresses) != 1 || u.Addresses[0].ID != address || len(u.Cards) != 1 || u.DefaultCard != card {
+		t.Errorf("Expected the guest address and card linked, received %+v %v", u, err)
+	}
+	if o, _ := s.GetUser(other); len(o.Addresses) != 1 || o.Addresses[0].ID != held {
+		t.Errorf("Expected the other customer to keep its address, received %+v", o.Addresses)
+	}
+
+	// A login leaves guest attributes alone, a merge after it links them
+	session, address, card = guest()
+	req := httptest.NewRequest("GET", "/login?guestAddresses="+address+"&guestCards="+card, nil)
+	req.SetBasicAuth("guest", "password")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if u, _ := s.GetUser(reg.ID); rec.Code != http.StatusOK || len(u.Addresses) != 1 {
+		t.Errorf("Expected the login to merge nothing, received %v %+v", rec.Code, u.Addresses)
+	}
+	merge := func(body string) (*httptest.ResponseRecorder, MergeResult) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/customers/"+reg.ID+"/merge", strings.NewReader(body)))
+		var r MergeResult
+		json.NewDecoder(rec.Body).Decode(&r)
+		return rec, r
+	}
+	rec, r := merge(`{"guestSession": "` + session + `", "guestAddresses": ["` + address + `"], "guestCards": ["` + card + `"]}`)
+	if rec.Code != http.StatusOK || len(r.Addresses) != 1 || len(r.Cards) != 1 || len(r.Failed) != 0 {
+		t.Errorf("Expected the address and card merged, received %v %+v", rec.Code, r)
+	}
+	if _, r := merge(`{"guestSession": "` + session + `", "guestAddresses": ["` + address + `"]}`); len(r.Failed) != 1 || r.Failed[0].Code != CodeAlreadyLinked {
+		t.Errorf("Expected a merged address not merged again, received %+v", r)
+	}
+	if rec, _ := merge(`{"guestAddresses": ["` + foreign + `"]}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected ids without a guest session refused, received %v", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/register", strings.NewReader(`{"username": "many", "password": "password", "email": "many@example.com", "firstName": "first", "lastName": "last",
+		"guestSession": "`+session+`", "guestCards": [`+strings.Repeat(`"`+missing+`", `, MaxMergedAttributes)+`"`+missing+`"]}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected more than %v guest ids refused, received %v", MaxMergedAttributes, rec.Code)
+	}
+}
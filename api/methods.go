@@ -0,0 +1,54 @@
+package api
+
+// methods.go answers requests no route serves: a path served with other
+// methods is answered 405 with the methods it is served with, any other
+// path 404, both in the error envelope.
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// ErrMethodNotAllowed answers a request to a path not served with its method
+var ErrMethodNotAllowed = errors.New("Method not allowed")
+
+// ErrRouteNotFound answers a request to a path no route serves
+var ErrRouteNotFound = errors.New("Not found")
+
+// routeMethods are the methods routes are probed with for the Allow header
+var routeMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+// handleUnrouted answers the requests r has no route for. Whether the path
+// is served with other methods is found by probing r rather than trusted to
+// the router, which loses a method mismatch when a later route matches the
+// method but not the path.
+func handleUnrouted(r *mux.Router) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		allowed := allowedMethods(r, req)
+		if len(allowed) == 0 {
+			encodeError(req.Context(), ErrRouteNotFound, w)
+			return
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		encodeError(req.Context(), ErrMethodNotAllowed, w)
+	})
+	r.NotFoundHandler = h
+	r.MethodNotAllowedHandler = h
+}
+
+// allowedMethods returns the methods r serves the path of req with
+func allowedMethods(r *mux.Router, req *http.Request) []string {
+	var allowed []string
+	for _, m := range routeMethods {
+		probe := req.Clone(req.Context())
+		probe.Method = m
+		var match mux.RouteMatch
+		if r.Match(probe, &match) && match.MatchErr == nil {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
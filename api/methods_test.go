@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/microservices-demo/user/db/memory"
+)
+
+func TestUnsupportedMethods(t *testing.T) {
+	h := newTestHandler(NewFixedService(memory.New())).(*mux.Router)
+	const id = "5a0e9c4e0000000000000000"
+	// Every path the service serves and the methods it serves it with. A
+	// nil list is served with any method.
+	paths := []struct {
+		path    string
+		methods []string
+	}{
+		{"/login", []string{"GET"}},
+		{"/login/mfa", []string{"POST"}},
+		{"/token/refresh", []string{"POST"}},
+		{"/logout", []string{"POST"}},
+		{"/register", []string{"POST"}},
+		{"/customers", []string{"GET", "POST"}},
+		{"/customers/" + id, []string{"GET", "PUT", "PATCH", "DELETE"}},
+		{"/customers/" + id + "/addresses", []string{"GET"}},
+		{"/customers/" + id + "/cards", []string{"GET"}},
+		{"/customers/" + id + "/cards/" + id, []string{"GET", "PATCH"}},
+		{"/customers/" + id + "/password", []string{"GET", "POST"}},
+		{"/customers/" + id + "/logout-all", []string{"GET", "POST"}},
+		{"/customers/" + id + "/roles", []string{"GET", "PUT"}},
+		{"/admin/impersonate/" + id, []string{"POST"}},
+		{"/customers/" + id + "/status", []string{"GET", "PUT"}},
+		{"/customers/" + id + "/preferences", []string{"GET", "PUT"}},
+		{"/customers/" + id + "/addresses/" + id + "/default", []string{"GET", "POST"}},
+		{"/customers/" + id + "/cards/" + id + "/default", []string{"GET", "POST"}},
+		{"/customers/" + id + "/merge", []string{"GET", "POST"}},
+		{"/customers/" + id + "/emails", []string{"GET", "POST"}},
+		{"/customers/" + id + "/emails/a@example.com", []string{"GET", "DELETE"}},
+		{"/customers/" + id + "/emails/a@example.com/verify", []string{"GET", "POST"}},
+		{"/customers/" + id + "/emails/a@example.com/primary", []string{"GET", "POST"}},
+		{"/customers/" + id + "/consents", []string{"GET", "PUT"}},
+		{"/customers/" + id + "/mfa", []string{"GET", "POST"}},
+		{"/customers/" + id + "/mfa/confirm", []string{"GET", "POST"}},
+		{"/customers/" + id + "/mfa/disable", []string{"GET", "POST"}},
+		{"/addresses", []string{"GET", "POST"}},
+		{"/addresses/" + id, []string{"GET", "DELETE"}},
+		{"/cards", []string{"GET", "POST"}},
+		{"/cards/" + id, []string{"GET", "DELETE"}},
+		{"/health", []string{"GET"}},
+		{"/version", []string{"GET"}},
+		{"/live", []string{"GET"}},
+		{"/ready", []string{"GET"}},
+		{"/metrics", nil},
+	}
+
+	// Every route of the handler must be listed, so a new one cannot be
+	// added without its methods being checked
+	err := h.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		methods, err := route.GetMethods()
+		if err != nil {
+			methods = routeMethods
+		}
+		for _, m := range methods {
+			listed := false
+			for _, p := range paths {
+				var match mux.RouteMatch
+				if route.Match(httptest.NewRequest(m, p.path, nil), &match) && (p.methods == nil || contains(p.methods, m)) {
+					listed = true
+					break
+				}
+			}
+			if !listed {
+				tpl, _ := route.GetPathTemplate()
+				t.Errorf("Route %v %v is not listed", m, tpl)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range paths {
+		if p.methods == nil {
+			continue
+		}
+		for _, m := range routeMethods {
+			if contains(p.methods, m) {
+				continue
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(m, p.path, nil))
+			if rec.Code != http.StatusMethodNotAllowed {
+				t.Errorf("Expected 405 for %v %v, received %v", m, p.path, rec.Code)
+				continue
+			}
+			if got, want := rec.Header().Get("Allow"), strings.Join(p.methods, ", "); got != want {
+				t.Errorf("Expected Allow %q for %v %v, received %q", want, m, p.path, got)
+			}
+			var body ErrorBody
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Code != CodeMethodNotAllowed {
+				t.Errorf("Expected code %v for %v %v, received %v", CodeMethodNotAllowed, m, p.path, body.Error.Code)
+			}
+		}
+	}
+
+	for _, path := range []string{"/", "/unknown", "/login/unknown", "/register/" + id, "/orders/" + id} {
+		for _, m := range routeMethods {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(m, path, nil))
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("Expected 404 for %v %v, received %v", m, path, rec.Code)
+				continue
+			}
+			var body ErrorBody
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error.Code != CodeNotFound {
+				t.Errorf("Expected code %v for %v %v, received %v", CodeNotFound, m, path, body.Error.Code)
+			}
+		}
+	}
+}
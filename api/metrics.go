@@ -0,0 +1,62 @@
+package api
+
+// metrics.go records the rate, errors and duration of requests per
+// endpoint, labelled like the endpoint log lines.
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/db"
+)
+
+// EndpointMetrics are the metrics of the endpoints. The counters and the
+// histogram are labelled by method, status_code, the status the request is
+// answered with, and status_class, its class (2xx, 4xx or 5xx), telling
+// mistakes of clients from failures of the service; the gauge by method.
+type EndpointMetrics struct {
+	// Requests counts the requests served
+	Requests metrics.Counter
+	// Errors counts the requests answered with an error, lookups of
+	// entities that do not exist aside
+	Errors metrics.Counter
+	// Duration observes the time taken to serve requests, in seconds
+	Duration metrics.Histogram
+	// InFlight is the number of requests being served
+	InFlight metrics.Gauge
+}
+
+// WithEndpointMetrics records the requests of the endpoints in m
+func WithEndpointMetrics(m EndpointMetrics) EndpointsOption {
+	return func(cfg *endpointsConfig) {
+		cfg.metrics = &m
+	}
+}
+
+// instrument returns an endpoint calling next that records its requests
+// as those of method in m
+func instrument(next endpoint.Endpoint, method string, m EndpointMetrics) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		inflight := m.InFlight.With("method", method)
+		inflight.Add(1)
+		begin := time.Now()
+		response, err := next(ctx, request)
+		inflight.Add(-1)
+		code := http.StatusOK
+		if err != nil {
+			code = errorStatus(err)
+		}
+		labels := []string{"method", method, "status_code", strconv.Itoa(code), "status_class", statusClass(code)}
+		m.Requests.With(labels...).Add(1)
+		// A miss is an ordinary outcome, not an error
+		if err != nil && db.ErrorKind(err) != db.KindNotFound {
+			m.Errors.With(labels...).Add(1)
+		}
+		m.Duration.With(labels...).Observe(time.Since(begin).Seconds())
+		return response, err
+	}
+}
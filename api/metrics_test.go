@@ -0,0 +1,122 @@
+package api
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/discard"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestEndpointMetrics(t *testing.T) {
+	labels := []string{"method", "status_code", "status_class"}
+	requests := stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "requests"}, labels)
+	errs := stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "errors"}, labels)
+	duration := stdprometheus.NewHistogramVec(stdprometheus.HistogramOpts{Name: "duration"}, labels)
+	inflight := stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{Name: "inflight"}, []string{"method"})
+	m := EndpointMetrics{
+		Requests: kitprometheus.NewCounter(requests),
+		Errors:   kitprometheus.NewCounter(errs),
+		Duration: kitprometheus.NewHistogram(duration),
+		InFlight: kitprometheus.NewGauge(inflight),
+	}
+
+	s := NewFixedService(memory.New())
+	if _, err := s.Register("metrics", "password", "metrics@example.com", "first", "last", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), nil, WithEndpointMetrics(m)), log.NewNopLogger())
+	for _, tc := range []struct{ user, password string }{
+		{"metrics", "password"},
+		{"metrics", "password"},
+		{"metrics", "wrong"},
+	} {
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.SetBasicAuth(tc.user, tc.password)
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/customers/zzz", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/customers/5a0e9c4e0000000000000000", nil))
+
+	for _, tc := range []struct {
+		vec    *stdprometheus.CounterVec
+		labels []string
+		want   float64
+	}{
+		{requests, []string{methodLogin, "200", "2xx"}, 2},
+		{requests, []string{methodLogin, "401", "4xx"}, 1},
+		{errs, []string{methodLogin, "200", "2xx"}, 0},
+		{errs, []string{methodLogin, "401", "4xx"}, 1},
+		{requests, []string{methodGetUsers, "400", "4xx"}, 1},
+		{errs, []string{methodGetUsers, "400", "4xx"}, 1},
+		{requests, []string{methodGetUsers, "404", "4xx"}, 1},
+		{errs, []string{methodGetUsers, "404", "4xx"}, 0},
+	} {
+		if got := testutil.ToFloat64(tc.vec.WithLabelValues(tc.labels...)); got != tc.want {
+			t.Errorf("Expected %v for %v, received %v", tc.want, tc.labels, got)
+		}
+	}
+	if got := testutil.CollectAndCount(duration); got != 4 {
+		t.Errorf("Expected durations of 4 series, received %v", got)
+	}
+	if got := testutil.ToFloat64(inflight.WithLabelValues(methodLogin)); got != 0 {
+		t.Errorf("Expected no request in flight, received %v", got)
+	}
+}
+
+// failingUsers fails lookups of customers as a database down would
+type failingUsers struct {
+	Service
+}
+
+func (failingUsers) GetUser(id string) (users.User, error) {
+	return users.User{}, errors.New("no reachable servers")
+}
+
+func TestEndpointMetricsStatusClass(t *testing.T) {
+	labels := []string{"method", "status_code", "status_class"}
+	requests := stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "requests"}, labels)
+	errs := stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "errors"}, labels)
+	m := EndpointMetrics{
+		Requests: kitprometheus.NewCounter(requests),
+		Errors:   kitprometheus.NewCounter(errs),
+		Duration: discard.NewHistogram(),
+		InFlight: discard.NewGauge(),
+	}
+	tracer := noop.NewTracerProvider().Tracer("")
+	serve := func(s Service, path string) {
+		h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), nil, WithEndpointMetrics(m)), log.NewNopLogger())
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	s := NewFixedService(memory.New())
+	serve(s, "/customers/5a0e9c4e0000000000000000")
+	serve(s, "/customers/zzz")
+	serve(failingUsers{s}, "/customers/5a0e9c4e0000000000000000")
+
+	for _, tc := range []struct {
+		labels           []string
+		requests, errors float64
+	}{
+		{[]string{methodGetUsers, "404", "4xx"}, 1, 0},
+		{[]string{methodGetUsers, "400", "4xx"}, 1, 1},
+		{[]string{methodGetUsers, "500", "5xx"}, 1, 1},
+	} {
+		if got := testutil.ToFloat64(requests.WithLabelValues(tc.labels...)); got != tc.requests {
+			t.Errorf("Expected %v requests for %v, received %v", tc.requests, tc.labels, got)
+		}
+		if got := testutil.ToFloat64(errs.WithLabelValues(tc.labels...)); got != tc.errors {
+			t.Errorf("Expected %v errors for %v, received %v", tc.errors, tc.labels, got)
+		}
+	}
+	if got := testutil.CollectAndCount(requests); got != 3 {
+		t.Errorf("Expected 3 label sets, received %v", got)
+	}
+}
@@ -0,0 +1,239 @@
+package api
+
+// mfa.go contains the TOTP based two-factor authentication: enrollment,
+// its removal, and the second step of logins for enrolled users.
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+)
+
+var (
+	// ErrMFAUnavailable is returned when two-factor authentication is used
+	// without a token issuer and secret key configured
+	ErrMFAUnavailable = errors.New("Two-factor authentication is not configured")
+	// ErrMFAEnrolled is returned when enrolling a user who already is
+	ErrMFAEnrolled = errors.New("Two-factor authentication is already enabled")
+	// ErrMFANotEnrolled is returned for users without a (pending) enrollment
+	ErrMFANotEnrolled = errors.New("Two-factor authentication is not enabled")
+)
+
+const (
+	reasonWrongCode        = "wrong code"
+	reasonInvalidChallenge = "invalid challenge"
+	recoveryCodeCount      = 10
+)
+
+// MFARequiredError is returned by Login for users enrolled in two-factor
+// authentication. The challenge is exchanged with a code for the token.
+type MFARequiredError struct {
+	Challenge string
+}
+
+func (e MFARequiredError) Error() string {
+	return "Two-factor authentication required"
+}
+
+// WithMFA enables two-factor authentication. Secrets are sealed with sealer
+// and issuer names the service in authenticator apps.
+func WithMFA(sealer *auth.Sealer, issuer string) ServiceOption {
+	return func(s *fixedService) {
+		s.mfaSealer = sealer
+		s.mfaIssuer = issuer
+	}
+}
+
+func (s *fixedService) mfaAvailable() bool {
+	return s.tokens != nil && s.mfaSealer != nil
+}
+
+// ProvisionMFA creates a new TOTP secret for the user, replacing any pending
+// one. Two-factor authentication is only enabled by ConfirmMFA, and only
+// users holding the admin role may enroll, ErrForbidden refusing others.
+func (s *fixedService) ProvisionMFA(id string) (string, string, error) {
+	if !s.mfaAvailable() {
+		return "", "", ErrMFAUnavailable
+	}
+	u, err := s.db.GetUser(id)
+	if err != nil {
+		return "", "", err
+	}
+	if !u.HasRole(users.RoleAdmin) {
+		return "", "", ErrForbidden
+	}
+	m, err := s.db.GetMFA(id)
+	if err != nil {
+		return "", "", err
+	}
+	if m.Enabled {
+		return "", "", ErrMFAEnrolled
+	}
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		return "", "", err
+	}
+	sealed, err := s.mfaSealer.Seal(secret)
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.db.SetMFA(id, users.MFA{Secret: sealed}); err != nil {
+		return "", "", err
+	}
+	return secret, auth.TOTPURI(s.mfaIssuer, u.Username, secret), nil
+}
+
+// ConfirmMFA enables the pending enrollment of the user once code proves
+// the authenticator was set up, returning the recovery codes. They are only
+// ever shown here.
+func (s *fixedService) ConfirmMFA(id, code string) ([]string, error) {
+	if !s.mfaAvailable() {
+		return nil, ErrMFAUnavailable
+	}
+	m, err := s.db.GetMFA(id)
+	if err != nil {
+		return nil, err
+	}
+	if m.Enabled {
+		return nil, ErrMFAEnrolled
+	}
+	if m.Secret == "" {
+		return nil, ErrMFANotEnrolled
+	}
+	step, err := s.checkTOTP(m, code)
+	if err != nil {
+		return nil, err
+	}
+	codes, hashes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	m.Enabled = true
+	m.LastStep = step
+	m.RecoveryCodes = hashes
+	if err := s.db.SetMFA(id, m); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// DisableMFA removes the enrollment of the user given a current code or one
+// of the recovery codes.
+func (s *fixedService) DisableMFA(id, code string) error {
+	if !s.mfaAvailable() {
+		return ErrMFAUnavailable
+	}
+	m, err := s.db.GetMFA(id)
+	if err != nil {
+		return err
+	}
+	if !m.Enabled {
+		return ErrMFANotEnrolled
+	}
+	if err := s.verifySecondFactor(id, m, code); err != nil {
+		return err
+	}
+	return s.db.SetMFA(id, users.MFA{})
+}
+
+// LoginMFA completes the login of an enrolled user, exchanging the challenge
+// returned by Login and a code for the user and an access token.
+func (s *fixedService) LoginMFA(challenge, code string) (users.User, string, error) {
+	if !s.mfaAvailable() {
+		return users.New(), "", ErrMFAUnavailable
+	}
+	c, err := s.tokens.ParseChallenge(challenge)
+	if err != nil {
+		return users.New(), "", s.authFailure(reasonInvalidChallenge)
+	}
+	id := c.UserID()
+	m, err := s.db.GetMFA(id)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && !m.Enabled) {
+		return users.New(), "", s.authFailure(reasonInvalidChallenge)
+	}
+	if err != nil {
+		return users.New(), "", err
+	}
+	if err := s.verifySecondFactor(id, m, code); err != nil {
+		return users.New(), "", err
+	}
+	// The challenge is spent, whether or not a denylist enforces it
+	s.tokens.Revoke(c)
+	u, err := s.db.GetUser(id)
+	if err != nil {
+		return users.New(), "", err
+	}
+	// Disabled since the challenge was issued
+	if u.Disabled() {
+		return users.New(), "", ErrAccountDisabled
+	}
+	u.AddLinks()
+	s.getUserAttributes(&u)
+	u.MaskCCs()
+	token, err := s.tokens.IssueVersion(u.UserID, u.Username, u.CredentialsVersion, u.Roles...)
+	if err != nil {
+		return users.New(), "", err
+	}
+	return u, token, nil
+}
+
+// mfaChallenge returns the error Login returns for an enrolled user, or nil
+// when the user is not enrolled.
+func (s *fixedService) mfaChallenge(u users.User) error {
+	m, err := s.db.GetMFA(u.UserID)
+	if err != nil {
+		return err
+	}
+	if !m.Enabled {
+		return nil
+	}
+	if !s.mfaAvailable() {
+		// Never let an enrolled user in on the password alone
+		return ErrMFAUnavailable
+	}
+	challenge, err := s.tokens.IssueChallenge(u.UserID, u.Username)
+	if err != nil {
+		return err
+	}
+	return MFARequiredError{Challenge: challenge}
+}
+
+// verifySecondFactor accepts a TOTP code, recording its step so it cannot
+// be used again, or a recovery code, which is used up.
+func (s *fixedService) verifySecondFactor(id string, m users.MFA, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) != 6 {
+		err := s.db.UseRecoveryCode(id, auth.HashRecoveryCode(code))
+		if errors.Is(err, db.ErrNotFound) {
+			return s.authFailure(reasonWrongCode)
+		}
+		return err
+	}
+	step, err := s.checkTOTP(m, code)
+	if err != nil {
+		return err
+	}
+	err = s.db.UseMFAStep(id, step)
+	if errors.Is(err, db.ErrNotFound) {
+		// Another request used the code first
+		return s.authFailure(reasonWrongCode)
+	}
+	return err
+}
+
+// checkTOTP returns the step code is valid for
+func (s *fixedService) checkTOTP(m users.MFA, code string) (int64, error) {
+	secret, err := s.mfaSealer.Open(m.Secret)
+	if err != nil {
+		return 0, err
+	}
+	step, ok := auth.VerifyTOTP(secret, strings.TrimSpace(code), time.Now(), m.LastStep)
+	if !ok {
+		return 0, s.authFailure(reasonWrongCode)
+	}
+	return step, nil
+}
@@ -0,0 +1,151 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMFA(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealer, err := auth.NewSealer([]byte("mfa key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := memory.New()
+	s := NewFixedService(d, WithTokenIssuer(issuer), WithMFA(sealer, "Sock Shop"),
+		WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	id, err := s.Register("admin", "password", "admin@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := issuer.Issue(id, "admin", auth.RoleAdmin)
+	customer, err := s.Register("customer", "password", "customer@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	customerToken, _ := issuer.Issue(customer, "customer")
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer), log.NewNopLogger())
+	do := func(method, path, bearer, body string, out interface{}) int {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+bearer)
+		}
+		if method == "GET" {
+			req.SetBasicAuth("admin", "password")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if out != nil {
+			json.NewDecoder(rec.Body).Decode(out)
+		}
+		return rec.Code
+	}
+
+	if code := do("POST", "/customers/"+customer+"/mfa", customerToken, "", nil); code != http.StatusForbidden {
+		t.Errorf("Expected a customer refused enrollment, received %v", code)
+	}
+	if err := d.SetUserRoles(id, []string{users.RoleCustomer, users.RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	var prov mfaProvisionResponse
+	if code := do("POST", "/customers/"+id+"/mfa", token, "", &prov); code != http.StatusOK {
+		t.Fatalf("Expected 200 provisioning, received %v", code)
+	}
+	if !strings.HasPrefix(prov.URI, "otpauth://totp/") || !strings.Contains(prov.URI, prov.Secret) {
+		t.Errorf("Unexpected provisioning %+v", prov)
+	}
+	step := auth.TOTPStep(time.Now())
+	code := func(step int64) string {
+		c, _ := auth.TOTPCode(prov.Secret, step)
+		return c
+	}
+
+	if c := do("POST", "/customers/"+id+"/mfa/confirm", token, `{"code": "000000x"}`, nil); c != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong code refused, received %v", c)
+	}
+	var rc recoveryCodesResponse
+	if c := do("POST", "/customers/"+id+"/mfa/confirm", token, `{"code": "`+code(step)+`"}`, &rc); c != http.StatusOK {
+		t.Fatalf("Expected 200 confirming, received %v", c)
+	}
+	if len(rc.RecoveryCodes) != recoveryCodeCount {
+		t.Errorf("Expected %d recovery codes, received %v", recoveryCodeCount, rc.RecoveryCodes)
+	}
+	if c := do("POST", "/customers/"+id+"/mfa", token, "", nil); c != http.StatusConflict {
+		t.Errorf("Expected 409 provisioning again, received %v", c)
+	}
+
+	var challenge mfaRequiredResponse
+	if c := do("GET", "/login", "", "", &challenge); c != http.StatusOK || !challenge.MFARequired || challenge.Challenge == "" {
+		t.Fatalf("Expected a challenge, received %v %+v", c, challenge)
+	}
+	if c := do("DELETE", "/customers/"+id, challenge.Challenge, "", nil); c != http.StatusUnauthorized {
+		t.Errorf("Expected the challenge refused as access token, received %v", c)
+	}
+	login := func(code string) (int, userResponse) {
+		var ur userResponse
+		c := do("POST", "/login/mfa", "", `{"challenge": "`+challenge.Challenge+`", "code": "`+code+`"}`, &ur)
+		return c, ur
+	}
+	if c, _ := login(code(step)); c != http.StatusUnauthorized {
+		t.Errorf("Expected the code used for confirming refused, received %v", c)
+	}
+	if c, ur := login(code(step + 1)); c != http.StatusOK || ur.Token == "" || ur.User.UserID != id {
+		t.Errorf("Expected a token for the next code, received %v %+v", c, ur)
+	}
+	if c, _ := login(code(step + 1)); c != http.StatusUnauthorized {
+		t.Errorf("Expected a replayed code refused, received %v", c)
+	}
+	if c, ur := login(strings.ToUpper(rc.RecoveryCodes[0])); c != http.StatusOK || ur.Token == "" {
+		t.Errorf("Expected a token for a recovery code, received %v", c)
+	}
+	if c, _ := login(rc.RecoveryCodes[0]); c != http.StatusUnauthorized {
+		t.Errorf("Expected a used recovery code refused, received %v", c)
+	}
+
+	if c := do("POST", "/customers/"+id+"/mfa/disable", token, `{"code": "`+rc.RecoveryCodes[1]+`"}`, nil); c != http.StatusOK {
+		t.Fatalf("Expected 200 disabling, received %v", c)
+	}
+	var ur userResponse
+	if c := do("GET", "/login", "", "", &ur); c != http.StatusOK || ur.Token == "" {
+		t.Errorf("Expected a token on the password alone, received %v %+v", c, ur)
+	}
+}
+
+func TestMFAUnavailable(t *testing.T) {
+	issuer, _ := auth.NewIssuer(auth.HS256, []byte("secret"))
+	sealer, _ := auth.NewSealer([]byte("mfa key"))
+	d := memory.New()
+	hasher := WithHasher(users.NewBcryptHasher(bcrypt.MinCost))
+	s := NewFixedService(d, WithTokenIssuer(issuer), WithMFA(sealer, "Sock Shop"), hasher)
+	id, _ := s.Register("admin", "password", "admin@example.com", "first", "last", "", "")
+	d.SetUserRoles(id, []string{users.RoleAdmin})
+	secret, _, err := s.ProvisionMFA(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := auth.TOTPCode(secret, auth.TOTPStep(time.Now()))
+	if _, err := s.ConfirmMFA(id, c); err != nil {
+		t.Fatal(err)
+	}
+
+	// An enrolled user must not get in on the password once MFA is off
+	s = NewFixedService(d, WithTokenIssuer(issuer), hasher)
+	if _, token, err := s.Login("admin", "password", false); err != ErrMFAUnavailable || token != "" {
+		t.Errorf("Expected ErrMFAUnavailable, received %q %v", token, err)
+	}
+}
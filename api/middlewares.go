@@ -1,10 +1,14 @@
 package api
 
 import (
+	"context"
+	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/redact"
 	"github.com/microservices-demo/user/users"
 )
 
@@ -26,137 +30,543 @@ type loggingMiddleware struct {
 	logger log.Logger
 }
 
-func (mw loggingMiddleware) Login(username, password string) (user users.User, err error) {
+// withContext logs the calls with the trace and request ids of ctx, which
+// join them to the line the endpoint logs of the request
+func (mw loggingMiddleware) withContext(ctx context.Context) Service {
+	requestID, _ := RequestIDFromContext(ctx)
+	return loggingMiddleware{
+		next:   withContext(mw.next, ctx),
+		logger: log.With(mw.logger, "traceid", traceID(ctx), "request_id", requestID),
+	}
+}
+
+// log logs the call begun at begin, with the fields of its method, at the
+// level requestLogger gives err
+func (mw loggingMiddleware) log(begin time.Time, err error, keyvals ...interface{}) {
+	if err != nil {
+		keyvals = append(keyvals, "err", err.Error())
+	}
+	keyvals = append(keyvals, "took", time.Since(begin))
+	requestLogger(mw.logger, err).Log(keyvals...)
+}
+
+// found is the count of entities a read of one by id found
+func found(id string) int {
+	if id == "" {
+		return 0
+	}
+	return 1
+}
+
+func (mw loggingMiddleware) Login(username, password string, attributes bool) (user users.User, token string, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.log(begin, err,
 			"method", "Login",
-			"took", time.Since(begin),
+			"attributes", attributes,
 		)
 	}(time.Now())
-	return mw.next.Login(username, password)
+	return mw.next.Login(username, password, attributes)
 }
 
-func (mw loggingMiddleware) Register(username, password, email, first, last string) (string, error) {
+func (mw loggingMiddleware) LogoutAll(id, principal string) (err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.log(begin, err,
+			"method", "LogoutAll",
+			"id", id,
+			"principal", principal,
+		)
+	}(time.Now())
+	return mw.next.LogoutAll(id, principal)
+}
+
+func (mw loggingMiddleware) Impersonate(id, impersonator string) (u users.User, token string, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "Impersonate",
+			"id", id,
+			"impersonator", impersonator,
+		)
+	}(time.Now())
+	return mw.next.Impersonate(id, impersonator)
+}
+
+func (mw loggingMiddleware) AuditImpersonation(id, impersonator, method string, refused bool) (err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "AuditImpersonation",
+			"id", id,
+			"impersonator", impersonator,
+			"endpoint", method,
+			"refused", refused,
+		)
+	}(time.Now())
+	return mw.next.AuditImpersonation(id, impersonator, method, refused)
+}
+
+func (mw loggingMiddleware) Register(username, password, email, first, last, phone, displayName string) (id string, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
 			"method", "Register",
 			"username", username,
-			"email", email,
-			"took", time.Since(begin),
+			"email", redact.Email(email),
+			"result", id,
 		)
 	}(time.Now())
-	return mw.next.Register(username, password, email, first, last)
+	return mw.next.Register(username, password, email, first, last, phone, displayName)
 }
 
-func (mw loggingMiddleware) PostUser(user users.User) (id string, err error) {
+func (mw loggingMiddleware) PostUser(user users.User) (u users.User, err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.log(begin, err,
 			"method", "PostUser",
 			"username", user.Username,
-			"email", user.Email,
-			"result", id,
-			"took", time.Since(begin),
+			"email", redact.Email(user.Email),
+			"addresses", len(user.Addresses),
+			"cards", len(user.Cards),
+			"result", u.UserID,
 		)
 	}(time.Now())
 	return mw.next.PostUser(user)
 }
 
-func (mw loggingMiddleware) GetUsers(id string) (u []users.User, err error) {
+func (mw loggingMiddleware) UpdateUser(id string, user users.User, principal string) (u users.User, err error) {
 	defer func(begin time.Time) {
-		who := id
-		if who == "" {
-			who = "all"
-		}
-		mw.logger.Log(
-			"method", "GetUsers",
-			"id", who,
+		mw.log(begin, err,
+			"method", "PutUser",
+			"id", id,
+			"username", user.Username,
+			"principal", principal,
+			"result", u.UserID,
+		)
+	}(time.Now())
+	return mw.next.UpdateUser(id, user, principal)
+}
+
+func (mw loggingMiddleware) PatchUser(id string, p users.UserPatch, principal string) (u users.User, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "PatchUser",
+			"id", id,
+			"principal", principal,
+			"result", u.UserID,
+		)
+	}(time.Now())
+	return mw.next.PatchUser(id, p, principal)
+}
+
+func (mw loggingMiddleware) ChangePassword(id, current, next string) (err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "ChangePassword",
+			"id", id,
+		)
+	}(time.Now())
+	return mw.next.ChangePassword(id, current, next)
+}
+
+func (mw loggingMiddleware) CreateRefreshToken(userID, device string) (token string, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "CreateRefreshToken",
+			"id", userID,
+			"device", device,
+		)
+	}(time.Now())
+	return mw.next.CreateRefreshToken(userID, device)
+}
+
+func (mw loggingMiddleware) Refresh(refreshToken string) (token, next string, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "Refresh",
+		)
+	}(time.Now())
+	return mw.next.Refresh(refreshToken)
+}
+
+func (mw loggingMiddleware) Logout(refreshToken, accessToken string) (err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "Logout",
+		)
+	}(time.Now())
+	return mw.next.Logout(refreshToken, accessToken)
+}
+
+func (mw loggingMiddleware) LoginMFA(challenge, code string) (u users.User, token string, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "LoginMFA",
+			"result", u.UserID,
+		)
+	}(time.Now())
+	return mw.next.LoginMFA(challenge, code)
+}
+
+func (mw loggingMiddleware) ProvisionMFA(id string) (secret, uri string, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "ProvisionMFA",
+			"id", id,
+		)
+	}(time.Now())
+	return mw.next.ProvisionMFA(id)
+}
+
+func (mw loggingMiddleware) ConfirmMFA(id, code string) (recoveryCodes []string, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "ConfirmMFA",
+			"id", id,
+		)
+	}(time.Now())
+	return mw.next.ConfirmMFA(id, code)
+}
+
+func (mw loggingMiddleware) DisableMFA(id, code string) (err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "DisableMFA",
+			"id", id,
+		)
+	}(time.Now())
+	return mw.next.DisableMFA(id, code)
+}
+
+func (mw loggingMiddleware) SetRoles(id string, roles []string, principal string) (u users.User, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "SetRoles",
+			"id", id,
+			"roles", strings.Join(roles, ","),
+			"principal", principal,
+		)
+	}(time.Now())
+	return mw.next.SetRoles(id, roles, principal)
+}
+
+func (mw loggingMiddleware) SetStatus(id, status, reason, principal string) (u users.User, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "SetStatus",
+			"id", id,
+			"status", status,
+			"principal", principal,
+		)
+	}(time.Now())
+	return mw.next.SetStatus(id, status, reason, principal)
+}
+
+func (mw loggingMiddleware) SetPreferences(id string, changes map[string]*string) (prefs map[string]string, err error) {
+	defer func(begin time.Time) {
+		// Values are the customer's own; only their number is logged.
+		mw.log(begin, err,
+			"method", "SetPreferences",
+			"id", id,
+			"changes", len(changes),
+		)
+	}(time.Now())
+	return mw.next.SetPreferences(id, changes)
+}
+
+func (mw loggingMiddleware) SetDefaultAddress(id, addressID, typ string) (u users.User, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "SetDefaultAddress",
+			"id", id,
+			"address", addressID,
+			"type", typ,
+		)
+	}(time.Now())
+	return mw.next.SetDefaultAddress(id, addressID, typ)
+}
+
+func (mw loggingMiddleware) SetCardLabel(id, cardID, label string) (c users.Card, err error) {
+	defer func(begin time.Time) {
+		// Labels are the customer's own and not logged.
+		mw.log(begin, err,
+			"method", "SetCardLabel",
+			"id", id,
+			"card", cardID,
+		)
+	}(time.Now())
+	return mw.next.SetCardLabel(id, cardID, label)
+}
+
+func (mw loggingMiddleware) SetDefaultCard(id, cardID string) (u users.User, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "SetDefaultCard",
+			"id", id,
+			"card", cardID,
+		)
+	}(time.Now())
+	return mw.next.SetDefaultCard(id, cardID)
+}
+
+func (mw loggingMiddleware) MergeAttributes(id, session string, addresses, cards []string) (r MergeResult) {
+	defer func(begin time.Time) {
+		mw.log(begin, nil,
+			"method", "MergeAttributes",
+			"id", id,
+			"addresses", len(r.Addresses),
+			"cards", len(r.Cards),
+			"failed", len(r.Failed),
+		)
+	}(time.Now())
+	return mw.next.MergeAttributes(id, session, addresses, cards)
+}
+
+func (mw loggingMiddleware) GetEmails(id string) (es []users.EmailAddress, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "GetEmails",
+			"id", id,
+			"result", len(es),
+		)
+	}(time.Now())
+	return mw.next.GetEmails(id)
+}
+
+func (mw loggingMiddleware) AddEmail(id, address string) (es []users.EmailAddress, code string, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "AddEmail",
+			"id", id,
+			"email", users.MaskEmail(address),
+		)
+	}(time.Now())
+	return mw.next.AddEmail(id, address)
+}
+
+func (mw loggingMiddleware) VerifyEmail(id, address, code string) (es []users.EmailAddress, err error) {
+	defer func(begin time.Time) {
+		// Never log the code.
+		mw.log(begin, err,
+			"method", "VerifyEmail",
+			"id", id,
+			"email", users.MaskEmail(address),
+		)
+	}(time.Now())
+	return mw.next.VerifyEmail(id, address, code)
+}
+
+func (mw loggingMiddleware) RemoveEmail(id, address string) (es []users.EmailAddress, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "RemoveEmail",
+			"id", id,
+			"email", users.MaskEmail(address),
+		)
+	}(time.Now())
+	return mw.next.RemoveEmail(id, address)
+}
+
+func (mw loggingMiddleware) SetPrimaryEmail(id, address string) (u users.User, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "SetPrimaryEmail",
+			"id", id,
+			"email", users.MaskEmail(address),
+		)
+	}(time.Now())
+	return mw.next.SetPrimaryEmail(id, address)
+}
+
+func (mw loggingMiddleware) GetConsents(id string) (c users.ConsentState, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "GetConsents",
+			"id", id,
+		)
+	}(time.Now())
+	return mw.next.GetConsents(id)
+}
+
+func (mw loggingMiddleware) SetConsents(id, source string, consents map[string]bool) (c users.ConsentState, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "SetConsents",
+			"id", id,
+			"source", source,
+		)
+	}(time.Now())
+	return mw.next.SetConsents(id, source, consents)
+}
+
+func (mw loggingMiddleware) AnonymizeUser(id, principal string) (err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "AnonymizeUser",
+			"id", id,
+			"principal", principal,
+		)
+	}(time.Now())
+	return mw.next.AnonymizeUser(id, principal)
+}
+
+func (mw loggingMiddleware) GetUser(id string) (u users.User, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "GetUser",
+			"id", id,
+			"result", found(u.UserID),
+		)
+	}(time.Now())
+	return mw.next.GetUser(id)
+}
+
+func (mw loggingMiddleware) ListUsers(params ListParams) (u []users.User, page Page, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "ListUsers",
+			"sort", params.Sort.Field,
+			"desc", params.Sort.Desc,
+			"page", page.Number,
 			"result", len(u),
-			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.GetUsers(id)
+	return mw.next.ListUsers(params)
+}
+
+func (mw loggingMiddleware) StreamUsers(sort db.Sort, fn func(users.User) error) (err error) {
+	n := 0
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "StreamUsers",
+			"sort", sort.Field,
+			"desc", sort.Desc,
+			"result", n,
+		)
+	}(time.Now())
+	return mw.next.StreamUsers(sort, func(u users.User) error {
+		n++
+		return fn(u)
+	})
 }
 
-func (mw loggingMiddleware) PostAddress(add users.Address, id string) (string, error) {
+func (mw loggingMiddleware) StreamAddresses(fn func(users.Address) error) (err error) {
+	n := 0
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.log(begin, err,
+			"method", "StreamAddresses",
+			"result", n,
+		)
+	}(time.Now())
+	return mw.next.StreamAddresses(func(a users.Address) error {
+		n++
+		return fn(a)
+	})
+}
+
+func (mw loggingMiddleware) StreamCards(fn func(users.Card) error) (err error) {
+	n := 0
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "StreamCards",
+			"result", n,
+		)
+	}(time.Now())
+	return mw.next.StreamCards(func(c users.Card) error {
+		n++
+		return fn(c)
+	})
+}
+
+func (mw loggingMiddleware) PostAddress(add users.Address, userID, principal string) (id string, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
 			"method", "PostAddress",
 			"street", add.Street,
 			"number", add.Number,
-			"user", id,
-			"took", time.Since(begin),
+			"user", userID,
+			"principal", principal,
+			"result", id,
 		)
 	}(time.Now())
-	return mw.next.PostAddress(add, id)
+	return mw.next.PostAddress(add, userID, principal)
 }
 
-func (mw loggingMiddleware) GetAddresses(id string) (a []users.Address, err error) {
+func (mw loggingMiddleware) GetAddress(id string) (a users.Address, err error) {
 	defer func(begin time.Time) {
-		who := id
-		if who == "" {
-			who = "all"
-		}
-		mw.logger.Log(
-			"method", "GetAddresses",
-			"id", who,
+		mw.log(begin, err,
+			"method", "GetAddress",
+			"id", id,
+			"result", found(a.ID),
+		)
+	}(time.Now())
+	return mw.next.GetAddress(id)
+}
+
+func (mw loggingMiddleware) ListAddresses(params ListParams) (a []users.Address, page Page, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "ListAddresses",
+			"page", page.Number,
 			"result", len(a),
-			"took", time.Since(begin),
 		)
 	}(time.Now())
-	return mw.next.GetAddresses(id)
+	return mw.next.ListAddresses(params)
 }
 
-func (mw loggingMiddleware) PostCard(card users.Card, id string) (string, error) {
+func (mw loggingMiddleware) PostCard(card users.Card, userID, principal string) (id string, err error) {
 	defer func(begin time.Time) {
 		cc := card
 		cc.MaskCC()
-		mw.logger.Log(
+		mw.log(begin, err,
 			"method", "PostCard",
 			"card", cc.LongNum,
-			"user", id,
-			"took", time.Since(begin),
+			"user", userID,
+			"principal", principal,
+			"result", id,
 		)
 	}(time.Now())
-	return mw.next.PostCard(card, id)
+	return mw.next.PostCard(card, userID, principal)
 }
 
-func (mw loggingMiddleware) GetCards(id string) (a []users.Card, err error) {
+func (mw loggingMiddleware) GetCard(id string) (c users.Card, err error) {
 	defer func(begin time.Time) {
-		who := id
-		if who == "" {
-			who = "all"
-		}
-		mw.logger.Log(
-			"method", "GetCards",
-			"id", who,
-			"result", len(a),
-			"took", time.Since(begin),
+		mw.log(begin, err,
+			"method", "GetCard",
+			"id", id,
+			"result", found(c.ID),
+		)
+	}(time.Now())
+	return mw.next.GetCard(id)
+}
+
+func (mw loggingMiddleware) ListCards(params ListParams) (c []users.Card, page Page, err error) {
+	defer func(begin time.Time) {
+		mw.log(begin, err,
+			"method", "ListCards",
+			"page", page.Number,
+			"result", len(c),
 		)
 	}(time.Now())
-	return mw.next.GetCards(id)
+	return mw.next.ListCards(params)
 }
 
-func (mw loggingMiddleware) Delete(entity, id string) (err error) {
+func (mw loggingMiddleware) Delete(entity, id string, version int64, principal string) (err error) {
 	defer func(begin time.Time) {
-		mw.logger.Log(
+		mw.log(begin, err,
 			"method", "Delete",
 			"entity", entity,
 			"id", id,
-			"took", time.Since(begin),
+			"version", version,
+			"principal", principal,
 		)
 	}(time.Now())
-	return mw.next.Delete(entity, id)
+	return mw.next.Delete(entity, id, version, principal)
 }
 
-func (mw loggingMiddleware) Health() (health []Health) {
+func (mw loggingMiddleware) Health(force bool) (health []Health) {
 	// defer func(begin time.Time) {
 	// 	mw.logger.Log(
 	// 		"method", "Health",
 	// 		"result", len(health),
-	// 		"took", time.Since(begin),
 	// 	)
 	// }(time.Now())
-	return mw.next.Health()
+	return mw.next.Health(force)
 }
 
 type instrumentingService struct {
@@ -165,6 +575,10 @@ type instrumentingService struct {
 	Service
 }
 
+func (s *instrumentingService) withContext(ctx context.Context) Service {
+	return &instrumentingService{requestCount: s.requestCount, requestLatency: s.requestLatency, Service: withContext(s.Service, ctx)}
+}
+
 // NewInstrumentingService returns an instance of an instrumenting Service.
 func NewInstrumentingService(requestCount metrics.Counter, requestLatency metrics.Histogram, s Service) Service {
 	return &instrumentingService{
@@ -174,25 +588,52 @@ func NewInstrumentingService(requestCount metrics.Counter, requestLatency metric
 	}
 }
 
-func (s *instrumentingService) Login(username, password string) (users.User, error) {
+func (s *instrumentingService) Login(username, password string, attributes bool) (users.User, string, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "login").Add(1)
 		s.requestLatency.With("method", "login").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Login(username, password)
+	return s.Service.Login(username, password, attributes)
 }
 
-func (s *instrumentingService) Register(username, password, email, first, last string) (string, error) {
+func (s *instrumentingService) LogoutAll(id, principal string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "logoutAll").Add(1)
+		s.requestLatency.With("method", "logoutAll").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.LogoutAll(id, principal)
+}
+
+func (s *instrumentingService) Impersonate(id, impersonator string) (users.User, string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "impersonate").Add(1)
+		s.requestLatency.With("method", "impersonate").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Impersonate(id, impersonator)
+}
+
+func (s *instrumentingService) AuditImpersonation(id, impersonator, method string, refused bool) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "auditImpersonation").Add(1)
+		s.requestLatency.With("method", "auditImpersonation").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.AuditImpersonation(id, impersonator, method, refused)
+}
+
+func (s *instrumentingService) Register(username, password, email, first, last, phone, displayName string) (string, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "register").Add(1)
 		s.requestLatency.With("method", "register").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Register(username, password, email, first, last)
+	return s.Service.Register(username, password, email, first, last, phone, displayName)
 }
 
-func (s *instrumentingService) PostUser(user users.User) (string, error) {
+func (s *instrumentingService) PostUser(user users.User) (users.User, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "postUser").Add(1)
 		s.requestLatency.With("method", "postUser").Observe(time.Since(begin).Seconds())
@@ -201,65 +642,344 @@ func (s *instrumentingService) PostUser(user users.User) (string, error) {
 	return s.Service.PostUser(user)
 }
 
-func (s *instrumentingService) GetUsers(id string) (u []users.User, err error) {
+func (s *instrumentingService) UpdateUser(id string, user users.User, principal string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "putUser").Add(1)
+		s.requestLatency.With("method", "putUser").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.UpdateUser(id, user, principal)
+}
+
+func (s *instrumentingService) PatchUser(id string, p users.UserPatch, principal string) (users.User, error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "getUsers").Add(1)
-		s.requestLatency.With("method", "getUsers").Observe(time.Since(begin).Seconds())
+		s.requestCount.With("method", "patchUser").Add(1)
+		s.requestLatency.With("method", "patchUser").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.GetUsers(id)
+	return s.Service.PatchUser(id, p, principal)
 }
 
-func (s *instrumentingService) PostAddress(add users.Address, id string) (string, error) {
+func (s *instrumentingService) ChangePassword(id, current, next string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "changePassword").Add(1)
+		s.requestLatency.With("method", "changePassword").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ChangePassword(id, current, next)
+}
+
+func (s *instrumentingService) CreateRefreshToken(userID, device string) (string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "createRefreshToken").Add(1)
+		s.requestLatency.With("method", "createRefreshToken").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.CreateRefreshToken(userID, device)
+}
+
+func (s *instrumentingService) Refresh(refreshToken string) (string, string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "refresh").Add(1)
+		s.requestLatency.With("method", "refresh").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Refresh(refreshToken)
+}
+
+func (s *instrumentingService) Logout(refreshToken, accessToken string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "logout").Add(1)
+		s.requestLatency.With("method", "logout").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.Logout(refreshToken, accessToken)
+}
+
+func (s *instrumentingService) LoginMFA(challenge, code string) (users.User, string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "loginMFA").Add(1)
+		s.requestLatency.With("method", "loginMFA").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.LoginMFA(challenge, code)
+}
+
+func (s *instrumentingService) ProvisionMFA(id string) (string, string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "provisionMFA").Add(1)
+		s.requestLatency.With("method", "provisionMFA").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ProvisionMFA(id)
+}
+
+func (s *instrumentingService) ConfirmMFA(id, code string) ([]string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "confirmMFA").Add(1)
+		s.requestLatency.With("method", "confirmMFA").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ConfirmMFA(id, code)
+}
+
+func (s *instrumentingService) DisableMFA(id, code string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "disableMFA").Add(1)
+		s.requestLatency.With("method", "disableMFA").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.DisableMFA(id, code)
+}
+
+func (s *instrumentingService) SetRoles(id string, roles []string, principal string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setRoles").Add(1)
+		s.requestLatency.With("method", "setRoles").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetRoles(id, roles, principal)
+}
+
+func (s *instrumentingService) SetStatus(id, status, reason, principal string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setStatus").Add(1)
+		s.requestLatency.With("method", "setStatus").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetStatus(id, status, reason, principal)
+}
+
+func (s *instrumentingService) SetPreferences(id string, changes map[string]*string) (map[string]string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setPreferences").Add(1)
+		s.requestLatency.With("method", "setPreferences").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetPreferences(id, changes)
+}
+
+func (s *instrumentingService) SetDefaultAddress(id, addressID, typ string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setDefaultAddress").Add(1)
+		s.requestLatency.With("method", "setDefaultAddress").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetDefaultAddress(id, addressID, typ)
+}
+
+func (s *instrumentingService) SetCardLabel(id, cardID, label string) (users.Card, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setCardLabel").Add(1)
+		s.requestLatency.With("method", "setCardLabel").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetCardLabel(id, cardID, label)
+}
+
+func (s *instrumentingService) SetDefaultCard(id, cardID string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setDefaultCard").Add(1)
+		s.requestLatency.With("method", "setDefaultCard").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetDefaultCard(id, cardID)
+}
+
+func (s *instrumentingService) MergeAttributes(id, session string, addresses, cards []string) MergeResult {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "mergeAttributes").Add(1)
+		s.requestLatency.With("method", "mergeAttributes").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.MergeAttributes(id, session, addresses, cards)
+}
+
+func (s *instrumentingService) GetEmails(id string) ([]users.EmailAddress, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getEmails").Add(1)
+		s.requestLatency.With("method", "getEmails").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetEmails(id)
+}
+
+func (s *instrumentingService) AddEmail(id, address string) ([]users.EmailAddress, string, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "addEmail").Add(1)
+		s.requestLatency.With("method", "addEmail").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.AddEmail(id, address)
+}
+
+func (s *instrumentingService) VerifyEmail(id, address, code string) ([]users.EmailAddress, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "verifyEmail").Add(1)
+		s.requestLatency.With("method", "verifyEmail").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.VerifyEmail(id, address, code)
+}
+
+func (s *instrumentingService) RemoveEmail(id, address string) ([]users.EmailAddress, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "removeEmail").Add(1)
+		s.requestLatency.With("method", "removeEmail").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.RemoveEmail(id, address)
+}
+
+func (s *instrumentingService) SetPrimaryEmail(id, address string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setPrimaryEmail").Add(1)
+		s.requestLatency.With("method", "setPrimaryEmail").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetPrimaryEmail(id, address)
+}
+
+func (s *instrumentingService) GetConsents(id string) (users.ConsentState, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getConsents").Add(1)
+		s.requestLatency.With("method", "getConsents").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetConsents(id)
+}
+
+func (s *instrumentingService) SetConsents(id, source string, consents map[string]bool) (users.ConsentState, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "setConsents").Add(1)
+		s.requestLatency.With("method", "setConsents").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.SetConsents(id, source, consents)
+}
+
+func (s *instrumentingService) AnonymizeUser(id, principal string) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "anonymizeUser").Add(1)
+		s.requestLatency.With("method", "anonymizeUser").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.AnonymizeUser(id, principal)
+}
+
+func (s *instrumentingService) GetUser(id string) (users.User, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getUser").Add(1)
+		s.requestLatency.With("method", "getUser").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetUser(id)
+}
+
+func (s *instrumentingService) ListUsers(params ListParams) ([]users.User, Page, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "listUsers").Add(1)
+		s.requestLatency.With("method", "listUsers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.ListUsers(params)
+}
+
+func (s *instrumentingService) StreamUsers(sort db.Sort, fn func(users.User) error) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "streamUsers").Add(1)
+		s.requestLatency.With("method", "streamUsers").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.StreamUsers(sort, fn)
+}
+
+func (s *instrumentingService) StreamAddresses(fn func(users.Address) error) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "streamAddresses").Add(1)
+		s.requestLatency.With("method", "streamAddresses").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.StreamAddresses(fn)
+}
+
+func (s *instrumentingService) StreamCards(fn func(users.Card) error) error {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "streamCards").Add(1)
+		s.requestLatency.With("method", "streamCards").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.StreamCards(fn)
+}
+
+func (s *instrumentingService) PostAddress(add users.Address, id, principal string) (string, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "postAddress").Add(1)
 		s.requestLatency.With("method", "postAddress").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.PostAddress(add, id)
+	return s.Service.PostAddress(add, id, principal)
+}
+
+func (s *instrumentingService) GetAddress(id string) (users.Address, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getAddress").Add(1)
+		s.requestLatency.With("method", "getAddress").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetAddress(id)
 }
 
-func (s *instrumentingService) GetAddresses(id string) ([]users.Address, error) {
+func (s *instrumentingService) ListAddresses(params ListParams) ([]users.Address, Page, error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "getAddresses").Add(1)
-		s.requestLatency.With("method", "getAddresses").Observe(time.Since(begin).Seconds())
+		s.requestCount.With("method", "listAddresses").Add(1)
+		s.requestLatency.With("method", "listAddresses").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.GetAddresses(id)
+	return s.Service.ListAddresses(params)
 }
 
-func (s *instrumentingService) PostCard(card users.Card, id string) (string, error) {
+func (s *instrumentingService) PostCard(card users.Card, id, principal string) (string, error) {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "postCard").Add(1)
 		s.requestLatency.With("method", "postCard").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.PostCard(card, id)
+	return s.Service.PostCard(card, id, principal)
+}
+
+func (s *instrumentingService) GetCard(id string) (users.Card, error) {
+	defer func(begin time.Time) {
+		s.requestCount.With("method", "getCard").Add(1)
+		s.requestLatency.With("method", "getCard").Observe(time.Since(begin).Seconds())
+	}(time.Now())
+
+	return s.Service.GetCard(id)
 }
 
-func (s *instrumentingService) GetCards(id string) ([]users.Card, error) {
+func (s *instrumentingService) ListCards(params ListParams) ([]users.Card, Page, error) {
 	defer func(begin time.Time) {
-		s.requestCount.With("method", "getCards").Add(1)
-		s.requestLatency.With("method", "getCards").Observe(time.Since(begin).Seconds())
+		s.requestCount.With("method", "listCards").Add(1)
+		s.requestLatency.With("method", "listCards").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.GetCards(id)
+	return s.Service.ListCards(params)
 }
 
-func (s *instrumentingService) Delete(entity, id string) error {
+func (s *instrumentingService) Delete(entity, id string, version int64, principal string) error {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "delete").Add(1)
 		s.requestLatency.With("method", "delete").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Delete(entity, id)
+	return s.Service.Delete(entity, id, version, principal)
 }
 
-func (s *instrumentingService) Health() []Health {
+func (s *instrumentingService) Health(force bool) []Health {
 	defer func(begin time.Time) {
 		s.requestCount.With("method", "health").Add(1)
 		s.requestLatency.With("method", "health").Observe(time.Since(begin).Seconds())
 	}(time.Now())
 
-	return s.Service.Health()
+	return s.Service.Health(force)
 }
@@ -2,12 +2,18 @@ package api
 
 import (
 	"fmt"
+	"net/http/httptest"
 	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 var (
 	TestLogger     bogusLogger = newBogusLogger()
-	TestMiddleWare Service     = LoggingMiddleware(TestLogger)(NewFixedService())
+	TestMiddleWare Service     = LoggingMiddleware(TestLogger)(NewFixedService(memory.New()))
 )
 
 type bogusLogger struct {
@@ -24,3 +30,70 @@ func (bl bogusLogger) Log(v ...interface{}) error {
 
 func TestLoginMiddleWare(t *testing.T) {
 }
+
+// recordLogger keeps the lines logged to it, by key
+type recordLogger struct {
+	lines *[]map[string]string
+}
+
+func (l recordLogger) Log(keyvals ...interface{}) error {
+	line := make(map[string]string, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		line[fmt.Sprint(keyvals[i])] = fmt.Sprint(keyvals[i+1])
+	}
+	*l.lines = append(*l.lines, line)
+	return nil
+}
+
+func TestLoggingMiddleware(t *testing.T) {
+	var lines []map[string]string
+	s := LoggingMiddleware(recordLogger{&lines})(NewFixedService(memory.New()))
+	id, err := s.Register("logged", "password", "logged@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PostCard(users.Card{LongNum: "4111111111111111", Expires: "08/27", CCV: "123"}, id, ""); err != nil {
+		t.Fatal(err)
+	}
+	s.GetUser(id)
+	s.GetUser("000000000000000000000000")
+	if len(lines) != 4 {
+		t.Fatalf("Expected a line per call, received %v", lines)
+	}
+	for i, want := range []map[string]string{
+		{"level": "info", "method": "Register", "result": id},
+		{"level": "info", "method": "PostCard", "user": id, "card": "************1111"},
+		{"level": "info", "method": "GetUser", "id": id, "result": "1"},
+		{"level": "info", "method": "GetUser", "result": "0"},
+	} {
+		for k, v := range want {
+			if lines[i][k] != v {
+				t.Errorf("Expected %v=%v on line %v, received %v", k, v, i, lines[i])
+			}
+		}
+	}
+	if lines[3]["err"] == "" || lines[0]["took"] == "" {
+		t.Errorf("Expected the error and the time of calls logged, received %v", lines)
+	}
+}
+
+func TestLoggingMiddlewareJoinsRequest(t *testing.T) {
+	var lines []map[string]string
+	s := LoggingMiddleware(recordLogger{&lines})(NewFixedService(memory.New()))
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := RequestIDMiddleware(MakeHTTPHandler(MakeEndpoints(s, tracer, NewLevelLogger(recordLogger{&lines}, LevelInfo), nil), log.NewNopLogger()))
+	req := httptest.NewRequest("GET", "/customers/000000000000000000000000", nil)
+	req.Header.Set(RequestIDHeader, "joined")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if len(lines) != 2 {
+		t.Fatalf("Expected the lines of the request and of the call, received %v", lines)
+	}
+	for _, line := range lines {
+		if line["request_id"] != "joined" {
+			t.Errorf("Expected the request id on every line, received %v", line)
+		}
+	}
+	if request, call := lines[1], lines[0]; request["took"] != "" || request["err"] != "" || call["err"] == "" || call["took"] == "" {
+		t.Errorf("Expected the error and duration logged once, by the call, received %v and %v", request, call)
+	}
+}
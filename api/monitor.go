@@ -0,0 +1,235 @@
+package api
+
+// monitor.go pings the database in the background and raises an alert when
+// it stays down, so an outage is known before customers report it.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/microservices-demo/user/events"
+)
+
+// States of a component told in alerts
+const (
+	StateDown      = "down"
+	StateRecovered = "recovered"
+)
+
+// Alert tells that a component went down, after Failures consecutive failed
+// pings, or recovered
+type Alert struct {
+	Component string    `json:"component"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// Notifier is told of alerts
+type Notifier interface {
+	Notify(ctx context.Context, a Alert) error
+}
+
+// Notifiers tells every notifier of each alert, failing with the first error
+type Notifiers []Notifier
+
+// Notify tells every notifier of a
+func (ns Notifiers) Notify(ctx context.Context, a Alert) error {
+	var first error
+	for _, n := range ns {
+		if err := n.Notify(ctx, a); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// LogNotifier logs alerts, outages at error level with alert=db_unavailable
+// for log based alerting to match
+type LogNotifier struct {
+	Logger log.Logger
+}
+
+// Notify logs a
+func (n LogNotifier) Notify(_ context.Context, a Alert) error {
+	if a.State == StateDown {
+		return level.Error(n.Logger).Log("alert", "db_unavailable", "component", a.Component, "failures", a.Failures, "err", a.Error)
+	}
+	return level.Info(n.Logger).Log("alert", "db_recovered", "component", a.Component)
+}
+
+// WebhookNotifier posts alerts as JSON to URL, signed like events when
+// Secret is set
+type WebhookNotifier struct {
+	URL    string
+	Secret []byte
+	Client *http.Client
+}
+
+// Notify posts a once
+func (n WebhookNotifier) Notify(ctx context.Context, a Alert) error {
+	body, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(n.Secret) > 0 {
+		req.Header.Set(events.SignatureHeader, events.Sign(n.Secret, body))
+	}
+	client := n.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v answered %v", n.URL, resp.Status)
+	}
+	return nil
+}
+
+// PingMonitor follows the pings of a component. After Failures consecutive
+// failed pings it notifies that the component is down, and once a ping
+// succeeds again that it recovered. Notifications are at least MinInterval
+// apart, against flapping: a change within the interval is told when it
+// ends, if the component is still in that state. The gauge is 1 while the
+// component is down, whatever the notifications. A ping not answered
+// within Timeout, the interval of Run when zero, fails; a hung ping is
+// waited for rather than pinged again.
+type PingMonitor struct {
+	Component   string
+	Failures    int
+	MinInterval time.Duration
+	Timeout     time.Duration
+
+	notifier    Notifier
+	unavailable metrics.Gauge
+	logger      log.Logger
+
+	mu       sync.Mutex
+	failures int
+	lastErr  error
+	// told is the state last notified, empty before any
+	told   string
+	toldAt time.Time
+	now    func() time.Time
+}
+
+// NewPingMonitor returns a PingMonitor of component notifying n after
+// failures consecutive failures, at most once every minInterval, and
+// setting unavailable, which may be nil. A single failure is enough when
+// failures is below 1.
+func NewPingMonitor(component string, failures int, minInterval time.Duration, n Notifier, unavailable metrics.Gauge) *PingMonitor {
+	if failures < 1 {
+		failures = 1
+	}
+	if unavailable == nil {
+		unavailable = discard.NewGauge()
+	}
+	return &PingMonitor{
+		Component:   component,
+		Failures:    failures,
+		MinInterval: minInterval,
+		notifier:    n,
+		unavailable: unavailable,
+		logger:      log.NewNopLogger(),
+		now:         time.Now,
+	}
+}
+
+// SetLogger logs failed notifications to l
+func (m *PingMonitor) SetLogger(l log.Logger) {
+	m.logger = l
+}
+
+// ErrPingTimeout fails the pings of a PingMonitor not answered in time
+var ErrPingTimeout = errors.New("Ping timed out")
+
+// Run pings with ping every interval until ctx is done
+func (m *PingMonitor) Run(ctx context.Context, ping func() error, interval time.Duration) {
+	timeout := m.Timeout
+	if timeout <= 0 {
+		timeout = interval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	// pending carries the result of the ping under way
+	var pending chan error
+	for {
+		if pending == nil {
+			pending = make(chan error, 1)
+			go func(result chan<- error) { result <- ping() }(pending)
+		}
+		expired := time.NewTimer(timeout)
+		select {
+		case err := <-pending:
+			pending = nil
+			m.Observe(ctx, err)
+		case <-expired.C:
+			m.Observe(ctx, ErrPingTimeout)
+		case <-ctx.Done():
+			expired.Stop()
+			return
+		}
+		expired.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Observe records the result err of a ping, notifying when the state of the
+// component is to be told
+func (m *PingMonitor) Observe(ctx context.Context, err error) {
+	m.mu.Lock()
+	if err != nil {
+		m.failures++
+		m.lastErr = err
+	} else {
+		m.failures = 0
+	}
+	state := StateRecovered
+	if m.failures >= m.Failures {
+		state = StateDown
+		m.unavailable.Set(1)
+	} else {
+		m.unavailable.Set(0)
+	}
+	now := m.now()
+	// Nothing to tell until the component first goes down
+	if (m.told == "" && state == StateRecovered) || state == m.told || now.Sub(m.toldAt) < m.MinInterval {
+		m.mu.Unlock()
+		return
+	}
+	m.told, m.toldAt = state, now
+	a := Alert{Component: m.Component, State: state, Time: now}
+	if state == StateDown {
+		a.Failures = m.failures
+		a.Error = m.lastErr.Error()
+	}
+	m.mu.Unlock()
+
+	if err := m.notifier.Notify(ctx, a); err != nil {
+		m.logger.Log("msg", "Alert notification failed", "component", m.Component, "state", state, "err", err)
+	}
+}
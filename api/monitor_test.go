@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/microservices-demo/user/events"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type alertRecorder []Alert
+
+func (r *alertRecorder) Notify(_ context.Context, a Alert) error {
+	*r = append(*r, a)
+	return nil
+}
+
+func TestPingMonitor(t *testing.T) {
+	var alerts alertRecorder
+	unavailable := stdprometheus.NewGaugeVec(stdprometheus.GaugeOpts{Name: "db_unavailable"}, nil)
+	gauge := unavailable.WithLabelValues()
+	m := NewPingMonitor("user-db", 3, time.Minute, &alerts, kitprometheus.NewGauge(unavailable))
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	m.now = func() time.Time { return now }
+	down := errors.New("no reachable servers")
+	ctx := context.Background()
+
+	observe := func(err error, advance time.Duration) {
+		now = now.Add(advance)
+		m.Observe(ctx, err)
+	}
+	expect := func(step string, states ...string) {
+		t.Helper()
+		if len(alerts) != len(states) {
+			t.Fatalf("%v: expected alerts %v, received %+v", step, states, alerts)
+		}
+		for i, s := range states {
+			if alerts[i].State != s {
+				t.Errorf("%v: expected alert %v %v, received %+v", step, i, s, alerts[i])
+			}
+		}
+	}
+
+	observe(nil, 0)
+	expect("healthy")
+	observe(down, time.Second)
+	observe(down, time.Second)
+	expect("below the threshold")
+	if testutil.ToFloat64(gauge) != 0 {
+		t.Error("Expected available below the threshold")
+	}
+	observe(down, time.Second)
+	expect("at the threshold", StateDown)
+	if alerts[0].Failures != 3 || alerts[0].Error != down.Error() || testutil.ToFloat64(gauge) != 1 {
+		t.Errorf("Expected an outage after 3 failures, received %+v, gauge %v", alerts[0], testutil.ToFloat64(gauge))
+	}
+	observe(down, time.Second)
+	expect("still down", StateDown)
+
+	// Flapping: the recovery within the interval is held back
+	observe(nil, 10*time.Second)
+	expect("recovered early", StateDown)
+	if testutil.ToFloat64(gauge) != 0 {
+		t.Error("Expected available once a ping succeeds")
+	}
+	observe(down, time.Second)
+	observe(down, time.Second)
+	observe(down, time.Second)
+	expect("down again early", StateDown)
+	observe(nil, time.Second)
+	observe(nil, time.Minute)
+	expect("recovered past the interval", StateDown, StateRecovered)
+	observe(nil, time.Minute)
+	expect("still recovered", StateDown, StateRecovered)
+}
+
+func TestPingMonitorHungPing(t *testing.T) {
+	var alerts alertRecorder
+	m := NewPingMonitor("user-db", 2, 0, &alerts, nil)
+	m.Timeout = time.Millisecond
+	var pings atomic.Int32
+	release := make(chan struct{})
+	defer close(release)
+	ping := func() error {
+		pings.Add(1)
+		<-release
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		m.Run(ctx, ping, time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	<-done
+	if len(alerts) == 0 || alerts[0].State != StateDown || alerts[0].Error != ErrPingTimeout.Error() {
+		t.Errorf("Expected a hung ping reported down, received %+v", alerts)
+	}
+	if n := pings.Load(); n != 1 {
+		t.Errorf("Expected the hung ping waited for, pinged %v times", n)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	secret := []byte("secret")
+	var received Alert
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		json.NewDecoder(r.Body).Decode(&body)
+		if r.Header.Get(events.SignatureHeader) != events.Sign(secret, body) {
+			t.Errorf("Expected a valid signature, received %v", r.Header.Get(events.SignatureHeader))
+		}
+		json.Unmarshal(body, &received)
+	}))
+	defer ts.Close()
+
+	n := WebhookNotifier{URL: ts.URL, Secret: secret}
+	if err := n.Notify(context.Background(), Alert{Component: "user-db", State: StateDown, Failures: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if received.State != StateDown || received.Failures != 3 {
+		t.Errorf("Expected the alert posted, received %+v", received)
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+// ownership.go checks, in the service, that callers act on their own
+// customer, addresses and cards, whatever the transport checked before.
+
+import (
+	"strings"
+
+	"github.com/microservices-demo/user/users"
+)
+
+// customerPrincipal reports whether principal is a customer, the user of a
+// token, rather than an API key, a client certificate, a caller outside an
+// authenticated request or anyone when authentication is disabled
+func customerPrincipal(principal string) bool {
+	return principal != "" && principal != "anonymous" &&
+		!strings.HasPrefix(principal, "apikey:") && !strings.HasPrefix(principal, "cert:")
+}
+
+// authorize returns ErrForbidden unless principal may act on the customer
+// owner: the customer itself, an admin, or a principal that is no customer.
+// An empty owner, as for an address of no customer, is anyone's. Refusals
+// are audited as forbidden, with the action refused as reason.
+func (s *fixedService) authorize(action, owner, principal string) error {
+	if !customerPrincipal(principal) || owner == "" || principal == owner {
+		return nil
+	}
+	if u, err := s.db.GetUser(principal); err == nil && u.HasRole(users.RoleAdmin) {
+		return nil
+	}
+	return s.forbid(action, "customers", owner, principal)
+}
+
+// authorizeDelete returns ErrForbidden unless principal may delete the
+// entity: a customer only itself, and addresses and cards it holds, unless
+// it is an admin
+func (s *fixedService) authorizeDelete(entity, id, principal string) error {
+	if entity == "customers" {
+		return s.authorize("delete", id, principal)
+	}
+	if !customerPrincipal(principal) {
+		return nil
+	}
+	u, err := s.db.GetUser(principal)
+	if err == nil && u.HasRole(users.RoleAdmin) {
+		return nil
+	}
+	if err == nil && s.db.GetUserAttributes(&u) == nil && holds(u, entity, id) {
+		return nil
+	}
+	return s.forbid("delete", entity, id, principal)
+}
+
+// holds reports whether the address or card id is one of u
+func holds(u users.User, entity, id string) bool {
+	switch entity {
+	case "addresses":
+		for _, a := range u.Addresses {
+			if a.ID == id {
+				return true
+			}
+		}
+	case "cards":
+		for _, c := range u.Cards {
+			if c.ID == id {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// forbid audits that principal was refused action on the entity, returning
+// ErrForbidden whether or not the refusal could be recorded
+func (s *fixedService) forbid(action, entity, id, principal string) error {
+	s.auditReason("forbidden", entity, id, principal, action)
+	return ErrForbidden
+}
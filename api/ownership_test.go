@@ -0,0 +1,77 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+)
+
+// storeAdmin registers a customer holding the admin role, returning its id
+func storeAdmin(t *testing.T, s Service, name string) string {
+	t.Helper()
+	id, err := s.Register(name, "password", name+"@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.(*fixedService).db.SetUserRoles(id, []string{users.RoleCustomer, users.RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestOwnership(t *testing.T) {
+	d := memory.New()
+	s := NewFixedService(d)
+	owner, err := s.Register("owner", "password", "owner@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Register("other", "password", "other@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := storeAdmin(t, s, "admin")
+	card := users.Card{LongNum: "4111111111111111", Expires: "12/30", CCV: "123"}
+
+	if _, err := s.PostCard(card, owner, other); err != ErrForbidden || errorStatus(err) != http.StatusForbidden {
+		t.Errorf("Expected a card added to another customer forbidden, received %v", err)
+	}
+	if _, err := s.PostAddress(users.Address{Street: "street", City: "city"}, owner, other); err != ErrForbidden {
+		t.Errorf("Expected an address added to another customer forbidden, received %v", err)
+	}
+	log := d.AuditLog()
+	if len(log) != 2 || log[0].Action != "forbidden" || log[0].ID != owner || log[0].Principal != other || log[0].Reason != "create card" {
+		t.Errorf("Expected the refusals audited, received %+v", log)
+	}
+
+	var cards []string
+	for _, principal := range []string{owner, admin, "apikey:ops", ""} {
+		id, err := s.PostCard(card, owner, principal)
+		if err != nil {
+			t.Errorf("Expected %q allowed to add a card, received %v", principal, err)
+		}
+		cards = append(cards, id)
+	}
+
+	if err := s.Delete("cards", cards[0], db.AnyVersion, other); err != ErrForbidden {
+		t.Errorf("Expected a card of another customer kept, received %v", err)
+	}
+	if err := s.Delete("cards", cards[0], db.AnyVersion, owner); err != nil {
+		t.Errorf("Expected the customer to delete its card, received %v", err)
+	}
+	if err := s.Delete("cards", cards[1], db.AnyVersion, admin); err != nil {
+		t.Errorf("Expected an admin to delete any card, received %v", err)
+	}
+	if err := s.Delete("customers", owner, db.AnyVersion, other); err != ErrForbidden {
+		t.Errorf("Expected another customer kept, received %v", err)
+	}
+	if err := s.AnonymizeUser(owner, other); err != ErrForbidden {
+		t.Errorf("Expected another customer kept from anonymization, received %v", err)
+	}
+	if err := s.Delete("customers", owner, db.AnyVersion, owner); err != nil {
+		t.Errorf("Expected the customer to delete itself, received %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package api
+
+// ping.go caches the pings of the health check, so probes polling the
+// service do not add load to a database that is already struggling.
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultPingInterval is how long a health check ping result is reused
+const DefaultPingInterval = 5 * time.Second
+
+// WithPingInterval reuses the result of the pings of health checks for d;
+// 0 pings on every check.
+func WithPingInterval(d time.Duration) ServiceOption {
+	return func(s *fixedService) {
+		s.pingInterval = d
+	}
+}
+
+// cachedPing is the last result of ping, observed at, which took took
+type cachedPing struct {
+	ping func() error
+
+	mu   sync.Mutex
+	err  error
+	at   time.Time
+	took time.Duration
+	// running is closed when the ping in flight returns, nil when there is
+	// none
+	running chan struct{}
+}
+
+// start pings again when forced or when the last result is older than
+// interval, unless a ping is in flight already, and returns a channel
+// closed once the result is there. Concurrent checks share a single ping,
+// and a ping that hangs is never started twice.
+func (c *cachedPing) start(interval time.Duration, force bool) <-chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.running != nil {
+		return c.running
+	}
+	if !force && !c.at.IsZero() && time.Since(c.at) < interval {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	running := make(chan struct{})
+	c.running = running
+	go func() {
+		begin := time.Now()
+		err := c.ping()
+		c.mu.Lock()
+		c.err, c.at, c.took = err, time.Now(), time.Since(begin)
+		c.running = nil
+		c.mu.Unlock()
+		close(running)
+	}()
+	return running
+}
+
+// result returns the last result of ping, when it was observed and how
+// long it took
+func (c *cachedPing) result() (error, time.Time, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err, c.at, c.took
+}
+
+// pingHealth returns the health of component, of the given severity, from
+// the last result of c
+func pingHealth(component, severity string, c *cachedPing) Health {
+	err, at, took := c.result()
+	h := Health{Service: component, Status: HealthOK, Severity: severity, Time: at.String(), Age: time.Since(at).Seconds(), Latency: took.Seconds()}
+	if err != nil {
+		h.Status, h.Error = HealthErr, err.Error()
+	}
+	return h
+}
@@ -0,0 +1,66 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+)
+
+// countedPings counts the pings of its database
+type countedPings struct {
+	db.Database
+	pings atomic.Int32
+}
+
+func (c *countedPings) Ping() error {
+	c.pings.Add(1)
+	return c.Database.Ping()
+}
+
+func TestHealthPingCache(t *testing.T) {
+	d := &countedPings{Database: memory.New()}
+	h := newTestHandler(NewFixedService(d, WithPingInterval(time.Hour)))
+	health := func(path string) []Health {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var body healthResponse
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		return body.Health
+	}
+
+	health("/health")
+	time.Sleep(10 * time.Millisecond)
+	hs := health("/health")
+	if got := d.pings.Load(); got != 1 {
+		t.Errorf("Expected the ping reused, received %v pings", got)
+	}
+	for _, hc := range hs {
+		if hc.Service == "user-db" && hc.Age <= 0 {
+			t.Errorf("Expected the age of the cached ping, received %+v", hc)
+		}
+	}
+
+	hs = health("/health?force=true")
+	if got := d.pings.Load(); got != 2 {
+		t.Errorf("Expected a forced ping, received %v pings", got)
+	}
+	for _, hc := range hs {
+		if hc.Service == "user-db" && hc.Age > 1 {
+			t.Errorf("Expected a fresh observation, received %+v", hc)
+		}
+	}
+
+	s := NewFixedService(d, WithPingInterval(0))
+	s.Health(false)
+	s.Health(false)
+	if got := d.pings.Load(); got != 4 {
+		t.Errorf("Expected a ping per check without caching, received %v pings", got-2)
+	}
+}
@@ -0,0 +1,207 @@
+package api
+
+// ratelimit.go contains the token bucket rate limiting applied to the
+// credential checking endpoints to slow down credential stuffing.
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitedError is returned when a caller exceeded its rate limit.
+type RateLimitedError struct {
+	RetryAfter time.Duration
+}
+
+func (e RateLimitedError) Error() string {
+	return fmt.Sprintf("Too many attempts, retry after %v", e.RetryAfter)
+}
+
+// RateLimiter keeps a token bucket per key. Buckets unused for longer than
+// the idle time are evicted, so memory is bounded by the keys active at once.
+type RateLimiter struct {
+	rate  rate.Limit
+	burst int
+	idle  time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+	now     func() time.Time
+}
+
+type bucket struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// NewRateLimiter returns a limiter allowing r events per second per key with
+// bursts of up to burst events.
+func NewRateLimiter(r float64, burst int, idle time.Duration) *RateLimiter {
+	return &RateLimiter{
+		rate:    rate.Limit(r),
+		burst:   burst,
+		idle:    idle,
+		buckets: make(map[string]*bucket),
+		now:     time.Now,
+	}
+}
+
+// Allow takes a token from the bucket of key, returning how long to wait
+// when none is left.
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.swept) > l.idle {
+		for k, b := range l.buckets {
+			if now.Sub(b.seen) > l.idle {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(l.rate, l.burst)}
+		l.buckets[key] = b
+	}
+	b.seen = now
+	r := b.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return false, l.idle
+	}
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return false, d
+	}
+	return true, 0
+}
+
+// Len returns the number of buckets currently held.
+func (l *RateLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// LoginRateLimit returns an endpoint middleware limiting attempts both per
+// client IP and per attempted account. X-Forwarded-For is only believed
+// when the connection comes from one of the trusted proxies. Throttled
+// attempts are counted in throttled, labelled by the exhausted key.
+func LoginRateLimit(l *RateLimiter, trusted []*net.IPNet, throttled metrics.Counter) endpoint.Middleware {
+	if throttled == nil {
+		throttled = discard.NewCounter()
+	}
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			keys := []struct{ kind, key string }{{"ip", clientIP(ctx, trusted)}}
+			if account := rateLimitAccount(request); account != "" {
+				keys = append(keys, struct{ kind, key string }{"account", account})
+			}
+			for _, k := range keys {
+				if ok, wait := l.Allow(k.kind + ":" + k.key); !ok {
+					throttled.With("key", k.kind).Add(1)
+					return nil, RateLimitedError{RetryAfter: wait}
+				}
+			}
+			return next(ctx, request)
+		}
+	}
+}
+
+// rateLimitAccount returns the account a credential check is attempted on
+func rateLimitAccount(request interface{}) string {
+	switch req := request.(type) {
+	case loginRequest:
+		return strings.ToLower(req.Username)
+	case passwordRequest:
+		return req.ID
+	case mfaRequest:
+		return req.ID
+	case loginMFARequest:
+		// New challenges need the password, which is limited per account
+		return req.Challenge
+	}
+	return ""
+}
+
+// clientIP returns the address of the client, following X-Forwarded-For
+// from the right through trusted proxies only, and proxies connecting over
+// a unix socket. It relies on the request fields populated by
+// httptransport.PopulateRequestContext.
+func clientIP(ctx context.Context, trusted []*net.IPNet) string {
+	remote, _ := ctx.Value(httptransport.ContextKeyRequestRemoteAddr).(string)
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if !isTrusted(remote, trusted) && !fromUnixSocket(ctx) {
+		return remote
+	}
+	xff, _ := ctx.Value(httptransport.ContextKeyRequestXForwardedFor).(string)
+	hops := strings.Split(xff, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrusted(hop, trusted) {
+			return hop
+		}
+		remote = hop
+	}
+	return remote
+}
+
+func isTrusted(addr string, trusted []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDRs parses a comma separated list of CIDRs or single addresses.
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if strings.Contains(s, ":") {
+				s += "/128"
+			} else {
+				s += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// retryAfterSeconds rounds d up to whole seconds for the Retry-After header
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,91 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/microservices-demo/user/db/memory"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := NewRateLimiter(1, 2, time.Minute)
+	l.now = func() time.Time { return now }
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("Expected attempt %v within burst allowed", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("Expected throttling with a wait up to 1s, received %v %v", ok, wait)
+	}
+	if ok, _ := l.Allow("b"); !ok {
+		t.Error("Expected other key unaffected")
+	}
+	l.now = func() time.Time { return now.Add(time.Second) }
+	if ok, _ := l.Allow("a"); !ok {
+		t.Error("Expected bucket refilled")
+	}
+	l.now = func() time.Time { return now.Add(time.Hour) }
+	l.Allow("c")
+	if n := l.Len(); n != 1 {
+		t.Errorf("Expected idle buckets evicted, %v left", n)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	trusted, err := ParseCIDRs("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ remote, xff, want string }{
+		{"1.2.3.4:1000", "5.6.7.8", "1.2.3.4"},
+		{"10.0.0.1:1000", "5.6.7.8", "5.6.7.8"},
+		{"10.0.0.1:1000", "9.9.9.9, 5.6.7.8, 192.168.1.1", "5.6.7.8"},
+		{"10.0.0.1:1000", "", "10.0.0.1"},
+	} {
+		ctx := context.WithValue(context.Background(), httptransport.ContextKeyRequestRemoteAddr, tc.remote)
+		ctx = context.WithValue(ctx, httptransport.ContextKeyRequestXForwardedFor, tc.xff)
+		if got := clientIP(ctx, trusted); got != tc.want {
+			t.Errorf("%v %q: expected %v, received %v", tc.remote, tc.xff, tc.want, got)
+		}
+	}
+
+	// Proxies on a unix socket are trusted
+	ctx := UnixConnContext(context.Background(), nil)
+	ctx = context.WithValue(ctx, httptransport.ContextKeyRequestRemoteAddr, "")
+	ctx = context.WithValue(ctx, httptransport.ContextKeyRequestXForwardedFor, "9.9.9.9, 5.6.7.8")
+	if got := clientIP(ctx, trusted); got != "5.6.7.8" {
+		t.Errorf("Expected the client behind a unix socket proxy, received %v", got)
+	}
+}
+
+func TestLoginRateLimit(t *testing.T) {
+	s := NewFixedService(memory.New())
+	tracer := noop.NewTracerProvider().Tracer("")
+	e := MakeEndpoints(s, tracer, log.NewNopLogger(), nil)
+	e.LoginEndpoint = LoginRateLimit(NewRateLimiter(0.01, 1, time.Minute), nil, nil)(e.LoginEndpoint)
+	h := MakeHTTPHandler(e, log.NewNopLogger())
+
+	codes := []int{}
+	for i := 0; i < 2; i++ {
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.SetBasicAuth("nobody", "password")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		codes = append(codes, rec.Code)
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Error("Expected Retry-After header")
+		}
+	}
+	if codes[1] != http.StatusTooManyRequests {
+		t.Errorf("Expected second attempt throttled, received %v", codes)
+	}
+}
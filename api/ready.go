@@ -0,0 +1,72 @@
+package api
+
+// ready.go contains the probes of orchestrators: /live answers as long as
+// the process serves requests, so an outage of a dependency never gets the
+// service restarted, while /ready fails until its dependencies answer, so
+// it only stops receiving traffic.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+)
+
+// DefaultReadyTimeout is the time dependencies get to answer a readiness
+// check
+const DefaultReadyTimeout = 2 * time.Second
+
+// NotReadyError answers a readiness check with the components that failed
+// it
+type NotReadyError struct {
+	Components []string
+}
+
+func (e NotReadyError) Error() string {
+	return fmt.Sprintf("Not ready: %v", strings.Join(e.Components, ", "))
+}
+
+// WithReadyTimeout gives dependencies d to answer readiness checks
+func WithReadyTimeout(d time.Duration) EndpointsOption {
+	return func(cfg *endpointsConfig) {
+		cfg.readyTimeout = d
+	}
+}
+
+// MakeReadyEndpoint returns the readiness of the service: the components of
+// its health, failing when a critical one reports an error or they do not
+// all report within timeout.
+func MakeReadyEndpoint(s Service, timeout time.Duration) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		done := make(chan []Health, 1)
+		go func() { done <- s.Health(false) }()
+		var health []Health
+		select {
+		case health = <-done:
+		case <-ctx.Done():
+			return nil, NotReadyError{Components: []string{"timeout"}}
+		}
+		status, failed := healthStatus(health)
+		if status == HealthErr {
+			return nil, NotReadyError{Components: failed}
+		}
+		return healthResponse{Status: status, Health: health, Version: version}, nil
+	}
+}
+
+// serveLive answers GET /live, which only fails while the service shuts
+// down
+func serveLive(w http.ResponseWriter, r *http.Request) {
+	encodeResponse(r.Context(), w, Health{Service: "user", Status: HealthOK, Severity: SeverityCritical, Time: time.Now().String()})
+}
+
+// probePath reports whether path is that of a probe, answered while the
+// service is overloaded and failed while it shuts down
+func probePath(path string) bool {
+	return strings.HasPrefix(path, "/health") || path == "/live" || path == "/ready"
+}
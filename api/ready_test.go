@@ -0,0 +1,61 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db/memory"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// probedService reports the health given, after delay
+type probedService struct {
+	Service
+	health []Health
+	delay  time.Duration
+}
+
+func (s probedService) Health(bool) []Health {
+	time.Sleep(s.delay)
+	return s.health
+}
+
+func TestProbes(t *testing.T) {
+	tracer := noop.NewTracerProvider().Tracer("")
+	serve := func(s Service, path string) (int, ErrorBody) {
+		h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), nil, WithReadyTimeout(50*time.Millisecond)), log.NewNopLogger())
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		var body ErrorBody
+		json.NewDecoder(rec.Body).Decode(&body)
+		return rec.Code, body
+	}
+	base := NewFixedService(memory.New())
+	dbDown := []Health{{Service: "user", Status: "OK"}, {Service: "user-db", Status: "err"}}
+
+	for _, tc := range []struct {
+		name   string
+		s      Service
+		path   string
+		status int
+	}{
+		{"healthy", base, "/ready", http.StatusOK},
+		{"healthy", base, "/live", http.StatusOK},
+		{"database down", probedService{base, dbDown, 0}, "/ready", http.StatusServiceUnavailable},
+		{"database down", probedService{base, dbDown, 0}, "/live", http.StatusOK},
+		{"database down", probedService{base, dbDown, 0}, "/health", http.StatusOK},
+		{"database hanging", probedService{base, nil, time.Second}, "/ready", http.StatusServiceUnavailable},
+	} {
+		status, body := serve(tc.s, tc.path)
+		if status != tc.status {
+			t.Errorf("%v: expected %v %v, received %v", tc.name, tc.path, tc.status, status)
+		}
+		if status == http.StatusServiceUnavailable && body.Error.Code != CodeNotReady {
+			t.Errorf("%v: expected code %v, received %v", tc.name, CodeNotReady, body.Error.Code)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+// recover.go turns a panicking endpoint into an internal error, so one bad
+// request is answered with 500 instead of a dropped connection.
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/microservices-demo/user/auth"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PanicError is returned by an endpoint that panicked. Its message says
+// nothing of the panic, which is only logged.
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e PanicError) Error() string {
+	return "Internal error"
+}
+
+// EndpointsOption configures the endpoints returned by MakeEndpoints
+type EndpointsOption func(*endpointsConfig)
+
+type endpointsConfig struct {
+	panics       metrics.Counter
+	metrics      *EndpointMetrics
+	readyTimeout time.Duration
+	slow         time.Duration
+	slowCounter  metrics.Counter
+	userBaggage  bool
+	// impersonationKeys are the API keys of POST /admin/impersonate
+	impersonationKeys  *auth.APIKeys
+	impersonatedWrites bool
+}
+
+// WithPanicCounter counts the panics recovered from endpoints in c
+func WithPanicCounter(c metrics.Counter) EndpointsOption {
+	return func(cfg *endpointsConfig) {
+		cfg.panics = c
+	}
+}
+
+// recoverPanic returns an endpoint calling next that answers a panic with
+// a PanicError, counting it in panics and marking the span as errored.
+func recoverPanic(next endpoint.Endpoint, panics metrics.Counter) endpoint.Endpoint {
+	if panics == nil {
+		panics = discard.NewCounter()
+	}
+	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				panics.Add(1)
+				span := trace.SpanFromContext(ctx)
+				span.AddEvent("panic", trace.WithAttributes(attribute.String("message", fmt.Sprint(p))))
+				span.SetStatus(codes.Error, "panic")
+				response, err = nil, PanicError{Value: p, Stack: debug.Stack()}
+			}
+		}()
+		return next(ctx, request)
+	}
+}
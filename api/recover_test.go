@@ -0,0 +1,79 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics/generic"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type panickingService struct {
+	Service
+}
+
+func (panickingService) ListUsers(ListParams) ([]users.User, Page, error) {
+	var u *users.User
+	return []users.User{*u}, Page{}, nil
+}
+
+func TestRecoverPanic(t *testing.T) {
+	var buf bytes.Buffer
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("")
+	panics := generic.NewCounter("panics")
+	e := MakeEndpoints(panickingService{NewFixedService(memory.New())}, tracer, log.NewLogfmtLogger(&buf), nil, WithPanicCounter(panics))
+	h := RequestIDMiddleware(MakeHTTPHandler(e, log.NewNopLogger()))
+
+	req := httptest.NewRequest("GET", "/customers", nil)
+	req.Header.Set(RequestIDHeader, "boom")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("Expected 500, received %v", rec.Code)
+	}
+	var body ErrorBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != CodeInternal || strings.Contains(body.Error.Message, "nil pointer") {
+		t.Errorf("Expected internal error without panic details, received %+v", body.Error)
+	}
+	if len(body.Error.TraceID) != 32 || body.Error.RequestID != "boom" {
+		t.Errorf("Expected the trace and request ids of the request, received %+v", body.Error)
+	}
+	if panics.Value() != 1 {
+		t.Errorf("Expected panic counted, counted %v", panics.Value())
+	}
+	logged := buf.String()
+	for _, want := range []string{"request_id=boom", "nil pointer dereference", "stack=", "panickingService.ListUsers"} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("Expected %q logged, received %v", want, logged)
+		}
+	}
+	errored := false
+	for _, span := range spans.Ended() {
+		if span.Status().Code == codes.Error {
+			errored = true
+		}
+	}
+	if !errored {
+		t.Error("Expected span marked as errored")
+	}
+
+	// Other requests are still served
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/addresses", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected service still serving, received %v", rec.Code)
+	}
+}
@@ -0,0 +1,73 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/redact"
+	"github.com/microservices-demo/user/users"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestNoSensitiveValuesLogged(t *testing.T) {
+	redact.SetPolicy(redact.Policy{MaskEmails: true})
+	defer redact.SetPolicy(redact.Policy{})
+	var buf bytes.Buffer
+	logger := log.NewLogfmtLogger(&buf)
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("")
+	s := LoggingMiddleware(logger)(NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost))))
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, NewLevelLogger(logger, LevelDebug), nil), log.NewNopLogger())
+	// Ids and durations are random, so they may hold any digits: the values
+	// logged are replaced before looking for the CCV
+	var random []string
+	post := func(path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", path, strings.NewReader(body)))
+		var res struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(rec.Body.Bytes(), &res) == nil && res.ID != "" {
+			random = append(random, res.ID, "id")
+		}
+		return rec
+	}
+
+	rec := post("/register", `{"username": "redacted", "password": "s3cret-Passw0rd", "email": "private.person@example.com", "firstName": "Red", "lastName": "Acted"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected registered, received %v %v", rec.Code, rec.Body)
+	}
+	rec = post("/cards", `{"longNum": "4111111111111111", "expires": "04/29", "ccv": "7290"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected card posted, received %v %v", rec.Code, rec.Body)
+	}
+
+	var captured strings.Builder
+	captured.WriteString(buf.String())
+	for _, span := range spans.Ended() {
+		fmt.Fprint(&captured, span.Name(), span.Attributes(), span.Events(), span.Status())
+	}
+	for _, span := range spans.Ended() {
+		traceID := span.SpanContext().TraceID().String()
+		random = append(random, traceID, "traceid", traceID[16:], "traceid", span.SpanContext().SpanID().String(), "spanid")
+	}
+	scrubbed := strings.NewReplacer(random...).Replace(regexp.MustCompile(`took=\S+`).ReplaceAllString(captured.String(), "took="))
+	for _, secret := range []string{"s3cret-Passw0rd", "4111111111111111", "7290", "private.person@example.com"} {
+		if strings.Contains(scrubbed, secret) {
+			t.Errorf("Expected %q redacted, received %v", secret, captured.String())
+		}
+	}
+	if !strings.Contains(buf.String(), "request=") || !strings.Contains(buf.String(), "************1111") {
+		t.Errorf("Expected the requests dumped with the card masked, received %v", buf.String())
+	}
+}
@@ -0,0 +1,78 @@
+package api
+
+// requestid.go gives every request an id that clients see and can quote, so
+// a complaint can be matched with the logs and trace of its request.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// RequestIDHeader carries the id of a request, both ways
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLength = 128
+
+type requestIDKey struct{}
+
+// RequestIDMiddleware takes the id of each request from its X-Request-ID
+// header, generating a random UUID when it is absent or unusable, stores it
+// in the request context and echoes it in the response headers.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(NewRequestIDContext(r.Context(), id)))
+	})
+}
+
+// NewRequestIDContext returns a context carrying the request id
+func NewRequestIDContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestIDFromContext returns the request id stored in ctx, if any
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// validRequestID accepts ids of printable ASCII only, so a client cannot
+// inject line breaks or control characters into the logs
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// fallbackRequestIDs counts the request ids made without randomness
+var fallbackRequestIDs atomic.Uint64
+
+// newRequestID returns a random version 4 UUID. Should the random source
+// fail, the id is made of the time and a counter instead, still unique
+// within the process, rather than of zeros shared by every request.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(b[8:], fallbackRequestIDs.Add(1))
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db/memory"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := noop.NewTracerProvider().Tracer("")
+	e := MakeEndpoints(NewFixedService(memory.New()), tracer, log.NewLogfmtLogger(&buf), nil)
+	h := RequestIDMiddleware(MakeHTTPHandler(e, log.NewNopLogger()))
+	get := func(path, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get("/customers/5a0e9c4e0000000000000000", "complaint-42")
+	if rec.Code != http.StatusNotFound || rec.Header().Get(RequestIDHeader) != "complaint-42" {
+		t.Errorf("Expected request id echoed on error, received %v %q", rec.Code, rec.Header().Get(RequestIDHeader))
+	}
+	if !strings.Contains(buf.String(), "request_id=complaint-42") {
+		t.Errorf("Expected request id logged, received %v", buf.String())
+	}
+
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	for _, id := range []string{"", "two words", strings.Repeat("x", 200)} {
+		got := get("/customers", id).Header().Get(RequestIDHeader)
+		if !uuid.MatchString(got) {
+			t.Errorf("Header %q: expected generated UUID, received %q", id, got)
+		}
+	}
+}
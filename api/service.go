@@ -4,156 +4,1141 @@ package api
 // user service. Everything here is agnostic to the transport (HTTP).
 
 import (
-	"crypto/sha1"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
-	"fmt"
-	"io"
+	"sync"
 	"time"
 
+	"github.com/microservices-demo/user/auth"
 	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/events"
 	"github.com/microservices-demo/user/users"
 )
 
 var (
 	ErrUnauthorized = errors.New("Unauthorized")
+	// ErrUserExists is a registration taking the username or email of
+	// another user
+	ErrUserExists = errors.New("User already exists")
+	// ErrNotFound is a lookup or change of an entity that does not exist
+	ErrNotFound = errors.New("Not found")
+	// ErrUnavailable is the database failing to answer, a request worth
+	// retrying later
+	ErrUnavailable = errors.New("Service unavailable")
+)
+
+// ServiceError is an error of Kind, ErrUserExists, ErrNotFound or
+// ErrUnavailable, caused by Err. It matches both with errors.Is and
+// errors.As, so the transport keys off Kind while Err, as a
+// db.NotFoundError naming the entity, stays at hand for the error body and
+// the logs.
+type ServiceError struct {
+	Kind error
+	Err  error
+}
+
+// Error returns the message of Err, but for ErrUnavailable, whose cause is
+// only logged
+func (e ServiceError) Error() string {
+	if e.Kind == ErrUnavailable {
+		return e.Kind.Error()
+	}
+	return e.Err.Error()
+}
+
+// Unwrap returns Kind and Err
+func (e ServiceError) Unwrap() []error {
+	return []error{e.Kind, e.Err}
+}
+
+// serviceError wraps err, from the database, in the ServiceError of its
+// kind: missing entities as ErrNotFound and a database out of reach as
+// ErrUnavailable. Other errors are returned as they are.
+func serviceError(err error) error {
+	switch db.ErrorKind(err) {
+	case db.KindNotFound:
+		return ServiceError{Kind: ErrNotFound, Err: err}
+	case db.KindTimeout, db.KindConnection:
+		return ServiceError{Kind: ErrUnavailable, Err: err}
+	}
+	return err
+}
+
+// AuthError is a failed credential check. It reads and matches as
+// ErrUnauthorized, so clients cannot tell an unknown user from a wrong
+// password, while Reason keeps the cause for logs and traces.
+type AuthError struct {
+	Reason string
+}
+
+func (e AuthError) Error() string {
+	return ErrUnauthorized.Error()
+}
+
+// Is reports whether target is ErrUnauthorized
+func (e AuthError) Is(target error) bool {
+	return target == ErrUnauthorized
+}
+
+const (
+	reasonUnknownUser   = "unknown user"
+	reasonWrongPassword = "wrong password"
 )
 
 // Service is the user service, providing operations for users to login, register, and retrieve customer information.
 type Service interface {
-	Login(username, password string) (users.User, error) // GET /login
-	Register(username, password, email, first, last string) (string, error)
-	GetUsers(id string) ([]users.User, error)
-	PostUser(u users.User) (string, error)
-	GetAddresses(id string) ([]users.Address, error)
-	PostAddress(u users.Address, userid string) (string, error)
-	GetCards(id string) ([]users.Card, error)
-	PostCard(u users.Card, userid string) (string, error)
-	Delete(entity, id string) error
-	Health() []Health // GET /health
+	// Login returns the user logged in with a token; its addresses and
+	// cards are only loaded when attributes is set
+	Login(username, password string, attributes bool) (users.User, string, error) // GET /login
+	LoginMFA(challenge, code string) (users.User, string, error)                  // POST /login/mfa
+	Register(username, password, email, first, last, phone, displayName string) (string, error)
+	// GetUser returns the user with its addresses and cards, ErrNotFound
+	// when there is none
+	GetUser(id string) (users.User, error)
+	// ListUsers returns the page of the users params select, with the Page
+	// it is
+	ListUsers(params ListParams) ([]users.User, Page, error)
+	// PostUser creates the user with its addresses and cards, all or none
+	// of them, returning it with the ids they were given
+	PostUser(u users.User) (users.User, error)
+	UpdateUser(id string, u users.User, principal string) (users.User, error)
+	PatchUser(id string, p users.UserPatch, principal string) (users.User, error)
+	ChangePassword(id, current, next string) error
+	SetRoles(id string, roles []string, principal string) (users.User, error)
+	SetStatus(id, status, reason, principal string) (users.User, error)
+	// SetPreferences merges changes into the preferences of the user, a nil
+	// value deleting its key, returning them all
+	SetPreferences(id string, changes map[string]*string) (map[string]string, error)
+	CreateRefreshToken(userID, device string) (string, error)
+	Refresh(refreshToken string) (token, nextRefreshToken string, err error) // POST /token/refresh
+	Logout(refreshToken, accessToken string) error                           // POST /logout
+	// LogoutAll ends every session of the user: the access tokens and
+	// session cookies issued to it are refused, and its refresh tokens
+	// revoked
+	LogoutAll(id, principal string) error
+	// Impersonate returns the user and a short lived token letting the
+	// impersonator, an admin, see the service as the user
+	Impersonate(id, impersonator string) (users.User, string, error)
+	// AuditImpersonation records a request the impersonator made to method
+	// as the user, and whether it was refused
+	AuditImpersonation(id, impersonator, method string, refused bool) error
+	ProvisionMFA(id string) (secret, uri string, err error)
+	ConfirmMFA(id, code string) (recoveryCodes []string, err error)
+	DisableMFA(id, code string) error
+	GetAddress(id string) (users.Address, error)
+	ListAddresses(params ListParams) ([]users.Address, Page, error)
+	// PostAddress and PostCard add an address or a card to the user, which
+	// principal must be, or an admin
+	PostAddress(u users.Address, userid, principal string) (string, error)
+	// SetDefaultAddress makes an address of the user its default shipping
+	// or billing address, as typ says
+	SetDefaultAddress(id, addressID, typ string) (users.User, error)
+	GetCard(id string) (users.Card, error)
+	ListCards(params ListParams) ([]users.Card, Page, error)
+	PostCard(u users.Card, userid, principal string) (string, error)
+	// SetCardLabel replaces the label of a card of the user
+	SetCardLabel(id, cardID, label string) (users.Card, error)
+	// SetDefaultCard makes a card of the user the one checkouts charge
+	SetDefaultCard(id, cardID string) (users.User, error)
+	// MergeAttributes links the addresses and cards created by a guest,
+	// without a customer, in the guest session to the user. An item that
+	// cannot be linked, as one posted in another session, is reported in the
+	// result and does not keep the others from being linked.
+	MergeAttributes(id, session string, addresses, cards []string) MergeResult
+	// GetEmails lists the emails of the user, the primary first. AddEmail
+	// adds one unverified, returning the code VerifyEmail verifies it with;
+	// RemoveEmail removes one but the primary, and SetPrimaryEmail makes a
+	// verified one primary.
+	GetEmails(id string) ([]users.EmailAddress, error)
+	AddEmail(id, address string) ([]users.EmailAddress, string, error)
+	VerifyEmail(id, address, code string) ([]users.EmailAddress, error)
+	RemoveEmail(id, address string) ([]users.EmailAddress, error)
+	SetPrimaryEmail(id, address string) (users.User, error)
+	// GetConsents returns the consents of the user to marketing and their
+	// history; SetConsents records changes to them, given through source
+	GetConsents(id string) (users.ConsentState, error)
+	SetConsents(id, source string, consents map[string]bool) (users.ConsentState, error)
+	// Delete removes the entity; a customer only at the given version,
+	// unless it is db.AnyVersion
+	Delete(entity, id string, version int64, principal string) error
+	AnonymizeUser(id, principal string) error
+	// StreamUsers, StreamAddresses and StreamCards call fn with each entity
+	// of the full listing in turn, stopping at the first error fn returns
+	StreamUsers(sort db.Sort, fn func(users.User) error) error
+	StreamAddresses(fn func(users.Address) error) error
+	StreamCards(fn func(users.Card) error) error
+	// Health reports the health of the service and its dependencies, from
+	// recent pings unless force
+	Health(force bool) []Health // GET /health
+}
+
+// ListParams select a page of a list. Page and Size select it, a zero Size
+// listing everything; Sort orders customers, and Label narrows cards to those
+// whose label holds it, in any case.
+type ListParams struct {
+	Page  int
+	Size  int
+	Sort  db.Sort
+	Label string
+}
+
+// contextBinder is implemented by services able to make their calls for
+// the request of a context. Middlewares implement it by binding the service
+// they wrap, so the binding reaches the fixed service below them.
+type contextBinder interface {
+	withContext(ctx context.Context) Service
+}
+
+// withContext returns s making its calls for the request of ctx when it is
+// a contextBinder, and s otherwise
+func withContext(s Service, ctx context.Context) Service {
+	if b, ok := s.(contextBinder); ok {
+		return b.withContext(ctx)
+	}
+	return s
+}
+
+// ServiceOption configures the service returned by NewFixedService.
+type ServiceOption func(*fixedService)
+
+// WithTokenIssuer makes Login return a token signed by i alongside the user.
+func WithTokenIssuer(i *auth.Issuer) ServiceOption {
+	return func(s *fixedService) {
+		s.tokens = i
+	}
+}
+
+// WithRefreshTTL sets how long refresh tokens stay valid.
+func WithRefreshTTL(ttl time.Duration) ServiceOption {
+	return func(s *fixedService) {
+		s.refreshTTL = ttl
+	}
+}
+
+// WithHasher sets the password hasher, bcrypt with the default cost by default.
+func WithHasher(h users.Hasher) ServiceOption {
+	return func(s *fixedService) {
+		s.hasher = h
+	}
+}
+
+// WithPasswordPolicy sets the policy new passwords must meet, by default any
+// password is accepted.
+func WithPasswordPolicy(p users.PasswordPolicy) ServiceOption {
+	return func(s *fixedService) {
+		s.policy = p
+	}
+}
+
+// WithConfusableUsernames refuses usernames only told apart from that of
+// another user by confusable characters, as аdmin with a Cyrillic а. The
+// database must keep skeletons unique for names taken at once to be refused.
+func WithConfusableUsernames() ServiceOption {
+	return func(s *fixedService) {
+		s.rejectConfusable = true
+	}
+}
+
+// WithEventSink makes the service write its audit events to sink instead of
+// the audit log of the database.
+func WithEventSink(sink events.EventSink) ServiceOption {
+	return func(s *fixedService) {
+		s.sink = sink
+	}
 }
 
 // NewFixedService returns a simple implementation of the Service interface,
-func NewFixedService() Service {
-	return &fixedService{}
+// backed by the given database.
+func NewFixedService(d db.Database, opts ...ServiceOption) Service {
+	s := &fixedService{
+		ctx:           context.Background(),
+		db:            d,
+		background:    &sync.WaitGroup{},
+		dummy:         &dummyHash{},
+		refreshTTL:    30 * 24 * time.Hour,
+		hasher:        users.NewBcryptHasher(0),
+		pingInterval:  DefaultPingInterval,
+		healthTimeout: DefaultHealthTimeout,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	// The database and the denylist come first, before the components of
+	// the options
+	checks := []healthCheck{{component: "user-db", severity: SeverityCritical, ping: &cachedPing{ping: d.Ping}}}
+	if s.tokens != nil && s.tokens.Denylist != nil {
+		checks = append(checks, healthCheck{component: "user-denylist-" + s.tokens.Denylist.Backend(), severity: SeverityCritical, ping: &cachedPing{ping: s.tokens.Denylist.Ping}})
+	}
+	s.checks = append(checks, s.checks...)
+	return s
 }
 
-type fixedService struct{}
+type fixedService struct {
+	// ctx is the context of the request the calls are made for, set by
+	// withContext
+	ctx        context.Context
+	db         db.Database
+	tokens     *auth.Issuer
+	refreshTTL time.Duration
+	hasher     users.Hasher
+	policy     users.PasswordPolicy
+	mfaSealer  *auth.Sealer
+	mfaIssuer  string
+	sink       events.EventSink
+	// rejectConfusable refuses usernames confusable with that of another
+	rejectConfusable bool
+	// background tracks password upgrades still being written
+	background *sync.WaitGroup
+	dummy      *dummyHash
+	// pingInterval is how long the pings of health checks are reused
+	pingInterval time.Duration
+	// healthTimeout is the time each of checks gets to answer
+	healthTimeout time.Duration
+	checks        []healthCheck
+}
 
 type Health struct {
 	Service string `json:"service"`
 	Status  string `json:"status"`
-	Time    string `json:"time"`
+	// Severity tells whether the component gates readiness, when critical
+	Severity string `json:"severity"`
+	// Time is when the status was observed
+	Time string `json:"time"`
+	// Age is the age of the status in seconds, for a cached observation
+	Age float64 `json:"age"`
+	// Latency is the time the check of the status took, in seconds
+	Latency float64 `json:"latency"`
+	// Error is why the component failed its check
+	Error string `json:"error,omitempty"`
 }
 
-func (s *fixedService) Login(username, password string) (users.User, error) {
-	u, err := db.GetUserByName(username)
+func (s *fixedService) Login(username, password string, attributes bool) (users.User, string, error) {
+	u, joined, err := s.userByName(username, attributes)
+	if errors.Is(err, db.ErrNotFound) && users.ValidateEmail(username) == nil {
+		// Any verified email of the user logs in as well as its name
+		u, err = s.db.GetUserByEmail(username)
+		joined = false
+	}
+	if errors.Is(err, db.ErrNotFound) {
+		// Spend the time of a real comparison so timing does not tell
+		// unknown users apart
+		s.hasher.Verify(s.dummyHash(), "", password)
+		return users.New(), "", s.authFailure(reasonUnknownUser)
+	}
 	if err != nil {
-		return users.New(), err
+		return users.New(), "", serviceError(err)
 	}
-	if u.Password != calculatePassHash(password, u.Salt) {
-		return users.New(), ErrUnauthorized
+	if !s.hasher.Verify(u.Password, u.Salt, password) {
+		return users.New(), "", s.authFailure(reasonWrongPassword)
 	}
-	db.GetUserAttributes(&u)
-	u.MaskCCs()
-	return u, nil
-
+	// Only told once the password is right, not to whoever tries the name
+	if u.Disabled() {
+		return users.New(), "", ErrAccountDisabled
+	}
+	if s.hasher.NeedsRehash(u.Password) {
+		s.rehash(u.UserID, u.Password, password)
+	}
+	if err := s.mfaChallenge(u); err != nil {
+		return users.New(), "", err
+	}
+	u.AddLinks()
+	switch {
+	case joined:
+		linkAttributes(&u)
+	case attributes:
+		s.getUserAttributes(&u)
+	default:
+		u.Addresses, u.Cards = make([]users.Address, 0), make([]users.Card, 0)
+	}
+	// The card numbers are masked as the response is marshalled, in the
+	// style of the role of the user, see MaskCardsForRole
+	if s.tokens == nil {
+		return u, "", nil
+	}
+	token, err := s.tokens.IssueVersion(u.UserID, u.Username, u.CredentialsVersion, u.Roles...)
+	if err != nil {
+		return users.New(), "", err
+	}
+	return u, token, nil
 }
 
-func (s *fixedService) Register(username, password, email, first, last string) (string, error) {
+// Register creates a customer, returning ErrUserExists when another holds
+// its username or email
+func (s *fixedService) Register(username, password, email, first, last, phone, displayName string) (string, error) {
+	if err := s.checkUsername("", username); err != nil {
+		return "", serviceError(err)
+	}
+	if err := s.policy.Check(password, username, email); err != nil {
+		return "", err
+	}
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		return "", err
+	}
 	u := users.New()
 	u.Username = username
-	u.Password = calculatePassHash(password, u.Salt)
+	u.Password = hash
+	u.Salt = ""
 	u.Email = email
 	u.FirstName = first
 	u.LastName = last
-	err := db.CreateUser(&u)
-	return u.UserID, err
+	u.Phone = phone
+	u.DisplayName = displayName
+	u.Roles = []string{users.RoleCustomer}
+	u.Status = users.StatusActive
+	if err := s.db.CreateUser(&u); err != nil {
+		if confusable(err) {
+			return "", errConfusableUsername()
+		}
+		if errors.Is(err, db.ErrAlreadyExists) {
+			return "", ServiceError{Kind: ErrUserExists, Err: err}
+		}
+		return "", serviceError(err)
+	}
+	return u.UserID, nil
 }
 
-func (s *fixedService) GetUsers(id string) ([]users.User, error) {
-	if id == "" {
-		us, err := db.GetUsers()
-		for k, u := range us {
-			u.AddLinks()
-			us[k] = u
-		}
-		return us, err
+func (s *fixedService) GetUser(id string) (users.User, error) {
+	u, err := s.db.GetUser(id)
+	if err != nil {
+		return users.User{}, serviceError(notFound(err, "customers", id))
 	}
-	u, err := db.GetUser(id)
+	s.getUserAttributes(&u)
 	u.AddLinks()
-	return []users.User{u}, err
+	return u, nil
+}
+
+func (s *fixedService) ListUsers(params ListParams) ([]users.User, Page, error) {
+	us, err := s.db.GetUsersSorted(params.Sort)
+	if err != nil {
+		return nil, Page{}, serviceError(err)
+	}
+	us, page := paginate(us, params.Page, params.Size)
+	for k, u := range us {
+		u.AddLinks()
+		us[k] = u
+	}
+	return us, page, nil
+}
+
+// StreamUsers reads the users one at a time when the database is a
+// db.Streamer, else lists them all first
+func (s *fixedService) StreamUsers(sort db.Sort, fn func(users.User) error) error {
+	withLinks := func(u users.User) error {
+		u.AddLinks()
+		return fn(u)
+	}
+	if st, ok := s.db.(db.Streamer); ok {
+		return st.StreamUsers(sort, withLinks)
+	}
+	us, err := s.db.GetUsersSorted(sort)
+	if err != nil {
+		return err
+	}
+	return each(us, withLinks)
+}
+
+// StreamAddresses reads the addresses one at a time when the database is a
+// db.Streamer, else lists them all first
+func (s *fixedService) StreamAddresses(fn func(users.Address) error) error {
+	withLinks := func(a users.Address) error {
+		a.AddLinks()
+		return fn(a)
+	}
+	if st, ok := s.db.(db.Streamer); ok {
+		return st.StreamAddresses(withLinks)
+	}
+	as, err := s.db.GetAddresses()
+	if err != nil {
+		return err
+	}
+	return each(as, withLinks)
+}
+
+// StreamCards reads the cards one at a time when the database is a
+// db.Streamer, else lists them all first
+func (s *fixedService) StreamCards(fn func(users.Card) error) error {
+	withLinks := func(c users.Card) error {
+		c.AddLinks()
+		return fn(c)
+	}
+	if st, ok := s.db.(db.Streamer); ok {
+		return st.StreamCards(withLinks)
+	}
+	cs, err := s.db.GetCards()
+	if err != nil {
+		return err
+	}
+	return each(cs, withLinks)
+}
+
+// each calls fn with the items in turn, stopping at the first error
+func each[T any](items []T, fn func(T) error) error {
+	for _, item := range items {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notFound names the entity of a db.ErrNotFound
+func notFound(err error, entity, id string) error {
+	if err == db.ErrNotFound {
+		return db.NotFoundError{Entity: entity, ID: id}
+	}
+	return err
+}
+
+// getUserAttributes loads the addresses and cards of u, with links.
+func (s *fixedService) getUserAttributes(u *users.User) error {
+	err := s.db.GetUserAttributes(u)
+	if err != nil {
+		return err
+	}
+	linkAttributes(u)
+	return nil
+}
+
+// userByName reads the user named name, joined with its addresses and cards
+// in a single query when attributes is set and the database is able to
+func (s *fixedService) userByName(name string, attributes bool) (u users.User, joined bool, err error) {
+	if j, ok := s.db.(db.AttributeJoiner); ok && attributes {
+		u, err = j.GetUserByNameWithAttributes(name)
+		return u, true, err
+	}
+	u, err = s.db.GetUserByName(name)
+	return u, false, err
+}
+
+// linkAttributes sets the links of the loaded addresses and cards of u and
+// marks its default card
+func linkAttributes(u *users.User) {
+	for k := range u.Addresses {
+		u.Addresses[k].AddLinks()
+	}
+	for k := range u.Cards {
+		u.Cards[k].AddLinks()
+		u.Cards[k].Default = u.Cards[k].ID == u.DefaultCard
+	}
+}
+
+// PostUser validates the user and every address and card of it before
+// storing any, refusing the whole of it with FieldErrors naming each problem,
+// as addresses[0].street
+func (s *fixedService) PostUser(u users.User) (users.User, error) {
+	u.Normalize()
+	for k := range u.Addresses {
+		u.Addresses[k].Normalize()
+	}
+	for k := range u.Cards {
+		u.Cards[k].Normalize()
+	}
+	if err := u.ValidateWithAttributes(); err != nil {
+		return users.New(), err
+	}
+	if err := s.checkUsername("", u.Username); err != nil {
+		return users.New(), serviceError(err)
+	}
+	if err := s.policy.Check(u.Password, u.Username, u.Email); err != nil {
+		return users.New(), err
+	}
+	hash, err := s.hasher.Hash(u.Password)
+	if err != nil {
+		return users.New(), err
+	}
+	u.Password = hash
+	u.Salt = ""
+	// Roles are only granted through SetRoles, and statuses set through
+	// SetStatus
+	u.Roles = []string{users.RoleCustomer}
+	u.Status = users.StatusActive
+	if err := s.db.CreateUser(&u); err != nil {
+		if confusable(err) {
+			return users.New(), errConfusableUsername()
+		}
+		if errors.Is(err, db.ErrAlreadyExists) {
+			return users.New(), ServiceError{Kind: ErrUserExists, Err: err}
+		}
+		return users.New(), serviceError(err)
+	}
+	return u, nil
+}
+
+// UpdateUser replaces the profile of the user, returning it with the Changes
+// made, which the audit entry records. The email is kept; another is refused,
+// the emails changing through AddEmail and SetPrimaryEmail only.
+func (s *fixedService) UpdateUser(id string, u users.User, principal string) (users.User, error) {
+	before, err := s.db.GetUser(id)
+	if err != nil {
+		return users.New(), notFound(err, "customers", id)
+	}
+	if err := s.checkRename(before, u.Username); err != nil {
+		return users.New(), err
+	}
+	if u.Email != "" && !users.SameEmail(u.Email, before.Email) {
+		return users.New(), errEmailNotUpdatable
+	}
+	u.UserID, u.Email = id, before.Email
+	if before.DisplayNameDefaulted(u.DisplayName, u) {
+		u.DisplayName = ""
+	}
+	if err := s.db.UpdateUser(&u); err != nil {
+		if confusable(err) {
+			return users.New(), errConfusableUsername()
+		}
+		return users.New(), notFound(err, "customers", id)
+	}
+	return s.auditUpdate("update", before, principal)
+}
+
+// PatchUser sets the fields present in p, returning the user with the
+// Changes made, which the audit entry records. Like UpdateUser it refuses
+// another email.
+func (s *fixedService) PatchUser(id string, p users.UserPatch, principal string) (users.User, error) {
+	before, err := s.db.GetUser(id)
+	if err != nil {
+		return users.New(), notFound(err, "customers", id)
+	}
+	if p.Username != nil {
+		if err := s.checkRename(before, *p.Username); err != nil {
+			return users.New(), err
+		}
+	}
+	if p.Email != nil && *p.Email != "" && !users.SameEmail(*p.Email, before.Email) {
+		return users.New(), errEmailNotUpdatable
+	}
+	p.Email = nil
+	if p.DisplayName != nil {
+		after := before
+		p.Apply(&after)
+		if before.DisplayNameDefaulted(*p.DisplayName, after) {
+			unset := ""
+			p.DisplayName = &unset
+		}
+	}
+	if err := s.db.PatchUser(id, p); err != nil {
+		if confusable(err) {
+			return users.New(), errConfusableUsername()
+		}
+		return users.New(), notFound(err, "customers", id)
+	}
+	return s.auditUpdate("patch", before, principal)
 }
 
-func (s *fixedService) PostUser(u users.User) (string, error) {
-	u.NewSalt()
-	u.Password = calculatePassHash(u.Password, u.Salt)
-	err := db.CreateUser(&u)
-	return u.UserID, err
+// auditUpdate reads back the user before was updated to, setting the
+// Changes from before, and records them under action
+func (s *fixedService) auditUpdate(action string, before users.User, principal string) (users.User, error) {
+	u, err := s.GetUser(before.UserID)
+	if err != nil {
+		return users.New(), err
+	}
+	u.Changes = users.Diff(before, u)
+	err = s.record(db.AuditEntry{Action: action, Entity: "customers", ID: u.UserID, Principal: principal, Changes: u.Changes})
+	if err != nil {
+		return users.New(), err
+	}
+	return u, nil
+}
+
+// checkUsername refuses name, new to the user id or to a user yet to be
+// created when id is empty, when it breaks the rules of usernames or, with
+// WithConfusableUsernames, is confusable with the username of another user.
+// The check is only the early answer: two users taking confusable names at
+// once are told apart by the database keeping skeletons unique.
+func (s *fixedService) checkUsername(id, name string) error {
+	if err := users.ValidateUsername(name); err != nil {
+		return err
+	}
+	if !s.rejectConfusable {
+		return nil
+	}
+	other, err := s.db.GetUserBySkeleton(users.UsernameSkeleton(name))
+	if errors.Is(err, db.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// The same name is refused by the database as a duplicate
+	if other.UserID == id || other.Username == name {
+		return nil
+	}
+	return errConfusableUsername()
+}
+
+// errConfusableUsername refuses a username confusable with that of another
+// user
+func errConfusableUsername() error {
+	return users.FieldErrors{{Field: "username", Code: users.FieldInvalid, Message: "Username is too close to that of another customer"}}
+}
+
+// confusable reports whether err is the database refusing a username whose
+// skeleton another user holds
+func confusable(err error) bool {
+	var ae db.AlreadyExistsError
+	return errors.As(err, &ae) && ae.Field == db.UsernameSkeletonField
 }
 
-func (s *fixedService) GetAddresses(id string) ([]users.Address, error) {
-	if id == "" {
-		as, err := db.GetAddresses()
-		for k, a := range as {
-			a.AddLinks()
-			as[k] = a
+// checkRename checks name with checkUsername when it is not the current
+// username of u, which may be a legacy one
+func (s *fixedService) checkRename(u users.User, name string) error {
+	if u.Username == name {
+		return nil
+	}
+	return s.checkUsername(u.UserID, name)
+}
+
+// SetRoles replaces the roles of the user. Unknown roles are refused. The
+// new roles are carried by tokens issued from now on; removing a role ends
+// the sessions of the user, lest its tokens keep claiming it.
+func (s *fixedService) SetRoles(id string, roles []string, principal string) (users.User, error) {
+	set := make([]string, 0, len(roles))
+	for _, r := range roles {
+		if !users.ValidRole(r) {
+			return users.New(), ErrInvalidRequest
+		}
+		if !contains(set, r) {
+			set = append(set, r)
+		}
+	}
+	before, err := s.db.GetUser(id)
+	if err != nil {
+		return users.New(), notFound(err, "customers", id)
+	}
+	if err := s.db.SetUserRoles(id, set); err != nil {
+		return users.New(), notFound(err, "customers", id)
+	}
+	for _, r := range before.Roles {
+		if !contains(set, r) {
+			if err := s.revokeCredentials(id); err != nil {
+				return users.New(), err
+			}
+			break
 		}
-		return as, err
 	}
-	a, err := db.GetAddress(id)
+	if err := s.audit("roles", "customers", id, principal); err != nil {
+		return users.New(), err
+	}
+	return s.GetUser(id)
+}
+
+// SetStatus sets the account status of the user, recording reason in the
+// audit log. Disabling an account ends its sessions, as LogoutAll does.
+func (s *fixedService) SetStatus(id, status, reason, principal string) (users.User, error) {
+	if !users.ValidStatus(status) {
+		return users.New(), users.FieldErrors{{Field: "status", Code: users.FieldInvalid, Message: "Status must be active or disabled"}}
+	}
+	if err := s.db.SetUserStatus(id, status); err != nil {
+		return users.New(), notFound(err, "customers", id)
+	}
+	action := "enable"
+	if status == users.StatusDisabled {
+		action = "disable"
+		if err := s.revokeCredentials(id); err != nil {
+			return users.New(), err
+		}
+	}
+	if err := s.auditReason(action, "customers", id, principal, reason); err != nil {
+		return users.New(), err
+	}
+	return s.GetUser(id)
+}
+
+// SetPreferences merges changes into the preferences of the user, a nil
+// value deleting its key. The merged preferences must stay within the caps of
+// users.ValidatePreferences. Only the keys changed are written, so changes to
+// other keys made meanwhile are kept.
+func (s *fixedService) SetPreferences(id string, changes map[string]*string) (map[string]string, error) {
+	u, err := s.db.GetUser(id)
+	if err != nil {
+		return nil, notFound(err, "customers", id)
+	}
+	if err := users.ValidatePreferences(users.MergePreferences(u.Preferences, changes)); err != nil {
+		return nil, err
+	}
+	prefs, err := s.db.UpdateUserPreferences(id, changes)
+	if err != nil {
+		return nil, notFound(err, "customers", id)
+	}
+	return prefs, nil
+}
+
+// SetCardLabel replaces the label of the card with id cardID, which the user
+// must hold, returning the card. An empty label clears it.
+func (s *fixedService) SetCardLabel(id, cardID, label string) (users.Card, error) {
+	if err := users.ValidateCardLabel(label); err != nil {
+		return users.Card{}, err
+	}
+	if err := s.db.SetCardLabel(id, cardID, label); err != nil {
+		if err == db.ErrNotFound {
+			if _, err := s.db.GetUser(id); err != nil {
+				return users.Card{}, notFound(err, "customers", id)
+			}
+		}
+		return users.Card{}, notFound(err, "cards", cardID)
+	}
+	return s.GetCard(cardID)
+}
+
+// SetDefaultCard makes the card with id cardID, which the user must hold, its
+// default card, returning the user
+func (s *fixedService) SetDefaultCard(id, cardID string) (users.User, error) {
+	if err := s.db.SetDefaultCard(id, cardID); err != nil {
+		if err == db.ErrNotFound {
+			if _, err := s.db.GetUser(id); err != nil {
+				return users.New(), notFound(err, "customers", id)
+			}
+		}
+		return users.New(), notFound(err, "cards", cardID)
+	}
+	return s.GetUser(id)
+}
+
+// SetDefaultAddress makes the address with id addressID, which the user must
+// hold, the default of type typ, users.AddressShipping or users.AddressBilling.
+func (s *fixedService) SetDefaultAddress(id, addressID, typ string) (users.User, error) {
+	if typ != users.AddressShipping && typ != users.AddressBilling {
+		return users.New(), users.FieldErrors{{Field: "type", Code: users.FieldInvalid, Message: "Type must be shipping or billing"}}
+	}
+	if err := s.db.SetDefaultAddress(id, addressID, typ); err != nil {
+		if err == db.ErrNotFound {
+			if _, err := s.db.GetUser(id); err != nil {
+				return users.New(), notFound(err, "customers", id)
+			}
+		}
+		return users.New(), notFound(err, "addresses", addressID)
+	}
+	return s.GetUser(id)
+}
+
+// ChangePassword verifies the current password and stores a hash of the next
+// one, which must meet the password policy, then ends the sessions of the
+// user as LogoutAll does. Unknown users get the same ErrUnauthorized as a
+// wrong password.
+func (s *fixedService) ChangePassword(id, current, next string) error {
+	u, err := s.db.GetUser(id)
+	if errors.Is(err, db.ErrNotFound) || errors.Is(err, db.ErrInvalidHexID) {
+		s.hasher.Verify(s.dummyHash(), "", current)
+		return s.authFailure(reasonUnknownUser)
+	}
+	if err != nil {
+		return err
+	}
+	if !s.hasher.Verify(u.Password, u.Salt, current) {
+		return s.authFailure(reasonWrongPassword)
+	}
+	if err := s.policy.Check(next, u.Username, u.Email); err != nil {
+		return err
+	}
+	hash, err := s.hasher.Hash(next)
+	if err != nil {
+		return err
+	}
+	// Revoked first, so a failure leaves the password as it was rather
+	// than changed with the sessions of the former one still valid
+	if err := s.revokeCredentials(id); err != nil {
+		return err
+	}
+	return s.db.SetUserPassword(id, hash, "")
+}
+
+// dummyHash is the hash compared against when there is no user, made once
+type dummyHash struct {
+	once sync.Once
+	hash string
+}
+
+// dummyHash returns a hash to compare against when there is no user, so
+// that a failed lookup costs as much as a failed comparison.
+func (s *fixedService) dummyHash() string {
+	s.dummy.once.Do(func() {
+		s.dummy.hash, _ = s.hasher.Hash("dummy password")
+	})
+	return s.dummy.hash
+}
+
+// withContext returns a service sharing the state of s, making its calls
+// for the request of ctx: its database operations, events and audits are
+// traced within ctx
+func (s *fixedService) withContext(ctx context.Context) Service {
+	c := *s
+	c.ctx = ctx
+	c.db = db.WithContext(s.db, ctx)
+	return &c
+}
+
+// authFailure tags the span of the request with reason and returns an
+// AuthError.
+func (s *fixedService) authFailure(reason string) error {
+	tagSpan(s.ctx, "auth.failure", reason)
+	return AuthError{Reason: reason}
+}
+
+// rehash upgrades the stored hash old of the user in the background, so
+// the login that verified the password is not slowed down by it. A password
+// changed meanwhile is left as it is.
+func (s *fixedService) rehash(id, old, password string) {
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		hash, err := s.hasher.Hash(password)
+		if err != nil {
+			return
+		}
+		s.db.ReplaceUserPassword(id, old, hash, "")
+	}()
+}
+
+// CreateRefreshToken returns a new refresh token for the user, labelled with
+// the device it was handed to. No token is created when token issuing is
+// disabled.
+func (s *fixedService) CreateRefreshToken(userID, device string) (string, error) {
+	if s.tokens == nil {
+		return "", nil
+	}
+	token, hash, err := auth.NewRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	id, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	err = s.db.CreateRefreshToken(userID, users.RefreshToken{
+		ID:        id,
+		Hash:      hash,
+		Device:    device,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.refreshTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Refresh exchanges a refresh token for a new access token and a rotated
+// refresh token. Presenting an already exchanged token is treated as a
+// replay and revokes every refresh token of the user; should the revocation
+// fail, its error is returned rather than leaving the tokens usable.
+func (s *fixedService) Refresh(refreshToken string) (string, string, error) {
+	if s.tokens == nil || refreshToken == "" {
+		return "", "", ErrUnauthorized
+	}
+	id, rt, err := s.db.UseRefreshToken(auth.HashRefreshToken(refreshToken))
+	if err != nil {
+		if errors.Is(err, db.ErrNotFound) {
+			return "", "", ErrUnauthorized
+		}
+		return "", "", err
+	}
+	if rt.Used {
+		if err := s.db.RevokeRefreshTokens(id); err != nil {
+			return "", "", err
+		}
+		return "", "", ErrUnauthorized
+	}
+	if !rt.Active(time.Now()) {
+		return "", "", ErrUnauthorized
+	}
+	u, err := s.db.GetUser(id)
+	if err != nil {
+		return "", "", ErrUnauthorized
+	}
+	if u.Disabled() {
+		return "", "", ErrAccountDisabled
+	}
+	token, err := s.tokens.IssueVersion(id, u.Username, u.CredentialsVersion, u.Roles...)
+	if err != nil {
+		return "", "", err
+	}
+	next, err := s.CreateRefreshToken(id, rt.Device)
+	if err != nil {
+		return "", "", err
+	}
+	return token, next, nil
+}
+
+// Logout revokes the given refresh token and puts the given access token on
+// the denylist. Either may be empty, but at least one must be valid.
+func (s *fixedService) Logout(refreshToken, accessToken string) error {
+	if s.tokens == nil {
+		return ErrUnauthorized
+	}
+	revoked := false
+	if refreshToken != "" {
+		id, rt, err := s.db.UseRefreshToken(auth.HashRefreshToken(refreshToken))
+		switch {
+		case errors.Is(err, db.ErrNotFound):
+		case err != nil:
+			return err
+		default:
+			if err := s.db.RevokeRefreshTokens(id, rt.ID); err != nil {
+				return err
+			}
+			revoked = true
+		}
+	}
+	if accessToken != "" {
+		if c, err := s.tokens.Parse(accessToken); err == nil {
+			if err := s.tokens.Revoke(c); err != nil {
+				return err
+			}
+			revoked = true
+		}
+	}
+	if !revoked {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+func (s *fixedService) GetAddress(id string) (users.Address, error) {
+	a, err := s.db.GetAddress(id)
+	if err != nil {
+		return users.Address{}, serviceError(notFound(err, "addresses", id))
+	}
 	a.AddLinks()
-	return []users.Address{a}, err
+	return a, nil
+}
+
+func (s *fixedService) ListAddresses(params ListParams) ([]users.Address, Page, error) {
+	as, err := s.db.GetAddresses()
+	if err != nil {
+		return nil, Page{}, serviceError(err)
+	}
+	as, page := paginate(as, params.Page, params.Size)
+	for k, a := range as {
+		a.AddLinks()
+		as[k] = a
+	}
+	return as, page, nil
 }
 
-func (s *fixedService) PostAddress(add users.Address, userid string) (string, error) {
-	err := db.CreateAddress(&add, userid)
+func (s *fixedService) PostAddress(add users.Address, userid, principal string) (string, error) {
+	if err := s.authorize("create address", userid, principal); err != nil {
+		return "", err
+	}
+	add.Normalize()
+	err := s.db.CreateAddress(&add, userid)
 	return add.ID, err
 }
 
-func (s *fixedService) GetCards(id string) ([]users.Card, error) {
-	if id == "" {
-		cs, err := db.GetCards()
-		for k, c := range cs {
-			c.AddLinks()
-			cs[k] = c
-		}
-		return cs, err
+func (s *fixedService) GetCard(id string) (users.Card, error) {
+	c, err := s.db.GetCard(id)
+	if err != nil {
+		return users.Card{}, serviceError(notFound(err, "cards", id))
 	}
-	c, err := db.GetCard(id)
 	c.AddLinks()
-	return []users.Card{c}, err
+	return c, nil
 }
 
-func (s *fixedService) PostCard(card users.Card, userid string) (string, error) {
-	err := db.CreateCard(&card, userid)
-	return card.ID, err
+// ListCards lists the cards whose label holds params.Label
+func (s *fixedService) ListCards(params ListParams) ([]users.Card, Page, error) {
+	cs, err := s.db.GetCards()
+	if err != nil {
+		return nil, Page{}, serviceError(err)
+	}
+	if params.Label != "" {
+		found := make([]users.Card, 0, len(cs))
+		for _, c := range cs {
+			if labelled(c, params.Label) {
+				found = append(found, c)
+			}
+		}
+		cs = found
+	}
+	cs, page := paginate(cs, params.Page, params.Size)
+	for k, c := range cs {
+		c.AddLinks()
+		cs[k] = c
+	}
+	return cs, page, nil
 }
 
-func (s *fixedService) Delete(entity, id string) error {
-	return db.Delete(entity, id)
+func (s *fixedService) PostCard(card users.Card, userid, principal string) (string, error) {
+	if err := s.authorize("create card", userid, principal); err != nil {
+		return "", err
+	}
+	card.Normalize()
+	err := s.db.CreateCard(&card, userid)
+	return card.ID, err
 }
 
-func (s *fixedService) Health() []Health {
-	var health []Health
-	dbstatus := "OK"
+// Delete removes the entity, a customer for itself or an admin only, and an
+// address or a card for the customer holding it or an admin
+func (s *fixedService) Delete(entity, id string, version int64, principal string) error {
+	if err := s.authorizeDelete(entity, id, principal); err != nil {
+		return err
+	}
+	if err := s.db.Delete(entity, id, version); err != nil {
+		return serviceError(notFound(err, entity, id))
+	}
+	return s.audit("delete", entity, id, principal)
+}
 
-	err := db.Ping()
-	if err != nil {
-		dbstatus = "err"
+// AnonymizeUser erases the personal data of the customer instead of deleting
+// it, so references held by other services stay valid.
+func (s *fixedService) AnonymizeUser(id, principal string) error {
+	if err := s.authorize("anonymize", id, principal); err != nil {
+		return err
+	}
+	if err := s.db.AnonymizeUser(id); err != nil {
+		return err
 	}
+	return s.audit("anonymize", "customers", id, principal)
+}
+
+// audit writes to the event sink, by default the audit log of the database
+// when it keeps one, that principal performed action on the entity with the
+// given id. An empty principal, from callers outside an authenticated
+// request, is recorded as "anonymous".
+func (s *fixedService) audit(action, entity, id, principal string) error {
+	return s.auditReason(action, entity, id, principal, "")
+}
 
-	app := Health{"user", "OK", time.Now().String()}
-	db := Health{"user-db", dbstatus, time.Now().String()}
+// auditReason records the action like audit, with the reason the principal
+// gave for it
+func (s *fixedService) auditReason(action, entity, id, principal, reason string) error {
+	return s.record(db.AuditEntry{Action: action, Entity: entity, ID: id, Principal: principal, Reason: reason})
+}
 
-	health = append(health, app)
-	health = append(health, db)
+// record writes entry to the audit sink, stamped with the time
+func (s *fixedService) record(entry db.AuditEntry) error {
+	sink := s.sink
+	if sink == nil {
+		a, ok := s.db.(db.Auditor)
+		if !ok {
+			return nil
+		}
+		sink = events.NewAuditorSink(a)
+	}
+	if entry.Principal == "" {
+		entry.Principal = "anonymous"
+	}
+	entry.Time = time.Now()
+	e := events.NewAudit(entry)
+	e.TraceID = traceID(s.ctx)
+	return sink.Write(s.ctx, e)
+}
 
-	return health
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
 }
 
-func calculatePassHash(pass, salt string) string {
-	h := sha1.New()
-	io.WriteString(h, salt)
-	io.WriteString(h, pass)
-	return fmt.Sprintf("%x", h.Sum(nil))
+func newTokenID() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
@@ -1,9 +1,21 @@
 package api
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
 
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/events"
 	"github.com/microservices-demo/user/users"
+	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -12,7 +24,7 @@ var (
 )
 
 func init() {
-	TestService = NewFixedService()
+	TestService = NewFixedService(memory.New())
 }
 
 func TestLogin(t *testing.T) {
@@ -23,17 +35,534 @@ func TestRegister(t *testing.T) {
 
 }
 
-func TestCalculatePassHash(t *testing.T) {
-	hash1 := calculatePassHash("eve", "c748112bc027878aa62812ba1ae00e40ad46d497")
-	if hash1 != "fec51acb3365747fc61247da5e249674cf8463c2" {
-		t.Error("Eve's password failed hash test")
+func TestUpdateUser(t *testing.T) {
+	s := NewFixedService(memory.New())
+	id, err := s.Register("update", "password", "update@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
 	}
-	hash2 := calculatePassHash("password", "6c1c6176e8b455ef37da13d953df971c249d0d8e")
-	if hash2 != "e2de7202bb2201842d041f6de201b10438369fb8" {
-		t.Error("user's password failed hash test")
+	_, err = s.Register("taken", "password", "taken@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
 	}
-	hash3 := calculatePassHash("password", "bd832b0e10c6882deabc5e8e60a37689e2b708c2")
-	if hash3 != "8f31df4dcc25694aeb0c212118ae37bbd6e47bcd" {
-		t.Error("user1's password failed hash test")
+	u, err := s.UpdateUser(id, users.User{Username: "updated", Email: "update@example.com", FirstName: "new", LastName: "name"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.UserID != id || u.Username != "updated" || u.FirstName != "new" {
+		t.Errorf("Expected updated user, received %+v", u)
+	}
+	if _, _, err := s.Login("updated", "password", false); err != nil {
+		t.Errorf("Expected password to survive update, received %v", err)
+	}
+	_, err = s.UpdateUser(id, users.User{Username: "taken"}, "")
+	if err != db.ErrAlreadyExists {
+		t.Errorf("Expected already exists error, received %v", err)
+	}
+	_, err = s.UpdateUser("5a0e9c4e0000000000000000", users.User{Username: "missing"}, "")
+	if !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func TestUpdateAuditsChanges(t *testing.T) {
+	d := memory.New()
+	s := NewFixedService(d, WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	id, err := s.Register("changes", "password", "changes@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	email, first, last := "moved@example.org", "renamed", "changed"
+	var fe users.FieldErrors
+	if _, err := s.PatchUser(id, users.UserPatch{Email: &email}, "support"); !errors.As(err, &fe) || fe[0].Field != "email" {
+		t.Errorf("Expected the email refused, received %v", err)
+	}
+	u, err := s.PatchUser(id, users.UserPatch{FirstName: &first, LastName: &last}, "support")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []users.FieldChange{
+		{Field: "firstName", Old: "first", New: "renamed"},
+		{Field: "lastName", Old: "last", New: "changed"},
+	}
+	if !reflect.DeepEqual(u.Changes, want) {
+		t.Errorf("Expected the changes %+v, received %+v", want, u.Changes)
+	}
+	audit := d.AuditLog()
+	if len(audit) != 1 || audit[0].Action != "patch" || !reflect.DeepEqual(audit[0].Changes, want) {
+		t.Errorf("Expected the changes audited, received %+v", audit)
+	}
+
+	u.FirstName = "first"
+	if u, err = s.UpdateUser(id, u, "support"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []users.FieldChange{{Field: "firstName", Old: "renamed", New: "first"}}; !reflect.DeepEqual(u.Changes, want) {
+		t.Errorf("Expected the changes %+v, received %+v", want, u.Changes)
+	}
+	if u, err = s.UpdateUser(id, u, "support"); err != nil || u.Changes != nil {
+		t.Errorf("Expected no changes, received %+v %v", u.Changes, err)
+	}
+	u.Email = "moved@example.org"
+	if _, err = s.UpdateUser(id, u, "support"); !errors.As(err, &fe) || fe[0].Field != "email" {
+		t.Errorf("Expected the email refused, received %v", err)
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	s := NewFixedService(memory.New())
+	id, err := s.Register("change", "old", "change@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ChangePassword(id, "wrong", "new"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected unauthorized for wrong password, received %v", err)
+	}
+	if err := s.ChangePassword("5a0e9c4e0000000000000000", "old", "new"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected unauthorized for unknown user, received %v", err)
+	}
+	if err := s.ChangePassword(id, "old", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Login("change", "old", false); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected old password rejected, received %v", err)
+	}
+	if _, _, err := s.Login("change", "new", false); err != nil {
+		t.Errorf("Expected new password accepted, received %v", err)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	s := NewFixedService(memory.New(), WithPasswordPolicy(users.PasswordPolicy{MinLength: 8, RejectIdentity: true}))
+	var pe users.PasswordPolicyError
+	if _, err := s.Register("weak", "short", "weak@example.com", "first", "last", "", ""); !errors.As(err, &pe) {
+		t.Errorf("Expected policy error, received %v", err)
+	}
+	id, err := s.Register("strong", "long enough", "strong@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ChangePassword(id, "long enough", "strong@example.com"); !errors.As(err, &pe) || pe.Rules[0] != users.RuleIdentity {
+		t.Errorf("Expected identity rule broken, received %v", err)
+	}
+}
+
+func TestLoginToken(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewFixedService(memory.New(), WithTokenIssuer(issuer))
+	id, err := s.Register("token", "password", "token@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := s.Login("token", "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := issuer.Parse(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UserID() != id || c.Username != "token" {
+		t.Errorf("Unexpected claims %+v", c)
+	}
+	if _, token, _ := NewFixedService(memory.New()).Login("token", "password", false); token != "" {
+		t.Errorf("Expected no token without an issuer, received %v", token)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := memory.New()
+	s := NewFixedService(d, WithTokenIssuer(issuer))
+	id, err := s.Register("refresh", "password", "refresh@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.CreateRefreshToken(id, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, second, err := s.Refresh(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := issuer.Parse(token); err != nil || c.UserID() != id {
+		t.Errorf("Expected access token for %v, received %+v %v", id, c, err)
+	}
+	if second == "" || second == first {
+		t.Errorf("Expected rotated refresh token, received %q", second)
+	}
+	ts, _ := d.GetRefreshTokens(id)
+	if len(ts) != 1 || ts[0].Device != "phone" {
+		t.Errorf("Expected one active token keeping its device, received %+v", ts)
+	}
+
+	// Replaying the exchanged token revokes the whole family.
+	if _, _, err := s.Refresh(first); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected replay rejected, received %v", err)
+	}
+	if _, _, err := s.Refresh(second); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected tokens revoked after replay, received %v", err)
+	}
+	if _, _, err := s.Refresh("unknown"); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected unknown token rejected, received %v", err)
+	}
+}
+
+// revokeFailingDB fails to revoke refresh tokens
+type revokeFailingDB struct {
+	*memory.Memory
+}
+
+var errRevokeFailed = errors.New("revocation failed")
+
+func (revokeFailingDB) RevokeRefreshTokens(string, ...string) error { return errRevokeFailed }
+
+func TestRefreshReplayRevocationFails(t *testing.T) {
+	issuer, _ := auth.NewIssuer(auth.HS256, []byte("secret"))
+	d := revokeFailingDB{memory.New()}
+	u := users.New()
+	u.Username = "replay"
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	s := NewFixedService(d, WithTokenIssuer(issuer))
+	first, err := s.CreateRefreshToken(u.UserID, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Refresh(first); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Refresh(first); !errors.Is(err, errRevokeFailed) {
+		t.Errorf("Expected the failed revocation returned, received %v", err)
+	}
+}
+
+func TestLoginUpgradesLegacyHash(t *testing.T) {
+	d := memory.New()
+	u := users.New()
+	u.Username = "legacy"
+	u.Password = users.LegacyHash("password", u.Salt)
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	hasher := users.NewBcryptHasher(bcrypt.MinCost)
+	s := NewFixedService(d, WithHasher(hasher))
+	if _, _, err := s.Login("legacy", "wrong", false); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected wrong password rejected, received %v", err)
+	}
+	if _, _, err := s.Login("legacy", "password", false); err != nil {
+		t.Fatal(err)
+	}
+	s.(*fixedService).background.Wait()
+	stored, _ := d.GetUserByName("legacy")
+	if !strings.HasPrefix(stored.Password, users.SchemeBcrypt) || hasher.NeedsRehash(stored.Password) {
+		t.Errorf("Expected hash upgraded to bcrypt, received %v", stored.Password)
+	}
+	if stored.Salt != "" {
+		t.Errorf("Expected the legacy salt dropped, received %v", stored.Salt)
+	}
+	if _, _, err := s.Login("legacy", "password", false); err != nil {
+		t.Errorf("Expected login with upgraded hash, received %v", err)
+	}
+}
+
+func TestRehashKeepsChangedPassword(t *testing.T) {
+	d := memory.New()
+	u := users.New()
+	u.Username = "legacy"
+	u.Password = users.LegacyHash("password", u.Salt)
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	s := NewFixedService(d, WithHasher(users.NewBcryptHasher(bcrypt.MinCost))).(*fixedService)
+	// The password changes between the login and its rehash
+	if err := d.SetUserPassword(u.UserID, "changed", ""); err != nil {
+		t.Fatal(err)
+	}
+	s.rehash(u.UserID, u.Password, "password")
+	s.background.Wait()
+	stored, _ := d.GetUserByName("legacy")
+	if stored.Password != "changed" {
+		t.Errorf("Expected the changed password kept, received %v", stored.Password)
+	}
+}
+
+func TestRegisterHashesWithBcrypt(t *testing.T) {
+	d := memory.New()
+	s := NewFixedService(d, WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	if _, err := s.Register("new", "password", "new@example.com", "first", "last", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := d.GetUserByName("new")
+	if !strings.HasPrefix(stored.Password, users.SchemeBcrypt) {
+		t.Errorf("Expected bcrypt hash, received %v", stored.Password)
+	}
+	if _, _, err := s.Login("new", "password", false); err != nil {
+		t.Errorf("Expected login, received %v", err)
+	}
+
+	// Every hash has a salt of its own, so the same password is never
+	// stored the same
+	id, err := s.Register("same", "password", "same@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	same, _ := d.GetUserByName("same")
+	if same.Password == stored.Password {
+		t.Errorf("Expected different hashes of the same password, received %v twice", same.Password)
+	}
+	if err := s.ChangePassword(id, "password", "password"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := d.GetUserByName("same"); changed.Password == same.Password {
+		t.Error("Expected a new hash at a password change")
+	}
+}
+
+func TestEventSink(t *testing.T) {
+	d := memory.New()
+	var buf bytes.Buffer
+	sink := events.NewFanout(nil, nil).Add("stdout", events.NewJSONSink(&buf))
+	s := NewFixedService(d, WithHasher(users.NewBcryptHasher(bcrypt.MinCost)), WithEventSink(sink))
+	id, err := s.Register("sunk", "password", "sunk@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete("customers", id, db.AnyVersion, "apikey:admin"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"type":"audit.delete"`) || !strings.Contains(buf.String(), `"principal":"apikey:admin"`) {
+		t.Errorf("Expected the deletion written to the sink, received %v", buf.String())
+	}
+	if len(d.AuditLog()) != 0 {
+		t.Errorf("Expected the audit log of the database bypassed, received %+v", d.AuditLog())
+	}
+}
+
+// downDB fails the reads and writes of customers as a database out of reach
+type downDB struct {
+	db.Database
+}
+
+var errNoServers = errors.New("no reachable servers")
+
+func (downDB) GetUserByName(string) (users.User, error) { return users.User{}, errNoServers }
+func (downDB) CreateUser(*users.User) error             { return errNoServers }
+
+func TestServiceErrors(t *testing.T) {
+	d := memory.New()
+	s := NewFixedService(d, WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	if _, err := s.Register("errors", "password", "errors@example.com", "first", "last", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	var ae db.AlreadyExistsError
+	if _, err := s.Register("errors", "password", "other@example.com", "first", "last", "", ""); !errors.Is(err, ErrUserExists) || !errors.As(err, &ae) || ae.Field != "username" {
+		t.Errorf("Expected ErrUserExists on the username, received %v", err)
+	}
+	var nf db.NotFoundError
+	if _, err := s.GetUser("5a0e9c4e0000000000000000"); !errors.Is(err, ErrNotFound) || !errors.As(err, &nf) || nf.Entity != "customers" {
+		t.Errorf("Expected ErrNotFound naming the customer, received %v", err)
+	}
+	if err := s.Delete("cards", "5a0e9c4e0000000000000000", db.AnyVersion, ""); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, received %v", err)
+	}
+	if _, _, err := s.Login("errors", "wrong", false); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized, received %v", err)
+	}
+
+	down := NewFixedService(downDB{d})
+	if _, _, err := down.Login("errors", "password", false); !errors.Is(err, ErrUnavailable) || !errors.Is(err, errNoServers) {
+		t.Errorf("Expected ErrUnavailable caused by the database, received %v", err)
+	}
+	if _, err := down.Register("fresh", "password", "fresh@example.com", "first", "last", "", ""); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("Expected ErrUnavailable, received %v", err)
+	}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/login", nil)
+	req.SetBasicAuth("errors", "password")
+	newTestHandler(down).ServeHTTP(rec, req)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), CodeUnavailable) || strings.Contains(rec.Body.String(), errNoServers.Error()) {
+		t.Errorf("Expected 503 without the cause, received %v: %v", rec.Code, rec.Body.String())
+	}
+}
+
+func TestPostUserAttributes(t *testing.T) {
+	d := memory.New()
+	s := NewFixedService(d, WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	u := users.User{FirstName: "first", LastName: "last", Username: "nested", Password: "password", Email: "nested@example.com",
+		Addresses: []users.Address{{Street: "High Street", City: "London", Country: "GB"}},
+		Cards:     []users.Card{{LongNum: "4111111111111111", Expires: "12/30"}, {LongNum: "4111"}},
+	}
+	_, err := s.PostUser(u)
+	if fe, ok := err.(users.FieldErrors); !ok || len(fe) != 1 || fe[0].Field != "cards[1].longNum" {
+		t.Fatalf("Expected the second card refused, received %v", err)
+	}
+	if us, _ := d.GetUsers(); len(us) != 0 {
+		t.Errorf("Expected nothing stored, received %+v", us)
+	}
+	if as, _ := d.GetAddresses(); len(as) != 0 {
+		t.Errorf("Expected no address stored, received %+v", as)
+	}
+
+	u.Cards = u.Cards[:1]
+	created, err := s.PostUser(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := s.GetUser(created.UserID)
+	if err != nil || len(stored.Addresses) != 1 || stored.Addresses[0].ID != created.Addresses[0].ID || len(stored.Cards) != 1 || stored.Cards[0].ID != created.Cards[0].ID {
+		t.Errorf("Expected the ids of the attributes returned, received %+v and %+v %v", created, stored, err)
+	}
+
+	rec := httptest.NewRecorder()
+	newTestHandler(s).ServeHTTP(rec, httptest.NewRequest("POST", "/customers", strings.NewReader(`{"username": "posted", "password": "password", "email": "posted@example.com", "firstName": "first", "lastName": "last", "addresses": [{"street": "High Street", "city": "London", "country": "GB"}], "cards": [{"longNum": "4111111111111111"}, {"longNum": "5555555555554444"}]}`)))
+	var resp postResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK || resp.ID == "" || len(resp.Addresses) != 1 || len(resp.Cards) != 2 {
+		t.Errorf("Expected the ids of the customer, its address and cards, received %v %+v %v", rec.Code, resp, err)
+	}
+}
+
+// countingDB counts the queries a login makes: reading the attributes
+// queries the addresses and the cards
+type countingDB struct {
+	*memory.Memory
+	queries int
+}
+
+func (d *countingDB) GetUserByName(name string) (users.User, error) {
+	d.queries++
+	return d.Memory.GetUserByName(name)
+}
+
+func (d *countingDB) GetUserAttributes(u *users.User) error {
+	d.queries += 2
+	return d.Memory.GetUserAttributes(u)
+}
+
+func (d *countingDB) GetUserByNameWithAttributes(name string) (users.User, error) {
+	d.queries++
+	return d.Memory.GetUserByNameWithAttributes(name)
+}
+
+// unjoinedDB is a countingDB unable to join the attributes of a user
+type unjoinedDB struct {
+	db.Database
+}
+
+func TestLoginAttributes(t *testing.T) {
+	d := &countingDB{Memory: memory.New()}
+	s := NewFixedService(d)
+	id, err := s.Register("attributes", "password", "attributes@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PostAddress(users.Address{Street: "street", City: "city"}, id, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.PostCard(users.Card{LongNum: "4111111111111111", Expires: "12/30"}, id, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		name       string
+		s          Service
+		attributes bool
+		queries    int
+	}{
+		{"bare", s, false, 1},
+		{"joined", s, true, 1},
+		{"unjoined", NewFixedService(unjoinedDB{d}), true, 3},
+	} {
+		d.queries = 0
+		u, _, err := tt.s.Login("attributes", "password", tt.attributes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.queries != tt.queries {
+			t.Errorf("%v: expected %v queries, received %v", tt.name, tt.queries, d.queries)
+		}
+		if loaded := len(u.Addresses) == 1 && u.Addresses[0].Street == "street" && len(u.Cards) == 1 && u.Cards[0].Default; loaded != tt.attributes {
+			t.Errorf("%v: expected the attributes loaded %v, received %+v", tt.name, tt.attributes, u)
+		}
+		if !tt.attributes && (len(u.Addresses) != 0 || len(u.Cards) != 0) {
+			t.Errorf("%v: expected the bare user, received %+v", tt.name, u)
+		}
+	}
+
+	for query, embedded := range map[string]bool{"": false, "?include=attributes": true} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/login"+query, nil)
+		req.SetBasicAuth("attributes", "password")
+		newTestHandler(s).ServeHTTP(rec, req)
+		var resp struct {
+			Embedded *struct {
+				Addresses []users.Address `json:"address"`
+				Cards     []users.Card    `json:"card"`
+			} `json:"_embedded"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("Expected a login, received %v %v", rec.Code, err)
+		}
+		if (resp.Embedded != nil && len(resp.Embedded.Addresses) == 1 && len(resp.Embedded.Cards) == 1) != embedded {
+			t.Errorf("%q: expected the attributes embedded %v, received %+v", query, embedded, resp.Embedded)
+		}
+	}
+}
+
+// racingDB is a database whose skeleton lookups miss the users created
+// since, as those of registrations made at once
+type racingDB struct {
+	*memory.Memory
+}
+
+func (racingDB) GetUserBySkeleton(string) (users.User, error) {
+	return users.New(), db.ErrNotFound
+}
+
+func TestRegisterConfusableRace(t *testing.T) {
+	m := memory.New()
+	m.SetUniqueSkeletons(true)
+	s := NewFixedService(racingDB{m}, WithConfusableUsernames())
+	if _, err := s.Register("admin", "password", "admin@example.com", "first", "last", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err := s.Register("аdmin", "password", "cyrillic@example.com", "first", "last", "", "")
+	var fe users.FieldErrors
+	if !errors.As(err, &fe) || fe[0].Field != "username" {
+		t.Errorf("Expected the confusable name refused by the database, received %v", err)
+	}
+}
+
+func TestSetRoles(t *testing.T) {
+	d := memory.New()
+	s := NewFixedService(d)
+	id, err := s.Register("roles", "password", "roles@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetRoles("000000000000000000000000", []string{users.RoleCustomer}, ""); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected an unknown user not found, received %v", err)
+	}
+	version := func() int64 {
+		u, _ := d.GetUser(id)
+		return u.CredentialsVersion
+	}
+	if _, err := s.SetRoles(id, []string{users.RoleCustomer, users.RoleAdmin}, ""); err != nil {
+		t.Fatal(err)
+	}
+	granted := version()
+	if _, err := s.SetRoles(id, []string{users.RoleCustomer}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if version() == granted {
+		t.Error("Expected the sessions ended when a role is removed")
 	}
 }
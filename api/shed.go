@@ -0,0 +1,156 @@
+package api
+
+// shed.go caps the requests served at once, so a slow database makes
+// requests wait briefly and then fail fast instead of piling up until the
+// service runs out of memory.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"golang.org/x/sync/semaphore"
+	"google.golang.org/grpc"
+)
+
+// Classes of requests limited apart by the LoadShedder
+const (
+	// ClassRead are GET and HEAD requests
+	ClassRead = "read"
+	// ClassWrite are requests changing data, other than credential checks
+	ClassWrite = "write"
+	// ClassLogin are credential checks: logins, token refreshes, password
+	// changes and second factor confirmations
+	ClassLogin = "login"
+)
+
+// OverloadedError answers requests shed because too many of their class
+// were being served for them to get a turn in time.
+type OverloadedError struct {
+	RetryAfter time.Duration
+}
+
+func (e OverloadedError) Error() string {
+	return fmt.Sprintf("Service overloaded, retry after %v", e.RetryAfter)
+}
+
+// LoadShedder serves a limited number of requests of each class at once.
+// Requests beyond the limit wait for a turn up to the queue timeout and are
+// then refused with OverloadedError. Health checks and metrics are never
+// limited.
+type LoadShedder struct {
+	slots    map[string]*semaphore.Weighted
+	wait     time.Duration
+	inflight metrics.Gauge
+}
+
+// NewLoadShedder returns a LoadShedder serving at most limits[class]
+// requests of each class at once, letting others wait up to wait for a
+// turn. Classes without a positive limit are not limited. The requests being
+// served are reported in inflight, by class.
+func NewLoadShedder(limits map[string]int64, wait time.Duration, inflight metrics.Gauge) *LoadShedder {
+	if inflight == nil {
+		inflight = discard.NewGauge()
+	}
+	l := &LoadShedder{slots: make(map[string]*semaphore.Weighted), wait: wait, inflight: inflight}
+	for class, limit := range limits {
+		if limit > 0 {
+			l.slots[class] = semaphore.NewWeighted(limit)
+		}
+	}
+	return l
+}
+
+// acquire takes a turn for a request of class, returning the function
+// ending it
+func (l *LoadShedder) acquire(ctx context.Context, class string) (func(), error) {
+	gauge := l.inflight.With("class", class)
+	slots, ok := l.slots[class]
+	if ok && !l.take(ctx, slots) {
+		return nil, OverloadedError{RetryAfter: l.retryAfter()}
+	}
+	gauge.Add(1)
+	return func() {
+		gauge.Add(-1)
+		if ok {
+			slots.Release(1)
+		}
+	}, nil
+}
+
+// take takes one of slots, waiting up to the queue timeout, or not at all
+// without one
+func (l *LoadShedder) take(ctx context.Context, slots *semaphore.Weighted) bool {
+	if l.wait <= 0 {
+		return slots.TryAcquire(1)
+	}
+	ctx, cancel := context.WithTimeout(ctx, l.wait)
+	defer cancel()
+	return slots.Acquire(ctx, 1) == nil
+}
+
+// retryAfter is how long shed clients are told to wait, at least a second
+func (l *LoadShedder) retryAfter() time.Duration {
+	if l.wait < time.Second {
+		return time.Second
+	}
+	return l.wait
+}
+
+// Middleware limits the HTTP requests it serves
+func (l *LoadShedder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if probePath(r.URL.Path) || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		done, err := l.acquire(r.Context(), requestClass(r.Method, r.URL.Path))
+		if err != nil {
+			encodeError(r.Context(), err, w)
+			return
+		}
+		defer done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UnaryInterceptor limits the gRPC calls it serves
+func (l *LoadShedder) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+		var class string
+		switch method {
+		case "Health":
+			return handler(ctx, req)
+		case "Login":
+			class = ClassLogin
+		case "GetUser", "GetUsers":
+			class = ClassRead
+		default:
+			class = ClassWrite
+		}
+		done, err := l.acquire(ctx, class)
+		if err != nil {
+			return nil, grpcError(ctx, err)
+		}
+		defer done()
+		return handler(ctx, req)
+	}
+}
+
+// requestClass returns the class of an HTTP request
+func requestClass(method, path string) string {
+	switch {
+	case path == "/login", path == "/login/mfa", path == "/token/refresh",
+		strings.HasSuffix(path, "/password") && method == "POST",
+		strings.HasSuffix(path, "/mfa/confirm"), strings.HasSuffix(path, "/mfa/disable"):
+		return ClassLogin
+	case method == "GET", method == "HEAD":
+		return ClassRead
+	}
+	return ClassWrite
+}
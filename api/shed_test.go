@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLoadShedder(t *testing.T) {
+	l := NewLoadShedder(map[string]int64{ClassRead: 1, ClassLogin: 1}, 20*time.Millisecond, nil)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	h := l.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Block") != "" {
+			started <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(method, path string, block bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if block {
+			req.Header.Set("X-Block", "1")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// A read holds the only read slot
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serve("GET", "/customers", true)
+	}()
+	<-started
+
+	rec := serve("GET", "/cards", false)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a second read shed with 503, received %v", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Expected Retry-After 1, received %q", got)
+	}
+	var body ErrorBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != CodeOverloaded {
+		t.Errorf("Expected code %v, received %v", CodeOverloaded, body.Error.Code)
+	}
+
+	// Other classes, unlimited ones and health checks are still served
+	for _, tc := range []struct{ method, path string }{
+		{"GET", "/login"},
+		{"POST", "/customers"},
+		{"DELETE", "/cards/1"},
+		{"GET", "/health"},
+		{"GET", "/health/ready"},
+		{"GET", "/live"},
+		{"GET", "/ready"},
+		{"GET", "/metrics"},
+	} {
+		if rec := serve(tc.method, tc.path, false); rec.Code != http.StatusOK {
+			t.Errorf("Expected %v %v served, received %v", tc.method, tc.path, rec.Code)
+		}
+	}
+
+	// A queued read is served once the slot frees within the wait
+	l.wait = time.Second
+	done := make(chan int)
+	go func() { done <- serve("GET", "/addresses", false).Code }()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Errorf("Expected a queued read served, received %v", code)
+	}
+	wg.Wait()
+}
+
+func TestLoadShedderWithoutQueue(t *testing.T) {
+	l := NewLoadShedder(map[string]int64{ClassRead: 1}, 0, nil)
+	done, err := l.acquire(context.Background(), ClassRead)
+	if err != nil {
+		t.Fatalf("Expected a free slot taken without a queue timeout, received %v", err)
+	}
+	if _, err := l.acquire(context.Background(), ClassRead); err == nil {
+		t.Error("Expected a busy slot refused at once")
+	}
+	done()
+	if _, err := l.acquire(context.Background(), ClassRead); err != nil {
+		t.Errorf("Expected the released slot taken, received %v", err)
+	}
+}
+
+func TestRequestClass(t *testing.T) {
+	for _, tc := range []struct{ method, path, class string }{
+		{"GET", "/login", ClassLogin},
+		{"POST", "/login/mfa", ClassLogin},
+		{"POST", "/token/refresh", ClassLogin},
+		{"POST", "/customers/1/password", ClassLogin},
+		{"GET", "/customers/1/password", ClassRead},
+		{"POST", "/customers/1/mfa/confirm", ClassLogin},
+		{"POST", "/customers/1/mfa/disable", ClassLogin},
+		{"POST", "/customers/1/mfa", ClassWrite},
+		{"GET", "/customers/1", ClassRead},
+		{"HEAD", "/cards", ClassRead},
+		{"POST", "/register", ClassWrite},
+		{"PATCH", "/customers/1", ClassWrite},
+		{"DELETE", "/addresses/1", ClassWrite},
+	} {
+		if got := requestClass(tc.method, tc.path); got != tc.class {
+			t.Errorf("Expected %v %v in class %v, received %v", tc.method, tc.path, tc.class, got)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package api
+
+// shutdown.go contains the draining of the HTTP servers on shutdown: the
+// readiness check fails at once so load balancers stop routing, in-flight
+// requests get until a deadline to finish, and those that do not are
+// answered 503 rather than having their connection reset.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrShuttingDown answers readiness checks while the service drains and
+// requests still running when the drain deadline passes
+var ErrShuttingDown = errors.New("Service shutting down")
+
+// expiredGrace is the time given to answer expired requests with 503 after
+// the drain deadline
+const expiredGrace = time.Second
+
+// Drainer tracks the shutdown of the service. Its Middleware must wrap the
+// handlers of every server it shuts down.
+type Drainer struct {
+	draining atomic.Bool
+	expired  chan struct{}
+	once     sync.Once
+}
+
+// NewDrainer returns a Drainer of a running service
+func NewDrainer() *Drainer {
+	return &Drainer{expired: make(chan struct{})}
+}
+
+// Drain makes readiness checks fail from now on
+func (d *Drainer) Drain() {
+	d.draining.Store(true)
+}
+
+// Draining reports whether the service is shutting down
+func (d *Drainer) Draining() bool {
+	return d.draining.Load()
+}
+
+// Expire answers every request still running with 503, unless it already
+// started its response
+func (d *Drainer) Expire() {
+	d.once.Do(func() { close(d.expired) })
+}
+
+// Shutdown drains servers: it fails readiness, stops accepting connections
+// and waits up to timeout for in-flight requests, then answers those still
+// running with 503.
+func (d *Drainer) Shutdown(timeout time.Duration, servers ...*http.Server) error {
+	d.Drain()
+	errc := make(chan error, len(servers))
+	for _, s := range servers {
+		go func(s *http.Server) {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			err := s.Shutdown(ctx)
+			if err == context.DeadlineExceeded {
+				d.Expire()
+				ctx, cancel := context.WithTimeout(context.Background(), expiredGrace)
+				defer cancel()
+				err = s.Shutdown(ctx)
+			}
+			errc <- err
+		}(s)
+	}
+	var err error
+	for range servers {
+		if e := <-errc; e != nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Middleware fails readiness checks while draining and lets Expire answer
+// the requests it serves.
+func (d *Drainer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if d.Draining() && probePath(r.URL.Path) {
+			w.Header().Set("Connection", "close")
+			encodeError(r.Context(), ErrShuttingDown, w)
+			return
+		}
+		dw := &drainWriter{w: w, h: make(http.Header)}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(dw, r)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case p := <-panicked:
+			panic(p)
+		case <-d.expired:
+			dw.expire(r.Context())
+		}
+	})
+}
+
+// drainWriter passes a response through unless the request expired before
+// the response started. The handler gets a header map of its own, so an
+// expiry never races with it.
+type drainWriter struct {
+	w http.ResponseWriter
+	h http.Header
+
+	mu      sync.Mutex
+	wrote   bool
+	expired bool
+}
+
+func (dw *drainWriter) Header() http.Header {
+	return dw.h
+}
+
+func (dw *drainWriter) WriteHeader(code int) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.expired || dw.wrote {
+		return
+	}
+	dw.start()
+	dw.w.WriteHeader(code)
+}
+
+func (dw *drainWriter) Write(b []byte) (int, error) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.expired {
+		return 0, http.ErrHandlerTimeout
+	}
+	if !dw.wrote {
+		dw.start()
+	}
+	return dw.w.Write(b)
+}
+
+// Flush lets streaming responses through
+func (dw *drainWriter) Flush() {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if f, ok := dw.w.(http.Flusher); ok && !dw.expired {
+		if !dw.wrote {
+			dw.start()
+		}
+		f.Flush()
+	}
+}
+
+func (dw *drainWriter) start() {
+	dw.wrote = true
+	for k, v := range dw.h {
+		dw.w.Header()[k] = v
+	}
+}
+
+func (dw *drainWriter) expire(ctx context.Context) {
+	dw.mu.Lock()
+	defer dw.mu.Unlock()
+	if dw.wrote {
+		return
+	}
+	dw.expired = true
+	dw.w.Header().Set("Connection", "close")
+	encodeError(ctx, ErrShuttingDown, dw.w)
+}
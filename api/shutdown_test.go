@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestDrainerShutdown(t *testing.T) {
+	d := NewDrainer()
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	defer close(release)
+	ts := httptest.NewServer(d.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		switch r.URL.Path {
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/stuck":
+			<-release
+		}
+		w.Write([]byte("done"))
+	})))
+	defer ts.Close()
+
+	type result struct {
+		code int
+		body ErrorBody
+		err  error
+	}
+	get := func(path string) <-chan result {
+		c := make(chan result, 1)
+		go func() {
+			resp, err := http.Get(ts.URL + path)
+			if err != nil {
+				c <- result{err: err}
+				return
+			}
+			defer resp.Body.Close()
+			r := result{code: resp.StatusCode}
+			json.NewDecoder(resp.Body).Decode(&r.body)
+			c <- r
+		}()
+		return c
+	}
+	slow, stuck := get("/slow"), get("/stuck")
+	<-started
+	<-started
+
+	begin := time.Now()
+	if err := d.Shutdown(300*time.Millisecond, ts.Config); err != nil {
+		t.Errorf("Expected shutdown after answering expired requests, received %v", err)
+	}
+	if took := time.Since(begin); took > 2*time.Second {
+		t.Errorf("Expected shutdown bounded by its timeout, took %v", took)
+	}
+	if r := <-slow; r.err != nil || r.code != http.StatusOK {
+		t.Errorf("Expected slow request drained, received %v %v", r.code, r.err)
+	}
+	if r := <-stuck; r.err != nil || r.code != http.StatusServiceUnavailable || r.body.Error.Code != CodeShuttingDown {
+		t.Errorf("Expected 503 for request over the deadline, received %v %+v %v", r.code, r.body.Error, r.err)
+	}
+}
+
+func TestDrainerReadiness(t *testing.T) {
+	d := NewDrainer()
+	h := d.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected ready, received %v", rec.Code)
+	}
+	d.Drain()
+	for _, path := range []string{"/health", "/health/ready", "/live", "/ready"} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		if rec.Code != http.StatusServiceUnavailable {
+			t.Errorf("%v: expected 503 while draining, received %v", path, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/customers", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected requests still served while draining, received %v", rec.Code)
+	}
+}
@@ -0,0 +1,34 @@
+package api
+
+// slow.go reports the requests taking longer than a threshold.
+
+import (
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+)
+
+// WithSlowRequests logs requests taking longer than threshold as warnings,
+// with their redacted request, and counts them in counter, labelled by layer
+// and operation, the method of the endpoint. A zero threshold disables it.
+func WithSlowRequests(threshold time.Duration, counter metrics.Counter) EndpointsOption {
+	return func(cfg *endpointsConfig) {
+		cfg.slow = threshold
+		cfg.slowCounter = counter
+	}
+}
+
+// reportSlow reports a request to method that took took, if past the slow
+// threshold of cfg
+func reportSlow(cfg endpointsConfig, logger log.Logger, method, traceid string, request interface{}, took time.Duration) {
+	if cfg.slow <= 0 || took <= cfg.slow {
+		return
+	}
+	if cfg.slowCounter != nil {
+		cfg.slowCounter.With("layer", "endpoint", "operation", method).Add(1)
+	}
+	level.Warn(logger).Log("msg", "slow operation", "layer", "endpoint", "operation", method,
+		"took", took, "threshold", cfg.slow, "traceid", traceid, "request", dump{request})
+}
@@ -0,0 +1,55 @@
+package api
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+type slowService struct {
+	Service
+}
+
+func (s slowService) ListUsers(params ListParams) ([]users.User, Page, error) {
+	time.Sleep(5 * time.Millisecond)
+	return s.Service.ListUsers(params)
+}
+
+func TestSlowRequests(t *testing.T) {
+	var buf bytes.Buffer
+	counter := stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "slow"}, []string{"layer", "operation"})
+	tracer := noop.NewTracerProvider().Tracer("")
+	logger := NewLevelLogger(log.NewLogfmtLogger(&buf), LevelWarn)
+	e := MakeEndpoints(slowService{NewFixedService(memory.New())}, tracer, logger, nil,
+		WithSlowRequests(time.Millisecond, kitprometheus.NewCounter(counter)))
+	h := MakeHTTPHandler(e, log.NewNopLogger())
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/customers", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/addresses", nil))
+
+	if got := testutil.ToFloat64(counter.WithLabelValues("endpoint", methodGetUsers)); got != 1 {
+		t.Errorf("Expected the slow request counted, counted %v", got)
+	}
+	if got := testutil.CollectAndCount(counter); got != 1 {
+		t.Errorf("Expected only the slow request counted, counted %v series", got)
+	}
+	logged := buf.String()
+	for _, want := range []string{"level=warn", `msg="slow operation"`, "operation=" + methodGetUsers, "request="} {
+		if !strings.Contains(logged, want) {
+			t.Errorf("Expected %q logged, received %v", want, logged)
+		}
+	}
+	if strings.Contains(logged, methodGetAddresses) {
+		t.Errorf("Expected fast requests not logged, received %v", logged)
+	}
+}
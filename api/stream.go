@@ -0,0 +1,91 @@
+package api
+
+// stream.go encodes full listings as newline delimited JSON for clients
+// asking for it: one entity per line, written as it is read from the
+// database, so neither side holds the whole listing in memory.
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/microservices-demo/user/db/fallback"
+)
+
+const (
+	// ContentTypeNDJSON is the media type of streamed listings
+	ContentTypeNDJSON = "application/x-ndjson"
+	// StreamErrorTrailer carries the error code of a stream that failed
+	// after its status was sent
+	StreamErrorTrailer = "X-Stream-Error"
+)
+
+// streamFlushLines is how many lines are written between flushes
+const streamFlushLines = 100
+
+// streamResponse is a listing encoded as it is read. each calls fn with
+// every entity in turn, stopping at the first error fn returns.
+type streamResponse struct {
+	each func(fn func(interface{}) error) error
+}
+
+// acceptsNDJSON reports whether the Accept header of r asks for a stream
+func acceptsNDJSON(r *http.Request) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(strings.TrimSpace(v)); err == nil && t == ContentTypeNDJSON {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeStream writes the entities of sr one per line, flushing every
+// streamFlushLines lines. The status is sent with the first line, so a
+// listing failing before it is answered with its error status as usual. A
+// later failure ends the stream with a line holding the error envelope and
+// sets the StreamErrorTrailer to its code.
+func encodeStream(ctx context.Context, w http.ResponseWriter, sr streamResponse) error {
+	w.Header().Set("Content-Type", ContentTypeNDJSON)
+	w.Header().Set("Trailer", StreamErrorTrailer)
+	if fallback.IsStale(ctx) {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	started := false
+	n := 0
+	err := sr.each(func(v interface{}) error {
+		started = true
+		if err := enc.Encode(withLinks(ctx, v)); err != nil {
+			return err
+		}
+		if n++; n%streamFlushLines == 0 && flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+	if !started {
+		w.Header().Del("Trailer")
+		encodeError(ctx, err, w)
+		return nil
+	}
+	// The status is sent: the error can only be told in the body and the
+	// trailer
+	code := errorStatus(err)
+	enc.Encode(newErrorBody(ctx, err, code))
+	c, _ := errorDetails(err)
+	w.Header().Set(StreamErrorTrailer, c)
+	return nil
+}
+
+// streamOf returns the streamResponse of a listing of T
+func streamOf[T any](list func(func(T) error) error) streamResponse {
+	return streamResponse{each: func(fn func(interface{}) error) error {
+		return list(func(v T) error { return fn(v) })
+	}}
+}
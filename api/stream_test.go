@@ -0,0 +1,104 @@
+package api
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+)
+
+// brokenStream fails a listing of users after the given number of users
+type brokenStream struct {
+	Service
+	after int
+}
+
+func (b brokenStream) StreamUsers(sort db.Sort, fn func(users.User) error) error {
+	n := 0
+	return b.Service.StreamUsers(sort, func(u users.User) error {
+		if n == b.after {
+			return errors.New("cursor lost")
+		}
+		n++
+		return fn(u)
+	})
+}
+
+func TestStream(t *testing.T) {
+	s := NewFixedService(memory.New())
+	for _, name := range []string{"stream1", "stream2", "stream3"} {
+		id, err := s.Register(name, "password", name+"@example.com", "first", "last", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.PostCard(users.Card{LongNum: "4111111111111111", Expires: "12/30", CCV: "123"}, id, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(h http.Handler, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Accept", "application/x-ndjson")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	lines := func(rec *httptest.ResponseRecorder) []map[string]interface{} {
+		var ls []map[string]interface{}
+		sc := bufio.NewScanner(rec.Body)
+		for sc.Scan() {
+			var l map[string]interface{}
+			if err := json.Unmarshal(sc.Bytes(), &l); err != nil {
+				t.Fatalf("Expected a JSON object per line, received %q", sc.Text())
+			}
+			ls = append(ls, l)
+		}
+		return ls
+	}
+
+	rec := get(newTestHandler(s), "/customers?sort=-username")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != ContentTypeNDJSON {
+		t.Fatalf("Expected an NDJSON stream, received %v %v", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	ls := lines(rec)
+	if len(ls) != 3 || ls[0]["username"] != "stream3" || ls[2]["username"] != "stream1" {
+		t.Fatalf("Expected the sorted customers, received %v", ls)
+	}
+	if ls[0]["_links"] == nil {
+		t.Error("Expected links on streamed customers")
+	}
+
+	ls = lines(get(newTestHandler(s), "/cards"))
+	if len(ls) != 3 || ls[0]["longNum"] != "************1111" {
+		t.Errorf("Expected three masked cards, received %v", ls)
+	}
+
+	if rec := get(newTestHandler(s), "/customers?size=2"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a paginated stream, received %v", rec.Code)
+	}
+
+	rec = get(newTestHandler(brokenStream{Service: s, after: 0}), "/customers")
+	if rec.Code != http.StatusInternalServerError || rec.Header().Get("Content-Type") != "application/hal+json" {
+		t.Errorf("Expected an error envelope for a stream failing at once, received %v %v", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	rec = get(newTestHandler(brokenStream{Service: s, after: 2}), "/customers")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for a stream failing midway, received %v", rec.Code)
+	}
+	ls = lines(rec)
+	if len(ls) != 3 {
+		t.Fatalf("Expected two customers and an error line, received %v", ls)
+	}
+	if e, ok := ls[2]["error"].(map[string]interface{}); !ok || e["code"] != CodeInternal {
+		t.Errorf("Expected an error line, received %v", ls[2])
+	}
+	if got := rec.Result().Trailer.Get(StreamErrorTrailer); got != CodeInternal {
+		t.Errorf("Expected %v trailer %v, received %q", StreamErrorTrailer, CodeInternal, got)
+	}
+}
@@ -0,0 +1,160 @@
+package api
+
+// tenant.go routes requests to the tenant named by their X-Tenant-ID
+// header. Each tenant is served by endpoints of its own, over a database of
+// its own, so nothing stored for one tenant can be reached by another.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc/metadata"
+)
+
+// TenantHeader names the tenant of a request
+const TenantHeader = "X-Tenant-ID"
+
+// ErrUnknownTenant answers a request naming a tenant not on the allowlist
+var ErrUnknownTenant = errors.New("Unknown tenant")
+
+// tenantName is what tenant names are made of. They become part of database
+// names, so are kept short and plain.
+var tenantName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,31}$`)
+
+type tenantKey struct{}
+
+// NewTenantContext returns a context carrying the tenant of the request
+func NewTenantContext(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant stored in ctx, if any
+func TenantFromContext(ctx context.Context) (string, bool) {
+	t, ok := ctx.Value(tenantKey{}).(string)
+	return t, ok && t != ""
+}
+
+// Tenants serves each tenant of an allowlist with endpoints of its own,
+// made by open on the first request of the tenant. Requests naming no
+// tenant are served by the default endpoints, as without tenants.
+type Tenants struct {
+	allowed   map[string]bool
+	def       Endpoints
+	open      func(tenant string) (Endpoints, error)
+	opening   singleflight.Group
+	mu        sync.Mutex
+	endpoints map[string]Endpoints
+}
+
+// NewTenants returns the tenants of allowed, served by the endpoints open
+// makes for them. It fails on names that are not lowercase letters, digits,
+// '-' and '_', of at most 32 characters.
+func NewTenants(allowed []string, def Endpoints, open func(tenant string) (Endpoints, error)) (*Tenants, error) {
+	t := &Tenants{
+		allowed:   make(map[string]bool),
+		def:       def,
+		open:      open,
+		endpoints: make(map[string]Endpoints),
+	}
+	for _, name := range allowed {
+		if !tenantName.MatchString(name) {
+			return nil, fmt.Errorf("invalid tenant name %q", name)
+		}
+		t.allowed[name] = true
+	}
+	return t, nil
+}
+
+// Middleware resolves the tenant of HTTP requests, refusing those naming a
+// tenant not on the allowlist.
+func (t *Tenants) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant := r.Header.Get(TenantHeader)
+		if tenant == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !t.allowed[tenant] {
+			encodeError(r.Context(), ErrUnknownTenant, w)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewTenantContext(r.Context(), tenant)))
+	})
+}
+
+// Endpoints returns endpoints passing each request on to the same endpoint
+// of its tenant. Every endpoint is passed on, so one added to Endpoints can
+// never reach the default database from a tenant's request.
+func (t *Tenants) Endpoints() Endpoints {
+	var e Endpoints
+	v := reflect.ValueOf(&e).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		i := i
+		v.Field(i).Set(reflect.ValueOf(endpoint.Endpoint(func(ctx context.Context, request interface{}) (interface{}, error) {
+			te, err := t.of(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return reflect.ValueOf(te).Field(i).Interface().(endpoint.Endpoint)(ctx, request)
+		})))
+	}
+	return e
+}
+
+// of returns the endpoints of the tenant of ctx, opening them on its first
+// request. Requests arriving while a tenant is opened wait for that open,
+// without holding up the requests of other tenants. A failed open is retried
+// by the next request.
+func (t *Tenants) of(ctx context.Context) (Endpoints, error) {
+	tenant, ok := TenantFromContext(ctx)
+	if !ok {
+		return t.def, nil
+	}
+	if !t.allowed[tenant] {
+		return Endpoints{}, ErrUnknownTenant
+	}
+	if e, ok := t.opened(tenant); ok {
+		return e, nil
+	}
+	e, err, _ := t.opening.Do(tenant, func() (interface{}, error) {
+		if e, ok := t.opened(tenant); ok {
+			return e, nil
+		}
+		e, err := t.open(tenant)
+		if err != nil {
+			return nil, err
+		}
+		t.mu.Lock()
+		t.endpoints[tenant] = e
+		t.mu.Unlock()
+		return e, nil
+	})
+	if err != nil {
+		return Endpoints{}, err
+	}
+	return e.(Endpoints), nil
+}
+
+// opened returns the endpoints of the tenant, if they were opened
+func (t *Tenants) opened(tenant string) (Endpoints, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e, ok := t.endpoints[tenant]
+	return e, ok
+}
+
+// tenantFromMetadata does for calls what Tenants.Middleware does for HTTP
+// requests. Unknown tenants are refused by the endpoints.
+func tenantFromMetadata(ctx context.Context, md metadata.MD) context.Context {
+	if tenant := firstMetadata(md, "x-tenant-id"); tenant != "" {
+		return NewTenantContext(ctx, tenant)
+	}
+	return ctx
+}
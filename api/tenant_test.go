@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+func TestTenants(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := noop.NewTracerProvider().Tracer("")
+	newEndpoints := func(store db.Database, iss *auth.Issuer) Endpoints {
+		return MakeEndpoints(NewFixedService(store, WithTokenIssuer(iss)), tracer, log.NewNopLogger(), iss)
+	}
+	base := memory.New()
+	opened := map[string]int{}
+	tenants, err := NewTenants([]string{"a", "b"}, newEndpoints(base, issuer), func(tenant string) (Endpoints, error) {
+		opened[tenant]++
+		store, err := base.ForTenant(tenant)
+		if err != nil {
+			return Endpoints{}, err
+		}
+		return newEndpoints(store, issuer.ForTenant(tenant)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := tenants.Middleware(MakeHTTPHandler(tenants.Endpoints(), log.NewNopLogger()))
+
+	do := func(tenant, method, path, token, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if tenant != "" {
+			req.Header.Set(TenantHeader, tenant)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	register := func(tenant string) string {
+		t.Helper()
+		rec := do(tenant, "POST", "/register", "", `{"username": "same", "password": "password", "email": "same@example.com", "firstName": "first", "lastName": "last"}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected 200 registering under %q, received %v: %v", tenant, rec.Code, rec.Body.String())
+		}
+		var resp struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.ID
+	}
+
+	// The same username registers in every tenant, each keeping its own
+	idA, idB, idDefault := register("a"), register("b"), register("")
+	for _, tc := range []struct {
+		tenant, id string
+		code       int
+	}{
+		{"a", idA, http.StatusOK},
+		{"b", idA, http.StatusNotFound},
+		{"", idA, http.StatusNotFound},
+		{"b", idB, http.StatusOK},
+		{"a", idB, http.StatusNotFound},
+		{"", idDefault, http.StatusOK},
+		{"a", idDefault, http.StatusNotFound},
+	} {
+		if rec := do(tc.tenant, "GET", "/customers/"+tc.id, "", ""); rec.Code != tc.code {
+			t.Errorf("Expected %v getting %v under %q, received %v", tc.code, tc.id, tc.tenant, rec.Code)
+		}
+	}
+	var list EmbedStruct
+	rec := do("b", "GET", "/customers", "", "")
+	if err := json.NewDecoder(rec.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if us := list.Embed.(map[string]interface{})["customer"].([]interface{}); len(us) != 1 {
+		t.Errorf("Expected the one customer of tenant b, received %v", us)
+	}
+
+	// Tokens are honoured by their own tenant only
+	tokenA, _ := issuer.ForTenant("a").Issue(idA, "same", auth.RoleAdmin)
+	if rec := do("b", "DELETE", "/customers/"+idB, tokenA, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a token of tenant a refused by tenant b, received %v", rec.Code)
+	}
+	if rec := do("", "DELETE", "/customers/"+idDefault, tokenA, ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a token of tenant a refused without a tenant, received %v", rec.Code)
+	}
+	if rec := do("a", "DELETE", "/customers/"+idA, tokenA, ""); rec.Code != http.StatusOK {
+		t.Errorf("Expected a token of tenant a honoured by it, received %v: %v", rec.Code, rec.Body.String())
+	}
+
+	rec = do("c", "GET", "/customers", "", "")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown tenant, received %v", rec.Code)
+	}
+	var body ErrorBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error.Code != CodeUnknownTenant {
+		t.Errorf("Expected code %v, received %v", CodeUnknownTenant, body.Error.Code)
+	}
+	if _, err := tenants.Endpoints().UserGetEndpoint(NewTenantContext(context.Background(), "c"), GetRequest{}); err != ErrUnknownTenant {
+		t.Errorf("Expected an unknown tenant refused by the endpoints, received %v", err)
+	}
+
+	if opened["a"] != 1 || opened["b"] != 1 {
+		t.Errorf("Expected each tenant opened once, received %v", opened)
+	}
+
+	if _, err := NewTenants([]string{"a/b"}, Endpoints{}, nil); err == nil {
+		t.Error("Expected an invalid tenant name refused")
+	}
+}
+
+func TestTenantsOpenConcurrently(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	opened := map[string]int{}
+	tenants, err := NewTenants([]string{"slow", "fast"}, Endpoints{}, func(tenant string) (Endpoints, error) {
+		mu.Lock()
+		opened[tenant]++
+		mu.Unlock()
+		if tenant == "slow" {
+			<-release
+		}
+		return Endpoints{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for k := 0; k < 10; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := tenants.of(NewTenantContext(context.Background(), "slow")); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// A tenant opening slowly keeps no other tenant waiting
+	done := make(chan error)
+	go func() {
+		_, err := tenants.of(NewTenantContext(context.Background(), "fast"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a tenant opened while another is")
+	}
+	close(release)
+	wg.Wait()
+	if opened["slow"] != 1 || opened["fast"] != 1 {
+		t.Errorf("Expected each tenant opened once, received %v", opened)
+	}
+}
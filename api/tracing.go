@@ -0,0 +1,162 @@
+package api
+
+// tracing.go contains the OpenTelemetry tracing of the endpoints: the trace
+// of a request is joined from its W3C traceparent header, or gRPC metadata,
+// and each endpoint serves it in a span of its own.
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/microservices-demo/user/db"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// traceServer returns an endpoint middleware serving requests in a server
+// span named name. A miss is tagged result=not_found, while the span of any
+// other failure is marked as errored, with the error.kind of db.ErrorKind.
+func traceServer(tracer trace.Tracer, name string) endpoint.Middleware {
+	return func(next endpoint.Endpoint) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			ctx, span := tracer.Start(ctx, name, trace.WithSpanKind(trace.SpanKindServer))
+			defer span.End()
+			if h, ok := ctx.Value(traceHolderKey{}).(*traceHolder); ok {
+				h.set(traceID(ctx))
+			}
+			response, err := next(ctx, request)
+			recordCapture(ctx, span, response, err)
+			switch kind := db.ErrorKind(err); kind {
+			case "":
+			case db.KindNotFound:
+				span.SetAttributes(attribute.String("result", "not_found"))
+			default:
+				span.RecordError(err)
+				span.SetAttributes(attribute.String("error.kind", kind))
+				span.SetStatus(codes.Error, err.Error())
+			}
+			return response, err
+		}
+	}
+}
+
+// traceToContext joins the trace the propagation headers of r carry
+func traceToContext(ctx context.Context, r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+}
+
+type traceHolderKey struct{}
+
+// traceHolder carries the trace id of the server span of a request back out
+// of its endpoint, for the error encoder that only sees the context of the
+// transport
+type traceHolder struct {
+	mu sync.Mutex
+	id string
+}
+
+func (h *traceHolder) set(id string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.id = id
+}
+
+func (h *traceHolder) get() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.id
+}
+
+// traceHolderToContext makes room in the context for the trace id of the
+// server span of the request
+func traceHolderToContext(ctx context.Context, _ *http.Request) context.Context {
+	return context.WithValue(ctx, traceHolderKey{}, &traceHolder{})
+}
+
+// requestTraceID returns the id of the trace of the request of ctx: that of
+// its server span once the endpoint started one, otherwise that of the span
+// in ctx. It is empty when the request is not traced.
+func requestTraceID(ctx context.Context) string {
+	if h, ok := ctx.Value(traceHolderKey{}).(*traceHolder); ok {
+		if id := h.get(); id != "" {
+			return id
+		}
+	}
+	return traceID(ctx)
+}
+
+// traceFromMetadata joins the trace the propagation metadata of a gRPC call
+// carries
+func traceFromMetadata(ctx context.Context, md metadata.MD) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+}
+
+// metadataCarrier adapts gRPC metadata to propagation.TextMapCarrier
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if v := metadata.MD(c).Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// tagSpan sets key to value on the span of ctx, if it is recording
+func tagSpan(ctx context.Context, key, value string) {
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String(key, value))
+}
+
+// traceID returns the id of the trace of the span in ctx, or an empty
+// string when there is none. As in Zipkin, a 64-bit id, its high half zero,
+// is formatted in 16 hex digits and a 128-bit one in all 32.
+func traceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	id := sc.TraceID()
+	if [8]byte(id[:8]) == [8]byte{} {
+		return hex.EncodeToString(id[8:])
+	}
+	return id.String()
+}
+
+// shortTraceID returns the low 64 bits of the id of the trace of the span in
+// ctx, in 16 hex digits, or an empty string when there is none. Dashboards
+// built on 64-bit ids join on it.
+func shortTraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	id := sc.TraceID()
+	return hex.EncodeToString(id[8:])
+}
+
+// spanID returns the id of the span in ctx, or an empty string when there
+// is none
+func spanID(ctx context.Context) string {
+	if sc := trace.SpanContextFromContext(ctx); sc.HasSpanID() {
+		return sc.SpanID().String()
+	}
+	return ""
+}
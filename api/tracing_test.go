@@ -0,0 +1,245 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/events"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceparent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+func TestTraceparent(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("")
+	var buf bytes.Buffer
+	e := MakeEndpoints(NewFixedService(memory.New()), tracer, log.NewLogfmtLogger(&buf), nil)
+	h := MakeHTTPHandler(e, log.NewNopLogger())
+
+	req := httptest.NewRequest("GET", "/customers", nil)
+	req.Header.Set("traceparent", testTraceparent)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	ended := spans.Ended()
+	if len(ended) != 1 {
+		t.Fatalf("Expected one span, received %v", len(ended))
+	}
+	span := ended[0]
+	if span.SpanContext().TraceID().String() != testTraceID || span.Parent().SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("Expected span joined to the traceparent, received trace %v parent %v", span.SpanContext().TraceID(), span.Parent().SpanID())
+	}
+	if span.SpanKind() != trace.SpanKindServer || span.Name() != "GET /customers" {
+		t.Errorf("Expected server span GET /customers, received %v %v", span.SpanKind(), span.Name())
+	}
+	for _, want := range []string{"traceid=" + testTraceID, "traceid_short=a3ce929d0e0e4736", "spanid=" + span.SpanContext().SpanID().String()} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q logged, received %v", want, buf.String())
+		}
+	}
+}
+
+func TestTraceFromMetadata(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+
+	ctx := traceFromMetadata(context.Background(), metadata.Pairs("traceparent", testTraceparent))
+	if got := traceID(ctx); got != testTraceID {
+		t.Errorf("Expected trace id of the metadata, received %q", got)
+	}
+	if got := traceID(traceFromMetadata(context.Background(), metadata.MD{})); got != "" {
+		t.Errorf("Expected no trace without metadata, received %q", got)
+	}
+}
+
+func TestTraceIDWidth(t *testing.T) {
+	for _, tc := range []struct {
+		id, full, short string
+	}{
+		{"00000000000000000000000000abcdef", "0000000000abcdef", "0000000000abcdef"},
+		{testTraceID, testTraceID, "a3ce929d0e0e4736"},
+	} {
+		id, err := trace.TraceIDFromHex(tc.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: id, SpanID: trace.SpanID{1}})
+		ctx := trace.ContextWithSpanContext(context.Background(), sc)
+		if got := traceID(ctx); got != tc.full {
+			t.Errorf("%v: expected trace id %v, received %v", tc.id, tc.full, got)
+		}
+		if got := shortTraceID(ctx); got != tc.short {
+			t.Errorf("%v: expected short trace id %v, received %v", tc.id, tc.short, got)
+		}
+	}
+	if traceID(context.Background()) != "" || shortTraceID(context.Background()) != "" {
+		t.Error("Expected no trace id without a span")
+	}
+}
+
+func TestTraceNotFound(t *testing.T) {
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("")
+	var buf bytes.Buffer
+	h := MakeHTTPHandler(MakeEndpoints(NewFixedService(memory.New()), tracer, log.NewLogfmtLogger(&buf), nil), log.NewNopLogger())
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/customers/5a0e9c4e0000000000000000", nil))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/customers/zzz", nil))
+
+	ended := spans.Ended()
+	if len(ended) != 2 {
+		t.Fatalf("Expected two spans, received %v", len(ended))
+	}
+	miss, invalid := ended[0], ended[1]
+	if miss.Status().Code == codes.Error || !hasAttribute(miss, attribute.String("result", "not_found")) {
+		t.Errorf("Expected miss tagged not_found and not errored, received %v %v", miss.Status(), miss.Attributes())
+	}
+	if invalid.Status().Code != codes.Error || !hasAttribute(invalid, attribute.String("error.kind", "invalid_input")) {
+		t.Errorf("Expected invalid id errored with its kind, received %v %v", invalid.Status(), invalid.Attributes())
+	}
+	for _, want := range []string{"result=not_found", "error_kind=invalid_input"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q logged, received %v", want, buf.String())
+		}
+	}
+}
+
+func hasAttribute(span sdktrace.ReadOnlySpan, kv attribute.KeyValue) bool {
+	for _, a := range span.Attributes() {
+		if a == kv {
+			return true
+		}
+	}
+	return false
+}
+
+// contextRecorder records the context the service binds it to
+type contextRecorder struct {
+	db.Database
+	ctx *context.Context
+}
+
+func (d contextRecorder) WithContext(ctx context.Context) db.Database {
+	*d.ctx = ctx
+	return d
+}
+
+func TestUserBaggage(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bound context.Context
+	s := NewFixedService(contextRecorder{memory.New(), &bound})
+	id, err := s.Register("baggage", "password", "baggage@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := issuer.Issue(id, "baggage")
+	serve := func(opts ...EndpointsOption) (sdktrace.ReadOnlySpan, string) {
+		spans := tracetest.NewSpanRecorder()
+		tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("")
+		h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer, opts...), log.NewNopLogger())
+		req := httptest.NewRequest("PATCH", "/customers/"+id, strings.NewReader(`{"lastName": "patched"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("baggage", "user.id=forged,tenant=shop")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		return spans.Ended()[0], db.UserFromBaggage(bound)
+	}
+
+	span, user := serve(WithUserBaggage())
+	if user != id || !hasAttribute(span, attribute.String(db.UserBaggageKey, id)) {
+		t.Errorf("Expected the authenticated user in baggage and span, received %q and %v", user, span.Attributes())
+	}
+	if got := baggage.FromContext(bound).Member("tenant").Value(); got != "shop" {
+		t.Errorf("Expected other baggage kept, received %q", got)
+	}
+
+	// Anonymous requests drop the user a caller claims
+	spans := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spans)).Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer, WithUserBaggage()), log.NewNopLogger())
+	req := httptest.NewRequest("GET", "/customers/"+id, nil)
+	req.Header.Set("baggage", "user.id=forged")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if user := db.UserFromBaggage(bound); user != "" {
+		t.Errorf("Expected the claimed user dropped, received %q", user)
+	}
+
+	span, user = serve()
+	if user != "forged" || hasAttribute(span, attribute.String(db.UserBaggageKey, id)) {
+		t.Errorf("Expected baggage untouched without the option, received %q and %v", user, span.Attributes())
+	}
+}
+
+// traceEmitter records the trace of the event of each entity
+type traceEmitter struct {
+	mu     sync.Mutex
+	traces map[string]string
+}
+
+func (e *traceEmitter) Emit(ev events.Event) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.traces[ev.EntityID] = ev.TraceID
+}
+
+func TestConcurrentRequestTraces(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	emitted := &traceEmitter{traces: make(map[string]string)}
+	s := EventsMiddleware(emitted)(NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost))))
+	tracer := sdktrace.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), nil), log.NewNopLogger())
+
+	registered := make([]string, 20)
+	var wg sync.WaitGroup
+	for k := range registered {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest("POST", "/register", strings.NewReader(fmt.Sprintf(`{"username": "traced%v", "password": "password", "email": "traced%v@example.com", "firstName": "first", "lastName": "last"}`, k, k)))
+			req.Header.Set("traceparent", fmt.Sprintf("00-%032x-00f067aa0ba902b7-01", k+1))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			var res struct {
+				ID string `json:"id"`
+			}
+			json.NewDecoder(rec.Body).Decode(&res)
+			registered[k] = res.ID
+		}()
+	}
+	wg.Wait()
+	for k, id := range registered {
+		if want := fmt.Sprintf("%016x", k+1); emitted.traces[id] != want {
+			t.Errorf("Expected the event of request %v in its trace %v, received %q", k, want, emitted.traces[id])
+		}
+	}
+}
@@ -7,32 +7,72 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/go-kit/kit/log"
-	"github.com/go-kit/kit/tracing/opentracing"
 	httptransport "github.com/go-kit/kit/transport/http"
 	"github.com/gorilla/mux"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/fallback"
 	"github.com/microservices-demo/user/users"
-	stdopentracing "github.com/opentracing/opentracing-go"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
-	ErrInvalidRequest = errors.New("Invalid request")
+	// ErrInvalidRequest matches db.ErrInvalidInput with errors.Is
+	ErrInvalidRequest error = db.InputError("Invalid request")
 )
 
+// NotPatchableError is returned when a PATCH body names a field that cannot
+// be changed that way.
+type NotPatchableError struct {
+	Field string
+}
+
+func (e NotPatchableError) Error() string {
+	return fmt.Sprintf("Field %v is not patchable, patchable fields are %v", e.Field, strings.Join(users.PatchableFields, ", "))
+}
+
+// Is reports whether target is db.ErrInvalidInput
+func (e NotPatchableError) Is(target error) bool {
+	return target == db.ErrInvalidInput
+}
+
 // MakeHTTPHandler mounts the endpoints into a REST-y HTTP handler.
-func MakeHTTPHandler(e Endpoints, logger log.Logger, tracer stdopentracing.Tracer) *mux.Router {
+func MakeHTTPHandler(e Endpoints, logger log.Logger, opts ...HTTPOption) *mux.Router {
+	cfg := httpConfig{maxBodySize: DefaultMaxBodySize}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
 	r := mux.NewRouter().StrictSlash(false)
 	options := []httptransport.ServerOption{
 		httptransport.ServerErrorLogger(logger),
 		httptransport.ServerErrorEncoder(encodeError),
-		// Add HTTPToContext globally to all endpoints for trace propagation
-		httptransport.ServerBefore(opentracing.HTTPToContext(tracer, "http-request", logger)),
+		httptransport.ServerBefore(limitBody(cfg.maxBodySize)),
+		// Join the trace of the traceparent header in every endpoint, and
+		// keep the id of its trace for error responses
+		httptransport.ServerBefore(traceToContext, traceHolderToContext),
+		httptransport.ServerBefore(staleToContext),
+		httptransport.ServerBefore(bearerToContext),
+		httptransport.ServerBefore(apiKeyToContext),
+		httptransport.ServerBefore(clientCertToContext),
+		httptransport.ServerBefore(idempotencyKeyToContext),
+		httptransport.ServerBefore(linksToContext(users.LinkBase())),
+		httptransport.ServerBefore(httptransport.PopulateRequestContext),
+	}
+	encodeLogin, encodeLogout := encodeResponse, encodeResponse
+	if cfg.cookie != nil {
+		options = append(options, httptransport.ServerBefore(cfg.cookie.toContext))
+		encodeLogin, encodeLogout = cfg.cookie.encodeLogin, cfg.cookie.encodeLogout
 	}
 
+	// Options for responses revalidated with If-None-Match
+	taggedOptions := append([]httptransport.ServerOption{httptransport.ServerBefore(ifNoneMatchToContext)}, options...)
+
 	// Options for health/metrics endpoints without tracing
 	healthOptions := []httptransport.ServerOption{
 		httptransport.ServerErrorLogger(logger),
@@ -40,26 +80,64 @@ func MakeHTTPHandler(e Endpoints, logger log.Logger, tracer stdopentracing.Trace
 	}
 
 	// GET /login       Login
+	// POST /login/mfa  Second login step of two-factor users
+	// POST /token/refresh Refresh
+	// POST /logout     Logout
 	// GET /register    Register
 	// GET /health      Health Check
+	// GET /live        Liveness probe
+	// GET /ready       Readiness probe
+	// GET /version     Build of the binary
+	// GET|PUT /admin/loglevel Log level, with WithLogLevelAdmin
+	// POST /admin/impersonate/{id} Impersonation token, with WithImpersonation
 
 	r.Methods("GET").Path("/login").Handler(httptransport.NewServer(
 		e.LoginEndpoint,
 		decodeLoginRequest,
+		encodeLogin,
+		options...,
+	))
+	r.Methods("POST").Path("/login/mfa").Handler(httptransport.NewServer(
+		e.LoginMFAEndpoint,
+		decodeLoginMFARequest,
+		encodeLogin,
+		options...,
+	))
+	r.Methods("POST").Path("/token/refresh").Handler(httptransport.NewServer(
+		e.RefreshEndpoint,
+		decodeRefreshRequest,
 		encodeResponse,
 		options...,
 	))
+	r.Methods("POST").Path("/logout").Handler(httptransport.NewServer(
+		e.LogoutEndpoint,
+		decodeLogoutRequest,
+		encodeLogout,
+		options...,
+	))
 	r.Methods("POST").Path("/register").Handler(httptransport.NewServer(
 		e.RegisterEndpoint,
 		decodeRegisterRequest,
 		encodeResponse,
 		options...,
 	))
+	r.Methods("GET").Path("/customers/{id}/emails").Handler(httptransport.NewServer(
+		e.EmailsGetEndpoint,
+		decodeEmailRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("GET").Path("/customers/{id}/consents").Handler(httptransport.NewServer(
+		e.ConsentsGetEndpoint,
+		decodeConsentsRequest,
+		encodeResponse,
+		options...,
+	))
 	r.Methods("GET").PathPrefix("/customers").Handler(httptransport.NewServer(
 		e.UserGetEndpoint,
 		decodeGetRequest,
-		encodeResponse,
-		options...,
+		encodeTaggedResponse,
+		taggedOptions...,
 	))
 	r.Methods("GET").PathPrefix("/cards").Handler(httptransport.NewServer(
 		e.CardGetEndpoint,
@@ -79,6 +157,126 @@ func MakeHTTPHandler(e Endpoints, logger log.Logger, tracer stdopentracing.Trace
 		encodeResponse,
 		options...,
 	))
+	r.Methods("PUT").Path("/customers/{id}").Handler(httptransport.NewServer(
+		e.UserPutEndpoint,
+		decodeUserPutRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PATCH").Path("/customers/{id}").Handler(httptransport.NewServer(
+		e.UserPatchEndpoint,
+		decodeUserPatchRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/password").Handler(httptransport.NewServer(
+		e.PasswordEndpoint,
+		decodePasswordRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/logout-all").Handler(httptransport.NewServer(
+		e.LogoutAllEndpoint,
+		decodeLogoutAllRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/admin/impersonate/{id}").Handler(httptransport.NewServer(
+		e.ImpersonateEndpoint,
+		decodeImpersonateRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/roles").Handler(httptransport.NewServer(
+		e.RolesEndpoint,
+		decodeRolesRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/status").Handler(httptransport.NewServer(
+		e.StatusEndpoint,
+		decodeStatusRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/preferences").Handler(httptransport.NewServer(
+		e.PreferencesEndpoint,
+		decodePreferencesRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/addresses/{aid}/default").Handler(httptransport.NewServer(
+		e.DefaultEndpoint,
+		decodeDefaultAddressRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PATCH").Path("/customers/{id}/cards/{cid}").Handler(httptransport.NewServer(
+		e.CardLabelEndpoint,
+		decodeCardLabelRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/cards/{cid}/default").Handler(httptransport.NewServer(
+		e.CardDefaultEndpoint,
+		decodeDefaultCardRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/merge").Handler(httptransport.NewServer(
+		e.MergeEndpoint,
+		decodeMergeRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/emails").Handler(httptransport.NewServer(
+		e.EmailAddEndpoint,
+		decodeEmailBodyRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/emails/{address}/verify").Handler(httptransport.NewServer(
+		e.EmailVerifyEndpoint,
+		decodeEmailBodyRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/emails/{address}/primary").Handler(httptransport.NewServer(
+		e.EmailPrimaryEndpoint,
+		decodeEmailRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("DELETE").Path("/customers/{id}/emails/{address}").Handler(httptransport.NewServer(
+		e.EmailRemoveEndpoint,
+		decodeEmailRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("PUT").Path("/customers/{id}/consents").Handler(httptransport.NewServer(
+		e.ConsentsSetEndpoint,
+		decodeConsentsRequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/mfa").Handler(httptransport.NewServer(
+		e.MFAProvisionEndpoint,
+		decodeMFARequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/mfa/confirm").Handler(httptransport.NewServer(
+		e.MFAConfirmEndpoint,
+		decodeMFARequest,
+		encodeResponse,
+		options...,
+	))
+	r.Methods("POST").Path("/customers/{id}/mfa/disable").Handler(httptransport.NewServer(
+		e.MFADisableEndpoint,
+		decodeMFARequest,
+		encodeResponse,
+		options...,
+	))
 	r.Methods("POST").Path("/addresses").Handler(httptransport.NewServer(
 		e.AddressPostEndpoint,
 		decodeAddressRequest,
@@ -91,35 +289,48 @@ func MakeHTTPHandler(e Endpoints, logger log.Logger, tracer stdopentracing.Trace
 		encodeResponse,
 		options...,
 	))
-	r.Methods("DELETE").PathPrefix("/").Handler(httptransport.NewServer(
+	r.Methods("DELETE").Path("/{entity:customers|addresses|cards}/{id}").Handler(httptransport.NewServer(
 		e.DeleteEndpoint,
 		decodeDeleteRequest,
 		encodeResponse,
 		options...,
 	))
+	r.Methods("GET").Path("/live").HandlerFunc(serveLive)
+	r.Methods("GET").Path("/ready").Handler(httptransport.NewServer(
+		e.ReadyEndpoint,
+		decodeHealthRequest,
+		encodeHealthResponse,
+		healthOptions...,
+	))
 	r.Methods("GET").PathPrefix("/health").Handler(httptransport.NewServer(
 		e.HealthEndpoint,
 		decodeHealthRequest,
 		encodeHealthResponse,
 		healthOptions...,
 	))
+	r.Methods("GET").Path("/version").HandlerFunc(serveVersion)
+	if cfg.logLevel != nil {
+		r.Methods("GET", "PUT").Path("/admin/loglevel").Handler(cfg.logLevel)
+	}
 	r.Handle("/metrics", promhttp.Handler())
+	handleUnrouted(r)
 	return r
 }
 
-func encodeError(_ context.Context, err error, w http.ResponseWriter) {
-	code := http.StatusInternalServerError
-	switch err {
-	case ErrUnauthorized:
-		code = http.StatusUnauthorized
+// encodeError answers err with the error envelope, shared by every endpoint
+func encodeError(ctx context.Context, err error, w http.ResponseWriter) {
+	code := errorStatus(err)
+	var rl RateLimitedError
+	var ol OverloadedError
+	switch {
+	case errors.As(err, &rl):
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(rl.RetryAfter)))
+	case errors.As(err, &ol):
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(ol.RetryAfter)))
 	}
-	w.WriteHeader(code)
 	w.Header().Set("Content-Type", "application/hal+json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"error":       err.Error(),
-		"status_code": code,
-		"status_text": http.StatusText(code),
-	})
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(newErrorBody(ctx, err, code))
 }
 
 func decodeLoginRequest(_ context.Context, r *http.Request) (interface{}, error) {
@@ -127,35 +338,115 @@ func decodeLoginRequest(_ context.Context, r *http.Request) (interface{}, error)
 	if !ok {
 		return loginRequest{}, ErrUnauthorized
 	}
+	u = users.NormalizeUsername(u)
+	if !users.PlainUsername(u) {
+		return loginRequest{}, ErrInvalidRequest
+	}
+
+	device := r.URL.Query().Get("device")
+	if device == "" {
+		device = r.UserAgent()
+	}
+	meta := map[string]string{MetaUserAgent: r.UserAgent()}
+	if t := r.Header.Get(CaptchaHeader); t != "" {
+		meta[MetaCaptchaToken] = t
+	}
+	req := loginRequest{
+		Username:   u,
+		Password:   p,
+		Remember:   r.URL.Query().Get("remember") == "true",
+		Device:     device,
+		Metadata:   meta,
+		Attributes: r.URL.Query().Get("include") == "attributes",
+	}
+	return req, nil
+}
+
+func decodeLoginMFARequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := loginMFARequest{}
+	err := decodeJSON(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	req.Remember = r.URL.Query().Get("remember") == "true"
+	req.Device = r.URL.Query().Get("device")
+	if req.Device == "" {
+		req.Device = r.UserAgent()
+	}
+	return req, nil
+}
+
+func decodeLogoutRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := logoutRequest{}
+	// The body is optional when only the access token is revoked
+	err := decodeJSON(r, &req)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	req.AccessToken, _ = ctx.Value(bearerKey{}).(string)
+	if err := csrfCheck(ctx); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
 
-	return loginRequest{
-		Username: u,
-		Password: p,
-	}, nil
+func decodeRefreshRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := refreshRequest{}
+	err := decodeJSON(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
 }
 
 func decodeRegisterRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	reg := registerRequest{}
-	err := json.NewDecoder(r.Body).Decode(&reg)
+	// A username sent as an object, like {"$gt": ""}, fails to decode
+	err := decodeJSON(r, &reg)
 	if err != nil {
 		return nil, err
 	}
+	u := users.User{Username: reg.Username, Password: reg.Password, Email: reg.Email, FirstName: reg.FirstName, LastName: reg.LastName, Phone: reg.Phone, DisplayName: reg.DisplayName}
+	u.Normalize()
+	if err := u.Validate(); err != nil {
+		return nil, err
+	}
+	if err := validMerge(reg.GuestSession, reg.GuestAddresses, reg.GuestCards); err != nil {
+		return nil, err
+	}
+	reg.Username, reg.Email, reg.Phone, reg.DisplayName = u.Username, u.Email, u.Phone, u.DisplayName
 	return reg, nil
 }
 
 func decodeDeleteRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	d := deleteRequest{}
+	d := deleteRequest{Mode: r.URL.Query().Get("mode"), IfMatch: r.Header.Get("If-Match")}
 	u := strings.Split(r.URL.Path, "/")
-	if len(u) == 3 {
-		d.Entity = u[1]
-		d.ID = u[2]
-		return d, nil
+	if len(u) != 3 {
+		return d, ErrInvalidRequest
+	}
+	d.Entity = u[1]
+	d.ID = u[2]
+	// Only purging a customer can be conditional
+	if d.IfMatch != "" && (d.Entity != "customers" || d.Mode == deleteModeAnonymize) {
+		return d, ErrInvalidRequest
+	}
+	switch d.Mode {
+	case "", deleteModePurge:
+	case deleteModeAnonymize:
+		if d.Entity != "customers" {
+			return d, ErrInvalidRequest
+		}
+	default:
+		return d, ErrInvalidRequest
 	}
-	return d, ErrInvalidRequest
+	return d, nil
 }
 
 func decodeGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	g := GetRequest{}
+	g := GetRequest{Full: r.URL.Query().Get("full") == "true"}
 	u := strings.Split(r.URL.Path, "/")
 	if len(u) > 2 {
 		g.ID = u[2]
@@ -163,49 +454,343 @@ func decodeGetRequest(_ context.Context, r *http.Request) (interface{}, error) {
 			g.Attr = u[3]
 		}
 	}
+	if g.ID == "" {
+		var err error
+		if g.Page, g.Size, err = decodePage(r); err != nil {
+			return nil, err
+		}
+		// A stream is the full list, it is not paginated
+		if g.Stream = acceptsNDJSON(r); g.Stream && g.Size != 0 {
+			return nil, ErrInvalidRequest
+		}
+		if u[1] == "customers" {
+			if g.Sort, err = decodeSort(r.URL.Query().Get("sort")); err != nil {
+				return nil, err
+			}
+		}
+		if u[1] == "cards" {
+			g.Label = strings.TrimSpace(r.URL.Query().Get("label"))
+		}
+	}
 	return g, nil
 }
 
+// decodeSort parses a sort parameter like "lastName" or "-createdAt", a
+// leading minus sorting in descending order
+func decodeSort(v string) (db.Sort, error) {
+	if v == "" {
+		return db.Sort{}, nil
+	}
+	s := db.Sort{Field: strings.TrimPrefix(v, "-"), Desc: strings.HasPrefix(v, "-")}
+	for _, f := range db.UserSortFields {
+		if s.Field == f {
+			return s, nil
+		}
+	}
+	return db.Sort{}, users.FieldErrors{{
+		Field:   "sort",
+		Code:    users.FieldInvalid,
+		Message: fmt.Sprintf("Customers can be sorted by %v", strings.Join(db.UserSortFields, ", ")),
+	}}
+}
+
+// userPostRequest is a posted customer, with its email, password and the
+// addresses and cards to create along with it, which users.User leaves out
+// of its JSON
+type userPostRequest struct {
+	users.User
+	Email     string          `json:"email"`
+	Password  string          `json:"password"`
+	Addresses []users.Address `json:"addresses"`
+	Cards     []users.Card    `json:"cards"`
+}
+
 func decodeUserRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
-	u := users.User{}
-	err := json.NewDecoder(r.Body).Decode(&u)
+	req := userPostRequest{}
+	err := decodeJSON(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	u := req.User
+	u.Email, u.Password = req.Email, req.Password
+	u.Addresses, u.Cards = req.Addresses, req.Cards
+	u.Normalize()
+	for k := range u.Addresses {
+		u.Addresses[k].Normalize()
+	}
+	for k := range u.Cards {
+		u.Cards[k].Normalize()
+	}
+	if err := u.ValidateWithAttributes(); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func decodeUserPutRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	u := userPutRequest{}
+	err := decodeJSON(r, &u)
 	if err != nil {
 		return nil, err
 	}
+	profile := users.User{Username: u.Username, Email: u.Email, FirstName: u.FirstName, LastName: u.LastName, Phone: u.Phone, DisplayName: u.DisplayName}
+	profile.Normalize()
+	if err := profile.ValidateProfile(); err != nil {
+		return nil, err
+	}
+	u.Username, u.Email, u.Phone, u.DisplayName = profile.Username, profile.Email, profile.Phone, profile.DisplayName
+	u.ID = mux.Vars(r)["id"]
 	return u, nil
 }
 
+func decodeUserPatchRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	fields := map[string]json.RawMessage{}
+	err := decodeJSON(r, &fields)
+	if err != nil {
+		return nil, err
+	}
+	for f := range fields {
+		patchable := false
+		for _, p := range users.PatchableFields {
+			if f == p {
+				patchable = true
+			}
+		}
+		if !patchable {
+			return nil, NotPatchableError{Field: f}
+		}
+	}
+	body, _ := json.Marshal(fields)
+	p := userPatchRequest{}
+	err = json.Unmarshal(body, &p.UserPatch)
+	if err != nil {
+		return nil, err
+	}
+	if p.Username != nil {
+		username := users.NormalizeUsername(*p.Username)
+		p.Username = &username
+	}
+	if p.Email != nil {
+		email := strings.TrimSpace(*p.Email)
+		p.Email = &email
+	}
+	if p.Phone != nil {
+		phone := users.NormalizePhone(*p.Phone)
+		p.Phone = &phone
+	}
+	if p.DisplayName != nil {
+		name := strings.TrimSpace(*p.DisplayName)
+		p.DisplayName = &name
+	}
+	if err := p.UserPatch.Validate(); err != nil {
+		return nil, err
+	}
+	p.ID = mux.Vars(r)["id"]
+	return p, nil
+}
+
+func decodePasswordRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	p := passwordRequest{}
+	err := decodeJSON(r, &p)
+	if err != nil {
+		return nil, err
+	}
+	p.ID = mux.Vars(r)["id"]
+	return p, nil
+}
+
+func decodeLogoutAllRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return logoutAllRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func decodeImpersonateRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	return impersonateRequest{ID: mux.Vars(r)["id"]}, nil
+}
+
+func decodeRolesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := rolesRequest{}
+	err := decodeJSON(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	req.ID = mux.Vars(r)["id"]
+	return req, nil
+}
+
+func decodeStatusRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := statusRequest{}
+	err := decodeJSON(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	req.ID = mux.Vars(r)["id"]
+	return req, nil
+}
+
+func decodePreferencesRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := preferencesRequest{}
+	err := decodeJSON(r, &req.Changes)
+	if err != nil {
+		return nil, err
+	}
+	req.ID = mux.Vars(r)["id"]
+	return req, nil
+}
+
+// decodeDefaultAddressRequest reads the type of default from the query,
+// shipping unless given
+func decodeDefaultAddressRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	req := defaultAddressRequest{ID: vars["id"], AddressID: vars["aid"], Type: r.URL.Query().Get("type")}
+	if req.Type == "" {
+		req.Type = users.AddressShipping
+	}
+	return req, nil
+}
+
+func decodeMergeRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := mergeRequest{}
+	if err := decodeJSON(r, &req); err != nil {
+		return nil, err
+	}
+	if err := validMerge(req.GuestSession, req.GuestAddresses, req.GuestCards); err != nil {
+		return nil, err
+	}
+	req.ID = mux.Vars(r)["id"]
+	return req, nil
+}
+
+func decodeDefaultCardRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	return defaultCardRequest{ID: vars["id"], CardID: vars["cid"]}, nil
+}
+
+// decodeConsentsRequest reads the consents changed, and their source, from
+// the body when there is one
+func decodeConsentsRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := consentsRequest{}
+	if r.Method != "GET" {
+		if err := decodeJSON(r, &req); err != nil {
+			return nil, err
+		}
+	}
+	req.ID = mux.Vars(r)["id"]
+	req.Source = strings.TrimSpace(req.Source)
+	return req, nil
+}
+
+// decodeEmailRequest reads the customer and its email from the path
+func decodeEmailRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	vars := mux.Vars(r)
+	return emailRequest{ID: vars["id"], Address: vars["address"]}, nil
+}
+
+// decodeEmailBodyRequest reads the email added, or the code verifying the
+// email of the path, from the body
+func decodeEmailBodyRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := emailRequest{}
+	err := decodeJSON(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	vars := mux.Vars(r)
+	req.ID = vars["id"]
+	if a, ok := vars["address"]; ok {
+		req.Address = a
+	}
+	req.Address = strings.TrimSpace(req.Address)
+	return req, nil
+}
+
+func decodeCardLabelRequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := cardLabelRequest{}
+	err := decodeJSON(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	vars := mux.Vars(r)
+	req.ID, req.CardID = vars["id"], vars["cid"]
+	req.Label = strings.TrimSpace(req.Label)
+	return req, nil
+}
+
+func decodeMFARequest(_ context.Context, r *http.Request) (interface{}, error) {
+	defer r.Body.Close()
+	req := mfaRequest{}
+	// Provisioning takes no code
+	err := decodeJSON(r, &req)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	req.ID = mux.Vars(r)["id"]
+	return req, nil
+}
+
 func decodeAddressRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
 	a := addressPostRequest{}
-	err := json.NewDecoder(r.Body).Decode(&a)
+	err := decodeJSON(r, &a)
 	if err != nil {
 		return nil, err
 	}
+	a.Address.Normalize()
+	if err := a.Address.Validate(); err != nil {
+		return nil, err
+	}
 	return a, nil
 }
 
 func decodeCardRequest(_ context.Context, r *http.Request) (interface{}, error) {
 	defer r.Body.Close()
 	c := cardPostRequest{}
-	err := json.NewDecoder(r.Body).Decode(&c)
+	err := decodeJSON(r, &c)
 	if err != nil {
 		return nil, err
 	}
+	c.Card.Normalize()
+	if err := c.Card.Validate(); err != nil {
+		return nil, err
+	}
 	return c, nil
 }
 
 func decodeHealthRequest(_ context.Context, r *http.Request) (interface{}, error) {
-	return struct{}{}, nil
+	return healthRequest{Force: r.URL.Query().Get("force") == "true"}, nil
 }
 
 func encodeHealthResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
 	return encodeResponse(ctx, w, response.(healthResponse))
 }
 
-func encodeResponse(_ context.Context, w http.ResponseWriter, response interface{}) error {
+// staleToContext lets a fallback database record that a read was served
+// from its secondary source.
+func staleToContext(ctx context.Context, _ *http.Request) context.Context {
+	return fallback.WithStaleMarker(ctx)
+}
+
+func encodeResponse(ctx context.Context, w http.ResponseWriter, response interface{}) error {
+	if sr, ok := response.(streamResponse); ok {
+		return encodeStream(ctx, w, sr)
+	}
+	response = withLinks(ctx, response)
 	// All of our response objects are JSON serializable, so we just do that.
 	w.Header().Set("Content-Type", "application/hal+json")
+	if fallback.IsStale(ctx) {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
 	return json.NewEncoder(w).Encode(response)
 }
@@ -0,0 +1,385 @@
+package api
+
+// transport_grpc.go binds the endpoints to gRPC, for internal callers that
+// prefer it over HTTP. The endpoints are the same, so authentication, rate
+// limiting and tracing behave as they do over HTTP.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/log"
+	grpctransport "github.com/go-kit/kit/transport/grpc"
+	httptransport "github.com/go-kit/kit/transport/http"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/fallback"
+	"github.com/microservices-demo/user/pb"
+	"github.com/microservices-demo/user/users"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// ErrorCodeTrailer is the trailer carrying the error code of a failed call,
+// the same code the HTTP error envelope holds
+const ErrorCodeTrailer = "error-code"
+
+type grpcServer struct {
+	pb.UnimplementedUserServer
+	login       grpctransport.Handler
+	register    grpctransport.Handler
+	getUser     grpctransport.Handler
+	getUsers    grpctransport.Handler
+	postAddress grpctransport.Handler
+	postCard    grpctransport.Handler
+	delete      grpctransport.Handler
+	health      grpctransport.Handler
+}
+
+// MakeGRPCServer mounts the endpoints into a gRPC server. Credentials are
+// read from the metadata like the HTTP headers they stand for:
+// authorization, x-api-key, x-request-id and x-tenant-id.
+func MakeGRPCServer(e Endpoints, logger log.Logger) pb.UserServer {
+	options := []grpctransport.ServerOption{
+		grpctransport.ServerErrorLogger(logger),
+		grpctransport.ServerBefore(traceFromMetadata),
+		grpctransport.ServerBefore(requestIDFromMetadata),
+		grpctransport.ServerBefore(peerToContext),
+		grpctransport.ServerBefore(credentialsFromMetadata),
+		grpctransport.ServerBefore(tenantFromMetadata),
+		grpctransport.ServerBefore(func(ctx context.Context, _ metadata.MD) context.Context {
+			return fallback.WithStaleMarker(ctx)
+		}),
+	}
+	healthOptions := []grpctransport.ServerOption{
+		grpctransport.ServerErrorLogger(logger),
+	}
+	return &grpcServer{
+		login:       grpctransport.NewServer(e.LoginEndpoint, decodeGRPCLoginRequest, encodeGRPCLoginResponse, options...),
+		register:    grpctransport.NewServer(e.RegisterEndpoint, decodeGRPCRegisterRequest, encodeGRPCIDResponse, options...),
+		getUser:     grpctransport.NewServer(e.UserGetEndpoint, decodeGRPCGetUserRequest, encodeGRPCGetUserResponse, options...),
+		getUsers:    grpctransport.NewServer(usersByID(e.UserGetEndpoint), decodeGRPCGetUsersRequest, encodeGRPCGetUsersResponse, options...),
+		postAddress: grpctransport.NewServer(e.AddressPostEndpoint, decodeGRPCAddressRequest, encodeGRPCIDResponse, options...),
+		postCard:    grpctransport.NewServer(e.CardPostEndpoint, decodeGRPCCardRequest, encodeGRPCIDResponse, options...),
+		delete:      grpctransport.NewServer(e.DeleteEndpoint, decodeGRPCDeleteRequest, encodeGRPCDeleteResponse, options...),
+		health:      grpctransport.NewServer(e.HealthEndpoint, decodeGRPCHealthRequest, encodeGRPCHealthResponse, healthOptions...),
+	}
+}
+
+func (s *grpcServer) Login(ctx context.Context, req *pb.LoginRequest) (*pb.LoginReply, error) {
+	_, rep, err := s.login.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return rep.(*pb.LoginReply), nil
+}
+
+func (s *grpcServer) Register(ctx context.Context, req *pb.RegisterRequest) (*pb.IDReply, error) {
+	_, rep, err := s.register.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return rep.(*pb.IDReply), nil
+}
+
+func (s *grpcServer) GetUser(ctx context.Context, req *pb.GetUserRequest) (*pb.Customer, error) {
+	_, rep, err := s.getUser.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return rep.(*pb.Customer), nil
+}
+
+func (s *grpcServer) GetUsers(ctx context.Context, req *pb.GetUsersRequest) (*pb.GetUsersReply, error) {
+	_, rep, err := s.getUsers.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return rep.(*pb.GetUsersReply), nil
+}
+
+func (s *grpcServer) PostAddress(ctx context.Context, req *pb.PostAddressRequest) (*pb.IDReply, error) {
+	_, rep, err := s.postAddress.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return rep.(*pb.IDReply), nil
+}
+
+func (s *grpcServer) PostCard(ctx context.Context, req *pb.PostCardRequest) (*pb.IDReply, error) {
+	_, rep, err := s.postCard.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return rep.(*pb.IDReply), nil
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteReply, error) {
+	_, rep, err := s.delete.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return rep.(*pb.DeleteReply), nil
+}
+
+func (s *grpcServer) Health(ctx context.Context, req *pb.HealthRequest) (*pb.HealthReply, error) {
+	_, rep, err := s.health.ServeGRPC(ctx, req)
+	if err != nil {
+		return nil, grpcError(ctx, err)
+	}
+	return rep.(*pb.HealthReply), nil
+}
+
+// grpcError turns err into a status with the code matching its HTTP
+// status, and sets the error code trailer
+func grpcError(ctx context.Context, err error) error {
+	code, _ := errorDetails(err)
+	grpc.SetTrailer(ctx, metadata.Pairs(ErrorCodeTrailer, code))
+	var c codes.Code
+	switch errorStatus(err) {
+	case http.StatusBadRequest:
+		c = codes.InvalidArgument
+	case http.StatusUnauthorized:
+		c = codes.Unauthenticated
+	case http.StatusForbidden:
+		c = codes.PermissionDenied
+	case http.StatusNotFound:
+		c = codes.NotFound
+	case http.StatusConflict:
+		c = codes.AlreadyExists
+	case http.StatusUnprocessableEntity, http.StatusPreconditionFailed:
+		c = codes.FailedPrecondition
+	case http.StatusTooManyRequests, http.StatusRequestEntityTooLarge:
+		c = codes.ResourceExhausted
+	case http.StatusNotImplemented:
+		c = codes.Unimplemented
+	case http.StatusServiceUnavailable:
+		c = codes.Unavailable
+	default:
+		c = codes.Internal
+	}
+	return status.Error(c, err.Error())
+}
+
+// requestIDFromMetadata does for calls what RequestIDMiddleware does for
+// HTTP requests
+func requestIDFromMetadata(ctx context.Context, md metadata.MD) context.Context {
+	id := firstMetadata(md, "x-request-id")
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs("x-request-id", id))
+	return NewRequestIDContext(ctx, id)
+}
+
+// peerToContext stores the address of the caller where the rate limiter
+// looks for it, and its certificate identity when it sent a verified one
+func peerToContext(ctx context.Context, md metadata.MD) context.Context {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ctx
+	}
+	ctx = context.WithValue(ctx, httptransport.ContextKeyRequestRemoteAddr, p.Addr.String())
+	if xff := firstMetadata(md, "x-forwarded-for"); xff != "" {
+		ctx = context.WithValue(ctx, httptransport.ContextKeyRequestXForwardedFor, xff)
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+		ctx = auth.NewClientCertContext(ctx, auth.ClientIdentity(info.State.VerifiedChains[0][0]))
+	}
+	return ctx
+}
+
+// credentialsFromMetadata moves the bearer token and API key into the
+// context for the authentication middleware
+func credentialsFromMetadata(ctx context.Context, md metadata.MD) context.Context {
+	if h := firstMetadata(md, "authorization"); len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		ctx = context.WithValue(ctx, bearerKey{}, strings.TrimSpace(h[7:]))
+	}
+	if k := firstMetadata(md, "x-api-key"); k != "" {
+		ctx = context.WithValue(ctx, apiKeyHeaderKey{}, k)
+	}
+	return ctx
+}
+
+func firstMetadata(md metadata.MD, key string) string {
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// usersByID returns an endpoint getting the users of a list of ids with
+// get, skipping those not found. No ids get all users.
+func usersByID(get endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		ids := request.([]string)
+		if len(ids) == 0 {
+			return get(ctx, GetRequest{})
+		}
+		us := make([]users.User, 0, len(ids))
+		for _, id := range ids {
+			u, err := get(ctx, GetRequest{ID: id})
+			if errors.Is(err, db.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			us = append(us, u.(users.User))
+		}
+		return EmbedStruct{Embed: usersResponse{Users: us}}, nil
+	}
+}
+
+func decodeGRPCLoginRequest(ctx context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.LoginRequest)
+	username := users.NormalizeUsername(req.Username)
+	if !users.PlainUsername(username) {
+		return nil, ErrInvalidRequest
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	agent := firstMetadata(md, "user-agent")
+	meta := map[string]string{MetaUserAgent: agent}
+	if t := firstMetadata(md, strings.ToLower(CaptchaHeader)); t != "" {
+		meta[MetaCaptchaToken] = t
+	}
+	// The reply carries the addresses and cards of the customer
+	return loginRequest{Username: username, Password: req.Password, Device: agent, Metadata: meta, Attributes: true}, nil
+}
+
+func encodeGRPCLoginResponse(_ context.Context, response interface{}) (interface{}, error) {
+	switch r := response.(type) {
+	case mfaRequiredResponse:
+		return &pb.LoginReply{MfaRequired: true, Challenge: r.Challenge}, nil
+	case userResponse:
+		return &pb.LoginReply{User: customerToPB(r.User), Token: r.Token}, nil
+	}
+	return nil, errors.New("unexpected login response")
+}
+
+func decodeGRPCRegisterRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.RegisterRequest)
+	u := users.User{Username: req.Username, Password: req.Password, Email: req.Email, FirstName: req.FirstName, LastName: req.LastName}
+	u.Normalize()
+	if err := u.Validate(); err != nil {
+		return nil, err
+	}
+	return registerRequest{Username: u.Username, Password: req.Password, Email: u.Email, FirstName: req.FirstName, LastName: req.LastName}, nil
+}
+
+func encodeGRPCIDResponse(_ context.Context, response interface{}) (interface{}, error) {
+	return &pb.IDReply{Id: response.(postResponse).ID}, nil
+}
+
+func decodeGRPCGetUserRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.GetUserRequest)
+	if req.Id == "" {
+		return nil, ErrInvalidRequest
+	}
+	return GetRequest{ID: req.Id}, nil
+}
+
+func encodeGRPCGetUserResponse(_ context.Context, response interface{}) (interface{}, error) {
+	return customerToPB(response.(users.User)), nil
+}
+
+func decodeGRPCGetUsersRequest(_ context.Context, request interface{}) (interface{}, error) {
+	return request.(*pb.GetUsersRequest).Ids, nil
+}
+
+func encodeGRPCGetUsersResponse(_ context.Context, response interface{}) (interface{}, error) {
+	us := response.(EmbedStruct).Embed.(usersResponse).Users
+	rep := &pb.GetUsersReply{Users: make([]*pb.Customer, 0, len(us))}
+	for _, u := range us {
+		rep.Users = append(rep.Users, customerToPB(u))
+	}
+	return rep, nil
+}
+
+func decodeGRPCAddressRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.PostAddressRequest)
+	a := req.GetAddress()
+	add := addressPostRequest{
+		Address: users.Address{Street: a.GetStreet(), Number: a.GetNumber(), Country: a.GetCountry(), City: a.GetCity(), PostCode: a.GetPostcode()},
+		UserID:  req.UserId,
+	}
+	add.Address.Normalize()
+	if err := add.Address.Validate(); err != nil {
+		return nil, err
+	}
+	return add, nil
+}
+
+func decodeGRPCCardRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.PostCardRequest)
+	c := req.GetCard()
+	card := cardPostRequest{
+		Card:   users.Card{LongNum: c.GetLongNum(), Expires: c.GetExpires(), CCV: c.GetCcv()},
+		UserID: req.UserId,
+	}
+	card.Card.Normalize()
+	if err := card.Card.Validate(); err != nil {
+		return nil, err
+	}
+	return card, nil
+}
+
+func decodeGRPCDeleteRequest(_ context.Context, request interface{}) (interface{}, error) {
+	req := request.(*pb.DeleteRequest)
+	d := deleteRequest{Entity: req.Entity, ID: req.Id}
+	switch req.Entity {
+	case "customers", "addresses", "cards":
+	default:
+		return nil, ErrInvalidRequest
+	}
+	if req.Anonymize {
+		if req.Entity != "customers" {
+			return nil, ErrInvalidRequest
+		}
+		d.Mode = deleteModeAnonymize
+	}
+	return d, nil
+}
+
+func encodeGRPCDeleteResponse(_ context.Context, response interface{}) (interface{}, error) {
+	return &pb.DeleteReply{Status: response.(statusResponse).Status}, nil
+}
+
+func decodeGRPCHealthRequest(_ context.Context, _ interface{}) (interface{}, error) {
+	return struct{}{}, nil
+}
+
+func encodeGRPCHealthResponse(_ context.Context, response interface{}) (interface{}, error) {
+	hs := response.(healthResponse).Health
+	rep := &pb.HealthReply{Health: make([]*pb.Health, 0, len(hs))}
+	for _, h := range hs {
+		rep.Health = append(rep.Health, &pb.Health{Service: h.Service, Status: h.Status, Time: h.Time})
+	}
+	return rep, nil
+}
+
+// customerToPB converts u, masking its card numbers as the HTTP API does
+func customerToPB(u users.User) *pb.Customer {
+	c := &pb.Customer{
+		Id:         u.UserID,
+		Username:   u.Username,
+		FirstName:  u.FirstName,
+		LastName:   u.LastName,
+		Roles:      u.Roles,
+		Anonymized: u.Anonymized,
+	}
+	for _, a := range u.Addresses {
+		c.Addresses = append(c.Addresses, &pb.Address{Id: a.ID, Street: a.Street, Number: a.Number, Country: a.Country, City: a.City, Postcode: a.PostCode})
+	}
+	for _, card := range u.Cards {
+		c.Cards = append(c.Cards, &pb.Card{Id: card.ID, LongNum: users.MaskNumber(card.LongNum), Expires: card.Expires})
+	}
+	return c
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/pb"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func TestGRPCServer(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)), WithTokenIssuer(issuer))
+	tracer := noop.NewTracerProvider().Tracer("")
+	e := MakeEndpoints(s, tracer, log.NewNopLogger(), issuer)
+
+	ln := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	pb.RegisterUserServer(srv, MakeGRPCServer(e, log.NewNopLogger()))
+	go srv.Serve(ln)
+	defer srv.Stop()
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return ln.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := pb.NewUserClient(conn)
+	ctx := context.Background()
+
+	reg, err := c.Register(ctx, &pb.RegisterRequest{Username: "grpc", Password: "password", Email: "grpc@example.com", FirstName: "first", LastName: "last"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Register(ctx, &pb.RegisterRequest{Username: "grpc", Password: "password", Email: "grpc@example.com", FirstName: "first", LastName: "last"})
+	if status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected AlreadyExists for a taken username, received %v", err)
+	}
+
+	login, err := c.Login(ctx, &pb.LoginRequest{Username: "grpc", Password: "password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if login.User.Id != reg.Id || login.Token == "" {
+		t.Fatalf("Expected user %v with a token, received %v", reg.Id, login)
+	}
+	_, err = c.Login(ctx, &pb.LoginRequest{Username: "grpc", Password: "wrong"})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated for a wrong password, received %v", err)
+	}
+
+	card := &pb.PostCardRequest{UserId: reg.Id, Card: &pb.Card{LongNum: "4111111111111111", Expires: "12/30", Ccv: "123"}}
+	var trailer metadata.MD
+	_, err = c.PostCard(ctx, card, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Expected Unauthenticated without a token, received %v", err)
+	}
+	if got := trailer.Get(ErrorCodeTrailer); len(got) != 1 || got[0] != CodeUnauthorized {
+		t.Errorf("Expected error code %v, received %v", CodeUnauthorized, got)
+	}
+	authed := metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+login.Token)
+	if _, err := c.PostCard(authed, card); err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.PostCard(authed, &pb.PostCardRequest{UserId: reg.Id, Card: &pb.Card{LongNum: "x"}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument for an invalid card, received %v", err)
+	}
+
+	u, err := c.GetUser(ctx, &pb.GetUserRequest{Id: reg.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Cards) != 1 || u.Cards[0].LongNum != "************1111" {
+		t.Errorf("Expected one masked card, received %v", u.Cards)
+	}
+	_, err = c.GetUser(ctx, &pb.GetUserRequest{Id: strings.Repeat("0", 24)})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound, received %v", err)
+	}
+
+	us, err := c.GetUsers(ctx, &pb.GetUsersRequest{Ids: []string{reg.Id, strings.Repeat("0", 24)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(us.Users) != 1 || us.Users[0].Id != reg.Id {
+		t.Errorf("Expected only the existing user, received %v", us.Users)
+	}
+
+	h, err := c.Health(ctx, &pb.HealthRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Health) == 0 {
+		t.Error("Expected health statuses")
+	}
+}
@@ -0,0 +1,1332 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/auth"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/events"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func newTestHandler(s Service) http.Handler {
+	tracer := noop.NewTracerProvider().Tracer("")
+	return MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), nil), log.NewNopLogger())
+}
+
+func TestPatchUser(t *testing.T) {
+	s := NewFixedService(memory.New())
+	id, err := s.Register("patch", "password", "patch@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(s)
+
+	req := httptest.NewRequest("PATCH", "/customers/"+id, strings.NewReader(`{"lastName": "changed"}`))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, received %v: %v", rec.Code, rec.Body.String())
+	}
+	var u struct {
+		FirstName string `json:"firstName"`
+		LastName  string `json:"lastName"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.FirstName != "first" || u.LastName != "changed" {
+		t.Errorf("Expected only last name changed, received %+v", u)
+	}
+
+	for _, body := range []string{`{"password": "x"}`, `{"cards": []}`, `{"addresses": []}`, `{"lastName": ""}`, `{"email": "nope"}`} {
+		req = httptest.NewRequest("PATCH", "/customers/"+id, strings.NewReader(body))
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %v, received %v", body, rec.Code)
+		}
+	}
+
+	req = httptest.NewRequest("PATCH", "/customers/"+id, strings.NewReader(`{"phone": "0044 20 7946-0958"}`))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `"phone":"+442079460958"`) {
+		t.Errorf("Expected the phone normalized, received %v: %v", rec.Code, rec.Body.String())
+	}
+	req = httptest.NewRequest("PATCH", "/customers/"+id, strings.NewReader(`{"phone": "+0 123"}`))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an invalid phone, received %v", rec.Code)
+	}
+
+	req = httptest.NewRequest("PATCH", "/customers/5a0e9c4e0000000000000000", strings.NewReader(`{"email": "x@example.com"}`))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for unknown id, received %v", rec.Code)
+	}
+}
+
+func TestDeleteStatusCodes(t *testing.T) {
+	s := NewFixedService(memory.New())
+	id, err := s.Register("delete", "password", "delete@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(s)
+
+	missing := "5a0e9c4e0000000000000000"
+	req := httptest.NewRequest("DELETE", "/cards/"+missing, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for missing card, received %v", rec.Code)
+	}
+	var body map[string]interface{}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body["entity"] != "cards" || body["id"] != missing {
+		t.Errorf("Expected entity and id in body, received %v", body)
+	}
+
+	req = httptest.NewRequest("DELETE", "/customers/invalid", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid id, received %v", rec.Code)
+	}
+
+	req = httptest.NewRequest("DELETE", "/customers/"+id, nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":true`) {
+		t.Errorf("Expected successful delete, received %v %v", rec.Code, rec.Body.String())
+	}
+}
+
+func TestAuthentication(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewFixedService(memory.New())
+	owner, err := s.Register("owner", "password", "owner@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := s.Register("other", "password", "other@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, err := s.PostCard(users.Card{LongNum: "4111111111111111"}, owner, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	spare, err := s.PostCard(users.Card{LongNum: "4000056655665556"}, owner, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ownerToken, _ := issuer.Issue(owner, "owner")
+	otherToken, _ := issuer.Issue(other, "other")
+	adminToken, _ := issuer.Issue(storeAdmin(t, s, "admin"), "admin", auth.RoleAdmin)
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer), log.NewNopLogger())
+
+	for _, tc := range []struct {
+		method, path, token, body string
+		code                      int
+	}{
+		{"GET", "/health", "", "", http.StatusOK},
+		{"DELETE", "/cards/" + card, "", "", http.StatusUnauthorized},
+		{"DELETE", "/cards/" + card, "garbage", "", http.StatusUnauthorized},
+		{"DELETE", "/cards/" + card, otherToken, "", http.StatusForbidden},
+		{"POST", "/cards", otherToken, `{"userID": "` + owner + `", "longNum": "4111111111111111"}`, http.StatusForbidden},
+		{"PATCH", "/customers/" + owner, otherToken, `{"firstName": "x"}`, http.StatusForbidden},
+		{"PATCH", "/customers/" + owner, ownerToken, `{"firstName": "x"}`, http.StatusOK},
+		{"POST", "/cards", ownerToken, `{"userID": "` + owner + `", "longNum": "4111111111111111"}`, http.StatusOK},
+		{"DELETE", "/customers/" + owner, ownerToken, "", http.StatusForbidden},
+		{"DELETE", "/cards/" + card, ownerToken, "", http.StatusOK},
+		{"DELETE", "/cards/" + spare, adminToken, "", http.StatusOK},
+		{"DELETE", "/customers/" + owner, adminToken, "", http.StatusOK},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, strings.NewReader(tc.body))
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tc.code {
+			t.Errorf("%v %v: expected %v, received %v: %v", tc.method, tc.path, tc.code, rec.Code, rec.Body.String())
+			continue
+		}
+		if tc.code == http.StatusUnauthorized || tc.code == http.StatusForbidden {
+			var body map[string]interface{}
+			if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body["status_code"] != float64(tc.code) {
+				t.Errorf("%v %v: expected JSON error body, received %v", tc.method, tc.path, body)
+			}
+		}
+	}
+}
+
+func TestLogout(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer.Denylist = auth.NewMemoryDenylist()
+	s := NewFixedService(memory.New(), WithTokenIssuer(issuer))
+	if _, err := s.Register("logout", "password", "logout@example.com", "first", "last", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer), log.NewNopLogger())
+
+	req := httptest.NewRequest("GET", "/login?remember=true&device=phone", nil)
+	req.SetBasicAuth("logout", "password")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var login struct {
+		User         struct{ ID string }
+		Token        string
+		RefreshToken string
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&login); err != nil || login.Token == "" || login.RefreshToken == "" {
+		t.Fatalf("Expected access and refresh token, received %+v %v", login, err)
+	}
+
+	req = httptest.NewRequest("POST", "/logout", strings.NewReader(`{"refreshToken": "`+login.RefreshToken+`"}`))
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, received %v: %v", rec.Code, rec.Body.String())
+	}
+
+	req = httptest.NewRequest("DELETE", "/customers/"+login.User.ID, nil)
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected revoked access token rejected, received %v", rec.Code)
+	}
+	if _, _, err := s.Refresh(login.RefreshToken); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected revoked refresh token rejected, received %v", err)
+	}
+
+	req = httptest.NewRequest("POST", "/logout", nil)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without any token, received %v", rec.Code)
+	}
+
+	found := false
+	for _, hc := range s.Health(false) {
+		if hc.Service == "user-denylist-memory" && hc.Status == "OK" && hc.Severity == SeverityCritical {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Expected the denylist in health, critical, received %+v", s.Health(false))
+	}
+}
+
+func TestLoginUniformErrors(t *testing.T) {
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	if _, err := s.Register("known", "password", "known@example.com", "first", "last", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(s)
+
+	bodies := []string{}
+	for _, username := range []string{"known", "unknown"} {
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.SetBasicAuth(username, "wrong")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusUnauthorized {
+			t.Errorf("%v: expected 401, received %v", username, rec.Code)
+		}
+		bodies = append(bodies, rec.Body.String())
+	}
+	if bodies[0] != bodies[1] {
+		t.Errorf("Expected identical bodies, received %v and %v", bodies[0], bodies[1])
+	}
+
+	var ae AuthError
+	if _, _, err := s.Login("unknown", "wrong", false); !errors.As(err, &ae) || ae.Reason != reasonUnknownUser {
+		t.Errorf("Expected unknown user reason, received %v", err)
+	}
+	if _, _, err := s.Login("known", "wrong", false); !errors.As(err, &ae) || ae.Reason != reasonWrongPassword {
+		t.Errorf("Expected wrong password reason, received %v", err)
+	}
+}
+
+func TestOperatorShapedUsernames(t *testing.T) {
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	if _, err := s.Register("victim", "password", "victim@example.com", "first", "last", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(s)
+
+	for _, username := range []string{`{"$gt": ""}`, `$ne`, "victim\x00", ""} {
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.SetBasicAuth(username, "password")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Login as %q: expected 400, received %v", username, rec.Code)
+		}
+	}
+
+	for _, body := range []string{
+		`{"username": {"$gt": ""}, "password": "password"}`,
+		`{"username": ["victim"], "password": "password"}`,
+		`{"username": "$where", "password": "password"}`,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", "/register", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Register %v: expected 400, received %v", body, rec.Code)
+		}
+	}
+}
+
+func TestPasswordPolicyErrors(t *testing.T) {
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)),
+		WithPasswordPolicy(users.PasswordPolicy{MinLength: 8, RequireDigit: true, Common: users.CommonPasswords()}))
+	rec := httptest.NewRecorder()
+	newTestHandler(s).ServeHTTP(rec, httptest.NewRequest("POST", "/register", strings.NewReader(`{"username": "weak", "password": "qwerty", "email": "weak@example.com", "firstName": "first", "lastName": "last"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected 400, received %v", rec.Code)
+	}
+	var body ErrorBody
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	rules := []string{}
+	for _, d := range body.Error.Details {
+		if d.Field != "password" {
+			t.Errorf("Expected password field, received %+v", d)
+		}
+		rules = append(rules, d.Code)
+	}
+	if body.Error.Code != CodeValidationFailed || strings.Join(rules, ",") != "min_length,digit,common" {
+		t.Errorf("Expected broken rules listed, received %+v", body.Error)
+	}
+}
+
+func TestValidationErrors(t *testing.T) {
+	h := newTestHandler(NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost))))
+	for _, tc := range []struct {
+		path, body string
+		fields     string
+	}{
+		{"/register", `{"username": "", "password": "password", "firstName": "` + strings.Repeat("x", 5000) + `", "lastName": "last", "email": "nope"}`, "firstName,username,email"},
+		{"/customers", `{"username": "valid", "firstName": "first", "lastName": "last"}`, "password,email"},
+		{"/customers", `{"username": "valid", "password": "password", "email": "valid@example.com", "firstName": "first", "lastName": "last", "addresses": [{"street": "High Street", "city": "London", "country": "GB"}, {"street": "x"}], "cards": [{"longNum": "12"}]}`, "addresses[1].city,addresses[1].country,cards[0].longNum"},
+		{"/register", `{"username": "valid", "password": "password", "email": "valid@example.com", "firstName": "first", "lastName": "last", "phone": "0207 946 0958"}`, "phone"},
+		{"/addresses", `{"street": "High Street", "city": "London"}`, "country"},
+		{"/addresses", `{"street": "High Street", "country": "<script>", "postcode": "` + strings.Repeat("9", 20) + `"}`, "city,country,postcode"},
+		{"/addresses", `{"street": "High Street", "city": "London", "country": "GB", "postcode": "asdf"}`, "postcode"},
+		{"/addresses", `{"street": "High Street", "city": "London", "country": "GB", "type": "work"}`, "type"},
+		{"/cards", `{"longNum": "4111-1111-1111-1112", "expires": "13/24", "ccv": "12"}`, "longNum,expires,ccv"},
+		{"/cards", `{"longNum": "4111111111111111", "label": "` + strings.Repeat("x", users.MaxLabelLength+1) + `"}`, "label"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", tc.path, strings.NewReader(tc.body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("POST %v: expected 400, received %v", tc.path, rec.Code)
+			continue
+		}
+		var body ErrorBody
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		fields := []string{}
+		for _, d := range body.Error.Details {
+			fields = append(fields, d.Field)
+		}
+		if body.Error.Code != CodeValidationFailed || strings.Join(fields, ",") != tc.fields {
+			t.Errorf("POST %v: expected %v listed, received %+v", tc.path, tc.fields, body.Error)
+		}
+	}
+}
+
+func TestAddressCountryNormalized(t *testing.T) {
+	h := newTestHandler(NewFixedService(memory.New()))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/addresses", strings.NewReader(`{"street": "High Street", "city": "London", "country": "United Kingdom", "postcode": "sw1a1aa"}`)))
+	var posted postResponse
+	if err := json.NewDecoder(rec.Body).Decode(&posted); err != nil || posted.ID == "" {
+		t.Fatalf("Expected the address created, received %v %v", rec.Code, err)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/addresses/"+posted.ID, nil))
+	if !strings.Contains(rec.Body.String(), `"country":"GB"`) || !strings.Contains(rec.Body.String(), `"postcode":"SW1A 1AA"`) {
+		t.Errorf("Expected the country stored as GB and the post code as SW1A 1AA, received %v", rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/addresses", strings.NewReader(`{"street": "High Street", "city": "Poseidonis", "country": "Atlantis"}`)))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "ISO 3166-1") {
+		t.Errorf("Expected 400 listing the accepted forms, received %v %v", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDefaultAddresses(t *testing.T) {
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	id, err := s.Register("defaults", "password", "defaults@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(s)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	post := func(body string) string {
+		var posted postResponse
+		if err := json.NewDecoder(do("POST", "/addresses", body).Body).Decode(&posted); err != nil || posted.ID == "" {
+			t.Fatalf("Expected the address created, received %v", err)
+		}
+		return posted.ID
+	}
+	ship := post(`{"street": "High Street", "city": "London", "country": "GB", "userID": "` + id + `"}`)
+	bill := post(`{"street": "Low Street", "city": "London", "country": "GB", "type": "Billing", "userID": "` + id + `"}`)
+	if rec := do("GET", "/addresses/"+ship, ""); !strings.Contains(rec.Body.String(), `"type":"shipping"`) {
+		t.Errorf("Expected an address without a type stored as shipping, received %v", rec.Body.String())
+	}
+	if rec := do("GET", "/addresses/"+bill, ""); !strings.Contains(rec.Body.String(), `"type":"billing"`) {
+		t.Errorf("Expected the type stored in lower case, received %v", rec.Body.String())
+	}
+
+	if rec := do("POST", "/customers/"+id+"/addresses/"+ship+"/default", ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the default shipping address set, received %v: %v", rec.Code, rec.Body.String())
+	}
+	rec := do("POST", "/customers/"+id+"/addresses/"+bill+"/default?type=billing", "")
+	var u users.User
+	if err := json.NewDecoder(rec.Body).Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.DefaultShipping != ship || u.DefaultBilling != bill {
+		t.Errorf("Expected the defaults %v and %v, received %v and %v", ship, bill, u.DefaultShipping, u.DefaultBilling)
+	}
+	if rec := do("POST", "/customers/"+id+"/addresses/"+bill+"/default?type=other", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a default of type other refused, received %v", rec.Code)
+	}
+	other := post(`{"street": "Side Street", "city": "London", "country": "GB"}`)
+	if rec := do("POST", "/customers/"+id+"/addresses/"+other+"/default", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected the address of another refused, received %v", rec.Code)
+	}
+
+	if rec := do("DELETE", "/addresses/"+bill, ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the address deleted, received %v", rec.Code)
+	}
+	rec = do("GET", "/customers/"+id, "")
+	if !strings.Contains(rec.Body.String(), `"defaultShipping":"`+ship+`"`) || strings.Contains(rec.Body.String(), "defaultBilling") {
+		t.Errorf("Expected only the default shipping address left, received %v", rec.Body.String())
+	}
+}
+
+func TestDefaultCard(t *testing.T) {
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	id, err := s.Register("defaultcard", "password", "defaultcard@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(s)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	post := func(body string) string {
+		var posted postResponse
+		if err := json.NewDecoder(do("POST", "/cards", body).Body).Decode(&posted); err != nil || posted.ID == "" {
+			t.Fatalf("Expected the card created, received %v", err)
+		}
+		return posted.ID
+	}
+	first := post(`{"longNum": "4242424242424242", "userID": "` + id + `"}`)
+	second := post(`{"longNum": "5555555555554444", "userID": "` + id + `"}`)
+	cards := func() []users.Card {
+		var embed struct {
+			Embedded cardsResponse `json:"_embedded"`
+		}
+		if err := json.NewDecoder(do("GET", "/customers/"+id+"/cards", "").Body).Decode(&embed); err != nil {
+			t.Fatal(err)
+		}
+		return embed.Embedded.Cards
+	}
+	for _, c := range cards() {
+		if c.Default != (c.ID == first) {
+			t.Errorf("Expected only the first card added marked default, received %+v", c)
+		}
+	}
+
+	rec := do("POST", "/customers/"+id+"/cards/"+second+"/default", "")
+	var u users.User
+	if err := json.NewDecoder(rec.Body).Decode(&u); err != nil {
+		t.Fatal(err)
+	}
+	if u.DefaultCard != second {
+		t.Errorf("Expected the default card %v, received %v", second, u.DefaultCard)
+	}
+	for _, c := range u.Cards {
+		if c.Default != (c.ID == second) {
+			t.Errorf("Expected only the second card marked default, received %+v", c)
+		}
+	}
+	other := post(`{"longNum": "4242424242424242"}`)
+	if rec := do("POST", "/customers/"+id+"/cards/"+other+"/default", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected the card of another refused, received %v", rec.Code)
+	}
+
+	if rec := do("DELETE", "/cards/"+second, ""); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the card deleted, received %v", rec.Code)
+	}
+	if cs := cards(); len(cs) != 1 || !cs[0].Default || cs[0].ID != first {
+		t.Errorf("Expected the card left promoted to default, received %+v", cs)
+	}
+}
+
+func TestDisplayName(t *testing.T) {
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	h := newTestHandler(s)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	register := func(body string) string {
+		var posted postResponse
+		rec := do("POST", "/register", body)
+		if err := json.NewDecoder(rec.Body).Decode(&posted); err != nil || posted.ID == "" {
+			t.Fatalf("Expected the user registered, received %v: %v", rec.Code, err)
+		}
+		return posted.ID
+	}
+	displayName := func(id string) string {
+		var u users.User
+		if err := json.NewDecoder(do("GET", "/customers/"+id, "").Body).Decode(&u); err != nil {
+			t.Fatal(err)
+		}
+		return u.DisplayName
+	}
+
+	id := register(`{"username": "display", "password": "password", "email": "display@example.com", "firstName": "Ada", "lastName": "Lovelace", "displayName": " Countess "}`)
+	if got := displayName(id); got != "Countess" {
+		t.Errorf("Expected the display name registered, received %q", got)
+	}
+	// Display names are not unique
+	other := register(`{"username": "display2", "password": "password", "email": "display2@example.com", "firstName": "Ada", "lastName": "Byron", "displayName": "Countess"}`)
+	if got := displayName(other); got != "Countess" {
+		t.Errorf("Expected a display name shared, received %q", got)
+	}
+	if _, _, err := s.Login("Countess", "password", false); err == nil {
+		t.Error("Expected a display name refused at login")
+	}
+
+	if rec := do("PATCH", "/customers/"+id, `{"displayName": "bad\u0007name"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a control character refused, received %v", rec.Code)
+	}
+	if rec := do("PATCH", "/customers/"+id, `{"displayName": ""}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the display name cleared, received %v: %v", rec.Code, rec.Body.String())
+	}
+	if got := displayName(id); got != "Ada Lovelace" {
+		t.Errorf("Expected the first and last names without a display name, received %q", got)
+	}
+	// The default read and sent back is not stored, so it follows the names
+	if rec := do("PUT", "/customers/"+id, `{"username": "display", "email": "display@example.com", "firstName": "Ada", "lastName": "King", "displayName": "Ada Lovelace"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the profile updated, received %v: %v", rec.Code, rec.Body.String())
+	}
+	if got := displayName(id); got != "Ada King" {
+		t.Errorf("Expected the display name to follow the names, received %q", got)
+	}
+	if rec := do("PUT", "/customers/"+id, `{"username": "display", "email": "display@example.com", "firstName": "Ada", "lastName": "King", "displayName": "Enchantress"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the profile updated, received %v: %v", rec.Code, rec.Body.String())
+	}
+	if got := displayName(id); got != "Enchantress" {
+		t.Errorf("Expected the display name updated, received %q", got)
+	}
+}
+
+func TestEmails(t *testing.T) {
+	var emitted recordingEmitter
+	s := EventsMiddleware(&emitted)(NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost))))
+	id, err := s.Register("emails", "password", "emails@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Register("taken", "password", "taken@example.com", "first", "last", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(s)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	list := func(rec *httptest.ResponseRecorder) []users.EmailAddress {
+		var es emailsResponse
+		if err := json.NewDecoder(rec.Body).Decode(&es); err != nil {
+			t.Fatal(err)
+		}
+		return es.Emails
+	}
+	code := func() string {
+		e := emitted[len(emitted)-1]
+		if e.Type != events.EmailVerification {
+			t.Fatalf("Expected the code sent through the events, received %+v", e)
+		}
+		return e.Data.(emailVerification).Code
+	}
+
+	rec := do("POST", "/customers/"+id+"/emails", `{"address": " billing@example.com "}`)
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), code()) {
+		t.Fatalf("Expected the email added without its code, received %v: %v", rec.Code, rec.Body.String())
+	}
+	es := list(do("GET", "/customers/"+id+"/emails", ""))
+	if len(es) != 2 || es[0].Address != "emails@example.com" || !es[0].Primary || es[1].Address != "billing@example.com" || es[1].Verified {
+		t.Errorf("Expected the primary then the unverified email, received %+v", es)
+	}
+	if rec := do("POST", "/customers/"+id+"/emails", `{"address": "taken@Example.COM"}`); rec.Code != http.StatusConflict {
+		t.Errorf("Expected the email of another refused, received %v", rec.Code)
+	}
+	if rec := do("POST", "/customers/"+id+"/emails/billing@example.com/primary", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unverified email refused as primary, received %v", rec.Code)
+	}
+	if _, _, err := s.Login("billing@example.com", "password", false); err == nil {
+		t.Error("Expected an unverified email refused at login")
+	}
+
+	sent := code()
+	if rec := do("POST", "/customers/"+id+"/emails/billing@example.com/verify", `{"code": "aaaa-aaaa"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a wrong code refused, received %v", rec.Code)
+	}
+	es = list(do("POST", "/customers/"+id+"/emails/billing@example.com/verify", `{"code": "`+sent+`"}`))
+	if len(es) != 2 || !es[1].Verified {
+		t.Errorf("Expected the email verified, received %+v", es)
+	}
+	if u, _, err := s.Login("billing@example.com", "password", false); err != nil || u.UserID != id {
+		t.Errorf("Expected a verified email to log in, received %v %v", u.UserID, err)
+	}
+	if _, err := s.Register("other", "password", "billing@example.com", "first", "last", "", ""); err == nil {
+		t.Error("Expected a registration with the email of another refused")
+	}
+
+	rec = do("POST", "/customers/"+id+"/emails/billing@example.com/primary", "")
+	var u users.User
+	if err := json.NewDecoder(rec.Body).Decode(&u); err != nil || u.UserID != id {
+		t.Fatalf("Expected the user returned, received %v %v", rec.Body.String(), err)
+	}
+	es = list(do("GET", "/customers/"+id+"/emails", ""))
+	if len(es) != 2 || es[0].Address != "billing@example.com" || !es[0].Primary || !es[0].Verified || es[1].Address != "emails@example.com" {
+		t.Errorf("Expected the former primary kept as another email, received %+v", es)
+	}
+	if rec := do("DELETE", "/customers/"+id+"/emails/billing@example.com", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected the primary email kept, received %v", rec.Code)
+	}
+	if es := list(do("DELETE", "/customers/"+id+"/emails/emails@example.com", "")); len(es) != 1 {
+		t.Errorf("Expected the email removed, received %+v", es)
+	}
+	if rec := do("DELETE", "/customers/"+id+"/emails/emails@example.com", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected an email the user does not hold not found, received %v", rec.Code)
+	}
+}
+
+func TestConsents(t *testing.T) {
+	var emitted recordingEmitter
+	d := memory.New()
+	s := EventsMiddleware(&emitted)(NewFixedService(d, WithHasher(users.NewBcryptHasher(bcrypt.MinCost))))
+	h := newTestHandler(s)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	state := func(rec *httptest.ResponseRecorder) users.ConsentState {
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Expected the consents, received %v: %v", rec.Code, rec.Body.String())
+		}
+		var c users.ConsentState
+		if err := json.NewDecoder(rec.Body).Decode(&c); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	if rec := do("POST", "/register", `{"username": "refused", "password": "password", "email": "refused@example.com", "firstName": "first", "lastName": "last", "consents": {"fax": true}}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected consents to an unknown channel refused, received %v", rec.Code)
+	}
+	if _, err := d.GetUserByName("refused"); err == nil {
+		t.Error("Expected no customer registered along refused consents")
+	}
+	rec := do("POST", "/register", `{"username": "consents", "password": "password", "email": "consents@example.com", "firstName": "first", "lastName": "last", "consents": {"email": true}}`)
+	var pr postResponse
+	if err := json.NewDecoder(rec.Body).Decode(&pr); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("Expected the customer registered, received %v %v", rec.Code, err)
+	}
+	id := pr.ID
+
+	c := state(do("GET", "/customers/"+id+"/consents", ""))
+	if e := c.Consents[users.ConsentEmail]; !e.Granted || e.Source != users.ConsentSourceRegistration || e.At == nil {
+		t.Errorf("Expected the consent given at registration, received %+v", e)
+	}
+	if sms := c.Consents[users.ConsentSMS]; sms.Granted || sms.At != nil {
+		t.Errorf("Expected a channel left out not consented to, received %+v", sms)
+	}
+
+	for _, body := range []string{
+		`{"source": "settings", "consents": {"fax": true}}`,
+		`{"consents": {"email": false}}`,
+		`{"source": "settings", "consents": {}}`,
+	} {
+		if rec := do("PUT", "/customers/"+id+"/consents", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, received %v", body, rec.Code)
+		}
+	}
+	c = state(do("PUT", "/customers/"+id+"/consents", `{"source": "settings", "consents": {"email": false, "sms": true}}`))
+	if c.Consents[users.ConsentEmail].Granted || !c.Consents[users.ConsentSMS].Granted || c.Consents[users.ConsentSMS].Source != "settings" {
+		t.Errorf("Expected the consents changed, received %+v", c.Consents)
+	}
+	if len(c.History) != 3 || !c.History[0].Granted || c.History[0].Channel != users.ConsentEmail {
+		t.Errorf("Expected the changes appended to the history, received %+v", c.History)
+	}
+	if e := emitted[len(emitted)-1]; e.Type != events.ConsentsUpdated || e.EntityID != id {
+		t.Errorf("Expected the change told of, received %+v", e)
+	}
+
+	if err := s.AnonymizeUser(id, id); err != nil {
+		t.Fatal(err)
+	}
+	u, err := d.GetUser(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []users.ConsentTally{{Channel: users.ConsentEmail, Grants: 1, Withdrawals: 1}, {Channel: users.ConsentSMS, Grants: 1}}
+	if len(u.ConsentHistory) != 0 || !reflect.DeepEqual(u.ConsentTallies, want) {
+		t.Errorf("Expected only the tallies kept, received %+v %+v", u.ConsentHistory, u.ConsentTallies)
+	}
+}
+
+// failingConsents fails to record consents
+type failingConsents struct {
+	Service
+}
+
+func (f failingConsents) SetConsents(string, string, map[string]bool) (users.ConsentState, error) {
+	return users.ConsentState{}, errors.New("connection reset")
+}
+
+func TestRegisterConsentsFailing(t *testing.T) {
+	d := memory.New()
+	h := newTestHandler(failingConsents{NewFixedService(d, WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("POST", "/register", strings.NewReader(`{"username": "consents", "password": "password", "email": "consents@example.com", "firstName": "first", "lastName": "last", "consents": {"email": true}}`)))
+	var pr postResponse
+	if err := json.NewDecoder(rec.Body).Decode(&pr); err != nil || rec.Code != http.StatusOK || pr.ID == "" {
+		t.Fatalf("Expected the customer registered, received %v %+v %v", rec.Code, pr, err)
+	}
+	if pr.ConsentsFailed == "" {
+		t.Errorf("Expected the consents reported failing, received %+v", pr)
+	}
+	if _, err := d.GetUser(pr.ID); err != nil {
+		t.Errorf("Expected the customer stored, received %v", err)
+	}
+}
+
+func TestCardLabels(t *testing.T) {
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	id, err := s.Register("labels", "password", "labels@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newTestHandler(s)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	var posted postResponse
+	rec := do("POST", "/cards", `{"longNum": "4242424242424242", "label": " Work Visa ", "userID": "`+id+`"}`)
+	if err := json.NewDecoder(rec.Body).Decode(&posted); err != nil || posted.ID == "" {
+		t.Fatalf("Expected the card created, received %v %v", rec.Code, err)
+	}
+	other, err := s.PostCard(users.Card{LongNum: "4000056655665556"}, id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := do("GET", "/customers/"+id+"/cards", ""); !strings.Contains(rec.Body.String(), `"label":"Work Visa"`) {
+		t.Errorf("Expected the label trimmed and returned, received %v", rec.Body.String())
+	}
+
+	rec = do("PATCH", "/customers/"+id+"/cards/"+other, `{"label": "personal"}`)
+	var card users.Card
+	if err := json.NewDecoder(rec.Body).Decode(&card); err != nil || card.Label != "personal" {
+		t.Errorf("Expected the card labelled, received %v %+v %v", rec.Code, card, err)
+	}
+	if strings.Contains(rec.Body.String(), "4000056655665556") {
+		t.Errorf("Expected the number masked, received %v", rec.Body.String())
+	}
+	if rec := do("PATCH", "/customers/"+id+"/cards/"+other, `{"label": "`+strings.Repeat("x", users.MaxLabelLength+1)+`"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a long label refused, received %v", rec.Code)
+	}
+	stranger, _ := s.Register("stranger", "password", "stranger@example.com", "first", "last", "", "")
+	if rec := do("PATCH", "/customers/"+stranger+"/cards/"+other, `{"label": "mine"}`); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected the card of another refused, received %v", rec.Code)
+	}
+
+	for q, want := range map[string][]string{"work": {posted.ID}, "PERS": {other}, "none": {}} {
+		var body struct {
+			Embedded cardsResponse `json:"_embedded"`
+		}
+		if err := json.NewDecoder(do("GET", "/cards?label="+q, "").Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, c := range body.Embedded.Cards {
+			got = append(got, c.ID)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: expected %v, received %v", q, want, got)
+		}
+	}
+}
+
+func TestCardNumbersMasked(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewFixedService(memory.New(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	id, err := s.Register("cards", "password", "cards@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	card, err := s.PostCard(users.Card{LongNum: "4111111111111111", Expires: "01/30"}, id, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := noop.NewTracerProvider().Tracer("")
+	e := MakeEndpoints(s, tracer, log.NewNopLogger(), nil)
+	e.CardGetEndpoint = MaskCardsForRole(issuer, auth.RoleAdmin, users.MaskBin6Last4)(e.CardGetEndpoint)
+	e.UserGetEndpoint = MaskCardsForRole(issuer, auth.RoleAdmin, users.MaskBin6Last4)(e.UserGetEndpoint)
+	e.LoginEndpoint = MaskCardsForRole(issuer, auth.RoleAdmin, users.MaskBin6Last4)(e.LoginEndpoint)
+	e.CardGetEndpoint = ExposeCardNumbers(issuer)(e.CardGetEndpoint)
+	h := MakeHTTPHandler(e, log.NewNopLogger())
+
+	get := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, path := range []string{"/cards", "/cards/" + card, "/customers/" + id + "/cards", "/cards/" + card + "?full=true"} {
+		rec := get(path, "")
+		if strings.Contains(rec.Body.String(), "4111111111111111") {
+			t.Errorf("%v: expected masked number, received %v", path, rec.Body.String())
+		}
+		if rec.Code == http.StatusOK && !strings.Contains(rec.Body.String(), "************1111") {
+			t.Errorf("%v: expected last four digits, received %v", path, rec.Body.String())
+		}
+	}
+
+	customer, _ := issuer.Issue(id, "cards")
+	admin, _ := issuer.Issue(id, "cards", auth.RoleAdmin)
+	payment, _ := issuer.Issue("payment", "payment", auth.RolePayment)
+	if rec := get("/cards/"+card+"?full=true", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without token, received %v", rec.Code)
+	}
+	for _, token := range []string{customer, admin} {
+		if rec := get("/cards/"+card+"?full=true", token); rec.Code != http.StatusForbidden {
+			t.Errorf("Expected 403 without payment role, received %v", rec.Code)
+		}
+	}
+	for _, path := range []string{"/cards/" + card + "?full=true", "/cards?full=true"} {
+		if rec := get(path, payment); !strings.Contains(rec.Body.String(), "4111111111111111") {
+			t.Errorf("%v: expected full number for payment role, received %v", path, rec.Body.String())
+		}
+	}
+	if rec := get("/cards/"+card, payment); strings.Contains(rec.Body.String(), "4111111111111111") {
+		t.Errorf("Expected masked number without ?full=true, received %v", rec.Body.String())
+	}
+	for _, path := range []string{"/cards", "/cards/" + card, "/customers/" + id + "/cards"} {
+		if rec := get(path, admin); !strings.Contains(rec.Body.String(), `"411111******1111"`) {
+			t.Errorf("%v: expected first six and last four digits for admin role, received %v", path, rec.Body.String())
+		}
+		if rec := get(path, customer); rec.Code == http.StatusOK && !strings.Contains(rec.Body.String(), `"************1111"`) {
+			t.Errorf("%v: expected last four digits for customer, received %v", path, rec.Body.String())
+		}
+	}
+	if rec := get("/cards/"+card, "invalid"); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"************1111"`) {
+		t.Errorf("Expected an invalid token served the default style, received %v %v", rec.Code, rec.Body.String())
+	}
+
+	// The cards embedded in a login follow the roles of the user
+	login := func() string {
+		req := httptest.NewRequest("GET", "/login?include=attributes", nil)
+		req.SetBasicAuth("cards", "password")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	if body := login(); !strings.Contains(body, `"************1111"`) {
+		t.Errorf("Expected last four digits embedded for customer, received %v", body)
+	}
+	if err := s.(*fixedService).db.SetUserRoles(id, []string{users.RoleCustomer, users.RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	if body := login(); !strings.Contains(body, `"411111******1111"`) {
+		t.Errorf("Expected first six and last four digits embedded for admin, received %v", body)
+	}
+}
+
+func TestAnonymizeCustomer(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := memory.New()
+	s := NewFixedService(d, WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	id, err := s.Register("forget", "password", "forget@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	support := storeAdmin(t, s, "support")
+	token, _ := issuer.Issue(support, "support", auth.RoleAdmin)
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer), log.NewNopLogger())
+
+	for path, code := range map[string]int{
+		"/customers/" + id + "?mode=shred":     http.StatusBadRequest,
+		"/cards/" + id + "?mode=anonymize":     http.StatusBadRequest,
+		"/customers/" + id + "?mode=anonymize": http.StatusOK,
+	} {
+		req := httptest.NewRequest("DELETE", path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != code {
+			t.Errorf("%v: expected %v, received %v: %v", path, code, rec.Code, rec.Body.String())
+		}
+	}
+
+	u, err := d.GetUser(id)
+	if err != nil || !u.Anonymized {
+		t.Errorf("Expected customer kept but anonymized, received %+v %v", u, err)
+	}
+	if _, _, err := s.Login("forget", "password", false); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("Expected login impossible, received %v", err)
+	}
+	audit := d.AuditLog()
+	if len(audit) != 1 || audit[0].Action != "anonymize" || audit[0].ID != id || audit[0].Principal != support {
+		t.Errorf("Expected audit entry with principal, received %+v", audit)
+	}
+}
+
+func TestAuditPrincipal(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := memory.New()
+	s := NewFixedService(d, WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	id, err := s.Register("audited", "password", "audited@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin, err := s.Register("auditor", "password", "auditor@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SetRoles(admin, []string{users.RoleAdmin}, ""); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := issuer.Issue(id, "audited")
+	adminToken, _ := issuer.Issue(admin, "auditor", auth.RoleAdmin)
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer), log.NewNopLogger())
+
+	for _, r := range []struct {
+		method, path, body, token string
+	}{
+		{"PATCH", "/customers/" + id, `{"lastName": "patched"}`, token},
+		{"PUT", "/customers/" + id + "/roles", `{"roles": ["customer", "support"]}`, adminToken},
+		{"DELETE", "/customers/" + id, "", adminToken},
+	} {
+		req := httptest.NewRequest(r.method, r.path, strings.NewReader(r.body))
+		req.Header.Set("Authorization", "Bearer "+r.token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%v %v: expected 200, received %v: %v", r.method, r.path, rec.Code, rec.Body.String())
+		}
+	}
+
+	// Without an issuer mutations are unauthenticated
+	other, err := s.Register("unauthenticated", "password", "unauthenticated@example.com", "first", "last", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	newTestHandler(s).ServeHTTP(rec, httptest.NewRequest("DELETE", "/customers/"+other, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, received %v", rec.Code)
+	}
+
+	want := []struct{ action, principal string }{
+		{"roles", "anonymous"}, {"patch", id}, {"roles", admin}, {"delete", admin}, {"delete", "anonymous"},
+	}
+	audit := d.AuditLog()
+	if len(audit) != len(want) {
+		t.Fatalf("Expected %v audit entries, received %+v", len(want), audit)
+	}
+	for k, w := range want {
+		if audit[k].Action != w.action || audit[k].Principal != w.principal {
+			t.Errorf("Entry %v: expected %v by %v, received %+v", k, w.action, w.principal, audit[k])
+		}
+	}
+}
+
+func TestRequireAPIKey(t *testing.T) {
+	t.Setenv("TEST_API_KEYS", "exporter="+auth.HashAPIKey("key"))
+	keys, err := auth.LoadAPIKeys("", "TEST_API_KEYS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	issuer, _ := auth.NewIssuer(auth.HS256, []byte("secret"))
+	adminToken, _ := issuer.Issue("id", "admin", auth.RoleAdmin)
+	e := RequireAPIKey(keys)(func(ctx context.Context, _ interface{}) (interface{}, error) {
+		return principal(ctx), nil
+	})
+	for _, tc := range []struct {
+		header, value string
+		err           error
+	}{
+		{"X-API-Key", "key", nil},
+		{"X-API-Key", "wrong", ErrUnauthorized},
+		{"Authorization", "Bearer " + adminToken, ErrUnauthorized},
+		{"", "", ErrUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tc.header != "" {
+			req.Header.Set(tc.header, tc.value)
+		}
+		ctx := bearerToContext(apiKeyToContext(req.Context(), req), req)
+		p, err := e(ctx, nil)
+		if err != tc.err {
+			t.Errorf("%v %v: expected %v, received %v", tc.header, tc.value, tc.err, err)
+		}
+		if err == nil && p != "apikey:exporter" {
+			t.Errorf("Expected the key name as principal, received %v", p)
+		}
+	}
+}
+
+func TestRoles(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewFixedService(memory.New(), WithTokenIssuer(issuer), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	admin, _ := s.Register("admin", "password", "admin@example.com", "first", "last", "", "")
+	customer, _ := s.Register("customer", "password", "customer@example.com", "first", "last", "", "")
+	if _, err := s.SetRoles(admin, []string{users.RoleCustomer, users.RoleAdmin}, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, adminToken, err := s.Login("admin", "password", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c, err := issuer.Parse(adminToken); err != nil || !c.HasRole(auth.RoleAdmin) {
+		t.Fatalf("Expected the admin role in the token, received %+v %v", c, err)
+	}
+	_, customerToken, _ := s.Login("customer", "password", false)
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer), log.NewNopLogger())
+	put := func(token, id, body string) int {
+		req := httptest.NewRequest("PUT", "/customers/"+id+"/roles", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := put(customerToken, customer, `{"roles": ["admin"]}`); code != http.StatusForbidden {
+		t.Errorf("Expected a customer refused, received %v", code)
+	}
+	if code := put(adminToken, customer, `{"roles": ["wizard"]}`); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown role refused, received %v", code)
+	}
+	if code := put(adminToken, customer, `{"roles": ["customer", "support"]}`); code != http.StatusOK {
+		t.Errorf("Expected roles granted, received %v", code)
+	}
+	if u, _ := s.GetUser(customer); !u.HasRole(users.RoleSupport) {
+		t.Errorf("Expected support role stored, received %v", u.Roles)
+	}
+
+	// The token still claims admin, the database no longer does
+	if _, err := s.SetRoles(admin, []string{users.RoleCustomer}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if code := put(adminToken, customer, `{"roles": ["customer"]}`); code != http.StatusForbidden {
+		t.Errorf("Expected a revoked admin refused, received %v", code)
+	}
+
+	posted, err := s.PostUser(users.User{FirstName: "first", LastName: "last", Username: "posted", Password: "password", Email: "posted@example.com", Roles: []string{users.RoleAdmin}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, _ := s.GetUser(posted.UserID); u.HasRole(users.RoleAdmin) {
+		t.Errorf("Expected roles in a posted user ignored, received %v", u.Roles)
+	}
+}
+
+func TestAccountStatus(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := memory.New()
+	s := NewFixedService(d, WithTokenIssuer(issuer), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	admin, _ := s.Register("admin", "password", "admin@example.com", "first", "last", "", "")
+	id, _ := s.Register("compromised", "password", "compromised@example.com", "first", "last", "", "")
+	if _, err := s.SetRoles(admin, []string{users.RoleCustomer, users.RoleAdmin}, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, adminToken, _ := s.Login("admin", "password", false)
+	refresh, err := s.CreateRefreshToken(id, "phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer), log.NewNopLogger())
+	put := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", "/customers/"+id+"/status", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	login := func(password string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.SetBasicAuth("compromised", password)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if u, _ := s.GetUser(id); u.Status != users.StatusActive {
+		t.Errorf("Expected a new account active, received %q", u.Status)
+	}
+	if rec := put(`{"status": "frozen"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown status refused, received %v", rec.Code)
+	}
+	if rec := put(`{"status": "disabled", "reason": "credentials leaked"}`); rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"status":"disabled"`) {
+		t.Fatalf("Expected the account disabled, received %v: %v", rec.Code, rec.Body.String())
+	}
+	rec := login("password")
+	var body ErrorBody
+	json.NewDecoder(rec.Body).Decode(&body)
+	if rec.Code != http.StatusForbidden || body.Error.Code != CodeAccountDisabled {
+		t.Errorf("Expected 403 %v, received %v %+v", CodeAccountDisabled, rec.Code, body.Error)
+	}
+	if rec := login("wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("Expected a wrong password told as such, received %v", rec.Code)
+	}
+	if _, _, err := s.Refresh(refresh); err == nil {
+		t.Error("Expected the refresh tokens revoked")
+	}
+	if us, _, _ := s.ListUsers(ListParams{}); len(us) != 2 {
+		t.Errorf("Expected a disabled account still listed, received %+v", us)
+	}
+	entries := d.AuditLog()
+	if last := entries[len(entries)-1]; last.Action != "disable" || last.Reason != "credentials leaked" || last.Principal != admin {
+		t.Errorf("Expected the reason audited, received %+v", last)
+	}
+
+	if rec := put(`{"status": "active"}`); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the account enabled, received %v", rec.Code)
+	}
+	if rec := login("password"); rec.Code != http.StatusOK {
+		t.Errorf("Expected an enabled account to log in, received %v", rec.Code)
+	}
+}
+
+func TestPreferences(t *testing.T) {
+	issuer, err := auth.NewIssuer(auth.HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewFixedService(memory.New(), WithTokenIssuer(issuer), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	id, _ := s.Register("prefs", "password", "prefs@example.com", "first", "last", "", "")
+	_, token, _ := s.Login("prefs", "password", false)
+	tracer := noop.NewTracerProvider().Tracer("")
+	h := MakeHTTPHandler(MakeEndpoints(s, tracer, log.NewNopLogger(), issuer), log.NewNopLogger())
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	prefs := func(rec *httptest.ResponseRecorder) map[string]string {
+		var p map[string]string
+		if err := json.NewDecoder(rec.Body).Decode(&p); err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+
+	if p := prefs(do("GET", "/customers/"+id+"/preferences", "")); len(p) != 0 {
+		t.Errorf("Expected no preferences, received %v", p)
+	}
+	rec := do("PUT", "/customers/"+id+"/preferences", `{"currency": "EUR", "newsletter": "true"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the preferences set, received %v: %v", rec.Code, rec.Body.String())
+	}
+	rec = do("PUT", "/customers/"+id+"/preferences", `{"currency": "GBP", "newsletter": null}`)
+	if p := prefs(rec); !reflect.DeepEqual(p, map[string]string{"currency": "GBP"}) {
+		t.Errorf("Expected the preferences merged, received %v", p)
+	}
+	if rec := do("GET", "/customers/"+id, ""); !strings.Contains(rec.Body.String(), `"preferences":{"currency":"GBP"}`) {
+		t.Errorf("Expected the preferences in the user, received %v", rec.Body.String())
+	}
+
+	for name, body := range map[string]string{
+		"invalid key": `{"bad key": "x"}`,
+		"dotted key":  `{"a.b": "x"}`,
+		"long value":  `{"currency": "` + strings.Repeat("x", users.MaxPreferenceValueLength+1) + `"}`,
+	} {
+		if rec := do("PUT", "/customers/"+id+"/preferences", body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%v: expected 400, received %v", name, rec.Code)
+		}
+	}
+	many := make(map[string]string)
+	for i := 0; i < users.MaxPreferences; i++ {
+		many[fmt.Sprintf("key%v", i)] = "x"
+	}
+	body, _ := json.Marshal(many)
+	if rec := do("PUT", "/customers/"+id+"/preferences", string(body)); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected more than %v keys refused, received %v", users.MaxPreferences, rec.Code)
+	}
+
+	other, _ := s.Register("other", "password", "other@example.com", "first", "last", "", "")
+	if rec := do("PUT", "/customers/"+other+"/preferences", `{"currency": "EUR"}`); rec.Code != http.StatusForbidden {
+		t.Errorf("Expected the preferences of others refused, received %v", rec.Code)
+	}
+}
+
+func TestUsernameRules(t *testing.T) {
+	defer users.SetLegacyUsernames(false)
+	d := memory.New()
+	s := NewFixedService(d, WithConfusableUsernames(), WithHasher(users.NewBcryptHasher(bcrypt.MinCost)))
+	h := newTestHandler(s)
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rec
+	}
+	register := func(name string) *httptest.ResponseRecorder {
+		return do("POST", "/register", `{"username": "`+name+`", "password": "password", "email": "`+name+`@example.com", "firstName": "first", "lastName": "last"}`)
+	}
+
+	if rec := register("admin"); rec.Code != http.StatusOK {
+		t.Fatalf("Expected admin registered, received %v: %v", rec.Code, rec.Body.String())
+	}
+	for _, name := range []string{"Admin", "ad", "admin\u202e"} {
+		if rec := register(name); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"field":"username"`) {
+			t.Errorf("Expected %q refused, received %v: %v", name, rec.Code, rec.Body.String())
+		}
+	}
+	id, _ := s.Register("eve", "password", "eve@example.com", "first", "last", "", "")
+	if rec := do("PATCH", "/customers/"+id, `{"username": "ADMIN"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a confusable rename refused, received %v", rec.Code)
+	}
+	if rec := do("PUT", "/customers/"+id, `{"username": "eve", "email": "eve@example.com", "firstName": "changed", "lastName": "last"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected an update keeping the username, received %v: %v", rec.Code, rec.Body.String())
+	}
+
+	legacy := users.New()
+	legacy.Username, legacy.Email, legacy.FirstName, legacy.LastName = "ab", "ab@example.com", "first", "last"
+	legacy.Password, _ = users.NewBcryptHasher(bcrypt.MinCost).Hash("password")
+	if err := d.CreateUser(&legacy); err != nil {
+		t.Fatal(err)
+	}
+	login := func() int {
+		req := httptest.NewRequest("GET", "/login", nil)
+		req.SetBasicAuth("ab", "password")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := login(); code != http.StatusOK {
+		t.Errorf("Expected a legacy username to log in, received %v", code)
+	}
+	if rec := do("PUT", "/customers/"+legacy.UserID, `{"username": "ab", "email": "ab@example.com", "firstName": "changed", "lastName": "last"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a legacy username refused by updates, received %v", rec.Code)
+	}
+	users.SetLegacyUsernames(true)
+	if rec := do("PUT", "/customers/"+legacy.UserID, `{"username": "ab", "email": "ab@example.com", "firstName": "changed", "lastName": "last"}`); rec.Code != http.StatusOK {
+		t.Errorf("Expected a legacy username kept, received %v: %v", rec.Code, rec.Body.String())
+	}
+	if rec := do("PATCH", "/customers/"+id, `{"username": "ev"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected a rename to a legacy username refused, received %v", rec.Code)
+	}
+}
+
+func TestSortCustomers(t *testing.T) {
+	s := NewFixedService(memory.New())
+	for _, name := range []string{"carol", "alice", "bob"} {
+		if _, err := s.Register(name, "password", name+"@example.com", "first", "last", "", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := newTestHandler(s)
+
+	list := func(query string) (int, []string) {
+		req := httptest.NewRequest("GET", "/customers?"+query, nil)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var r struct {
+			Embedded struct {
+				Customer []users.User `json:"customer"`
+			} `json:"_embedded"`
+		}
+		json.NewDecoder(rec.Body).Decode(&r)
+		names := make([]string, 0)
+		for _, u := range r.Embedded.Customer {
+			names = append(names, u.Username)
+		}
+		return rec.Code, names
+	}
+	if _, names := list("sort=username"); strings.Join(names, ",") != "alice,bob,carol" {
+		t.Errorf("Expected ascending usernames, received %v", names)
+	}
+	if _, names := list("sort=-username&size=2&page=2"); strings.Join(names, ",") != "alice" {
+		t.Errorf("Expected the second page of descending usernames, received %v", names)
+	}
+	if code, _ := list("sort=password"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unsortable field, received %v", code)
+	}
+}
@@ -0,0 +1,55 @@
+package api
+
+// unix.go contains the unix domain socket listener, for proxies running
+// alongside the service to reach it without going through TCP.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// ListenUnix listens on the unix socket at path, with the file mode mode. A
+// socket left at path by a previous run is removed first, while a socket
+// still served by another process, or a file that is not a socket, is an
+// error. Closing the listener removes the socket.
+func ListenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%v exists and is not a socket", path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("%v is served by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+type unixConnKey struct{}
+
+// UnixConnContext is the ConnContext of servers listening on a unix socket.
+// Their clients are proxies alongside the service, so the X-Forwarded-For
+// they set is believed like that of trusted proxies.
+func UnixConnContext(ctx context.Context, _ net.Conn) context.Context {
+	return context.WithValue(ctx, unixConnKey{}, true)
+}
+
+// fromUnixSocket reports whether the request of ctx came over a unix socket
+func fromUnixSocket(ctx context.Context) bool {
+	unix, _ := ctx.Value(unixConnKey{}).(bool)
+	return unix
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/microservices-demo/user/db/memory"
+)
+
+func TestListenUnix(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "user.sock")
+
+	// A stale socket is removed
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("Expected a stale socket replaced, received %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, received %v", fi.Mode().Perm())
+	}
+	if _, err := ListenUnix(path, 0600); err == nil {
+		t.Error("Expected a socket in use refused")
+	}
+
+	server := &http.Server{Handler: newTestHandler(NewFixedService(memory.New()))}
+	go server.Serve(ln)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://unix/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected the health check served over the socket, received %v", resp.StatusCode)
+	}
+
+	if err := server.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket removed on shutdown, received %v", err)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ListenUnix(file, 0600); err == nil {
+		t.Error("Expected a file that is not a socket refused")
+	}
+}
@@ -0,0 +1,41 @@
+package api
+
+// version.go describes the build of the binary, set at link time with
+//
+//	go build -ldflags "-X github.com/microservices-demo/user/api.version=v1.2.3
+//		-X github.com/microservices-demo/user/api.commit=$(git rev-parse HEAD)
+//		-X github.com/microservices-demo/user/api.buildDate=$(date -u +%FT%TZ)"
+
+import (
+	"net/http"
+	"runtime"
+)
+
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// BuildInfo is the build of the running binary, as GET /version returns it
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"buildDate"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Build returns the build of the running binary
+func Build() BuildInfo {
+	return BuildInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+	}
+}
+
+// serveVersion answers GET /version with the build of the binary
+func serveVersion(w http.ResponseWriter, r *http.Request) {
+	encodeResponse(r.Context(), w, Build())
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	"github.com/microservices-demo/user/db/memory"
+)
+
+func TestVersion(t *testing.T) {
+	defer func(v, c string) { version, commit = v, c }(version, commit)
+	version, commit = "v1.2.3", "abc123"
+	h := newTestHandler(NewFixedService(memory.New()))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/version", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, received %v", rec.Code)
+	}
+	var build BuildInfo
+	if err := json.NewDecoder(rec.Body).Decode(&build); err != nil {
+		t.Fatal(err)
+	}
+	want := BuildInfo{Version: "v1.2.3", Commit: "abc123", BuildDate: buildDate, GoVersion: runtime.Version()}
+	if build != want {
+		t.Errorf("Expected %+v, received %+v", want, build)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/health", nil))
+	var health struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if health.Version != "v1.2.3" {
+		t.Errorf("Expected the version in the health response, received %q", health.Version)
+	}
+}
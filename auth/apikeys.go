@@ -0,0 +1,174 @@
+package auth
+
+// apikeys.go contains the static API keys protecting administrative
+// endpoints, independent of customer tokens.
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ScopeAdmin is the scope of API keys let into the debug server, which
+// exposes the internals of the process
+const ScopeAdmin = "admin"
+
+// APIKeys holds named API keys by the hex SHA-256 of their value. Keys can
+// be reloaded from their file while in use.
+type APIKeys struct {
+	file string
+	mu   sync.RWMutex
+	keys map[string]APIKey
+}
+
+// APIKey is a configured API key: the SHA-256 of its value and the scopes
+// it was granted
+type APIKey struct {
+	Hash   []byte
+	Scopes []string
+}
+
+// HasScope reports whether the key was granted scope
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadAPIKeys reads API keys from file, or from the environment variable
+// env when file is empty. Both hold name=hash pairs, one per line or comma
+// separated, the hash followed by the colon separated scopes of the key, as
+// in name=hash:admin; lines starting with # are ignored.
+func LoadAPIKeys(file, env string) (*APIKeys, error) {
+	k := &APIKeys{file: file}
+	if file != "" {
+		return k, k.Reload()
+	}
+	v := os.Getenv(env)
+	if v == "" {
+		return nil, ErrNoKey
+	}
+	keys, err := ParseAPIKeys(v)
+	if err != nil {
+		return nil, err
+	}
+	k.keys = keys
+	return k, nil
+}
+
+// Reload re-reads the key file, keeping the current keys on failure. Keys
+// loaded from the environment cannot be reloaded.
+func (k *APIKeys) Reload() error {
+	if k.file == "" {
+		return nil
+	}
+	b, err := os.ReadFile(k.file)
+	if err != nil {
+		return err
+	}
+	keys, err := ParseAPIKeys(string(b))
+	if err != nil {
+		return fmt.Errorf("%v: %v", k.file, err)
+	}
+	k.mu.Lock()
+	k.keys = keys
+	k.mu.Unlock()
+	return nil
+}
+
+// Lookup returns the name of key. Every configured key is compared, in
+// constant time, so the time taken does not tell how close a guess was.
+func (k *APIKeys) Lookup(key string) (string, bool) {
+	name, _, ok := k.lookup(key)
+	return name, ok
+}
+
+// LookupScope returns the name of key, provided it was granted scope
+func (k *APIKeys) LookupScope(key, scope string) (string, bool) {
+	name, found, ok := k.lookup(key)
+	if !ok || !found.HasScope(scope) {
+		return "", false
+	}
+	return name, true
+}
+
+func (k *APIKeys) lookup(key string) (string, APIKey, bool) {
+	if key == "" {
+		return "", APIKey{}, false
+	}
+	sum := sha256.Sum256([]byte(key))
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	found := ""
+	for name, configured := range k.keys {
+		if subtle.ConstantTimeCompare(sum[:], configured.Hash) == 1 {
+			found = name
+		}
+	}
+	return found, k.keys[found], found != ""
+}
+
+// Len returns the number of keys loaded
+func (k *APIKeys) Len() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return len(k.keys)
+}
+
+// ParseAPIKeys parses name=hash pairs, where hash is the hex SHA-256 of the
+// key as returned by HashAPIKey, followed by the scopes of the key, each
+// after a colon.
+func ParseAPIKeys(s string) (map[string]APIKey, error) {
+	keys := make(map[string]APIKey)
+	for _, line := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("invalid API key entry %q", strings.TrimSpace(parts[0]))
+		}
+		fields := strings.Split(strings.TrimSpace(parts[1]), ":")
+		hash, err := hex.DecodeString(fields[0])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid hash for API key %q", strings.TrimSpace(parts[0]))
+		}
+		key := APIKey{Hash: hash}
+		for _, scope := range fields[1:] {
+			if scope = strings.TrimSpace(scope); scope != "" {
+				key.Scopes = append(key.Scopes, scope)
+			}
+		}
+		keys[strings.TrimSpace(parts[0])] = key
+	}
+	return keys, nil
+}
+
+// HashAPIKey returns the hash of key to configure in place of the key
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+type apiKeyKey struct{}
+
+// NewAPIKeyContext returns a context carrying the name of the API key the
+// request authenticated with
+func NewAPIKeyContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, apiKeyKey{}, name)
+}
+
+// APIKeyFromContext returns the name of the API key stored in ctx, if any
+func APIKeyFromContext(ctx context.Context) (string, bool) {
+	name, ok := ctx.Value(apiKeyKey{}).(string)
+	return name, ok
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAPIKeys(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "keys")
+	content := "# batch jobs\nexporter=" + HashAPIKey("first") + "\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := LoadAPIKeys(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := k.Lookup("first"); !ok || name != "exporter" {
+		t.Errorf("Expected exporter, received %q %v", name, ok)
+	}
+	for _, key := range []string{"", "wrong", HashAPIKey("first")} {
+		if _, ok := k.Lookup(key); ok {
+			t.Errorf("Expected %q refused", key)
+		}
+	}
+
+	if err := os.WriteFile(file, []byte("exporter="+HashAPIKey("second")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := k.Lookup("first"); ok {
+		t.Error("Expected the rotated key refused")
+	}
+	if _, ok := k.Lookup("second"); !ok {
+		t.Error("Expected the new key accepted")
+	}
+	if err := os.WriteFile(file, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Reload(); err == nil {
+		t.Error("Expected an error for an invalid file")
+	}
+	if _, ok := k.Lookup("second"); !ok {
+		t.Error("Expected the keys kept after a failed reload")
+	}
+}
+
+func TestAPIKeysFromEnv(t *testing.T) {
+	t.Setenv("TEST_API_KEYS", "a="+HashAPIKey("ka")+",b="+HashAPIKey("kb"))
+	k, err := LoadAPIKeys("", "TEST_API_KEYS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Len() != 2 {
+		t.Errorf("Expected 2 keys, received %d", k.Len())
+	}
+	if name, _ := k.Lookup("kb"); name != "b" {
+		t.Errorf("Expected b, received %q", name)
+	}
+	if _, ok := k.LookupScope("kb", ScopeAdmin); ok {
+		t.Error("Expected a key without scopes refused the admin scope")
+	}
+	t.Setenv("TEST_API_KEYS", "a="+HashAPIKey("ka")+":metrics:admin,b="+HashAPIKey("kb"))
+	if k, err = LoadAPIKeys("", "TEST_API_KEYS"); err != nil {
+		t.Fatal(err)
+	}
+	if name, ok := k.LookupScope("ka", ScopeAdmin); !ok || name != "a" {
+		t.Errorf("Expected a granted the admin scope, received %q %v", name, ok)
+	}
+	if _, ok := k.LookupScope("kb", ScopeAdmin); ok {
+		t.Error("Expected b refused the admin scope")
+	}
+	if _, err := LoadAPIKeys("", "TEST_API_KEYS_UNSET"); err != ErrNoKey {
+		t.Errorf("Expected ErrNoKey, received %v", err)
+	}
+	if name, ok := APIKeyFromContext(NewAPIKeyContext(context.Background(), "a")); !ok || name != "a" {
+		t.Errorf("Expected a from context, received %q", name)
+	}
+}
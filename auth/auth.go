@@ -0,0 +1,394 @@
+package auth
+
+// auth.go contains creation and verification of the signed tokens handed out
+// on login, so that downstream services can authorize requests without
+// calling back into the user service.
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// HS256 signs tokens with a shared secret
+	HS256 = "HS256"
+	// RS256 signs tokens with an RSA private key
+	RS256 = "RS256"
+)
+
+var (
+	// ErrInvalidToken is returned for any token that fails verification
+	ErrInvalidToken = errors.New("Invalid token")
+	// ErrUnknownAlgorithm is returned for an unsupported signing algorithm
+	ErrUnknownAlgorithm = errors.New("Unknown signing algorithm")
+	// ErrNoKey is returned when no key material was provided
+	ErrNoKey = errors.New("No signing key")
+	// ErrStaleCredentials is wrapped by ErrInvalidToken for tokens issued
+	// before the credentials of their user changed
+	ErrStaleCredentials = errors.New("Credentials changed since the token was issued")
+)
+
+const (
+	// RoleAdmin is the role allowing a token to act on behalf of any user
+	RoleAdmin = "admin"
+	// RolePayment is the role of the payment integration, allowed to read
+	// full card numbers when that is enabled
+	RolePayment = "payment"
+)
+
+// PurposeMFA marks the short lived challenge tokens handed out when a login
+// still needs a second factor. They are not accepted as access tokens.
+const PurposeMFA = "mfa"
+
+// Claims are the claims carried by a user token. The subject is the user id.
+type Claims struct {
+	Username string   `json:"username"`
+	Roles    []string `json:"roles,omitempty"`
+	Purpose  string   `json:"purpose,omitempty"`
+	// Tenant is the tenant the user belongs to, empty for the default one
+	Tenant string `json:"tenant,omitempty"`
+	// CredentialsVersion is that of the user when the token was issued
+	CredentialsVersion int64 `json:"cv,omitempty"`
+	// Impersonator is the id of the admin the token was issued to, acting
+	// as the user, for impersonation tokens
+	Impersonator string `json:"impersonator,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// UserID returns the id of the user the token was issued to
+func (c Claims) UserID() string {
+	return c.Subject
+}
+
+// HasRole reports whether the token carries role
+func (c Claims) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+type claimsKey struct{}
+
+// NewContext returns a context carrying the authenticated claims
+func NewContext(ctx context.Context, c Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, c)
+}
+
+// FromContext returns the authenticated claims stored in ctx, if any
+func FromContext(ctx context.Context) (Claims, bool) {
+	c, ok := ctx.Value(claimsKey{}).(Claims)
+	return c, ok
+}
+
+// CredentialsVersions reports the current credentials version of users.
+// Tokens issued at an older version are refused.
+type CredentialsVersions interface {
+	CredentialsVersion(userID string) (int64, error)
+}
+
+// Issuer signs and verifies user tokens. It signs with a single current key
+// but verifies against every key it knows, selected by the kid header, so keys
+// can be rotated without invalidating tokens that are still in flight.
+type Issuer struct {
+	alg    string
+	kid    string
+	sign   interface{}
+	verify map[string]interface{}
+	// TTL is how long issued tokens are valid for
+	TTL time.Duration
+	// ChallengeTTL is how long MFA challenge tokens are valid for
+	ChallengeTTL time.Duration
+	// ImpersonationTTL is how long impersonation tokens are valid for
+	ImpersonationTTL time.Duration
+	// Leeway is the clock skew tolerated when checking time based claims
+	Leeway time.Duration
+	// Now returns the current time, overridable in tests
+	Now func() time.Time
+	// Denylist, when set, holds the ids of revoked tokens
+	Denylist Denylist
+	// Credentials, when set, holds the credentials versions tokens are
+	// checked against
+	Credentials CredentialsVersions
+	// tenant is the tenant tokens are issued to and accepted from
+	tenant string
+}
+
+// NewIssuer returns an issuer signing with alg using key. For HS256 key is
+// the shared secret, for RS256 a PEM encoded RSA private key.
+func NewIssuer(alg string, key []byte) (*Issuer, error) {
+	if len(key) == 0 {
+		return nil, ErrNoKey
+	}
+	i := &Issuer{
+		alg:              alg,
+		verify:           make(map[string]interface{}),
+		TTL:              time.Hour,
+		ChallengeTTL:     5 * time.Minute,
+		ImpersonationTTL: 15 * time.Minute,
+		Leeway:           30 * time.Second,
+		Now:              time.Now,
+	}
+	switch alg {
+	case HS256:
+		i.sign = key
+		i.kid = keyID(key)
+		i.verify[i.kid] = key
+	case RS256:
+		pk, err := jwt.ParseRSAPrivateKeyFromPEM(key)
+		if err != nil {
+			return nil, err
+		}
+		i.sign = pk
+		i.kid = rsaKeyID(&pk.PublicKey)
+		i.verify[i.kid] = &pk.PublicKey
+	default:
+		return nil, ErrUnknownAlgorithm
+	}
+	return i, nil
+}
+
+// ForTenant returns an issuer sharing the keys and settings of i whose
+// tokens belong to tenant. It only accepts tokens of that tenant, and i only
+// those of no tenant, so a token is never honoured by another tenant. The
+// Credentials of i, read from the database of no tenant, are not shared.
+func (i *Issuer) ForTenant(tenant string) *Issuer {
+	t := *i
+	t.tenant = tenant
+	t.Credentials = nil
+	return &t
+}
+
+// AddVerificationKey makes the issuer accept tokens signed by a previous key.
+// For HS256 key is the old secret, for RS256 a PEM encoded RSA public or
+// private key.
+func (i *Issuer) AddVerificationKey(key []byte) error {
+	if len(key) == 0 {
+		return ErrNoKey
+	}
+	switch i.alg {
+	case HS256:
+		i.verify[keyID(key)] = key
+	case RS256:
+		pub, err := parseRSAPublicKey(key)
+		if err != nil {
+			return err
+		}
+		i.verify[rsaKeyID(pub)] = pub
+	}
+	return nil
+}
+
+// Issue returns a signed token for the given user
+func (i *Issuer) Issue(userID, username string, roles ...string) (string, error) {
+	return i.IssueVersion(userID, username, 0, roles...)
+}
+
+// IssueVersion returns a signed token for the given user, at the given
+// credentials version
+func (i *Issuer) IssueVersion(userID, username string, credentialsVersion int64, roles ...string) (string, error) {
+	return i.issue(Claims{Username: username, Roles: roles, CredentialsVersion: credentialsVersion}, userID, i.TTL)
+}
+
+// IssueChallenge returns a challenge token for a user who passed the first
+// factor, to be exchanged for an access token with the second.
+func (i *Issuer) IssueChallenge(userID, username string) (string, error) {
+	return i.issue(Claims{Username: username, Purpose: PurposeMFA}, userID, i.ChallengeTTL)
+}
+
+// IssueImpersonation returns a token for the given user carrying the id of
+// the impersonator acting as it, valid for ImpersonationTTL
+func (i *Issuer) IssueImpersonation(userID, username string, credentialsVersion int64, impersonator string, roles ...string) (string, error) {
+	return i.issue(Claims{Username: username, Roles: roles, CredentialsVersion: credentialsVersion, Impersonator: impersonator}, userID, i.ImpersonationTTL)
+}
+
+// Impersonated reports whether token claims to be an impersonation token,
+// without verifying it. Only Parse tells whether the claim can be trusted.
+func Impersonated(token string) bool {
+	var c Claims
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &c); err != nil {
+		return false
+	}
+	return c.Impersonator != ""
+}
+
+func (i *Issuer) issue(claims Claims, userID string, ttl time.Duration) (string, error) {
+	claims.Tenant = i.tenant
+	now := i.Now()
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return "", err
+	}
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ID:        hex.EncodeToString(jti),
+		Subject:   userID,
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+	}
+	t := jwt.NewWithClaims(jwt.GetSigningMethod(i.alg), claims)
+	t.Header["kid"] = i.kid
+	return t.SignedString(i.sign)
+}
+
+// Parse verifies an access token and returns its claims
+func (i *Issuer) Parse(token string) (Claims, error) {
+	return i.parse(token, "")
+}
+
+// ParseChallenge verifies an MFA challenge token and returns its claims
+func (i *Issuer) ParseChallenge(token string) (Claims, error) {
+	return i.parse(token, PurposeMFA)
+}
+
+func (i *Issuer) parse(token, purpose string) (Claims, error) {
+	var c Claims
+	_, err := jwt.ParseWithClaims(token, &c, i.keyfunc,
+		jwt.WithValidMethods([]string{i.alg}),
+		jwt.WithLeeway(i.Leeway),
+		jwt.WithTimeFunc(i.Now),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	if c.Purpose != purpose {
+		return Claims{}, fmt.Errorf("%w: unexpected purpose %q", ErrInvalidToken, c.Purpose)
+	}
+	if c.Tenant != i.tenant {
+		return Claims{}, fmt.Errorf("%w: issued to tenant %q", ErrInvalidToken, c.Tenant)
+	}
+	if i.Denylist != nil && c.ID != "" {
+		denied, err := i.Denylist.Denied(c.ID)
+		if err != nil {
+			// Fail closed, a revoked token must never pass
+			return Claims{}, fmt.Errorf("%w: denylist: %v", ErrInvalidToken, err)
+		}
+		if denied {
+			return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, ErrRevokedToken)
+		}
+	}
+	if i.Credentials != nil {
+		v, err := i.Credentials.CredentialsVersion(c.Subject)
+		if err != nil {
+			// Fail closed, as for the denylist
+			return Claims{}, fmt.Errorf("%w: credentials: %v", ErrInvalidToken, err)
+		}
+		if c.CredentialsVersion != v {
+			return Claims{}, fmt.Errorf("%w: %v", ErrInvalidToken, ErrStaleCredentials)
+		}
+	}
+	return c, nil
+}
+
+// Revoke puts the token described by c on the denylist until it expires.
+// It is a no-op without a denylist.
+func (i *Issuer) Revoke(c Claims) error {
+	if i.Denylist == nil || c.ID == "" || c.ExpiresAt == nil {
+		return nil
+	}
+	return i.Denylist.Deny(c.ID, c.ExpiresAt.Add(i.Leeway))
+}
+
+// keyfunc picks the verification key named by the kid header, falling back
+// to the current key for tokens issued without one.
+func (i *Issuer) keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		kid = i.kid
+	}
+	k, ok := i.verify[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	return k, nil
+}
+
+// NewRefreshToken returns a new opaque refresh token and the hash to store
+// in its place
+func NewRefreshToken() (token, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	token = base64.RawURLEncoding.EncodeToString(b)
+	return token, HashRefreshToken(token), nil
+}
+
+// HashRefreshToken returns the stored form of a refresh token
+func HashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewGuestSession returns a new opaque guest session, handed to a client
+// posting addresses and cards without a customer, and the hash they are
+// stored with
+func NewGuestSession() (session, hash string, err error) {
+	return NewRefreshToken()
+}
+
+// ValidGuestSession reports whether session is of the form NewGuestSession
+// returns
+func ValidGuestSession(session string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(session)
+	return err == nil && len(b) == 32
+}
+
+// HashGuestSession returns the stored form of a guest session
+func HashGuestSession(session string) string {
+	return HashRefreshToken(session)
+}
+
+// LoadKey returns the key stored in file, trailing newlines trimmed, or the
+// value of the environment variable env when file is empty.
+func LoadKey(file, env string) ([]byte, error) {
+	if file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(b, "\r\n"), nil
+	}
+	if v := os.Getenv(env); v != "" {
+		return []byte(v), nil
+	}
+	return nil, ErrNoKey
+}
+
+func parseRSAPublicKey(key []byte) (*rsa.PublicKey, error) {
+	if strings.Contains(string(key), "PRIVATE KEY") {
+		pk, err := jwt.ParseRSAPrivateKeyFromPEM(key)
+		if err != nil {
+			return nil, err
+		}
+		return &pk.PublicKey, nil
+	}
+	return jwt.ParseRSAPublicKeyFromPEM(key)
+}
+
+// keyID derives a stable, non-secret identifier for a key
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// rsaKeyID identifies an RSA key pair by its public half, so the private and
+// public PEM of the same pair share an id
+func rsaKeyID(pub *rsa.PublicKey) string {
+	return keyID(pub.N.Bytes())
+}
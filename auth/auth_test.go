@@ -0,0 +1,263 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIssueParseHS256(t *testing.T) {
+	i, err := NewIssuer(HS256, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := i.Issue("57a98d98e4b00679b4a830af", "Eve_Berger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := i.Parse(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.UserID() != "57a98d98e4b00679b4a830af" || c.Username != "Eve_Berger" {
+		t.Errorf("Unexpected claims %+v", c)
+	}
+	if c.ExpiresAt == nil {
+		t.Error("Expected an expiry")
+	}
+}
+
+func TestIssueParseRS256(t *testing.T) {
+	key := rsaKey(t)
+	i, err := NewIssuer(RS256, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := i.Issue("id", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Parse(tok); err != nil {
+		t.Fatal(err)
+	}
+	h, _ := NewIssuer(HS256, []byte("secret"))
+	if _, err := h.Parse(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected RS256 token rejected by HS256 issuer, received %v", err)
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Now()
+	i, _ := NewIssuer(HS256, []byte("secret"))
+	i.TTL = time.Minute
+	i.Leeway = 10 * time.Second
+	i.Now = func() time.Time { return now }
+	tok, _ := i.Issue("id", "user")
+
+	i.Now = func() time.Time { return now.Add(time.Minute + 5*time.Second) }
+	if _, err := i.Parse(tok); err != nil {
+		t.Errorf("Expected token within leeway to be accepted, received %v", err)
+	}
+	i.Now = func() time.Time { return now.Add(time.Minute + 20*time.Second) }
+	if _, err := i.Parse(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected expired token rejected, received %v", err)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	old, _ := NewIssuer(HS256, []byte("old"))
+	tok, _ := old.Issue("id", "user")
+
+	i, _ := NewIssuer(HS256, []byte("new"))
+	if _, err := i.Parse(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected token from unknown key rejected, received %v", err)
+	}
+	if err := i.AddVerificationKey([]byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Parse(tok); err != nil {
+		t.Errorf("Expected token from previous key accepted, received %v", err)
+	}
+}
+
+func TestNewIssuerErrors(t *testing.T) {
+	if _, err := NewIssuer(HS256, nil); err != ErrNoKey {
+		t.Errorf("Expected ErrNoKey, received %v", err)
+	}
+	if _, err := NewIssuer("none", []byte("secret")); err != ErrUnknownAlgorithm {
+		t.Errorf("Expected ErrUnknownAlgorithm, received %v", err)
+	}
+	if _, err := NewIssuer(RS256, []byte("not a pem")); err == nil {
+		t.Error("Expected error for invalid RSA key")
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(file, []byte("secret\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TEST_KEY", "from env")
+	key, err := LoadKey(file, "TEST_KEY")
+	if err != nil || string(key) != "secret" {
+		t.Errorf("Expected trimmed key from file, received %q, %v", key, err)
+	}
+	missing := filepath.Join(t.TempDir(), "missing")
+	if _, err := LoadKey(missing, "TEST_KEY"); err == nil || !strings.Contains(err.Error(), missing) {
+		t.Errorf("Expected error naming %v, received %v", missing, err)
+	}
+	if key, err := LoadKey("", "TEST_KEY"); err != nil || string(key) != "from env" {
+		t.Errorf("Expected key from env, received %q, %v", key, err)
+	}
+}
+
+func rsaKey(t *testing.T) []byte {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(pk)})
+}
+
+func TestRolesAndContext(t *testing.T) {
+	i, _ := NewIssuer(HS256, []byte("secret"))
+	tok, _ := i.Issue("id", "user", RoleAdmin)
+	c, err := i.Parse(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.HasRole(RoleAdmin) || c.HasRole("customer") {
+		t.Errorf("Unexpected roles %v", c.Roles)
+	}
+	if _, ok := FromContext(context.Background()); ok {
+		t.Error("Expected no claims in empty context")
+	}
+	got, ok := FromContext(NewContext(context.Background(), c))
+	if !ok || got.UserID() != "id" {
+		t.Errorf("Expected claims from context, received %+v", got)
+	}
+}
+
+func TestNewRefreshToken(t *testing.T) {
+	tok, hash, err := NewRefreshToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok == hash || HashRefreshToken(tok) != hash {
+		t.Errorf("Expected stored hash of token, received %v for %v", hash, tok)
+	}
+	other, _, _ := NewRefreshToken()
+	if other == tok {
+		t.Error("Expected distinct tokens")
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	i, _ := NewIssuer(HS256, []byte("secret"))
+	ch, err := i.IssueChallenge("id", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Parse(ch); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a challenge refused as access token, received %v", err)
+	}
+	c, err := i.ParseChallenge(ch)
+	if err != nil || c.UserID() != "id" {
+		t.Errorf("Expected challenge claims, received %+v %v", c, err)
+	}
+	tok, _ := i.Issue("id", "user")
+	if _, err := i.ParseChallenge(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected an access token refused as challenge, received %v", err)
+	}
+}
+
+func TestTenantTokens(t *testing.T) {
+	i, _ := NewIssuer(HS256, []byte("secret"))
+	a, b := i.ForTenant("a"), i.ForTenant("b")
+	tok, err := a.Issue("id", "user", RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := a.Parse(tok)
+	if err != nil || c.Tenant != "a" {
+		t.Errorf("Expected claims of tenant a, received %+v %v", c, err)
+	}
+	if _, err := b.Parse(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a token refused by another tenant, received %v", err)
+	}
+	if _, err := i.Parse(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a tenant token refused without a tenant, received %v", err)
+	}
+	tok, _ = i.Issue("id", "user", RoleAdmin)
+	if _, err := a.Parse(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a token of no tenant refused by a tenant, received %v", err)
+	}
+}
+
+// versions are the credentials versions of users, failing for missing ones
+type versions map[string]int64
+
+func (v versions) CredentialsVersion(id string) (int64, error) {
+	n, ok := v[id]
+	if !ok {
+		return 0, errors.New("unreachable")
+	}
+	return n, nil
+}
+
+func TestCredentialsVersion(t *testing.T) {
+	i, _ := NewIssuer(HS256, []byte("secret"))
+	v := versions{"id": 1}
+	i.Credentials = v
+	old, _ := i.IssueVersion("id", "user", 1)
+	if c, err := i.Parse(old); err != nil || c.CredentialsVersion != 1 {
+		t.Fatalf("Expected a token of the current version accepted, received %+v %v", c, err)
+	}
+	v["id"] = 2
+	if _, err := i.Parse(old); !errors.Is(err, ErrInvalidToken) || !strings.Contains(err.Error(), ErrStaleCredentials.Error()) {
+		t.Errorf("Expected a token of an older version refused, received %v", err)
+	}
+	current, _ := i.IssueVersion("id", "user", 2)
+	if _, err := i.Parse(current); err != nil {
+		t.Errorf("Expected a token of the new version accepted, received %v", err)
+	}
+	other, _ := i.Issue("other", "user")
+	if _, err := i.Parse(other); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected a token refused when its version cannot be read, received %v", err)
+	}
+	if i.ForTenant("a").Credentials != nil {
+		t.Error("Expected the credentials versions not shared with a tenant")
+	}
+}
+
+func TestImpersonation(t *testing.T) {
+	i, _ := NewIssuer(HS256, []byte("secret"))
+	now := time.Now().Truncate(time.Second)
+	i.Now = func() time.Time { return now }
+	tok, err := i.IssueImpersonation("id", "user", 0, "admin-id", "customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := i.Parse(tok)
+	if err != nil || c.UserID() != "id" || c.Impersonator != "admin-id" {
+		t.Fatalf("Expected the customer as subject and the impersonator, received %+v %v", c, err)
+	}
+	if d := c.ExpiresAt.Sub(now); d != i.ImpersonationTTL {
+		t.Errorf("Expected the token valid for %v, received %v", i.ImpersonationTTL, d)
+	}
+	if !Impersonated(tok) {
+		t.Error("Expected an impersonation token told apart")
+	}
+	plain, _ := i.Issue("id", "user")
+	if Impersonated(plain) || Impersonated("garbage") {
+		t.Error("Expected other tokens not taken for impersonation tokens")
+	}
+}
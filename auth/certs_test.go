@@ -0,0 +1,165 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Minute)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	kb, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+func TestCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	server := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	spiffe, _ := url.Parse("spiffe://shop/orders")
+	client := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "orders"},
+		URIs:        []*url.URL{spiffe},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := server.write(t, dir, "server")
+
+	certs, err := LoadCertificates(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) > 0 {
+			w.Write([]byte(ClientIdentity(r.TLS.VerifiedChains[0][0])))
+		}
+	}))
+	ts.TLS = certs.TLSConfig(true)
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	get := func(certs ...tls.Certificate) (string, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := c.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b := make([]byte, 100)
+		n, _ := resp.Body.Read(b)
+		return string(b[:n]), nil
+	}
+	if id, err := get(client.tls()); err != nil || id != "spiffe://shop/orders" {
+		t.Errorf("Expected client identity, received %q %v", id, err)
+	}
+	if _, err := get(); err == nil {
+		t.Error("Expected connection without client certificate refused")
+	}
+
+	// A rotated server certificate is used for new connections
+	rotated := newTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "rotated"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca)
+	rotated.write(t, dir, "server")
+	if err := certs.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{client.tls()}, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if cn := conn.ConnectionState().PeerCertificates[0].Subject.CommonName; cn != "rotated" {
+		t.Errorf("Expected rotated certificate, received %v", cn)
+	}
+	if p := conn.ConnectionState().NegotiatedProtocol; p != "h2" {
+		t.Errorf("Expected h2 negotiated, received %q", p)
+	}
+
+	os.WriteFile(caFile, []byte("garbage"), 0600)
+	if err := certs.Reload(); err == nil {
+		t.Error("Expected reload of a broken CA bundle to fail")
+	}
+}
+
+func TestClientIdentity(t *testing.T) {
+	for _, tc := range []struct {
+		cert x509.Certificate
+		want string
+	}{
+		{x509.Certificate{Subject: pkix.Name{CommonName: "cn"}, DNSNames: []string{"orders.shop"}}, "orders.shop"},
+		{x509.Certificate{Subject: pkix.Name{CommonName: "cn"}}, "cn"},
+	} {
+		if got := ClientIdentity(&tc.cert); got != tc.want {
+			t.Errorf("Expected %v, received %v", tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package auth
+
+// denylist.go contains the stores of revoked access tokens. Access tokens
+// are stateless, so a token revoked before its expiry is remembered by id
+// until it would have expired anyway.
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrRevokedToken is returned by Parse for a token on the denylist
+var ErrRevokedToken = errors.New("Revoked token")
+
+// Denylist stores the ids of revoked tokens until they expire
+type Denylist interface {
+	// Deny revokes the token with id jti until the given time
+	Deny(jti string, until time.Time) error
+	// Denied reports whether the token with id jti has been revoked
+	Denied(jti string) (bool, error)
+	// Ping reports whether the backend is reachable
+	Ping() error
+	// Backend names the backend for health reporting
+	Backend() string
+}
+
+// MemoryDenylist is a Denylist local to the process. Revocations are
+// effective immediately on this replica but never reach other replicas, so
+// it suits single replica deployments.
+type MemoryDenylist struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+	now     func() time.Time
+}
+
+// NewMemoryDenylist returns an empty in-memory denylist
+func NewMemoryDenylist() *MemoryDenylist {
+	return &MemoryDenylist{entries: make(map[string]time.Time), now: time.Now}
+}
+
+// Deny revokes the token with id jti until the given time
+func (d *MemoryDenylist) Deny(jti string, until time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := d.now()
+	// Sweep on write so the map is bounded by the tokens live at once
+	for k, exp := range d.entries {
+		if !now.Before(exp) {
+			delete(d.entries, k)
+		}
+	}
+	d.entries[jti] = until
+	return nil
+}
+
+// Denied reports whether the token with id jti has been revoked
+func (d *MemoryDenylist) Denied(jti string) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	exp, ok := d.entries[jti]
+	return ok && d.now().Before(exp), nil
+}
+
+// Ping always succeeds
+func (d *MemoryDenylist) Ping() error {
+	return nil
+}
+
+// Backend returns "memory"
+func (d *MemoryDenylist) Backend() string {
+	return "memory"
+}
+
+// RedisDenylist is a Denylist shared by every replica through Redis. Every
+// check reads Redis, so a revocation is effective everywhere as soon as
+// Deny returns.
+type RedisDenylist struct {
+	client *redis.Client
+	// Prefix is prepended to the token ids to form the Redis keys
+	Prefix string
+	// Timeout bounds every Redis call
+	Timeout time.Duration
+}
+
+// NewRedisDenylist returns a denylist stored in the Redis server at addr
+func NewRedisDenylist(addr, password string) *RedisDenylist {
+	return &RedisDenylist{
+		client:  redis.NewClient(&redis.Options{Addr: addr, Password: password}),
+		Prefix:  "user:denylist:",
+		Timeout: time.Second,
+	}
+}
+
+// Deny revokes the token with id jti until the given time
+func (d *RedisDenylist) Deny(jti string, until time.Time) error {
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+	return d.client.Set(ctx, d.Prefix+jti, 1, ttl).Err()
+}
+
+// Denied reports whether the token with id jti has been revoked
+func (d *RedisDenylist) Denied(jti string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+	n, err := d.client.Exists(ctx, d.Prefix+jti).Result()
+	return n > 0, err
+}
+
+// Ping reports whether Redis is reachable
+func (d *RedisDenylist) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.Timeout)
+	defer cancel()
+	return d.client.Ping(ctx).Err()
+}
+
+// Backend returns "redis"
+func (d *RedisDenylist) Backend() string {
+	return "redis"
+}
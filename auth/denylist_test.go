@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryDenylist(t *testing.T) {
+	now := time.Now()
+	d := NewMemoryDenylist()
+	d.now = func() time.Time { return now }
+	d.Deny("a", now.Add(time.Minute))
+	if denied, _ := d.Denied("a"); !denied {
+		t.Error("Expected a denied")
+	}
+	if denied, _ := d.Denied("b"); denied {
+		t.Error("Expected b allowed")
+	}
+	d.now = func() time.Time { return now.Add(2 * time.Minute) }
+	if denied, _ := d.Denied("a"); denied {
+		t.Error("Expected a allowed after expiry")
+	}
+	d.Deny("b", now.Add(time.Hour))
+	if _, ok := d.entries["a"]; ok {
+		t.Error("Expected expired entries swept")
+	}
+}
+
+func TestRevoke(t *testing.T) {
+	i, _ := NewIssuer(HS256, []byte("secret"))
+	i.Denylist = NewMemoryDenylist()
+	tok, _ := i.Issue("id", "user")
+	other, _ := i.Issue("id", "user")
+	c, err := i.Parse(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Revoke(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := i.Parse(tok); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Expected revoked token rejected, received %v", err)
+	}
+	if _, err := i.Parse(other); err != nil {
+		t.Errorf("Expected other token of the user accepted, received %v", err)
+	}
+}
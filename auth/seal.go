@@ -0,0 +1,62 @@
+package auth
+
+// seal.go contains the encryption of secrets stored alongside users, such
+// as TOTP secrets, so a dump of the database does not reveal them.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+)
+
+// ErrUnsealed is returned when a sealed value cannot be decrypted
+var ErrUnsealed = errors.New("Cannot unseal value")
+
+// Sealer encrypts and authenticates values with AES-GCM
+type Sealer struct {
+	aead cipher.AEAD
+}
+
+// NewSealer returns a Sealer keyed by the SHA-256 of key, so keys of any
+// length can be configured.
+func NewSealer(key []byte) (*Sealer, error) {
+	if len(key) == 0 {
+		return nil, ErrNoKey
+	}
+	k := sha256.Sum256(key)
+	block, err := aes.NewCipher(k[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Sealer{aead: aead}, nil
+}
+
+// Seal returns the encrypted, base64 encoded form of plaintext
+func (s *Sealer) Seal(plaintext string) (string, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(s.aead.Seal(nonce, nonce, []byte(plaintext), nil)), nil
+}
+
+// Open returns the plaintext of a value returned by Seal
+func (s *Sealer) Open(sealed string) (string, error) {
+	b, err := base64.RawStdEncoding.DecodeString(sealed)
+	if err != nil || len(b) < s.aead.NonceSize() {
+		return "", ErrUnsealed
+	}
+	n := s.aead.NonceSize()
+	p, err := s.aead.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return "", ErrUnsealed
+	}
+	return string(p), nil
+}
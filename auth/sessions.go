@@ -0,0 +1,166 @@
+package auth
+
+// sessions.go contains the server-side session stores backing opaque
+// session cookies. A session maps a random id to the access token it stands
+// for, so the token itself never reaches the browser.
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrNoSession is returned for an unknown or expired session id
+var ErrNoSession = errors.New("No such session")
+
+// SessionStore keeps sessions until they expire or are deleted
+type SessionStore interface {
+	// Create stores token under a new session id for ttl
+	Create(token string, ttl time.Duration) (string, error)
+	// Get returns the token of the session
+	Get(id string) (string, error)
+	// Delete ends the session
+	Delete(id string) error
+	// Ping reports whether the backend is reachable
+	Ping() error
+	// Backend names the backend for health reporting
+	Backend() string
+}
+
+type session struct {
+	token   string
+	expires time.Time
+}
+
+// MemorySessionStore is a SessionStore local to the process, so sessions
+// only work against the replica that created them.
+type MemorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]session
+	now      func() time.Time
+}
+
+// NewMemorySessionStore returns an empty in-memory session store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{sessions: make(map[string]session), now: time.Now}
+}
+
+// Create stores token under a new session id for ttl
+func (m *MemorySessionStore) Create(token string, ttl time.Duration) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := m.now()
+	// Sweep on write so the map is bounded by the sessions live at once
+	for k, s := range m.sessions {
+		if !now.Before(s.expires) {
+			delete(m.sessions, k)
+		}
+	}
+	m.sessions[id] = session{token: token, expires: now.Add(ttl)}
+	return id, nil
+}
+
+// Get returns the token of the session
+func (m *MemorySessionStore) Get(id string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.sessions[id]
+	if !ok || !m.now().Before(s.expires) {
+		return "", ErrNoSession
+	}
+	return s.token, nil
+}
+
+// Delete ends the session
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, id)
+	return nil
+}
+
+// Ping always succeeds
+func (m *MemorySessionStore) Ping() error {
+	return nil
+}
+
+// Backend returns "memory"
+func (m *MemorySessionStore) Backend() string {
+	return "memory"
+}
+
+// RedisSessionStore is a SessionStore shared by every replica through Redis
+type RedisSessionStore struct {
+	client *redis.Client
+	// Prefix is prepended to the session ids to form the Redis keys
+	Prefix string
+	// Timeout bounds every Redis call
+	Timeout time.Duration
+}
+
+// NewRedisSessionStore returns a session store in the Redis server at addr
+func NewRedisSessionStore(addr, password string) *RedisSessionStore {
+	return &RedisSessionStore{
+		client:  redis.NewClient(&redis.Options{Addr: addr, Password: password}),
+		Prefix:  "user:session:",
+		Timeout: time.Second,
+	}
+}
+
+// Create stores token under a new session id for ttl
+func (r *RedisSessionStore) Create(token string, ttl time.Duration) (string, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	return id, r.client.Set(ctx, r.Prefix+id, token, ttl).Err()
+}
+
+// Get returns the token of the session
+func (r *RedisSessionStore) Get(id string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	token, err := r.client.Get(ctx, r.Prefix+id).Result()
+	if err == redis.Nil {
+		return "", ErrNoSession
+	}
+	return token, err
+}
+
+// Delete ends the session
+func (r *RedisSessionStore) Delete(id string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	return r.client.Del(ctx, r.Prefix+id).Err()
+}
+
+// Ping reports whether Redis is reachable
+func (r *RedisSessionStore) Ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	return r.client.Ping(ctx).Err()
+}
+
+// Backend returns "redis"
+func (r *RedisSessionStore) Backend() string {
+	return "redis"
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,36 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStore(t *testing.T) {
+	now := time.Now()
+	m := NewMemorySessionStore()
+	m.now = func() time.Time { return now }
+	id, err := m.Create("token", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok, err := m.Get(id); err != nil || tok != "token" {
+		t.Errorf("Expected token, received %q %v", tok, err)
+	}
+	if _, err := m.Get("unknown"); err != ErrNoSession {
+		t.Errorf("Expected ErrNoSession, received %v", err)
+	}
+	m.Delete(id)
+	if _, err := m.Get(id); err != ErrNoSession {
+		t.Errorf("Expected deleted session gone, received %v", err)
+	}
+
+	id, _ = m.Create("token", time.Minute)
+	m.now = func() time.Time { return now.Add(2 * time.Minute) }
+	if _, err := m.Get(id); err != ErrNoSession {
+		t.Errorf("Expected expired session gone, received %v", err)
+	}
+	m.Create("other", time.Minute)
+	if _, ok := m.sessions[id]; ok {
+		t.Error("Expected expired sessions swept")
+	}
+}
@@ -0,0 +1,121 @@
+package auth
+
+// totp.go implements the time based one time passwords of RFC 6238 as used
+// by authenticator apps: HMAC-SHA1, 30 second steps and 6 digits.
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// TOTPPeriod is the length of a time step
+	TOTPPeriod = 30 * time.Second
+	// TOTPSkew is the number of steps either side of now a code is accepted
+	TOTPSkew   = 1
+	totpDigits = 6
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a new base32 encoded secret
+func NewTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+// TOTPURI returns the otpauth:// URI authenticator apps enroll from
+func TOTPURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(int(TOTPPeriod.Seconds())))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// TOTPStep returns the time step t falls in
+func TOTPStep(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod.Seconds())
+}
+
+// TOTPCode returns the code of secret for the given step
+func TOTPCode(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000), nil
+}
+
+// VerifyTOTP checks code against the steps around t, tolerating TOTPSkew
+// steps of clock skew. Steps up to and including lastStep were used already
+// and are refused, so each code works once. It returns the matching step,
+// which the caller must record as the new last step.
+func VerifyTOTP(secret, code string, t time.Time, lastStep int64) (int64, bool) {
+	now := TOTPStep(t)
+	for step := now - TOTPSkew; step <= now+TOTPSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		want, err := TOTPCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// NewRecoveryCodes returns n single use recovery codes and the hashes to
+// store in their place
+func NewRecoveryCodes(n int) (codes, hashes []string, err error) {
+	for k := 0; k < n; k++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		c := strings.ToLower(totpEncoding.EncodeToString(b))
+		c = c[:4] + "-" + c[4:]
+		codes = append(codes, c)
+		hashes = append(hashes, HashRecoveryCode(c))
+	}
+	return codes, hashes, nil
+}
+
+// HashRecoveryCode returns the stored form of a recovery code, ignoring case
+// and dashes
+func HashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA1, truncated to 6 digits
+func TestTOTPCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	} {
+		got, err := TOTPCode(secret, TOTPStep(time.Unix(unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("At %d expected %s, received %s", unix, want, got)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	step := TOTPStep(now)
+	for _, d := range []int64{-1, 0, 1} {
+		code, _ := TOTPCode(secret, step+d)
+		got, ok := VerifyTOTP(secret, code, now, 0)
+		if !ok || got != step+d {
+			t.Errorf("Expected code of step %+d accepted, received %d %v", d, got, ok)
+		}
+	}
+	for _, d := range []int64{-2, 2} {
+		code, _ := TOTPCode(secret, step+d)
+		if _, ok := VerifyTOTP(secret, code, now, 0); ok {
+			t.Errorf("Expected code of step %+d refused", d)
+		}
+	}
+	code, _ := TOTPCode(secret, step)
+	if _, ok := VerifyTOTP(secret, code, now, step); ok {
+		t.Error("Expected a used code refused")
+	}
+	if _, ok := VerifyTOTP(secret, code, now, step-1); !ok {
+		t.Error("Expected a code after the last used step accepted")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := TOTPURI("Sock Shop", "Eve_Berger", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/Sock%20Shop:Eve_Berger?") {
+		t.Errorf("Unexpected URI %s", uri)
+	}
+	if !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") || !strings.Contains(uri, "issuer=Sock+Shop") {
+		t.Errorf("Unexpected URI %s", uri)
+	}
+}
+
+func TestSealer(t *testing.T) {
+	s, err := NewSealer([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := s.Seal("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(sealed, "JBSWY3DPEHPK3PXP") {
+		t.Error("Expected the value encrypted")
+	}
+	if got, err := s.Open(sealed); err != nil || got != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("Expected the value back, received %q %v", got, err)
+	}
+	other, _ := NewSealer([]byte("other"))
+	if _, err := other.Open(sealed); err != ErrUnsealed {
+		t.Errorf("Expected ErrUnsealed with another key, received %v", err)
+	}
+	if _, err := NewSealer(nil); err != ErrNoKey {
+		t.Errorf("Expected ErrNoKey, received %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+package db
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/baggage"
+)
+
+// UserBaggageKey is the baggage member carrying the id of the user a
+// request was authenticated as, for the spans of the services the request
+// reaches to be searchable by customer
+const UserBaggageKey = "user.id"
+
+// UserFromBaggage returns the user id in the baggage of ctx, empty when it
+// carries none
+func UserFromBaggage(ctx context.Context) string {
+	return baggage.FromContext(ctx).Member(UserBaggageKey).Value()
+}
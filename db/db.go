@@ -3,11 +3,9 @@ package db
 import (
 	"context"
 	"errors"
-	"flag"
 	"fmt"
-	"os"
+	"time"
 
-	"github.com/microservices-demo/user/db/mongodb"
 	"github.com/microservices-demo/user/users"
 )
 
@@ -16,163 +14,277 @@ import (
 type Database interface {
 	Init() error
 	GetUserByName(string) (users.User, error)
+	// GetUserBySkeleton returns a user whose username has the given
+	// users.UsernameSkeleton
+	GetUserBySkeleton(skeleton string) (users.User, error)
 	GetUser(string) (users.User, error)
 	GetUsers() ([]users.User, error)
+	//GetUsersSorted lists the users like GetUsers, in the order of s
+	GetUsersSorted(s Sort) ([]users.User, error)
+	//CreateUser stores the user with its addresses and cards, all or none
+	//of them, setting the ids of each
 	CreateUser(*users.User) error
+	UpdateUser(*users.User) error
+	PatchUser(string, users.UserPatch) error
+	SetUserPassword(id, hash, salt string) error
+	// ReplaceUserPassword sets the password hash and salt of the user like
+	// SetUserPassword, returning ErrVersionMismatch when its hash is no
+	// longer old
+	ReplaceUserPassword(id, old, hash, salt string) error
+	// SetUserRoles replaces the roles of the user
+	SetUserRoles(id string, roles []string) error
+	// SetUserStatus sets the account status of the user
+	SetUserStatus(id, status string) error
+	// BumpCredentialsVersion increments the CredentialsVersion of the user
+	BumpCredentialsVersion(id string) error
+	// UpdateUserPreferences sets the preferences of the user changed, a nil
+	// value unsetting its key, leaving the others as they are, and returns
+	// the preferences then held
+	UpdateUserPreferences(id string, changes map[string]*string) (map[string]string, error)
+	// GetUserByEmail returns the user holding email among its verified
+	// Emails
+	GetUserByEmail(email string) (users.User, error)
+	// SetUserEmails replaces the primary email and the other emails of the
+	// user at the given version, returning ErrVersionMismatch when the user
+	// changed since, and an AlreadyExistsError on the email when another
+	// user holds any of them
+	SetUserEmails(id, primary string, emails []users.EmailAddress, version int64) error
+	// AppendConsents appends records to the consent history of the user,
+	// which is never rewritten
+	AppendConsents(id string, records []users.ConsentRecord) error
+	// CreateRefreshToken stores t for the user, dropping expired tokens
+	CreateRefreshToken(userID string, t users.RefreshToken) error
+	// UseRefreshToken atomically marks the token with the given hash as
+	// used, returning its owner and its state from before the call
+	UseRefreshToken(hash string) (string, users.RefreshToken, error)
+	// GetRefreshTokens returns the active refresh tokens of the user
+	GetRefreshTokens(userID string) ([]users.RefreshToken, error)
+	// RevokeRefreshTokens revokes the user's tokens with the given ids, or
+	// all of them when no ids are given
+	RevokeRefreshTokens(userID string, ids ...string) error
+	// GetMFA returns the two-factor enrollment of the user, the zero MFA
+	// when there is none
+	GetMFA(userID string) (users.MFA, error)
+	// SetMFA replaces the two-factor enrollment of the user; the zero MFA
+	// removes it
+	SetMFA(userID string, m users.MFA) error
+	// UseMFAStep atomically records step as the last used TOTP step,
+	// returning ErrNotFound unless it is newer than the recorded one
+	UseMFAStep(userID string, step int64) error
+	// UseRecoveryCode atomically removes the recovery code with the given
+	// hash, returning ErrNotFound when the user has no such code
+	UseRecoveryCode(userID, hash string) error
 	GetUserAttributes(*users.User) error
 	GetAddress(string) (users.Address, error)
 	GetAddresses() ([]users.Address, error)
 	CreateAddress(*users.Address, string) error
+	// SetDefaultAddress makes the address with id addressID the default of
+	// type typ, users.AddressShipping or users.AddressBilling, of the user,
+	// returning ErrNotFound unless the user holds the address. Deleting the
+	// address clears the default.
+	SetDefaultAddress(userID, addressID, typ string) error
 	GetCard(string) (users.Card, error)
 	GetCards() ([]users.Card, error)
-	Delete(string, string) error
+	// SetCardLabel replaces the label of the card with id cardID, returning
+	// ErrNotFound unless the user holds the card
+	SetCardLabel(userID, cardID, label string) error
+	// SetDefaultCard makes the card with id cardID the default card of the
+	// user, returning ErrNotFound unless the user holds the card. The first
+	// card a user gets is its default until another is set; deleting the
+	// default card makes the first card left the default.
+	SetDefaultCard(userID, cardID string) error
+	//Delete removes the entity with the given id. A customer is only
+	//removed at the given version, unless it is AnyVersion.
+	Delete(entity, id string, version int64) error
+	// AnonymizeUser erases the personal data of a customer, deleting its
+	// addresses and cards, while keeping the document and its id
+	AnonymizeUser(id string) error
 	CreateCard(*users.Card, string) error
+	// LinkAttribute links the address or card with the given id, as entity
+	// is "addresses" or "cards", created without a customer in the guest
+	// session with hash guest to the user. It returns a NotFoundError when
+	// there is no such entity or it was created in another session, and
+	// ErrAlreadyLinked when a customer holds it already.
+	LinkAttribute(entity, id, userID, guest string) error
 	Ping() error
 }
 
-var (
-	database string
-	//DefaultDb is the database set for the microservice
-	DefaultDb Database
-	//DBTypes is a map of DB interfaces that can be used for this service
-	DBTypes = map[string]Database{}
-	//ErrNoDatabaseFound error returnes when database interface does not exists in DBTypes
-	ErrNoDatabaseFound = "No database with name %v registered"
-	//ErrNoDatabaseSelected is returned when no database was designated in the flag or env
-	ErrNoDatabaseSelected = errors.New("No DB selected")
-)
+//Sort orders a listing by Field, in descending order when Desc. Ties, and
+//listings without a Field, are ordered by id, so the pages of a listing are
+//stable.
+type Sort struct {
+	Field string
+	Desc  bool
+}
 
-func init() {
-	flag.StringVar(&database, "database", os.Getenv("USER_DATABASE"), "Database to use, Mongodb or ...")
+//AnyVersion makes Delete unconditional
+const AnyVersion int64 = -1
 
-}
+//UserSortFields are the fields users can be sorted by
+var UserSortFields = []string{"username", "firstName", "lastName", "email", "createdAt"}
 
-//Init inits the selected DB in DefaultDb
-func Init() error {
-	if database == "" {
-		return ErrNoDatabaseSelected
-	}
-	err := Set()
-	if err != nil {
-		return err
-	}
-	return DefaultDb.Init()
+//AuditEntry records a sensitive operation and who performed it
+type AuditEntry struct {
+	Time      time.Time `json:"time" bson:"time"`
+	Action    string    `json:"action" bson:"action"`
+	Entity    string    `json:"entity" bson:"entity"`
+	ID        string    `json:"id" bson:"id"`
+	Principal string    `json:"principal" bson:"principal"`
+	// Reason is the reason the principal gave, if any
+	Reason string `json:"reason,omitempty" bson:"reason,omitempty"`
+	// Changes are those made by an update, sensitive values masked
+	Changes []users.FieldChange `json:"changes,omitempty" bson:"changes,omitempty"`
+	// Method is the endpoint called, for the requests of an impersonation
+	Method string `json:"method,omitempty" bson:"method,omitempty"`
 }
 
-//Set the DefaultDb
-func Set() error {
-	if v, ok := DBTypes[database]; ok {
-		DefaultDb = v
-		return nil
-	}
-	return fmt.Errorf(ErrNoDatabaseFound, database)
+//Auditor is implemented by databases that keep an audit log
+type Auditor interface {
+	RecordAudit(AuditEntry) error
 }
 
-//Register registers the database interface in the DBTypes
-func Register(name string, db Database) {
-	DBTypes[name] = db
+//Closer is implemented by databases holding connections to release at
+//shutdown
+type Closer interface {
+	Close() error
 }
 
-//SetTraceContext sets the context for tracing database operations
-func SetTraceContext(ctx context.Context) {
-	mongodb.SetTraceContext(ctx)
+//Streamer is implemented by databases able to list entities one at a
+//time rather than holding the whole listing in memory. A listing stops at
+//the first error fn returns, which is returned.
+type Streamer interface {
+	StreamUsers(s Sort, fn func(users.User) error) error
+	StreamAddresses(fn func(users.Address) error) error
+	StreamCards(fn func(users.Card) error) error
 }
 
-//CreateUser invokes DefaultDb method
-func CreateUser(u *users.User) error {
-	return DefaultDb.CreateUser(u)
+//AttributeJoiner is implemented by databases able to read a user along
+//with its addresses and cards in a single query, rather than the user and
+//then GetUserAttributes
+type AttributeJoiner interface {
+	GetUserByNameWithAttributes(name string) (users.User, error)
 }
 
-//GetUserByName invokes DefaultDb method
-func GetUserByName(n string) (users.User, error) {
-	u, err := DefaultDb.GetUserByName(n)
-	if err == nil {
-		u.AddLinks()
-	}
-	return u, err
+//TenantOpener is implemented by databases able to keep the data of several
+//tenants apart, each in a database of its own. Nothing stored in the
+//database of one tenant can be read through the database of another.
+type TenantOpener interface {
+	ForTenant(tenant string) (Database, error)
 }
 
-//GetUser invokes DefaultDb method
-func GetUser(n string) (users.User, error) {
-	u, err := DefaultDb.GetUser(n)
-	if err == nil {
-		u.AddLinks()
-	}
-	return u, err
+//Factory constructs a ready to use Database
+type Factory func() (Database, error)
+
+var (
+	//DBTypes is a map of Database factories that can be used for this service
+	DBTypes = map[string]Factory{}
+	//ErrNoDatabaseFound error returnes when database interface does not exists in DBTypes
+	ErrNoDatabaseFound = "No database with name %v registered"
+	//ErrNoDatabaseSelected is returned when no database was designated in the flag or env
+	ErrNoDatabaseSelected = errors.New("No DB selected")
+	//ErrNotFound is returned when the entity to change does not exist
+	ErrNotFound = errors.New("not found")
+	//ErrAlreadyExists is returned when a change would duplicate a unique value
+	ErrAlreadyExists = errors.New("already exists")
+	//ErrAlreadyLinked is returned when linking an address or card held by
+	//a customer to another
+	ErrAlreadyLinked = errors.New("already linked to a customer")
+	//ErrInvalidInput is matched by errors.Is for every error caused by
+	//malformed input rather than by the state of the database
+	ErrInvalidInput = errors.New("invalid input")
+	//ErrVersionMismatch is returned when a conditional change finds the
+	//entity at another version
+	ErrVersionMismatch = errors.New("version mismatch")
+	//ErrNoTenant is returned when opening the database of an unnamed tenant
+	ErrNoTenant = errors.New("No tenant named")
+	//ErrInvalidHexID represents a entity id that is not a valid bson ObjectID
+	ErrInvalidHexID error = InputError("Invalid Id Hex")
+)
+
+//InputError describes malformed input; it matches ErrInvalidInput with
+//errors.Is
+type InputError string
+
+func (e InputError) Error() string {
+	return string(e)
 }
 
-//GetUsers invokes DefaultDb method
-func GetUsers() ([]users.User, error) {
-	us, err := DefaultDb.GetUsers()
-	for k, _ := range us {
-		us[k].AddLinks()
-	}
-	return us, err
+//Is reports whether target is ErrInvalidInput
+func (e InputError) Is(target error) bool {
+	return target == ErrInvalidInput
 }
 
-//GetUserAttributes invokes DefaultDb method
-func GetUserAttributes(u *users.User) error {
-	err := DefaultDb.GetUserAttributes(u)
-	if err != nil {
-		return err
-	}
-	for k, _ := range u.Addresses {
-		u.Addresses[k].AddLinks()
-	}
-	for k, _ := range u.Cards {
-		u.Cards[k].AddLinks()
-	}
-	return nil
+//NotFoundError names the entity that does not exist; it matches ErrNotFound
+//with errors.Is
+type NotFoundError struct {
+	Entity string
+	ID     string
 }
 
-//CreateAddress invokes DefaultDb method
-func CreateAddress(a *users.Address, userid string) error {
-	return DefaultDb.CreateAddress(a, userid)
+func (e NotFoundError) Error() string {
+	return fmt.Sprintf("%v %v not found", e.Entity, e.ID)
 }
 
-//GetAddress invokes DefaultDb method
-func GetAddress(n string) (users.Address, error) {
-	a, err := DefaultDb.GetAddress(n)
-	if err == nil {
-		a.AddLinks()
-	}
-	return a, err
+//Is reports whether target is ErrNotFound
+func (e NotFoundError) Is(target error) bool {
+	return target == ErrNotFound
 }
 
-//GetAddresses invokes DefaultDb method
-func GetAddresses() ([]users.Address, error) {
-	as, err := DefaultDb.GetAddresses()
-	for k, _ := range as {
-		as[k].AddLinks()
-	}
-	return as, err
+//AlreadyExistsError names the field whose value would be duplicated; it
+//matches ErrAlreadyExists with errors.Is
+type AlreadyExistsError struct {
+	Field string
 }
 
-//CreateCard invokes DefaultDb method
-func CreateCard(c *users.Card, userid string) error {
-	return DefaultDb.CreateCard(c, userid)
+func (e AlreadyExistsError) Error() string {
+	return fmt.Sprintf("%v already exists", e.Field)
 }
 
-//GetCard invokes DefaultDb method
-func GetCard(n string) (users.Card, error) {
-	return DefaultDb.GetCard(n)
+//Is reports whether target is ErrAlreadyExists
+func (e AlreadyExistsError) Is(target error) bool {
+	return target == ErrAlreadyExists
 }
 
-//GetCards invokes DefaultDb method
-func GetCards() ([]users.Card, error) {
-	cs, err := DefaultDb.GetCards()
-	for k, _ := range cs {
-		cs[k].AddLinks()
+//UsernameSkeletonField is the Field of the AlreadyExistsError of a username
+//whose users.UsernameSkeleton another user holds, refused by databases keeping
+//skeletons unique
+const UsernameSkeletonField = "username_skeleton"
+
+//Open constructs a new instance of the named database
+func Open(name string) (Database, error) {
+	if name == "" {
+		return nil, ErrNoDatabaseSelected
 	}
-	return cs, err
+	f, ok := DBTypes[name]
+	if !ok {
+		return nil, fmt.Errorf(ErrNoDatabaseFound, name)
+	}
+	return f()
+}
+
+//Register registers the database factory in the DBTypes
+func Register(name string, f Factory) {
+	DBTypes[name] = f
+}
+
+//ContextBinder is implemented by databases tracing their operations, or
+//marking their reads, within the context of the request making them
+type ContextBinder interface {
+	//WithContext returns the database doing its operations within ctx
+	WithContext(ctx context.Context) Database
 }
 
-//Delete invokes DefaultDb method
-func Delete(entity, id string) error {
-	return DefaultDb.Delete(entity, id)
+//WithContext returns d doing its operations within ctx, when it is a
+//ContextBinder, and d otherwise
+func WithContext(d Database, ctx context.Context) Database {
+	if b, ok := d.(ContextBinder); ok && ctx != nil {
+		return b.WithContext(ctx)
+	}
+	return d
 }
 
-//Ping invokes DefaultDB method
-func Ping() error {
-	return DefaultDb.Ping()
+//SourceReporter is implemented by databases able to serve reads from more
+//than one backing source
+type SourceReporter interface {
+	Source() string
 }
@@ -2,7 +2,6 @@ package db
 
 import (
 	"errors"
-	"reflect"
 	"testing"
 
 	"github.com/microservices-demo/user/users"
@@ -11,119 +10,160 @@ import (
 var (
 	TestDB       = fake{}
 	ErrFakeError = errors.New("Fake error")
-	TestAddress  = users.Address{
-		Street:  "street",
-		Number:  "51b",
-		Country: "Netherlands",
-		City:    "Amsterdam",
-		ID:      "000056",
-	}
 )
 
-func TestInit(t *testing.T) {
-	err := Init()
-	if err == nil {
-		t.Error("Expected no registered db error")
-	}
-	Register("test", TestDB)
-	database = "test"
-	err = Init()
-	if err != ErrFakeError {
-		t.Error("expected fake db error from init")
+func TestOpen(t *testing.T) {
+	_, err := Open("")
+	if err != ErrNoDatabaseSelected {
+		t.Error("Expected no database selected error")
 	}
-	TestAddress.AddLinks()
-}
-
-func TestSet(t *testing.T) {
-	database = "nodb"
-	err := Set()
+	_, err = Open("nodb")
 	if err == nil {
-		t.Error("Expecting error for no databade found")
+		t.Error("Expecting error for no database found")
 	}
-	Register("nodb2", TestDB)
-	database = "nodb2"
-	err = Set()
+	Register("test", func() (Database, error) { return TestDB, nil })
+	d, err := Open("test")
 	if err != nil {
 		t.Error(err)
 	}
+	if d != TestDB {
+		t.Error("Expected registered database")
+	}
+	Register("failing", func() (Database, error) { return nil, ErrFakeError })
+	_, err = Open("failing")
+	if err != ErrFakeError {
+		t.Error("expected fake db error from open")
+	}
 }
 
 func TestRegister(t *testing.T) {
+	f := func() (Database, error) { return TestDB, nil }
 	l := len(DBTypes)
-	Register("test2", TestDB)
+	Register("test2", f)
 	if len(DBTypes) != l+1 {
 		t.Errorf("Expecting %v DB types received %v", l+1, len(DBTypes))
 	}
 	l = len(DBTypes)
-	Register("test2", TestDB)
+	Register("test2", f)
 	if len(DBTypes) != l {
 		t.Errorf("Expecting %v DB types received %v duplicate names", l, len(DBTypes))
 	}
 }
 
-func TestCreateUser(t *testing.T) {
-	err := CreateUser(&users.User{})
-	if err != ErrFakeError {
-		t.Error("expected fake db error from create")
-	}
+type fake struct{}
+
+func (f fake) Init() error {
+	return ErrFakeError
+}
+func (f fake) GetUserByName(name string) (users.User, error) {
+	return users.User{}, ErrFakeError
+}
+func (f fake) GetUser(id string) (users.User, error) {
+	return users.User{}, ErrFakeError
 }
 
-func TestGetUser(t *testing.T) {
-	_, err := GetUser("test")
-	if err != ErrFakeError {
-		t.Error("expected fake db error from get")
-	}
+func (f fake) GetUsers() ([]users.User, error) {
+	return make([]users.User, 0), ErrFakeError
 }
 
-func TestGetUserByName(t *testing.T) {
-	_, err := GetUserByName("test")
-	if err != ErrFakeError {
-		t.Error("expected fake db error from get")
-	}
+func (f fake) GetUsersSorted(Sort) ([]users.User, error) {
+	return make([]users.User, 0), ErrFakeError
 }
 
-func TestGetUserAttributes(t *testing.T) {
-	u := users.New()
-	GetUserAttributes(&u)
-	if len(u.Addresses) != 1 {
-		t.Error("expected one address added for GetUserAttributes")
-	}
-	if !reflect.DeepEqual(u.Addresses[0], TestAddress) {
-		t.Error("expected matching addresses")
-	}
+func (f fake) CreateUser(*users.User) error {
+	return ErrFakeError
 }
 
-func TestPing(t *testing.T) {
-	err := Ping()
-	if err != ErrFakeError {
-		t.Error("expected fake db error from ping")
-	}
+func (f fake) UpdateUser(*users.User) error {
+	return ErrFakeError
+}
+
+func (f fake) PatchUser(string, users.UserPatch) error {
+	return ErrFakeError
+}
 
+func (f fake) SetUserPassword(id, hash, salt string) error {
+	return ErrFakeError
 }
 
-type fake struct{}
+func (f fake) ReplaceUserPassword(id, old, hash, salt string) error {
+	return ErrFakeError
+}
 
-func (f fake) Init() error {
+func (f fake) SetUserRoles(string, []string) error {
 	return ErrFakeError
 }
-func (f fake) GetUserByName(name string) (users.User, error) {
-	return users.User{}, ErrFakeError
+
+func (f fake) GetUserBySkeleton(string) (users.User, error) {
+	return users.New(), ErrFakeError
 }
-func (f fake) GetUser(id string) (users.User, error) {
+
+func (f fake) SetUserStatus(string, string) error {
+	return ErrFakeError
+}
+
+func (f fake) UpdateUserPreferences(string, map[string]*string) (map[string]string, error) {
+	return nil, ErrFakeError
+}
+
+func (f fake) GetUserByEmail(string) (users.User, error) {
 	return users.User{}, ErrFakeError
 }
 
-func (f fake) GetUsers() ([]users.User, error) {
-	return make([]users.User, 0), ErrFakeError
+func (f fake) SetUserEmails(string, string, []users.EmailAddress, int64) error {
+	return ErrFakeError
 }
 
-func (f fake) CreateUser(*users.User) error {
+func (f fake) AppendConsents(string, []users.ConsentRecord) error {
+	return ErrFakeError
+}
+
+func (f fake) SetDefaultAddress(string, string, string) error {
+	return ErrFakeError
+}
+
+func (f fake) SetCardLabel(string, string, string) error {
+	return ErrFakeError
+}
+
+func (f fake) SetDefaultCard(string, string) error {
+	return ErrFakeError
+}
+
+func (f fake) CreateRefreshToken(string, users.RefreshToken) error {
+	return ErrFakeError
+}
+
+func (f fake) UseRefreshToken(string) (string, users.RefreshToken, error) {
+	return "", users.RefreshToken{}, ErrFakeError
+}
+
+func (f fake) GetRefreshTokens(string) ([]users.RefreshToken, error) {
+	return make([]users.RefreshToken, 0), ErrFakeError
+}
+
+func (f fake) RevokeRefreshTokens(string, ...string) error {
+	return ErrFakeError
+}
+
+func (f fake) GetMFA(string) (users.MFA, error) {
+	return users.MFA{}, ErrFakeError
+}
+
+func (f fake) SetMFA(string, users.MFA) error {
+	return ErrFakeError
+}
+
+func (f fake) UseMFAStep(string, int64) error {
+	return ErrFakeError
+}
+
+func (f fake) UseRecoveryCode(string, string) error {
 	return ErrFakeError
 }
 
 func (f fake) GetUserAttributes(u *users.User) error {
-	u.Addresses = append(u.Addresses, TestAddress)
-	return nil
+	return ErrFakeError
 }
 
 func (f fake) GetCard(id string) (users.Card, error) {
@@ -150,7 +190,19 @@ func (f fake) CreateAddress(u *users.Address, id string) error {
 	return ErrFakeError
 }
 
-func (f fake) Delete(entity, id string) error {
+func (f fake) Delete(entity, id string, version int64) error {
+	return ErrFakeError
+}
+
+func (f fake) AnonymizeUser(string) error {
+	return ErrFakeError
+}
+
+func (f fake) BumpCredentialsVersion(string) error {
+	return ErrFakeError
+}
+
+func (f fake) LinkAttribute(string, string, string, string) error {
 	return ErrFakeError
 }
 
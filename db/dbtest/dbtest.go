@@ -0,0 +1,1341 @@
+package dbtest
+
+// dbtest.go contains a conformance suite every Database implementation is
+// expected to pass. Implementations run it from their own tests:
+//
+//	dbtest.RunConformanceTests(t, func() db.Database { return memory.New() })
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// RunConformanceTests runs the conformance suite. factory must return an
+// empty, initialised Database on every call.
+func RunConformanceTests(t *testing.T, factory func() db.Database) {
+	tests := []struct {
+		name string
+		test func(*testing.T, db.Database)
+	}{
+		{"CreateUserRoundTrip", testCreateUserRoundTrip},
+		{"CreateUserPopulatesIDs", testCreateUserPopulatesIDs},
+		{"UsernameUniqueness", testUsernameUniqueness},
+		{"EmailUniqueness", testEmailUniqueness},
+		{"GetUserBySkeleton", testGetUserBySkeleton},
+		{"UpdateUser", testUpdateUser},
+		{"PatchUser", testPatchUser},
+		{"SetUserPassword", testSetUserPassword},
+		{"ReplaceUserPassword", testReplaceUserPassword},
+		{"SetUserRoles", testSetUserRoles},
+		{"SetUserStatus", testSetUserStatus},
+		{"CredentialsVersion", testCredentialsVersion},
+		{"UpdateUserPreferences", testUpdateUserPreferences},
+		{"RefreshTokens", testRefreshTokens},
+		{"MFA", testMFA},
+		{"MissingUser", testMissingUser},
+		{"InvalidID", testInvalidID},
+		{"CreateAddressLinksUser", testCreateAddressLinksUser},
+		{"CreateCardLinksUser", testCreateCardLinksUser},
+		{"UserByNameWithAttributes", testUserByNameWithAttributes},
+		{"DefaultAddresses", testDefaultAddresses},
+		{"DefaultCard", testDefaultCard},
+		{"UserEmails", testUserEmails},
+		{"Consents", testConsents},
+		{"SetCardLabel", testSetCardLabel},
+		{"AnonymousAttributes", testAnonymousAttributes},
+		{"LinkAttribute", testLinkAttribute},
+		{"DeleteCustomerCascades", testDeleteCustomerCascades},
+		{"DeleteAttributeUnlinks", testDeleteAttributeUnlinks},
+		{"DeleteMissing", testDeleteMissing},
+		{"AnonymizeUser", testAnonymizeUser},
+		{"ConcurrentCreates", testConcurrentCreates},
+		{"UsersSorted", testUsersSorted},
+		{"VersionedDelete", testVersionedDelete},
+		{"Stream", testStream},
+		{"Tenants", testTenants},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, factory())
+		})
+	}
+}
+
+func newUser(name string) users.User {
+	u := users.New()
+	u.FirstName = "first"
+	u.LastName = "last"
+	u.Username = name
+	u.Email = name + "@example.com"
+	u.Password = "password"
+	return u
+}
+
+func testCreateUserRoundTrip(t *testing.T, d db.Database) {
+	u := newUser("roundtrip")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != u.UserID || got.Username != u.Username || got.Email != u.Email ||
+		got.FirstName != u.FirstName || got.LastName != u.LastName {
+		t.Errorf("Expected matching user, received %+v", got)
+	}
+	byName, err := d.GetUserByName(u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byName.UserID != u.UserID {
+		t.Errorf("Expected user id %v by name, received %v", u.UserID, byName.UserID)
+	}
+	all, err := d.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Errorf("Expected one user, received %v", len(all))
+	}
+}
+
+func testCreateUserPopulatesIDs(t *testing.T, d db.Database) {
+	u := newUser("nested")
+	u.Addresses = append(u.Addresses, users.Address{Street: "street", City: "city"})
+	u.Cards = append(u.Cards, users.Card{LongNum: "4111111111111111", Expires: "01/30"})
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if !bson.IsObjectIdHex(u.UserID) {
+		t.Errorf("Expected hex user id, received %q", u.UserID)
+	}
+	if len(u.Addresses) != 1 || !bson.IsObjectIdHex(u.Addresses[0].ID) {
+		t.Fatalf("Expected address id populated, received %+v", u.Addresses)
+	}
+	if len(u.Cards) != 1 || !bson.IsObjectIdHex(u.Cards[0].ID) {
+		t.Fatalf("Expected card id populated, received %+v", u.Cards)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.GetUserAttributes(&got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Addresses) != 1 || got.Addresses[0].Street != "street" || got.Addresses[0].ID != u.Addresses[0].ID {
+		t.Errorf("Expected stored address, received %+v", got.Addresses)
+	}
+	if len(got.Cards) != 1 || got.Cards[0].LongNum != "4111111111111111" || got.Cards[0].ID != u.Cards[0].ID {
+		t.Errorf("Expected stored card, received %+v", got.Cards)
+	}
+}
+
+func testUsernameUniqueness(t *testing.T, d db.Database) {
+	u := newUser("unique")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	dup := newUser("unique")
+	if err := d.CreateUser(&dup); !errors.Is(err, db.ErrAlreadyExists) {
+		t.Errorf("Expected ErrAlreadyExists creating duplicate username, received %v", err)
+	}
+	all, err := d.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 {
+		t.Errorf("Expected one user after duplicate create, received %v", len(all))
+	}
+}
+
+func testEmailUniqueness(t *testing.T, d db.Database) {
+	u := newUser("email")
+	u.Email = "same@Example.com"
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	dup := newUser("emailcase")
+	dup.Email = "same@EXAMPLE.COM"
+	var ae db.AlreadyExistsError
+	if err := d.CreateUser(&dup); !errors.As(err, &ae) || ae.Field != "email" {
+		t.Errorf("Expected the email taken whatever the case of its domain, received %v", err)
+	}
+	other := newUser("emailother")
+	if err := d.CreateUser(&other); err != nil {
+		t.Fatal(err)
+	}
+	email := "SAME@example.com"
+	if err := d.PatchUser(other.UserID, users.UserPatch{Email: &email}); err != nil {
+		t.Errorf("Expected local parts told apart by case, received %v", err)
+	}
+	email = "same@example.COM"
+	if err := d.PatchUser(other.UserID, users.UserPatch{Email: &email}); err != db.ErrAlreadyExists {
+		t.Errorf("Expected already exists error patching a taken email, received %v", err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != "same@Example.com" {
+		t.Errorf("Expected the email kept as written, received %v", got.Email)
+	}
+}
+
+func testGetUserBySkeleton(t *testing.T, d db.Database) {
+	u := newUser("Skeleton")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUserBySkeleton(users.UsernameSkeleton("skeletоn"))
+	if err != nil || got.UserID != u.UserID {
+		t.Errorf("Expected the user found by the skeleton of its username, received %v %v", got.UserID, err)
+	}
+	name := "renamed"
+	if err := d.PatchUser(u.UserID, users.UserPatch{Username: &name}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetUserBySkeleton("skeleton"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected the former skeleton gone, received %v", err)
+	}
+	if got, err := d.GetUserBySkeleton("renamed"); err != nil || got.UserID != u.UserID {
+		t.Errorf("Expected the user found by its new skeleton, received %v %v", got.UserID, err)
+	}
+}
+
+func testUpdateUser(t *testing.T, d db.Database) {
+	u := newUser("update")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	other := newUser("other")
+	if err := d.CreateUser(&other); err != nil {
+		t.Fatal(err)
+	}
+	u.FirstName = "changed"
+	u.Username = "updated"
+	if err := d.UpdateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.FirstName != "changed" || got.Username != "updated" {
+		t.Errorf("Expected updated user, received %+v", got)
+	}
+	if _, err := d.GetUserByName("updated"); err != nil {
+		t.Errorf("Expected user found by new username, received %v", err)
+	}
+	u.Username = other.Username
+	if err := d.UpdateUser(&u); err != db.ErrAlreadyExists {
+		t.Errorf("Expected already exists error for username collision, received %v", err)
+	}
+	u.Username = "updated"
+	u.Email = other.Email
+	if err := d.UpdateUser(&u); err != db.ErrAlreadyExists {
+		t.Errorf("Expected already exists error for email collision, received %v", err)
+	}
+	missing := newUser("missing")
+	missing.UserID = bson.NewObjectId().Hex()
+	if err := d.UpdateUser(&missing); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testPatchUser(t *testing.T, d db.Database) {
+	u := newUser("patch")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	other := newUser("otherpatch")
+	if err := d.CreateUser(&other); err != nil {
+		t.Fatal(err)
+	}
+	email := "patched@example.com"
+	empty := ""
+	if err := d.PatchUser(u.UserID, users.UserPatch{Email: &email, LastName: &empty}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != email || got.LastName != "" || got.FirstName != u.FirstName || got.Username != u.Username {
+		t.Errorf("Expected only email and last name patched, received %+v", got)
+	}
+	if err := d.PatchUser(u.UserID, users.UserPatch{Username: &other.Username}); err != db.ErrAlreadyExists {
+		t.Errorf("Expected already exists error, received %v", err)
+	}
+	if err := d.PatchUser(bson.NewObjectId().Hex(), users.UserPatch{Email: &email}); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testSetUserPassword(t *testing.T, d db.Database) {
+	u := newUser("password")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetUserPassword(u.UserID, "newhash", "newsalt"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUserByName(u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Password != "newhash" || got.Salt != "newsalt" {
+		t.Errorf("Expected new hash and salt, received %v %v", got.Password, got.Salt)
+	}
+	if got.FirstName != u.FirstName {
+		t.Errorf("Expected profile untouched, received %+v", got)
+	}
+	if err := d.SetUserPassword(bson.NewObjectId().Hex(), "h", "s"); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testReplaceUserPassword(t *testing.T, d db.Database) {
+	u := newUser("replace")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.ReplaceUserPassword(u.UserID, "stale", "rehashed", ""); err != db.ErrVersionMismatch {
+		t.Errorf("Expected version mismatch error, received %v", err)
+	}
+	if err := d.ReplaceUserPassword(u.UserID, u.Password, "rehashed", ""); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Password != "rehashed" {
+		t.Errorf("Expected the rehashed password, received %v", got.Password)
+	}
+	if err := d.ReplaceUserPassword(bson.NewObjectId().Hex(), "h", "h", ""); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testSetUserRoles(t *testing.T, d db.Database) {
+	u := newUser("roles")
+	u.Roles = []string{users.RoleCustomer}
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got.Roles, []string{users.RoleCustomer}) {
+		t.Errorf("Expected roles stored on create, received %v", got.Roles)
+	}
+	if err := d.SetUserRoles(u.UserID, []string{users.RoleCustomer, users.RoleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	u.FirstName = "changed"
+	if err := d.UpdateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err = d.GetUserByName(u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.HasRole(users.RoleAdmin) || !got.HasRole(users.RoleCustomer) {
+		t.Errorf("Expected roles kept across updates, received %v", got.Roles)
+	}
+	if err := d.SetUserRoles(bson.NewObjectId().Hex(), nil); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testSetUserStatus(t *testing.T, d db.Database) {
+	u := newUser("status")
+	u.Status = users.StatusActive
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetUserStatus(u.UserID, users.StatusDisabled); err != nil {
+		t.Fatal(err)
+	}
+	u.FirstName = "changed"
+	if err := d.UpdateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUserByName(u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Disabled() {
+		t.Errorf("Expected the status kept across updates, received %q", got.Status)
+	}
+	if err := d.SetUserStatus(bson.NewObjectId().Hex(), users.StatusActive); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testCredentialsVersion(t *testing.T, d db.Database) {
+	u := newUser("credentials")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := d.BumpCredentialsVersion(u.UserID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	u.FirstName = "changed"
+	if err := d.UpdateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetUserPassword(u.UserID, "rehashed", ""); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CredentialsVersion != 2 {
+		t.Errorf("Expected credentials version 2 kept across updates, received %v", got.CredentialsVersion)
+	}
+	if err := d.BumpCredentialsVersion(bson.NewObjectId().Hex()); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testUpdateUserPreferences(t *testing.T, d db.Database) {
+	u := newUser("preferences")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	eur, yes := "EUR", "true"
+	got, err := d.UpdateUserPreferences(u.UserID, map[string]*string{"currency": &eur, "newsletter": &yes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, map[string]string{"currency": "EUR", "newsletter": "true"}) {
+		t.Errorf("Expected the preferences set, received %v", got)
+	}
+	// A change leaves the keys it does not name as they are
+	gbp := "GBP"
+	if _, err := d.UpdateUserPreferences(u.UserID, map[string]*string{"currency": &gbp}); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(stored.Preferences, map[string]string{"currency": "GBP", "newsletter": "true"}) {
+		t.Errorf("Expected the preferences stored, received %v", stored.Preferences)
+	}
+	if got, err = d.UpdateUserPreferences(u.UserID, map[string]*string{"currency": nil, "newsletter": nil}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("Expected no preferences left, received %v", got)
+	}
+	if _, err := d.UpdateUserPreferences(bson.NewObjectId().Hex(), nil); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testRefreshTokens(t *testing.T, d db.Database) {
+	u := newUser("refresh")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, rt := range []users.RefreshToken{
+		{ID: "a", Hash: "hash-a", Device: "phone", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		{ID: "b", Hash: "hash-b", Device: "laptop", CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		{ID: "c", Hash: "hash-c", Device: "old", CreatedAt: now, ExpiresAt: now.Add(-time.Hour)},
+	} {
+		if err := d.CreateRefreshToken(u.UserID, rt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts, err := d.GetRefreshTokens(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ts) != 2 {
+		t.Errorf("Expected 2 active tokens, received %+v", ts)
+	}
+
+	id, rt, err := d.UseRefreshToken("hash-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != u.UserID || rt.ID != "a" || rt.Device != "phone" || rt.Used {
+		t.Errorf("Expected unused token a of %v, received %v %+v", u.UserID, id, rt)
+	}
+	if _, rt, err = d.UseRefreshToken("hash-a"); err != nil || !rt.Used {
+		t.Errorf("Expected second use to report token used, received %+v %v", rt, err)
+	}
+	if _, _, err := d.UseRefreshToken("missing"); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+
+	if err := d.RevokeRefreshTokens(u.UserID, "b"); err != nil {
+		t.Fatal(err)
+	}
+	if ts, _ := d.GetRefreshTokens(u.UserID); len(ts) != 0 {
+		t.Errorf("Expected no active tokens, received %+v", ts)
+	}
+	if err := d.CreateRefreshToken(u.UserID, users.RefreshToken{ID: "d", Hash: "hash-d", ExpiresAt: now.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RevokeRefreshTokens(u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if ts, _ := d.GetRefreshTokens(u.UserID); len(ts) != 0 {
+		t.Errorf("Expected revoke all to leave no active tokens, received %+v", ts)
+	}
+	if err := d.CreateRefreshToken(bson.NewObjectId().Hex(), users.RefreshToken{}); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testMFA(t *testing.T, d db.Database) {
+	u := newUser("mfa")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := d.GetMFA(u.UserID); err != nil || m.Enabled || m.Secret != "" {
+		t.Errorf("Expected no enrollment, received %+v %v", m, err)
+	}
+	want := users.MFA{Secret: "sealed", Enabled: true, RecoveryCodes: []string{"h1", "h2"}}
+	if err := d.SetMFA(u.UserID, want); err != nil {
+		t.Fatal(err)
+	}
+	m, err := d.GetMFA(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Secret != "sealed" || !m.Enabled || len(m.RecoveryCodes) != 2 {
+		t.Errorf("Expected %+v, received %+v", want, m)
+	}
+
+	if err := d.UseMFAStep(u.UserID, 10); err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range []int64{10, 9} {
+		if err := d.UseMFAStep(u.UserID, step); err != db.ErrNotFound {
+			t.Errorf("Expected step %d refused, received %v", step, err)
+		}
+	}
+	if err := d.UseMFAStep(u.UserID, 11); err != nil {
+		t.Errorf("Expected a newer step accepted, received %v", err)
+	}
+
+	if err := d.UseRecoveryCode(u.UserID, "h1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.UseRecoveryCode(u.UserID, "h1"); err != db.ErrNotFound {
+		t.Errorf("Expected a used code refused, received %v", err)
+	}
+	if m, _ := d.GetMFA(u.UserID); len(m.RecoveryCodes) != 1 || m.LastStep != 11 {
+		t.Errorf("Expected one code left at step 11, received %+v", m)
+	}
+
+	if err := d.SetMFA(u.UserID, users.MFA{}); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := d.GetMFA(u.UserID); m.Enabled || m.Secret != "" {
+		t.Errorf("Expected enrollment removed, received %+v", m)
+	}
+	if _, err := d.GetMFA(bson.NewObjectId().Hex()); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testMissingUser(t *testing.T, d db.Database) {
+	if _, err := d.GetUser(bson.NewObjectId().Hex()); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected not found error for missing user id, received %v", err)
+	}
+	if _, err := d.GetUserByName("nobody"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected not found error for missing username, received %v", err)
+	}
+	if _, err := d.GetAddress(bson.NewObjectId().Hex()); err == nil {
+		t.Error("Expected error for missing address")
+	}
+	if _, err := d.GetCard(bson.NewObjectId().Hex()); err == nil {
+		t.Error("Expected error for missing card")
+	}
+}
+
+func testInvalidID(t *testing.T, d db.Database) {
+	if _, err := d.GetUser("invalid"); !errors.Is(err, db.ErrInvalidInput) {
+		t.Errorf("Expected ErrInvalidInput for invalid user id, received %v", err)
+	}
+	if _, err := d.GetAddress("invalid"); !errors.Is(err, db.ErrInvalidInput) {
+		t.Errorf("Expected ErrInvalidInput for invalid address id, received %v", err)
+	}
+	if _, err := d.GetCard("invalid"); !errors.Is(err, db.ErrInvalidInput) {
+		t.Errorf("Expected ErrInvalidInput for invalid card id, received %v", err)
+	}
+	if err := d.CreateAddress(&users.Address{}, "invalid"); err == nil {
+		t.Error("Expected error creating address for invalid user id")
+	}
+	if err := d.CreateCard(&users.Card{}, "invalid"); err == nil {
+		t.Error("Expected error creating card for invalid user id")
+	}
+	if err := d.Delete("customers", "invalid", db.AnyVersion); err == nil {
+		t.Error("Expected error deleting invalid id")
+	}
+	u := users.User{Addresses: []users.Address{{ID: "invalid"}}}
+	if err := d.GetUserAttributes(&u); err == nil {
+		t.Error("Expected error loading attributes with invalid id")
+	}
+}
+
+func testCreateAddressLinksUser(t *testing.T, d db.Database) {
+	u := newUser("address")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	a := users.Address{Street: "street", Number: "1", City: "city"}
+	if err := d.CreateAddress(&a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if !bson.IsObjectIdHex(a.ID) {
+		t.Fatalf("Expected hex address id, received %q", a.ID)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Addresses) != 1 || got.Addresses[0].ID != a.ID {
+		t.Fatalf("Expected address %v linked to user, received %+v", a.ID, got.Addresses)
+	}
+	if err := d.GetUserAttributes(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Addresses[0].Street != "street" {
+		t.Errorf("Expected loaded address, received %+v", got.Addresses[0])
+	}
+	stored, err := d.GetAddress(a.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ID != a.ID || stored.City != "city" {
+		t.Errorf("Expected stored address, received %+v", stored)
+	}
+}
+
+func testCreateCardLinksUser(t *testing.T, d db.Database) {
+	u := newUser("card")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	c := users.Card{LongNum: "4111111111111111", Expires: "01/30", CCV: "123"}
+	if err := d.CreateCard(&c, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Cards) != 1 || got.Cards[0].ID != c.ID {
+		t.Fatalf("Expected card %v linked to user, received %+v", c.ID, got.Cards)
+	}
+	stored, err := d.GetCard(c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.ID != c.ID || stored.LongNum != c.LongNum {
+		t.Errorf("Expected stored card, received %+v", stored)
+	}
+	if c.Brand != users.BrandVisa || stored.Brand != users.BrandVisa {
+		t.Errorf("Expected brand %v stored, received %v and %v", users.BrandVisa, c.Brand, stored.Brand)
+	}
+}
+
+func testUserByNameWithAttributes(t *testing.T, d db.Database) {
+	j, ok := d.(db.AttributeJoiner)
+	if !ok {
+		t.Skip("database does not join attributes")
+	}
+	if _, err := j.GetUserByNameWithAttributes("nobody"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, received %v", err)
+	}
+	u := newUser("joined")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	a := users.Address{Street: "street", Number: "1", City: "city"}
+	if err := d.CreateAddress(&a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	c := users.Card{LongNum: "4111111111111111", Expires: "01/30", CCV: "123"}
+	if err := d.CreateCard(&c, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	got, err := j.GetUserByNameWithAttributes("joined")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.UserID != u.UserID || got.DefaultCard != c.ID {
+		t.Errorf("Expected user %v with default card %v, received %+v", u.UserID, c.ID, got)
+	}
+	if len(got.Addresses) != 1 || got.Addresses[0].ID != a.ID || got.Addresses[0].Street != "street" {
+		t.Errorf("Expected the address loaded, received %+v", got.Addresses)
+	}
+	if len(got.Cards) != 1 || got.Cards[0].ID != c.ID || got.Cards[0].LongNum != c.LongNum {
+		t.Errorf("Expected the card loaded, received %+v", got.Cards)
+	}
+}
+
+func testAnonymousAttributes(t *testing.T, d db.Database) {
+	a := users.Address{Street: "guest"}
+	if err := d.CreateAddress(&a, ""); err != nil {
+		t.Fatal(err)
+	}
+	c := users.Card{LongNum: "4111111111111111"}
+	if err := d.CreateCard(&c, ""); err != nil {
+		t.Fatal(err)
+	}
+	as, err := d.GetAddresses()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(as) != 1 || as[0].ID != a.ID {
+		t.Errorf("Expected anonymous address listed, received %+v", as)
+	}
+	cs, err := d.GetCards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 1 || cs[0].ID != c.ID {
+		t.Errorf("Expected anonymous card listed, received %+v", cs)
+	}
+}
+
+func testLinkAttribute(t *testing.T, d db.Database) {
+	u, other := newUser("linker"), newUser("other")
+	for _, u := range []*users.User{&u, &other} {
+		if err := d.CreateUser(u); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a := users.Address{Street: "guest", Guest: "session"}
+	if err := d.CreateAddress(&a, ""); err != nil {
+		t.Fatal(err)
+	}
+	c := users.Card{LongNum: "4111111111111111", Guest: "session"}
+	if err := d.CreateCard(&c, ""); err != nil {
+		t.Fatal(err)
+	}
+	held := users.Address{Street: "held"}
+	if err := d.CreateAddress(&held, other.UserID); err != nil {
+		t.Fatal(err)
+	}
+
+	var nf db.NotFoundError
+	if err := d.LinkAttribute("addresses", a.ID, u.UserID, "other session"); !errors.As(err, &nf) {
+		t.Errorf("Expected an address of another guest session not found, received %v", err)
+	}
+	if err := d.LinkAttribute("addresses", a.ID, u.UserID, ""); !errors.As(err, &nf) {
+		t.Errorf("Expected an address without a guest session not found, received %v", err)
+	}
+	if err := d.LinkAttribute("addresses", a.ID, u.UserID, "session"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.LinkAttribute("cards", c.ID, u.UserID, "session"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Addresses) != 1 || got.Addresses[0].ID != a.ID || len(got.Cards) != 1 || got.Cards[0].ID != c.ID || got.DefaultCard != c.ID {
+		t.Errorf("Expected the address and card linked, the card as default, received %+v", got)
+	}
+
+	if err := d.LinkAttribute("addresses", a.ID, other.UserID, "session"); !errors.Is(err, db.ErrAlreadyLinked) {
+		t.Errorf("Expected a linked address kept, received %v", err)
+	}
+	if err := d.LinkAttribute("addresses", held.ID, u.UserID, "session"); !errors.As(err, &nf) {
+		t.Errorf("Expected an address created with a customer kept, received %v", err)
+	}
+	if err := d.LinkAttribute("cards", bson.NewObjectId().Hex(), u.UserID, "session"); !errors.As(err, &nf) || nf.Entity != "cards" {
+		t.Errorf("Expected a missing card not found, received %v", err)
+	}
+}
+
+func testDefaultAddresses(t *testing.T, d db.Database) {
+	u := newUser("defaults")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	ship := users.Address{Street: "street", Type: users.AddressShipping}
+	bill := users.Address{Street: "street", Type: users.AddressBilling}
+	for _, a := range []*users.Address{&ship, &bill} {
+		if err := d.CreateAddress(a, u.UserID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.SetDefaultAddress(u.UserID, ship.ID, users.AddressShipping); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetDefaultAddress(u.UserID, bill.ID, users.AddressBilling); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.DefaultShipping != ship.ID || got.DefaultBilling != bill.ID {
+		t.Errorf("Expected the defaults %v and %v, received %v and %v", ship.ID, bill.ID, got.DefaultShipping, got.DefaultBilling)
+	}
+	if stored, err := d.GetAddress(bill.ID); err != nil || stored.Type != users.AddressBilling {
+		t.Errorf("Expected the type of the address stored, received %+v %v", stored, err)
+	}
+
+	other := users.Address{Street: "street"}
+	if err := d.CreateAddress(&other, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetDefaultAddress(u.UserID, other.ID, users.AddressShipping); err != db.ErrNotFound {
+		t.Errorf("Expected the address of no one refused, received %v", err)
+	}
+	if err := d.SetDefaultAddress(bson.NewObjectId().Hex(), ship.ID, users.AddressShipping); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+
+	if err := d.Delete("addresses", bill.ID, db.AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = d.GetUser(u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if got.DefaultShipping != ship.ID || got.DefaultBilling != "" {
+		t.Errorf("Expected only the default billing address cleared, received %v and %v", got.DefaultShipping, got.DefaultBilling)
+	}
+}
+
+func testDefaultCard(t *testing.T, d db.Database) {
+	u := newUser("defaultcard")
+	u.Cards = append(u.Cards, users.Card{LongNum: "4111111111111111"})
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	first := u.Cards[0].ID
+	if u.DefaultCard != first {
+		t.Errorf("Expected the card created with the user its default, received %q", u.DefaultCard)
+	}
+	second := users.Card{LongNum: "5555555555554444"}
+	if err := d.CreateCard(&second, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	defaultOf := func() string {
+		got, err := d.GetUser(u.UserID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got.DefaultCard
+	}
+	if got := defaultOf(); got != first {
+		t.Errorf("Expected the first card kept the default, received %v", got)
+	}
+	if err := d.SetDefaultCard(u.UserID, second.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got := defaultOf(); got != second.ID {
+		t.Errorf("Expected the default %v, received %v", second.ID, got)
+	}
+
+	other := users.Card{LongNum: "4111111111111111"}
+	if err := d.CreateCard(&other, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetDefaultCard(u.UserID, other.ID); err != db.ErrNotFound {
+		t.Errorf("Expected the card of no one refused, received %v", err)
+	}
+	if err := d.SetDefaultCard(bson.NewObjectId().Hex(), first); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+
+	if err := d.Delete("cards", second.ID, db.AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if got := defaultOf(); got != first {
+		t.Errorf("Expected the card left promoted to default, received %v", got)
+	}
+	if err := d.Delete("cards", first, db.AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if got := defaultOf(); got != "" {
+		t.Errorf("Expected no default card left, received %v", got)
+	}
+	if err := d.CreateCard(&second, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if got := defaultOf(); got != second.ID {
+		t.Errorf("Expected the first card added since promoted, received %v", got)
+	}
+}
+
+func testUserEmails(t *testing.T, d db.Database) {
+	u := newUser("emails")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	other := newUser("emailsother")
+	if err := d.CreateUser(&other); err != nil {
+		t.Fatal(err)
+	}
+	version := func(id string) int64 {
+		u, err := d.GetUser(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u.Version
+	}
+	emails := []users.EmailAddress{{Address: "billing@example.com", CodeHash: "hash"}}
+	stale := version(u.UserID)
+	if err := d.SetUserEmails(u.UserID, u.Email, emails, stale); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetUserEmails(u.UserID, u.Email, nil, stale); err != db.ErrVersionMismatch {
+		t.Errorf("Expected the emails of a user changed since refused, received %v", err)
+	}
+	if _, err := d.GetUserByEmail("billing@example.com"); err != db.ErrNotFound {
+		t.Errorf("Expected an unverified email not found, received %v", err)
+	}
+	emails[0].Verified, emails[0].CodeHash = true, ""
+	if err := d.SetUserEmails(u.UserID, u.Email, emails, version(u.UserID)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUserByEmail("billing@Example.COM")
+	if err != nil || got.UserID != u.UserID {
+		t.Fatalf("Expected the user found by its verified email, received %v %v", got.UserID, err)
+	}
+	if len(got.Emails) != 1 || !got.Emails[0].Verified || got.Emails[0].Address != "billing@example.com" {
+		t.Errorf("Expected the emails stored, received %+v", got.Emails)
+	}
+
+	var exists db.AlreadyExistsError
+	if err := d.SetUserEmails(other.UserID, other.Email, emails, version(other.UserID)); !errors.As(err, &exists) {
+		t.Errorf("Expected the email of another user refused, received %v", err)
+	}
+	if err := d.SetUserEmails(other.UserID, u.Email, nil, version(other.UserID)); !errors.As(err, &exists) {
+		t.Errorf("Expected the primary email of another user refused, received %v", err)
+	}
+	dup := newUser("emailsdup")
+	dup.Email = "billing@example.com"
+	if err := d.CreateUser(&dup); err == nil {
+		t.Error("Expected a user with the email of another refused")
+	}
+
+	if err := d.SetUserEmails(u.UserID, "billing@example.com", append(emails, users.EmailAddress{Address: u.Email}), version(u.UserID)); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = d.GetUser(u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if got.Email != "billing@example.com" || len(got.Emails) != 2 {
+		t.Errorf("Expected the primary email replaced, received %v %+v", got.Email, got.Emails)
+	}
+	if err := d.SetUserEmails(bson.NewObjectId().Hex(), "x@example.com", nil, 0); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testConsents(t *testing.T, d db.Database) {
+	u := newUser("consents")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	first := []users.ConsentRecord{{Channel: users.ConsentEmail, Granted: true, At: at, Source: "registration"}}
+	then := []users.ConsentRecord{
+		{Channel: users.ConsentEmail, At: at.Add(time.Hour), Source: "settings"},
+		{Channel: users.ConsentPost, Granted: true, At: at.Add(time.Hour), Source: "settings"},
+	}
+	for _, records := range [][]users.ConsentRecord{first, then} {
+		if err := d.AppendConsents(u.UserID, records); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(first, then...)
+	same := len(got.ConsentHistory) == len(want)
+	for k := 0; same && k < len(want); k++ {
+		// Stores may read times back in another location
+		g, w := got.ConsentHistory[k], want[k]
+		same = g.Channel == w.Channel && g.Granted == w.Granted && g.Source == w.Source && g.At.Equal(w.At)
+	}
+	if !same {
+		t.Errorf("Expected the records appended in order, received %+v", got.ConsentHistory)
+	}
+
+	if err := d.AnonymizeUser(u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	got, err = d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tallies := []users.ConsentTally{{Channel: users.ConsentEmail, Grants: 1, Withdrawals: 1}, {Channel: users.ConsentPost, Grants: 1}}
+	if len(got.ConsentHistory) != 0 || !reflect.DeepEqual(got.ConsentTallies, tallies) {
+		t.Errorf("Expected the history anonymized to its tallies, received %+v %+v", got.ConsentHistory, got.ConsentTallies)
+	}
+	if err := d.AppendConsents(bson.NewObjectId().Hex(), first); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testSetCardLabel(t *testing.T, d db.Database) {
+	u := newUser("label")
+	u.Cards = append(u.Cards, users.Card{LongNum: "4111111111111111", Label: "work"})
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	id := u.Cards[0].ID
+	if c, err := d.GetCard(id); err != nil || c.Label != "work" {
+		t.Fatalf("Expected the label stored with the card, received %+v %v", c, err)
+	}
+	if err := d.SetCardLabel(u.UserID, id, "personal"); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := d.GetCard(id); err != nil || c.Label != "personal" {
+		t.Errorf("Expected the label replaced, received %+v %v", c, err)
+	}
+	if err := d.SetCardLabel(u.UserID, id, ""); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := d.GetCard(id); err != nil || c.Label != "" {
+		t.Errorf("Expected the label cleared, received %+v %v", c, err)
+	}
+
+	other := newUser("label-other")
+	if err := d.CreateUser(&other); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetCardLabel(other.UserID, id, "stolen"); err != db.ErrNotFound {
+		t.Errorf("Expected the card of another refused, received %v", err)
+	}
+	if err := d.SetCardLabel(u.UserID, bson.NewObjectId().Hex(), "missing"); err != db.ErrNotFound {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testDeleteCustomerCascades(t *testing.T, d db.Database) {
+	u := newUser("cascade")
+	u.Addresses = append(u.Addresses, users.Address{Street: "street"})
+	u.Cards = append(u.Cards, users.Card{LongNum: "4111111111111111"})
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("customers", u.UserID, db.AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetUser(u.UserID); err == nil {
+		t.Error("Expected deleted user to be missing")
+	}
+	if _, err := d.GetAddress(u.Addresses[0].ID); err == nil {
+		t.Error("Expected address of deleted user to be removed")
+	}
+	if _, err := d.GetCard(u.Cards[0].ID); err == nil {
+		t.Error("Expected card of deleted user to be removed")
+	}
+}
+
+func testDeleteMissing(t *testing.T, d db.Database) {
+	for _, entity := range []string{"customers", "addresses", "cards"} {
+		err := d.Delete(entity, bson.NewObjectId().Hex(), db.AnyVersion)
+		if !errors.Is(err, db.ErrNotFound) {
+			t.Errorf("Expected not found error deleting missing %v, received %v", entity, err)
+		}
+	}
+}
+
+func testDeleteAttributeUnlinks(t *testing.T, d db.Database) {
+	u := newUser("unlink")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	a := users.Address{Street: "street"}
+	if err := d.CreateAddress(&a, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	c := users.Card{LongNum: "4111111111111111"}
+	if err := d.CreateCard(&c, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("addresses", a.ID, db.AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("cards", c.ID, db.AnyVersion); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Addresses) != 0 || len(got.Cards) != 0 {
+		t.Errorf("Expected attributes unlinked from user, received %+v %+v", got.Addresses, got.Cards)
+	}
+	if _, err := d.GetAddress(a.ID); err == nil {
+		t.Error("Expected deleted address to be missing")
+	}
+}
+
+func testConcurrentCreates(t *testing.T, d db.Database) {
+	const n = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			u := newUser(fmt.Sprintf("concurrent%d", i))
+			errs <- d.CreateUser(&u)
+		}(i)
+		go func() {
+			defer wg.Done()
+			u := newUser("contended")
+			if err := d.CreateUser(&u); err == nil {
+				errs <- nil
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	all, err := d.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != n+1 {
+		t.Errorf("Expected %v users after concurrent creates, received %v", n+1, len(all))
+	}
+}
+
+func testAnonymizeUser(t *testing.T, d db.Database) {
+	u := newUser("forget")
+	u.Addresses = append(u.Addresses, users.Address{Street: "street"})
+	u.Cards = append(u.Cards, users.Card{LongNum: "4111111111111111"})
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	other := newUser("remember")
+	if err := d.CreateUser(&other); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AnonymizeUser(u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatalf("Expected anonymized user kept, received %v", err)
+	}
+	if !got.Anonymized || got.Username == u.Username || got.FirstName == u.FirstName || got.Email != "" || got.Password != "" {
+		t.Errorf("Expected personal data erased, received %+v", got)
+	}
+	if _, err := d.GetAddress(u.Addresses[0].ID); err == nil {
+		t.Error("Expected address deleted")
+	}
+	if _, err := d.GetCard(u.Cards[0].ID); err == nil {
+		t.Error("Expected card deleted")
+	}
+	if _, err := d.GetUserByName(got.Username); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected anonymized user excluded from search, received %v", err)
+	}
+	us, err := d.GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(us) != 1 || us[0].UserID != other.UserID {
+		t.Errorf("Expected anonymized user excluded from listing, received %+v", us)
+	}
+	if err := d.AnonymizeUser(bson.NewObjectId().Hex()); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected not found error, received %v", err)
+	}
+}
+
+func testUsersSorted(t *testing.T, d db.Database) {
+	var created []string
+	for _, n := range []struct{ username, last string }{{"c", "b"}, {"a", "b"}, {"b", "a"}} {
+		u := newUser(n.username)
+		u.LastName = n.last
+		if err := d.CreateUser(&u); err != nil {
+			t.Fatal(err)
+		}
+		created = append(created, u.Username)
+	}
+	for _, tt := range []struct {
+		sort db.Sort
+		want []string
+	}{
+		{db.Sort{}, created},
+		{db.Sort{Field: "username"}, []string{"a", "b", "c"}},
+		{db.Sort{Field: "email", Desc: true}, []string{"c", "b", "a"}},
+		// Ties are ordered by id, in the direction of the sort
+		{db.Sort{Field: "lastName"}, []string{"b", "c", "a"}},
+		{db.Sort{Field: "lastName", Desc: true}, []string{"a", "c", "b"}},
+		{db.Sort{Field: "createdAt", Desc: true}, []string{"b", "a", "c"}},
+	} {
+		us, err := d.GetUsersSorted(tt.sort)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]string, 0, len(us))
+		for _, u := range us {
+			got = append(got, u.Username)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Expected %v sorted by %+v, received %v", tt.want, tt.sort, got)
+		}
+	}
+}
+
+func testVersionedDelete(t *testing.T, d db.Database) {
+	u := newUser("versioned")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	got, err := d.GetUser(u.UserID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := got.Version
+	c := users.Card{LongNum: "4111111111111111"}
+	if err := d.CreateCard(&c, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := d.GetUser(u.UserID); got.Version == read {
+		t.Fatal("Expected a new card to change the version")
+	}
+	if err := d.Delete("customers", u.UserID, read); !errors.Is(err, db.ErrVersionMismatch) {
+		t.Fatalf("Expected version mismatch deleting a stale version, received %v", err)
+	}
+	if _, err := d.GetCard(c.ID); err != nil {
+		t.Errorf("Expected card kept after a failed delete, received %v", err)
+	}
+	got, _ = d.GetUser(u.UserID)
+	if err := d.Delete("customers", u.UserID, got.Version); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetUser(u.UserID); err == nil {
+		t.Error("Expected deleted user to be missing")
+	}
+}
+
+func testStream(t *testing.T, d db.Database) {
+	st, ok := d.(db.Streamer)
+	if !ok {
+		t.Skip("database does not stream")
+	}
+	for _, name := range []string{"c", "a", "b"} {
+		u := newUser(name)
+		if err := d.CreateUser(&u); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.CreateAddress(&users.Address{Street: name}, u.UserID); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.CreateCard(&users.Card{LongNum: "4111111111111111"}, u.UserID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var got []string
+	err := st.StreamUsers(db.Sort{Field: "username"}, func(u users.User) error {
+		got = append(got, u.Username)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected users %v, received %v", want, got)
+	}
+
+	var addresses, cards int
+	if err := st.StreamAddresses(func(users.Address) error { addresses++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.StreamCards(func(users.Card) error { cards++; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if addresses != 3 || cards != 3 {
+		t.Errorf("Expected 3 addresses and cards, received %v and %v", addresses, cards)
+	}
+
+	stop := errors.New("stop")
+	n := 0
+	err = st.StreamUsers(db.Sort{}, func(users.User) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Errorf("Expected the stream stopped by the first error, received %v after %v users", err, n)
+	}
+}
+
+func testTenants(t *testing.T, d db.Database) {
+	to, ok := d.(db.TenantOpener)
+	if !ok {
+		t.Skip("database has no tenants")
+	}
+	if _, err := to.ForTenant(""); err != db.ErrNoTenant {
+		t.Errorf("Expected ErrNoTenant for an unnamed tenant, received %v", err)
+	}
+	a, err := to.ForTenant("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := newUser("tenant")
+	if err := d.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	address := users.Address{Street: "street"}
+	if err := d.CreateAddress(&address, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+	card := users.Card{LongNum: "4111111111111111"}
+	if err := d.CreateCard(&card, u.UserID); err != nil {
+		t.Fatal(err)
+	}
+
+	// The username is taken in another database only
+	ua := newUser("tenant")
+	if err := a.CreateUser(&ua); err != nil {
+		t.Fatalf("Expected the username free in the tenant, received %v", err)
+	}
+	if _, err := a.GetUser(u.UserID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected the user of another database not found, received %v", err)
+	}
+	if _, err := a.GetAddress(address.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected the address of another database not found, received %v", err)
+	}
+	if _, err := a.GetCard(card.ID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected the card of another database not found, received %v", err)
+	}
+	if err := a.Delete("customers", u.UserID, db.AnyVersion); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected the user of another database not deleted, received %v", err)
+	}
+	if us, err := a.GetUsers(); err != nil || len(us) != 1 || us[0].UserID != ua.UserID {
+		t.Errorf("Expected the one user of the tenant, received %v %v", us, err)
+	}
+	if _, err := d.GetUser(ua.UserID); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("Expected the user of the tenant not found outside it, received %v", err)
+	}
+}
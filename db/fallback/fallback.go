@@ -0,0 +1,279 @@
+package fallback
+
+// fallback.go contains a Database decorator that serves reads from a
+// secondary, read-only source when the primary database is unreachable.
+// Writes always go to the primary.
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// SourcePrimary is reported when the primary served the last read
+	SourcePrimary = "primary"
+	// SourceSecondary is reported when the secondary served the last read
+	SourceSecondary = "secondary"
+)
+
+var tracer = otel.Tracer("github.com/microservices-demo/user/db/fallback")
+
+// Reader is the read-only subset of db.Database used as the secondary source
+type Reader interface {
+	GetUserByName(string) (users.User, error)
+	GetUser(string) (users.User, error)
+	GetUsers() ([]users.User, error)
+	GetUsersSorted(db.Sort) ([]users.User, error)
+	GetUserAttributes(*users.User) error
+	GetAddress(string) (users.Address, error)
+	GetAddresses() ([]users.Address, error)
+	GetCard(string) (users.Card, error)
+	GetCards() ([]users.Card, error)
+}
+
+// Database wraps a primary db.Database and a secondary Reader
+type Database struct {
+	db.Database
+	Secondary Reader
+
+	// ctx is the context of the request the reads are made for, set by
+	// WithContext
+	ctx  context.Context
+	last *lastRead
+}
+
+// lastRead is the source of the most recent read, shared by a Database and
+// those its WithContext returns
+type lastRead struct {
+	mu       sync.Mutex
+	source   string
+	servedAt time.Time
+}
+
+// New returns a Database writing to primary and falling back to secondary
+// for reads when primary returns a connection-class error
+func New(primary db.Database, secondary Reader) *Database {
+	return &Database{
+		Database:  primary,
+		Secondary: secondary,
+		last:      &lastRead{source: SourcePrimary},
+	}
+}
+
+// WithContext returns a Database sharing the sources of d, the primary bound
+// to ctx, marking ctx stale when the secondary serves one of its reads
+func (d *Database) WithContext(ctx context.Context) db.Database {
+	return &Database{
+		Database:  db.WithContext(d.Database, ctx),
+		Secondary: d.Secondary,
+		ctx:       ctx,
+		last:      d.last,
+	}
+}
+
+// Source reports which source served the most recent read
+func (d *Database) Source() string {
+	d.last.mu.Lock()
+	defer d.last.mu.Unlock()
+	return d.last.source
+}
+
+// Close closes the primary and secondary when they hold connections
+func (d *Database) Close() error {
+	var err error
+	for _, c := range []interface{}{d.Database, d.Secondary} {
+		if c, ok := c.(db.Closer); ok {
+			if e := c.Close(); e != nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// ServedAt reports when the most recent read was served
+func (d *Database) ServedAt() time.Time {
+	d.last.mu.Lock()
+	defer d.last.mu.Unlock()
+	return d.last.servedAt
+}
+
+func (d *Database) served(source string) {
+	d.last.mu.Lock()
+	d.last.source = source
+	d.last.servedAt = time.Now()
+	d.last.mu.Unlock()
+}
+
+// read runs primary and, on a connection-class error, secondary instead,
+// marking the context of d stale
+func (d *Database) read(op string, primary func() error, secondary func() error) error {
+	err := primary()
+	if !IsConnectionError(err) || d.Secondary == nil {
+		d.served(SourcePrimary)
+		return err
+	}
+	ctx := d.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("stale", true))
+	_, span := tracer.Start(ctx, "fallback: "+op)
+	span.SetAttributes(
+		attribute.Bool("stale", true),
+		attribute.String("primary.error", err.Error()),
+	)
+	defer span.End()
+
+	err = secondary()
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	d.served(SourceSecondary)
+	markStale(ctx)
+	return err
+}
+
+// GetUserByName reads from primary, falling back to secondary
+func (d *Database) GetUserByName(name string) (u users.User, err error) {
+	err = d.read("find user by name",
+		func() (err error) { u, err = d.Database.GetUserByName(name); return },
+		func() (err error) { u, err = d.Secondary.GetUserByName(name); return })
+	return u, err
+}
+
+// GetUserByNameWithAttributes reads from primary, falling back to secondary,
+// in a single query from either when it is a db.AttributeJoiner
+func (d *Database) GetUserByNameWithAttributes(name string) (u users.User, err error) {
+	err = d.read("find user by name with attributes",
+		func() (err error) { u, err = withAttributes(d.Database, name); return },
+		func() (err error) { u, err = withAttributes(d.Secondary, name); return })
+	return u, err
+}
+
+// withAttributes reads the user named name from r along with its addresses
+// and cards
+func withAttributes(r Reader, name string) (users.User, error) {
+	if j, ok := r.(db.AttributeJoiner); ok {
+		return j.GetUserByNameWithAttributes(name)
+	}
+	u, err := r.GetUserByName(name)
+	if err != nil {
+		return u, err
+	}
+	return u, r.GetUserAttributes(&u)
+}
+
+// GetUser reads from primary, falling back to secondary
+func (d *Database) GetUser(id string) (u users.User, err error) {
+	err = d.read("find user by id",
+		func() (err error) { u, err = d.Database.GetUser(id); return },
+		func() (err error) { u, err = d.Secondary.GetUser(id); return })
+	return u, err
+}
+
+// GetUsers reads from primary, falling back to secondary
+func (d *Database) GetUsers() (us []users.User, err error) {
+	err = d.read("find all users",
+		func() (err error) { us, err = d.Database.GetUsers(); return },
+		func() (err error) { us, err = d.Secondary.GetUsers(); return })
+	return us, err
+}
+
+// GetUsersSorted reads from primary, falling back to secondary
+func (d *Database) GetUsersSorted(s db.Sort) (us []users.User, err error) {
+	err = d.read("find all users",
+		func() (err error) { us, err = d.Database.GetUsersSorted(s); return },
+		func() (err error) { us, err = d.Secondary.GetUsersSorted(s); return })
+	return us, err
+}
+
+// GetUserAttributes reads from primary, falling back to secondary
+func (d *Database) GetUserAttributes(u *users.User) error {
+	return d.read("get user attributes",
+		func() error { return d.Database.GetUserAttributes(u) },
+		func() error { return d.Secondary.GetUserAttributes(u) })
+}
+
+// GetAddress reads from primary, falling back to secondary
+func (d *Database) GetAddress(id string) (a users.Address, err error) {
+	err = d.read("find address by id",
+		func() (err error) { a, err = d.Database.GetAddress(id); return },
+		func() (err error) { a, err = d.Secondary.GetAddress(id); return })
+	return a, err
+}
+
+// GetAddresses reads from primary, falling back to secondary
+func (d *Database) GetAddresses() (as []users.Address, err error) {
+	err = d.read("find all addresses",
+		func() (err error) { as, err = d.Database.GetAddresses(); return },
+		func() (err error) { as, err = d.Secondary.GetAddresses(); return })
+	return as, err
+}
+
+// GetCard reads from primary, falling back to secondary
+func (d *Database) GetCard(id string) (c users.Card, err error) {
+	err = d.read("find card by id",
+		func() (err error) { c, err = d.Database.GetCard(id); return },
+		func() (err error) { c, err = d.Secondary.GetCard(id); return })
+	return c, err
+}
+
+// GetCards reads from primary, falling back to secondary
+func (d *Database) GetCards() (cs []users.Card, err error) {
+	err = d.read("find all cards",
+		func() (err error) { cs, err = d.Database.GetCards(); return },
+		func() (err error) { cs, err = d.Secondary.GetCards(); return })
+	return cs, err
+}
+
+// IsConnectionError reports whether err means the database could not be
+// reached, as opposed to a query failing
+func IsConnectionError(err error) bool {
+	switch db.ErrorKind(err) {
+	case db.KindConnection, db.KindTimeout:
+		return true
+	}
+	return false
+}
+
+type staleKey struct{}
+
+type staleMarker struct {
+	mu    sync.Mutex
+	stale bool
+}
+
+// WithStaleMarker returns a context able to record whether any read made
+// under it was served by a secondary source
+func WithStaleMarker(ctx context.Context) context.Context {
+	return context.WithValue(ctx, staleKey{}, &staleMarker{})
+}
+
+// IsStale reports whether a read made under ctx was served by a secondary
+// source
+func IsStale(ctx context.Context) bool {
+	m, ok := ctx.Value(staleKey{}).(*staleMarker)
+	if !ok {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.stale
+}
+
+func markStale(ctx context.Context) {
+	if m, ok := ctx.Value(staleKey{}).(*staleMarker); ok {
+		m.mu.Lock()
+		m.stale = true
+		m.mu.Unlock()
+	}
+}
@@ -0,0 +1,146 @@
+package fallback
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+	"github.com/microservices-demo/user/users"
+)
+
+var (
+	ErrFakeQuery = errors.New("Fake query error")
+)
+
+type fake struct {
+	db.Database
+	err  error
+	user users.User
+}
+
+func (f fake) GetUser(id string) (users.User, error) {
+	return f.user, f.err
+}
+
+func (f fake) CreateUser(u *users.User) error {
+	return f.err
+}
+
+func TestReadFallsBackOnConnectionError(t *testing.T) {
+	ctx := WithStaleMarker(context.Background())
+	d := New(fake{err: io.EOF}, fake{user: users.User{Username: "cached"}})
+	u, err := d.WithContext(ctx).GetUser("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Username != "cached" {
+		t.Errorf("Expected user from secondary, received %v", u.Username)
+	}
+	if d.Source() != SourceSecondary {
+		t.Errorf("Expected source %v, received %v", SourceSecondary, d.Source())
+	}
+	if !IsStale(ctx) {
+		t.Error("Expected context to be marked stale")
+	}
+}
+
+func TestReadDoesNotFallBackOnQueryError(t *testing.T) {
+	ctx := WithStaleMarker(context.Background())
+	d := New(fake{err: ErrFakeQuery}, fake{user: users.User{Username: "cached"}})
+	_, err := d.WithContext(ctx).GetUser("test")
+	if err != ErrFakeQuery {
+		t.Errorf("Expected primary error, received %v", err)
+	}
+	if d.Source() != SourcePrimary {
+		t.Errorf("Expected source %v, received %v", SourcePrimary, d.Source())
+	}
+	if IsStale(ctx) {
+		t.Error("Expected context not to be marked stale")
+	}
+}
+
+func TestWritesGoToPrimary(t *testing.T) {
+	d := New(fake{err: io.EOF}, fake{})
+	err := d.CreateUser(&users.User{})
+	if err != io.EOF {
+		t.Errorf("Expected primary error from write, received %v", err)
+	}
+}
+
+func TestIsConnectionError(t *testing.T) {
+	if IsConnectionError(nil) {
+		t.Error("Expected nil not to be a connection error")
+	}
+	if !IsConnectionError(errors.New("no reachable servers")) {
+		t.Error("Expected no reachable servers to be a connection error")
+	}
+	if IsConnectionError(errors.New("not found")) {
+		t.Error("Expected not found not to be a connection error")
+	}
+}
+
+// failing fails the reads of the user down with a connection error
+type failing struct {
+	db.Database
+}
+
+func (f failing) GetUser(id string) (users.User, error) {
+	if id == "down" {
+		return users.New(), io.EOF
+	}
+	return users.User{UserID: id}, nil
+}
+
+func TestStaleMarkedPerRequest(t *testing.T) {
+	d := New(failing{}, fake{user: users.User{Username: "cached"}})
+	var wg sync.WaitGroup
+	for k := 0; k < 50; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := "up"
+			if k%2 == 0 {
+				id = "down"
+			}
+			ctx := WithStaleMarker(context.Background())
+			if _, err := d.WithContext(ctx).GetUser(id); err != nil {
+				t.Error(err)
+			}
+			if IsStale(ctx) != (id == "down") {
+				t.Errorf("Expected the read of %v stale only when it fell back", id)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSnapshot(t *testing.T) {
+	source := memory.New()
+	u := users.User{Username: "snapped", Email: "snapped@example.com", Addresses: []users.Address{{Street: "Street"}}}
+	if err := source.CreateUser(&u); err != nil {
+		t.Fatal(err)
+	}
+	s := NewSnapshot(source)
+	if _, err := s.GetUser(u.UserID); err != db.ErrNotFound {
+		t.Errorf("Expected nothing before the first refresh, received %v", err)
+	}
+	if err := s.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	source.CreateUser(&users.User{Username: "later", Email: "later@example.com"})
+
+	got, err := s.GetUserByName("snapped")
+	if err != nil || got.UserID != u.UserID {
+		t.Fatalf("Expected the user of the snapshot, received %+v %v", got, err)
+	}
+	if err := s.GetUserAttributes(&got); err != nil || len(got.Addresses) != 1 || got.Addresses[0].Street != "Street" {
+		t.Errorf("Expected the address of the snapshot, received %+v %v", got.Addresses, err)
+	}
+	if _, err := s.GetUserByName("later"); err != db.ErrNotFound {
+		t.Errorf("Expected users created since the refresh missing, received %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package fallback
+
+// snapshot.go contains a Reader serving a copy of a database, taken
+// periodically, for the reads a Database falls back to.
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+)
+
+// Snapshot is a Reader serving the users, addresses and cards of a source
+// as they were at its last Refresh
+type Snapshot struct {
+	source Reader
+
+	mu        sync.RWMutex
+	users     []users.User
+	addresses map[string]users.Address
+	cards     map[string]users.Card
+	takenAt   time.Time
+}
+
+// NewSnapshot returns an empty Snapshot of source, filled by Refresh
+func NewSnapshot(source Reader) *Snapshot {
+	return &Snapshot{source: source}
+}
+
+// Refresh copies the users, addresses and cards of the source. The copy
+// taken before is kept when any of the reads fails.
+func (s *Snapshot) Refresh() error {
+	us, err := s.source.GetUsers()
+	if err != nil {
+		return err
+	}
+	as, err := s.source.GetAddresses()
+	if err != nil {
+		return err
+	}
+	cs, err := s.source.GetCards()
+	if err != nil {
+		return err
+	}
+	addresses := make(map[string]users.Address, len(as))
+	for _, a := range as {
+		addresses[a.ID] = a
+	}
+	cards := make(map[string]users.Card, len(cs))
+	for _, c := range cs {
+		cards[c.ID] = c
+	}
+	s.mu.Lock()
+	s.users, s.addresses, s.cards = us, addresses, cards
+	s.takenAt = time.Now()
+	s.mu.Unlock()
+	return nil
+}
+
+// TakenAt reports when the copy served was taken, the zero time before the
+// first Refresh
+func (s *Snapshot) TakenAt() time.Time {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.takenAt
+}
+
+// Run refreshes the snapshot every interval until ctx is done, logging the
+// refreshes that fail to logger
+func (s *Snapshot) Run(ctx context.Context, interval time.Duration, logger log.Logger) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.Refresh(); err != nil {
+				logger.Log("msg", "Snapshot refresh failed, serving the previous one", "err", err, "taken_at", s.TakenAt())
+			}
+		}
+	}
+}
+
+// GetUserByName returns the user named name
+func (s *Snapshot) GetUserByName(name string) (users.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if u.Username == name {
+			return u.Clone(), nil
+		}
+	}
+	return users.New(), db.ErrNotFound
+}
+
+// GetUser returns the user with the given id
+func (s *Snapshot) GetUser(id string) (users.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, u := range s.users {
+		if u.UserID == id {
+			return u.Clone(), nil
+		}
+	}
+	return users.New(), db.ErrNotFound
+}
+
+// GetUsers returns the users, in the order of the source
+func (s *Snapshot) GetUsers() ([]users.User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	us := make([]users.User, 0, len(s.users))
+	for _, u := range s.users {
+		us = append(us, u.Clone())
+	}
+	return us, nil
+}
+
+// GetUsersSorted returns the users in the order of o. Ids are created in
+// ascending order, so they stand for createdAt.
+func (s *Snapshot) GetUsersSorted(o db.Sort) ([]users.User, error) {
+	us, err := s.GetUsers()
+	if err != nil {
+		return us, err
+	}
+	field := func(u users.User) string {
+		switch o.Field {
+		case "username":
+			return u.Username
+		case "firstName":
+			return u.FirstName
+		case "lastName":
+			return u.LastName
+		case "email":
+			return u.Email
+		}
+		return ""
+	}
+	sort.Slice(us, func(i, j int) bool {
+		a, b := us[i], us[j]
+		if o.Desc {
+			a, b = b, a
+		}
+		if fa, fb := field(a), field(b); fa != fb {
+			return fa < fb
+		}
+		return a.UserID < b.UserID
+	})
+	return us, nil
+}
+
+// GetUserAttributes replaces the addresses and cards linked from u by
+// those of the snapshot, leaving out those it does not hold
+func (s *Snapshot) GetUserAttributes(u *users.User) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	as := make([]users.Address, 0, len(u.Addresses))
+	for _, a := range u.Addresses {
+		if sa, ok := s.addresses[a.ID]; ok {
+			as = append(as, sa.Clone())
+		}
+	}
+	cs := make([]users.Card, 0, len(u.Cards))
+	for _, c := range u.Cards {
+		if sc, ok := s.cards[c.ID]; ok {
+			cs = append(cs, sc.Clone())
+		}
+	}
+	u.Addresses = as
+	u.Cards = cs
+	return nil
+}
+
+// GetAddress returns the address with the given id
+func (s *Snapshot) GetAddress(id string) (users.Address, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	a, ok := s.addresses[id]
+	if !ok {
+		return users.Address{}, db.ErrNotFound
+	}
+	return a.Clone(), nil
+}
+
+// GetAddresses returns the addresses
+func (s *Snapshot) GetAddresses() ([]users.Address, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	as := make([]users.Address, 0, len(s.addresses))
+	for _, a := range s.addresses {
+		as = append(as, a.Clone())
+	}
+	return as, nil
+}
+
+// GetCard returns the card with the given id
+func (s *Snapshot) GetCard(id string) (users.Card, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	c, ok := s.cards[id]
+	if !ok {
+		return users.Card{}, db.ErrNotFound
+	}
+	return c.Clone(), nil
+}
+
+// GetCards returns the cards
+func (s *Snapshot) GetCards() ([]users.Card, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cs := make([]users.Card, 0, len(s.cards))
+	for _, c := range s.cards {
+		cs = append(cs, c.Clone())
+	}
+	return cs, nil
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+)
+
+// The kinds of error ErrorKind tells apart
+const (
+	// KindNotFound is a lookup of an entity that does not exist, an
+	// ordinary outcome rather than a failure
+	KindNotFound = "not_found"
+	// KindInvalidInput is a request malformed by the caller
+	KindInvalidInput = "invalid_input"
+	// KindConflict is a change clashing with the stored data
+	KindConflict = "conflict"
+	// KindTimeout is the database not answering in time
+	KindTimeout = "timeout"
+	// KindConnection is the database not being reachable
+	KindConnection = "connection"
+	// KindOther is any other failure
+	KindOther = "other"
+)
+
+// ErrorKind classifies err for traces, logs and metrics, returning an empty
+// string for a nil err. Drivers map their own errors to those of this
+// package first.
+func ErrorKind(err error) string {
+	var ne net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrNotFound):
+		return KindNotFound
+	case errors.Is(err, ErrInvalidInput):
+		return KindInvalidInput
+	case errors.Is(err, ErrAlreadyExists), errors.Is(err, ErrVersionMismatch):
+		return KindConflict
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return KindTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF), ne != nil:
+		return KindConnection
+	}
+	msg := err.Error()
+	if strings.Contains(msg, "i/o timeout") {
+		return KindTimeout
+	}
+	for _, s := range []string{"no reachable servers", "Closed explicitly", "connection refused", "connection reset"} {
+		if strings.Contains(msg, s) {
+			return KindConnection
+		}
+	}
+	return KindOther
+}
@@ -0,0 +1,37 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestErrorKind(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, ""},
+		{ErrNotFound, KindNotFound},
+		{NotFoundError{Entity: "customer", ID: "1"}, KindNotFound},
+		{fmt.Errorf("get user: %w", ErrNotFound), KindNotFound},
+		{ErrInvalidHexID, KindInvalidInput},
+		{AlreadyExistsError{Field: "username"}, KindConflict},
+		{ErrVersionMismatch, KindConflict},
+		{context.DeadlineExceeded, KindTimeout},
+		{&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, KindTimeout},
+		{errors.New("read tcp 10.0.0.1:27017: i/o timeout"), KindTimeout},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, KindConnection},
+		{io.EOF, KindConnection},
+		{errors.New("no reachable servers"), KindConnection},
+		{errors.New("E11000 something odd"), KindOther},
+	} {
+		if got := ErrorKind(tc.err); got != tc.want {
+			t.Errorf("%v: expected kind %q, received %q", tc.err, tc.want, got)
+		}
+	}
+}
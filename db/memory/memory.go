@@ -0,0 +1,1079 @@
+package memory
+
+// memory.go contains an in-memory implementation of the Database interface.
+// It mirrors the behaviour of the mongodb implementation and is meant for
+// local development, tests and as a read-only snapshot source.
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+	"gopkg.in/mgo.v2/bson"
+)
+
+var (
+	//ErrInvalidHexID represents a entity id that is not a valid bson ObjectID
+	ErrInvalidHexID = db.ErrInvalidHexID
+	//ErrDuplicateUsername is returned when a username is already taken
+	ErrDuplicateUsername error = db.AlreadyExistsError{Field: "username"}
+	//ErrDuplicateEmail is returned when an email is already taken
+	ErrDuplicateEmail error = db.AlreadyExistsError{Field: "email"}
+	//ErrDuplicateSkeleton is returned when the skeleton of a username is
+	//already taken, after SetUniqueSkeletons(true)
+	ErrDuplicateSkeleton error = db.AlreadyExistsError{Field: db.UsernameSkeletonField}
+)
+
+type customer struct {
+	users.User
+	AddressIDs    []string
+	CardIDs       []string
+	RefreshTokens []users.RefreshToken
+	MFA           users.MFA
+}
+
+// Memory meets the Database interface requirements
+type Memory struct {
+	mu        sync.RWMutex
+	audit     []db.AuditEntry
+	order     []string
+	customers map[string]customer
+	addresses map[string]users.Address
+	cards     map[string]users.Card
+	// uniqueSkeletons refuses usernames whose users.UsernameSkeleton
+	// another user holds
+	uniqueSkeletons bool
+}
+
+// New returns an empty in-memory database
+func New() *Memory {
+	m := &Memory{}
+	m.Init()
+	return m
+}
+
+// ForTenant returns an empty database of its own for tenant. Every call
+// returns a new one, callers keep the database of a tenant.
+func (m *Memory) ForTenant(tenant string) (db.Database, error) {
+	if tenant == "" {
+		return nil, db.ErrNoTenant
+	}
+	t := New()
+	t.uniqueSkeletons = m.uniqueSkeletons
+	return t, nil
+}
+
+// SetUniqueSkeletons refuses usernames whose users.UsernameSkeleton another
+// user holds, as MongoDB does WithUniqueSkeletons
+func (m *Memory) SetUniqueSkeletons(unique bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uniqueSkeletons = unique
+}
+
+// skeletonTaken reports whether a user other than id holds a username of
+// the skeleton of name, when skeletons are unique
+func (m *Memory) skeletonTaken(id, name string) bool {
+	if !m.uniqueSkeletons {
+		return false
+	}
+	skeleton := users.UsernameSkeleton(name)
+	for oid, o := range m.customers {
+		if oid != id && users.UsernameSkeleton(o.Username) == skeleton {
+			return true
+		}
+	}
+	return false
+}
+
+// Init clears the database
+func (m *Memory) Init() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.order = make([]string, 0)
+	m.customers = make(map[string]customer)
+	m.addresses = make(map[string]users.Address)
+	m.cards = make(map[string]users.Card)
+	m.audit = make([]db.AuditEntry, 0)
+	return nil
+}
+
+// toUser returns the customer as a user holding only attribute ids
+func (c customer) toUser(id string) users.User {
+	u := c.User
+	u.UserID = id
+	if c.Preferences != nil {
+		u.Preferences = users.MergePreferences(c.Preferences, nil)
+	}
+	if c.Emails != nil {
+		u.Emails = append([]users.EmailAddress(nil), c.Emails...)
+	}
+	if c.ConsentHistory != nil {
+		u.ConsentHistory = append([]users.ConsentRecord(nil), c.ConsentHistory...)
+	}
+	u.Addresses = make([]users.Address, 0)
+	for _, aid := range c.AddressIDs {
+		u.Addresses = append(u.Addresses, users.Address{ID: aid})
+	}
+	u.Cards = make([]users.Card, 0)
+	for _, cid := range c.CardIDs {
+		u.Cards = append(u.Cards, users.Card{ID: cid})
+	}
+	return u
+}
+
+// holdsEmail reports whether email is the primary email of c or one of its
+// other emails
+func (c customer) holdsEmail(email string) bool {
+	return users.SameEmail(c.Email, email) || c.FindEmail(email) >= 0
+}
+
+// CreateUser stores the user, including connected addresses and cards, and
+// updates the passed in user with ids
+func (m *Memory) CreateUser(u *users.User) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range m.customers {
+		if c.Username == u.Username {
+			return ErrDuplicateUsername
+		}
+		if c.holdsEmail(u.Email) {
+			return ErrDuplicateEmail
+		}
+	}
+	if m.skeletonTaken("", u.Username) {
+		return ErrDuplicateSkeleton
+	}
+	id := bson.NewObjectId().Hex()
+	c := customer{User: *u, AddressIDs: make([]string, 0), CardIDs: make([]string, 0)}
+	c.User.Addresses = nil
+	c.User.Cards = nil
+	c.User.DefaultShipping = ""
+	c.User.DefaultBilling = ""
+	c.User.DefaultCard = ""
+	for k, a := range u.Addresses {
+		a.ID = bson.NewObjectId().Hex()
+		m.addresses[a.ID] = a
+		c.AddressIDs = append(c.AddressIDs, a.ID)
+		u.Addresses[k].ID = a.ID
+	}
+	for k, ca := range u.Cards {
+		ca.ID = bson.NewObjectId().Hex()
+		ca.Brand = users.DetectBrand(ca.LongNum)
+		m.cards[ca.ID] = ca
+		c.CardIDs = append(c.CardIDs, ca.ID)
+		if c.DefaultCard == "" {
+			c.DefaultCard = ca.ID
+		}
+		u.Cards[k].ID = ca.ID
+		u.Cards[k].Brand = ca.Brand
+	}
+	m.customers[id] = c
+	m.order = append(m.order, id)
+	u.UserID = id
+	u.DefaultCard = c.DefaultCard
+	return nil
+}
+
+// UpdateUser updates the profile fields of the user identified by u.UserID
+func (m *Memory) UpdateUser(u *users.User) error {
+	if !bson.IsObjectIdHex(u.UserID) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[u.UserID]
+	if !ok {
+		return db.ErrNotFound
+	}
+	for id, o := range m.customers {
+		if id != u.UserID && (o.Username == u.Username || o.holdsEmail(u.Email)) {
+			return db.ErrAlreadyExists
+		}
+	}
+	if m.skeletonTaken(u.UserID, u.Username) {
+		return ErrDuplicateSkeleton
+	}
+	c.FirstName = u.FirstName
+	c.LastName = u.LastName
+	c.Email = u.Email
+	c.Username = u.Username
+	c.Phone = u.Phone
+	c.DisplayName = u.DisplayName
+	c.Version++
+	m.customers[u.UserID] = c
+	return nil
+}
+
+// PatchUser sets only the fields present in p on the user with the given id
+func (m *Memory) PatchUser(id string, p users.UserPatch) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	for oid, o := range m.customers {
+		if oid == id {
+			continue
+		}
+		if (p.Username != nil && o.Username == *p.Username) ||
+			(p.Email != nil && o.holdsEmail(*p.Email)) {
+			return db.ErrAlreadyExists
+		}
+	}
+	if p.Username != nil && m.skeletonTaken(id, *p.Username) {
+		return ErrDuplicateSkeleton
+	}
+	p.Apply(&c.User)
+	c.Version++
+	m.customers[id] = c
+	return nil
+}
+
+// SetUserPassword replaces the password hash and salt of the user
+func (m *Memory) SetUserPassword(id, hash, salt string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	c.Password = hash
+	c.Salt = salt
+	m.customers[id] = c
+	return nil
+}
+
+// ReplaceUserPassword replaces the password hash and salt of the user if
+// its hash is still old
+func (m *Memory) ReplaceUserPassword(id, old, hash, salt string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	if c.Password != old {
+		return db.ErrVersionMismatch
+	}
+	c.Password = hash
+	c.Salt = salt
+	m.customers[id] = c
+	return nil
+}
+
+// SetUserRoles replaces the roles of the user
+func (m *Memory) SetUserRoles(id string, roles []string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	c.Roles = append([]string(nil), roles...)
+	c.Version++
+	m.customers[id] = c
+	return nil
+}
+
+// SetUserStatus sets the account status of the user
+func (m *Memory) SetUserStatus(id, status string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	c.Status = status
+	c.Version++
+	m.customers[id] = c
+	return nil
+}
+
+// BumpCredentialsVersion increments the credentials version of the user
+func (m *Memory) BumpCredentialsVersion(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	c.CredentialsVersion++
+	m.customers[id] = c
+	return nil
+}
+
+// UpdateUserPreferences sets the preferences of the user changed, a nil
+// value unsetting its key
+func (m *Memory) UpdateUserPreferences(id string, changes map[string]*string) (map[string]string, error) {
+	if !bson.IsObjectIdHex(id) {
+		return nil, ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return nil, db.ErrNotFound
+	}
+	c.Preferences = users.MergePreferences(c.Preferences, changes)
+	c.Version++
+	m.customers[id] = c
+	return users.MergePreferences(c.Preferences, nil), nil
+}
+
+// SetUserEmails replaces the primary email and the emails of the user
+func (m *Memory) SetUserEmails(id, primary string, emails []users.EmailAddress, version int64) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	if c.Version != version {
+		return db.ErrVersionMismatch
+	}
+	for oid, o := range m.customers {
+		if oid == id {
+			continue
+		}
+		if o.holdsEmail(primary) {
+			return ErrDuplicateEmail
+		}
+		for _, e := range emails {
+			if o.holdsEmail(e.Address) {
+				return ErrDuplicateEmail
+			}
+		}
+	}
+	c.Email = primary
+	c.Emails = append([]users.EmailAddress(nil), emails...)
+	c.Version++
+	m.customers[id] = c
+	return nil
+}
+
+// AppendConsents appends records to the consent history of the user
+func (m *Memory) AppendConsents(id string, records []users.ConsentRecord) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return db.ErrNotFound
+	}
+	c.ConsentHistory = append(append([]users.ConsentRecord(nil), c.ConsentHistory...), records...)
+	c.Version++
+	m.customers[id] = c
+	return nil
+}
+
+// CreateRefreshToken stores t for the user, dropping expired tokens
+func (m *Memory) CreateRefreshToken(userID string, t users.RefreshToken) error {
+	if !bson.IsObjectIdHex(userID) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[userID]
+	if !ok {
+		return db.ErrNotFound
+	}
+	now := time.Now()
+	ts := make([]users.RefreshToken, 0, len(c.RefreshTokens)+1)
+	for _, o := range c.RefreshTokens {
+		if now.Before(o.ExpiresAt) {
+			ts = append(ts, o)
+		}
+	}
+	c.RefreshTokens = append(ts, t)
+	m.customers[userID] = c
+	return nil
+}
+
+// UseRefreshToken marks the token with the given hash as used, returning
+// its owner and its state from before the call
+func (m *Memory) UseRefreshToken(hash string) (string, users.RefreshToken, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, c := range m.customers {
+		for k, t := range c.RefreshTokens {
+			if t.Hash == hash {
+				c.RefreshTokens[k].Used = true
+				return id, t, nil
+			}
+		}
+	}
+	return "", users.RefreshToken{}, db.ErrNotFound
+}
+
+// GetRefreshTokens returns the active refresh tokens of the user
+func (m *Memory) GetRefreshTokens(userID string) ([]users.RefreshToken, error) {
+	ts := make([]users.RefreshToken, 0)
+	if !bson.IsObjectIdHex(userID) {
+		return ts, ErrInvalidHexID
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.customers[userID]
+	if !ok {
+		return ts, db.ErrNotFound
+	}
+	now := time.Now()
+	for _, t := range c.RefreshTokens {
+		if t.Active(now) {
+			ts = append(ts, t)
+		}
+	}
+	return ts, nil
+}
+
+// RevokeRefreshTokens revokes the user's tokens with the given ids, or all
+// of them when no ids are given
+func (m *Memory) RevokeRefreshTokens(userID string, ids ...string) error {
+	if !bson.IsObjectIdHex(userID) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[userID]
+	if !ok {
+		return db.ErrNotFound
+	}
+	for k, t := range c.RefreshTokens {
+		if len(ids) == 0 || contains(ids, t.ID) {
+			c.RefreshTokens[k].Revoked = true
+		}
+	}
+	return nil
+}
+
+// GetMFA returns the two-factor enrollment of the user
+func (m *Memory) GetMFA(userID string) (users.MFA, error) {
+	if !bson.IsObjectIdHex(userID) {
+		return users.MFA{}, ErrInvalidHexID
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.customers[userID]
+	if !ok {
+		return users.MFA{}, db.ErrNotFound
+	}
+	mfa := c.MFA
+	mfa.RecoveryCodes = append([]string(nil), c.MFA.RecoveryCodes...)
+	return mfa, nil
+}
+
+// SetMFA replaces the two-factor enrollment of the user
+func (m *Memory) SetMFA(userID string, mfa users.MFA) error {
+	if !bson.IsObjectIdHex(userID) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[userID]
+	if !ok {
+		return db.ErrNotFound
+	}
+	mfa.RecoveryCodes = append([]string(nil), mfa.RecoveryCodes...)
+	c.MFA = mfa
+	m.customers[userID] = c
+	return nil
+}
+
+// UseMFAStep records step as the last used TOTP step if it is newer
+func (m *Memory) UseMFAStep(userID string, step int64) error {
+	if !bson.IsObjectIdHex(userID) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[userID]
+	if !ok || c.MFA.LastStep >= step {
+		return db.ErrNotFound
+	}
+	c.MFA.LastStep = step
+	m.customers[userID] = c
+	return nil
+}
+
+// UseRecoveryCode removes the recovery code with the given hash
+func (m *Memory) UseRecoveryCode(userID, hash string) error {
+	if !bson.IsObjectIdHex(userID) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[userID]
+	if !ok || !contains(c.MFA.RecoveryCodes, hash) {
+		return db.ErrNotFound
+	}
+	c.MFA.RecoveryCodes = remove(c.MFA.RecoveryCodes, hash)
+	m.customers[userID] = c
+	return nil
+}
+
+// GetUserByName Get user by their name
+func (m *Memory) GetUserByName(name string) (users.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, id := range m.order {
+		if c := m.customers[id]; c.Username == name && !c.Anonymized {
+			return c.toUser(id), nil
+		}
+	}
+	return users.New(), db.ErrNotFound
+}
+
+// GetUserByNameWithAttributes gets the user by their name along with its
+// addresses and cards, under a single lock
+func (m *Memory) GetUserByNameWithAttributes(name string) (users.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, id := range m.order {
+		if c := m.customers[id]; c.Username == name && !c.Anonymized {
+			u := c.toUser(id)
+			u.Addresses = make([]users.Address, 0)
+			for _, aid := range c.AddressIDs {
+				if a, ok := m.addresses[aid]; ok {
+					u.Addresses = append(u.Addresses, a)
+				}
+			}
+			u.Cards = make([]users.Card, 0)
+			for _, cid := range c.CardIDs {
+				if card, ok := m.cards[cid]; ok {
+					u.Cards = append(u.Cards, card)
+				}
+			}
+			return u, nil
+		}
+	}
+	return users.New(), db.ErrNotFound
+}
+
+// GetUserByEmail returns the user holding email verified
+func (m *Memory) GetUserByEmail(email string) (users.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, id := range m.order {
+		if c := m.customers[id]; c.HasVerifiedEmail(email) && !c.Anonymized {
+			return c.toUser(id), nil
+		}
+	}
+	return users.New(), db.ErrNotFound
+}
+
+// GetUserBySkeleton returns a user whose username has the given
+// users.UsernameSkeleton
+func (m *Memory) GetUserBySkeleton(skeleton string) (users.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, id := range m.order {
+		if c := m.customers[id]; users.UsernameSkeleton(c.Username) == skeleton && !c.Anonymized {
+			return c.toUser(id), nil
+		}
+	}
+	return users.New(), db.ErrNotFound
+}
+
+// GetUser Get user by their object id
+func (m *Memory) GetUser(id string) (users.User, error) {
+	if !bson.IsObjectIdHex(id) {
+		return users.New(), ErrInvalidHexID
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return users.New(), db.ErrNotFound
+	}
+	return c.toUser(id), nil
+}
+
+// GetUsers Get all users
+func (m *Memory) GetUsers() ([]users.User, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	us := make([]users.User, 0)
+	for _, id := range m.order {
+		if c := m.customers[id]; !c.Anonymized {
+			us = append(us, c.toUser(id))
+		}
+	}
+	return us, nil
+}
+
+// GetUsersSorted lists the users in the order of s. Ids are created in
+// ascending order, so they stand for createdAt.
+func (m *Memory) GetUsersSorted(s db.Sort) ([]users.User, error) {
+	us, err := m.GetUsers()
+	if err != nil {
+		return us, err
+	}
+	field := func(u users.User) string {
+		switch s.Field {
+		case "username":
+			return u.Username
+		case "firstName":
+			return u.FirstName
+		case "lastName":
+			return u.LastName
+		case "email":
+			return u.Email
+		}
+		return ""
+	}
+	sort.Slice(us, func(i, j int) bool {
+		a, b := us[i], us[j]
+		if s.Desc {
+			a, b = b, a
+		}
+		if fa, fb := field(a), field(b); fa != fb {
+			return fa < fb
+		}
+		return a.UserID < b.UserID
+	})
+	return us, nil
+}
+
+// GetUserAttributes given a user, load all cards and addresses connected to that user
+func (m *Memory) GetUserAttributes(u *users.User) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	na := make([]users.Address, 0)
+	for _, a := range u.Addresses {
+		if !bson.IsObjectIdHex(a.ID) {
+			return ErrInvalidHexID
+		}
+		if sa, ok := m.addresses[a.ID]; ok {
+			na = append(na, sa)
+		}
+	}
+	nc := make([]users.Card, 0)
+	for _, c := range u.Cards {
+		if !bson.IsObjectIdHex(c.ID) {
+			return ErrInvalidHexID
+		}
+		if sc, ok := m.cards[c.ID]; ok {
+			nc = append(nc, sc)
+		}
+	}
+	u.Addresses = na
+	u.Cards = nc
+	return nil
+}
+
+// GetAddress Gets an address by object Id
+func (m *Memory) GetAddress(id string) (users.Address, error) {
+	if !bson.IsObjectIdHex(id) {
+		return users.Address{}, ErrInvalidHexID
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	a, ok := m.addresses[id]
+	if !ok {
+		return users.Address{}, db.ErrNotFound
+	}
+	return a, nil
+}
+
+// GetAddresses gets all addresses
+func (m *Memory) GetAddresses() ([]users.Address, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	as := make([]users.Address, 0)
+	for _, a := range m.addresses {
+		as = append(as, a)
+	}
+	return as, nil
+}
+
+// StreamUsers calls fn with each user in the order of s, as stored when
+// the listing starts
+func (m *Memory) StreamUsers(s db.Sort, fn func(users.User) error) error {
+	us, err := m.GetUsersSorted(s)
+	if err != nil {
+		return err
+	}
+	return each(us, fn)
+}
+
+// StreamAddresses calls fn with each address, as stored when the listing
+// starts
+func (m *Memory) StreamAddresses(fn func(users.Address) error) error {
+	as, err := m.GetAddresses()
+	if err != nil {
+		return err
+	}
+	return each(as, fn)
+}
+
+// StreamCards calls fn with each card, as stored when the listing starts
+func (m *Memory) StreamCards(fn func(users.Card) error) error {
+	cs, err := m.GetCards()
+	if err != nil {
+		return err
+	}
+	return each(cs, fn)
+}
+
+// each calls fn with the items in turn, stopping at the first error
+func each[T any](items []T, fn func(T) error) error {
+	for _, item := range items {
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateAddress stores the address and links it to userid when given
+func (m *Memory) CreateAddress(a *users.Address, userid string) error {
+	if userid != "" && !bson.IsObjectIdHex(userid) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	na := *a
+	na.ID = bson.NewObjectId().Hex()
+	m.addresses[na.ID] = na
+	// Address for anonymous user
+	if userid != "" {
+		c, ok := m.customers[userid]
+		if !ok {
+			return db.ErrNotFound
+		}
+		c.AddressIDs = appendUnique(c.AddressIDs, na.ID)
+		c.Version++
+		m.customers[userid] = c
+	}
+	*a = na
+	return nil
+}
+
+// SetDefaultAddress makes the address of the user the default of type typ
+func (m *Memory) SetDefaultAddress(userID, addressID, typ string) error {
+	if !bson.IsObjectIdHex(userID) || !bson.IsObjectIdHex(addressID) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[userID]
+	if !ok || !contains(c.AddressIDs, addressID) {
+		return db.ErrNotFound
+	}
+	switch typ {
+	case users.AddressShipping:
+		c.DefaultShipping = addressID
+	case users.AddressBilling:
+		c.DefaultBilling = addressID
+	default:
+		return fmt.Errorf("no default address of type %q", typ)
+	}
+	c.Version++
+	m.customers[userID] = c
+	return nil
+}
+
+// GetCard Gets card by objects Id
+func (m *Memory) GetCard(id string) (users.Card, error) {
+	if !bson.IsObjectIdHex(id) {
+		return users.Card{}, ErrInvalidHexID
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	c, ok := m.cards[id]
+	if !ok {
+		return users.Card{}, db.ErrNotFound
+	}
+	return c, nil
+}
+
+// GetCards Gets all cards
+func (m *Memory) GetCards() ([]users.Card, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	cs := make([]users.Card, 0)
+	for _, c := range m.cards {
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+// SetCardLabel replaces the label of the card the user holds
+func (m *Memory) SetCardLabel(userID, cardID, label string) error {
+	if !bson.IsObjectIdHex(userID) || !bson.IsObjectIdHex(cardID) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[userID]
+	card, held := m.cards[cardID]
+	if !ok || !held || !contains(c.CardIDs, cardID) {
+		return db.ErrNotFound
+	}
+	card.Label = label
+	m.cards[cardID] = card
+	c.Version++
+	m.customers[userID] = c
+	return nil
+}
+
+// SetDefaultCard makes the card of the user its default card
+func (m *Memory) SetDefaultCard(userID, cardID string) error {
+	if !bson.IsObjectIdHex(userID) || !bson.IsObjectIdHex(cardID) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[userID]
+	if !ok || !contains(c.CardIDs, cardID) {
+		return db.ErrNotFound
+	}
+	c.DefaultCard = cardID
+	c.Version++
+	m.customers[userID] = c
+	return nil
+}
+
+// CreateCard stores the card and links it to userid when given
+func (m *Memory) CreateCard(ca *users.Card, userid string) error {
+	if userid != "" && !bson.IsObjectIdHex(userid) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	nc := *ca
+	nc.ID = bson.NewObjectId().Hex()
+	nc.Brand = users.DetectBrand(nc.LongNum)
+	m.cards[nc.ID] = nc
+	// Card for anonymous user
+	if userid != "" {
+		c, ok := m.customers[userid]
+		if !ok {
+			return db.ErrNotFound
+		}
+		c.CardIDs = appendUnique(c.CardIDs, nc.ID)
+		if c.DefaultCard == "" {
+			c.DefaultCard = nc.ID
+		}
+		c.Version++
+		m.customers[userid] = c
+	}
+	*ca = nc
+	return nil
+}
+
+// LinkAttribute links the address or card created without a customer in
+// the guest session with hash guest to the user
+func (m *Memory) LinkAttribute(entity, id, userID, guest string) error {
+	if !bson.IsObjectIdHex(id) || !bson.IsObjectIdHex(userID) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch entity {
+	case "addresses":
+		if a, ok := m.addresses[id]; !ok || guest == "" || a.Guest != guest {
+			return db.NotFoundError{Entity: entity, ID: id}
+		}
+	case "cards":
+		if c, ok := m.cards[id]; !ok || guest == "" || c.Guest != guest {
+			return db.NotFoundError{Entity: entity, ID: id}
+		}
+	default:
+		return fmt.Errorf("no attribute %q", entity)
+	}
+	c, ok := m.customers[userID]
+	if !ok {
+		return db.NotFoundError{Entity: "customers", ID: userID}
+	}
+	for _, o := range m.customers {
+		if contains(o.AddressIDs, id) || contains(o.CardIDs, id) {
+			return db.ErrAlreadyLinked
+		}
+	}
+	if entity == "addresses" {
+		c.AddressIDs = append(c.AddressIDs, id)
+	} else {
+		c.CardIDs = append(c.CardIDs, id)
+		if c.DefaultCard == "" {
+			c.DefaultCard = id
+		}
+	}
+	c.Version++
+	m.customers[userID] = c
+	return nil
+}
+
+// Delete removes an entity, cascading customers to their addresses and
+// cards and unlinking addresses and cards from their customers
+func (m *Memory) Delete(entity, id string, version int64) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch entity {
+	case "customers":
+		c, ok := m.customers[id]
+		if !ok {
+			return db.NotFoundError{Entity: entity, ID: id}
+		}
+		if version != db.AnyVersion && c.Version != version {
+			return db.ErrVersionMismatch
+		}
+		for _, aid := range c.AddressIDs {
+			delete(m.addresses, aid)
+		}
+		for _, cid := range c.CardIDs {
+			delete(m.cards, cid)
+		}
+		delete(m.customers, id)
+		m.order = remove(m.order, id)
+	case "addresses":
+		if _, ok := m.addresses[id]; !ok {
+			return db.NotFoundError{Entity: entity, ID: id}
+		}
+		for k, c := range m.customers {
+			if ids := remove(c.AddressIDs, id); len(ids) != len(c.AddressIDs) {
+				c.AddressIDs = ids
+				if c.DefaultShipping == id {
+					c.DefaultShipping = ""
+				}
+				if c.DefaultBilling == id {
+					c.DefaultBilling = ""
+				}
+				c.Version++
+				m.customers[k] = c
+			}
+		}
+		delete(m.addresses, id)
+	case "cards":
+		if _, ok := m.cards[id]; !ok {
+			return db.NotFoundError{Entity: entity, ID: id}
+		}
+		for k, c := range m.customers {
+			if ids := remove(c.CardIDs, id); len(ids) != len(c.CardIDs) {
+				c.CardIDs = ids
+				if c.DefaultCard == id {
+					c.DefaultCard = ""
+					if len(ids) > 0 {
+						c.DefaultCard = ids[0]
+					}
+				}
+				c.Version++
+				m.customers[k] = c
+			}
+		}
+		delete(m.cards, id)
+	default:
+		return db.NotFoundError{Entity: entity, ID: id}
+	}
+	return nil
+}
+
+// AnonymizeUser erases the personal data of a customer, deleting its
+// addresses and cards, while keeping the customer and its id
+func (m *Memory) AnonymizeUser(id string) error {
+	if !bson.IsObjectIdHex(id) {
+		return ErrInvalidHexID
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c, ok := m.customers[id]
+	if !ok {
+		return db.NotFoundError{Entity: "customers", ID: id}
+	}
+	for _, aid := range c.AddressIDs {
+		delete(m.addresses, aid)
+	}
+	for _, cid := range c.CardIDs {
+		delete(m.cards, cid)
+	}
+	c.User.UserID = id
+	c.User.Anonymize()
+	c.User.Addresses = nil
+	c.User.Cards = nil
+	c.AddressIDs = make([]string, 0)
+	c.CardIDs = make([]string, 0)
+	c.RefreshTokens = nil
+	c.MFA = users.MFA{}
+	c.Version++
+	m.customers[id] = c
+	return nil
+}
+
+// RecordAudit appends the entry to the audit log
+func (m *Memory) RecordAudit(e db.AuditEntry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.audit = append(m.audit, e)
+	return nil
+}
+
+// AuditLog returns the recorded audit entries in order
+func (m *Memory) AuditLog() []db.AuditEntry {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return append([]db.AuditEntry(nil), m.audit...)
+}
+
+// Ping always succeeds
+func (m *Memory) Ping() error {
+	return nil
+}
+
+func appendUnique(ids []string, id string) []string {
+	for _, i := range ids {
+		if i == id {
+			return ids
+		}
+	}
+	return append(ids, id)
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func remove(ids []string, id string) []string {
+	n := make([]string, 0, len(ids))
+	for _, i := range ids {
+		if i != id {
+			n = append(n, i)
+		}
+	}
+	return n
+}
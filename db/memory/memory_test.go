@@ -0,0 +1,14 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/dbtest"
+)
+
+func TestConformance(t *testing.T) {
+	dbtest.RunConformanceTests(t, func() db.Database {
+		return New()
+	})
+}
@@ -0,0 +1,182 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Migration is a numbered, one-off change to the stored data of a driver
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(Database) error
+}
+
+// MigrationStore is implemented by databases that track applied migrations
+type MigrationStore interface {
+	// AppliedMigrations returns the versions already applied
+	AppliedMigrations() ([]int, error)
+	// RecordMigration marks the migration as applied
+	RecordMigration(Migration) error
+	// AcquireMigrationLock takes the advisory migration lock for owner, or
+	// renews it when owner holds it, reporting false when somebody else
+	// holds an unexpired lock
+	AcquireMigrationLock(owner string, ttl time.Duration) (bool, error)
+	// ReleaseMigrationLock releases the lock if held by owner
+	ReleaseMigrationLock(owner string) error
+}
+
+var (
+	migrationsMu sync.Mutex
+	migrations   = map[string][]Migration{}
+	// MigrationLockTTL bounds how long a crashed replica can block others
+	MigrationLockTTL = 5 * time.Minute
+	// MigrationLockPoll is how often a waiting replica retries the lock
+	MigrationLockPoll = time.Second
+	// ErrMigrationLocked is returned when the lock could not be acquired in time
+	ErrMigrationLocked = errors.New("Timed out waiting for migration lock")
+	// ErrMigrationLockLost is returned when the lock could not be renewed
+	// while migrating, so another replica may be migrating too
+	ErrMigrationLockLost = errors.New("Lost the migration lock")
+)
+
+// RegisterMigration registers a migration for the named driver
+func RegisterMigration(driver string, m Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	for _, e := range migrations[driver] {
+		if e.Version == m.Version {
+			panic(fmt.Sprintf("migration %v registered twice for %v", m.Version, driver))
+		}
+	}
+	migrations[driver] = append(migrations[driver], m)
+}
+
+// Migrations returns the migrations registered for driver ordered by version
+func Migrations(driver string) []Migration {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	ms := append([]Migration(nil), migrations[driver]...)
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms
+}
+
+// Migrate applies the pending migrations of driver to d, holding the
+// advisory lock so concurrent replicas never run the same migration twice.
+// The lock is renewed while migrating, for migrations outlasting its TTL.
+func Migrate(driver string, d Database) (err error) {
+	store, ok := d.(MigrationStore)
+	if !ok {
+		return nil
+	}
+	ms := Migrations(driver)
+	if len(ms) == 0 {
+		return nil
+	}
+	owner := migrationOwner()
+	deadline := time.Now().Add(MigrationLockTTL)
+	for {
+		locked, err := store.AcquireMigrationLock(owner, MigrationLockTTL)
+		if err != nil {
+			return err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			return ErrMigrationLocked
+		}
+		time.Sleep(MigrationLockPoll)
+	}
+	renewal := renewMigrationLock(store, owner)
+	defer func() {
+		renewal.stop()
+		if rerr := store.ReleaseMigrationLock(owner); rerr != nil && err == nil {
+			err = fmt.Errorf("releasing migration lock: %v", rerr)
+		}
+	}()
+
+	applied, err := store.AppliedMigrations()
+	if err != nil {
+		return err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, v := range applied {
+		done[v] = true
+	}
+	for _, m := range ms {
+		if done[m.Version] {
+			continue
+		}
+		if err := renewal.err(); err != nil {
+			return err
+		}
+		if err := m.Up(d); err != nil {
+			return fmt.Errorf("migration %v (%v): %v", m.Version, m.Name, err)
+		}
+		if err := store.RecordMigration(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockRenewal renews the migration lock of an owner until stopped
+type lockRenewal struct {
+	done    chan struct{}
+	stopped chan struct{}
+	mu      sync.Mutex
+	failed  error
+}
+
+// renewMigrationLock renews the lock of owner every third of its TTL until
+// stopped, remembering the first renewal failing
+func renewMigrationLock(store MigrationStore, owner string) *lockRenewal {
+	r := &lockRenewal{done: make(chan struct{}), stopped: make(chan struct{})}
+	go func() {
+		defer close(r.stopped)
+		ticker := time.NewTicker(MigrationLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-r.done:
+				return
+			case <-ticker.C:
+			}
+			locked, err := store.AcquireMigrationLock(owner, MigrationLockTTL)
+			if err == nil && !locked {
+				err = ErrMigrationLockLost
+			}
+			if err != nil {
+				r.mu.Lock()
+				if r.failed == nil {
+					r.failed = err
+				}
+				r.mu.Unlock()
+			}
+		}
+	}()
+	return r
+}
+
+// err returns the first renewal failing, nil while the lock is held
+func (r *lockRenewal) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed
+}
+
+// stop stops renewing the lock and waits for a renewal under way
+func (r *lockRenewal) stop() {
+	close(r.done)
+	<-r.stopped
+}
+
+func migrationOwner() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%v-%v-%v", host, os.Getpid(), time.Now().UnixNano())
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type fakeMigrationStore struct {
+	fake
+	applied    []int
+	mu         sync.Mutex
+	owner      string
+	renewals   int
+	releaseErr error
+}
+
+func (f *fakeMigrationStore) AppliedMigrations() ([]int, error) {
+	return f.applied, nil
+}
+
+func (f *fakeMigrationStore) RecordMigration(m Migration) error {
+	f.applied = append(f.applied, m.Version)
+	return nil
+}
+
+func (f *fakeMigrationStore) AcquireMigrationLock(owner string, ttl time.Duration) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.owner != "" && f.owner != owner {
+		return false, nil
+	}
+	if f.owner == owner {
+		f.renewals++
+	}
+	f.owner = owner
+	return true, nil
+}
+
+func (f *fakeMigrationStore) ReleaseMigrationLock(owner string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.owner == owner {
+		f.owner = ""
+	}
+	return f.releaseErr
+}
+
+func TestMigrate(t *testing.T) {
+	var ran []int
+	for _, v := range []int{2, 1, 3} {
+		v := v
+		RegisterMigration("migratetest", Migration{
+			Version: v,
+			Up: func(Database) error {
+				ran = append(ran, v)
+				return nil
+			},
+		})
+	}
+	store := &fakeMigrationStore{applied: []int{2}}
+	if err := Migrate("migratetest", store); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 2 || ran[0] != 1 || ran[1] != 3 {
+		t.Errorf("Expected migrations 1 and 3 in order, ran %v", ran)
+	}
+	if len(store.applied) != 3 {
+		t.Errorf("Expected three applied migrations, received %v", store.applied)
+	}
+	if store.owner != "" {
+		t.Error("Expected migration lock released")
+	}
+	ran = nil
+	if err := Migrate("migratetest", store); err != nil {
+		t.Fatal(err)
+	}
+	if len(ran) != 0 {
+		t.Errorf("Expected no migrations on second run, ran %v", ran)
+	}
+}
+
+func TestMigrateFailureStops(t *testing.T) {
+	ErrMigration := errors.New("migration failed")
+	RegisterMigration("migratefail", Migration{Version: 1, Up: func(Database) error { return ErrMigration }})
+	RegisterMigration("migratefail", Migration{Version: 2, Up: func(Database) error { return nil }})
+	store := &fakeMigrationStore{}
+	if err := Migrate("migratefail", store); err == nil {
+		t.Error("Expected migration error")
+	}
+	if len(store.applied) != 0 {
+		t.Errorf("Expected nothing recorded, received %v", store.applied)
+	}
+}
+
+func TestMigrateWaitsForLock(t *testing.T) {
+	RegisterMigration("migratelocked", Migration{Version: 1, Up: func(Database) error { return nil }})
+	store := &fakeMigrationStore{owner: "other"}
+	ttl, poll := MigrationLockTTL, MigrationLockPoll
+	MigrationLockTTL, MigrationLockPoll = 10*time.Millisecond, time.Millisecond
+	defer func() { MigrationLockTTL, MigrationLockPoll = ttl, poll }()
+	if err := Migrate("migratelocked", store); err != ErrMigrationLocked {
+		t.Errorf("Expected lock timeout, received %v", err)
+	}
+}
+
+func TestMigrateRenewsLock(t *testing.T) {
+	RegisterMigration("migraterenew", Migration{Version: 1, Up: func(Database) error {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}})
+	store := &fakeMigrationStore{}
+	ttl := MigrationLockTTL
+	MigrationLockTTL = 15 * time.Millisecond
+	defer func() { MigrationLockTTL = ttl }()
+	if err := Migrate("migraterenew", store); err != nil {
+		t.Fatal(err)
+	}
+	if store.renewals == 0 {
+		t.Error("Expected the lock renewed while migrating")
+	}
+}
+
+func TestMigrateReportsRelease(t *testing.T) {
+	RegisterMigration("migraterelease", Migration{Version: 1, Up: func(Database) error { return nil }})
+	store := &fakeMigrationStore{releaseErr: errors.New("release failed")}
+	if err := Migrate("migraterelease", store); err == nil {
+		t.Error("Expected the release error returned")
+	}
+}
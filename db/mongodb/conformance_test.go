@@ -0,0 +1,37 @@
+//go:build integration
+
+package mongodb_test
+
+import (
+	"testing"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/dbtest"
+	"github.com/microservices-demo/user/db/mongodb"
+	"gopkg.in/mgo.v2"
+	mgodbtest "gopkg.in/mgo.v2/dbtest"
+)
+
+func TestConformance(t *testing.T) {
+	var server mgodbtest.DBServer
+	server.SetPath(t.TempDir())
+	defer server.Stop()
+	var sessions []*mgo.Session
+	defer func() {
+		for _, s := range sessions {
+			s.Close()
+		}
+	}()
+	dbtest.RunConformanceTests(t, func() db.Database {
+		s := server.Session()
+		sessions = append(sessions, s)
+		if err := s.DB("").DropDatabase(); err != nil {
+			t.Fatal(err)
+		}
+		m := &mongodb.Mongo{Session: s}
+		if err := m.EnsureIndexes(); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	})
+}
@@ -0,0 +1,139 @@
+package mongodb
+
+// mfa.go contains the storage of two-factor enrollments, kept as a
+// sub-document of the customer.
+
+import (
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/attribute"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// GetMFA returns the two-factor enrollment of the user
+func (m *Mongo) GetMFA(userID string) (users.MFA, error) {
+	_, span := m.start("mongodb: get mfa")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", userID),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(userID) {
+		recordError(span, ErrInvalidHexID)
+		return users.MFA{}, ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	var mu MongoUser
+	err := c.FindId(bson.ObjectIdHex(userID)).Select(bson.M{"mfa": 1}).One(&mu)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+		return users.MFA{}, err
+	}
+	if mu.MFA == nil {
+		return users.MFA{}, nil
+	}
+	return *mu.MFA, nil
+}
+
+// SetMFA replaces the two-factor enrollment of the user, removing it for
+// the zero MFA
+func (m *Mongo) SetMFA(userID string, mfa users.MFA) error {
+	_, span := m.start("mongodb: set mfa")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", userID),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(userID) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	update := bson.M{"$set": bson.M{"mfa": mfa}}
+	if mfa.Secret == "" {
+		update = bson.M{"$unset": bson.M{"mfa": ""}}
+	}
+	err := c.UpdateId(bson.ObjectIdHex(userID), update)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// UseMFAStep records step as the last used TOTP step if it is newer than
+// the recorded one. The condition is part of the update so that concurrent
+// logins cannot both use the same code.
+func (m *Mongo) UseMFAStep(userID string, step int64) error {
+	_, span := m.start("mongodb: use mfa step")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", userID),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(userID) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	err := c.Update(
+		bson.M{"_id": bson.ObjectIdHex(userID), "mfa.lastStep": bson.M{"$lt": step}},
+		bson.M{"$set": bson.M{"mfa.lastStep": step}},
+	)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// UseRecoveryCode removes the recovery code with the given hash
+func (m *Mongo) UseRecoveryCode(userID, hash string) error {
+	_, span := m.start("mongodb: use recovery code")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", userID),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(userID) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	err := c.Update(
+		bson.M{"_id": bson.ObjectIdHex(userID), "mfa.recoveryCodes": hash},
+		bson.M{"$pull": bson.M{"mfa.recoveryCodes": hash}},
+	)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
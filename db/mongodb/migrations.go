@@ -0,0 +1,360 @@
+package mongodb
+
+import (
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const (
+	migrationsCollection = "schema_migrations"
+	migrationLockID      = "lock"
+)
+
+func init() {
+	db.RegisterMigration("mongodb", db.Migration{
+		Version: 1,
+		Name:    "backfill username_lower",
+		Up:      backfillUsernameLower,
+	})
+	db.RegisterMigration("mongodb", db.Migration{
+		Version: 2,
+		Name:    "backfill createdAt",
+		Up:      backfillCreatedAt,
+	})
+	db.RegisterMigration("mongodb", db.Migration{
+		Version: 3,
+		Name:    "backfill card brand",
+		Up:      backfillCardBrand,
+	})
+	db.RegisterMigration("mongodb", db.Migration{
+		Version: 4,
+		Name:    "normalize address countries",
+		Up:      normalizeCountries,
+	})
+	db.RegisterMigration("mongodb", db.Migration{
+		Version: 5,
+		Name:    "backfill status",
+		Up:      backfillStatus,
+	})
+	db.RegisterMigration("mongodb", db.Migration{
+		Version: 6,
+		Name:    "backfill email_normalized",
+		Up:      backfillEmailNormalized,
+	})
+	db.RegisterMigration("mongodb", db.Migration{
+		Version: 7,
+		Name:    "backfill username_skeleton",
+		Up:      backfillUsernameSkeleton,
+	})
+	db.RegisterMigration("mongodb", db.Migration{
+		Version: 8,
+		Name:    "backfill address type",
+		Up:      backfillAddressType,
+	})
+	db.RegisterMigration("mongodb", db.Migration{
+		Version: 9,
+		Name:    "backfill default card",
+		Up:      backfillDefaultCard,
+	})
+}
+
+type migrationRecord struct {
+	Version   int       `bson:"version"`
+	Name      string    `bson:"name"`
+	AppliedAt time.Time `bson:"appliedAt"`
+}
+
+// AppliedMigrations returns the versions recorded in schema_migrations
+func (m *Mongo) AppliedMigrations() ([]int, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	var rs []migrationRecord
+	err := s.DB(m.database).C(migrationsCollection).Find(bson.M{"version": bson.M{"$exists": true}}).All(&rs)
+	vs := make([]int, 0, len(rs))
+	for _, r := range rs {
+		vs = append(vs, r.Version)
+	}
+	return vs, err
+}
+
+// RecordMigration marks the migration as applied
+func (m *Mongo) RecordMigration(mi db.Migration) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	return s.DB(m.database).C(migrationsCollection).Insert(migrationRecord{
+		Version:   mi.Version,
+		Name:      mi.Name,
+		AppliedAt: time.Now().UTC(),
+	})
+}
+
+// AcquireMigrationLock takes the lock document, or renews it for its
+// owner, unless another owner holds an unexpired one
+func (m *Mongo) AcquireMigrationLock(owner string, ttl time.Duration) (bool, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C(migrationsCollection)
+	now := time.Now().UTC()
+	lock := bson.M{"_id": migrationLockID, "owner": owner, "expires": now.Add(ttl)}
+	err := c.Insert(lock)
+	if err == nil {
+		return true, nil
+	}
+	if !mgo.IsDup(err) {
+		return false, err
+	}
+	err = c.Update(bson.M{"_id": migrationLockID, "$or": []bson.M{
+		{"owner": owner},
+		{"expires": bson.M{"$lt": now}},
+	}}, lock)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// ReleaseMigrationLock removes the lock document if owned by owner
+func (m *Mongo) ReleaseMigrationLock(owner string) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	err := s.DB(m.database).C(migrationsCollection).Remove(bson.M{"_id": migrationLockID, "owner": owner})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+func backfillUsernameLower(d db.Database) error {
+	m := d.(*Mongo)
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	var doc struct {
+		ID       bson.ObjectId `bson:"_id"`
+		Username string        `bson:"username"`
+	}
+	iter := c.Find(bson.M{"username_lower": bson.M{"$exists": false}}).Select(bson.M{"username": 1}).Iter()
+	for iter.Next(&doc) {
+		err := c.UpdateId(doc.ID, bson.M{"$set": bson.M{"username_lower": strings.ToLower(doc.Username)}})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func backfillUsernameSkeleton(d db.Database) error {
+	m := d.(*Mongo)
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	var doc struct {
+		ID       bson.ObjectId `bson:"_id"`
+		Username string        `bson:"username"`
+	}
+	iter := c.Find(bson.M{"username_skeleton": bson.M{"$exists": false}}).Select(bson.M{"username": 1}).Iter()
+	for iter.Next(&doc) {
+		err := c.UpdateId(doc.ID, bson.M{"$set": bson.M{"username_skeleton": users.UsernameSkeleton(doc.Username)}})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func backfillCreatedAt(d db.Database) error {
+	m := d.(*Mongo)
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	var doc struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	iter := c.Find(bson.M{"createdAt": bson.M{"$exists": false}}).Select(bson.M{"_id": 1}).Iter()
+	for iter.Next(&doc) {
+		err := c.UpdateId(doc.ID, bson.M{"$set": bson.M{"createdAt": doc.ID.Time().UTC()}})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func backfillStatus(d db.Database) error {
+	m := d.(*Mongo)
+	s := m.Session.Copy()
+	defer s.Close()
+	_, err := s.DB(m.database).C("customers").UpdateAll(
+		bson.M{"status": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"status": users.StatusActive}},
+	)
+	return err
+}
+
+// backfillAddressType makes the addresses stored before they had a type
+// shipping addresses, as users.Address.Normalize does
+func backfillAddressType(d db.Database) error {
+	m := d.(*Mongo)
+	s := m.Session.Copy()
+	defer s.Close()
+	_, err := s.DB(m.database).C("addresses").UpdateAll(
+		bson.M{"type": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"type": users.AddressShipping}},
+	)
+	return err
+}
+
+// backfillDefaultCard makes the first card of the customers holding cards
+// before they had a default card their default
+func backfillDefaultCard(d db.Database) error {
+	m := d.(*Mongo)
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	var doc struct {
+		ID      bson.ObjectId   `bson:"_id"`
+		CardIDs []bson.ObjectId `bson:"cards"`
+	}
+	iter := c.Find(bson.M{"defaultCard": bson.M{"$exists": false}, "cards.0": bson.M{"$exists": true}}).Select(bson.M{"cards": 1}).Iter()
+	for iter.Next(&doc) {
+		err := c.UpdateId(doc.ID, bson.M{"$set": bson.M{"defaultCard": doc.CardIDs[0]}})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func backfillCardBrand(d db.Database) error {
+	m := d.(*Mongo)
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("cards")
+	var doc struct {
+		ID      bson.ObjectId `bson:"_id"`
+		LongNum string        `bson:"longNum"`
+	}
+	iter := c.Find(bson.M{"brand": bson.M{"$exists": false}}).Select(bson.M{"longNum": 1}).Iter()
+	for iter.Next(&doc) {
+		err := c.UpdateId(doc.ID, bson.M{"$set": bson.M{"brand": users.DetectBrand(doc.LongNum)}})
+		if err != nil {
+			iter.Close()
+			return err
+		}
+	}
+	return iter.Close()
+}
+
+func normalizeCountries(d db.Database) error {
+	m := d.(*Mongo)
+	unmapped, err := m.NormalizeCountries()
+	if err != nil {
+		return err
+	}
+	logger := m.Config.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	for country, n := range unmapped {
+		logger.Log("msg", "Address country left unnormalized", "database", m.database, "country", country, "addresses", n)
+	}
+	return nil
+}
+
+// NormalizeCountries replaces the countries of the stored addresses by their
+// ISO 3166-1 alpha-2 codes. Countries users.NormalizeCountry does not know
+// are left as they are and returned, with the number of addresses having
+// each, to be corrected by hand.
+func (m *Mongo) NormalizeCountries() (map[string]int, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("addresses")
+	unmapped := map[string]int{}
+	var doc struct {
+		ID      bson.ObjectId `bson:"_id"`
+		Country string        `bson:"country"`
+	}
+	iter := c.Find(bson.M{"country": bson.M{"$nin": []interface{}{nil, ""}}}).Select(bson.M{"country": 1}).Iter()
+	for iter.Next(&doc) {
+		code, ok := users.NormalizeCountry(doc.Country)
+		if !ok {
+			unmapped[doc.Country]++
+			continue
+		}
+		if code == doc.Country {
+			continue
+		}
+		if err := c.UpdateId(doc.ID, bson.M{"$set": bson.M{"country": code}}); err != nil {
+			iter.Close()
+			return unmapped, err
+		}
+	}
+	return unmapped, iter.Close()
+}
+
+func backfillEmailNormalized(d db.Database) error {
+	m := d.(*Mongo)
+	collisions, err := m.NormalizeEmails()
+	if err != nil {
+		return err
+	}
+	logger := m.Config.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	// Emails are personal data; the users are told by id only
+	for _, ids := range collisions {
+		logger.Log("msg", "Email of another user left unnormalized", "database", m.database, "users", strings.Join(ids, ","))
+	}
+	return nil
+}
+
+// NormalizeEmails stores the normalized email of the users missing one. A
+// user whose email normalizes as that of another, so that both could not be
+// told apart, keeps none, for the unique index to hold. They are returned by
+// normalized email, the ids of the users left unnormalized after the id of
+// the user holding it, to be corrected by hand.
+func (m *Mongo) NormalizeEmails() (map[string][]string, error) {
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	collisions := map[string][]string{}
+	var doc struct {
+		ID    bson.ObjectId `bson:"_id"`
+		Email string        `bson:"email"`
+	}
+	var holder struct {
+		ID bson.ObjectId `bson:"_id"`
+	}
+	iter := c.Find(bson.M{"email_normalized": bson.M{"$exists": false}, "email": bson.M{"$nin": []interface{}{nil, ""}}}).Select(bson.M{"email": 1}).Iter()
+	for iter.Next(&doc) {
+		email := users.NormalizeEmail(doc.Email)
+		err := c.Find(bson.M{"email_normalized": email}).Select(bson.M{"_id": 1}).One(&holder)
+		if err == nil {
+			if len(collisions[email]) == 0 {
+				collisions[email] = []string{holder.ID.Hex()}
+			}
+			collisions[email] = append(collisions[email], doc.ID.Hex())
+			continue
+		}
+		if err != mgo.ErrNotFound {
+			iter.Close()
+			return collisions, err
+		}
+		if err := c.UpdateId(doc.ID, bson.M{"$set": bson.M{"email_normalized": email}}); err != nil {
+			iter.Close()
+			return collisions, err
+		}
+	}
+	return collisions, iter.Close()
+}
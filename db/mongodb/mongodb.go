@@ -2,72 +2,275 @@ package mongodb
 
 import (
 	"context"
-	"errors"
-	"flag"
 	"fmt"
 	"net/url"
-	"os"
+	"strings"
 	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/redact"
 	"github.com/microservices-demo/user/users"
-	stdopentracing "github.com/opentracing/opentracing-go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
 
 var (
-	name     string
-	password string
-	host     string
-	db       = "users"
 	//ErrInvalidHexID represents a entity id that is not a valid bson ObjectID
-	ErrInvalidHexID = errors.New("Invalid Id Hex")
+	ErrInvalidHexID = db.ErrInvalidHexID
 )
 
-// Package-level context for tracing - set by the db package
-var traceContext context.Context = context.Background()
+// tracer traces the operations on MongoDB, as children of the span of the
+// request bound by WithContext
+var tracer = otel.Tracer("github.com/microservices-demo/user/db/mongodb")
 
-// SetTraceContext sets the context for tracing MongoDB operations
-func SetTraceContext(ctx context.Context) {
-	if ctx != nil {
-		traceContext = ctx
+// recordError records the outcome err of an operation on its span. A miss
+// is tagged result=not_found, an ordinary outcome, while any other failure
+// marks the span as errored, with the error.kind of db.ErrorKind.
+func recordError(span trace.Span, err error) {
+	kind := errorKind(err)
+	switch kind {
+	case "":
+		return
+	case db.KindNotFound:
+		span.SetAttributes(attribute.String("result", "not_found"))
+		return
 	}
+	span.SetAttributes(attribute.String("error.kind", kind))
+	span.SetStatus(codes.Error, err.Error())
 }
 
-func init() {
-	flag.StringVar(&name, "mongo-user", os.Getenv("MONGO_USER"), "Mongo user")
-	flag.StringVar(&password, "mongo-password", os.Getenv("MONGO_PASS"), "Mongo password")
-	flag.StringVar(&host, "mongo-host", os.Getenv("MONGO_HOST"), "Mongo host")
+// tagUsername sets the username tag of span, when the redaction policy
+// allows usernames in spans
+func tagUsername(span trace.Span, username string) {
+	if redact.Usernames() {
+		span.SetAttributes(attribute.String("username", username))
+	}
+}
+
+// errorKind is db.ErrorKind, knowing the errors of mgo
+func errorKind(err error) string {
+	switch {
+	case err == mgo.ErrNotFound:
+		return db.KindNotFound
+	case mgo.IsDup(err):
+		return db.KindConflict
+	}
+	return db.ErrorKind(err)
+}
+
+// Config holds the connection settings of a Mongo instance
+type Config struct {
+	Host     string
+	User     string
+	Password string
+	// Database defaults to "users"
+	Database string
+	// Timeout defaults to 5 seconds
+	Timeout time.Duration
+	// SlowThreshold is the duration past which an operation is logged to
+	// SlowLogger and counted in SlowCounter; zero disables it
+	SlowThreshold time.Duration
+	SlowLogger    log.Logger
+	SlowCounter   metrics.Counter
+	// Logger is told what migrations could not do; nil discards it
+	Logger log.Logger
+	// TraceUserIDs tags the spans of operations with the user of the
+	// baggage of their context
+	TraceUserIDs bool
+	// UniqueSkeletons makes the index on username_skeleton unique, so no
+	// two users hold usernames only told apart by confusable characters
+	UniqueSkeletons bool
+}
+
+// URL returns the connection URL described by the config
+func (c Config) URL() url.URL {
+	database := c.Database
+	if database == "" {
+		database = "users"
+	}
+	ur := url.URL{
+		Scheme: "mongodb",
+		Host:   c.Host,
+		Path:   database,
+	}
+	if c.User != "" {
+		u := url.UserPassword(c.User, c.Password)
+		ur.User = u
+	}
+	return ur
 }
 
 // Mongo meets the Database interface requirements
 type Mongo struct {
 	//Session is a MongoDB Session
 	Session *mgo.Session
+	//Config is used by Init to connect
+	Config Config
+	// database is the database of a tenant, empty for the one named by
+	// Config
+	database string
+	// ctx is the context of the request the operations are made for, set
+	// by WithContext
+	ctx context.Context
+}
+
+// New returns a Mongo connected using cfg
+func New(cfg Config) (*Mongo, error) {
+	m := &Mongo{Config: cfg}
+	if err := m.Init(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Option configures a Mongo built by NewWithOptions
+type Option func(*Config)
+
+// WithHost sets the host (and optional port) to connect to
+func WithHost(host string) Option {
+	return func(c *Config) {
+		c.Host = host
+	}
+}
+
+// WithCredentials sets the user and password to authenticate with
+func WithCredentials(user, password string) Option {
+	return func(c *Config) {
+		c.User = user
+		c.Password = password
+	}
+}
+
+// WithDatabase sets the database name
+func WithDatabase(database string) Option {
+	return func(c *Config) {
+		c.Database = database
+	}
+}
+
+// WithTimeout sets the dial timeout
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Config) {
+		c.Timeout = timeout
+	}
+}
+
+// WithLogger sets the logger migrations report to
+func WithLogger(logger log.Logger) Option {
+	return func(c *Config) {
+		c.Logger = logger
+	}
+}
+
+// WithUserIDs tags the spans of operations with the user.id baggage of
+// their context
+func WithUserIDs() Option {
+	return func(c *Config) {
+		c.TraceUserIDs = true
+	}
+}
+
+// WithUniqueSkeletons refuses usernames whose users.UsernameSkeleton another
+// user holds
+func WithUniqueSkeletons() Option {
+	return func(c *Config) {
+		c.UniqueSkeletons = true
+	}
+}
+
+// NewWithOptions returns a Mongo connected using the given options
+func NewWithOptions(opts ...Option) (*Mongo, error) {
+	var cfg Config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return New(cfg)
 }
 
-// Init MongoDB
+// Init connects using m.Config, which main fills from the -mongo-* flags
 func (m *Mongo) Init() error {
-	u := getURL()
+	u := m.Config.URL()
+	timeout := m.Config.Timeout
+	if timeout == 0 {
+		timeout = time.Duration(5) * time.Second
+	}
 	var err error
-	m.Session, err = mgo.DialWithTimeout(u.String(), time.Duration(5)*time.Second)
+	m.Session, err = mgo.DialWithTimeout(u.String(), timeout)
 	if err != nil {
 		return err
 	}
-	return m.EnsureIndexes()
+	if err = m.EnsureIndexes(); err != nil {
+		return err
+	}
+	return db.Migrate("mongodb", m)
+}
+
+// WithContext returns a Mongo sharing the session of m, tracing its
+// operations as children of the span of ctx
+func (m *Mongo) WithContext(ctx context.Context) db.Database {
+	c := *m
+	c.ctx = ctx
+	return &c
+}
+
+// ForTenant returns the database of tenant, on the cluster of m and named
+// after its database suffixed by the tenant. Its indexes are created and its
+// migrations run when it is opened, so on the first request of the tenant.
+func (m *Mongo) ForTenant(tenant string) (db.Database, error) {
+	if tenant == "" {
+		return nil, db.ErrNoTenant
+	}
+	database := m.Config.Database
+	if database == "" {
+		database = "users"
+	}
+	t := &Mongo{Session: m.Session, Config: m.Config, database: database + "_" + tenant}
+	if err := t.EnsureIndexes(); err != nil {
+		return nil, err
+	}
+	if err := db.Migrate("mongodb", t); err != nil {
+		return nil, err
+	}
+	return t, nil
 }
 
 // MongoUser is a wrapper for the users
 type MongoUser struct {
-	users.User `bson:",inline"`
-	ID         bson.ObjectId   `bson:"_id"`
-	AddressIDs []bson.ObjectId `bson:"addresses"`
-	CardIDs    []bson.ObjectId `bson:"cards"`
+	users.User    `bson:",inline"`
+	ID            bson.ObjectId        `bson:"_id"`
+	AddressIDs    []bson.ObjectId      `bson:"addresses"`
+	CardIDs       []bson.ObjectId      `bson:"cards"`
+	UsernameLower string               `bson:"username_lower,omitempty"`
+	CreatedAt     time.Time            `bson:"createdAt,omitempty"`
+	RefreshTokens []users.RefreshToken `bson:"refreshTokens,omitempty"`
+	MFA           *users.MFA           `bson:"mfa,omitempty"`
+	Version       int64                `bson:"version,omitempty"`
+	// CredentialsVersion is users.User.CredentialsVersion, only changed by
+	// BumpCredentialsVersion
+	CredentialsVersion int64 `bson:"credentialsVersion,omitempty"`
+	// EmailNormalized is the email of the user as users.NormalizeEmail
+	// writes it, unique among users
+	EmailNormalized string `bson:"email_normalized,omitempty"`
+	// UsernameSkeleton is users.UsernameSkeleton of the username, to find
+	// confusable names
+	UsernameSkeleton string `bson:"username_skeleton,omitempty"`
+	// DefaultShippingID and DefaultBillingID reference the default
+	// addresses of the user, among AddressIDs
+	DefaultShippingID bson.ObjectId `bson:"defaultShipping,omitempty"`
+	DefaultBillingID  bson.ObjectId `bson:"defaultBilling,omitempty"`
+	// DefaultCardID references the default card of the user, among CardIDs
+	DefaultCardID bson.ObjectId `bson:"defaultCard,omitempty"`
 }
 
-// New Returns a new MongoUser
-func New() MongoUser {
+// NewUser Returns a new MongoUser
+func NewUser() MongoUser {
 	u := users.New()
 	return MongoUser{
 		User:       u,
@@ -93,6 +296,19 @@ func (mu *MongoUser) AddUserIDs() {
 		mu.User.Cards = append(mu.User.Cards, users.Card{ID: id.Hex()})
 	}
 	mu.User.UserID = mu.ID.Hex()
+	mu.User.Version = mu.Version
+	mu.User.CredentialsVersion = mu.CredentialsVersion
+	mu.User.DefaultShipping, mu.User.DefaultBilling = "", ""
+	if mu.DefaultShippingID.Valid() {
+		mu.User.DefaultShipping = mu.DefaultShippingID.Hex()
+	}
+	if mu.DefaultBillingID.Valid() {
+		mu.User.DefaultBilling = mu.DefaultBillingID.Hex()
+	}
+	mu.User.DefaultCard = ""
+	if mu.DefaultCardID.Valid() {
+		mu.User.DefaultCard = mu.DefaultCardID.Hex()
+	}
 }
 
 // MongoAddress is a wrapper for Address
@@ -119,48 +335,517 @@ func (m *MongoCard) AddID() {
 
 // CreateUser Insert user to MongoDB, including connected addresses and cards, update passed in user with Ids
 func (m *Mongo) CreateUser(u *users.User) error {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: create user", stdopentracing.ChildOf(parentSpan.Context()))
-	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: create user")
-	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("db.collection", "customers")
-	span.SetTag("username", u.Username)
-	defer span.Finish()
+	_, span := m.start("mongodb: create user")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+	)
+	tagUsername(span, u.Username)
+	defer span.End()
 
 	s := m.Session.Copy()
 	defer s.Close()
 	id := bson.NewObjectId()
-	mu := New()
+	mu := NewUser()
 	mu.User = *u
 	mu.ID = id
-	var carderr error
-	var addrerr error
-	mu.CardIDs, carderr = m.createCards(u.Cards)
-	mu.AddressIDs, addrerr = m.createAddresses(u.Addresses)
-	c := s.DB("").C("customers")
-	_, err := c.UpsertId(mu.ID, mu)
-	if err != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
-		// Gonna clean up if we can, ignore error
-		// because the user save error takes precedence.
+	mu.UsernameLower = strings.ToLower(u.Username)
+	mu.EmailNormalized = users.NormalizeEmail(u.Email)
+	mu.UsernameSkeleton = users.UsernameSkeleton(u.Username)
+	mu.CreatedAt = id.Time().UTC()
+	c := s.DB(m.database).C("customers")
+	// The index on email_normalized only spans primary emails
+	if mu.EmailNormalized != "" {
+		n, err := c.Find(bson.M{"emails.normalized": mu.EmailNormalized}).Count()
+		if err == nil && n > 0 {
+			err = db.AlreadyExistsError{Field: "email"}
+		}
+		if err != nil {
+			recordError(span, err)
+			return err
+		}
+	}
+	// MongoDB has no transactions here: the addresses and cards are stored
+	// first, and removed again unless the customer holding them is
+	var err error
+	mu.CardIDs, err = m.createCards(u.Cards)
+	if err == nil {
+		mu.AddressIDs, err = m.createAddresses(u.Addresses)
+	}
+	if err != nil {
+		recordError(span, err)
+		// The error storing them takes precedence over any removing them
 		m.cleanAttributes(mu)
 		return err
 	}
+	if len(mu.CardIDs) > 0 {
+		mu.DefaultCardID = mu.CardIDs[0]
+	}
+	_, err = c.UpsertId(mu.ID, mu)
+	if err != nil {
+		recordError(span, err)
+		// The error saving the user takes precedence over any removing
+		// its attributes
+		m.cleanAttributes(mu)
+		if mgo.IsDup(err) {
+			// The error names the unique index refusing the user
+			field := "username"
+			if strings.Contains(err.Error(), "email_normalized") {
+				field = "email"
+			} else if strings.Contains(err.Error(), "username_skeleton") {
+				field = db.UsernameSkeletonField
+			}
+			err = db.AlreadyExistsError{Field: field}
+		}
+		return err
+	}
 	mu.User.UserID = mu.ID.Hex()
-	// Cheap err for attributes
-	if carderr != nil || addrerr != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", fmt.Sprintf("%v %v", carderr, addrerr))
-		return fmt.Errorf("%v %v", carderr, addrerr)
+	if mu.DefaultCardID.Valid() {
+		mu.User.DefaultCard = mu.DefaultCardID.Hex()
 	}
 	*u = mu.User
 	return nil
 }
 
+// UpdateUser updates the profile fields of the user identified by u.UserID
+func (m *Mongo) UpdateUser(u *users.User) error {
+	_, span := m.start("mongodb: update user")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", u.UserID),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(u.UserID) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	id := bson.ObjectIdHex(u.UserID)
+	or := []bson.M{{"username": u.Username}}
+	set := bson.M{
+		"firstName":         u.FirstName,
+		"lastName":          u.LastName,
+		"email":             u.Email,
+		"username":          u.Username,
+		"username_lower":    strings.ToLower(u.Username),
+		"phone":             u.Phone,
+		"username_skeleton": users.UsernameSkeleton(u.Username),
+	}
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	unset := bson.M{}
+	if email := users.NormalizeEmail(u.Email); email != "" {
+		or = append(or, bson.M{"email_normalized": email}, bson.M{"emails.normalized": email})
+		set["email_normalized"] = email
+	} else {
+		unset["email_normalized"] = ""
+	}
+	if u.DisplayName != "" {
+		set["displayName"] = u.DisplayName
+	} else {
+		unset["displayName"] = ""
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	n, err := c.Find(bson.M{"_id": bson.M{"$ne": id}, "$or": or}).Count()
+	if err == nil && n > 0 {
+		err = db.ErrAlreadyExists
+	}
+	if err == nil {
+		err = c.UpdateId(id, update)
+		if err == mgo.ErrNotFound {
+			err = db.ErrNotFound
+		} else if mgo.IsDup(err) {
+			err = dupError(err)
+		}
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// dupError returns the error of an update refused by a unique index:
+// an AlreadyExistsError when the index is that of username_skeleton, which
+// no count before the update can rule out, ErrAlreadyExists otherwise
+func dupError(err error) error {
+	if strings.Contains(err.Error(), "username_skeleton") {
+		return db.AlreadyExistsError{Field: db.UsernameSkeletonField}
+	}
+	return db.ErrAlreadyExists
+}
+
+// PatchUser sets only the fields present in p on the user with the given id
+func (m *Mongo) PatchUser(id string, p users.UserPatch) error {
+	_, span := m.start("mongodb: patch user")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", id),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	oid := bson.ObjectIdHex(id)
+	set := bson.M{}
+	unset := bson.M{}
+	or := make([]bson.M, 0)
+	if p.FirstName != nil {
+		set["firstName"] = *p.FirstName
+	}
+	if p.LastName != nil {
+		set["lastName"] = *p.LastName
+	}
+	if p.Email != nil {
+		set["email"] = *p.Email
+		if email := users.NormalizeEmail(*p.Email); email != "" {
+			set["email_normalized"] = email
+			or = append(or, bson.M{"email_normalized": email}, bson.M{"emails.normalized": email})
+		} else {
+			unset["email_normalized"] = ""
+		}
+	}
+	if p.Username != nil {
+		set["username"] = *p.Username
+		set["username_lower"] = strings.ToLower(*p.Username)
+		set["username_skeleton"] = users.UsernameSkeleton(*p.Username)
+		or = append(or, bson.M{"username": *p.Username})
+	}
+	if p.Phone != nil {
+		set["phone"] = *p.Phone
+	}
+	if p.DisplayName != nil && *p.DisplayName != "" {
+		set["displayName"] = *p.DisplayName
+	} else if p.DisplayName != nil {
+		unset["displayName"] = ""
+	}
+	var err error
+	if len(or) > 0 {
+		var n int
+		n, err = c.Find(bson.M{"_id": bson.M{"$ne": oid}, "$or": or}).Count()
+		if err == nil && n > 0 {
+			err = db.ErrAlreadyExists
+		}
+	}
+	if err == nil {
+		if len(set) == 0 && len(unset) == 0 {
+			var n int
+			n, err = c.FindId(oid).Count()
+			if err == nil && n == 0 {
+				err = db.ErrNotFound
+			}
+		} else {
+			update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+			if len(unset) > 0 {
+				update["$unset"] = unset
+			}
+			err = c.UpdateId(oid, update)
+			if err == mgo.ErrNotFound {
+				err = db.ErrNotFound
+			} else if mgo.IsDup(err) {
+				err = dupError(err)
+			}
+		}
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// SetUserPassword replaces the password hash and salt of the user
+func (m *Mongo) SetUserPassword(id, hash, salt string) error {
+	_, span := m.start("mongodb: set user password")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", id),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	err := c.UpdateId(bson.ObjectIdHex(id), bson.M{"$set": bson.M{"password": hash, "salt": salt}})
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// ReplaceUserPassword replaces the password hash and salt of the user if
+// its hash is still old
+func (m *Mongo) ReplaceUserPassword(id, old, hash, salt string) error {
+	_, span := m.start("mongodb: replace user password")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", id),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	oid := bson.ObjectIdHex(id)
+	// A change of password since the read fails the update
+	err := c.Update(bson.M{"_id": oid, "password": old}, bson.M{"$set": bson.M{"password": hash, "salt": salt}})
+	if err == mgo.ErrNotFound {
+		err = db.ErrVersionMismatch
+		if n, cerr := c.FindId(oid).Count(); cerr != nil {
+			err = cerr
+		} else if n == 0 {
+			err = db.ErrNotFound
+		}
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// SetUserRoles replaces the roles of the user
+func (m *Mongo) SetUserRoles(id string, roles []string) error {
+	_, span := m.start("mongodb: set user roles")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", id),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	err := c.UpdateId(bson.ObjectIdHex(id), bson.M{"$set": bson.M{"roles": roles}, "$inc": bson.M{"version": 1}})
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// BumpCredentialsVersion increments the credentials version of the user
+func (m *Mongo) BumpCredentialsVersion(id string) error {
+	_, span := m.start("mongodb: bump credentials version")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", id),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	err := c.UpdateId(bson.ObjectIdHex(id), bson.M{"$inc": bson.M{"credentialsVersion": 1}})
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// SetUserStatus sets the account status of the user
+func (m *Mongo) SetUserStatus(id, status string) error {
+	_, span := m.start("mongodb: set user status")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", id),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	err := c.UpdateId(bson.ObjectIdHex(id), bson.M{"$set": bson.M{"status": status}, "$inc": bson.M{"version": 1}})
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// AppendConsents pushes records to the consent history of the user
+func (m *Mongo) AppendConsents(id string, records []users.ConsentRecord) error {
+	_, span := m.start("mongodb: append consents")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", id),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	err := c.UpdateId(bson.ObjectIdHex(id), bson.M{
+		"$push": bson.M{"consentHistory": bson.M{"$each": records}},
+		"$inc":  bson.M{"version": 1},
+	})
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// SetUserEmails replaces the primary email and the emails of the user at
+// the given version, unsetting the emails when there are none
+func (m *Mongo) SetUserEmails(id, primary string, emails []users.EmailAddress, version int64) error {
+	_, span := m.start("mongodb: set user emails")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", id),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	oid := bson.ObjectIdHex(id)
+	normalized := users.NormalizeEmail(primary)
+	set := bson.M{"email": primary, "email_normalized": normalized}
+	update := bson.M{"$set": set, "$inc": bson.M{"version": 1}}
+	or := []bson.M{{"email_normalized": normalized}, {"emails.normalized": normalized}}
+	if len(emails) > 0 {
+		stored := make([]users.EmailAddress, len(emails))
+		for k, e := range emails {
+			e.Normalized = users.NormalizeEmail(e.Address)
+			stored[k] = e
+			or = append(or, bson.M{"email_normalized": e.Normalized}, bson.M{"emails.normalized": e.Normalized})
+		}
+		set["emails"] = stored
+	} else {
+		update["$unset"] = bson.M{"emails": ""}
+	}
+	n, err := c.Find(bson.M{"_id": bson.M{"$ne": oid}, "$or": or}).Count()
+	if err == nil && n > 0 {
+		err = db.AlreadyExistsError{Field: "email"}
+	}
+	if err == nil {
+		// A change since the read fails the update
+		err = c.Update(bson.M{"_id": oid, "version": versionQuery(version)}, update)
+		if err == mgo.ErrNotFound {
+			err = db.ErrVersionMismatch
+			if n, cerr := c.FindId(oid).Count(); cerr != nil {
+				err = cerr
+			} else if n == 0 {
+				err = db.ErrNotFound
+			}
+		} else if mgo.IsDup(err) {
+			err = db.AlreadyExistsError{Field: "email"}
+		}
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// UpdateUserPreferences sets the preferences of the user changed, a nil
+// value unsetting its key. Each key is set or unset on its own, so changes
+// to different keys made at once are all kept.
+func (m *Mongo) UpdateUserPreferences(id string, changes map[string]*string) (map[string]string, error) {
+	_, span := m.start("mongodb: set user preferences")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", id),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		recordError(span, ErrInvalidHexID)
+		return nil, ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	set, unset := bson.M{}, bson.M{}
+	for k, v := range changes {
+		if v == nil {
+			unset["preferences."+k] = ""
+		} else {
+			set["preferences."+k] = *v
+		}
+	}
+	update := bson.M{"$inc": bson.M{"version": 1}}
+	if len(set) > 0 {
+		update["$set"] = set
+	}
+	if len(unset) > 0 {
+		update["$unset"] = unset
+	}
+	var got struct {
+		Preferences map[string]string `bson:"preferences"`
+	}
+	_, err := c.Find(bson.M{"_id": bson.ObjectIdHex(id)}).Select(bson.M{"preferences": 1}).
+		Apply(mgo.Change{Update: update, ReturnNew: true}, &got)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+	if got.Preferences == nil {
+		got.Preferences = map[string]string{}
+	}
+	return got.Preferences, nil
+}
+
 func (m *Mongo) createCards(cs []users.Card) ([]bson.ObjectId, error) {
 	s := m.Session.Copy()
 	defer s.Close()
@@ -168,14 +853,16 @@ func (m *Mongo) createCards(cs []users.Card) ([]bson.ObjectId, error) {
 	defer s.Close()
 	for k, ca := range cs {
 		id := bson.NewObjectId()
+		ca.Brand = users.DetectBrand(ca.LongNum)
 		mc := MongoCard{Card: ca, ID: id}
-		c := s.DB("").C("cards")
+		c := s.DB(m.database).C("cards")
 		_, err := c.UpsertId(mc.ID, mc)
 		if err != nil {
 			return ids, err
 		}
 		ids = append(ids, id)
 		cs[k].ID = id.Hex()
+		cs[k].Brand = ca.Brand
 	}
 	return ids, nil
 }
@@ -187,7 +874,7 @@ func (m *Mongo) createAddresses(as []users.Address) ([]bson.ObjectId, error) {
 	for k, a := range as {
 		id := bson.NewObjectId()
 		ma := MongoAddress{Address: a, ID: id}
-		c := s.DB("").C("addresses")
+		c := s.DB(m.database).C("addresses")
 		_, err := c.UpsertId(ma.ID, ma)
 		if err != nil {
 			return ids, err
@@ -201,9 +888,9 @@ func (m *Mongo) createAddresses(as []users.Address) ([]bson.ObjectId, error) {
 func (m *Mongo) cleanAttributes(mu MongoUser) error {
 	s := m.Session.Copy()
 	defer s.Close()
-	c := s.DB("").C("addresses")
+	c := s.DB(m.database).C("addresses")
 	_, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": mu.AddressIDs}})
-	c = s.DB("").C("cards")
+	c = s.DB(m.database).C("cards")
 	_, err = c.RemoveAll(bson.M{"_id": bson.M{"$in": mu.CardIDs}})
 	return err
 }
@@ -211,40 +898,144 @@ func (m *Mongo) cleanAttributes(mu MongoUser) error {
 func (m *Mongo) appendAttributeId(attr string, id bson.ObjectId, userid string) error {
 	s := m.Session.Copy()
 	defer s.Close()
-	c := s.DB("").C("customers")
+	c := s.DB(m.database).C("customers")
 	return c.Update(bson.M{"_id": bson.ObjectIdHex(userid)},
-		bson.M{"$addToSet": bson.M{attr: id}})
+		bson.M{"$addToSet": bson.M{attr: id}, "$inc": bson.M{"version": 1}})
 }
 
 func (m *Mongo) removeAttributeId(attr string, id bson.ObjectId, userid string) error {
 	s := m.Session.Copy()
 	defer s.Close()
-	c := s.DB("").C("customers")
+	c := s.DB(m.database).C("customers")
 	return c.Update(bson.M{"_id": bson.ObjectIdHex(userid)},
-		bson.M{"$pull": bson.M{attr: id}})
+		bson.M{"$pull": bson.M{attr: id}, "$inc": bson.M{"version": 1}})
 }
 
 // GetUserByName Get user by their name
 func (m *Mongo) GetUserByName(name string) (users.User, error) {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: find user by name", stdopentracing.ChildOf(parentSpan.Context()))
-	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: find user by name")
+	_, span := m.start("mongodb: find user by name")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+	)
+	tagUsername(span, name)
+	defer span.End()
+
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	mu := NewUser()
+	// $eq matches name literally, whatever it holds
+	err := c.Find(bson.M{"username": bson.M{"$eq": name}, "anonymized": bson.M{"$ne": true}}).One(&mu)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	mu.AddUserIDs()
+	return mu.User, err
+}
+
+// mongoJoinedUser is a customer document joined with its addresses and
+// cards by GetUserByNameWithAttributes
+type mongoJoinedUser struct {
+	MongoUser       `bson:",inline"`
+	JoinedAddresses []MongoAddress `bson:"joinedAddresses"`
+	JoinedCards     []MongoCard    `bson:"joinedCards"`
+}
+
+// GetUserByNameWithAttributes gets the user by their name along with its
+// addresses and cards, in a single aggregation rather than three queries
+func (m *Mongo) GetUserByNameWithAttributes(name string) (users.User, error) {
+	_, span := m.start("mongodb: find user by name with attributes")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+	)
+	tagUsername(span, name)
+	defer span.End()
+
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	var mu mongoJoinedUser
+	err := c.Pipe([]bson.M{
+		{"$match": bson.M{"username": bson.M{"$eq": name}, "anonymized": bson.M{"$ne": true}}},
+		{"$limit": 1},
+		{"$lookup": bson.M{"from": "addresses", "localField": "addresses", "foreignField": "_id", "as": "joinedAddresses"}},
+		{"$lookup": bson.M{"from": "cards", "localField": "cards", "foreignField": "_id", "as": "joinedCards"}},
+	}).One(&mu)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+		return users.New(), err
 	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("db.collection", "customers")
-	span.SetTag("username", name)
-	defer span.Finish()
+	mu.AddUserIDs()
+	u := mu.User
+	u.Addresses = make([]users.Address, 0, len(mu.JoinedAddresses))
+	for _, a := range mu.JoinedAddresses {
+		a.AddID()
+		u.Addresses = append(u.Addresses, a.Address)
+	}
+	u.Cards = make([]users.Card, 0, len(mu.JoinedCards))
+	for _, ca := range mu.JoinedCards {
+		ca.AddID()
+		u.Cards = append(u.Cards, ca.Card)
+	}
+	span.SetAttributes(attribute.Int("result.addresses", len(u.Addresses)), attribute.Int("result.cards", len(u.Cards)))
+	return u, nil
+}
+
+// GetUserByEmail returns the user holding email among its verified emails
+func (m *Mongo) GetUserByEmail(email string) (users.User, error) {
+	_, span := m.start("mongodb: find user by email")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+	)
+	defer span.End()
+
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	mu := NewUser()
+	err := c.Find(bson.M{
+		"emails":     bson.M{"$elemMatch": bson.M{"normalized": bson.M{"$eq": users.NormalizeEmail(email)}, "verified": true}},
+		"anonymized": bson.M{"$ne": true},
+	}).One(&mu)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	mu.AddUserIDs()
+	return mu.User, err
+}
+
+// GetUserBySkeleton returns a user whose username has the given
+// users.UsernameSkeleton
+func (m *Mongo) GetUserBySkeleton(skeleton string) (users.User, error) {
+	_, span := m.start("mongodb: find user by skeleton")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+	)
+	defer span.End()
 
 	s := m.Session.Copy()
 	defer s.Close()
-	c := s.DB("").C("customers")
-	mu := New()
-	err := c.Find(bson.M{"username": name}).One(&mu)
+	c := s.DB(m.database).C("customers")
+	mu := NewUser()
+	err := c.Find(bson.M{"username_skeleton": bson.M{"$eq": skeleton}, "anonymized": bson.M{"$ne": true}}).One(&mu)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
 	if err != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		recordError(span, err)
 	}
 	mu.AddUserIDs()
 	return mu.User, err
@@ -252,31 +1043,29 @@ func (m *Mongo) GetUserByName(name string) (users.User, error) {
 
 // GetUser Get user by their object id
 func (m *Mongo) GetUser(id string) (users.User, error) {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: find user by id", stdopentracing.ChildOf(parentSpan.Context()))
-	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: find user by id")
-	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("db.collection", "customers")
-	span.SetTag("user.id", id)
-	defer span.Finish()
+	_, span := m.start("mongodb: find user by id")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", id),
+	)
+	defer span.End()
 
 	s := m.Session.Copy()
 	defer s.Close()
 	if !bson.IsObjectIdHex(id) {
-		err := errors.New("Invalid Id Hex")
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		err := ErrInvalidHexID
+		recordError(span, err)
 		return users.New(), err
 	}
-	c := s.DB("").C("customers")
-	mu := New()
+	c := s.DB(m.database).C("customers")
+	mu := NewUser()
 	err := c.FindId(bson.ObjectIdHex(id)).One(&mu)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
 	if err != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		recordError(span, err)
 	}
 	mu.AddUserIDs()
 	return mu.User, err
@@ -284,27 +1073,52 @@ func (m *Mongo) GetUser(id string) (users.User, error) {
 
 // GetUsers Get all users
 func (m *Mongo) GetUsers() ([]users.User, error) {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: find all users", stdopentracing.ChildOf(parentSpan.Context()))
+	_, span := m.start("mongodb: find all users")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+	)
+	defer span.End()
+
+	// TODO: add paginations
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	var mus []MongoUser
+	err := c.Find(bson.M{"anonymized": bson.M{"$ne": true}}).All(&mus)
+	if err != nil {
+		recordError(span, err)
 	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: find all users")
+		span.SetAttributes(attribute.Int("result.count", len(mus)))
+	}
+	us := make([]users.User, 0)
+	for _, mu := range mus {
+		mu.AddUserIDs()
+		us = append(us, mu.User)
 	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("db.collection", "customers")
-	defer span.Finish()
+	return us, err
+}
+
+// GetUsersSorted lists the users in the order of so, using the index of
+// its field
+func (m *Mongo) GetUsersSorted(so db.Sort) ([]users.User, error) {
+	_, span := m.start("mongodb: find all users")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("db.sort", so.Field),
+	)
+	defer span.End()
 
-	// TODO: add paginations
 	s := m.Session.Copy()
 	defer s.Close()
-	c := s.DB("").C("customers")
+	c := s.DB(m.database).C("customers")
 	var mus []MongoUser
-	err := c.Find(nil).All(&mus)
+	err := c.Find(bson.M{"anonymized": bson.M{"$ne": true}}).Sort(sortKeys(so)...).All(&mus)
 	if err != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		recordError(span, err)
 	} else {
-		span.SetTag("result.count", len(mus))
+		span.SetAttributes(attribute.Int("result.count", len(mus)))
 	}
 	us := make([]users.User, 0)
 	for _, mu := range mus {
@@ -314,47 +1128,56 @@ func (m *Mongo) GetUsers() ([]users.User, error) {
 	return us, err
 }
 
+// sortKeys returns the keys of so for Query.Sort, ending with _id so
+// ties keep a stable order. Ties go the direction of the field, which lets
+// a descending sort read the ascending index backwards.
+func sortKeys(so db.Sort) []string {
+	dir := ""
+	if so.Desc {
+		dir = "-"
+	}
+	if so.Field == "" {
+		return []string{dir + "_id"}
+	}
+	return []string{dir + so.Field, dir + "_id"}
+}
+
 // GetUserAttributes given a user, load all cards and addresses connected to that user
 func (m *Mongo) GetUserAttributes(u *users.User) error {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: get user attributes", stdopentracing.ChildOf(parentSpan.Context()))
-	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: get user attributes")
-	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("user.id", u.UserID)
-	defer span.Finish()
+	ctx, span := m.start("mongodb: get user attributes")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("user.id", u.UserID),
+	)
+	defer span.End()
 
 	s := m.Session.Copy()
 	defer s.Close()
 
 	// Fetch addresses
-	addrSpan := stdopentracing.StartSpan("mongodb: find addresses", stdopentracing.ChildOf(span.Context()))
-	addrSpan.SetTag("db.collection", "addresses")
+	_, addrSpan := tracer.Start(ctx, "mongodb: find addresses")
+	addrSpan.SetAttributes(attribute.String("db.collection", "addresses"))
 	ids := make([]bson.ObjectId, 0)
 	for _, a := range u.Addresses {
 		if !bson.IsObjectIdHex(a.ID) {
-			addrSpan.SetTag("error", true)
-			addrSpan.SetTag("error.message", ErrInvalidHexID.Error())
-			addrSpan.Finish()
-			span.SetTag("error", true)
+			recordError(addrSpan, ErrInvalidHexID)
+			addrSpan.End()
+			recordError(span, ErrInvalidHexID)
 			return ErrInvalidHexID
 		}
 		ids = append(ids, bson.ObjectIdHex(a.ID))
 	}
 	var ma []MongoAddress
-	c := s.DB("").C("addresses")
+	c := s.DB(m.database).C("addresses")
 	err := c.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&ma)
 	if err != nil {
-		addrSpan.SetTag("error", true)
-		addrSpan.SetTag("error.message", err.Error())
-		addrSpan.Finish()
-		span.SetTag("error", true)
+		recordError(addrSpan, err)
+		addrSpan.End()
+		recordError(span, err)
 		return err
 	}
-	addrSpan.SetTag("result.count", len(ma))
-	addrSpan.Finish()
+	addrSpan.SetAttributes(attribute.Int("result.count", len(ma)))
+	addrSpan.End()
 
 	na := make([]users.Address, 0)
 	for _, a := range ma {
@@ -364,31 +1187,29 @@ func (m *Mongo) GetUserAttributes(u *users.User) error {
 	u.Addresses = na
 
 	// Fetch cards
-	cardSpan := stdopentracing.StartSpan("mongodb: find cards", stdopentracing.ChildOf(span.Context()))
-	cardSpan.SetTag("db.collection", "cards")
+	_, cardSpan := tracer.Start(ctx, "mongodb: find cards")
+	cardSpan.SetAttributes(attribute.String("db.collection", "cards"))
 	ids = make([]bson.ObjectId, 0)
 	for _, c := range u.Cards {
 		if !bson.IsObjectIdHex(c.ID) {
-			cardSpan.SetTag("error", true)
-			cardSpan.SetTag("error.message", ErrInvalidHexID.Error())
-			cardSpan.Finish()
-			span.SetTag("error", true)
+			recordError(cardSpan, ErrInvalidHexID)
+			cardSpan.End()
+			recordError(span, ErrInvalidHexID)
 			return ErrInvalidHexID
 		}
 		ids = append(ids, bson.ObjectIdHex(c.ID))
 	}
 	var mc []MongoCard
-	c = s.DB("").C("cards")
+	c = s.DB(m.database).C("cards")
 	err = c.Find(bson.M{"_id": bson.M{"$in": ids}}).All(&mc)
 	if err != nil {
-		cardSpan.SetTag("error", true)
-		cardSpan.SetTag("error.message", err.Error())
-		cardSpan.Finish()
-		span.SetTag("error", true)
+		recordError(cardSpan, err)
+		cardSpan.End()
+		recordError(span, err)
 		return err
 	}
-	cardSpan.SetTag("result.count", len(mc))
-	cardSpan.Finish()
+	cardSpan.SetAttributes(attribute.Int("result.count", len(mc)))
+	cardSpan.End()
 
 	nc := make([]users.Card, 0)
 	for _, ca := range mc {
@@ -401,31 +1222,26 @@ func (m *Mongo) GetUserAttributes(u *users.User) error {
 
 // GetCard Gets card by objects Id
 func (m *Mongo) GetCard(id string) (users.Card, error) {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: find card by id", stdopentracing.ChildOf(parentSpan.Context()))
-	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: find card by id")
-	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("db.collection", "cards")
-	span.SetTag("card.id", id)
-	defer span.Finish()
+	_, span := m.start("mongodb: find card by id")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "cards"),
+		attribute.String("card.id", id),
+	)
+	defer span.End()
 
 	s := m.Session.Copy()
 	defer s.Close()
 	if !bson.IsObjectIdHex(id) {
-		err := errors.New("Invalid Id Hex")
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		err := ErrInvalidHexID
+		recordError(span, err)
 		return users.Card{}, err
 	}
-	c := s.DB("").C("cards")
+	c := s.DB(m.database).C("cards")
 	mc := MongoCard{}
 	err := c.FindId(bson.ObjectIdHex(id)).One(&mc)
 	if err != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		recordError(span, err)
 	}
 	mc.AddID()
 	return mc.Card, err
@@ -433,27 +1249,23 @@ func (m *Mongo) GetCard(id string) (users.Card, error) {
 
 // GetCards Gets all cards
 func (m *Mongo) GetCards() ([]users.Card, error) {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: find all cards", stdopentracing.ChildOf(parentSpan.Context()))
-	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: find all cards")
-	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("db.collection", "cards")
-	defer span.Finish()
+	_, span := m.start("mongodb: find all cards")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "cards"),
+	)
+	defer span.End()
 
 	// TODO: add pagination
 	s := m.Session.Copy()
 	defer s.Close()
-	c := s.DB("").C("cards")
+	c := s.DB(m.database).C("cards")
 	var mcs []MongoCard
 	err := c.Find(nil).All(&mcs)
 	if err != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		recordError(span, err)
 	} else {
-		span.SetTag("result.count", len(mcs))
+		span.SetAttributes(attribute.Int("result.count", len(mcs)))
 	}
 	cs := make([]users.Card, 0)
 	for _, mc := range mcs {
@@ -465,40 +1277,47 @@ func (m *Mongo) GetCards() ([]users.Card, error) {
 
 // CreateCard adds card to MongoDB
 func (m *Mongo) CreateCard(ca *users.Card, userid string) error {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: create card", stdopentracing.ChildOf(parentSpan.Context()))
-	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: create card")
-	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("db.collection", "cards")
-	span.SetTag("user.id", userid)
-	defer span.Finish()
+	_, span := m.start("mongodb: create card")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "cards"),
+		attribute.String("user.id", userid),
+	)
+	defer span.End()
 
 	if userid != "" && !bson.IsObjectIdHex(userid) {
-		err := errors.New("Invalid Id Hex")
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		err := ErrInvalidHexID
+		recordError(span, err)
 		return err
 	}
 	s := m.Session.Copy()
 	defer s.Close()
-	c := s.DB("").C("cards")
+	c := s.DB(m.database).C("cards")
 	id := bson.NewObjectId()
+	ca.Brand = users.DetectBrand(ca.LongNum)
 	mc := MongoCard{Card: *ca, ID: id}
 	_, err := c.UpsertId(mc.ID, mc)
 	if err != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		recordError(span, err)
 		return err
 	}
 	// Address for anonymous user
 	if userid != "" {
 		err = m.appendAttributeId("cards", mc.ID, userid)
 		if err != nil {
-			span.SetTag("error", true)
-			span.SetTag("error.message", err.Error())
+			recordError(span, err)
+			return err
+		}
+		// The first card of the user becomes its default
+		err = s.DB(m.database).C("customers").Update(
+			bson.M{"_id": bson.ObjectIdHex(userid), "defaultCard": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"defaultCard": mc.ID}},
+		)
+		if err == mgo.ErrNotFound {
+			err = nil
+		}
+		if err != nil {
+			recordError(span, err)
 			return err
 		}
 	}
@@ -509,31 +1328,26 @@ func (m *Mongo) CreateCard(ca *users.Card, userid string) error {
 
 // GetAddress Gets an address by object Id
 func (m *Mongo) GetAddress(id string) (users.Address, error) {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: find address by id", stdopentracing.ChildOf(parentSpan.Context()))
-	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: find address by id")
-	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("db.collection", "addresses")
-	span.SetTag("address.id", id)
-	defer span.Finish()
+	_, span := m.start("mongodb: find address by id")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "addresses"),
+		attribute.String("address.id", id),
+	)
+	defer span.End()
 
 	s := m.Session.Copy()
 	defer s.Close()
 	if !bson.IsObjectIdHex(id) {
-		err := errors.New("Invalid Id Hex")
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		err := ErrInvalidHexID
+		recordError(span, err)
 		return users.Address{}, err
 	}
-	c := s.DB("").C("addresses")
+	c := s.DB(m.database).C("addresses")
 	ma := MongoAddress{}
 	err := c.FindId(bson.ObjectIdHex(id)).One(&ma)
 	if err != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		recordError(span, err)
 	}
 	ma.AddID()
 	return ma.Address, err
@@ -541,27 +1355,23 @@ func (m *Mongo) GetAddress(id string) (users.Address, error) {
 
 // GetAddresses gets all addresses
 func (m *Mongo) GetAddresses() ([]users.Address, error) {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: find all addresses", stdopentracing.ChildOf(parentSpan.Context()))
-	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: find all addresses")
-	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("db.collection", "addresses")
-	defer span.Finish()
+	_, span := m.start("mongodb: find all addresses")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "addresses"),
+	)
+	defer span.End()
 
 	// TODO: add pagination
 	s := m.Session.Copy()
 	defer s.Close()
-	c := s.DB("").C("addresses")
+	c := s.DB(m.database).C("addresses")
 	var mas []MongoAddress
 	err := c.Find(nil).All(&mas)
 	if err != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		recordError(span, err)
 	} else {
-		span.SetTag("result.count", len(mas))
+		span.SetAttributes(attribute.Int("result.count", len(mas)))
 	}
 	as := make([]users.Address, 0)
 	for _, ma := range mas {
@@ -573,40 +1383,34 @@ func (m *Mongo) GetAddresses() ([]users.Address, error) {
 
 // CreateAddress Inserts Address into MongoDB
 func (m *Mongo) CreateAddress(a *users.Address, userid string) error {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: create address", stdopentracing.ChildOf(parentSpan.Context()))
-	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: create address")
-	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("db.collection", "addresses")
-	span.SetTag("user.id", userid)
-	defer span.Finish()
+	_, span := m.start("mongodb: create address")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "addresses"),
+		attribute.String("user.id", userid),
+	)
+	defer span.End()
 
 	if userid != "" && !bson.IsObjectIdHex(userid) {
-		err := errors.New("Invalid Id Hex")
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		err := ErrInvalidHexID
+		recordError(span, err)
 		return err
 	}
 	s := m.Session.Copy()
 	defer s.Close()
-	c := s.DB("").C("addresses")
+	c := s.DB(m.database).C("addresses")
 	id := bson.NewObjectId()
 	ma := MongoAddress{Address: *a, ID: id}
 	_, err := c.UpsertId(ma.ID, ma)
 	if err != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		recordError(span, err)
 		return err
 	}
 	// Address for anonymous user
 	if userid != "" {
 		err = m.appendAttributeId("addresses", ma.ID, userid)
 		if err != nil {
-			span.SetTag("error", true)
-			span.SetTag("error.message", err.Error())
+			recordError(span, err)
 			return err
 		}
 	}
@@ -615,71 +1419,352 @@ func (m *Mongo) CreateAddress(a *users.Address, userid string) error {
 	return err
 }
 
-// Delete removes an entity from MongoDB
-func (m *Mongo) Delete(entity, id string) error {
-	var span stdopentracing.Span
-	if parentSpan := stdopentracing.SpanFromContext(traceContext); parentSpan != nil {
-		span = stdopentracing.StartSpan("mongodb: delete entity", stdopentracing.ChildOf(parentSpan.Context()))
-	} else {
-		span = stdopentracing.GlobalTracer().StartSpan("mongodb: delete entity")
+// SetCardLabel replaces the label of the card the user holds
+func (m *Mongo) SetCardLabel(userID, cardID, label string) error {
+	_, span := m.start("mongodb: set card label")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "cards"),
+		attribute.String("user.id", userID),
+		attribute.String("card.id", cardID),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(userID) || !bson.IsObjectIdHex(cardID) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	cid := bson.ObjectIdHex(cardID)
+	// Counting the change to the user checks it holds the card
+	err := s.DB(m.database).C("customers").Update(
+		bson.M{"_id": bson.ObjectIdHex(userID), "cards": cid},
+		bson.M{"$inc": bson.M{"version": 1}},
+	)
+	if err == nil {
+		update := bson.M{"$set": bson.M{"label": label}}
+		if label == "" {
+			update = bson.M{"$unset": bson.M{"label": ""}}
+		}
+		err = s.DB(m.database).C("cards").UpdateId(cid, update)
+	}
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// LinkAttribute links the address or card created without a customer in
+// the guest session with hash guest to the user. The attribute is first claimed for the user with a conditional
+// update, so of two customers linking it at once only one succeeds.
+func (m *Mongo) LinkAttribute(entity, id, userID, guest string) error {
+	_, span := m.start("mongodb: link attribute")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", entity),
+		attribute.String("user.id", userID),
+	)
+	defer span.End()
+
+	if entity != "addresses" && entity != "cards" {
+		err := fmt.Errorf("no attribute %q", entity)
+		recordError(span, err)
+		return err
+	}
+	if !bson.IsObjectIdHex(id) || !bson.IsObjectIdHex(userID) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	aid, uid := bson.ObjectIdHex(id), bson.ObjectIdHex(userID)
+	err := m.linkAttribute(s, entity, aid, uid, guest)
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+func (m *Mongo) linkAttribute(s *mgo.Session, entity string, id, userID bson.ObjectId, guest string) error {
+	attrs := s.DB(m.database).C(entity)
+	customers := s.DB(m.database).C("customers")
+	if guest == "" {
+		return db.NotFoundError{Entity: entity, ID: id.Hex()}
+	}
+	if n, err := attrs.Find(bson.M{"_id": id, "guest": guest}).Count(); err != nil {
+		return err
+	} else if n == 0 {
+		return db.NotFoundError{Entity: entity, ID: id.Hex()}
+	}
+	// Attributes created with a customer carry no claim
+	if n, err := customers.Find(bson.M{entity: id}).Count(); err != nil {
+		return err
+	} else if n > 0 {
+		return db.ErrAlreadyLinked
+	}
+	err := attrs.Update(bson.M{"_id": id, "guest": guest, "linkedTo": bson.M{"$exists": false}}, bson.M{"$set": bson.M{"linkedTo": userID}})
+	if err == mgo.ErrNotFound {
+		return db.ErrAlreadyLinked
+	}
+	if err != nil {
+		return err
+	}
+	err = m.appendAttributeId(entity, id, userID.Hex())
+	if err == mgo.ErrNotFound {
+		err = db.NotFoundError{Entity: "customers", ID: userID.Hex()}
+	}
+	if err != nil {
+		attrs.UpdateId(id, bson.M{"$unset": bson.M{"linkedTo": ""}})
+		return err
+	}
+	if entity == "cards" {
+		// A first card becomes the default, as in CreateCard
+		err = customers.Update(
+			bson.M{"_id": userID, "defaultCard": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"defaultCard": id}},
+		)
+		if err == mgo.ErrNotFound {
+			err = nil
+		}
+	}
+	return err
+}
+
+// SetDefaultAddress makes the address of the user the default of type typ
+func (m *Mongo) SetDefaultAddress(userID, addressID, typ string) error {
+	_, span := m.start("mongodb: set default address")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", userID),
+		attribute.String("address.id", addressID),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(userID) || !bson.IsObjectIdHex(addressID) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	var field string
+	switch typ {
+	case users.AddressShipping:
+		field = "defaultShipping"
+	case users.AddressBilling:
+		field = "defaultBilling"
+	default:
+		err := fmt.Errorf("no default address of type %q", typ)
+		recordError(span, err)
+		return err
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	aid := bson.ObjectIdHex(addressID)
+	err := s.DB(m.database).C("customers").Update(
+		bson.M{"_id": bson.ObjectIdHex(userID), "addresses": aid},
+		bson.M{"$set": bson.M{field: aid}, "$inc": bson.M{"version": 1}},
+	)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// SetDefaultCard makes the card of the user its default card
+func (m *Mongo) SetDefaultCard(userID, cardID string) error {
+	_, span := m.start("mongodb: set default card")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", userID),
+		attribute.String("card.id", cardID),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(userID) || !bson.IsObjectIdHex(cardID) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	cid := bson.ObjectIdHex(cardID)
+	err := s.DB(m.database).C("customers").Update(
+		bson.M{"_id": bson.ObjectIdHex(userID), "cards": cid},
+		bson.M{"$set": bson.M{"defaultCard": cid}, "$inc": bson.M{"version": 1}},
+	)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
 	}
-	span.SetTag("db.type", "mongodb")
-	span.SetTag("db.collection", entity)
-	span.SetTag("entity.id", id)
-	defer span.Finish()
+	return err
+}
+
+// Delete removes an entity from MongoDB
+func (m *Mongo) Delete(entity, id string, version int64) error {
+	_, span := m.start("mongodb: delete entity")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", entity),
+		attribute.String("entity.id", id),
+	)
+	defer span.End()
 
 	if !bson.IsObjectIdHex(id) {
-		err := errors.New("Invalid Id Hex")
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		err := ErrInvalidHexID
+		recordError(span, err)
 		return err
 	}
 	s := m.Session.Copy()
 	defer s.Close()
-	c := s.DB("").C(entity)
+	c := s.DB(m.database).C(entity)
+	oid := bson.ObjectIdHex(id)
 	if entity == "customers" {
-		u, err := m.GetUser(id)
+		var mu MongoUser
+		err := c.FindId(oid).One(&mu)
+		if err == nil && version != db.AnyVersion && mu.Version != version {
+			err = db.ErrVersionMismatch
+		}
+		if err == nil {
+			q := bson.M{"_id": oid}
+			if version != db.AnyVersion {
+				// A change since the read fails the removal
+				q["version"] = versionQuery(version)
+			}
+			err = c.Remove(q)
+			if err == mgo.ErrNotFound && version != db.AnyVersion {
+				err = db.ErrVersionMismatch
+			}
+		}
+		if err == mgo.ErrNotFound {
+			err = db.NotFoundError{Entity: entity, ID: id}
+		}
 		if err != nil {
-			span.SetTag("error", true)
-			span.SetTag("error.message", err.Error())
+			recordError(span, err)
 			return err
 		}
-		aids := make([]bson.ObjectId, 0)
-		for _, a := range u.Addresses {
-			aids = append(aids, bson.ObjectIdHex(a.ID))
+		s.DB(m.database).C("addresses").RemoveAll(bson.M{"_id": bson.M{"$in": mu.AddressIDs}})
+		s.DB(m.database).C("cards").RemoveAll(bson.M{"_id": bson.M{"$in": mu.CardIDs}})
+		return nil
+	}
+	s.DB(m.database).C("customers").UpdateAll(bson.M{entity: oid},
+		bson.M{"$pull": bson.M{entity: oid}, "$inc": bson.M{"version": 1}})
+	if entity == "addresses" {
+		for _, f := range []string{"defaultShipping", "defaultBilling"} {
+			s.DB(m.database).C("customers").UpdateAll(bson.M{f: oid}, bson.M{"$unset": bson.M{f: ""}})
 		}
-		cids := make([]bson.ObjectId, 0)
-		for _, c := range u.Cards {
-			cids = append(cids, bson.ObjectIdHex(c.ID))
+	}
+	if entity == "cards" {
+		// The first card left becomes the default of its holder
+		var holders []MongoUser
+		s.DB(m.database).C("customers").Find(bson.M{"defaultCard": oid}).Select(bson.M{"cards": 1}).All(&holders)
+		for _, h := range holders {
+			update := bson.M{"$unset": bson.M{"defaultCard": ""}}
+			if len(h.CardIDs) > 0 {
+				update = bson.M{"$set": bson.M{"defaultCard": h.CardIDs[0]}}
+			}
+			s.DB(m.database).C("customers").Update(bson.M{"_id": h.ID, "defaultCard": oid}, update)
 		}
-		ac := s.DB("").C("addresses")
-		ac.RemoveAll(bson.M{"_id": bson.M{"$in": aids}})
-		cc := s.DB("").C("cards")
-		cc.RemoveAll(bson.M{"_id": bson.M{"$in": cids}})
-	} else {
-		c := s.DB("").C("customers")
-		c.UpdateAll(bson.M{},
-			bson.M{"$pull": bson.M{entity: bson.ObjectIdHex(id)}})
 	}
-	err := c.Remove(bson.M{"_id": bson.ObjectIdHex(id)})
+	err := c.Remove(bson.M{"_id": oid})
+	if err == mgo.ErrNotFound {
+		err = db.NotFoundError{Entity: entity, ID: id}
+	}
 	if err != nil {
-		span.SetTag("error", true)
-		span.SetTag("error.message", err.Error())
+		recordError(span, err)
 	}
 	return err
 }
 
-func getURL() url.URL {
-	ur := url.URL{
-		Scheme: "mongodb",
-		Host:   host,
-		Path:   db,
+// versionQuery matches version v, which documents written before versions
+// were kept are at without the field
+func versionQuery(v int64) interface{} {
+	if v == 0 {
+		return bson.M{"$in": []interface{}{0, nil}}
 	}
-	if name != "" {
-		u := url.UserPassword(name, password)
-		ur.User = u
+	return v
+}
+
+// AnonymizeUser erases the personal data of a customer, deleting its
+// addresses and cards, while keeping the document and its id
+func (m *Mongo) AnonymizeUser(id string) error {
+	_, span := m.start("mongodb: anonymize user")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", id),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(id) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
 	}
-	return ur
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	var mu MongoUser
+	err := c.FindId(bson.ObjectIdHex(id)).One(&mu)
+	if err == mgo.ErrNotFound {
+		err = db.NotFoundError{Entity: "customers", ID: id}
+	}
+	if err != nil {
+		recordError(span, err)
+		return err
+	}
+	// The personal data of addresses and cards left behind would outlive
+	// the anonymization, which fails so as to be retried
+	if _, err := s.DB(m.database).C("addresses").RemoveAll(bson.M{"_id": bson.M{"$in": mu.AddressIDs}}); err != nil {
+		recordError(span, err)
+		return err
+	}
+	if _, err := s.DB(m.database).C("cards").RemoveAll(bson.M{"_id": bson.M{"$in": mu.CardIDs}}); err != nil {
+		recordError(span, err)
+		return err
+	}
+
+	u := users.User{UserID: id, ConsentHistory: mu.ConsentHistory, ConsentTallies: mu.ConsentTallies}
+	u.Anonymize()
+	set := bson.M{
+		"firstName":         u.FirstName,
+		"lastName":          u.LastName,
+		"username":          u.Username,
+		"username_lower":    strings.ToLower(u.Username),
+		"username_skeleton": users.UsernameSkeleton(u.Username),
+		"email":             u.Email,
+		"password":          u.Password,
+		"salt":              u.Salt,
+		"anonymized":        true,
+		"addresses":         []bson.ObjectId{},
+		"cards":             []bson.ObjectId{},
+	}
+	// Only the tallies of the consent history outlive it
+	if len(u.ConsentTallies) > 0 {
+		set["consentTallies"] = u.ConsentTallies
+	}
+	err = c.UpdateId(mu.ID, bson.M{
+		"$set":   set,
+		"$unset": bson.M{"refreshTokens": "", "mfa": "", "roles": "", "phone": "", "preferences": "", "email_normalized": "", "defaultShipping": "", "defaultBilling": "", "defaultCard": "", "emails": "", "displayName": "", "consentHistory": ""},
+		"$inc":   bson.M{"version": 1},
+	})
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// RecordAudit stores the entry in the audit collection
+func (m *Mongo) RecordAudit(e db.AuditEntry) error {
+	s := m.Session.Copy()
+	defer s.Close()
+	return s.DB(m.database).C("audit").Insert(e)
 }
 
 // EnsureIndexes ensures username is unique
@@ -693,8 +1778,55 @@ func (m *Mongo) EnsureIndexes() error {
 		Background: true,
 		Sparse:     false,
 	}
-	c := s.DB("").C("customers")
-	return c.EnsureIndex(i)
+	c := s.DB(m.database).C("customers")
+	if err := c.EnsureIndex(i); err != nil {
+		return err
+	}
+	// A unique index has a name of its own, as an index cannot change
+	// options under the same name
+	skeletons := mgo.Index{
+		Key:        []string{"username_skeleton"},
+		Background: true,
+	}
+	if m.Config.UniqueSkeletons {
+		skeletons.Name = "username_skeleton_unique"
+		skeletons.Unique = true
+	}
+	if err := c.EnsureIndex(skeletons); err != nil {
+		return err
+	}
+	// Users without an email, as anonymized ones, have no email_normalized
+	if err := c.EnsureIndex(mgo.Index{
+		Key:        []string{"email_normalized"},
+		Unique:     true,
+		Background: true,
+		Sparse:     true,
+	}); err != nil {
+		return err
+	}
+	// Nor can the other emails of a user, verified or not, be anyone else's
+	if err := c.EnsureIndex(mgo.Index{
+		Key:        []string{"emails.normalized"},
+		Unique:     true,
+		Background: true,
+		Sparse:     true,
+	}); err != nil {
+		return err
+	}
+	if err := c.EnsureIndex(mgo.Index{
+		Key:        []string{"refreshTokens.hash"},
+		Background: true,
+		Sparse:     true,
+	}); err != nil {
+		return err
+	}
+	// Sorted listings
+	for _, f := range db.UserSortFields {
+		if err := c.EnsureIndex(mgo.Index{Key: []string{f, "_id"}, Background: true}); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (m *Mongo) Ping() error {
@@ -702,3 +1834,9 @@ func (m *Mongo) Ping() error {
 	defer s.Close()
 	return s.Ping()
 }
+
+// Close closes the session and its connections
+func (m *Mongo) Close() error {
+	m.Session.Close()
+	return nil
+}
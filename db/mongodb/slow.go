@@ -0,0 +1,94 @@
+package mongodb
+
+// slow.go reports the operations on MongoDB taking longer than a threshold.
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/go-kit/kit/metrics"
+	"github.com/microservices-demo/user/db"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// WithSlowQueries logs operations taking longer than threshold to logger,
+// as warnings, and counts them in counter, labelled by layer and operation.
+// A zero threshold disables it.
+func WithSlowQueries(threshold time.Duration, logger log.Logger, counter metrics.Counter) Option {
+	return func(c *Config) {
+		c.SlowThreshold = threshold
+		c.SlowLogger = logger
+		c.SlowCounter = counter
+	}
+}
+
+// start starts the span of the operation op, as a child of the span of the
+// context of m and, when m traces user ids, tagged with the user of its
+// baggage, reported when it ends past the slow threshold of m
+func (m *Mongo) start(op string) (context.Context, trace.Span) {
+	parent := m.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, span := tracer.Start(parent, op)
+	if user := db.UserFromBaggage(ctx); user != "" && m.Config.TraceUserIDs {
+		span.SetAttributes(attribute.String(db.UserBaggageKey, user))
+	}
+	if m.Config.SlowThreshold <= 0 {
+		return ctx, span
+	}
+	return ctx, &slowSpan{Span: span, config: &m.Config, op: op, begin: time.Now()}
+}
+
+// slowSpan is a span keeping its attributes, the parameters of the
+// operation, to report them when it ends late
+type slowSpan struct {
+	trace.Span
+	config *Config
+	op     string
+	begin  time.Time
+	attrs  []attribute.KeyValue
+}
+
+func (s *slowSpan) SetAttributes(kv ...attribute.KeyValue) {
+	s.attrs = append(s.attrs, kv...)
+	s.Span.SetAttributes(kv...)
+}
+
+func (s *slowSpan) End(opts ...trace.SpanEndOption) {
+	s.Span.End(opts...)
+	took := time.Since(s.begin)
+	if took <= s.config.SlowThreshold {
+		return
+	}
+	if s.config.SlowCounter != nil {
+		s.config.SlowCounter.With("layer", "db", "operation", s.op).Add(1)
+	}
+	if s.config.SlowLogger == nil {
+		return
+	}
+	keyvals := []interface{}{
+		"msg", "slow operation",
+		"layer", "db",
+		"operation", s.op,
+		"took", took,
+		"threshold", s.config.SlowThreshold,
+		"traceid", traceID(s.Span),
+	}
+	// The attributes are already redacted as spans require
+	for _, kv := range s.attrs {
+		keyvals = append(keyvals, string(kv.Key), kv.Value.Emit())
+	}
+	level.Warn(s.config.SlowLogger).Log(keyvals...)
+}
+
+// traceID returns the id of the trace of span, empty when it is not traced
+func traceID(span trace.Span) string {
+	if sc := span.SpanContext(); sc.HasTraceID() {
+		return sc.TraceID().String()
+	}
+	return ""
+}
@@ -0,0 +1,50 @@
+package mongodb
+
+// stats.go exposes the connection statistics of mgo as Prometheus gauges.
+
+import (
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/mgo.v2"
+)
+
+// statsCollector reads the statistics of mgo when scraped. mgo keeps them
+// under a mutex it takes on socket and operation events, with no polling,
+// so they are cheap enough to stay enabled.
+type statsCollector struct {
+	clusters     *stdprometheus.Desc
+	sockets      *stdprometheus.Desc
+	socketsInUse *stdprometheus.Desc
+	sessions     *stdprometheus.Desc
+}
+
+// NewStatsCollector enables the statistics of mgo and returns a collector
+// of gauges of them, named with namespace and subsystem: the clusters
+// known, the sockets alive and in use, and the references of sessions to
+// sockets, the active sessions.
+func NewStatsCollector(namespace, subsystem string) stdprometheus.Collector {
+	mgo.SetStats(true)
+	name := func(n string) string {
+		return stdprometheus.BuildFQName(namespace, subsystem, n)
+	}
+	return &statsCollector{
+		clusters:     stdprometheus.NewDesc(name("mongo_clusters"), "MongoDB clusters known to the driver.", nil, nil),
+		sockets:      stdprometheus.NewDesc(name("mongo_sockets_alive"), "Sockets open to MongoDB.", nil, nil),
+		socketsInUse: stdprometheus.NewDesc(name("mongo_sockets_in_use"), "Sockets to MongoDB held by a session.", nil, nil),
+		sessions:     stdprometheus.NewDesc(name("mongo_session_socket_refs"), "References of sessions to sockets, the active MongoDB sessions.", nil, nil),
+	}
+}
+
+func (c *statsCollector) Describe(ch chan<- *stdprometheus.Desc) {
+	ch <- c.clusters
+	ch <- c.sockets
+	ch <- c.socketsInUse
+	ch <- c.sessions
+}
+
+func (c *statsCollector) Collect(ch chan<- stdprometheus.Metric) {
+	s := mgo.GetStats()
+	ch <- stdprometheus.MustNewConstMetric(c.clusters, stdprometheus.GaugeValue, float64(s.Clusters))
+	ch <- stdprometheus.MustNewConstMetric(c.sockets, stdprometheus.GaugeValue, float64(s.SocketsAlive))
+	ch <- stdprometheus.MustNewConstMetric(c.socketsInUse, stdprometheus.GaugeValue, float64(s.SocketsInUse))
+	ch <- stdprometheus.MustNewConstMetric(c.sessions, stdprometheus.GaugeValue, float64(s.SocketRefs))
+}
@@ -0,0 +1,81 @@
+package mongodb
+
+// stream.go lists customers, addresses and cards through a cursor, so a
+// listing holds one document in memory at a time however large it is.
+
+import (
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/attribute"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// StreamUsers calls fn with each customer not anonymized, in the order of so
+func (m *Mongo) StreamUsers(so db.Sort, fn func(users.User) error) error {
+	find := func(c *mgo.Collection) *mgo.Query {
+		return c.Find(bson.M{"anonymized": bson.M{"$ne": true}}).Sort(sortKeys(so)...)
+	}
+	return stream(m, "mongodb: stream users", "customers", find, func(mu MongoUser) error {
+		mu.AddUserIDs()
+		return fn(mu.User)
+	})
+}
+
+// StreamAddresses calls fn with each address
+func (m *Mongo) StreamAddresses(fn func(users.Address) error) error {
+	find := func(c *mgo.Collection) *mgo.Query {
+		return c.Find(nil)
+	}
+	return stream(m, "mongodb: stream addresses", "addresses", find, func(ma MongoAddress) error {
+		ma.AddID()
+		return fn(ma.Address)
+	})
+}
+
+// StreamCards calls fn with each card
+func (m *Mongo) StreamCards(fn func(users.Card) error) error {
+	find := func(c *mgo.Collection) *mgo.Query {
+		return c.Find(nil)
+	}
+	return stream(m, "mongodb: stream cards", "cards", find, func(mc MongoCard) error {
+		mc.AddID()
+		return fn(mc.Card)
+	})
+}
+
+// stream calls fn with each document of the query find runs on collection,
+// decoded into a fresh T, until fn or the cursor fails
+func stream[T any](m *Mongo, op, collection string, find func(*mgo.Collection) *mgo.Query, fn func(T) error) error {
+	_, span := m.start(op)
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", collection),
+	)
+	defer span.End()
+
+	s := m.Session.Copy()
+	defer s.Close()
+	iter := find(s.DB(m.database).C(collection)).Iter()
+	var err error
+	n := 0
+	for {
+		var doc T
+		if !iter.Next(&doc) {
+			break
+		}
+		if err = fn(doc); err != nil {
+			break
+		}
+		n++
+	}
+	if cerr := iter.Close(); err == nil {
+		err = cerr
+	}
+	span.SetAttributes(attribute.Int("result.count", n))
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
@@ -0,0 +1,161 @@
+package mongodb
+
+// tokens.go contains the storage of refresh tokens, kept as an array on the
+// customer document.
+
+import (
+	"time"
+
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/users"
+	"go.opentelemetry.io/otel/attribute"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// CreateRefreshToken stores t on the user, dropping expired tokens
+func (m *Mongo) CreateRefreshToken(userID string, t users.RefreshToken) error {
+	_, span := m.start("mongodb: create refresh token")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", userID),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(userID) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	id := bson.ObjectIdHex(userID)
+	// $pull and $push on the same array cannot share an update
+	err := c.UpdateId(id, bson.M{"$pull": bson.M{"refreshTokens": bson.M{"expiresAt": bson.M{"$lt": time.Now()}}}})
+	if err == nil {
+		err = c.UpdateId(id, bson.M{"$push": bson.M{"refreshTokens": t}})
+	}
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+	}
+	return err
+}
+
+// UseRefreshToken atomically marks the token with the given hash as used,
+// returning its owner and its state from before the call
+func (m *Mongo) UseRefreshToken(hash string) (string, users.RefreshToken, error) {
+	_, span := m.start("mongodb: use refresh token")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+	)
+	defer span.End()
+
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	var mu MongoUser
+	_, err := c.Find(bson.M{"refreshTokens.hash": hash}).
+		Select(bson.M{"refreshTokens.$": 1}).
+		Apply(mgo.Change{Update: bson.M{"$set": bson.M{"refreshTokens.$.used": true}}}, &mu)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err == nil && len(mu.RefreshTokens) == 0 {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+		return "", users.RefreshToken{}, err
+	}
+	span.SetAttributes(attribute.String("user.id", mu.ID.Hex()))
+	return mu.ID.Hex(), mu.RefreshTokens[0], nil
+}
+
+// GetRefreshTokens returns the active refresh tokens of the user
+func (m *Mongo) GetRefreshTokens(userID string) ([]users.RefreshToken, error) {
+	_, span := m.start("mongodb: find refresh tokens")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", userID),
+	)
+	defer span.End()
+
+	ts := make([]users.RefreshToken, 0)
+	if !bson.IsObjectIdHex(userID) {
+		recordError(span, ErrInvalidHexID)
+		return ts, ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	var mu MongoUser
+	err := c.FindId(bson.ObjectIdHex(userID)).Select(bson.M{"refreshTokens": 1}).One(&mu)
+	if err == mgo.ErrNotFound {
+		err = db.ErrNotFound
+	}
+	if err != nil {
+		recordError(span, err)
+		return ts, err
+	}
+	now := time.Now()
+	for _, t := range mu.RefreshTokens {
+		if t.Active(now) {
+			ts = append(ts, t)
+		}
+	}
+	span.SetAttributes(attribute.Int("result.count", len(ts)))
+	return ts, nil
+}
+
+// RevokeRefreshTokens revokes the user's tokens with the given ids, or all of
+// them when no ids are given
+func (m *Mongo) RevokeRefreshTokens(userID string, ids ...string) error {
+	_, span := m.start("mongodb: revoke refresh tokens")
+	span.SetAttributes(
+		attribute.String("db.type", "mongodb"),
+		attribute.String("db.collection", "customers"),
+		attribute.String("user.id", userID),
+	)
+	defer span.End()
+
+	if !bson.IsObjectIdHex(userID) {
+		recordError(span, ErrInvalidHexID)
+		return ErrInvalidHexID
+	}
+	s := m.Session.Copy()
+	defer s.Close()
+	c := s.DB(m.database).C("customers")
+	id := bson.ObjectIdHex(userID)
+	if len(ids) == 0 {
+		var mu MongoUser
+		err := c.FindId(id).Select(bson.M{"refreshTokens.id": 1}).One(&mu)
+		if err == mgo.ErrNotFound {
+			err = db.ErrNotFound
+		}
+		if err != nil {
+			recordError(span, err)
+			return err
+		}
+		for _, t := range mu.RefreshTokens {
+			ids = append(ids, t.ID)
+		}
+	}
+	for _, tid := range ids {
+		err := c.Update(bson.M{"_id": id, "refreshTokens.id": tid}, bson.M{"$set": bson.M{"refreshTokens.$.revoked": true}})
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			recordError(span, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package events
+
+// broker.go publishes events to a message broker from a buffer, so a slow
+// or unreachable broker never delays the requests making the changes.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+)
+
+// ErrBacklogFull is returned by the health checks of sinks whose buffer is
+// full, as when their broker or target hangs, so events emitted are dropped
+var ErrBacklogFull = errors.New("Event buffer full")
+
+// Publisher sends payloads to a message broker
+type Publisher interface {
+	// Publish sends payload to topic, keyed by key where the broker
+	// partitions topics
+	Publish(topic, key string, payload []byte) error
+	Close() error
+}
+
+// Broker publishes the events emitted through a Publisher in the
+// background, to the topic named by the topic prefix and the event type,
+// keyed by the entity id. Events arriving while the buffer is full, and
+// events the publisher fails, are dropped and counted: the broker is not
+// retried, so an outage costs events but never latency.
+type Broker struct {
+	pub Publisher
+	options
+
+	queue chan Event
+	done  chan struct{}
+	// mu guards closed against the queue closing under Emit
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewBroker returns a Broker publishing through p and starts its worker
+func NewBroker(p Publisher, opts ...Option) *Broker {
+	b := &Broker{pub: p, options: newOptions(opts), done: make(chan struct{})}
+	b.queue = make(chan Event, b.queueSize)
+	go b.run()
+	return b
+}
+
+// Emit buffers e, dropping it when the buffer is full or the broker closed
+func (b *Broker) Emit(e Event) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		b.deliveries.With("result", ResultDropped).Add(1)
+		b.logger.Log("msg", "Broker closed, event dropped", "event", e.Type, "id", e.ID)
+		return
+	}
+	select {
+	case b.queue <- e:
+	default:
+		b.deliveries.With("result", ResultDropped).Add(1)
+		b.logger.Log("msg", "Event buffer full, event dropped", "event", e.Type, "id", e.ID)
+	}
+}
+
+// Close stops accepting events, publishes those buffered until ctx is done
+// and closes the publisher
+func (b *Broker) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.mu.Unlock()
+	select {
+	case <-b.done:
+		return b.pub.Close()
+	case <-ctx.Done():
+		// Publishing what is left fails fast once the publisher is closed
+		b.pub.Close()
+		return ctx.Err()
+	}
+}
+
+// Ping returns ErrBacklogFull while the buffer is full
+func (b *Broker) Ping() error {
+	if len(b.queue) == cap(b.queue) {
+		return ErrBacklogFull
+	}
+	return nil
+}
+
+func (b *Broker) run() {
+	defer close(b.done)
+	for e := range b.queue {
+		payload, err := json.Marshal(e)
+		if err == nil {
+			err = b.pub.Publish(b.topicPrefix+e.Type, e.EntityID, payload)
+		}
+		if err != nil {
+			b.deliveries.With("result", ResultDropped).Add(1)
+			b.logger.Log("msg", "Event publication failed, event dropped", "event", e.Type, "id", e.ID, "err", err)
+			continue
+		}
+		b.deliveries.With("result", ResultDelivered).Add(1)
+	}
+}
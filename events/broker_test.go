@@ -0,0 +1,116 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+type publication struct {
+	topic, key string
+	event      Event
+}
+
+type fakePublisher struct {
+	mu        sync.Mutex
+	published []publication
+	err       error
+}
+
+func (p *fakePublisher) Publish(topic, key string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	var e Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return err
+	}
+	p.published = append(p.published, publication{topic: topic, key: key, event: e})
+	return nil
+}
+
+func (p *fakePublisher) Close() error {
+	return nil
+}
+
+func TestBroker(t *testing.T) {
+	pub := &fakePublisher{}
+	counter := newResultCounter()
+	b := NewBroker(pub, WithTopicPrefix("shop."), WithDeliveryCounter(counter))
+	e := New(UserCreated, "42", nil)
+	e.TraceID = "abc"
+	b.Emit(e)
+	if err := b.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(pub.published) != 1 {
+		t.Fatalf("Expected one publication, received %v", pub.published)
+	}
+	p := pub.published[0]
+	if p.topic != "shop.user.created" || p.key != "42" {
+		t.Errorf("Expected topic shop.user.created keyed 42, received %v keyed %v", p.topic, p.key)
+	}
+	if p.event.Version != SchemaVersion || p.event.EntityID != "42" || p.event.TraceID != "abc" || p.event.Time.IsZero() {
+		t.Errorf("Expected the versioned event, received %+v", p.event)
+	}
+	if got := counter.get(ResultDelivered); got != 1 {
+		t.Errorf("Expected 1 delivery, counted %v", got)
+	}
+
+	// A broker that is down costs events, counted as dropped
+	counter = newResultCounter()
+	b = NewBroker(&fakePublisher{err: errors.New("down")}, WithDeliveryCounter(counter))
+	b.Emit(New(UserDeleted, "42", nil))
+	b.Close(context.Background())
+	if got := counter.get(ResultDropped); got != 1 {
+		t.Errorf("Expected 1 dropped event, counted %v", got)
+	}
+}
+
+// blockedPublisher hangs until released
+type blockedPublisher struct {
+	release chan struct{}
+}
+
+func (p blockedPublisher) Publish(string, string, []byte) error {
+	<-p.release
+	return nil
+}
+
+func (p blockedPublisher) Close() error {
+	return nil
+}
+
+func TestBrokerPing(t *testing.T) {
+	pub := blockedPublisher{release: make(chan struct{})}
+	b := NewBroker(pub, WithQueueSize(1))
+	if err := b.Ping(); err != nil {
+		t.Errorf("Expected an empty buffer healthy, received %v", err)
+	}
+	// One event is being published, the next fills the buffer
+	b.Emit(New(UserCreated, "1", nil))
+	for len(b.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	b.Emit(New(UserCreated, "2", nil))
+	if err := b.Ping(); !errors.Is(err, ErrBacklogFull) {
+		t.Errorf("Expected a full buffer reported, received %v", err)
+	}
+	close(pub.release)
+	b.Close(context.Background())
+}
+
+func TestBrokerEmitAfterClose(t *testing.T) {
+	counter := newResultCounter()
+	b := NewBroker(&fakePublisher{}, WithDeliveryCounter(counter))
+	b.Close(context.Background())
+	b.Emit(New(UserCreated, "1", nil))
+	if got := counter.get(ResultDropped); got != 1 {
+		t.Errorf("Expected the event dropped, counted %v", got)
+	}
+}
@@ -0,0 +1,91 @@
+// Package events carries the changes made to users, addresses and cards to
+// the services that follow them.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+
+	"github.com/microservices-demo/user/users"
+)
+
+// Types of events
+const (
+	UserCreated    = "user.created"
+	UserUpdated    = "user.updated"
+	UserDeleted    = "user.deleted"
+	AddressCreated = "address.created"
+	CardCreated    = "card.created"
+	// EmailVerification carries the code verifying an email a user added,
+	// for the mailer to send it to the address
+	EmailVerification = "email.verification"
+	// ConsentsUpdated carries the consents of a user to marketing once they
+	// change, for the mailers to stop or start contacting them
+	ConsentsUpdated = "consents.updated"
+)
+
+// SchemaVersion is the Version of the events encoded by this service. It
+// changes when a field is removed or changes meaning, not when one is
+// added.
+const SchemaVersion = 1
+
+// Event is a change to an entity. Data is the entity as the API returns
+// it, card numbers masked. TraceID is the trace of the request making the
+// change. Changes list what an update changed, as users.Diff tells it.
+type Event struct {
+	Version  int         `json:"version"`
+	ID       string      `json:"id"`
+	Type     string      `json:"type"`
+	Time     time.Time   `json:"time"`
+	EntityID string      `json:"entityId"`
+	TraceID  string      `json:"traceId,omitempty"`
+	Data     interface{} `json:"data,omitempty"`
+	// Changes are only told of user.updated events
+	Changes []users.FieldChange `json:"changes,omitempty"`
+}
+
+// New returns an event of type typ about the entity id, happening now
+func New(typ, id string, data interface{}) Event {
+	return Event{Version: SchemaVersion, ID: newID(), Type: typ, Time: time.Now().UTC(), EntityID: id, Data: data}
+}
+
+// Results a delivery is counted with
+const (
+	ResultDelivered = "delivered"
+	ResultFailed    = "failed"
+	ResultDropped   = "dropped"
+)
+
+// Emitter is told of the events of the service. Emit must not block nor
+// fail the change the event is about.
+type Emitter interface {
+	Emit(Event)
+}
+
+// Emitters tells every emitter of each event
+type Emitters []Emitter
+
+// Emit tells every emitter of e
+func (es Emitters) Emit(e Event) {
+	for _, em := range es {
+		em.Emit(e)
+	}
+}
+
+// fallbackIDs counts the event ids made without randomness
+var fallbackIDs atomic.Uint64
+
+// newID returns a random id for an event, so receivers can tell a
+// redelivery from a new event. Should the random source fail, the id is
+// made of the time and a counter, lest every event share one of zeros.
+func newID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(b[8:], fallbackIDs.Add(1))
+	}
+	return hex.EncodeToString(b)
+}
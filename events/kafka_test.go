@@ -0,0 +1,45 @@
+package events
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKafkaREST(t *testing.T) {
+	var received struct {
+		Records []struct {
+			Key   string          `json:"key"`
+			Value json.RawMessage `json:"value"`
+		} `json:"records"`
+	}
+	fail := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/topics/user.created" || r.Header.Get("Content-Type") != "application/vnd.kafka.json.v2+json" {
+			t.Errorf("Expected a JSON produce to the topic, received %v %v", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		json.NewDecoder(r.Body).Decode(&received)
+		if fail {
+			w.Write([]byte(`{"offsets":[{"partition":null,"offset":null,"error_code":50003,"error":"leader not available"}]}`))
+			return
+		}
+		w.Write([]byte(`{"offsets":[{"partition":0,"offset":7,"error_code":null,"error":null}]}`))
+	}))
+	defer ts.Close()
+
+	k, err := NewKafkaREST(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := k.Publish("user.created", "42", []byte(`{"id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if len(received.Records) != 1 || received.Records[0].Key != "42" || string(received.Records[0].Value) != `{"id":"1"}` {
+		t.Errorf("Expected the event keyed by entity, received %+v", received)
+	}
+	fail = true
+	if err := k.Publish("user.created", "42", []byte(`{}`)); err == nil {
+		t.Error("Expected a failed record to fail the publication")
+	}
+}
@@ -0,0 +1,76 @@
+package events
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// serveNATS accepts one connection on ln and sends the subject and payload
+// of each PUB to msgs
+func serveNATS(t *testing.T, ln net.Listener, msgs chan<- string) {
+	conn, err := ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	fmt.Fprint(conn, "INFO {\"server_id\":\"test\"}\r\n")
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "CONNECT":
+			if !strings.Contains(line, `"user":"svc"`) {
+				t.Errorf("Expected the user in CONNECT, received %v", line)
+			}
+		case "PUB":
+			var n int
+			fmt.Sscan(fields[2], &n)
+			payload := make([]byte, n+2)
+			io.ReadFull(r, payload)
+			msgs <- fields[1] + " " + string(payload[:n])
+		case "PING":
+			fmt.Fprint(conn, "PONG\r\n")
+		}
+	}
+}
+
+func TestNATS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	msgs := make(chan string, 1)
+	go serveNATS(t, ln, msgs)
+
+	n, err := NewNATS("nats://svc:secret@" + ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.Close()
+	if err := n.Publish("user.created", "42", []byte(`{"id":"1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-msgs; got != `user.created {"id":"1"}` {
+		t.Errorf("Expected the event published, received %v", got)
+	}
+
+	ln.Close()
+	if err := n.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Publish("user.created", "42", nil); err != ErrPublisherClosed {
+		t.Errorf("Expected %v after Close, received %v", ErrPublisherClosed, err)
+	}
+	if _, err := NewNATS("http://localhost"); err == nil {
+		t.Error("Expected a URL other than nats:// refused")
+	}
+}
@@ -0,0 +1,92 @@
+package events
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+)
+
+// Option configures Webhooks and Broker
+type Option func(*options)
+
+type options struct {
+	attempts    int
+	backoff     time.Duration
+	queueSize   int
+	client      *http.Client
+	topicPrefix string
+	logger      log.Logger
+	deliveries  metrics.Counter
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		attempts:   5,
+		backoff:    time.Second,
+		queueSize:  1000,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		logger:     log.NewNopLogger(),
+		deliveries: discard.NewCounter(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithAttempts sets how often a webhook delivery is attempted before it is
+// given up, 5 by default
+func WithAttempts(n int) Option {
+	return func(o *options) {
+		o.attempts = n
+	}
+}
+
+// WithBackoff sets the wait before the first retry of a webhook delivery,
+// doubled for every further one; 1s by default
+func WithBackoff(d time.Duration) Option {
+	return func(o *options) {
+		o.backoff = d
+	}
+}
+
+// WithQueueSize sets how many events wait for delivery, to each webhook or
+// to the broker, before further ones are dropped; 1000 by default
+func WithQueueSize(n int) Option {
+	return func(o *options) {
+		o.queueSize = n
+	}
+}
+
+// WithHTTPClient sets the client webhooks are posted with, one with a 5s
+// timeout by default
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.client = c
+	}
+}
+
+// WithTopicPrefix sets what the broker prefixes the type of an event with
+// to name its topic
+func WithTopicPrefix(p string) Option {
+	return func(o *options) {
+		o.topicPrefix = p
+	}
+}
+
+// WithLogger logs failed and dropped deliveries to l
+func WithLogger(l log.Logger) Option {
+	return func(o *options) {
+		o.logger = l
+	}
+}
+
+// WithDeliveryCounter counts deliveries in c, labelled with their result
+func WithDeliveryCounter(c metrics.Counter) Option {
+	return func(o *options) {
+		o.deliveries = c
+	}
+}
@@ -0,0 +1,147 @@
+package events
+
+// sink.go writes the audit records of the service to the destinations a
+// deployment enables: the audit collection of the database, stdout and
+// webhooks, alone or several at once.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/metrics"
+	"github.com/go-kit/kit/metrics/discard"
+	"github.com/microservices-demo/user/db"
+)
+
+// AuditPrefix prefixes the action of an audit event to make its type, as
+// in audit.delete. The Data of an audit event is a db.AuditEntry.
+const AuditPrefix = "audit."
+
+// EventSink receives events synchronously, unlike an Emitter, and reports
+// whether it could take them
+type EventSink interface {
+	Write(ctx context.Context, e Event) error
+}
+
+// NewAudit returns the audit event of entry
+func NewAudit(entry db.AuditEntry) Event {
+	e := New(AuditPrefix+entry.Action, entry.ID, entry)
+	e.Time = entry.Time.UTC()
+	return e
+}
+
+// AuditorSink writes the audit events it is given to the audit log of a
+// database
+type AuditorSink struct {
+	auditor db.Auditor
+}
+
+// NewAuditorSink returns an AuditorSink writing to a
+func NewAuditorSink(a db.Auditor) AuditorSink {
+	return AuditorSink{auditor: a}
+}
+
+// Write records the db.AuditEntry of e, refusing events of other types
+func (s AuditorSink) Write(_ context.Context, e Event) error {
+	entry, ok := e.Data.(db.AuditEntry)
+	if !ok {
+		return fmt.Errorf("%v is not an audit event", e.Type)
+	}
+	return s.auditor.RecordAudit(entry)
+}
+
+// JSONSink writes events as lines of JSON, to stdout for a log collector
+// to pick up
+type JSONSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONSink returns a JSONSink writing to w
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+// Write writes e as one line
+func (s *JSONSink) Write(_ context.Context, e Event) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// Write queues e for every target, as Emit does: Webhooks retry and count
+// deliveries themselves, so Write never fails.
+func (w *Webhooks) Write(_ context.Context, e Event) error {
+	w.Emit(e)
+	return nil
+}
+
+// Fanout writes every event to each of its sinks. A sink failing, or
+// panicking, neither keeps the event from the other sinks nor fails the
+// write: the failure is logged and counted, with the sink name, instead.
+type Fanout struct {
+	sinks  []namedSink
+	logger log.Logger
+	writes metrics.Counter
+}
+
+type namedSink struct {
+	name string
+	sink EventSink
+}
+
+// NewFanout returns a Fanout of no sinks, logging failures to logger and
+// counting writes in writes, labelled by sink and result (delivered or
+// failed). Either may be nil.
+func NewFanout(logger log.Logger, writes metrics.Counter) *Fanout {
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	if writes == nil {
+		writes = discard.NewCounter()
+	}
+	return &Fanout{logger: logger, writes: writes}
+}
+
+// Add adds s to the sinks, named name in logs and metrics, and returns f
+func (f *Fanout) Add(name string, s EventSink) *Fanout {
+	f.sinks = append(f.sinks, namedSink{name: name, sink: s})
+	return f
+}
+
+// Len returns the number of sinks
+func (f *Fanout) Len() int {
+	return len(f.sinks)
+}
+
+// Write writes e to every sink in turn
+func (f *Fanout) Write(ctx context.Context, e Event) error {
+	for _, s := range f.sinks {
+		if err := write(ctx, s.sink, e); err != nil {
+			f.writes.With("sink", s.name, "result", ResultFailed).Add(1)
+			f.logger.Log("msg", "Event sink write failed", "sink", s.name, "event", e.Type, "id", e.ID, "err", err)
+			continue
+		}
+		f.writes.With("sink", s.name, "result", ResultDelivered).Add(1)
+	}
+	return nil
+}
+
+// write writes e to s, turning a panic into an error
+func write(ctx context.Context, s EventSink, e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return s.Write(ctx, e)
+}
@@ -0,0 +1,78 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
+	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/memory"
+	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type sinkFunc func(context.Context, Event) error
+
+func (f sinkFunc) Write(ctx context.Context, e Event) error {
+	return f(ctx, e)
+}
+
+func TestFanout(t *testing.T) {
+	writes := stdprometheus.NewCounterVec(stdprometheus.CounterOpts{Name: "writes"}, []string{"sink", "result"})
+	var received []Event
+	f := NewFanout(nil, kitprometheus.NewCounter(writes)).
+		Add("failing", sinkFunc(func(context.Context, Event) error { return errors.New("down") })).
+		Add("panicking", sinkFunc(func(context.Context, Event) error { panic("broken") })).
+		Add("working", sinkFunc(func(_ context.Context, e Event) error {
+			received = append(received, e)
+			return nil
+		}))
+
+	e := NewAudit(db.AuditEntry{Time: time.Now(), Action: "delete", Entity: "customers", ID: "1", Principal: "admin"})
+	if err := f.Write(context.Background(), e); err != nil {
+		t.Errorf("Expected failures isolated, received %v", err)
+	}
+	if len(received) != 1 || received[0].Type != "audit.delete" {
+		t.Errorf("Expected the event written past failing sinks, received %+v", received)
+	}
+	for _, c := range []struct{ sink, result string }{
+		{"failing", ResultFailed}, {"panicking", ResultFailed}, {"working", ResultDelivered},
+	} {
+		if got := testutil.ToFloat64(writes.WithLabelValues(c.sink, c.result)); got != 1 {
+			t.Errorf("Expected a %v write counted for %v, counted %v", c.result, c.sink, got)
+		}
+	}
+}
+
+func TestAuditSinks(t *testing.T) {
+	entry := db.AuditEntry{Time: time.Now(), Action: "anonymize", Entity: "customers", ID: "1", Principal: "support"}
+	e := NewAudit(entry)
+
+	m := memory.New()
+	if err := NewAuditorSink(m).Write(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	if log := m.AuditLog(); len(log) != 1 || !reflect.DeepEqual(log[0], entry) {
+		t.Errorf("Expected the entry recorded, received %+v", log)
+	}
+	if err := NewAuditorSink(m).Write(context.Background(), New(UserCreated, "1", nil)); err == nil {
+		t.Error("Expected an event other than an audit refused")
+	}
+
+	var buf bytes.Buffer
+	if err := NewJSONSink(&buf).Write(context.Background(), e); err != nil {
+		t.Fatal(err)
+	}
+	var line struct {
+		Type string
+		Data db.AuditEntry
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil || line.Type != "audit.anonymize" || line.Data.Principal != "support" {
+		t.Errorf("Expected a JSON line of the event, received %v %v", buf.String(), err)
+	}
+}
@@ -0,0 +1,183 @@
+package events
+
+// webhook.go posts events to HTTP endpoints. Each target has its own queue
+// and worker, so a slow or failing target delays only its own deliveries.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// SignatureHeader holds "sha256=" and the hex HMAC-SHA256 of the body,
+	// keyed with the webhook secret
+	SignatureHeader = "X-Signature-256"
+	// TypeHeader holds the type of the event posted
+	TypeHeader = "X-Event-Type"
+	// IDHeader holds the id of the event posted, the same for every attempt
+	IDHeader = "X-Event-ID"
+)
+
+// Webhooks posts the events emitted to target URLs in the background,
+// retrying failed deliveries with exponential backoff.
+type Webhooks struct {
+	secret []byte
+	options
+
+	targets []*webhookTarget
+	stop    chan struct{}
+	wg      sync.WaitGroup
+	// mu guards closed against the queues closing under Emit
+	mu     sync.RWMutex
+	closed bool
+}
+
+type webhookTarget struct {
+	url   string
+	queue chan Event
+}
+
+// NewWebhooks returns Webhooks posting to urls, signed with secret, and
+// starts their workers
+func NewWebhooks(urls []string, secret []byte, opts ...Option) *Webhooks {
+	w := &Webhooks{
+		secret:  secret,
+		options: newOptions(opts),
+		stop:    make(chan struct{}),
+	}
+	for _, u := range urls {
+		t := &webhookTarget{url: u, queue: make(chan Event, w.queueSize)}
+		w.targets = append(w.targets, t)
+		w.wg.Add(1)
+		go w.run(t)
+	}
+	return w
+}
+
+// Emit queues e for every target, dropping it for targets whose queue is
+// full, and for all of them once closed
+func (w *Webhooks) Emit(e Event) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		w.deliveries.With("result", ResultDropped).Add(float64(len(w.targets)))
+		w.logger.Log("msg", "Webhooks closed, event dropped", "event", e.Type, "id", e.ID)
+		return
+	}
+	for _, t := range w.targets {
+		select {
+		case t.queue <- e:
+		default:
+			w.deliveries.With("result", ResultDropped).Add(1)
+			w.logger.Log("msg", "Webhook queue full, event dropped", "url", t.url, "event", e.Type, "id", e.ID)
+		}
+	}
+}
+
+// Close stops accepting events and delivers those queued until ctx is
+// done, when retries are abandoned
+func (w *Webhooks) Close(ctx context.Context) error {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		for _, t := range w.targets {
+			close(t.queue)
+		}
+	}
+	w.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		w.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		close(w.stop)
+		<-done
+		return ctx.Err()
+	}
+}
+
+// Ping returns ErrBacklogFull, naming the target, while the queue of a
+// target is full
+func (w *Webhooks) Ping() error {
+	for _, t := range w.targets {
+		if len(t.queue) == cap(t.queue) {
+			return fmt.Errorf("%w: %v", ErrBacklogFull, t.url)
+		}
+	}
+	return nil
+}
+
+func (w *Webhooks) run(t *webhookTarget) {
+	defer w.wg.Done()
+	for e := range t.queue {
+		w.deliver(t.url, e)
+	}
+}
+
+// deliver posts e to url until it is accepted or the attempts run out
+func (w *Webhooks) deliver(url string, e Event) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		w.deliveries.With("result", ResultFailed).Add(1)
+		w.logger.Log("msg", "Webhook event not encodable", "event", e.Type, "id", e.ID, "err", err)
+		return
+	}
+	wait := w.backoff
+retry:
+	for attempt := 1; ; attempt++ {
+		if err = w.post(url, e, body); err == nil {
+			w.deliveries.With("result", ResultDelivered).Add(1)
+			return
+		}
+		if attempt >= w.attempts {
+			break
+		}
+		select {
+		case <-time.After(wait):
+			wait *= 2
+		case <-w.stop:
+			break retry
+		}
+	}
+	w.deliveries.With("result", ResultFailed).Add(1)
+	w.logger.Log("msg", "Webhook delivery failed", "url", url, "event", e.Type, "id", e.ID, "err", err)
+}
+
+func (w *Webhooks) post(url string, e Event, body []byte) error {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TypeHeader, e.Type)
+	req.Header.Set(IDHeader, e.ID)
+	req.Header.Set(SignatureHeader, Sign(w.secret, body))
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v answered %v", url, resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the SignatureHeader value of body for secret
+func Sign(secret, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,138 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/metrics"
+)
+
+// resultCounter counts by the value of the result label
+type resultCounter struct {
+	*results
+	result string
+}
+
+type results struct {
+	mu     sync.Mutex
+	counts map[string]float64
+}
+
+func newResultCounter() resultCounter {
+	return resultCounter{results: &results{counts: map[string]float64{}}}
+}
+
+func (c resultCounter) With(labelValues ...string) metrics.Counter {
+	return resultCounter{results: c.results, result: labelValues[1]}
+}
+
+func (c resultCounter) Add(delta float64) {
+	c.mu.Lock()
+	c.counts[c.result] += delta
+	c.mu.Unlock()
+}
+
+func (c resultCounter) get(result string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[result]
+}
+
+func TestWebhooks(t *testing.T) {
+	secret := []byte("secret")
+	var mu sync.Mutex
+	var received []Event
+	failures := 2
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.Header.Get(SignatureHeader) != Sign(secret, body) {
+			t.Errorf("Expected a valid signature, received %v", r.Header.Get(SignatureHeader))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var e Event
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		if r.Header.Get(TypeHeader) != e.Type || r.Header.Get(IDHeader) != e.ID {
+			t.Errorf("Expected event headers of %v, received %v", e, r.Header)
+		}
+		received = append(received, e)
+	}))
+	defer ts.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	counter := newResultCounter()
+	w := NewWebhooks([]string{ts.URL, failing.URL}, secret,
+		WithAttempts(3), WithBackoff(time.Millisecond), WithDeliveryCounter(counter))
+	w.Emit(New(UserCreated, "1", map[string]string{"username": "hook"}))
+	w.Emit(New(UserDeleted, "1", nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first event is retried through two failures, in order with the
+	// second
+	if len(received) != 2 || received[0].Type != UserCreated || received[1].Type != UserDeleted {
+		t.Fatalf("Expected both events in order, received %v", received)
+	}
+	if got := counter.get(ResultDelivered); got != 2 {
+		t.Errorf("Expected 2 deliveries, counted %v", got)
+	}
+	if got := counter.get(ResultFailed); got != 2 {
+		t.Errorf("Expected 2 failed deliveries to the failing target, counted %v", got)
+	}
+}
+
+func TestWebhooksDropWhenFull(t *testing.T) {
+	block := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer ts.Close()
+	counter := newResultCounter()
+	w := NewWebhooks([]string{ts.URL}, nil, WithQueueSize(1), WithAttempts(1), WithDeliveryCounter(counter))
+	if err := w.Ping(); err != nil {
+		t.Errorf("Expected an empty queue healthy, received %v", err)
+	}
+	// One event is posted, one waits in the queue, the rest are dropped
+	for i := 0; i < 5; i++ {
+		w.Emit(New(UserCreated, "1", nil))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := w.Ping(); !errors.Is(err, ErrBacklogFull) {
+		t.Errorf("Expected a full queue reported, received %v", err)
+	}
+	close(block)
+	w.Close(context.Background())
+	if got := counter.get(ResultDropped); got != 3 {
+		t.Errorf("Expected 3 dropped events, counted %v", got)
+	}
+}
+
+func TestWebhooksEmitAfterClose(t *testing.T) {
+	counter := newResultCounter()
+	w := NewWebhooks([]string{"http://127.0.0.1:1"}, nil, WithDeliveryCounter(counter))
+	w.Close(context.Background())
+	w.Emit(New(UserCreated, "1", nil))
+	if got := counter.get(ResultDropped); got != 1 {
+		t.Errorf("Expected the event dropped, counted %v", got)
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -16,20 +19,134 @@ import (
 	"github.com/go-kit/kit/log"
 	kitprometheus "github.com/go-kit/kit/metrics/prometheus"
 	"github.com/microservices-demo/user/api"
+	"github.com/microservices-demo/user/auth"
 	"github.com/microservices-demo/user/db"
+	"github.com/microservices-demo/user/db/fallback"
+	"github.com/microservices-demo/user/db/memory"
 	"github.com/microservices-demo/user/db/mongodb"
-	stdopentracing "github.com/opentracing/opentracing-go"
-	zipkinot "github.com/openzipkin-contrib/zipkin-go-opentracing"
-	"github.com/openzipkin/zipkin-go"
-	"github.com/openzipkin/zipkin-go/reporter"
-	zipkinhttp "github.com/openzipkin/zipkin-go/reporter/http"
+	"github.com/microservices-demo/user/events"
+	"github.com/microservices-demo/user/pb"
+	"github.com/microservices-demo/user/redact"
+	"github.com/microservices-demo/user/users"
 	stdprometheus "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	commonMiddleware "github.com/weaveworks/common/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/zipkin"
+	"go.opentelemetry.io/otel/propagation"
+	sdkresource "go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
 var (
-	port string
-	zip  string
+	port          string
+	plainPort     string
+	grpcPort      string
+	tlsCertFile   string
+	tlsKeyFile    string
+	tlsClientCA   string
+	tlsClientReq  bool
+	zip           string
+	database      string
+	mongoUser     string
+	mongoPassword string
+	mongoHost     string
+	migrateOnly   bool
+	jwtAlg        string
+	jwtKeyFile    string
+	jwtPrevKeys   string
+	jwtTTL        time.Duration
+	jwtLeeway     time.Duration
+	credsTTL      time.Duration
+	imperTTL      time.Duration
+	imperWrites   bool
+	refreshTTL    time.Duration
+	denylist      string
+	redisAddr     string
+	redisPassword string
+	loginRate     float64
+	loginBurst    int
+	loginIdle     time.Duration
+	trustedProxy  string
+	gateFailures  int
+	gateWindow    time.Duration
+	gateTimeout   time.Duration
+	captchaURL    string
+	bcryptCost    int
+	pwMinLength   int
+	pwRequire     string
+	pwIdentity    bool
+	pwCommon      bool
+	pwCommonFile  string
+	exposeCards   bool
+	skipLuhn      bool
+	foldEmails    bool
+	nameCharset   string
+	legacyNames   bool
+	confusables   bool
+	cardMask      string
+	adminCardMask string
+	mfaKeyFile    string
+	mfaIssuer     string
+	apiKeysFile   string
+	cookieMode    string
+	cookieName    string
+	cookieDomain  string
+	cookieMaxAge  time.Duration
+	cookieSame    string
+	sessionStore  string
+	maxBodySize   int64
+	idemTTL       time.Duration
+	shutdownWait  time.Duration
+	shutdownDelay time.Duration
+	readyTimeout  time.Duration
+	pingInterval  time.Duration
+	healthTimeout time.Duration
+	alertFailures int
+	alertPeriod   time.Duration
+	alertSpacing  time.Duration
+	alertWebhook  string
+	webhookURLs   string
+	webhookSecret string
+	webhookTries  int
+	eventBroker   string
+	auditSinks    string
+	auditHooks    string
+	eventURL      string
+	eventPrefix   string
+	tenantList    string
+	coalesceReads bool
+	cacheTTL      time.Duration
+	fallbackEvery time.Duration
+	cacheEntries  int
+	maxReads      int64
+	maxWrites     int64
+	maxLogins     int64
+	queueTimeout  time.Duration
+	unixSocket    string
+	unixMode      string
+	readTimeout   time.Duration
+	writeTimeout  time.Duration
+	idleTimeout   time.Duration
+	enablePprof   bool
+	pprofAddr     string
+	logLevel      string
+	logFormat     string
+	maskEmails    bool
+	traceNames    bool
+	traceUserIDs  bool
+	captureRate   float64
+	slowRequest   time.Duration
+	slowQuery     time.Duration
+	tracerBackend string
+	jaegerURL     string
 )
 
 var (
@@ -55,6 +172,17 @@ var (
 		Help:    "Size of HTTP response bodies.",
 		Buckets: stdprometheus.ExponentialBuckets(1024, 2, 10),
 	}, []string{"method", "route"})
+
+	SlowOperations = stdprometheus.NewCounterVec(stdprometheus.CounterOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "slow_operations_total",
+		Help:      "Operations taking longer than their -slow-*-threshold, by layer and operation.",
+	}, []string{"layer", "operation"})
+
+	// dbLogger is the logger of slow database operations and migrations,
+	// set by main before the database is opened
+	dbLogger log.Logger = log.NewNopLogger()
 )
 
 const (
@@ -66,9 +194,140 @@ func init() {
 	stdprometheus.MustRegister(HTTPRequestsInFlight)
 	stdprometheus.MustRegister(HTTPRequestBodySize)
 	stdprometheus.MustRegister(HTTPResponseBodySize)
-	flag.StringVar(&zip, "zipkin", os.Getenv("ZIPKIN"), "Zipkin address")
-	flag.StringVar(&port, "port", "8084", "Port on which to run")
-	db.Register("mongodb", &mongodb.Mongo{})
+	stdprometheus.MustRegister(SlowOperations)
+	// The default registry collects the Go runtime and the process already;
+	// the runtime collector is replaced by one adding the GC pause and
+	// scheduler histograms of runtime/metrics.
+	stdprometheus.Unregister(collectors.NewGoCollector())
+	stdprometheus.MustRegister(collectors.NewGoCollector(
+		collectors.WithGoCollectorRuntimeMetrics(collectors.MetricsGC, collectors.MetricsScheduler),
+	))
+	stdprometheus.MustRegister(mongodb.NewStatsCollector("microservices_demo", "user"))
+	flag.StringVar(&tracerBackend, "tracer", os.Getenv("TRACER"), "Span exporter, otlp, zipkin, jaeger or none; every exporter configured when empty")
+	flag.StringVar(&zip, "zipkin", os.Getenv("ZIPKIN"), "Zipkin collector URL, spans are sent there alongside any other exporter unless -tracer selects one")
+	flag.StringVar(&jaegerURL, "jaeger-endpoint", os.Getenv("JAEGER_ENDPOINT"), "OTLP/HTTP traces URL of the Jaeger collector, such as http://jaeger:4318/v1/traces")
+	flag.StringVar(&port, "port", "8084", "Port on which to run; empty to serve on -listen-unix only")
+	flag.StringVar(&unixSocket, "listen-unix", os.Getenv("LISTEN_UNIX"), "Unix socket also serving the HTTP API, without TLS; disabled when empty")
+	flag.StringVar(&unixMode, "listen-unix-mode", "0660", "File mode of the -listen-unix socket")
+	flag.DurationVar(&readTimeout, "http-read-timeout", 10*time.Second, "Time a client of the API port or socket has to send a request, headers and body; 0 for no limit")
+	flag.DurationVar(&writeTimeout, "http-write-timeout", time.Minute, "Time a response of the API port or socket may take to write, streamed exports included; 0 for no limit")
+	flag.DurationVar(&idleTimeout, "http-idle-timeout", 2*time.Minute, "Time a kept alive connection to the API port or socket waits for its next request")
+	flag.BoolVar(&enablePprof, "enable-pprof", false, "Serve pprof profiles and /debug/vars on -pprof-addr, behind the API keys when configured")
+	flag.StringVar(&pprofAddr, "pprof-addr", "localhost:6060", "Address of the -enable-pprof debug server, localhost only by default")
+	flag.StringVar(&logLevel, "log-level", "info", "Least level logged, debug, info, warn or error; raised by SIGUSR1, lowered by SIGUSR2")
+	flag.StringVar(&logFormat, "log-format", "logfmt", "Format of the log lines, logfmt or json")
+	flag.BoolVar(&maskEmails, "log-mask-emails", false, "Partially redact emails in logs, keeping their first letter and domain")
+	flag.BoolVar(&traceNames, "trace-usernames", false, "Tag database spans with usernames")
+	flag.Float64Var(&captureRate, "debug-capture-rate", 0, "Fraction of requests whose redacted bodies are recorded on their span and logged at debug level; 0 for none")
+	flag.BoolVar(&traceUserIDs, "trace-user-ids", false, "Propagate the id of the authenticated user as user.id trace baggage and tag spans with it")
+	flag.DurationVar(&slowRequest, "slow-request-threshold", time.Second, "Requests taking longer are logged as slow and counted; 0 disables it")
+	flag.DurationVar(&slowQuery, "slow-query-threshold", 500*time.Millisecond, "Database operations taking longer are logged as slow and counted; 0 disables it")
+	flag.StringVar(&plainPort, "plain-port", "", "Port serving only /health and /metrics without TLS, for probes and scrapers")
+	flag.StringVar(&grpcPort, "grpc-port", "", "Port serving the gRPC API, with the TLS settings of the HTTP server; disabled when empty")
+	flag.StringVar(&tlsCertFile, "tls-cert-file", os.Getenv("TLS_CERT_FILE"), "Server certificate, enables TLS; reloaded on SIGHUP")
+	flag.StringVar(&tlsKeyFile, "tls-key-file", os.Getenv("TLS_KEY_FILE"), "Server certificate key")
+	flag.StringVar(&tlsClientCA, "tls-client-ca-file", os.Getenv("TLS_CLIENT_CA_FILE"), "CA bundle client certificates are verified against")
+	flag.BoolVar(&tlsClientReq, "tls-require-client-cert", false, "Refuse TLS connections without a verified client certificate")
+	flag.StringVar(&database, "database", os.Getenv("USER_DATABASE"), "Database to use, Mongodb or ...")
+	flag.StringVar(&mongoUser, "mongo-user", os.Getenv("MONGO_USER"), "Mongo user")
+	flag.StringVar(&mongoPassword, "mongo-password", "", "Mongo password, defaults to the contents of MONGO_PASS_FILE or to MONGO_PASS")
+	flag.StringVar(&mongoHost, "mongo-host", os.Getenv("MONGO_HOST"), "Mongo host")
+	flag.BoolVar(&migrateOnly, "migrate-only", false, "Run database migrations and exit")
+	flag.StringVar(&jwtAlg, "jwt-alg", auth.HS256, "Token signing algorithm, HS256 or RS256")
+	flag.StringVar(&jwtKeyFile, "jwt-key-file", os.Getenv("JWT_KEY_FILE"), "File holding the token signing key, falls back to JWT_KEY")
+	flag.StringVar(&jwtPrevKeys, "jwt-previous-key-files", os.Getenv("JWT_PREVIOUS_KEY_FILES"), "Comma separated files holding keys still accepted for verification")
+	flag.DurationVar(&jwtTTL, "jwt-ttl", time.Hour, "Lifetime of issued tokens")
+	flag.DurationVar(&jwtLeeway, "jwt-leeway", 30*time.Second, "Clock skew tolerated when verifying tokens")
+	flag.DurationVar(&credsTTL, "credentials-cache-ttl", 5*time.Second, "Time the credentials version of a customer is cached for when verifying tokens, the delay before other replicas refuse tokens issued before a password change, a disable or a logout from everywhere")
+	flag.DurationVar(&imperTTL, "impersonation-ttl", 15*time.Minute, "Lifetime of the tokens admins impersonate customers with")
+	flag.BoolVar(&imperWrites, "allow-impersonated-writes", false, "Let impersonation tokens call mutating endpoints; they are read-only otherwise")
+	flag.DurationVar(&refreshTTL, "refresh-ttl", 30*24*time.Hour, "Lifetime of refresh tokens")
+	flag.StringVar(&denylist, "denylist", "memory", "Revoked access token store, memory, redis or none")
+	flag.StringVar(&redisAddr, "redis-addr", os.Getenv("REDIS_ADDR"), "Redis address for the redis denylist and session store")
+	flag.StringVar(&redisPassword, "redis-password", "", "Redis password for the redis denylist and session store, defaults to the contents of REDIS_PASSWORD_FILE or to REDIS_PASSWORD")
+	flag.Float64Var(&loginRate, "login-rate", 0.2, "Login attempts per second allowed per client IP and per account")
+	flag.IntVar(&loginBurst, "login-burst", 5, "Login attempts allowed in a burst per client IP and per account")
+	flag.DurationVar(&loginIdle, "login-limit-idle", 15*time.Minute, "Inactivity after which login rate limit state is dropped")
+	flag.StringVar(&nameCharset, "username-charset", "ascii", "Characters of new usernames: ascii, or unicode for the letters of a single script as well")
+	flag.BoolVar(&legacyNames, "username-legacy", true, "Let usernames registered before the username rules be kept by profile updates")
+	flag.BoolVar(&confusables, "username-reject-confusable", false, "Refuse usernames only told apart from that of another customer by lookalike characters or case")
+	flag.BoolVar(&foldEmails, "email-fold-local", false, "Compare the local part of emails, before the @, ignoring case, as the domain")
+	flag.BoolVar(&skipLuhn, "card-skip-luhn", false, "Accept card numbers failing the Luhn checksum, for demos with made up numbers")
+	flag.StringVar(&cardMask, "card-mask", "last4", "Masking of card numbers in responses and logs: last4 or bin6last4")
+	flag.StringVar(&adminCardMask, "admin-card-mask", "bin6last4", "Masking of card numbers in responses to tokens with the admin role: last4 or bin6last4")
+	flag.BoolVar(&exposeCards, "expose-card-numbers", false, "Return full card numbers to tokens with the payment role asking with ?full=true")
+	flag.IntVar(&bcryptCost, "bcrypt-cost", 10, "Cost of bcrypt password hashes")
+	flag.IntVar(&pwMinLength, "password-min-length", 8, "Minimum length of new passwords")
+	flag.StringVar(&pwRequire, "password-require", "", "Comma separated character classes new passwords must contain: upper, lower, digit, symbol")
+	flag.BoolVar(&pwIdentity, "password-reject-identity", true, "Refuse the username or email as password")
+	flag.BoolVar(&pwCommon, "password-reject-common", true, "Refuse common passwords")
+	flag.StringVar(&pwCommonFile, "password-common-file", "", "File of common passwords, one per line, replacing the bundled list")
+	flag.StringVar(&mfaKeyFile, "mfa-key-file", os.Getenv("MFA_KEY_FILE"), "File holding the key sealing TOTP secrets, falls back to MFA_KEY")
+	flag.StringVar(&mfaIssuer, "mfa-issuer", "Sock Shop", "Issuer shown for TOTP secrets in authenticator apps")
+	flag.StringVar(&apiKeysFile, "api-keys-file", os.Getenv("API_KEYS_FILE"), "File of name=sha256 API keys for admin endpoints, falls back to API_KEYS; reloaded on SIGHUP")
+	flag.StringVar(&cookieMode, "session-cookie", "", "Set a session cookie on login: jwt, session (server-side store) or empty for bearer tokens only")
+	flag.StringVar(&cookieName, "cookie-name", "user_session", "Name of the session cookie")
+	flag.StringVar(&cookieDomain, "cookie-domain", "", "Domain of the session cookie")
+	flag.DurationVar(&cookieMaxAge, "cookie-max-age", time.Hour, "Max-Age of the session cookie and lifetime of server-side sessions")
+	flag.StringVar(&cookieSame, "cookie-samesite", "lax", "SameSite mode of the session cookie, lax, strict or none")
+	flag.StringVar(&sessionStore, "session-store", "memory", "Server-side session store, memory or redis")
+	flag.IntVar(&gateFailures, "login-gate-failures", 0, "Failed logins from a client IP after which a captcha is required, 0 disables the check")
+	flag.DurationVar(&gateWindow, "login-gate-window", 15*time.Minute, "Period over which failed logins are counted for the captcha requirement")
+	flag.DurationVar(&gateTimeout, "login-gate-timeout", 2*time.Second, "Time allowed for captcha verification before the login proceeds without it")
+	flag.StringVar(&captchaURL, "captcha-verify-url", os.Getenv("CAPTCHA_VERIFY_URL"), "Siteverify URL of the captcha vendor, the secret is read from CAPTCHA_SECRET or CAPTCHA_SECRET_FILE")
+	flag.Int64Var(&maxBodySize, "max-body-size", api.DefaultMaxBodySize, "Largest request body accepted, in bytes")
+	flag.DurationVar(&idemTTL, "idempotency-ttl", 24*time.Hour, "Period for which responses are replayed to requests repeating their Idempotency-Key")
+	flag.DurationVar(&shutdownDelay, "shutdown-delay", 5*time.Second, "Time /ready fails on shutdown before the servers stop accepting connections, for load balancers to notice")
+	flag.DurationVar(&fallbackEvery, "db-fallback-interval", 0, "Period of the snapshots of the database that reads fall back to while it is unreachable; 0 disables the fallback")
+	flag.IntVar(&alertFailures, "db-alert-failures", 3, "Consecutive failed background database pings raising a db_unavailable alert; 0 disables the pings")
+	flag.DurationVar(&alertPeriod, "db-alert-ping-interval", 10*time.Second, "Period of the background database pings")
+	flag.DurationVar(&alertSpacing, "db-alert-min-interval", 5*time.Minute, "Least time between two database alerts, against flapping")
+	flag.StringVar(&alertWebhook, "db-alert-webhook", os.Getenv("DB_ALERT_WEBHOOK"), "URL posted database alerts and recoveries, signed with the webhook secret when set; alerts are logged only when empty")
+	flag.DurationVar(&pingInterval, "health-ping-interval", api.DefaultPingInterval, "Period for which health checks reuse the result of their database and denylist pings; 0 pings on every check")
+	flag.DurationVar(&healthTimeout, "health-timeout", api.DefaultHealthTimeout, "Time each component gets to answer a health check before it is reported failing; 0 waits for all of them")
+	flag.DurationVar(&readyTimeout, "ready-timeout", api.DefaultReadyTimeout, "Time dependencies get to answer a /ready check before it fails")
+	flag.DurationVar(&shutdownWait, "shutdown-timeout", 20*time.Second, "Time in-flight requests get to finish on shutdown before they are answered with 503")
+	flag.StringVar(&webhookURLs, "webhook-urls", os.Getenv("WEBHOOK_URLS"), "Comma separated URLs posted user and card events; disabled when empty")
+	flag.StringVar(&webhookSecret, "webhook-secret-file", os.Getenv("WEBHOOK_SECRET_FILE"), "File holding the key webhook posts are signed with, falls back to WEBHOOK_SECRET")
+	flag.IntVar(&webhookTries, "webhook-attempts", 5, "Attempts at delivering an event to a webhook before it is given up")
+	flag.StringVar(&auditSinks, "audit-sinks", "db", "Comma separated destinations of audit events: db, stdout and webhook; none for no audit")
+	flag.StringVar(&auditHooks, "audit-webhook-urls", os.Getenv("AUDIT_WEBHOOK_URLS"), "Comma separated URLs posted audit events by the webhook audit sink")
+	flag.StringVar(&eventBroker, "event-broker", "none", "Broker user, address and card events are published to: nats, kafka or none")
+	flag.StringVar(&eventURL, "event-broker-url", os.Getenv("EVENT_BROKER_URL"), "URL of the NATS server (nats://host:4222) or of the Kafka REST proxy (http://host:8082)")
+	flag.StringVar(&eventPrefix, "event-topic-prefix", "", "Prefix of the topics events are published to, named by event type")
+	flag.StringVar(&tenantList, "tenants", os.Getenv("TENANTS"), "Comma separated tenants accepted in X-Tenant-ID, each served from a database of its own; disabled when empty")
+	flag.BoolVar(&coalesceReads, "coalesce-reads", true, "Share one database read between concurrent requests for the same customer, address or card")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "Time customers, addresses and cards read are cached in memory for; 0 disables the cache")
+	flag.IntVar(&cacheEntries, "cache-entries", api.DefaultCacheEntries, "Entries the in-memory cache holds, beyond which the least recently used are evicted")
+	flag.Int64Var(&maxReads, "max-inflight-reads", 256, "Reads served at once, beyond which requests queue; 0 for no limit")
+	flag.Int64Var(&maxWrites, "max-inflight-writes", 128, "Writes served at once, beyond which requests queue; 0 for no limit")
+	flag.Int64Var(&maxLogins, "max-inflight-logins", 32, "Credential checks served at once, beyond which requests queue; 0 for no limit")
+	flag.DurationVar(&queueTimeout, "inflight-queue-timeout", 250*time.Millisecond, "Time a request queues for a turn before it is answered with 503")
+	flag.StringVar(&trustedProxy, "trusted-proxies", os.Getenv("TRUSTED_PROXIES"), "Comma separated CIDRs of proxies whose X-Forwarded-For is trusted")
+	db.Register("mongodb", func() (db.Database, error) {
+		opts := []mongodb.Option{
+			mongodb.WithHost(mongoHost),
+			mongodb.WithCredentials(mongoUser, mongoPassword),
+			mongodb.WithSlowQueries(slowQuery, dbLogger, kitprometheus.NewCounter(SlowOperations)),
+			mongodb.WithLogger(dbLogger),
+		}
+		if traceUserIDs {
+			opts = append(opts, mongodb.WithUserIDs())
+		}
+		if confusables {
+			opts = append(opts, mongodb.WithUniqueSkeletons())
+		}
+		m, err := mongodb.NewWithOptions(opts...)
+		if err != nil {
+			return nil, err
+		}
+		return m, nil
+	})
+	db.Register("memory", func() (db.Database, error) {
+		m := memory.New()
+		m.SetUniqueSkeletons(confusables)
+		return m, nil
+	})
 }
 
 func main() {
@@ -79,117 +338,668 @@ func main() {
 
 	// Log domain.
 	var logger log.Logger
+	var levels *api.LevelLogger
 	{
-		logger = log.NewLogfmtLogger(os.Stderr)
-		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
+		switch logFormat {
+		case "logfmt":
+			logger = log.NewLogfmtLogger(log.NewSyncWriter(os.Stderr))
+		case "json":
+			logger = log.NewJSONLogger(log.NewSyncWriter(os.Stderr))
+		default:
+			corelog.Fatalf("Unknown log format %q, expected logfmt or json", logFormat)
+		}
+		lv, err := api.ParseLogLevel(logLevel)
+		if err != nil {
+			corelog.Fatal(err)
+		}
+		levels = api.NewLevelLogger(logger, lv)
+		logger = log.With(levels, "ts", log.DefaultTimestampUTC)
 		logger = log.With(logger, "caller", log.DefaultCaller)
 	}
+	users.SetLuhnCheck(!skipLuhn)
+	users.SetFoldEmailLocal(foldEmails)
+	charset, err := users.ParseUsernameCharset(nameCharset)
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	users.SetUsernameCharset(charset)
+	users.SetLegacyUsernames(legacyNames)
+	maskStyle, err := users.ParseMaskStyle(cardMask)
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	users.SetMaskStyle(maskStyle)
+	adminMaskStyle, err := users.ParseMaskStyle(adminCardMask)
+	if err != nil {
+		corelog.Fatal(err)
+	}
+	redact.SetPolicy(redact.Policy{MaskEmails: maskEmails, TagUsernames: traceNames})
+	dbLogger = logger
+	// SIGUSR1 and SIGUSR2 raise and lower the log level a step
+	{
+		usr := make(chan os.Signal, 1)
+		signal.Notify(usr, syscall.SIGUSR1, syscall.SIGUSR2)
+		go func() {
+			for s := range usr {
+				var lv api.LogLevel
+				if s == syscall.SIGUSR1 {
+					lv = levels.Raise()
+				} else {
+					lv = levels.Lower()
+				}
+				logger.Log("msg", "Log level changed", "signal", s, "log_level", lv)
+			}
+		}()
+	}
+	build := api.Build()
+	logger.Log("msg", "Starting", "version", build.Version, "commit", build.Commit, "build_date", build.BuildDate, "go_version", build.GoVersion)
+	kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "build_info",
+		Help:      "Always 1, labelled with the build of the running binary.",
+	}, []string{"version", "commit", "build_date", "go_version"}).With(
+		"version", build.Version, "commit", build.Commit, "build_date", build.BuildDate, "go_version", build.GoVersion,
+	).Set(1)
 
-	// Find service local IP.
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+	// Secrets. Not defaulted in init so they do not show in -help.
+	for _, s := range []struct {
+		v   *string
+		env string
+	}{
+		{&mongoPassword, "MONGO_PASS"},
+		{&redisPassword, "REDIS_PASSWORD"},
+	} {
+		if *s.v != "" {
+			continue
+		}
+		v, err := secretFromEnv(s.env)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		*s.v = v
+	}
+
+	tp, shutdownTracing, exporters, err := newTracerProvider(context.Background(), tracingConfig{
+		backend:        tracerBackend,
+		zipkinURL:      zip,
+		jaegerEndpoint: jaegerURL,
+	})
 	if err != nil {
 		logger.Log("err", err)
 		os.Exit(1)
 	}
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	host := strings.Split(localAddr.String(), ":")[0]
-	defer conn.Close()
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	if len(exporters) == 0 {
+		logger.Log("msg", "Tracing disabled - no OTLP or Zipkin endpoint configured")
+	} else {
+		logger.Log("msg", "Tracing enabled", "exporters", strings.Join(exporters, ","))
+	}
 
-	var tracer stdopentracing.Tracer
-	var zipkinReporter reporter.Reporter
+	// Flush pending spans on shutdown
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdownTracing(ctx)
+	}()
+	var store db.Database
+	for store == nil {
+		store, err = db.Open(database)
+		if err != nil {
+			if err == db.ErrNoDatabaseSelected {
+				corelog.Fatal(err)
+			}
+			corelog.Print(err)
+		}
+	}
+	// Migrations run while opening the database.
+	if migrateOnly {
+		logger.Log("msg", "Migrations complete")
+		return
+	}
+
+	// Background tasks run until shutdown.
+	background, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// Reads fall back to a periodic snapshot of the database while it is
+	// unreachable. Tenants are opened on the primary, without fallback.
+	primary := store
+	if fallbackEvery > 0 {
+		snapshot := fallback.NewSnapshot(store)
+		if err := snapshot.Refresh(); err != nil {
+			logger.Log("msg", "Database snapshot failed, reads fall back once one is taken", "err", err)
+		}
+		go snapshot.Run(background, fallbackEvery, log.With(logger, "component", "fallback"))
+		store = fallback.New(store, snapshot)
+		logger.Log("msg", "Database fallback enabled", "interval", fallbackEvery)
+	}
+
+	// Database alerts, raised by background pings.
+	if alertFailures > 0 {
+		notifiers := api.Notifiers{api.LogNotifier{Logger: logger}}
+		if alertWebhook != "" {
+			// The secret is optional, alerts carry no personal data
+			secret, err := auth.LoadKey(webhookSecret, "WEBHOOK_SECRET")
+			if err != nil && !errors.Is(err, auth.ErrNoKey) {
+				logger.Log("msg", "Webhook secret unreadable, alerts are sent unsigned", "err", err)
+			}
+			notifiers = append(notifiers, api.WebhookNotifier{URL: alertWebhook, Secret: secret, Client: &http.Client{Timeout: 5 * time.Second}})
+		}
+		unavailable := kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "microservices_demo",
+			Subsystem: "user",
+			Name:      "db_unavailable",
+			Help:      "1 while -db-alert-failures consecutive background database pings failed, else 0.",
+		}, []string{})
+		monitor := api.NewPingMonitor("user-db", alertFailures, alertSpacing, notifiers, unavailable)
+		monitor.Timeout = healthTimeout
+		monitor.SetLogger(logger)
+		go monitor.Run(background, store.Ping, alertPeriod)
+	}
+
+	// Password domain.
+	serviceOpts := []api.ServiceOption{api.WithHasher(users.NewBcryptHasher(bcryptCost)), api.WithPingInterval(pingInterval), api.WithHealthTimeout(healthTimeout)}
+	if confusables {
+		serviceOpts = append(serviceOpts, api.WithConfusableUsernames())
+	}
 	{
-		if zip == "" {
-			tracer = stdopentracing.NoopTracer{}
-			logger.Log("msg", "Tracing disabled - no Zipkin endpoint configured")
-		} else {
-			logger := log.With(logger, "tracer", "Zipkin")
-			logger.Log("addr", zip)
-
-			// Create a standard logger for Zipkin reporter errors
-			zipkinLogger := corelog.New(os.Stderr, "ZIPKIN: ", corelog.LstdFlags)
-
-			// Create reporter with batching for better performance
-			zipkinReporter = zipkinhttp.NewReporter(
-				zip,
-				zipkinhttp.BatchSize(100),
-				zipkinhttp.BatchInterval(1*time.Second),
-				zipkinhttp.Logger(zipkinLogger),
-			)
+		policy := users.PasswordPolicy{MinLength: pwMinLength, RejectIdentity: pwIdentity}
+		for _, class := range strings.Split(pwRequire, ",") {
+			switch strings.TrimSpace(class) {
+			case "":
+			case users.RuleUpper:
+				policy.RequireUpper = true
+			case users.RuleLower:
+				policy.RequireLower = true
+			case users.RuleDigit:
+				policy.RequireDigit = true
+			case users.RuleSymbol:
+				policy.RequireSymbol = true
+			default:
+				logger.Log("err", "unknown password character class "+class)
+				os.Exit(1)
+			}
+		}
+		if pwCommon {
+			policy.Common = users.CommonPasswords()
+			if pwCommonFile != "" {
+				f, err := os.Open(pwCommonFile)
+				if err != nil {
+					logger.Log("err", err)
+					os.Exit(1)
+				}
+				policy.Common, err = users.ReadPasswordList(f)
+				f.Close()
+				if err != nil {
+					logger.Log("err", err)
+					os.Exit(1)
+				}
+			}
+		}
+		serviceOpts = append(serviceOpts, api.WithPasswordPolicy(policy))
+	}
 
-			endpoint, err := zipkin.NewEndpoint(ServiceName, fmt.Sprintf("%v:%v", host, port))
+	// Token domain.
+	var issuer *auth.Issuer
+	{
+		key, err := auth.LoadKey(jwtKeyFile, "JWT_KEY")
+		switch {
+		case err == auth.ErrNoKey:
+			logger.Log("msg", "Tokens and authentication disabled - no signing key configured")
+		case err != nil:
+			logger.Log("err", err)
+			os.Exit(1)
+		default:
+			issuer, err = auth.NewIssuer(jwtAlg, key)
 			if err != nil {
 				logger.Log("err", err)
 				os.Exit(1)
 			}
-
-			nativeTracer, err := zipkin.NewTracer(
-				zipkinReporter,
-				zipkin.WithLocalEndpoint(endpoint),
-				zipkin.WithSharedSpans(true),
-			)
+			issuer.TTL = jwtTTL
+			issuer.Leeway = jwtLeeway
+			issuer.ImpersonationTTL = imperTTL
+			switch denylist {
+			case "memory":
+				issuer.Denylist = auth.NewMemoryDenylist()
+			case "redis":
+				issuer.Denylist = auth.NewRedisDenylist(redisAddr, redisPassword)
+			case "none":
+			default:
+				logger.Log("err", fmt.Sprintf("unknown denylist %v", denylist))
+				os.Exit(1)
+			}
+			for _, f := range strings.Split(jwtPrevKeys, ",") {
+				if f == "" {
+					continue
+				}
+				prev, err := os.ReadFile(f)
+				if err == nil {
+					err = issuer.AddVerificationKey(prev)
+				}
+				if err != nil {
+					logger.Log("err", err)
+					os.Exit(1)
+				}
+			}
+			serviceOpts = append(serviceOpts, api.WithTokenIssuer(issuer), api.WithRefreshTTL(refreshTTL))
+		}
+		key, err = auth.LoadKey(mfaKeyFile, "MFA_KEY")
+		switch {
+		case err == auth.ErrNoKey:
+			logger.Log("msg", "Two-factor authentication disabled - no MFA key configured")
+		case err != nil:
+			logger.Log("err", err)
+			os.Exit(1)
+		case issuer == nil:
+			logger.Log("err", "two-factor authentication requires a token signing key")
+			os.Exit(1)
+		default:
+			sealer, err := auth.NewSealer(key)
 			if err != nil {
 				logger.Log("err", err)
 				os.Exit(1)
 			}
+			serviceOpts = append(serviceOpts, api.WithMFA(sealer, mfaIssuer))
+		}
+	}
 
-			tracer = zipkinot.Wrap(nativeTracer)
-			logger.Log("msg", "Zipkin tracer initialized successfully")
+	// API keys for administrative endpoints, reloaded on SIGHUP.
+	var apiKeys *auth.APIKeys
+	{
+		var err error
+		apiKeys, err = auth.LoadAPIKeys(apiKeysFile, "API_KEYS")
+		switch {
+		case err == auth.ErrNoKey:
+			apiKeys = nil
+			logger.Log("msg", "API keys disabled - no keys configured")
+		case err != nil:
+			logger.Log("err", err)
+			os.Exit(1)
+		default:
+			logger.Log("msg", "API keys loaded", "count", apiKeys.Len())
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			go func() {
+				for range hup {
+					if err := apiKeys.Reload(); err != nil {
+						logger.Log("msg", "API key reload failed, keeping current keys", "err", err)
+						continue
+					}
+					logger.Log("msg", "API keys reloaded", "count", apiKeys.Len())
+				}
+			}()
 		}
-		stdopentracing.InitGlobalTracer(tracer)
 	}
 
-	// Ensure reporter is closed on shutdown to flush pending spans
-	defer func() {
-		if zipkinReporter != nil {
-			zipkinReporter.Close()
+	fieldKeys := []string{"method"}
+	// Service domain.
+	requestCount := kitprometheus.NewCounterFrom(
+		stdprometheus.CounterOpts{
+			Namespace: "microservices_demo",
+			Subsystem: "user",
+			Name:      "request_count",
+			Help:      "Number of requests received.",
+		},
+		fieldKeys)
+	requestLatency := kitprometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "request_latency_microseconds",
+		Help:      "Total duration of requests in microseconds.",
+	}, fieldKeys)
+	coalesced := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "coalesced_reads_total",
+		Help:      "Number of reads answered by a concurrent read of the same entity, by entity.",
+	}, []string{"entity"})
+	cacheLookups := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "cache_lookups_total",
+		Help:      "Number of lookups of the in-memory cache, by entity and result, hit or miss.",
+	}, []string{"entity", "result"})
+
+	// Webhooks and the event broker, told of the changes made through the
+	// service.
+	var emitters events.Emitters
+	deliveries := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "event_deliveries_total",
+		Help:      "Number of event deliveries by sink (webhook or broker) and result: delivered, failed or dropped.",
+	}, []string{"sink", "result"})
+	var webhooks *events.Webhooks
+	if webhookURLs != "" {
+		secret, err := auth.LoadKey(webhookSecret, "WEBHOOK_SECRET")
+		if err != nil {
+			logger.Log("err", fmt.Sprintf("webhooks require a signing secret: %v", err))
+			os.Exit(1)
+		}
+		var urls []string
+		for _, u := range strings.Split(webhookURLs, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		webhooks = events.NewWebhooks(urls, secret,
+			events.WithAttempts(webhookTries),
+			events.WithLogger(log.With(logger, "component", "webhooks")),
+			events.WithDeliveryCounter(deliveries.With("sink", "webhook")),
+		)
+		emitters = append(emitters, webhooks)
+		serviceOpts = append(serviceOpts, api.WithHealthCheck("user-webhooks", api.SeverityOptional, webhooks.Ping))
+		logger.Log("msg", "Webhooks enabled", "targets", len(urls))
+	}
+	var broker *events.Broker
+	{
+		var pub events.Publisher
+		var err error
+		switch eventBroker {
+		case "none":
+		case "nats":
+			pub, err = events.NewNATS(eventURL)
+		case "kafka":
+			pub, err = events.NewKafkaREST(eventURL)
+		default:
+			err = fmt.Errorf("unknown event broker %v", eventBroker)
 		}
-	}()
-	dbconn := false
-	for !dbconn {
-		err := db.Init()
 		if err != nil {
-			if err == db.ErrNoDatabaseSelected {
-				corelog.Fatal(err)
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		if pub != nil {
+			broker = events.NewBroker(pub,
+				events.WithTopicPrefix(eventPrefix),
+				events.WithLogger(log.With(logger, "component", "events")),
+				events.WithDeliveryCounter(deliveries.With("sink", "broker")),
+			)
+			emitters = append(emitters, broker)
+			serviceOpts = append(serviceOpts, api.WithHealthCheck("user-events-"+eventBroker, api.SeverityOptional, broker.Ping))
+			logger.Log("msg", "Event publication enabled", "broker", eventBroker)
+		}
+	}
+
+	// Audit sinks. The database sink writes to the audit collection of each
+	// tenant, the others are shared.
+	auditWrites := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "audit_writes_total",
+		Help:      "Number of audit event writes by sink (db, stdout or webhook) and result: delivered or failed.",
+	}, []string{"sink", "result"})
+	var auditDB bool
+	var auditStdout *events.JSONSink
+	var auditWebhooks *events.Webhooks
+	for _, name := range strings.Split(auditSinks, ",") {
+		switch name = strings.TrimSpace(name); name {
+		case "", "none":
+		case "db":
+			auditDB = true
+		case "stdout":
+			auditStdout = events.NewJSONSink(os.Stdout)
+		case "webhook":
+			var urls []string
+			for _, u := range strings.Split(auditHooks, ",") {
+				if u = strings.TrimSpace(u); u != "" {
+					urls = append(urls, u)
+				}
 			}
-			corelog.Print(err)
-		} else {
-			dbconn = true
+			secret, err := auth.LoadKey(webhookSecret, "WEBHOOK_SECRET")
+			if len(urls) == 0 || err != nil {
+				logger.Log("err", fmt.Sprintf("the webhook audit sink requires -audit-webhook-urls and a signing secret: %v", err))
+				os.Exit(1)
+			}
+			auditWebhooks = events.NewWebhooks(urls, secret,
+				events.WithAttempts(webhookTries),
+				events.WithLogger(log.With(logger, "component", "audit")),
+				events.WithDeliveryCounter(deliveries.With("sink", "audit_webhook")),
+			)
+		default:
+			logger.Log("err", fmt.Sprintf("unknown audit sink %v, expected db, stdout, webhook or none", name))
+			os.Exit(1)
 		}
 	}
+	if auditWebhooks != nil {
+		serviceOpts = append(serviceOpts, api.WithHealthCheck("user-audit-webhooks", api.SeverityOptional, auditWebhooks.Ping))
+	}
+	logger.Log("msg", "Audit sinks", "sinks", auditSinks)
 
-	fieldKeys := []string{"method"}
-	// Service domain.
-	var service api.Service
-	{
-		service = api.NewFixedService()
-		// Logging now done at endpoint level with trace information
-		// service = api.LoggingMiddleware(logger)(service)
-		service = api.NewInstrumentingService(
-			kitprometheus.NewCounterFrom(
-				stdprometheus.CounterOpts{
-					Namespace: "microservices_demo",
-					Subsystem: "user",
-					Name:      "request_count",
-					Help:      "Number of requests received.",
-				},
-				fieldKeys),
-			kitprometheus.NewSummaryFrom(stdprometheus.SummaryOpts{
-				Namespace: "microservices_demo",
-				Subsystem: "user",
-				Name:      "request_latency_microseconds",
-				Help:      "Total duration of requests in microseconds.",
-			}, fieldKeys),
-			service,
-		)
+	// newService returns the service over the database of a tenant, or of
+	// the default one, issuing tokens with iss
+	newService := func(store db.Database, iss *auth.Issuer) api.Service {
+		// Audits are written to, and credentials checked against, the
+		// primary only, never a stale snapshot
+		primary := store
+		if f, ok := store.(*fallback.Database); ok {
+			primary = f.Database
+		}
+		audit := events.NewFanout(log.With(logger, "component", "audit"), auditWrites)
+		if a, ok := primary.(db.Auditor); ok && auditDB {
+			audit.Add("db", events.NewAuditorSink(a))
+		}
+		if auditStdout != nil {
+			audit.Add("stdout", auditStdout)
+		}
+		if auditWebhooks != nil {
+			audit.Add("webhook", auditWebhooks)
+		}
+		opts := append(serviceOpts[:len(serviceOpts):len(serviceOpts)], api.WithEventSink(audit))
+		if iss != nil {
+			iss.Credentials = api.NewCredentialsCache(primary, credsTTL)
+			opts = append(opts, api.WithTokenIssuer(iss))
+		}
+		service := api.NewFixedService(store, opts...)
+		if coalesceReads {
+			service = api.CoalescingMiddleware(coalesced)(service)
+		}
+		service = api.NewCachingService(service, cacheTTL, cacheEntries, cacheLookups)
+		service = api.LoggingMiddleware(log.With(logger, "component", "service"))(service)
+		service = api.NewInstrumentingService(requestCount, requestLatency, service)
+		if len(emitters) > 0 {
+			service = api.EventsMiddleware(emitters)(service)
+		}
+		return service
 	}
 
 	// Endpoint domain.
-	endpoints := api.MakeEndpoints(service, tracer, logger)
+	panics := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "panics_total",
+		Help:      "Number of panics recovered from endpoints.",
+	}, []string{})
+	endpointMetrics := api.EndpointMetrics{
+		Requests: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "microservices_demo",
+			Subsystem: "user",
+			Name:      "endpoint_requests_total",
+			Help:      "Number of requests served, by endpoint method, status code and status class.",
+		}, []string{"method", "status_code", "status_class"}),
+		Errors: kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+			Namespace: "microservices_demo",
+			Subsystem: "user",
+			Name:      "endpoint_errors_total",
+			Help:      "Number of requests answered with an error, by endpoint method, status code and status class.",
+		}, []string{"method", "status_code", "status_class"}),
+		Duration: kitprometheus.NewHistogramFrom(stdprometheus.HistogramOpts{
+			Namespace: "microservices_demo",
+			Subsystem: "user",
+			Name:      "endpoint_duration_seconds",
+			Help:      "Time taken to serve requests, by endpoint method, status code and status class.",
+			Buckets:   stdprometheus.DefBuckets,
+		}, []string{"method", "status_code", "status_class"}),
+		InFlight: kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+			Namespace: "microservices_demo",
+			Subsystem: "user",
+			Name:      "endpoint_inflight_requests",
+			Help:      "Number of requests being served, by endpoint method.",
+		}, []string{"method"}),
+	}
+	trusted, err := api.ParseCIDRs(trustedProxy)
+	if err != nil {
+		logger.Log("err", err)
+		os.Exit(1)
+	}
+	throttled := kitprometheus.NewCounterFrom(stdprometheus.CounterOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "login_throttled_total",
+		Help:      "Number of credential checks rejected by rate limiting.",
+	}, []string{"key"})
+	var gate api.LoginGate = api.NopLoginGate{}
+	if gateFailures > 0 {
+		if captchaURL == "" {
+			logger.Log("err", "-login-gate-failures requires -captcha-verify-url")
+			os.Exit(1)
+		}
+		secret, err := secretFromEnv("CAPTCHA_SECRET")
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		captcha := api.SiteVerifyCaptcha{URL: captchaURL, Secret: secret}
+		gate = api.NewThresholdGate(gateFailures, gateWindow, captcha)
+	}
+	// Logins are limited per client across tenants
+	limit := api.LoginRateLimit(api.NewRateLimiter(loginRate, loginBurst, loginIdle), trusted, throttled)
+	if exposeCards && issuer == nil {
+		logger.Log("err", "-expose-card-numbers requires a token signing key")
+		os.Exit(1)
+	}
+	// newEndpoints returns the endpoints of service, authenticating tokens
+	// with iss
+	newEndpoints := func(service api.Service, iss *auth.Issuer) api.Endpoints {
+		opts := []api.EndpointsOption{api.WithPanicCounter(panics), api.WithEndpointMetrics(endpointMetrics), api.WithReadyTimeout(readyTimeout), api.WithSlowRequests(slowRequest, kitprometheus.NewCounter(SlowOperations))}
+		if traceUserIDs {
+			opts = append(opts, api.WithUserBaggage())
+		}
+		if apiKeys != nil {
+			opts = append(opts, api.WithImpersonation(apiKeys))
+		}
+		if imperWrites {
+			opts = append(opts, api.WithImpersonatedWrites())
+		}
+		endpoints := api.MakeEndpoints(service, tp.Tracer("github.com/microservices-demo/user/api"), logger, iss, opts...)
+		endpoints.LoginEndpoint = api.LoginGateMiddleware(gate, trusted, gateTimeout)(endpoints.LoginEndpoint)
+		endpoints.LoginEndpoint = limit(endpoints.LoginEndpoint)
+		endpoints.PasswordEndpoint = limit(endpoints.PasswordEndpoint)
+		endpoints.LoginMFAEndpoint = limit(endpoints.LoginMFAEndpoint)
+		endpoints.MFAConfirmEndpoint = limit(endpoints.MFAConfirmEndpoint)
+		endpoints.MFADisableEndpoint = limit(endpoints.MFADisableEndpoint)
+
+		store := api.NewMemoryIdempotencyStore(idemTTL)
+		endpoints.RegisterEndpoint = api.Idempotent(store, iss, "register")(endpoints.RegisterEndpoint)
+		endpoints.UserPostEndpoint = api.Idempotent(store, iss, "customers")(endpoints.UserPostEndpoint)
+		endpoints.AddressPostEndpoint = api.Idempotent(store, iss, "addresses")(endpoints.AddressPostEndpoint)
+		endpoints.CardPostEndpoint = api.Idempotent(store, iss, "cards")(endpoints.CardPostEndpoint)
+		endpoints.CardGetEndpoint = api.MaskCardsForRole(iss, auth.RoleAdmin, adminMaskStyle)(endpoints.CardGetEndpoint)
+		endpoints.UserGetEndpoint = api.MaskCardsForRole(iss, auth.RoleAdmin, adminMaskStyle)(endpoints.UserGetEndpoint)
+		endpoints.LoginEndpoint = api.MaskCardsForRole(iss, auth.RoleAdmin, adminMaskStyle)(endpoints.LoginEndpoint)
+		if exposeCards {
+			endpoints.CardGetEndpoint = api.ExposeCardNumbers(iss)(endpoints.CardGetEndpoint)
+		}
+		return endpoints
+	}
+	endpoints := newEndpoints(newService(store, issuer), issuer)
+
+	// Tenants, each served from a database of its own by endpoints made on
+	// its first request. Requests without X-Tenant-ID keep the default
+	// database.
+	var tenantMiddleware []commonMiddleware.Interface
+	if tenantList != "" {
+		opener, ok := primary.(db.TenantOpener)
+		if !ok {
+			logger.Log("err", fmt.Sprintf("-tenants is not supported by the %v database", database))
+			os.Exit(1)
+		}
+		var names []string
+		for _, t := range strings.Split(tenantList, ",") {
+			if t = strings.TrimSpace(t); t != "" {
+				names = append(names, t)
+			}
+		}
+		tenants, err := api.NewTenants(names, endpoints, func(tenant string) (api.Endpoints, error) {
+			ts, err := opener.ForTenant(tenant)
+			if err != nil {
+				return api.Endpoints{}, err
+			}
+			var iss *auth.Issuer
+			if issuer != nil {
+				iss = issuer.ForTenant(tenant)
+			}
+			logger.Log("msg", "Tenant database opened", "tenant", tenant)
+			return newEndpoints(newService(ts, iss), iss), nil
+		})
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		endpoints = tenants.Endpoints()
+		tenantMiddleware = append(tenantMiddleware, commonMiddleware.Func(tenants.Middleware))
+		logger.Log("msg", "Multi-tenancy enabled", "tenants", strings.Join(names, ","))
+	}
 
 	// HTTP router
-	router := api.MakeHTTPHandler(endpoints, logger, tracer)
+	httpOpts := []api.HTTPOption{api.WithMaxBodySize(maxBodySize)}
+	if apiKeys != nil {
+		httpOpts = append(httpOpts, api.WithLogLevelAdmin(levels, apiKeys))
+	}
+	if cookieMode != "" {
+		if issuer == nil {
+			logger.Log("err", "-session-cookie requires a token signing key")
+			os.Exit(1)
+		}
+		cookie := api.SessionCookie{Mode: cookieMode, Name: cookieName, Domain: cookieDomain, MaxAge: cookieMaxAge}
+		switch cookieSame {
+		case "lax":
+			cookie.SameSite = http.SameSiteLaxMode
+		case "strict":
+			cookie.SameSite = http.SameSiteStrictMode
+		case "none":
+			cookie.SameSite = http.SameSiteNoneMode
+		default:
+			logger.Log("err", fmt.Sprintf("unknown SameSite mode %v", cookieSame))
+			os.Exit(1)
+		}
+		switch cookieMode {
+		case api.CookieModeJWT:
+		case api.CookieModeSession:
+			switch sessionStore {
+			case "memory":
+				cookie.Sessions = auth.NewMemorySessionStore()
+			case "redis":
+				cookie.Sessions = auth.NewRedisSessionStore(redisAddr, redisPassword)
+			default:
+				logger.Log("err", fmt.Sprintf("unknown session store %v", sessionStore))
+				os.Exit(1)
+			}
+		default:
+			logger.Log("err", fmt.Sprintf("unknown session cookie mode %v", cookieMode))
+			os.Exit(1)
+		}
+		httpOpts = append(httpOpts, api.WithSessionCookie(cookie))
+	}
+	router := api.MakeHTTPHandler(endpoints, logger, httpOpts...)
 
+	drainer := api.NewDrainer()
+	shedder := api.NewLoadShedder(map[string]int64{
+		api.ClassRead:  maxReads,
+		api.ClassWrite: maxWrites,
+		api.ClassLogin: maxLogins,
+	}, queueTimeout, kitprometheus.NewGaugeFrom(stdprometheus.GaugeOpts{
+		Namespace: "microservices_demo",
+		Subsystem: "user",
+		Name:      "inflight_requests",
+		Help:      "Number of requests being served, by class: read, write or login.",
+	}, []string{"class"}))
 	httpMiddleware := []commonMiddleware.Interface{
+		commonMiddleware.Func(api.RequestIDMiddleware),
+		commonMiddleware.Func(api.CaptureMiddleware(captureRate, logger)),
+		commonMiddleware.Func(drainer.Middleware),
 		commonMiddleware.Instrument{
 			Duration:         HTTPLatency,
 			InflightRequests: HTTPRequestsInFlight,
@@ -197,23 +1007,331 @@ func main() {
 			ResponseBodySize: HTTPResponseBodySize,
 			RouteMatcher:     router,
 		},
+		commonMiddleware.Func(shedder.Middleware),
 	}
+	httpMiddleware = append(httpMiddleware, tenantMiddleware...)
 
 	// Handler
 	handler := commonMiddleware.Merge(httpMiddleware...).Wrap(router)
 
-	// Create and launch the HTTP server.
-	go func() {
-		logger.Log("transport", "HTTP", "port", port)
-		errc <- http.ListenAndServe(fmt.Sprintf(":%v", port), handler)
-	}()
+	// Create and launch the HTTP server. The port and the socket are held to
+	// the same timeouts, lest a slow client hold a connection forever.
+	apiServer := func(addr string) *http.Server {
+		return &http.Server{
+			Addr:              addr,
+			Handler:           handler,
+			ReadHeaderTimeout: readTimeout,
+			ReadTimeout:       readTimeout,
+			WriteTimeout:      writeTimeout,
+			IdleTimeout:       idleTimeout,
+		}
+	}
+	server := apiServer(fmt.Sprintf(":%v", port))
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		logger.Log("err", "-tls-cert-file and -tls-key-file must be set together")
+		os.Exit(1)
+	}
+	if tlsCertFile != "" {
+		if tlsClientReq && tlsClientCA == "" {
+			logger.Log("err", "-tls-require-client-cert requires -tls-client-ca-file")
+			os.Exit(1)
+		}
+		certs, err := auth.LoadCertificates(tlsCertFile, tlsKeyFile, tlsClientCA)
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		server.TLSConfig = certs.TLSConfig(tlsClientReq)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := certs.Reload(); err != nil {
+					logger.Log("msg", "Certificate reload failed, keeping current certificates", "err", err)
+					continue
+				}
+				logger.Log("msg", "Certificates reloaded")
+			}
+		}()
+	} else if tlsClientCA != "" || tlsClientReq {
+		logger.Log("err", "client certificates require -tls-cert-file")
+		os.Exit(1)
+	}
+	if port == "" && unixSocket == "" {
+		logger.Log("err", "an empty -port requires -listen-unix")
+		os.Exit(1)
+	}
+	var servers []*http.Server
+	if port != "" {
+		servers = append(servers, server)
+		go func() {
+			logger.Log("transport", "HTTP", "port", port, "tls", server.TLSConfig != nil, "client_certs", tlsClientCA != "")
+			if server.TLSConfig != nil {
+				errc <- server.ListenAndServeTLS("", "")
+				return
+			}
+			errc <- server.ListenAndServe()
+		}()
+	}
+	if unixSocket != "" {
+		mode, err := strconv.ParseUint(unixMode, 8, 32)
+		if err != nil {
+			logger.Log("err", fmt.Sprintf("invalid -listen-unix-mode %v", unixMode))
+			os.Exit(1)
+		}
+		ln, err := api.ListenUnix(unixSocket, os.FileMode(mode))
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		// The listener removes the socket when the server shuts down
+		unixServer := apiServer("")
+		unixServer.ConnContext = api.UnixConnContext
+		servers = append(servers, unixServer)
+		go func() {
+			logger.Log("transport", "HTTP", "socket", unixSocket)
+			errc <- unixServer.Serve(ln)
+		}()
+	}
+	if plainPort != "" {
+		plain := http.NewServeMux()
+		plain.Handle("/health", handler)
+		plain.Handle("/health/", handler)
+		plain.Handle("/live", handler)
+		plain.Handle("/ready", handler)
+		plain.Handle("/metrics", handler)
+		plainServer := &http.Server{Addr: fmt.Sprintf(":%v", plainPort), Handler: plain}
+		servers = append(servers, plainServer)
+		go func() {
+			logger.Log("transport", "HTTP", "port", plainPort, "paths", "/health,/live,/ready,/metrics")
+			errc <- plainServer.ListenAndServe()
+		}()
+	}
+	if enablePprof {
+		logger.Log("msg", "WARNING: pprof profiling enabled, profiles and runtime vars expose process internals", "addr", pprofAddr, "api_keys", apiKeys != nil)
+		debugServer := &http.Server{Addr: pprofAddr, Handler: api.MakeDebugHandler(apiKeys)}
+		servers = append(servers, debugServer)
+		go func() {
+			logger.Log("transport", "HTTP", "addr", pprofAddr, "paths", "/debug/pprof/,/debug/vars")
+			errc <- debugServer.ListenAndServe()
+		}()
+	}
+	var grpcServer *grpc.Server
+	if grpcPort != "" {
+		grpcOpts := []grpc.ServerOption{grpc.UnaryInterceptor(shedder.UnaryInterceptor())}
+		if server.TLSConfig != nil {
+			grpcOpts = append(grpcOpts, grpc.Creds(credentials.NewTLS(server.TLSConfig)))
+		}
+		grpcServer = grpc.NewServer(grpcOpts...)
+		pb.RegisterUserServer(grpcServer, api.MakeGRPCServer(endpoints, logger))
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%v", grpcPort))
+		if err != nil {
+			logger.Log("err", err)
+			os.Exit(1)
+		}
+		go func() {
+			logger.Log("transport", "gRPC", "port", grpcPort, "tls", server.TLSConfig != nil)
+			errc <- grpcServer.Serve(ln)
+		}()
+	}
 
-	// Capture interrupts.
-	go func() {
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-		errc <- fmt.Errorf("%s", <-c)
-	}()
+	// Capture interrupts, then drain the servers and close the database.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-errc:
+		logger.Log("exit", err)
+	case s := <-sig:
+		logger.Log("msg", "Shutting down", "signal", s, "delay", shutdownDelay, "timeout", shutdownWait)
+		// Fail readiness while still serving, so load balancers stop
+		// routing before the servers stop accepting connections
+		drainer.Drain()
+		stopBackground()
+		time.Sleep(shutdownDelay)
+		deadline := time.Now().Add(shutdownWait)
+		grpcDone := make(chan struct{})
+		go func() {
+			if grpcServer != nil {
+				grpcServer.GracefulStop()
+			}
+			close(grpcDone)
+		}()
+		if err := drainer.Shutdown(shutdownWait, servers...); err != nil {
+			logger.Log("msg", "Shutdown incomplete", "err", err)
+		}
+		select {
+		case <-grpcDone:
+		case <-time.After(time.Until(deadline)):
+			if grpcServer != nil {
+				grpcServer.Stop()
+			}
+		}
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		if webhooks != nil {
+			if err := webhooks.Close(ctx); err != nil {
+				logger.Log("msg", "Pending webhook deliveries abandoned", "err", err)
+			}
+		}
+		if broker != nil {
+			if err := broker.Close(ctx); err != nil {
+				logger.Log("msg", "Pending events abandoned", "err", err)
+			}
+		}
+		if auditWebhooks != nil {
+			if err := auditWebhooks.Close(ctx); err != nil {
+				logger.Log("msg", "Pending audit webhook deliveries abandoned", "err", err)
+			}
+		}
+		cancel()
+		if c, ok := store.(db.Closer); ok {
+			if err := c.Close(); err != nil {
+				logger.Log("msg", "Closing the database failed", "err", err)
+			}
+		}
+		logger.Log("exit", s)
+	}
+}
+
+// secretFromEnv returns the contents of the file named by env+"_FILE", as
+// mounted by Docker and Kubernetes secrets, with trailing newlines trimmed.
+// When that is unset it falls back to env itself.
+func secretFromEnv(env string) (string, error) {
+	file := os.Getenv(env + "_FILE")
+	if file == "" {
+		return os.Getenv(env), nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// tracingConfig selects and configures the exporters of the spans
+type tracingConfig struct {
+	// backend is otlp, zipkin, jaeger or none; empty for every exporter
+	// configured
+	backend        string
+	zipkinURL      string
+	jaegerEndpoint string
+}
+
+// newTracerProvider returns the tracer provider of the service, the function
+// flushing its spans on shutdown and the names of the exporters it sends
+// spans to.
+//
+// With no backend selected, spans are exported over OTLP when one of the
+// standard OTEL_EXPORTER_OTLP_*ENDPOINT variables or OTEL_TRACES_EXPORTER=otlp
+// is set, by gRPC or HTTP as OTEL_EXPORTER_OTLP_[TRACES_]PROTOCOL says, to
+// the Zipkin collector at zipkinURL and to the Jaeger collector at
+// jaegerEndpoint, all at once during a migration. A backend selects its exporter
+// alone. The none backend, or OTEL_TRACES_EXPORTER=none, returns a no-op
+// provider.
+func newTracerProvider(ctx context.Context, cfg tracingConfig) (trace.TracerProvider, func(context.Context) error, []string, error) {
+	if cfg.backend == "none" || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return noop.NewTracerProvider(), func(context.Context) error { return nil }, nil, nil
+	}
+	res, err := sdkresource.Merge(
+		sdkresource.Default(),
+		sdkresource.NewSchemaless(semconv.ServiceName(ServiceName)),
+	)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	if res, err = sdkresource.Merge(res, sdkresource.Environment()); err != nil {
+		return nil, nil, nil, err
+	}
+	opts := []sdktrace.TracerProviderOption{sdktrace.WithResource(res)}
+	var names []string
+	add := func(name string, exporter sdktrace.SpanExporter) {
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+		names = append(names, name)
+	}
+
+	switch cfg.backend {
+	case "":
+		if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != "" ||
+			os.Getenv("OTEL_TRACES_EXPORTER") == "otlp" {
+			name, exporter, err := otlpExporter(ctx)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			add(name, exporter)
+		}
+		if cfg.zipkinURL != "" {
+			exporter, err := zipkin.New(cfg.zipkinURL)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			add("zipkin", exporter)
+		}
+		if cfg.jaegerEndpoint != "" {
+			exporter, err := jaegerExporter(ctx, cfg.jaegerEndpoint)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+			add("jaeger", exporter)
+		}
+	case "otlp":
+		name, exporter, err := otlpExporter(ctx)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		add(name, exporter)
+	case "zipkin":
+		if cfg.zipkinURL == "" {
+			return nil, nil, nil, errors.New("the zipkin tracer needs the -zipkin collector URL")
+		}
+		exporter, err := zipkin.New(cfg.zipkinURL)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		add("zipkin", exporter)
+	case "jaeger":
+		exporter, err := jaegerExporter(ctx, cfg.jaegerEndpoint)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		add("jaeger", exporter)
+	default:
+		return nil, nil, nil, fmt.Errorf("unknown tracer %q, expected otlp, zipkin, jaeger or none", cfg.backend)
+	}
+	tp := sdktrace.NewTracerProvider(opts...)
+	return tp, tp.Shutdown, names, nil
+}
 
-	logger.Log("exit", <-errc)
+// otlpExporter returns the OTLP exporter configured by the standard
+// OTEL_EXPORTER_OTLP_* variables, and its name
+func otlpExporter(ctx context.Context) (string, sdktrace.SpanExporter, error) {
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch protocol {
+	case "grpc":
+		exporter, err = otlptracegrpc.New(ctx)
+	case "", "http/protobuf":
+		protocol = "http/protobuf"
+		exporter, err = otlptracehttp.New(ctx)
+	default:
+		err = fmt.Errorf("unsupported OTLP protocol %q", protocol)
+	}
+	return "otlp/" + protocol, exporter, err
+}
+
+// defaultJaegerEndpoint is where a local Jaeger collector receives OTLP
+// over HTTP
+const defaultJaegerEndpoint = "http://localhost:4318/v1/traces"
+
+// jaegerExporter returns an exporter to the Jaeger collector at endpoint,
+// defaultJaegerEndpoint when empty, over OTLP, which Jaeger accepts natively
+// since the Jaeger exporter was deprecated
+func jaegerExporter(ctx context.Context, endpoint string) (sdktrace.SpanExporter, error) {
+	if endpoint == "" {
+		endpoint = defaultJaegerEndpoint
+	}
+	return otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
 }
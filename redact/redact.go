@@ -0,0 +1,235 @@
+// Package redact keeps sensitive values out of logs and spans: passwords,
+// secrets and tokens are never written, card and phone numbers only masked,
+// and emails and usernames as the policy of the process allows.
+package redact
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/microservices-demo/user/users"
+)
+
+// Redacted replaces values that are never written
+const Redacted = "[REDACTED]"
+
+// maxDepth bounds the nesting Sprint follows, against cycles
+const maxDepth = 8
+
+// Policy holds what may be written of the personal data that is not
+// secret
+type Policy struct {
+	// MaskEmails partially redacts emails, keeping their first letter and
+	// domain
+	MaskEmails bool
+	// TagUsernames allows usernames as span tags
+	TagUsernames bool
+}
+
+var policy atomic.Value
+
+func init() {
+	policy.Store(Policy{})
+}
+
+// SetPolicy makes p the policy of the process
+func SetPolicy(p Policy) {
+	policy.Store(p)
+}
+
+func current() Policy {
+	return policy.Load().(Policy)
+}
+
+// Email returns e as it may be written: partially redacted, like
+// j***@example.com, when the policy masks emails
+func Email(e string) string {
+	if !current().MaskEmails || e == "" {
+		return e
+	}
+	if strings.LastIndex(e, "@") <= 0 {
+		return Redacted
+	}
+	return users.MaskEmail(e)
+}
+
+// Usernames reports whether usernames may be set as span tags
+func Usernames() bool {
+	return current().TagUsernames
+}
+
+// field returns how the field named name is written: redacted, masked or as
+// is. The names are those of the request and entity types of the service.
+func field(name string) func(string) string {
+	n := strings.ToLower(name)
+	switch {
+	case strings.Contains(n, "password"), strings.Contains(n, "secret"), strings.Contains(n, "token"),
+		n == "code", n == "ccv", n == "cvv", n == "salt":
+		return func(string) string { return Redacted }
+	case n == "longnum", n == "cardnumber":
+		return users.MaskNumber
+	case n == "phone":
+		return func(p string) string { return users.MaskNumberStyle(p, users.MaskLast4) }
+	case n == "email":
+		return Email
+	}
+	return nil
+}
+
+// Sprint formats v like fmt's %+v, with the fields holding sensitive values
+// redacted or masked wherever they are nested
+func Sprint(v interface{}) string {
+	var b strings.Builder
+	format(&b, reflect.ValueOf(v), 0)
+	return b.String()
+}
+
+func format(b *strings.Builder, v reflect.Value, depth int) {
+	if depth > maxDepth {
+		b.WriteString("...")
+		return
+	}
+	if !v.IsValid() {
+		b.WriteString("<nil>")
+		return
+	}
+	if v.CanInterface() && v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface {
+		switch s := v.Interface().(type) {
+		case error:
+			b.WriteString(s.Error())
+			return
+		case fmt.Stringer:
+			b.WriteString(s.String())
+			return
+		}
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			b.WriteString("<nil>")
+			return
+		}
+		format(b, v.Elem(), depth+1)
+	case reflect.Struct:
+		b.WriteString("{")
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			b.WriteString(t.Field(i).Name)
+			b.WriteString(":")
+			formatField(b, t.Field(i).Name, v.Field(i), depth+1)
+		}
+		b.WriteString("}")
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			b.WriteString("[]")
+			return
+		}
+		b.WriteString("[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			format(b, v.Index(i), depth+1)
+		}
+		b.WriteString("]")
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j]) })
+		b.WriteString("map[")
+		for i, k := range keys {
+			if i > 0 {
+				b.WriteString(" ")
+			}
+			format(b, k, depth+1)
+			b.WriteString(":")
+			formatField(b, fmt.Sprint(k), v.MapIndex(k), depth+1)
+		}
+		b.WriteString("]")
+	case reflect.String:
+		b.WriteString(v.String())
+	case reflect.Bool:
+		fmt.Fprint(b, v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprint(b, v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		fmt.Fprint(b, v.Uint())
+	case reflect.Float32, reflect.Float64:
+		fmt.Fprint(b, v.Float())
+	default:
+		fmt.Fprintf(b, "<%v>", v.Type())
+	}
+}
+
+// formatField formats the value v of the field or map key named name,
+// redacting or masking it when the name says it is sensitive
+func formatField(b *strings.Builder, name string, v reflect.Value, depth int) {
+	f := field(name)
+	if f == nil {
+		format(b, v, depth)
+		return
+	}
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			b.WriteString("<nil>")
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.String {
+		b.WriteString(f(v.String()))
+		return
+	}
+	// Anything else under a sensitive name, such as a hash, is never written
+	b.WriteString(Redacted)
+}
+
+// JSON returns the JSON document data with the values of sensitive members
+// redacted or masked, as Sprint does with fields, wherever they are nested.
+// It fails when data is not a single JSON document.
+func JSON(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, errors.New("trailing data after the JSON document")
+	}
+	return json.Marshal(redactJSON(v, 0))
+}
+
+// redactJSON redacts the members of the decoded JSON value v
+func redactJSON(v interface{}, depth int) interface{} {
+	if depth > maxDepth {
+		return "..."
+	}
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			f := field(k)
+			switch s, ok := e.(string); {
+			case f == nil:
+				t[k] = redactJSON(e, depth+1)
+			case ok:
+				t[k] = f(s)
+			case e != nil:
+				t[k] = Redacted
+			}
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = redactJSON(e, depth+1)
+		}
+	}
+	return v
+}
@@ -0,0 +1,68 @@
+package redact
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/microservices-demo/user/users"
+)
+
+func TestSprint(t *testing.T) {
+	defer SetPolicy(Policy{})
+	type request struct {
+		users.User
+		CurrentPassword string
+		Extra           map[string]interface{}
+		Hash            []byte
+	}
+	v := &request{
+		User: users.User{
+			Username: "eve",
+			Password: "hunter22",
+			Salt:     "pepper",
+			Email:    "eve@example.com",
+			Phone:    "+14155550123",
+			Cards:    []users.Card{{LongNum: "4111111111111111", CCV: "958"}},
+		},
+		CurrentPassword: "old-hunter",
+		Extra:           map[string]interface{}{"refreshToken": "rt-secret", "note": "kept"},
+	}
+
+	got := Sprint(v)
+	for _, secret := range []string{"hunter22", "pepper", "4111111111111111", "958", "old-hunter", "rt-secret", "+14155550123"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("Expected %q redacted, received %v", secret, got)
+		}
+	}
+	for _, want := range []string{"Username:eve", "************1111", "Phone:********0123", "note:kept", "eve@example.com"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("Expected %q kept, received %v", want, got)
+		}
+	}
+
+	SetPolicy(Policy{MaskEmails: true})
+	if got := Sprint(v); strings.Contains(got, "eve@example.com") || !strings.Contains(got, "e***@example.com") {
+		t.Errorf("Expected the email masked, received %v", got)
+	}
+	if got := Email("not-an-email"); got != Redacted {
+		t.Errorf("Expected a malformed email redacted, received %v", got)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	got, err := JSON([]byte(`{"username": "eve", "password": "hunter22", "cards": [{"longNum": "4111111111111111", "ccv": 958}], "n": 12345678901234567890}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"username":"eve"`, `"password":"[REDACTED]"`, `"ccv":"[REDACTED]"`, `"n":12345678901234567890`} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("Expected %v in %s", want, got)
+		}
+	}
+	if strings.Contains(string(got), "hunter22") || strings.Contains(string(got), "4111111111111111") {
+		t.Errorf("Expected secrets and card numbers left out, received %s", got)
+	}
+	if _, err := JSON([]byte(`{"password": "hunter22"`)); err == nil {
+		t.Error("Expected a truncated document refused")
+	}
+}
@@ -1,5 +1,23 @@
 package users
 
+import "strings"
+
+// Types of addresses, telling the checkout which to prefill where
+const (
+	AddressShipping = "shipping"
+	AddressBilling  = "billing"
+	AddressOther    = "other"
+)
+
+// ValidAddressType reports whether t is one of the address types
+func ValidAddressType(t string) bool {
+	switch t {
+	case AddressShipping, AddressBilling, AddressOther:
+		return true
+	}
+	return false
+}
+
 type Address struct {
 	Street   string `json:"street" bson:"street,omitempty"`
 	Number   string `json:"number" bson:"number,omitempty"`
@@ -8,8 +26,32 @@ type Address struct {
 	PostCode string `json:"postcode" bson:"postcode,omitempty"`
 	ID       string `json:"id" bson:"-"`
 	Links    Links  `json:"_links"`
+	// Type is AddressShipping, AddressBilling or AddressOther
+	Type string `json:"type" bson:"type,omitempty"`
+	// Guest is the hash of the guest session the address was posted in,
+	// without a customer, which linking it to one requires
+	Guest string `json:"-" bson:"guest,omitempty"`
+}
+
+// Clone returns a copy of a sharing no links with it
+func (a Address) Clone() Address {
+	a.Links = a.Links.Clone()
+	return a
 }
 
 func (a *Address) AddLinks() {
 	a.Links.AddAddress(a.ID)
 }
+
+// Normalize puts the fields of a in the form they are stored and compared in.
+// An address without a type is a shipping address.
+func (a *Address) Normalize() {
+	a.Type = strings.ToLower(strings.TrimSpace(a.Type))
+	if a.Type == "" {
+		a.Type = AddressShipping
+	}
+	a.Country, _ = NormalizeCountry(a.Country)
+	if a.PostCode != "" {
+		a.PostCode = NormalizePostCode(a.Country, a.PostCode)
+	}
+}
@@ -15,3 +15,73 @@ func TestAddLinksAdd(t *testing.T) {
 	}
 
 }
+
+func TestNormalizeCountry(t *testing.T) {
+	for in, want := range map[string]string{
+		"GB":                "GB",
+		"gb":                "GB",
+		"UK":                "GB",
+		"United Kingdom":    "GB",
+		" united  kingdom ": "GB",
+		"Deutschland":       "DE",
+		"us":                "US",
+	} {
+		if got, ok := NormalizeCountry(in); !ok || got != want {
+			t.Errorf("Expected %v for %q, received %v %v", want, in, got, ok)
+		}
+	}
+	for _, in := range []string{"Atlantis", "XX", "", "G B"} {
+		if got, ok := NormalizeCountry(in); ok || got != in {
+			t.Errorf("Expected %q unknown and kept, received %v %v", in, got, ok)
+		}
+	}
+	a := Address{Street: "High Street", City: "London", Country: "england"}
+	a.Normalize()
+	if a.Country != "GB" {
+		t.Errorf("Expected the country normalized, received %v", a.Country)
+	}
+	a.Country = "Atlantis"
+	if fe, ok := a.Validate().(FieldErrors); !ok || len(fe) != 1 || fe[0].Field != "country" {
+		t.Errorf("Expected the country refused, received %v", a.Validate())
+	}
+}
+
+func TestPostCode(t *testing.T) {
+	for _, c := range []struct {
+		country, code, want string
+	}{
+		{"GB", "sw1a1aa", "SW1A 1AA"},
+		{"United Kingdom", " m1  1ae ", "M1 1AE"},
+		{"US", "94105", "94105"},
+		{"US", "94105 1234", "94105-1234"},
+		{"NL", "1012ab", "1012 AB"},
+		{"CA", "k1a0b1", "K1A 0B1"},
+		{"GB", "asdf", "ASDF"},
+		{"BE", " b-1000  x ", "B-1000 X"},
+	} {
+		if got := NormalizePostCode(c.country, c.code); got != c.want {
+			t.Errorf("Expected %q for %q in %v, received %q", c.want, c.code, c.country, got)
+		}
+	}
+	for _, c := range []struct {
+		country, code string
+		valid         bool
+	}{
+		{"GB", "SW1A 1AA", true},
+		{"GB", "ASDF", false},
+		{"US", "94105-1234", true},
+		{"US", "9410", false},
+		{"DE", "10115", true},
+		{"FR", "7500", false},
+		{"AU", "2000", true},
+		{"CA", "K1A 0B1", true},
+		{"NL", "1012", false},
+		{"BE", "1000", true},
+		{"BE", "$gt", false},
+	} {
+		a := Address{Street: "Main Street", City: "City", Country: c.country, PostCode: c.code}
+		if err := a.Validate(); (err == nil) != c.valid {
+			t.Errorf("Expected %q in %v valid %v, received %v", c.code, c.country, c.valid, err)
+		}
+	}
+}
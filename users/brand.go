@@ -0,0 +1,62 @@
+package users
+
+// brand.go tells the brand of a card from the leading digits of its number,
+// so clients can show a badge without the BIN tables.
+
+import "strconv"
+
+// Card brands
+const (
+	BrandVisa       = "visa"
+	BrandMastercard = "mastercard"
+	BrandAmex       = "amex"
+	BrandDiscover   = "discover"
+	BrandDiners     = "diners"
+	BrandJCB        = "jcb"
+	BrandUnknown    = "unknown"
+)
+
+// BrandRange gives Brand to the numbers whose first Digits digits lie
+// between From and To, inclusive
+type BrandRange struct {
+	Brand  string
+	Digits int
+	From   int
+	To     int
+}
+
+// BrandRanges are the ranges DetectBrand looks numbers up in, in order, the
+// first matching range giving the brand. Add a brand with its ranges here.
+var BrandRanges = []BrandRange{
+	{BrandVisa, 1, 4, 4},
+	{BrandMastercard, 2, 51, 55},
+	{BrandMastercard, 4, 2221, 2720},
+	{BrandAmex, 2, 34, 34},
+	{BrandAmex, 2, 37, 37},
+	{BrandDiscover, 4, 6011, 6011},
+	{BrandDiscover, 3, 644, 649},
+	{BrandDiscover, 2, 65, 65},
+	{BrandDiners, 3, 300, 305},
+	{BrandDiners, 2, 36, 36},
+	{BrandDiners, 2, 38, 39},
+	{BrandJCB, 4, 3528, 3589},
+}
+
+// DetectBrand returns the brand of the card number n, normalized first, or
+// BrandUnknown when no range matches it
+func DetectBrand(n string) string {
+	n = NormalizeCardNumber(n)
+	for _, r := range BrandRanges {
+		if len(n) < r.Digits {
+			continue
+		}
+		prefix, err := strconv.Atoi(n[:r.Digits])
+		if err != nil {
+			continue
+		}
+		if prefix >= r.From && prefix <= r.To {
+			return r.Brand
+		}
+	}
+	return BrandUnknown
+}
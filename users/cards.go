@@ -1,23 +1,186 @@
 package users
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"sync/atomic"
 )
 
 type Card struct {
 	LongNum string `json:"longNum" bson:"longNum"`
 	Expires string `json:"expires" bson:"expires"`
 	CCV     string `json:"ccv" bson:"ccv"`
-	ID      string `json:"id" bson:"-"`
-	Links   Links  `json:"_links" bson:"-"`
+	// Brand is that of DetectBrand, set when the card is stored
+	Brand string `json:"brand" bson:"brand"`
+	ID    string `json:"id" bson:"-"`
+	Links Links  `json:"_links" bson:"-"`
+	// Label is the nickname the customer told the card apart by, up to
+	// MaxLabelLength characters, empty when not given
+	Label string `json:"label" bson:"label,omitempty"`
+	// Default marks the card checkouts charge, among the cards of a
+	// customer; it is kept on the customer, as its DefaultCard
+	Default bool `json:"default,omitempty" bson:"-"`
+	// Guest is the hash of the guest session the card was posted in,
+	// without a customer, which linking it to one requires
+	Guest string `json:"-" bson:"guest,omitempty"`
+
+	// mask is the style MarshalJSON masks LongNum with, the default when
+	// unset
+	mask MaskStyle
+}
+
+// Clone returns a copy of c sharing no links with it
+func (c Card) Clone() Card {
+	c.Links = c.Links.Clone()
+	return c
 }
 
 func (c *Card) MaskCC() {
-	l := len(c.LongNum) - 4
-	c.LongNum = fmt.Sprintf("%v%v", strings.Repeat("*", l), c.LongNum[l:])
+	c.LongNum = MaskNumber(c.LongNum)
+}
+
+// MaskCCStyle masks the card number with style s rather than the default
+func (c *Card) MaskCCStyle(s MaskStyle) {
+	c.LongNum = MaskNumberStyle(c.LongNum, s)
+}
+
+// WithMaskStyle returns c marshalling its number masked with style s rather
+// than the default
+func (c Card) WithMaskStyle(s MaskStyle) Card {
+	c.mask = s
+	return c
+}
+
+// MaskStyle is how much of a card number masking leaves readable. The zero
+// MaskStyle stands for the default of SetMaskStyle.
+type MaskStyle int32
+
+// Mask styles
+const (
+	// MaskLast4 leaves the last four digits, for customers
+	MaskLast4 MaskStyle = iota + 1
+	// MaskBin6Last4 also leaves the first six, the issuer identification
+	// number, for internal views
+	MaskBin6Last4
+)
+
+var maskStyles = map[string]MaskStyle{"last4": MaskLast4, "bin6last4": MaskBin6Last4}
+
+// ParseMaskStyle returns the style named name, last4 or bin6last4
+func ParseMaskStyle(name string) (MaskStyle, error) {
+	s, ok := maskStyles[strings.ToLower(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown card mask style %q, expected last4 or bin6last4", name)
+	}
+	return s, nil
+}
+
+// defaultMaskStyle is the style of MaskNumber and MarshalJSON
+var defaultMaskStyle atomic.Int32
+
+func init() {
+	defaultMaskStyle.Store(int32(MaskLast4))
+}
+
+// SetMaskStyle sets the style card numbers are masked with unless one is
+// given, MaskLast4 to begin with
+func SetMaskStyle(s MaskStyle) {
+	if s != 0 {
+		defaultMaskStyle.Store(int32(s))
+	}
+}
+
+// DefaultMaskStyle returns the style set by SetMaskStyle
+func DefaultMaskStyle() MaskStyle {
+	return MaskStyle(defaultMaskStyle.Load())
+}
+
+// MaskNumber masks a card number with the default style
+func MaskNumber(n string) string {
+	return MaskNumberStyle(n, DefaultMaskStyle())
+}
+
+// MaskNumberStyle masks a card number with style s, the default if zero.
+// MaskLast4 replaces all but the last four digits, masking numbers of four
+// digits or less entirely. MaskBin6Last4 leaves the first six digits too, on
+// numbers of at least 12 digits, the shortest card numbers: shorter ones
+// would be left mostly readable, so they are masked entirely.
+func MaskNumberStyle(n string, s MaskStyle) string {
+	if s == 0 {
+		s = DefaultMaskStyle()
+	}
+	if s == MaskBin6Last4 {
+		if len(n) < 12 {
+			return strings.Repeat("*", len(n))
+		}
+		return n[:6] + strings.Repeat("*", len(n)-10) + n[len(n)-4:]
+	}
+	l := len(n) - 4
+	if l <= 0 {
+		return strings.Repeat("*", len(n))
+	}
+	return fmt.Sprintf("%v%v", strings.Repeat("*", l), n[l:])
 }
 
+// MarshalJSON masks the card number, so a stored number can never be read
+// back through any response that embeds a Card.
+func (c Card) MarshalJSON() ([]byte, error) {
+	type card Card
+	m := card(c)
+	m.LongNum = MaskNumberStyle(c.LongNum, c.mask)
+	return json.Marshal(m)
+}
+
+// UnmaskedCard serialises with the full card number. It is only for the
+// payment integration and must never be returned to customers.
+type UnmaskedCard Card
+
 func (c *Card) AddLinks() {
 	c.Links.AddCard(c.ID)
 }
+
+// luhnCheck is whether Validate verifies the checksum of card numbers
+var luhnCheck atomic.Bool
+
+func init() {
+	luhnCheck.Store(true)
+}
+
+// SetLuhnCheck turns the checksum verification of card numbers on or off,
+// for demo environments using made up numbers. The length and digits of
+// numbers are checked regardless.
+func SetLuhnCheck(enabled bool) {
+	luhnCheck.Store(enabled)
+}
+
+// NormalizeCardNumber strips the spaces and dashes card numbers are written
+// with, as in 4111 1111 1111 1111
+func NormalizeCardNumber(n string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(n)
+}
+
+// Normalize puts the card number in the form it is stored and compared in,
+// and trims the label
+func (c *Card) Normalize() {
+	c.LongNum = NormalizeCardNumber(c.LongNum)
+	c.Label = strings.TrimSpace(c.Label)
+}
+
+// Luhn reports whether the digits of n pass the Luhn checksum card numbers
+// carry in their last digit. n must only hold digits.
+func Luhn(n string) bool {
+	sum := 0
+	double := false
+	for i := len(n) - 1; i >= 0; i-- {
+		d := int(n[i] - '0')
+		if double {
+			if d *= 2; d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return n != "" && sum%10 == 0
+}
@@ -1,7 +1,9 @@
 package users
 
 import (
+	"encoding/json"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -25,3 +27,134 @@ func TestMaskCC(t *testing.T) {
 		t.Errorf("Expected matching CC number %v received %v", test1comp, test1)
 	}
 }
+
+func TestMaskNumberShort(t *testing.T) {
+	for n, want := range map[string]string{"": "", "123": "***", "1234": "****", "12345": "*2345"} {
+		if got := MaskNumber(n); got != want {
+			t.Errorf("Expected %q for %q, received %q", want, n, got)
+		}
+	}
+}
+
+func TestCardMarshalJSONMasks(t *testing.T) {
+	c := Card{LongNum: "4111111111111111", Expires: "01/30", ID: "id"}
+	b, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "4111111111111111") || !strings.Contains(string(b), `"longNum":"************1111"`) {
+		t.Errorf("Expected masked number, received %s", b)
+	}
+	if c.LongNum != "4111111111111111" {
+		t.Error("Expected marshalling to leave the card untouched")
+	}
+	b, _ = json.Marshal(UnmaskedCard(c))
+	if !strings.Contains(string(b), "4111111111111111") {
+		t.Errorf("Expected full number from UnmaskedCard, received %s", b)
+	}
+}
+
+func TestCardNumberChecks(t *testing.T) {
+	fields := func(err error) string {
+		fe, _ := err.(FieldErrors)
+		var got []string
+		for _, f := range fe {
+			got = append(got, f.Field+":"+f.Code)
+		}
+		return strings.Join(got, ",")
+	}
+	c := Card{LongNum: " 4111 1111-1111 1111 "}
+	c.Normalize()
+	if c.LongNum != "4111111111111111" {
+		t.Errorf("Expected spaces and dashes stripped, received %q", c.LongNum)
+	}
+	for num, want := range map[string]bool{"4111111111111111": true, "5500005555555559": true, "4111111111111112": false, "0": true} {
+		if got := Luhn(num); got != want {
+			t.Errorf("Luhn(%v): expected %v, received %v", num, want, got)
+		}
+	}
+
+	c = Card{LongNum: "4111111111111112"}
+	if got := fields(c.Validate()); got != "longNum:invalid" {
+		t.Errorf("Expected a failed checksum refused, received %v", got)
+	}
+	SetLuhnCheck(false)
+	defer SetLuhnCheck(true)
+	if err := c.Validate(); err != nil {
+		t.Errorf("Expected the checksum skipped, received %v", err)
+	}
+	c = Card{LongNum: "1234"}
+	if got := fields(c.Validate()); got != "longNum:invalid" {
+		t.Errorf("Expected the length checked without checksum, received %v", got)
+	}
+}
+
+func TestDetectBrand(t *testing.T) {
+	cases := []struct {
+		number string
+		brand  string
+	}{
+		{"4111111111111111", BrandVisa},
+		{"4111 1111 1111 1111", BrandVisa},
+		{"5555555555554444", BrandMastercard},
+		{"2221000000000009", BrandMastercard},
+		{"2720990000000007", BrandMastercard},
+		{"378282246310005", BrandAmex},
+		{"341111111111111", BrandAmex},
+		{"6011111111111117", BrandDiscover},
+		{"6445644564456445", BrandDiscover},
+		{"6500000000000002", BrandDiscover},
+		{"30569309025904", BrandDiners},
+		{"36227206271667", BrandDiners},
+		{"38520000023237", BrandDiners},
+		{"3530111333300000", BrandJCB},
+		{"3589000000000000", BrandJCB},
+		{"2721000000000000", BrandUnknown},
+		{"9111111111111111", BrandUnknown},
+		{"", BrandUnknown},
+	}
+	for _, c := range cases {
+		if b := DetectBrand(c.number); b != c.brand {
+			t.Errorf("Expected brand %v of %v, received %v", c.brand, c.number, b)
+		}
+	}
+}
+
+func TestMaskNumberStyle(t *testing.T) {
+	cases := []struct {
+		number string
+		style  MaskStyle
+		want   string
+	}{
+		{"4111111111111111", MaskLast4, "************1111"},
+		{"4111111111111111", MaskBin6Last4, "411111******1111"},
+		{"378282246310005", MaskBin6Last4, "378282*****0005"},
+		{"411111111111", MaskBin6Last4, "411111**1111"},
+		{"41111111111", MaskBin6Last4, "***********"},
+		{"123", MaskBin6Last4, "***"},
+		{"", MaskBin6Last4, ""},
+		{"4111111111111111", 0, "************1111"},
+	}
+	for _, c := range cases {
+		if got := MaskNumberStyle(c.number, c.style); got != c.want {
+			t.Errorf("Expected %q for %q in style %v, received %q", c.want, c.number, c.style, got)
+		}
+	}
+
+	defer SetMaskStyle(DefaultMaskStyle())
+	SetMaskStyle(MaskBin6Last4)
+	b, err := json.Marshal(Card{LongNum: "4111111111111111"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"longNum":"411111******1111"`) {
+		t.Errorf("Expected the default style in JSON, received %s", b)
+	}
+	b, _ = json.Marshal(Card{LongNum: "4111111111111111"}.WithMaskStyle(MaskLast4))
+	if !strings.Contains(string(b), `"longNum":"************1111"`) {
+		t.Errorf("Expected the style of the card over the default, received %s", b)
+	}
+	if _, err := ParseMaskStyle("first4"); err == nil {
+		t.Error("Expected an unknown style refused")
+	}
+}
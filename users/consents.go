@@ -0,0 +1,153 @@
+package users
+
+// consents.go records the consents of customers to be contacted for
+// marketing, as the GDPR asks: each change is appended to a history, with
+// when and through what it was given, and never overwritten. The current
+// consents are read from the history.
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Channels customers consent to be contacted through
+const (
+	ConsentEmail = "email"
+	ConsentSMS   = "sms"
+	ConsentPhone = "phone"
+	ConsentPost  = "post"
+)
+
+// ConsentChannels are the channels of consents
+var ConsentChannels = []string{ConsentEmail, ConsentSMS, ConsentPhone, ConsentPost}
+
+// MaxConsentSourceLength caps the source of consents, in characters
+const MaxConsentSourceLength = 64
+
+// ConsentSourceRegistration is the source of the consents given at
+// registration
+const ConsentSourceRegistration = "registration"
+
+// Consent is the current consent of a user to a channel. A channel never
+// consented to is not granted, and has no time nor source.
+type Consent struct {
+	Granted bool       `json:"granted"`
+	At      *time.Time `json:"at,omitempty"`
+	Source  string     `json:"source,omitempty"`
+}
+
+// ConsentRecord is an entry of the consent history of a user: the consent
+// to Channel granted or withdrawn At, through Source, as the form or the
+// page it was given on
+type ConsentRecord struct {
+	Channel string    `json:"channel" bson:"channel"`
+	Granted bool      `json:"granted" bson:"granted"`
+	At      time.Time `json:"at" bson:"at"`
+	Source  string    `json:"source" bson:"source"`
+}
+
+// ConsentTally counts the grants and withdrawals of the consent to Channel
+// of a user, all that is kept of its history once the user is anonymized
+type ConsentTally struct {
+	Channel     string `json:"channel" bson:"channel"`
+	Grants      int    `json:"grants" bson:"grants"`
+	Withdrawals int    `json:"withdrawals" bson:"withdrawals"`
+}
+
+// ConsentState is the current consent of a user to each channel, with the
+// history it is read from
+type ConsentState struct {
+	Consents map[string]Consent `json:"consents"`
+	History  []ConsentRecord    `json:"history"`
+}
+
+// ConsentState returns the consents of u
+func (u User) ConsentState() ConsentState {
+	history := append([]ConsentRecord{}, u.ConsentHistory...)
+	return ConsentState{Consents: CurrentConsents(history), History: history}
+}
+
+// ValidConsentChannel reports whether channel is one of ConsentChannels
+func ValidConsentChannel(channel string) bool {
+	for _, c := range ConsentChannels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// CurrentConsents returns the consent to every channel the history leaves,
+// the last record of a channel winning
+func CurrentConsents(history []ConsentRecord) map[string]Consent {
+	cs := make(map[string]Consent, len(ConsentChannels))
+	for _, c := range ConsentChannels {
+		cs[c] = Consent{}
+	}
+	for _, r := range history {
+		at := r.At
+		cs[r.Channel] = Consent{Granted: r.Granted, At: &at, Source: r.Source}
+	}
+	return cs
+}
+
+// NewConsentRecords returns the records of the consents changed to the
+// values of consents, through source at at, in the order of the channels,
+// or FieldErrors when there are none, a channel is unknown or the source
+// missing or too long
+func NewConsentRecords(consents map[string]bool, source string, at time.Time) ([]ConsentRecord, error) {
+	var e FieldErrors
+	if len(consents) == 0 {
+		e = append(e, FieldError{Field: "consents", Code: FieldRequired, Message: fmt.Sprintf(ErrMissingField, "Consents")})
+	}
+	if e.required("source", "Source", source) {
+		e.maxLength("source", "Source", source, MaxConsentSourceLength)
+	}
+	channels := make([]string, 0, len(consents))
+	for c := range consents {
+		channels = append(channels, c)
+	}
+	sort.Strings(channels)
+	records := make([]ConsentRecord, 0, len(channels))
+	for _, c := range channels {
+		if !ValidConsentChannel(c) {
+			e = append(e, FieldError{Field: "consents", Code: FieldInvalid, Message: fmt.Sprintf("Consent %q is to no known channel, known channels are %v", c, ConsentChannels)})
+			continue
+		}
+		records = append(records, ConsentRecord{Channel: c, Granted: consents[c], At: at, Source: source})
+	}
+	if err := e.err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// TallyConsents adds the grants and withdrawals of history to tallies,
+// returning them in the order of ConsentChannels
+func TallyConsents(tallies []ConsentTally, history []ConsentRecord) []ConsentTally {
+	if len(tallies) == 0 && len(history) == 0 {
+		return nil
+	}
+	counts := make(map[string]ConsentTally)
+	for _, t := range tallies {
+		counts[t.Channel] = t
+	}
+	for _, r := range history {
+		t := counts[r.Channel]
+		t.Channel = r.Channel
+		if r.Granted {
+			t.Grants++
+		} else {
+			t.Withdrawals++
+		}
+		counts[r.Channel] = t
+	}
+	out := make([]ConsentTally, 0, len(counts))
+	for _, c := range ConsentChannels {
+		if t, ok := counts[c]; ok {
+			out = append(out, t)
+		}
+	}
+	return out
+}
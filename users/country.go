@@ -0,0 +1,104 @@
+package users
+
+// country.go normalizes the countries of addresses to ISO 3166-1 alpha-2
+// codes, so the same country is stored the same way whatever it was written
+// as, and shipping rates can be looked up by code.
+
+import (
+	"strings"
+)
+
+// isoCountries are the ISO 3166-1 alpha-2 codes assigned
+var isoCountries = func() map[string]bool {
+	codes := strings.Fields(`
+		AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI
+		BJ BL BM BN BO BQ BR BS BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN
+		CO CR CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK
+		FM FO FR GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM
+		HN HR HT HU ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN
+		KP KR KW KY KZ LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK
+		ML MM MN MO MP MQ MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP
+		NR NU NZ OM PA PE PF PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW
+		SA SB SC SD SE SG SH SI SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF
+		TG TH TJ TK TL TM TN TO TR TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI
+		VN VU WF WS YE YT ZA ZM ZW`)
+	m := make(map[string]bool, len(codes))
+	for _, c := range codes {
+		m[c] = true
+	}
+	return m
+}()
+
+// CountryAliases maps the common names of countries, lower case, to their
+// codes. Add the names customers write here.
+var CountryAliases = map[string]string{
+	"uk":                       "GB",
+	"united kingdom":           "GB",
+	"great britain":            "GB",
+	"britain":                  "GB",
+	"england":                  "GB",
+	"scotland":                 "GB",
+	"wales":                    "GB",
+	"northern ireland":         "GB",
+	"usa":                      "US",
+	"united states":            "US",
+	"united states of america": "US",
+	"america":                  "US",
+	"canada":                   "CA",
+	"mexico":                   "MX",
+	"brazil":                   "BR",
+	"argentina":                "AR",
+	"ireland":                  "IE",
+	"germany":                  "DE",
+	"deutschland":              "DE",
+	"france":                   "FR",
+	"spain":                    "ES",
+	"españa":                   "ES",
+	"portugal":                 "PT",
+	"italy":                    "IT",
+	"italia":                   "IT",
+	"netherlands":              "NL",
+	"the netherlands":          "NL",
+	"holland":                  "NL",
+	"belgium":                  "BE",
+	"switzerland":              "CH",
+	"austria":                  "AT",
+	"denmark":                  "DK",
+	"sweden":                   "SE",
+	"norway":                   "NO",
+	"finland":                  "FI",
+	"poland":                   "PL",
+	"czech republic":           "CZ",
+	"czechia":                  "CZ",
+	"greece":                   "GR",
+	"turkey":                   "TR",
+	"russia":                   "RU",
+	"ukraine":                  "UA",
+	"israel":                   "IL",
+	"united arab emirates":     "AE",
+	"uae":                      "AE",
+	"south africa":             "ZA",
+	"india":                    "IN",
+	"china":                    "CN",
+	"hong kong":                "HK",
+	"japan":                    "JP",
+	"south korea":              "KR",
+	"korea":                    "KR",
+	"singapore":                "SG",
+	"australia":                "AU",
+	"new zealand":              "NZ",
+}
+
+// NormalizeCountry returns the ISO 3166-1 alpha-2 code of country, given as
+// a code in any case or as one of CountryAliases, and whether it is known.
+// An unknown country is returned as given.
+func NormalizeCountry(country string) (string, bool) {
+	c := strings.Join(strings.Fields(country), " ")
+	if code, ok := CountryAliases[strings.ToLower(c)]; ok {
+		return code, true
+	}
+	if code := strings.ToUpper(c); isoCountries[code] {
+		return code, true
+	}
+	return country, false
+}
@@ -0,0 +1,122 @@
+package users
+
+// diff.go tells what an update changed of a user, for the audit log and the
+// events of the service. Sensitive values are masked as in logs: passwords
+// and salts are never compared, emails and phone numbers only partially
+// shown.
+
+import (
+	"sort"
+)
+
+// FieldChange is a change to one field of a user. Field is the JSON name of
+// the field, or preferences.<key> for a preference. Old and New are the
+// values of scalar fields; the sets of ids of addresses and cards, and
+// roles, list the values Added and Removed instead.
+type FieldChange struct {
+	Field   string   `json:"field" bson:"field"`
+	Old     string   `json:"old,omitempty" bson:"old,omitempty"`
+	New     string   `json:"new,omitempty" bson:"new,omitempty"`
+	Added   []string `json:"added,omitempty" bson:"added,omitempty"`
+	Removed []string `json:"removed,omitempty" bson:"removed,omitempty"`
+}
+
+// Diff returns the changes from old to new, in a stable order, nil when
+// nothing changed
+func Diff(old, new User) []FieldChange {
+	var cs []FieldChange
+	scalar := func(field, o, n string, mask func(string) string) {
+		if o == n {
+			return
+		}
+		if mask != nil {
+			o, n = mask(o), mask(n)
+		}
+		cs = append(cs, FieldChange{Field: field, Old: o, New: n})
+	}
+	set := func(field string, o, n []string) {
+		added, removed := setDiff(o, n)
+		if len(added) > 0 || len(removed) > 0 {
+			cs = append(cs, FieldChange{Field: field, Added: added, Removed: removed})
+		}
+	}
+	scalar("firstName", old.FirstName, new.FirstName, nil)
+	scalar("lastName", old.LastName, new.LastName, nil)
+	scalar("email", old.Email, new.Email, MaskEmail)
+	scalar("username", old.Username, new.Username, nil)
+	// A display name filled from the names only changes along them
+	if old.DisplayName != old.DefaultDisplayName() || new.DisplayName != new.DefaultDisplayName() {
+		scalar("displayName", old.DisplayName, new.DisplayName, nil)
+	}
+	scalar("phone", old.Phone, new.Phone, maskPhone)
+	scalar("status", old.Status, new.Status, nil)
+	set("roles", old.Roles, new.Roles)
+	set("addresses", addressIDs(old.Addresses), addressIDs(new.Addresses))
+	set("cards", cardIDs(old.Cards), cardIDs(new.Cards))
+	scalar("defaultShipping", old.DefaultShipping, new.DefaultShipping, nil)
+	scalar("defaultBilling", old.DefaultBilling, new.DefaultBilling, nil)
+	scalar("defaultCard", old.DefaultCard, new.DefaultCard, nil)
+	keys := make(map[string]bool)
+	for k := range old.Preferences {
+		keys[k] = true
+	}
+	for k := range new.Preferences {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+	for _, k := range sorted {
+		scalar("preferences."+k, old.Preferences[k], new.Preferences[k], nil)
+	}
+	return cs
+}
+
+// setDiff returns the values of n missing from o, and those of o missing
+// from n, sorted
+func setDiff(o, n []string) (added, removed []string) {
+	in := func(vs []string) map[string]bool {
+		m := make(map[string]bool, len(vs))
+		for _, v := range vs {
+			m[v] = true
+		}
+		return m
+	}
+	om, nm := in(o), in(n)
+	for v := range nm {
+		if !om[v] {
+			added = append(added, v)
+		}
+	}
+	for v := range om {
+		if !nm[v] {
+			removed = append(removed, v)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
+
+func addressIDs(as []Address) []string {
+	ids := make([]string, 0, len(as))
+	for _, a := range as {
+		ids = append(ids, a.ID)
+	}
+	return ids
+}
+
+func cardIDs(cs []Card) []string {
+	ids := make([]string, 0, len(cs))
+	for _, c := range cs {
+		ids = append(ids, c.ID)
+	}
+	return ids
+}
+
+// maskPhone leaves the last four digits of a phone number
+func maskPhone(p string) string {
+	return MaskNumberStyle(p, MaskLast4)
+}
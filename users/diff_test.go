@@ -0,0 +1,64 @@
+package users
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	old := User{
+		FirstName:   "first",
+		LastName:    "last",
+		Email:       "first@example.com",
+		Username:    "user",
+		Phone:       "+14155550123",
+		Password:    "hash",
+		Salt:        "salt",
+		Roles:       []string{RoleCustomer},
+		Addresses:   []Address{{ID: "a1"}, {ID: "a2"}},
+		Cards:       []Card{{ID: "c1"}},
+		Preferences: map[string]string{"currency": "EUR"},
+	}
+	if cs := Diff(old, old.Clone()); cs != nil {
+		t.Errorf("Expected no changes, received %+v", cs)
+	}
+
+	single := old.Clone()
+	single.LastName = "other"
+	if cs, want := Diff(old, single), []FieldChange{{Field: "lastName", Old: "last", New: "other"}}; !reflect.DeepEqual(cs, want) {
+		t.Errorf("Expected %+v, received %+v", want, cs)
+	}
+
+	multi := old.Clone()
+	multi.Email = "second@example.org"
+	multi.Phone = "+442079460958"
+	multi.Password = "other hash"
+	multi.Salt = ""
+	multi.Addresses = []Address{{ID: "a2"}, {ID: "a3"}, {ID: "a4"}}
+	multi.Cards = nil
+	multi.Preferences = map[string]string{"newsletter": "true"}
+	want := []FieldChange{
+		{Field: "email", Old: "f***@example.com", New: "s***@example.org"},
+		{Field: "phone", Old: "********0123", New: "*********0958"},
+		{Field: "addresses", Added: []string{"a3", "a4"}, Removed: []string{"a1"}},
+		{Field: "cards", Removed: []string{"c1"}},
+		{Field: "preferences.currency", Old: "EUR"},
+		{Field: "preferences.newsletter", New: "true"},
+	}
+	if cs := Diff(old, multi); !reflect.DeepEqual(cs, want) {
+		t.Errorf("Expected %+v, received %+v", want, cs)
+	}
+
+	// A display name filled from the names is not told apart
+	filled, renamed := old.Clone(), old.Clone()
+	filled.FillDisplayName()
+	renamed.FirstName = "second"
+	renamed.FillDisplayName()
+	if cs, want := Diff(filled, renamed), []FieldChange{{Field: "firstName", Old: "first", New: "second"}}; !reflect.DeepEqual(cs, want) {
+		t.Errorf("Expected %+v, received %+v", want, cs)
+	}
+	renamed.DisplayName = "Boss"
+	if cs, want := Diff(filled, renamed)[1], (FieldChange{Field: "displayName", Old: "first last", New: "Boss"}); !reflect.DeepEqual(cs, want) {
+		t.Errorf("Expected %+v, received %+v", want, cs)
+	}
+}
@@ -0,0 +1,128 @@
+package users
+
+// email.go compares emails in a canonical form, so Bob@Example.COM and
+// bob@example.com cannot hold two accounts. The email is shown as the
+// customer wrote it; only its canonical form is compared and indexed.
+//
+// A user has a primary email, User.Email, and may add others, as a billing
+// address separate from the one logged in with. Emails must be verified
+// before they are made primary or logged in with.
+
+import (
+	"strings"
+	"sync/atomic"
+)
+
+// MaxEmails is the number of emails a user holds at most, its primary
+// included
+const MaxEmails = 10
+
+// FieldUnverified is the code of an email that must be verified first
+const FieldUnverified = "unverified"
+
+// EmailAddress is an email of a user. The emails of a user are stored
+// without the primary one, which stays in User.Email, until it is verified.
+type EmailAddress struct {
+	Address  string `json:"address" bson:"address"`
+	Verified bool   `json:"verified" bson:"verified"`
+	// Primary is whether the address is User.Email; it is never stored
+	Primary bool `json:"primary" bson:"-"`
+	// Normalized is NormalizeEmail of Address, unique among all the emails
+	// of all users
+	Normalized string `json:"-" bson:"normalized"`
+	// CodeHash is the hash of the code verifying the address, until it is
+	// verified
+	CodeHash string `json:"-" bson:"codeHash,omitempty"`
+}
+
+// EmailList returns the emails of u, the primary first and marked Primary.
+// The primary is listed unverified when u.Emails does not hold it.
+func (u User) EmailList() []EmailAddress {
+	list := make([]EmailAddress, 0, len(u.Emails)+1)
+	if u.Email != "" {
+		primary := EmailAddress{Address: u.Email, Primary: true}
+		if k := u.FindEmail(u.Email); k >= 0 {
+			primary.Verified = u.Emails[k].Verified
+		}
+		list = append(list, primary)
+	}
+	for _, e := range u.Emails {
+		if !SameEmail(e.Address, u.Email) {
+			e.CodeHash = ""
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// FindEmail returns the index of email in u.Emails, -1 when u holds no such
+// email besides, maybe, its primary
+func (u User) FindEmail(email string) int {
+	for k, e := range u.Emails {
+		if SameEmail(e.Address, email) {
+			return k
+		}
+	}
+	return -1
+}
+
+// HasVerifiedEmail reports whether email is one of the verified emails of u
+func (u User) HasVerifiedEmail(email string) bool {
+	k := u.FindEmail(email)
+	return k >= 0 && u.Emails[k].Verified
+}
+
+// ValidateEmail returns FieldErrors when email is no valid email, for the
+// endpoints adding one, which name it address
+func ValidateEmail(email string) error {
+	var e FieldErrors
+	if e.required("address", "Address", email) && e.maxLength("address", "Address", email, MaxEmailLength) {
+		e.match("address", "Address", email, emailPattern)
+	}
+	return e.err()
+}
+
+// foldEmailLocal is whether NormalizeEmail lowercases the local part too
+var foldEmailLocal atomic.Bool
+
+// SetFoldEmailLocal makes NormalizeEmail lowercase the local part of emails,
+// before the @, as well as the domain. Mail servers may tell local parts
+// apart by case, though few do.
+func SetFoldEmailLocal(fold bool) {
+	foldEmailLocal.Store(fold)
+}
+
+// NormalizeEmail returns the canonical form of email emails are compared in:
+// trimmed, with the domain in lower case, and the local part too after
+// SetFoldEmailLocal(true)
+func NormalizeEmail(email string) string {
+	email = strings.TrimSpace(email)
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return email
+	}
+	local := email[:i]
+	if foldEmailLocal.Load() {
+		local = strings.ToLower(local)
+	}
+	return local + strings.ToLower(email[i:])
+}
+
+// MaskEmail returns email partially masked, as j***@example.com, leaving the
+// first letter and the domain. Values that are no email are masked entirely.
+func MaskEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	at := strings.LastIndex(email, "@")
+	if at <= 0 {
+		return "***"
+	}
+	return email[:1] + "***" + email[at:]
+}
+
+// SameEmail reports whether the emails a and b are the same once normalized.
+// Empty emails are never the same as any.
+func SameEmail(a, b string) bool {
+	return a != "" && b != "" && NormalizeEmail(a) == NormalizeEmail(b)
+}
@@ -0,0 +1,76 @@
+package users
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// SchemeBcrypt prefixes stored bcrypt hashes. Stored hashes without a
+// scheme prefix are legacy salted sha1 hashes.
+const SchemeBcrypt = "bcrypt$"
+
+// Hasher hashes and verifies passwords
+type Hasher interface {
+	// Hash returns the stored form of password
+	Hash(password string) (string, error)
+	// Verify reports whether password matches the stored hash. salt is only
+	// used by legacy hashes.
+	Verify(stored, salt, password string) bool
+	// NeedsRehash reports whether stored should be replaced by a fresh Hash
+	NeedsRehash(stored string) bool
+}
+
+// BcryptHasher hashes with bcrypt and still verifies legacy hashes so they
+// can be upgraded on the next successful login.
+type BcryptHasher struct {
+	Cost int
+}
+
+// NewBcryptHasher returns a bcrypt Hasher with the given cost, falling back
+// to the bcrypt default for invalid costs.
+func NewBcryptHasher(cost int) BcryptHasher {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		cost = bcrypt.DefaultCost
+	}
+	return BcryptHasher{Cost: cost}
+}
+
+// Hash returns the prefixed bcrypt hash of password
+func (h BcryptHasher) Hash(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	if err != nil {
+		return "", err
+	}
+	return SchemeBcrypt + string(b), nil
+}
+
+// Verify reports whether password matches stored, in either format
+func (h BcryptHasher) Verify(stored, salt, password string) bool {
+	if strings.HasPrefix(stored, SchemeBcrypt) {
+		return bcrypt.CompareHashAndPassword([]byte(strings.TrimPrefix(stored, SchemeBcrypt)), []byte(password)) == nil
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(LegacyHash(password, salt))) == 1
+}
+
+// NeedsRehash reports whether stored is a legacy hash or uses another cost
+func (h BcryptHasher) NeedsRehash(stored string) bool {
+	if !strings.HasPrefix(stored, SchemeBcrypt) {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(strings.TrimPrefix(stored, SchemeBcrypt)))
+	return err != nil || cost != h.Cost
+}
+
+// LegacyHash is the salted sha1 hash passwords were stored as originally.
+// It is only used to verify hashes that have not been upgraded yet.
+func LegacyHash(password, salt string) string {
+	h := sha1.New()
+	io.WriteString(h, salt)
+	io.WriteString(h, password)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,55 @@
+package users
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestLegacyHash(t *testing.T) {
+	hash1 := LegacyHash("eve", "c748112bc027878aa62812ba1ae00e40ad46d497")
+	if hash1 != "fec51acb3365747fc61247da5e249674cf8463c2" {
+		t.Error("Eve's password failed hash test")
+	}
+	hash2 := LegacyHash("password", "6c1c6176e8b455ef37da13d953df971c249d0d8e")
+	if hash2 != "e2de7202bb2201842d041f6de201b10438369fb8" {
+		t.Error("user's password failed hash test")
+	}
+	hash3 := LegacyHash("password", "bd832b0e10c6882deabc5e8e60a37689e2b708c2")
+	if hash3 != "8f31df4dcc25694aeb0c212118ae37bbd6e47bcd" {
+		t.Error("user1's password failed hash test")
+	}
+}
+
+func TestBcryptHasher(t *testing.T) {
+	h := NewBcryptHasher(bcrypt.MinCost)
+	hash, err := h.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(hash, SchemeBcrypt) {
+		t.Errorf("Expected scheme prefix, received %v", hash)
+	}
+	if !h.Verify(hash, "", "password") || h.Verify(hash, "", "wrong") {
+		t.Error("Expected only the right password to verify")
+	}
+	if h.NeedsRehash(hash) {
+		t.Error("Expected fresh hash not to need rehash")
+	}
+	if !NewBcryptHasher(bcrypt.MinCost + 1).NeedsRehash(hash) {
+		t.Error("Expected hash with other cost to need rehash")
+	}
+}
+
+func TestBcryptHasherLegacy(t *testing.T) {
+	h := NewBcryptHasher(bcrypt.MinCost)
+	salt := "c748112bc027878aa62812ba1ae00e40ad46d497"
+	legacy := "fec51acb3365747fc61247da5e249674cf8463c2"
+	if !h.Verify(legacy, salt, "eve") || h.Verify(legacy, salt, "wrong") {
+		t.Error("Expected legacy hash to verify only the right password")
+	}
+	if !h.NeedsRehash(legacy) {
+		t.Error("Expected legacy hash to need rehash")
+	}
+}
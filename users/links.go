@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 )
 
 var (
@@ -21,6 +22,18 @@ func init() {
 
 type Links map[string]Href
 
+// Clone returns a copy of l, nil when l is
+func (l Links) Clone() Links {
+	if l == nil {
+		return nil
+	}
+	c := make(Links, len(l))
+	for k, v := range l {
+		c[k] = v
+	}
+	return c
+}
+
 func (l *Links) AddLink(ent string, id string) {
 	nl := make(Links)
 	link := fmt.Sprintf("http://%v/%v/%v", domain, entitymap[ent], id)
@@ -51,6 +64,51 @@ func (l *Links) AddCard(id string) {
 	l.AddLink("card", id)
 }
 
+// LinkBase returns the base URL set with -link-domain, or "" when unset. A
+// domain without a scheme is served over http.
+func LinkBase() string {
+	switch {
+	case domain == "":
+		return ""
+	case strings.Contains(domain, "://"):
+		return strings.TrimSuffix(domain, "/")
+	}
+	return "http://" + domain
+}
+
+// CustomerLinks returns the links of customer id under base, like
+// "https://example.com"
+func CustomerLinks(base, id string) Links {
+	self := Href{Href: fmt.Sprintf("%v/customers/%v", base, id)}
+	return Links{
+		"self":      self,
+		"customer":  self,
+		"addresses": Href{Href: self.Href + "/addresses"},
+		"cards":     Href{Href: self.Href + "/cards"},
+	}
+}
+
+// AddressLinks returns the links of address id under base, with a link to
+// the customer owning it when owner is known
+func AddressLinks(base, id, owner string) Links {
+	return attributeLinks(base, "address", id, owner)
+}
+
+// CardLinks returns the links of card id under base, with a link to the
+// customer owning it when owner is known
+func CardLinks(base, id, owner string) Links {
+	return attributeLinks(base, "card", id, owner)
+}
+
+func attributeLinks(base, ent, id, owner string) Links {
+	self := Href{Href: fmt.Sprintf("%v/%v/%v", base, entitymap[ent], id)}
+	l := Links{"self": self, ent: self}
+	if owner != "" {
+		l["customer"] = Href{Href: fmt.Sprintf("%v/customers/%v", base, owner)}
+	}
+	return l
+}
+
 type Href struct {
 	Href string `json:"href"`
 }
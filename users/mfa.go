@@ -0,0 +1,13 @@
+package users
+
+// MFA is the two-factor enrollment of a user. The secret is stored sealed
+// and recovery codes only as hashes.
+type MFA struct {
+	Secret string `json:"-" bson:"secret"`
+	// Enabled is set once enrollment was confirmed with a valid code
+	Enabled bool `json:"enabled" bson:"enabled"`
+	// LastStep is the last TOTP time step a code was accepted for, so that
+	// no code is accepted twice
+	LastStep      int64    `json:"-" bson:"lastStep"`
+	RecoveryCodes []string `json:"-" bson:"recoveryCodes"`
+}
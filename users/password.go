@@ -0,0 +1,119 @@
+package users
+
+import (
+	"bufio"
+	_ "embed"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// Password policy rules, as listed in a PasswordPolicyError
+const (
+	RuleMinLength = "min_length"
+	RuleUpper     = "upper"
+	RuleLower     = "lower"
+	RuleDigit     = "digit"
+	RuleSymbol    = "symbol"
+	RuleIdentity  = "identity"
+	RuleCommon    = "common"
+)
+
+// commonPasswords are the 7,141 most common passwords of the zxcvbn
+// password strength estimator (MIT License, Dropbox), ranked by frequency in
+// leaked password dumps, and those of the former bundled list they lack
+//
+//go:embed common-passwords.txt
+var commonPasswords string
+
+// PasswordPolicyError lists the rules a password breaks
+type PasswordPolicyError struct {
+	Rules []string
+}
+
+func (e PasswordPolicyError) Error() string {
+	return "Password does not meet policy: " + strings.Join(e.Rules, ", ")
+}
+
+// PasswordPolicy is the strength required of new passwords. The zero value
+// accepts any password.
+type PasswordPolicy struct {
+	MinLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// RejectIdentity refuses the username or email, or the local part of
+	// the email, as password, ignoring case
+	RejectIdentity bool
+	// Common passwords are refused, compared in lower case
+	Common map[string]bool
+}
+
+// CommonPasswords returns the bundled list of common passwords
+func CommonPasswords() map[string]bool {
+	m, _ := ReadPasswordList(strings.NewReader(commonPasswords))
+	return m
+}
+
+// ReadPasswordList reads a list of passwords, one per line
+func ReadPasswordList(r io.Reader) (map[string]bool, error) {
+	m := make(map[string]bool)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		if p := strings.TrimSpace(s.Text()); p != "" {
+			m[strings.ToLower(p)] = true
+		}
+	}
+	return m, s.Err()
+}
+
+// Check returns a PasswordPolicyError listing every rule password breaks for
+// the user with the given username and email, or nil.
+func (p PasswordPolicy) Check(password, username, email string) error {
+	var rules []string
+	if len([]rune(password)) < p.MinLength {
+		rules = append(rules, RuleMinLength)
+	}
+	for _, c := range []struct {
+		required bool
+		rule     string
+		is       func(rune) bool
+	}{
+		{p.RequireUpper, RuleUpper, unicode.IsUpper},
+		{p.RequireLower, RuleLower, unicode.IsLower},
+		{p.RequireDigit, RuleDigit, unicode.IsDigit},
+		{p.RequireSymbol, RuleSymbol, isSymbol},
+	} {
+		if c.required && strings.IndexFunc(password, c.is) < 0 {
+			rules = append(rules, c.rule)
+		}
+	}
+	if p.RejectIdentity && isIdentity(password, username, email) {
+		rules = append(rules, RuleIdentity)
+	}
+	if p.Common[strings.ToLower(password)] {
+		rules = append(rules, RuleCommon)
+	}
+	if len(rules) > 0 {
+		return PasswordPolicyError{Rules: rules}
+	}
+	return nil
+}
+
+func isSymbol(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r) && !unicode.IsSpace(r)
+}
+
+func isIdentity(password, username, email string) bool {
+	local := email
+	if i := strings.LastIndex(email, "@"); i >= 0 {
+		local = email[:i]
+	}
+	for _, v := range []string{username, email, local} {
+		if v != "" && strings.EqualFold(password, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package users
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	p := PasswordPolicy{
+		MinLength:      8,
+		RequireUpper:   true,
+		RequireDigit:   true,
+		RequireSymbol:  true,
+		RejectIdentity: true,
+		Common:         CommonPasswords(),
+	}
+	for password, want := range map[string][]string{
+		"x":                 {RuleMinLength, RuleUpper, RuleDigit, RuleSymbol},
+		"Correct-Horse-9":   nil,
+		"correct-horse-9":   {RuleUpper},
+		"Bob.Smith1!":       nil,
+		"BOB@example.com1":  nil,
+		"bob@Example.com":   {RuleDigit, RuleIdentity},
+		"Password":          {RuleDigit, RuleSymbol, RuleCommon},
+		"Ünïcödé-Pässwörd1": nil,
+	} {
+		err := p.Check(password, "bobsmith", "bob@example.com")
+		var pe PasswordPolicyError
+		if want == nil {
+			if err != nil {
+				t.Errorf("%q: expected no error, received %v", password, err)
+			}
+			continue
+		}
+		if !errors.As(err, &pe) || !reflect.DeepEqual(pe.Rules, want) {
+			t.Errorf("%q: expected %v, received %v", password, want, err)
+		}
+	}
+	if err := (PasswordPolicy{}).Check("", "", ""); err != nil {
+		t.Errorf("Expected zero policy to accept anything, received %v", err)
+	}
+}
+
+func TestReadPasswordList(t *testing.T) {
+	m, err := ReadPasswordList(strings.NewReader("Hunter2\n\n  secret  \n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || !m["hunter2"] || !m["secret"] {
+		t.Errorf("Expected two lower cased entries, received %v", m)
+	}
+	if !CommonPasswords()["123456"] {
+		t.Error("Expected bundled list to hold 123456")
+	}
+}
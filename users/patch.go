@@ -0,0 +1,77 @@
+package users
+
+// UserPatch holds the profile fields to change. Nil fields are left untouched,
+// so an empty string can be told apart from an absent field.
+type UserPatch struct {
+	FirstName *string `json:"firstName"`
+	LastName  *string `json:"lastName"`
+	Email     *string `json:"email"`
+	Username  *string `json:"username"`
+	Phone     *string `json:"phone"`
+	// DisplayName set empty falls back to the first and last names
+	DisplayName *string `json:"displayName"`
+}
+
+// PatchableFields lists the JSON names of the fields a UserPatch can change
+var PatchableFields = []string{"firstName", "lastName", "email", "username", "phone", "displayName"}
+
+// Apply sets the fields present in the patch on u
+func (p UserPatch) Apply(u *User) {
+	if p.FirstName != nil {
+		u.FirstName = *p.FirstName
+	}
+	if p.LastName != nil {
+		u.LastName = *p.LastName
+	}
+	if p.Email != nil {
+		u.Email = *p.Email
+	}
+	if p.Username != nil {
+		u.Username = *p.Username
+	}
+	if p.Phone != nil {
+		u.Phone = *p.Phone
+	}
+	if p.DisplayName != nil {
+		u.DisplayName = *p.DisplayName
+	}
+}
+
+// Validate returns FieldErrors listing every problem with the fields present
+// in p, held to the rules of User.Validate, or nil
+func (p UserPatch) Validate() error {
+	var u User
+	p.Apply(&u)
+	all, _ := u.ValidateProfile().(FieldErrors)
+	var e FieldErrors
+	for _, fe := range all {
+		if p.has(fe.Field) {
+			e = append(e, fe)
+		}
+	}
+	return e.err()
+}
+
+// has reports whether the field with the JSON name field is present in p
+func (p UserPatch) has(field string) bool {
+	switch field {
+	case "firstName":
+		return p.FirstName != nil
+	case "lastName":
+		return p.LastName != nil
+	case "email":
+		return p.Email != nil
+	case "username":
+		return p.Username != nil
+	case "phone":
+		return p.Phone != nil
+	case "displayName":
+		return p.DisplayName != nil
+	}
+	return false
+}
+
+// Empty reports whether the patch changes nothing
+func (p UserPatch) Empty() bool {
+	return p.FirstName == nil && p.LastName == nil && p.Email == nil && p.Username == nil && p.Phone == nil && p.DisplayName == nil
+}
@@ -0,0 +1,36 @@
+package users
+
+import "testing"
+
+func TestPatchApply(t *testing.T) {
+	u := User{FirstName: "first", LastName: "last", Email: "mail", Username: "user"}
+	empty := ""
+	email := "new@example.com"
+	p := UserPatch{Email: &email, LastName: &empty}
+	if p.Empty() {
+		t.Error("Expected non empty patch")
+	}
+	p.Apply(&u)
+	if u.Email != email || u.LastName != "" {
+		t.Errorf("Expected patched fields, received %+v", u)
+	}
+	if u.FirstName != "first" || u.Username != "user" {
+		t.Errorf("Expected untouched fields, received %+v", u)
+	}
+	if !(UserPatch{}).Empty() {
+		t.Error("Expected empty patch")
+	}
+}
+
+func TestPatchValidate(t *testing.T) {
+	empty := ""
+	email := "nope"
+	name := "valid"
+	if err := (UserPatch{FirstName: &name}).Validate(); err != nil {
+		t.Errorf("Expected absent fields ignored, received %v", err)
+	}
+	fe, ok := (UserPatch{LastName: &empty, Email: &email}).Validate().(FieldErrors)
+	if !ok || len(fe) != 2 || fe[0].Field != "lastName" || fe[1].Field != "email" {
+		t.Errorf("Expected the last name and email refused, received %+v", fe)
+	}
+}
@@ -0,0 +1,53 @@
+package users
+
+// phone.go normalizes and checks the contact numbers of customers, in the
+// E.164 form delivery partners dial: a plus, the country code and the
+// subscriber number. It checks the shape of numbers only, not that they are
+// assigned.
+
+import (
+	"regexp"
+	"strings"
+)
+
+// phonePattern is E.164: up to 15 digits after the plus, the country code
+// never starting with 0. Numbers shorter than 7 digits are not plausible.
+var phonePattern = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+// NormalizePhone strips the spaces, dashes, dots and parentheses numbers are
+// written with, as in +44 (20) 7946-0958, and turns an international 00
+// prefix into a plus
+func NormalizePhone(p string) string {
+	p = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "").Replace(p)
+	if strings.HasPrefix(p, "00") {
+		p = "+" + p[2:]
+	}
+	return p
+}
+
+// ValidPhone reports whether p is a normalized E.164 number
+func ValidPhone(p string) bool {
+	return phonePattern.MatchString(p)
+}
+
+// ValidatePhone returns FieldErrors when p is neither empty nor a
+// normalized E.164 number, for the updates checking that field alone
+func ValidatePhone(p string) error {
+	var e FieldErrors
+	e.phone(p)
+	return e.err()
+}
+
+func (e *FieldErrors) phone(p string) {
+	if p != "" && !ValidPhone(p) {
+		*e = append(*e, FieldError{Field: "phone", Code: FieldInvalid, Message: "Phone must be in international format, as +14155550123"})
+	}
+}
+
+// Normalize puts the fields of u in the form they are stored and compared in
+func (u *User) Normalize() {
+	u.Username = NormalizeUsername(u.Username)
+	u.DisplayName = strings.TrimSpace(u.DisplayName)
+	u.Email = strings.TrimSpace(u.Email)
+	u.Phone = NormalizePhone(u.Phone)
+}
@@ -0,0 +1,67 @@
+package users
+
+// postcode.go checks post codes against the format of the country of the
+// address, and writes them the way the post of that country does.
+
+import (
+	"regexp"
+	"strings"
+)
+
+// PostCodeRule is the format of the post codes of a country. Pattern is
+// matched against the code in upper case without spaces or dashes, and
+// Format, a regexp replacement of Pattern, writes it out: separators Format
+// leaves at either end, for optional groups, are dropped. Example is shown to
+// customers getting it wrong.
+type PostCodeRule struct {
+	Pattern *regexp.Regexp
+	Format  string
+	Example string
+}
+
+// PostCodeRules are the formats of post codes by country code. Post codes of
+// countries without a rule need only be plausible. Add a country here.
+var PostCodeRules = map[string]PostCodeRule{
+	"GB": {regexp.MustCompile(`^([A-Z]{1,2}[0-9][A-Z0-9]?)([0-9][A-Z]{2})$`), "$1 $2", "SW1A 1AA"},
+	"US": {regexp.MustCompile(`^([0-9]{5})([0-9]{4})?$`), "$1-$2", "94105 or 94105-1234"},
+	"DE": {regexp.MustCompile(`^([0-9]{5})$`), "$1", "10115"},
+	"FR": {regexp.MustCompile(`^([0-9]{5})$`), "$1", "75001"},
+	"NL": {regexp.MustCompile(`^([0-9]{4})([A-Z]{2})$`), "$1 $2", "1012 AB"},
+	"CA": {regexp.MustCompile(`^([A-Z][0-9][A-Z])([0-9][A-Z][0-9])$`), "$1 $2", "K1A 0B1"},
+	"AU": {regexp.MustCompile(`^([0-9]{4})$`), "$1", "2000"},
+}
+
+// compactPostCode returns code in upper case without spaces or dashes
+func compactPostCode(code string) string {
+	return strings.NewReplacer(" ", "", "-", "").Replace(strings.ToUpper(code))
+}
+
+// NormalizePostCode writes code as the post of country, a code or a name
+// NormalizeCountry knows, does, as in SW1A 1AA for sw1a1aa in GB. Codes not
+// matching the rule of the country, and those of countries without one, are
+// only upper cased with their whitespace collapsed.
+func NormalizePostCode(country, code string) string {
+	country, _ = NormalizeCountry(country)
+	if r, ok := PostCodeRules[country]; ok {
+		if c := compactPostCode(code); r.Pattern.MatchString(c) {
+			return strings.Trim(r.Pattern.ReplaceAllString(c, r.Format), " -")
+		}
+	}
+	return strings.ToUpper(strings.Join(strings.Fields(code), " "))
+}
+
+// postCode checks code against the rule of country, or for plausibility
+func (e *FieldErrors) postCode(country, code string) {
+	if code == "" {
+		return
+	}
+	country, _ = NormalizeCountry(country)
+	r, ok := PostCodeRules[country]
+	if !ok {
+		e.match("postcode", "PostCode", code, postCodePattern)
+		return
+	}
+	if !r.Pattern.MatchString(compactPostCode(code)) {
+		*e = append(*e, FieldError{Field: "postcode", Code: FieldInvalid, Message: "PostCode is not a valid post code of " + country + ", as " + r.Example})
+	}
+}
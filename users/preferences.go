@@ -0,0 +1,68 @@
+package users
+
+// preferences.go bounds the small settings the front end keeps on the
+// profile of a customer, as the preferred currency or the newsletter opt-in,
+// so that no client can grow a user document without limit.
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+// Caps of the preferences of a user, values counted in bytes
+const (
+	MaxPreferences           = 32
+	MaxPreferenceValueLength = 256
+)
+
+var preferenceKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidPreferenceKey reports whether key is up to 64 letters, digits and
+// _- only. Keys are stored as fields of a document, which may not hold dots.
+func ValidPreferenceKey(key string) bool {
+	return preferenceKeyPattern.MatchString(key)
+}
+
+// MergePreferences returns p with changes applied, leaving p as it is: a nil
+// value deletes its key, any other sets it
+func MergePreferences(p map[string]string, changes map[string]*string) map[string]string {
+	merged := make(map[string]string, len(p)+len(changes))
+	for k, v := range p {
+		merged[k] = v
+	}
+	for k, v := range changes {
+		if v == nil {
+			delete(merged, k)
+		} else {
+			merged[k] = *v
+		}
+	}
+	return merged
+}
+
+// ValidatePreferences returns FieldErrors listing the invalid keys and the
+// values too long in p, or more keys than MaxPreferences, or nil
+func ValidatePreferences(p map[string]string) error {
+	var e FieldErrors
+	e.preferences(p)
+	return e.err()
+}
+
+func (e *FieldErrors) preferences(p map[string]string) {
+	if len(p) > MaxPreferences {
+		*e = append(*e, FieldError{Field: "preferences", Code: FieldTooLong, Message: fmt.Sprintf("Preferences hold at most %v keys", MaxPreferences)})
+	}
+	keys := make([]string, 0, len(p))
+	for k := range p {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !ValidPreferenceKey(k) {
+			*e = append(*e, FieldError{Field: "preferences", Code: FieldInvalid, Message: fmt.Sprintf("Preference %q may only hold up to 64 letters, digits and _-", k)})
+		} else if len(p[k]) > MaxPreferenceValueLength {
+			*e = append(*e, FieldError{Field: "preferences", Code: FieldTooLong, Message: fmt.Sprintf("Preference %v is longer than %v bytes", k, MaxPreferenceValueLength)})
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package users
+
+// Roles users can hold. They are carried in issued tokens, where the admin
+// and payment roles are the ones of the auth package.
+const (
+	RoleCustomer = "customer"
+	RoleSupport  = "support"
+	RoleAdmin    = "admin"
+	RolePayment  = "payment"
+)
+
+var validRoles = map[string]bool{
+	RoleCustomer: true,
+	RoleSupport:  true,
+	RoleAdmin:    true,
+	RolePayment:  true,
+}
+
+// ValidRole reports whether role is a known role
+func ValidRole(role string) bool {
+	return validRoles[role]
+}
+
+// HasRole reports whether the user holds role
+func (u User) HasRole(role string) bool {
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,18 @@
+package users
+
+// Statuses of accounts. Support disables compromised accounts, which cannot
+// log in until they are enabled again, without deleting them.
+const (
+	StatusActive   = "active"
+	StatusDisabled = "disabled"
+)
+
+// ValidStatus reports whether status is a known account status
+func ValidStatus(status string) bool {
+	return status == StatusActive || status == StatusDisabled
+}
+
+// Disabled reports whether the account of u is disabled
+func (u User) Disabled() bool {
+	return u.Status == StatusDisabled
+}
@@ -0,0 +1,22 @@
+package users
+
+import "time"
+
+// RefreshToken is a long lived credential exchanged for new access tokens.
+// Only the hash of the token value is stored.
+type RefreshToken struct {
+	ID        string    `json:"id" bson:"id"`
+	Hash      string    `json:"-" bson:"hash"`
+	Device    string    `json:"device" bson:"device"`
+	CreatedAt time.Time `json:"createdAt" bson:"createdAt"`
+	ExpiresAt time.Time `json:"expiresAt" bson:"expiresAt"`
+	// Used is set once the token has been exchanged; presenting it again
+	// is a replay.
+	Used    bool `json:"-" bson:"used"`
+	Revoked bool `json:"-" bson:"revoked"`
+}
+
+// Active reports whether the token can still be exchanged at now
+func (t RefreshToken) Active(now time.Time) bool {
+	return !t.Used && !t.Revoked && now.Before(t.ExpiresAt)
+}
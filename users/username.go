@@ -0,0 +1,228 @@
+package users
+
+// username.go holds the rules of usernames. Names are stored in Unicode
+// normalization form C, so the same name typed on different keyboards is the
+// same name, and are refused when they hold control characters, direction
+// overrides, emoji or letters of several scripts, which break downstream
+// systems or let one customer pass for another.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Charsets of usernames
+const (
+	// UsernameASCII allows ASCII letters and digits, and ._@+-
+	UsernameASCII = "ascii"
+	// UsernameUnicode allows the letters of a single script as well, as in
+	// Zoë or Дмитрий, but neither symbols nor digits of other scripts
+	UsernameUnicode = "unicode"
+)
+
+// Length bounds of usernames, in characters once normalized
+const (
+	MinUsernameLength = 3
+	MaxUsernameLength = 32
+)
+
+// FieldTooShort is the code of a value shorter than its field allows
+const FieldTooShort = "too_short"
+
+// legacyUsernamePattern is what usernames were held to before these rules
+var legacyUsernamePattern = regexp.MustCompile(`^[A-Za-z0-9._@+-]{1,64}$`)
+
+var (
+	usernameUnicode atomic.Bool
+	legacyUsernames atomic.Bool
+)
+
+// ParseUsernameCharset checks s is UsernameASCII or UsernameUnicode
+func ParseUsernameCharset(s string) (string, error) {
+	switch s {
+	case UsernameASCII, UsernameUnicode:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown username charset %q, expected %v or %v", s, UsernameASCII, UsernameUnicode)
+}
+
+// SetUsernameCharset sets the charset new usernames are held to,
+// UsernameASCII unless set
+func SetUsernameCharset(charset string) {
+	usernameUnicode.Store(charset == UsernameUnicode)
+}
+
+// SetLegacyUsernames lets usernames meeting only the former rules, up to 64
+// ASCII letters, digits and ._@+-, be kept by profile updates. They can no
+// longer be registered, nor be taken by a rename.
+func SetLegacyUsernames(allow bool) {
+	legacyUsernames.Store(allow)
+}
+
+// NormalizeUsername returns name in Unicode normalization form C
+func NormalizeUsername(name string) string {
+	return norm.NFC.String(name)
+}
+
+// ValidUsername reports whether name, normalized, is a username new users
+// may take: 3 to 32 characters of the charset of SetUsernameCharset. None is
+// anything a query could read as an operator.
+func ValidUsername(name string) bool {
+	var e FieldErrors
+	e.username(name)
+	return len(e) == 0
+}
+
+// ValidExistingUsername reports whether a user holding name may keep it: a
+// valid username or, after SetLegacyUsernames(true), one of the former rules
+func ValidExistingUsername(name string) bool {
+	return ValidUsername(name) || (legacyUsernames.Load() && legacyUsernamePattern.MatchString(name))
+}
+
+// PlainUsername reports whether name may be looked up as it is: not empty,
+// without control characters, neither starting with $ nor holding braces, so
+// nothing a query could read as an operator. Logins are held to it alone, as
+// names registered under former rules must still log in.
+func PlainUsername(name string) bool {
+	if name == "" || strings.HasPrefix(name, "$") || strings.ContainsAny(name, "{}") {
+		return false
+	}
+	return strings.IndexFunc(name, unicode.IsControl) < 0
+}
+
+// ValidateUsername returns FieldErrors when name is not a valid username,
+// for the renames checking that field alone
+func ValidateUsername(name string) error {
+	var e FieldErrors
+	e.username(name)
+	return e.err()
+}
+
+func (e *FieldErrors) username(name string) {
+	if !e.required("username", "Username", name) {
+		return
+	}
+	n := utf8.RuneCountInString(name)
+	if n < MinUsernameLength {
+		*e = append(*e, FieldError{Field: "username", Code: FieldTooShort, Message: fmt.Sprintf("Username is shorter than %v characters", MinUsernameLength)})
+		return
+	}
+	if !e.maxLength("username", "Username", name, MaxUsernameLength) {
+		return
+	}
+	if usernameUnicode.Load() {
+		if !validUnicodeUsername(name) {
+			*e = append(*e, FieldError{Field: "username", Code: FieldInvalid, Message: "Username may only hold letters of a single script, digits 0-9 and ._@+-"})
+		}
+		return
+	}
+	if !legacyUsernamePattern.MatchString(name) {
+		*e = append(*e, FieldError{Field: "username", Code: FieldInvalid, Message: "Username may only hold letters A-Z, digits 0-9 and ._@+-"})
+	}
+}
+
+// usernameScripts are the scripts the letters of Unicode usernames may be
+// of. Letters of other scripts are refused, as are names mixing scripts,
+// but for Han written along kana or Hangul.
+var usernameScripts = []struct {
+	name  string
+	table *unicode.RangeTable
+}{
+	{"Latin", unicode.Latin},
+	{"Greek", unicode.Greek},
+	{"Cyrillic", unicode.Cyrillic},
+	{"Armenian", unicode.Armenian},
+	{"Georgian", unicode.Georgian},
+	{"Hebrew", unicode.Hebrew},
+	{"Arabic", unicode.Arabic},
+	{"Devanagari", unicode.Devanagari},
+	{"Bengali", unicode.Bengali},
+	{"Thai", unicode.Thai},
+	{"Han", unicode.Han},
+	{"Japanese", unicode.Hiragana},
+	{"Japanese", unicode.Katakana},
+	{"Korean", unicode.Hangul},
+}
+
+func validUnicodeUsername(name string) bool {
+	// script is that of the letters other than Han
+	script, han := "", false
+	prev := rune(0)
+	for _, r := range name {
+		switch {
+		case r < utf8.RuneSelf && !unicode.IsLetter(r):
+			if !legacyUsernamePattern.MatchString(string(r)) {
+				return false
+			}
+		case unicode.IsLetter(r):
+			switch s := scriptOf(r); {
+			case s == "":
+				return false
+			case s == "Han":
+				han = true
+			case script == "":
+				script = s
+			case s != script:
+				return false
+			}
+		case unicode.Is(unicode.Mn, r) || unicode.Is(unicode.Mc, r):
+			// Marks only combine with letters
+			if !unicode.IsLetter(prev) && !unicode.Is(unicode.Mn, prev) && !unicode.Is(unicode.Mc, prev) {
+				return false
+			}
+		default:
+			return false
+		}
+		prev = r
+	}
+	return !han || script == "" || script == "Japanese" || script == "Korean"
+}
+
+func scriptOf(r rune) string {
+	for _, s := range usernameScripts {
+		if unicode.Is(s.table, r) {
+			return s.name
+		}
+	}
+	return ""
+}
+
+// usernameConfusables map letters to the Latin letters they are mistaken
+// for, as the Cyrillic а for a
+var usernameConfusables = map[rune]rune{
+	// Cyrillic
+	'А': 'a', 'В': 'b', 'Е': 'e', 'К': 'k', 'М': 'm', 'Н': 'h', 'О': 'o', 'Р': 'p', 'С': 'c', 'Т': 't', 'Х': 'x', 'Ѕ': 's', 'І': 'i', 'Ј': 'j',
+	'а': 'a', 'е': 'e', 'о': 'o', 'р': 'p', 'с': 'c', 'у': 'y', 'х': 'x', 'ѕ': 's', 'і': 'i', 'ј': 'j', 'һ': 'h', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w', 'к': 'k',
+	// Greek
+	'Α': 'a', 'Β': 'b', 'Ε': 'e', 'Ζ': 'z', 'Η': 'h', 'Ι': 'i', 'Κ': 'k', 'Μ': 'm', 'Ν': 'n', 'Ο': 'o', 'Ρ': 'p', 'Τ': 't', 'Υ': 'y', 'Χ': 'x',
+	'α': 'a', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'υ': 'u', 'χ': 'x',
+	// Digits
+	'0': 'o',
+	// An upper case I passes for an l, and names are compared regardless
+	// of case, so i, l and their lookalikes are all one letter
+	'1': 'i', 'l': 'i', 'L': 'i', '|': 'i',
+}
+
+// UsernameSkeleton returns the form of name two names only told apart by
+// confusable characters share, as admin for аdmin with a Cyrillic а, or
+// Admin: accents are dropped, lookalikes replaced by the Latin letters they
+// pass for and the name lowercased
+func UsernameSkeleton(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(name) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if c, ok := usernameConfusables[r]; ok {
+			r = c
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
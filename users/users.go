@@ -1,12 +1,12 @@
 package users
 
 import (
-	"crypto/sha1"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"strconv"
-	"time"
+	"strings"
 )
 
 var (
@@ -15,16 +15,120 @@ var (
 )
 
 type User struct {
-	FirstName string    `json:"firstName" bson:"firstName"`
-	LastName  string    `json:"lastName" bson:"lastName"`
-	Email     string    `json:"-" bson:"email"`
-	Username  string    `json:"username" bson:"username"`
+	FirstName string `json:"firstName" bson:"firstName"`
+	LastName  string `json:"lastName" bson:"lastName"`
+	Email     string `json:"-" bson:"email"`
+	Username  string `json:"username" bson:"username"`
+	// DisplayName is the name the front end shows, which the user changes
+	// at will; it is neither unique nor logged in with. Responses fill it
+	// with the first and last names when none is set, which is never stored.
+	DisplayName string `json:"displayName" bson:"displayName,omitempty"`
+	// Phone is a contact number in E.164 form, empty when not given
+	Phone     string    `json:"phone" bson:"phone,omitempty"`
 	Password  string    `json:"-" bson:"password,omitempty"`
-	Addresses []Address `json:"-,omitempty" bson:"-"`
-	Cards     []Card    `json:"-,omitempty" bson:"-"`
+	Addresses []Address `json:"-" bson:"-"`
+	Cards     []Card    `json:"-" bson:"-"`
 	UserID    string    `json:"id" bson:"-"`
 	Links     Links     `json:"_links"`
-	Salt      string    `json:"-" bson:"salt"`
+	// Salt is that of a legacy hash, empty once the password is hashed
+	// with bcrypt, whose hashes embed their own
+	Salt string `json:"-" bson:"salt"`
+	// DefaultShipping and DefaultBilling are the ids of the addresses of the
+	// user the checkout prefills, empty when none is set; they are only
+	// changed through the default address endpoint
+	DefaultShipping string `json:"defaultShipping,omitempty" bson:"-"`
+	DefaultBilling  string `json:"defaultBilling,omitempty" bson:"-"`
+	// DefaultCard is the id of the card checkouts charge: the first card
+	// added until the customer picks another, and the next one left when
+	// it is deleted
+	DefaultCard string `json:"defaultCard,omitempty" bson:"-"`
+	// Roles are only changed through the role management endpoint
+	Roles []string `json:"roles,omitempty" bson:"roles,omitempty"`
+	// Status is StatusActive, or StatusDisabled once support disabled the
+	// account; it is only changed through the status endpoint
+	Status string `json:"status" bson:"status,omitempty"`
+	// Preferences are small settings of the front end, bounded by
+	// ValidatePreferences and changed through the preferences endpoint
+	Preferences map[string]string `json:"preferences,omitempty" bson:"preferences,omitempty"`
+	// Anonymized users have been erased on request and are kept only so
+	// references to their id stay valid
+	Anonymized bool `json:"anonymized,omitempty" bson:"anonymized,omitempty"`
+	// Version counts the changes to the user, its addresses and cards, for
+	// conditional requests
+	Version int64 `json:"-" bson:"-"`
+	// CredentialsVersion is bumped whenever the tokens issued to the user
+	// before must no longer be accepted, as on a password change
+	CredentialsVersion int64 `json:"-" bson:"-"`
+	// Changes are those made by the update returning the user, for the
+	// events telling of it; they are never stored
+	Changes []FieldChange `json:"-" bson:"-"`
+	// Emails are the emails of the user besides Email, and Email once it is
+	// verified; EmailList lists them all. They are only changed through the
+	// email endpoints.
+	Emails []EmailAddress `json:"-" bson:"emails,omitempty"`
+	// ConsentHistory records every consent to marketing the user granted or
+	// withdrew, oldest first; it is only appended to, through the consents
+	// endpoints and registration
+	ConsentHistory []ConsentRecord `json:"-" bson:"consentHistory,omitempty"`
+	// ConsentTallies count the consents of ConsentHistory once the user is
+	// anonymized, which drops the history itself
+	ConsentTallies []ConsentTally `json:"-" bson:"consentTallies,omitempty"`
+}
+
+// AnonymizedPlaceholder is the name anonymized users are left with
+const AnonymizedPlaceholder = "anonymized"
+
+// Anonymize overwrites the personal data of u with placeholders derived only
+// from its id and blanks its password so it can no longer log in.
+func (u *User) Anonymize() {
+	u.FirstName = AnonymizedPlaceholder
+	u.LastName = AnonymizedPlaceholder
+	u.Username = AnonymizedPlaceholder + "-" + u.UserID
+	u.DisplayName = ""
+	u.Email = ""
+	u.Phone = ""
+	u.Password = ""
+	u.Salt = ""
+	u.Addresses = make([]Address, 0)
+	u.Cards = make([]Card, 0)
+	u.Roles = nil
+	u.Preferences = nil
+	u.DefaultShipping = ""
+	u.DefaultBilling = ""
+	u.DefaultCard = ""
+	u.Emails = nil
+	u.ConsentTallies = TallyConsents(u.ConsentTallies, u.ConsentHistory)
+	u.ConsentHistory = nil
+	u.Anonymized = true
+}
+
+// FillDisplayName sets the display name of u to its first and last names
+// when it has none
+func (u *User) FillDisplayName() {
+	if u.DisplayName == "" {
+		u.DisplayName = u.DefaultDisplayName()
+	}
+}
+
+// DefaultDisplayName returns the display name of u when none is set, its
+// first and last names
+func (u User) DefaultDisplayName() string {
+	return strings.TrimSpace(u.FirstName + " " + u.LastName)
+}
+
+// DisplayNameDefaulted reports whether name is the display name shown for u
+// holding none, or for u changed to renamed: one read as filled and sent
+// back, which is not to be stored
+func (u User) DisplayNameDefaulted(name string, renamed User) bool {
+	return u.DisplayName == "" && name != "" && (name == u.DefaultDisplayName() || name == renamed.DefaultDisplayName())
+}
+
+// MarshalJSON fills the display name of u when it has none, so only
+// responses carry the default
+func (u User) MarshalJSON() ([]byte, error) {
+	type plain User
+	u.FillDisplayName()
+	return json.Marshal(plain(u))
 }
 
 func New() User {
@@ -33,35 +137,61 @@ func New() User {
 	return u
 }
 
-func (u *User) Validate() error {
-	if u.FirstName == "" {
-		return fmt.Errorf(ErrMissingField, "FirstName")
-	}
-	if u.LastName == "" {
-		return fmt.Errorf(ErrMissingField, "LastName")
-	}
-	if u.Username == "" {
-		return fmt.Errorf(ErrMissingField, "Username")
-	}
-	if u.Password == "" {
-		return fmt.Errorf(ErrMissingField, "Password")
-	}
-	return nil
+func (u *User) MaskCCs() {
+	u.MaskCCsStyle(0)
 }
 
-func (u *User) MaskCCs() {
+// MaskCCsStyle masks the numbers of the cards of u with style s, the
+// default if zero
+func (u *User) MaskCCsStyle(s MaskStyle) {
 	for k, c := range u.Cards {
-		c.MaskCC()
+		c.MaskCCStyle(s)
 		u.Cards[k] = c
 	}
 }
 
+// Clone returns a copy of u sharing no slices or maps with it, so either
+// can be changed without the other seeing it
+func (u User) Clone() User {
+	c := u
+	c.Links = u.Links.Clone()
+	c.Roles = append([]string(nil), u.Roles...)
+	c.Changes = append([]FieldChange(nil), u.Changes...)
+	c.Emails = append([]EmailAddress(nil), u.Emails...)
+	c.ConsentHistory = append([]ConsentRecord(nil), u.ConsentHistory...)
+	c.ConsentTallies = append([]ConsentTally(nil), u.ConsentTallies...)
+	if u.Preferences != nil {
+		c.Preferences = MergePreferences(u.Preferences, nil)
+	}
+	if u.Addresses != nil {
+		c.Addresses = make([]Address, len(u.Addresses))
+		for i, a := range u.Addresses {
+			c.Addresses[i] = a.Clone()
+		}
+	}
+	if u.Cards != nil {
+		c.Cards = make([]Card, len(u.Cards))
+		for i, card := range u.Cards {
+			c.Cards[i] = card.Clone()
+		}
+	}
+	return c
+}
+
 func (u *User) AddLinks() {
 	u.Links.AddCustomer(u.UserID)
 }
 
+// SaltLength is the number of random bytes of a salt
+const SaltLength = 16
+
+// NewSalt gives u a salt of SaltLength bytes from crypto/rand, hex encoded,
+// of its own. Salts are only read by LegacyHash: bcrypt hashes carry a
+// random salt of their own, drawn anew by every Hash.
 func (u *User) NewSalt() {
-	h := sha1.New()
-	io.WriteString(h, strconv.Itoa(int(time.Now().UnixNano())))
-	u.Salt = fmt.Sprintf("%x", h.Sum(nil))
+	b := make([]byte, SaltLength)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("users: reading a random salt: %v", err))
+	}
+	u.Salt = hex.EncodeToString(b)
 }
@@ -2,7 +2,9 @@ package users
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNew(t *testing.T) {
@@ -12,6 +14,13 @@ func TestNew(t *testing.T) {
 	}
 }
 
+func TestNewSalt(t *testing.T) {
+	a, b := New(), New()
+	if len(a.Salt) != 2*SaltLength || a.Salt == b.Salt {
+		t.Errorf("Expected distinct salts of %v bytes, received %v and %v", SaltLength, a.Salt, b.Salt)
+	}
+}
+
 func TestValidate(t *testing.T) {
 	u := New()
 	err := u.Validate()
@@ -35,11 +44,67 @@ func TestValidate(t *testing.T) {
 	}
 	u.Password = "test"
 	err = u.Validate()
+	if err.Error() != fmt.Sprintf(ErrMissingField, "Email") {
+		t.Error("Expected missing email error")
+	}
+	u.Email = "test@example.com"
+	err = u.Validate()
 	if err != nil {
 		t.Error(err)
 	}
 }
 
+func TestValidateFields(t *testing.T) {
+	fields := func(err error) string {
+		fe, _ := err.(FieldErrors)
+		f := make([]string, 0, len(fe))
+		for _, e := range fe {
+			f = append(f, e.Field+":"+e.Code)
+		}
+		return strings.Join(f, ",")
+	}
+	u := User{FirstName: strings.Repeat("é", MaxNameLength+1), LastName: "last", Username: "a b", Password: "x", Email: "a@b"}
+	if got := fields(u.Validate()); got != "firstName:too_long,username:invalid,email:invalid" {
+		t.Errorf("Unexpected user errors %v", got)
+	}
+	u = User{FirstName: strings.Repeat("é", MaxNameLength), LastName: "last", Username: "abc", Password: "x", Email: "a@b.example"}
+	if err := u.Validate(); err != nil {
+		t.Errorf("Expected valid user, received %v", err)
+	}
+	for name, want := range map[string]string{
+		"Zoë the Builder":                           "",
+		strings.Repeat("é", MaxDisplayNameLength):   "",
+		strings.Repeat("é", MaxDisplayNameLength+1): "displayName:too_long",
+		"tab\there":         "displayName:invalid",
+		"evil\u202egnp.exe": "displayName:invalid",
+	} {
+		u.DisplayName = name
+		if got := fields(u.Validate()); got != want {
+			t.Errorf("Display name %q: expected %q, received %q", name, want, got)
+		}
+	}
+
+	a := Address{Street: "High Street", City: "London", Country: "United Kingdom", PostCode: "SW1A 1AA"}
+	if err := a.Validate(); err != nil {
+		t.Errorf("Expected valid address, received %v", err)
+	}
+	a = Address{Country: "42", PostCode: "$gt"}
+	if got := fields(a.Validate()); got != "street:required,city:required,country:invalid,postcode:invalid" {
+		t.Errorf("Unexpected address errors %v", got)
+	}
+
+	c := Card{LongNum: "4111111111111111", Expires: "08/27", CCV: "123"}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Expected valid card, received %v", err)
+	}
+	for num, want := range map[string]string{"": "longNum:required", "4111 1111": "longNum:invalid", "411111": "longNum:invalid"} {
+		c := Card{LongNum: num}
+		if got := fields(c.Validate()); got != want {
+			t.Errorf("Card %q: expected %v, received %v", num, want, got)
+		}
+	}
+}
+
 func TestMaskCCs(t *testing.T) {
 	u := New()
 	u.Cards = append(u.Cards, Card{LongNum: "abcdefg"})
@@ -52,3 +117,184 @@ func TestMaskCCs(t *testing.T) {
 		t.Error("Card two CC not masked")
 	}
 }
+
+func TestClone(t *testing.T) {
+	u := New()
+	u.UserID = "id"
+	u.Roles = []string{"admin"}
+	u.AddLinks()
+	u.Addresses = append(u.Addresses, Address{Street: "street", Links: Links{"self": {Href: "a"}}})
+	u.Cards = append(u.Cards, Card{LongNum: "4111111111111111", Links: Links{"self": {Href: "c"}}})
+	c := u.Clone()
+	c.Roles[0] = "changed"
+	c.Links["self"] = Href{Href: "changed"}
+	c.Addresses[0].Street = "changed"
+	c.Addresses[0].Links["self"] = Href{Href: "changed"}
+	c.Cards[0].MaskCC()
+	c.Cards[0].Links["self"] = Href{Href: "changed"}
+	if u.Roles[0] != "admin" || u.Links["self"].Href == "changed" {
+		t.Errorf("Expected the roles and links of the original kept, received %v %v", u.Roles, u.Links)
+	}
+	if u.Addresses[0].Street != "street" || u.Addresses[0].Links["self"].Href != "a" {
+		t.Errorf("Expected the address of the original kept, received %+v", u.Addresses[0])
+	}
+	if u.Cards[0].LongNum != "4111111111111111" || u.Cards[0].Links["self"].Href != "c" {
+		t.Errorf("Expected the card of the original kept, received %+v", u.Cards[0])
+	}
+}
+
+func TestValidUsername(t *testing.T) {
+	defer SetUsernameCharset(UsernameASCII)
+	defer SetLegacyUsernames(false)
+	for name, want := range map[string]bool{
+		"Eve_Berger":            true,
+		"bob.smith+shop@x":      true,
+		"":                      false,
+		"ab":                    false,
+		strings.Repeat("a", 33): false,
+		"$gt":                   false,
+		`{"$ne": null}`:         false,
+		"bob smith":             false,
+		"Zoë":                   false,
+		"admin‮":                false,
+	} {
+		if got := ValidUsername(name); got != want {
+			t.Errorf("ValidUsername(%q) = %v, expected %v", name, got, want)
+		}
+	}
+
+	SetUsernameCharset(UsernameUnicode)
+	for name, want := range map[string]bool{
+		"Zoë":                     true,
+		NormalizeUsername("Zoë"): true,
+		"Дмитрий":                 true,
+		"山田太郎":                    true,
+		"やまだ_山田":                  true,
+		"аdmin":                   false,
+		"bob山田":                   false,
+		"bob😀":                    false,
+		"bob":                    false,
+		"bob‮admin":               false,
+		"bob١٢٣":                  false,
+		strings.Repeat("é", 33):   false,
+	} {
+		if got := ValidUsername(name); got != want {
+			t.Errorf("Unicode ValidUsername(%q) = %v, expected %v", name, got, want)
+		}
+	}
+
+	legacy := strings.Repeat("a", 40)
+	if ValidExistingUsername(legacy) || ValidExistingUsername("ab") {
+		t.Error("Expected legacy usernames refused")
+	}
+	SetLegacyUsernames(true)
+	if !ValidExistingUsername(legacy) || !ValidExistingUsername("ab") || ValidExistingUsername("$gt") {
+		t.Error("Expected legacy usernames, and only them, allowed to be kept")
+	}
+	u := User{FirstName: "first", LastName: "last", Username: "ab", Password: "x", Email: "ab@example.com"}
+	if u.ValidateProfile() != nil || u.Validate() == nil {
+		t.Error("Expected a legacy username kept by profile updates, but not registered")
+	}
+}
+
+func TestPlainUsername(t *testing.T) {
+	for name, want := range map[string]bool{
+		"ab":            true,
+		"bob smith":     true,
+		"Zoë":           true,
+		"":              false,
+		"$gt":           false,
+		`{"$ne": null}`: false,
+		"bob\x00":       false,
+	} {
+		if got := PlainUsername(name); got != want {
+			t.Errorf("PlainUsername(%q) = %v, expected %v", name, got, want)
+		}
+	}
+}
+
+func TestUsernameSkeleton(t *testing.T) {
+	for _, name := range []string{"admin", "Admin", "аdmin", "ADMIN", "Αdmin", "àdmin"} {
+		if got := UsernameSkeleton(name); got != "admin" {
+			t.Errorf("Expected %q to pass for admin, received %q", name, got)
+		}
+	}
+	for _, name := range []string{"Iogin", "1ogin", "|ogin", "LOGIN", "іogin"} {
+		if got, want := UsernameSkeleton(name), UsernameSkeleton("login"); got != want {
+			t.Errorf("Expected %q to pass for login, received %q rather than %q", name, got, want)
+		}
+	}
+	if UsernameSkeleton("bob") == UsernameSkeleton("rob") {
+		t.Error("Expected distinct names told apart")
+	}
+}
+
+func TestPhone(t *testing.T) {
+	for in, want := range map[string]string{
+		"+1 (415) 555-0123": "+14155550123",
+		"0044 20 7946.0958": "+442079460958",
+		"":                  "",
+	} {
+		if got := NormalizePhone(in); got != want {
+			t.Errorf("Expected %q for %q, received %q", want, in, got)
+		}
+	}
+	for p, valid := range map[string]bool{
+		"+14155550123":      true,
+		"+4915123456789":    true,
+		"+1234567":          true,
+		"+123456":           false,
+		"+1234567890123456": false,
+		"+0123456789":       false,
+		"14155550123":       false,
+		"+1415555012a":      false,
+	} {
+		if ValidPhone(p) != valid {
+			t.Errorf("Expected %q valid %v", p, valid)
+		}
+	}
+	if err := ValidatePhone(""); err != nil {
+		t.Errorf("Expected an empty phone allowed, received %v", err)
+	}
+	u := User{FirstName: "first", LastName: "last", Username: "abc", Password: "x", Email: "ab@example.com", Phone: "555-0123"}
+	if fe, ok := u.Validate().(FieldErrors); !ok || len(fe) != 1 || fe[0].Field != "phone" {
+		t.Errorf("Expected the phone refused, received %v", u.Validate())
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	defer SetFoldEmailLocal(false)
+	if got := NormalizeEmail(" Bob@Example.COM "); got != "Bob@example.com" {
+		t.Errorf("Expected the domain lowercased, received %q", got)
+	}
+	if SameEmail("Bob@example.com", "bob@example.com") || SameEmail("", "") {
+		t.Error("Expected local parts told apart by case, and empty emails never the same")
+	}
+	SetFoldEmailLocal(true)
+	if !SameEmail("Bob@Example.COM ", "bob@example.com") {
+		t.Error("Expected local parts folded")
+	}
+}
+
+func TestConsents(t *testing.T) {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	records, err := NewConsentRecords(map[string]bool{ConsentSMS: true, ConsentEmail: false}, "settings", at)
+	if err != nil || len(records) != 2 || records[0].Channel != ConsentEmail || records[1].Channel != ConsentSMS {
+		t.Fatalf("Expected a record per channel in order, received %+v %v", records, err)
+	}
+	if _, err := NewConsentRecords(map[string]bool{"fax": true}, "", at); err == nil || len(err.(FieldErrors)) != 2 {
+		t.Errorf("Expected the channel and the source refused, received %v", err)
+	}
+	history := append(records, ConsentRecord{Channel: ConsentEmail, Granted: true, At: at.Add(time.Hour), Source: "checkout"})
+	cs := CurrentConsents(history)
+	if len(cs) != len(ConsentChannels) || !cs[ConsentEmail].Granted || cs[ConsentEmail].Source != "checkout" || cs[ConsentPost].Granted {
+		t.Errorf("Expected the last record of each channel to win, received %+v", cs)
+	}
+
+	u := User{UserID: "id", ConsentHistory: history}
+	u.Anonymize()
+	want := []ConsentTally{{Channel: ConsentEmail, Grants: 1, Withdrawals: 1}, {Channel: ConsentSMS, Grants: 1}}
+	if u.ConsentHistory != nil || fmt.Sprint(u.ConsentTallies) != fmt.Sprint(want) {
+		t.Errorf("Expected the history anonymized to its tallies, received %+v %+v", u.ConsentHistory, u.ConsentTallies)
+	}
+}
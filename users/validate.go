@@ -0,0 +1,225 @@
+package users
+
+// validate.go contains the rules customers, addresses and cards must satisfy
+// before they are stored. Every endpoint accepting one checks it here, so the
+// rules live in one place.
+
+import (
+	"fmt"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Codes of the problems a FieldError reports
+const (
+	FieldRequired = "required"
+	FieldTooLong  = "too_long"
+	FieldInvalid  = "invalid"
+)
+
+// Length caps of the free text fields
+const (
+	MaxNameLength     = 100
+	MaxEmailLength    = 254
+	MaxStreetLength   = 100
+	MaxNumberLength   = 20
+	MaxCityLength     = 100
+	MaxCountryLength  = 56
+	MaxPostCodeLength = 10
+	MaxLabelLength    = 40
+)
+
+// MaxDisplayNameLength caps display names, in characters
+const MaxDisplayNameLength = 64
+
+// FieldError is a problem with one field. Field is the JSON name of the field.
+type FieldError struct {
+	Field   string
+	Code    string
+	Message string
+}
+
+// FieldErrors lists every problem found with an entity
+type FieldErrors []FieldError
+
+// Error returns the message of the first problem
+func (e FieldErrors) Error() string {
+	if len(e) == 0 {
+		return "Validation failed"
+	}
+	return e[0].Message
+}
+
+func (e *FieldErrors) required(field, name, value string) bool {
+	if value == "" {
+		*e = append(*e, FieldError{Field: field, Code: FieldRequired, Message: fmt.Sprintf(ErrMissingField, name)})
+		return false
+	}
+	return true
+}
+
+func (e *FieldErrors) maxLength(field, name, value string, max int) bool {
+	if utf8.RuneCountInString(value) > max {
+		*e = append(*e, FieldError{Field: field, Code: FieldTooLong, Message: fmt.Sprintf("%v is longer than %v characters", name, max)})
+		return false
+	}
+	return true
+}
+
+func (e *FieldErrors) match(field, name, value string, pattern *regexp.Regexp) {
+	if value != "" && !pattern.MatchString(value) {
+		*e = append(*e, FieldError{Field: field, Code: FieldInvalid, Message: fmt.Sprintf("%v is not valid", name)})
+	}
+}
+
+// displayName checks the optional display name is within
+// MaxDisplayNameLength and holds no control characters, direction overrides
+// included, which would garble the pages showing it
+func (e *FieldErrors) displayName(name string) {
+	if !e.maxLength("displayName", "DisplayName", name, MaxDisplayNameLength) {
+		return
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || unicode.Is(unicode.Bidi_Control, r) {
+			*e = append(*e, FieldError{Field: "displayName", Code: FieldInvalid, Message: "DisplayName may not hold control characters"})
+			return
+		}
+	}
+}
+
+func (e FieldErrors) err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+var (
+	emailPattern    = regexp.MustCompile(`^[^\s@]+@[^\s@]+\.[^\s@]+$`)
+	postCodePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9 -]*$`)
+	digitsPattern   = regexp.MustCompile(`^[0-9]+$`)
+	cardNumPattern  = regexp.MustCompile(`^[0-9]{12,19}$`)
+	expiresPattern  = regexp.MustCompile(`^(0[1-9]|1[0-2])/([0-9]{2}|[0-9]{4})$`)
+	ccvPattern      = regexp.MustCompile(`^[0-9]{3,4}$`)
+)
+
+// Validate returns FieldErrors listing every problem with u, or nil. Names,
+// username, password and email are required; the phone is optional but must
+// be in E.164 form when given.
+func (u *User) Validate() error {
+	return u.validate(true)
+}
+
+// ValidateProfile is Validate without the password, for the updates of a
+// profile, which never carry one. A legacy username SetLegacyUsernames lets
+// be kept passes, for the user to keep it; renames are to be checked with
+// ValidateUsername.
+func (u *User) ValidateProfile() error {
+	return u.validate(false)
+}
+
+func (u *User) validate(password bool) error {
+	var e FieldErrors
+	if e.required("firstName", "FirstName", u.FirstName) {
+		e.maxLength("firstName", "FirstName", u.FirstName, MaxNameLength)
+	}
+	if e.required("lastName", "LastName", u.LastName) {
+		e.maxLength("lastName", "LastName", u.LastName, MaxNameLength)
+	}
+	if password || !ValidExistingUsername(u.Username) {
+		e.username(u.Username)
+	}
+	if password {
+		e.required("password", "Password", u.Password)
+	}
+	if e.required("email", "Email", u.Email) && e.maxLength("email", "Email", u.Email, MaxEmailLength) {
+		e.match("email", "Email", u.Email, emailPattern)
+	}
+	e.displayName(u.DisplayName)
+	e.phone(u.Phone)
+	e.preferences(u.Preferences)
+	return e.err()
+}
+
+// ValidateWithAttributes is Validate, checking every address and card of u
+// as well. Their problems are listed under their field prefixed with their
+// place, as addresses[0].street.
+func (u *User) ValidateWithAttributes() error {
+	var e FieldErrors
+	e.nested("", u.Validate())
+	for i := range u.Addresses {
+		e.nested(fmt.Sprintf("addresses[%d].", i), u.Addresses[i].Validate())
+	}
+	for i := range u.Cards {
+		e.nested(fmt.Sprintf("cards[%d].", i), u.Cards[i].Validate())
+	}
+	return e.err()
+}
+
+// nested adds the FieldErrors of err, their fields prefixed with prefix
+func (e *FieldErrors) nested(prefix string, err error) {
+	fe, _ := err.(FieldErrors)
+	for _, f := range fe {
+		f.Field = prefix + f.Field
+		*e = append(*e, f)
+	}
+}
+
+// Validate returns FieldErrors listing every problem with a, or nil. Street,
+// city and country are required; the country must be one NormalizeCountry
+// knows and the post code of the format of PostCodeRules for it when given.
+// The type, when given, is one of ValidAddressType.
+func (a *Address) Validate() error {
+	var e FieldErrors
+	if e.required("street", "Street", a.Street) {
+		e.maxLength("street", "Street", a.Street, MaxStreetLength)
+	}
+	e.maxLength("number", "Number", a.Number, MaxNumberLength)
+	if e.required("city", "City", a.City) {
+		e.maxLength("city", "City", a.City, MaxCityLength)
+	}
+	if e.required("country", "Country", a.Country) && e.maxLength("country", "Country", a.Country, MaxCountryLength) {
+		if _, ok := NormalizeCountry(a.Country); !ok {
+			e = append(e, FieldError{Field: "country", Code: FieldInvalid, Message: "Country must be an ISO 3166-1 alpha-2 code, as GB, or a common name, as United Kingdom"})
+		}
+	}
+	if e.maxLength("postcode", "PostCode", a.PostCode, MaxPostCodeLength) {
+		e.postCode(a.Country, a.PostCode)
+	}
+	if a.Type != "" && !ValidAddressType(a.Type) {
+		e = append(e, FieldError{Field: "type", Code: FieldInvalid, Message: "Type must be shipping, billing or other"})
+	}
+	return e.err()
+}
+
+// Validate returns FieldErrors listing every problem with c, or nil. The
+// card number is required, holds 12 to 19 digits only, normalized first,
+// and passes the Luhn checksum unless SetLuhnCheck turned it off; expiry
+// and CCV must be MM/YY and three or four digits when given. The label is
+// optional.
+func (c *Card) Validate() error {
+	var e FieldErrors
+	if e.required("longNum", "LongNum", c.LongNum) {
+		switch {
+		case !digitsPattern.MatchString(c.LongNum):
+			e = append(e, FieldError{Field: "longNum", Code: FieldInvalid, Message: "LongNum may only hold digits"})
+		case !cardNumPattern.MatchString(c.LongNum):
+			e.match("longNum", "LongNum", c.LongNum, cardNumPattern)
+		case luhnCheck.Load() && !Luhn(c.LongNum):
+			e = append(e, FieldError{Field: "longNum", Code: FieldInvalid, Message: "LongNum is not a valid card number"})
+		}
+	}
+	e.match("expires", "Expires", c.Expires, expiresPattern)
+	e.match("ccv", "CCV", c.CCV, ccvPattern)
+	e.maxLength("label", "Label", c.Label, MaxLabelLength)
+	return e.err()
+}
+
+// ValidateCardLabel returns FieldErrors when label is longer than
+// MaxLabelLength, for the label changes checking that field alone
+func ValidateCardLabel(label string) error {
+	var e FieldErrors
+	e.maxLength("label", "Label", label, MaxLabelLength)
+	return e.err()
+}